@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/version"
+)
+
+// actionStepTimeout bounds each command a quick action runs, so every
+// action answers within the server's call timeout.
+const actionStepTimeout = 10 * time.Second
+
+// maxStepOutput bounds the output kept from each step.
+const maxStepOutput = 4 << 10
+
+// errActionUnsupported is returned for actions the platform lacks.
+var errActionUnsupported = errors.New("not available on " + runtime.GOOS)
+
+// handleActionRequest runs a quick action off the message loop and
+// reports the result.
+func (a *Agent) handleActionRequest(payload json.RawMessage) {
+	var req protocol.ActionRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	go func() {
+		res := protocol.ActionResult{ID: req.ID, Action: req.Action}
+		var err error
+		switch req.Action {
+		case protocol.ActionFlushDNS:
+			res.Steps, err = flushDNS()
+		case protocol.ActionClearSpooler:
+			res.Steps, err = clearPrintSpooler()
+		case protocol.ActionRestartShell:
+			res.Steps, err = restartShell()
+		case protocol.ActionSupportBundle:
+			res.Bundle = collectSupportBundle()
+		default:
+			err = fmt.Errorf("unknown action %q", req.Action)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		log.Printf("Quick action %s: err=%v", req.Action, err)
+		data, _ := json.Marshal(res)
+		_ = a.sendMessage(protocol.Message{Type: "action_result", Payload: data})
+	}()
+}
+
+// runSteps runs each command in turn, recording its output, and stops at
+// the first failure unless keepGoing is set, in which case it fails only
+// if every command failed.
+func runSteps(keepGoing bool, cmds ...[]string) ([]protocol.ActionStep, error) {
+	var steps []protocol.ActionStep
+	var lastErr error
+	ok := false
+	for _, args := range cmds {
+		ctx, cancel := context.WithTimeout(context.Background(), actionStepTimeout)
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		cancel()
+		step := protocol.ActionStep{Command: strings.Join(args, " "), Output: strings.TrimSpace(string(out))}
+		if len(step.Output) > maxStepOutput {
+			step.Output = step.Output[:maxStepOutput]
+		}
+		if err != nil {
+			step.Error = err.Error()
+			lastErr = fmt.Errorf("%s: %w", args[0], err)
+		} else {
+			ok = true
+		}
+		steps = append(steps, step)
+		if err != nil && !keepGoing {
+			return steps, lastErr
+		}
+	}
+	if !ok {
+		return steps, lastErr
+	}
+	return steps, nil
+}
+
+// flushDNS clears the resolver cache.
+func flushDNS() ([]protocol.ActionStep, error) {
+	switch runtime.GOOS {
+	case "windows":
+		return runSteps(false, []string{"ipconfig", "/flushdns"})
+	case "darwin":
+		return runSteps(false, []string{"dscacheutil", "-flushcache"}, []string{"killall", "-HUP", "mDNSResponder"})
+	case "linux":
+		// Whichever caching resolver is installed.
+		var cmds [][]string
+		if _, err := exec.LookPath("resolvectl"); err == nil {
+			cmds = append(cmds, []string{"resolvectl", "flush-caches"})
+		}
+		if _, err := exec.LookPath("nscd"); err == nil {
+			cmds = append(cmds, []string{"nscd", "--invalidate=hosts"})
+		}
+		if len(cmds) == 0 {
+			return nil, errors.New("no DNS cache found (systemd-resolved or nscd)")
+		}
+		return runSteps(true, cmds...)
+	}
+	return nil, errActionUnsupported
+}
+
+// clearPrintSpooler cancels every queued print job. On Windows the
+// spooler is stopped while its queue files are removed.
+func clearPrintSpooler() ([]protocol.ActionStep, error) {
+	if runtime.GOOS != "windows" {
+		return runSteps(false, []string{"cancel", "-a", "-x"})
+	}
+	steps, err := runSteps(false, []string{"net", "stop", "spooler"})
+	if err != nil {
+		return steps, err
+	}
+	dir := filepath.Join(os.Getenv("SystemRoot"), "System32", "spool", "PRINTERS")
+	entries, _ := os.ReadDir(dir)
+	removed := 0
+	for _, e := range entries {
+		if os.RemoveAll(filepath.Join(dir, e.Name())) == nil {
+			removed++
+		}
+	}
+	steps = append(steps, protocol.ActionStep{
+		Command: "remove " + dir + `\*`,
+		Output:  fmt.Sprintf("%d queue files removed", removed),
+	})
+	more, err := runSteps(false, []string{"net", "start", "spooler"})
+	return append(steps, more...), err
+}
+
+// restartShell restarts the desktop shell of the agent's session.
+func restartShell() ([]protocol.ActionStep, error) {
+	switch runtime.GOOS {
+	case "windows":
+		steps, err := runSteps(false, []string{"taskkill", "/f", "/im", "explorer.exe"})
+		if err != nil {
+			return steps, err
+		}
+		start := protocol.ActionStep{Command: "explorer.exe"}
+		if err := exec.Command("explorer.exe").Start(); err != nil {
+			start.Error = err.Error()
+			return append(steps, start), err
+		}
+		return append(steps, start), nil
+	case "darwin":
+		// launchd starts Finder again.
+		return runSteps(false, []string{"killall", "Finder"})
+	}
+	return nil, errActionUnsupported
+}
+
+// collectSupportBundle snapshots the machine for triage. It takes about a
+// second, to measure CPU use.
+func collectSupportBundle() *protocol.SupportBundle {
+	var info SystemInfo
+	collectPlatformInfo(&info)
+	b := &protocol.SupportBundle{
+		CollectedAt:   time.Now(),
+		Hostname:      getHostname(),
+		OS:            runtime.GOOS,
+		OSVersion:     info.OSVersion,
+		Arch:          runtime.GOARCH,
+		AgentVersion:  version.Version,
+		Username:      localUsername(),
+		UptimeSeconds: info.UptimeSeconds,
+		CPUCount:      runtime.NumCPU(),
+		MemoryTotal:   info.MemoryTotal,
+		MemoryFree:    info.MemoryFree,
+		DiskTotal:     info.DiskTotal,
+		DiskFree:      info.DiskFree,
+		Interfaces:    collectInterfaces(),
+		DNSServers:    collectDNSServers(),
+	}
+	var procs processSampler
+	procs.top()
+	time.Sleep(time.Second)
+	b.TopCPU, b.TopMemory = procs.top()
+	return b
+}
+
+// collectInterfaces lists the network interfaces other than loopback.
+func collectInterfaces() []protocol.NetInterface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var out []protocol.NetInterface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ni := protocol.NetInterface{
+			Name: iface.Name,
+			MAC:  iface.HardwareAddr.String(),
+			Up:   iface.Flags&net.FlagUp != 0,
+		}
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				ni.Addrs = append(ni.Addrs, addr.String())
+			}
+		}
+		out = append(out, ni)
+	}
+	return out
+}
+
+// collectDNSServers returns the configured name servers.
+func collectDNSServers() []string {
+	var servers []string
+	if runtime.GOOS == "windows" {
+		out, err := exec.Command("powershell", "-NoProfile", "-Command",
+			"Get-DnsClientServerAddress | Select-Object -ExpandProperty ServerAddresses | Sort-Object -Unique").Output()
+		if err != nil {
+			return nil
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				servers = append(servers, line)
+			}
+		}
+		return servers
+	}
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer f.Close() //nolint:errcheck
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		if fields := strings.Fields(lines.Text()); len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
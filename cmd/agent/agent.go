@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
@@ -9,8 +10,10 @@ import (
 	"log"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/avaropoint/rmm/internal/protocol"
@@ -19,66 +22,156 @@ import (
 // heartbeatInterval is the keep-alive period for the server connection.
 const heartbeatInterval = 30 * time.Second
 
+const (
+	// dialTimeout bounds connecting to the server, across all of its
+	// addresses.
+	dialTimeout = 30 * time.Second
+	// dialFallbackDelay is how long a connection attempt on the preferred
+	// address family (usually IPv6) gets before one on the other family
+	// races it (Happy Eyeballs, RFC 6555), so a broken IPv6 or IPv4 path
+	// on a dual-stack network delays the agent by a moment rather than a
+	// full TCP timeout. On IPv6-only networks only IPv6 addresses resolve.
+	dialFallbackDelay = 300 * time.Millisecond
+)
+
 // Agent handles the connection to the server and manages
 // screen capture and input injection.
 type Agent struct {
-	serverURL      string
+	serverURL      string   // last server connected to
+	discovery      string   // domain the servers are discovered through, if any
+	servers        []string // servers in order of preference, from the server; guarded by serversMu
+	serversMu      sync.Mutex
+	preferred      []string // servers preferred over the current one
+	demoted        map[string]time.Time
+	reconnectAfter time.Duration // from the server's closing notice; zero for reconnectDelay
 	name           string
+	agentID        string
 	credential     string
 	tlsConfig      *tls.Config
 	conn           net.Conn
 	reader         *bufio.Reader
-	capturing      bool
+	capture        *captureRun // while streaming, guarded by captureMu
 	captureMu      sync.Mutex
-	stopCapture    chan struct{}
 	currentDisplay int
+	viewMode       string           // protocol.View*, guarded by captureMu; empty means ViewSingle
+	screenCredit   *protocol.Credit // paces screen frames; nil without flow control, guarded by captureMu
+	frames         frameSettings    // how live frames are encoded
+	flowControl    bool             // the server paces the file channel and grants screen credit
+	input          inputQueue       // events waiting for injection
+	keyboard       keyboardMode     // negotiated per viewer session
+	keyboardMu     sync.Mutex
+	transferMu     sync.Mutex
+	transfer       *fileTransfer    // upload in progress
+	uploadCredit   *protocol.Credit // paces uploads to the server; nil without flow control
+	diagnosing     atomic.Bool      // a diagnostics archive is being collected
+	counting       atomic.Bool      // a reboot countdown is showing
+	softwareMu     sync.Mutex       // one package manager run at a time
+	staged         stagedPackages   // installers received for software requests
+	topProcesses   bool             // include a process summary in heartbeats
+	connected      atomic.Bool      // registered with the server
+	outbox         *outbox          // nil when disabled with -outbox-size=0
+	reboot         rebootCheck
+	timeSync       timeSyncCheck
+	bootTime       atomic.Int64   // Unix seconds, from the uptime reported at registration
+	tray           *trayIndicator // nil when disabled with -tray=false
+	commands       commandVerifier
+	capabilities   *capabilityPolicy
+	gateways       gatewaySet
+	plugins        *pluginRunner // nil when disabled with -plugins=""
 }
 
 // run establishes a connection to the server, registers, and enters
 // the main message loop. It returns on disconnect.
 func (a *Agent) run() error {
 	var err error
-	a.conn, a.reader, err = dialWebSocket(a.serverURL, a.tlsConfig)
+	a.conn, a.reader, err = a.dial()
 	if err != nil {
 		return err
 	}
 	defer a.conn.Close() //nolint:errcheck
+	defer a.abortTransfer()
+	defer a.input.releaseAll()
+	defer a.gateways.closeAll()
 
 	log.Println("Connected to server")
 
+	confirmed := false
+	defer func() {
+		if !confirmed {
+			a.demote(a.serverURL)
+		}
+	}()
 	if err := a.register(); err != nil {
 		return fmt.Errorf("registration failed: %w", err)
 	}
 
-	opcode, data, err := protocol.ReadFrame(a.reader)
+	resp, err := a.readControl()
 	if err != nil {
 		return fmt.Errorf("failed to read registration response: %w", err)
 	}
-	if opcode != protocol.OpText {
-		return fmt.Errorf("unexpected response opcode: %d", opcode)
+	if resp.Type == "challenge" {
+		if err := a.answerChallenge(resp.Payload); err != nil {
+			return fmt.Errorf("attestation challenge failed: %w", err)
+		}
+		if resp, err = a.readControl(); err != nil {
+			return fmt.Errorf("failed to read registration response: %w", err)
+		}
 	}
-
-	var resp protocol.Message
-	if err := json.Unmarshal(data, &resp); err != nil || resp.Type != "registered" {
+	if resp.Type == "registration_refused" {
+		var refused protocol.RegistrationRefused
+		_ = json.Unmarshal(resp.Payload, &refused)
+		return &retryLater{
+			reason: "registration refused: " + refused.Error,
+			after:  time.Duration(refused.RetryAfterMS) * time.Millisecond,
+		}
+	}
+	if resp.Type != "registered" {
 		return fmt.Errorf("registration not confirmed")
 	}
 	log.Println("Registration confirmed")
+	confirmed = true
+	a.rememberServer()
+	a.tray.setConnected(true)
+	defer a.tray.setConnected(false)
+
+	var registered protocol.Registered
+	_ = json.Unmarshal(resp.Payload, &registered)
+	a.flowControl = registered.FlowControl
+	a.lockCapabilities(registered.DisabledCapabilities)
+	if setBranding(registered.Branding) {
+		a.tray.refresh()
+	}
+	if len(registered.Servers) > 0 {
+		a.setServers(registered.Servers)
+	}
+	if err := a.commands.setKey(registered.PlatformKey); err != nil {
+		log.Printf("High-impact commands will be refused: %v", err)
+	}
+	a.captureMu.Lock()
+	if a.flowControl {
+		a.screenCredit = protocol.NewCredit()
+		defer a.screenCredit.Close()
+	} else {
+		a.screenCredit = nil
+	}
+	a.captureMu.Unlock()
+	a.uploadCredit = nil
+	if a.flowControl {
+		a.uploadCredit = protocol.NewCredit()
+		defer a.uploadCredit.Close()
+	}
 
-	// Heartbeat goroutine (stopped on disconnect via done channel).
+	// Display watchers (stopped on disconnect via done channel).
 	done := make(chan struct{})
 	defer close(done)
-	go func() {
-		ticker := time.NewTicker(heartbeatInterval)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-done:
-				return
-			case <-ticker.C:
-				_ = a.sendMessage(protocol.Message{Type: "heartbeat"})
-			}
-		}
-	}()
+	go a.watchDisplays(done)
+	if len(a.preferred) > 0 {
+		go a.watchFailback(done, a.conn, a.preferred)
+	}
+	a.connected.Store(true)
+	defer a.connected.Store(false)
+	go a.replayOutbox()
+	go a.reportPluginState()
 
 	// Message loop.
 	for {
@@ -92,6 +185,25 @@ func (a *Agent) run() error {
 			return nil
 		case protocol.OpPing:
 			_ = protocol.WriteClientFrame(a.conn, protocol.OpPong, data)
+		case protocol.OpBinary:
+			if len(data) == 0 {
+				continue
+			}
+			switch data[0] {
+			case protocol.BinFile:
+				a.handleFileChunk(data)
+				if a.flowControl {
+					_ = a.sendBinary(protocol.CreditGrant(protocol.BinFile, len(data)))
+				}
+			case protocol.BinGateway:
+				a.handleGatewayData(data)
+			case protocol.BinControl:
+				if stream, n, err := protocol.ParseGatewayCreditGrant(data); err == nil {
+					a.handleGatewayCredit(stream, n)
+				} else {
+					a.handleCredit(data)
+				}
+			}
 		case protocol.OpText:
 			var msg protocol.Message
 			if err := json.Unmarshal(data, &msg); err != nil {
@@ -101,21 +213,119 @@ func (a *Agent) run() error {
 
 			log.Printf("Agent received message type: %s", msg.Type)
 
+			if class, resultType, ok := protocol.CommandCapability(msg.Type); ok && !a.capabilities.allows(class) {
+				log.Printf("Refused %s: %s capability is disabled", msg.Type, class)
+				if resultType != "" {
+					a.refuseCommand(resultType, msg.Payload, fmt.Errorf("%s capability is disabled on this agent", class))
+				}
+				continue
+			}
+			if resultType, signed := protocol.RequiresSignature(msg.Type); signed {
+				if err := a.commands.verify(msg, a.agentID); err != nil {
+					log.Printf("Refused %s: %v", msg.Type, err)
+					a.refuseCommand(resultType, msg.Payload, err)
+					continue
+				}
+			}
+
 			switch msg.Type {
 			case "start_capture":
-				a.startCapture()
+				a.startCapture(msg.Payload)
 			case "stop_capture":
-				a.stopCaptureLoop()
+				a.stopCaptureLoop(msg.Payload)
+			case "session_diagnostics_request":
+				a.handleSessionDiagnosticsRequest(msg.Payload)
 			case "input":
 				log.Printf("Processing input message")
 				a.handleInput(msg.Payload)
 			case "switch_display":
 				a.handleSwitchDisplay(msg.Payload)
+			case "set_view":
+				a.handleSetView(msg.Payload)
+			case "set_resolution":
+				a.handleSetResolution(msg.Payload)
+			case "session_setup":
+				a.handleSessionSetup(msg.Payload)
+			case "consent_request":
+				a.handleConsentRequest(msg.Payload)
+			case "registry_request":
+				a.handleRegistryRequest(msg.Payload)
+			case "startup_request":
+				a.handleStartupRequest(msg.Payload)
+			case "screenshot_request":
+				a.handleScreenshotRequest(msg.Payload)
+			case "power_request":
+				a.handlePowerRequest(msg.Payload)
+			case "reboot_notice":
+				a.handleRebootNotice(msg.Payload)
+			case "permissions_request":
+				a.handlePermissionsRequest(msg.Payload)
+			case "ssh_keys_request":
+				a.handleSSHKeysRequest(msg.Payload)
+			case "action_request":
+				a.handleActionRequest(msg.Payload)
+			case "plugin_request":
+				a.handlePluginRequest(msg.Payload)
+			case "hostconfig_request":
+				a.handleHostConfigRequest(msg.Payload)
+			case "software_request":
+				a.handleSoftwareRequest(msg.Payload)
+			case "collect_diagnostics":
+				a.handleCollectDiagnostics(msg.Payload)
+			case "gateway_open":
+				a.handleGatewayOpen(msg.Payload)
+			case "gateway_close":
+				a.handleGatewayClose(msg.Payload)
+			case "branding":
+				a.handleBranding(msg.Payload)
+			case "server_closing":
+				a.handleServerClosing(msg.Payload)
+			case protocol.FSList, protocol.FSStat, protocol.FSMkdir, protocol.FSDelete, protocol.FSRename:
+				a.handleFSRequest(msg.Type, msg.Payload)
+			case "file_start":
+				a.handleFileStart(msg.Payload)
+			case "file_end":
+				a.handleFileEnd(msg.Payload)
 			}
 		}
 	}
 }
 
+// readControl reads one text frame and decodes it as a protocol message.
+func (a *Agent) readControl() (protocol.Message, error) {
+	var msg protocol.Message
+	opcode, data, err := protocol.ReadFrame(a.reader)
+	if err != nil {
+		return msg, err
+	}
+	if opcode != protocol.OpText {
+		return msg, fmt.Errorf("unexpected response opcode: %d", opcode)
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+// answerChallenge signs the server's registration nonce with the
+// TPM-resident key registered at enrollment.
+func (a *Agent) answerChallenge(payload json.RawMessage) error {
+	var ch protocol.Challenge
+	if err := json.Unmarshal(payload, &ch); err != nil {
+		return err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(ch.Nonce)
+	if err != nil {
+		return err
+	}
+	sig, err := attestSign(protocol.AttestationChallengeDigest(nonce, a.agentID))
+	if err != nil {
+		return err
+	}
+	resp, _ := json.Marshal(protocol.ChallengeResponse{Signature: sig})
+	return a.sendMessage(protocol.Message{Type: "challenge_response", Payload: resp})
+}
+
 // sendMessage marshals and sends a protocol message over the WebSocket.
 func (a *Agent) sendMessage(msg protocol.Message) error {
 	data, err := json.Marshal(msg)
@@ -131,14 +341,43 @@ func (a *Agent) sendBinary(data []byte) error {
 	return protocol.WriteClientFrame(a.conn, protocol.OpBinary, data)
 }
 
+// handleCredit applies a credit grant from the server.
+func (a *Agent) handleCredit(frame []byte) {
+	ch, n, err := protocol.ParseCreditGrant(frame)
+	if err != nil {
+		return
+	}
+	if ch == protocol.BinFile {
+		if a.uploadCredit != nil {
+			a.uploadCredit.Grant(n)
+		}
+		return
+	}
+	if ch != protocol.BinScreen {
+		return
+	}
+	a.captureMu.Lock()
+	credit := a.screenCredit
+	a.captureMu.Unlock()
+	if credit != nil {
+		credit.Grant(n)
+	}
+}
+
 // register collects system information and sends it to the server.
 func (a *Agent) register() error {
 	info := CollectSystemInfo(a.name)
 	a.name = info.Name
 	a.currentDisplay = 1
+	setDisplays(info.Displays)
+	if info.UptimeSeconds > 0 {
+		a.bootTime.Store(time.Now().Unix() - info.UptimeSeconds)
+	}
 
 	// Include enrollment credential in registration payload.
 	info.Credential = a.credential
+	info.FlowControl = true
+	info.DisabledCapabilities = a.capabilities.list()
 
 	return a.sendMessage(protocol.Message{
 		Type:    "register",
@@ -146,6 +385,32 @@ func (a *Agent) register() error {
 	})
 }
 
+// serverDialer returns the dialer every connection to the server uses.
+func serverDialer() *net.Dialer {
+	return &net.Dialer{Timeout: dialTimeout, FallbackDelay: dialFallbackDelay}
+}
+
+// dialTarget returns the address to dial for a ws:// or wss:// URL, and
+// the Host header and TLS server name to present. u.Hostname and u.Port
+// take IPv6 literals out of their brackets, so "[2001:db8::1]" gets its
+// default port like any other host. A zone ("[fe80::1%25eth0]") is
+// needed to dial but means nothing to the server or in certificates, so
+// the Host header and server name leave it out.
+func dialTarget(u *url.URL) (addr, host, serverName string) {
+	hostname, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	addr = net.JoinHostPort(hostname, port)
+	if i := strings.IndexByte(hostname, '%'); i >= 0 {
+		hostname = hostname[:i]
+	}
+	return addr, net.JoinHostPort(hostname, port), hostname
+}
+
 // dialWebSocket connects to the server using a raw TCP (or TLS) connection
 // and performs the WebSocket handshake.
 func dialWebSocket(serverURL string, tlsConfig *tls.Config) (net.Conn, *bufio.Reader, error) {
@@ -154,7 +419,6 @@ func dialWebSocket(serverURL string, tlsConfig *tls.Config) (net.Conn, *bufio.Re
 		return nil, nil, err
 	}
 
-	host := u.Host
 	path := u.Path
 	if path == "" {
 		path = "/ws/agent"
@@ -162,26 +426,28 @@ func dialWebSocket(serverURL string, tlsConfig *tls.Config) (net.Conn, *bufio.Re
 		path = path + "/ws/agent"
 	}
 
-	// Ensure host has a port.
-	if !strings.Contains(host, ":") {
-		if u.Scheme == "wss" {
-			host += ":443"
-		} else {
-			host += ":80"
-		}
-	}
+	addr, host, serverName := dialTarget(u)
 
+	dialer := serverDialer()
 	var conn net.Conn
 	if u.Scheme == "wss" && tlsConfig != nil {
-		conn, err = tls.Dial("tcp", host, tlsConfig)
+		cfg := tlsConfig
+		if cfg.ServerName == "" {
+			cfg = tlsConfig.Clone()
+			cfg.ServerName = serverName
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, cfg)
 	} else {
-		conn, err = net.Dial("tcp", host)
+		conn, err = dialer.Dial("tcp", addr)
 	}
 	if err != nil {
 		return nil, nil, err
 	}
 
-	key := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d", time.Now().UnixNano())))
+	// RFC 6455 section 4.1: 16 random bytes, base64 encoded.
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
 
 	request := fmt.Sprintf("GET %s HTTP/1.1\r\n"+
 		"Host: %s\r\n"+
@@ -203,12 +469,9 @@ func dialWebSocket(serverURL string, tlsConfig *tls.Config) (net.Conn, *bufio.Re
 		return nil, nil, err
 	}
 
-	if len(statusLine) < 12 || statusLine[9:12] != "101" {
-		_ = conn.Close()
-		return nil, nil, fmt.Errorf("websocket handshake failed: %s", statusLine)
-	}
-
-	// Skip response headers.
+	// Read the response headers. A full server's 503 says when to try
+	// again.
+	var retryAfter string
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
@@ -218,6 +481,18 @@ func dialWebSocket(serverURL string, tlsConfig *tls.Config) (net.Conn, *bufio.Re
 		if line == "\r\n" {
 			break
 		}
+		if k, v, ok := strings.Cut(line, ":"); ok && strings.EqualFold(k, "Retry-After") {
+			retryAfter = strings.TrimSpace(v)
+		}
+	}
+
+	if len(statusLine) < 12 || statusLine[9:12] != "101" {
+		_ = conn.Close()
+		err := fmt.Errorf("websocket handshake failed: %s", strings.TrimSpace(statusLine))
+		if secs, perr := strconv.Atoi(retryAfter); perr == nil && secs > 0 {
+			return nil, nil, &retryLater{reason: err.Error(), after: time.Duration(secs) * time.Second}
+		}
+		return nil, nil, err
 	}
 
 	return conn, reader, nil
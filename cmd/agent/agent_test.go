@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestDialTarget(t *testing.T) {
+	tests := []struct {
+		url, addr, host, serverName string
+	}{
+		{"ws://[2001:db8::1]", "[2001:db8::1]:80", "[2001:db8::1]:80", "2001:db8::1"},
+		{"wss://[2001:db8::1]", "[2001:db8::1]:443", "[2001:db8::1]:443", "2001:db8::1"},
+		{"wss://[fe80::1%25eth0]:8443", "[fe80::1%eth0]:8443", "[fe80::1]:8443", "fe80::1"},
+		{"wss://rmm.example.com:8443", "rmm.example.com:8443", "rmm.example.com:8443", "rmm.example.com"},
+		{"ws://192.0.2.10:8080/rmm", "192.0.2.10:8080", "192.0.2.10:8080", "192.0.2.10"},
+		{"wss://rmm.example.com", "rmm.example.com:443", "rmm.example.com:443", "rmm.example.com"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.url, err)
+		}
+		addr, host, serverName := dialTarget(u)
+		if addr != tt.addr || host != tt.host || serverName != tt.serverName {
+			t.Errorf("%s: got (%q, %q, %q), want (%q, %q, %q)",
+				tt.url, addr, host, serverName, tt.addr, tt.host, tt.serverName)
+		}
+	}
+}
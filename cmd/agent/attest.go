@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"log"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// errNoTPM is returned when the platform has no usable TPM 2.0.
+var errNoTPM = errors.New("no TPM available")
+
+// openAttestationKey opens the TPM and derives the agent's signing key.
+// The caller must close both with closeAttestationKey.
+func openAttestationKey() (*tpmKey, error) {
+	t, err := openTPM()
+	if err != nil {
+		return nil, err
+	}
+	key, err := tpmCreatePrimary(t)
+	if err != nil {
+		_ = t.Close()
+		return nil, err
+	}
+	return key, nil
+}
+
+func closeAttestationKey(k *tpmKey) {
+	_ = k.close()
+	_ = k.tpm.Close()
+}
+
+// attestSign signs digest with the TPM-resident key and returns it base64
+// encoded.
+func attestSign(digest []byte) (string, error) {
+	key, err := openAttestationKey()
+	if err != nil {
+		return "", err
+	}
+	defer closeAttestationKey(key)
+
+	sig, err := key.sign(digest)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// enrollAttestation builds the key binding sent with an enrollment
+// request, or returns nil when no TPM is usable.
+func enrollAttestation(code string) *protocol.Attestation {
+	key, err := openAttestationKey()
+	if err != nil {
+		log.Printf("TPM key binding unavailable: %v", err)
+		return nil
+	}
+	defer closeAttestationKey(key)
+
+	der, err := x509.MarshalPKIXPublicKey(key.pub)
+	if err != nil {
+		log.Printf("TPM key binding unavailable: %v", err)
+		return nil
+	}
+	sig, err := key.sign(protocol.AttestationEnrollDigest(code))
+	if err != nil {
+		log.Printf("TPM key binding unavailable: %v", err)
+		return nil
+	}
+
+	log.Println("Binding enrollment to a TPM key")
+	return &protocol.Attestation{
+		Type:      protocol.AttestationTPM2,
+		PublicKey: base64.StdEncoding.EncodeToString(der),
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// maxProductName bounds the product name shown in dialogs and the tray.
+const maxProductName = 64
+
+// brand is the product name of the agent's organization, sent by the
+// server at registration and whenever it changes; empty for the default
+// look.
+var brand struct {
+	mu   sync.Mutex
+	name string
+}
+
+// productName returns the branded product name, or "" when unbranded.
+func productName() string {
+	brand.mu.Lock()
+	defer brand.mu.Unlock()
+	return brand.name
+}
+
+// setBranding applies the branding the server sent and reports whether
+// the product name changed. The name is cleaned of anything that could
+// break out of a quoted AppleScript string, since titles are embedded in
+// dialog scripts on macOS. Windows dialogs never embed it: PowerShell
+// reads titles from the environment (see windowsPopup), as its quoting
+// rules also treat the Unicode single quotes as delimiters.
+func setBranding(b *protocol.Branding) bool {
+	name := ""
+	if b != nil {
+		name = strings.Map(func(r rune) rune {
+			if r == '"' || r == '\'' || r == '\\' || r < 0x20 {
+				return -1
+			}
+			return r
+		}, b.ProductName)
+		name = strings.TrimSpace(name)
+		if len(name) > maxProductName {
+			name = strings.ToValidUTF8(name[:maxProductName], "")
+		}
+	}
+	brand.mu.Lock()
+	defer brand.mu.Unlock()
+	changed := brand.name != name
+	brand.name = name
+	return changed
+}
+
+// dialogTitle prefixes a dialog title with the product name, if any.
+func dialogTitle(title string) string {
+	if name := productName(); name != "" {
+		return name + " — " + title
+	}
+	return title
+}
+
+// handleBranding applies a branding change pushed by the server.
+func (a *Agent) handleBranding(payload json.RawMessage) {
+	var b protocol.Branding
+	if err := json.Unmarshal(payload, &b); err != nil {
+		return
+	}
+	if setBranding(&b) {
+		a.tray.refresh()
+	}
+}
@@ -3,84 +3,250 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
 	"image"
+	"image/draw"
 	"image/jpeg"
 	"log"
-	"os"
-	"os/exec"
-	"runtime"
-	"sync"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/watermark"
 )
 
 const (
 	// captureInterval controls the target frame rate for screen capture.
-	captureInterval = 100 * time.Millisecond // ~10 FPS
+	captureInterval = 50 * time.Millisecond // ~20 FPS
 
-	// jpegQuality sets the JPEG compression level for screen captures.
-	jpegQuality = 70
+	// defaultJPEGQuality is the JPEG quality of live frames and
+	// screenshots without -jpeg-quality.
+	defaultJPEGQuality = 70
 
 	// testPatternWidth and testPatternHeight define the fallback test image size.
 	testPatternWidth  = 800
 	testPatternHeight = 600
 )
 
-// Cached display count (computed once on first call).
-var (
-	cachedDisplayCount int
-	displayCountOnce   sync.Once
-)
+// captureRun is one start_capture to stop_capture cycle. Capture and
+// sending run in separate goroutines joined by a one-capture buffer: while
+// a write is still in progress, each new capture replaces the unsent one,
+// so a stalled socket costs frames instead of queueing stale ones ahead
+// of input and heartbeats. A capture is one frame, or one per display in
+// ViewSeparate mode.
+type captureRun struct {
+	stop     chan struct{}
+	latest   chan capture // the newest capture not yet sent
+	sent     atomic.Int64
+	dropped  atomic.Int64
+	noCredit atomic.Int64 // of dropped, for want of screen credit
+	input    bool         // the session may inject input (see protocol.PermInput)
+	operator string       // who is viewing, for the watermark
+	stamped  bool         // watermark every frame (see stamp)
+	timings  frameTimings // see sessiondiag.go
+
+	fullRes  atomic.Bool                   // the viewer asked for unscaled frames
+	geometry atomic.Pointer[frameGeometry] // of the latest single-display frame
+
+	// Lossless regions (see tiles.go).
+	recorded bool        // the server records the session: whole frames only
+	tiles    atomic.Bool // the viewer draws tile frames
+	resync   atomic.Bool // a frame was dropped: send a whole one next
+	tiler    tiler       // only the capture goroutine uses it
+}
+
+// startCapture begins the screen-capture loop in a background goroutine
+// and shows the session indicator.
+func (a *Agent) startCapture(payload json.RawMessage) {
+	var start protocol.CaptureStart
+	_ = json.Unmarshal(payload, &start)
 
-// startCapture begins the screen-capture loop in a background goroutine.
-func (a *Agent) startCapture() {
 	a.captureMu.Lock()
-	if a.capturing {
+	if a.capture != nil {
 		a.captureMu.Unlock()
 		return
 	}
-	a.capturing = true
-	a.stopCapture = make(chan struct{})
+	run := &captureRun{
+		stop:     make(chan struct{}),
+		latest:   make(chan capture, 1),
+		input:    len(start.Permissions) == 0 || slices.Contains(start.Permissions, protocol.PermInput),
+		operator: start.Operator,
+		stamped:  start.Watermark,
+		recorded: start.Recording,
+	}
+	a.capture = run
+	a.viewMode = protocol.ViewSingle // each session starts on one display
 	a.captureMu.Unlock()
 
 	log.Println("Starting screen capture")
+	a.tray.setSession(true, start.Operator, run.input, start.Recording)
 
+	go a.sendFrames(run)
 	go func() {
 		ticker := time.NewTicker(captureInterval)
 		defer ticker.Stop()
 
+		var last time.Time
 		for {
 			select {
-			case <-a.stopCapture:
+			case <-run.stop:
 				return
 			case <-ticker.C:
-				data, err := captureScreen(a.currentDisplay)
-				if err != nil {
+				a.captureMu.Lock()
+				display, mode := a.currentDisplay, a.viewMode
+				a.captureMu.Unlock()
+
+				if mode != "" && mode != protocol.ViewSingle {
+					run.tiler.reset()
+					if time.Since(last) < multiCaptureInterval {
+						continue
+					}
+					last = time.Now()
+					frames, err := captureAllDisplays(mode, run.stamp)
+					if err != nil {
+						log.Printf("Multi-display capture failed: %v", err)
+						continue
+					}
+					run.timings.captured(time.Since(last), 0)
+					run.offer(capture{frames: frames, began: last})
 					continue
 				}
 
-				// Binary frame: [type prefix | JPEG bytes]
-				frame := make([]byte, 1+len(data))
-				frame[0] = protocol.BinScreen
-				copy(frame[1:], data)
-				_ = a.sendBinary(frame)
+				began := time.Now()
+				img := captureScreen(display)
+				grabbed := time.Now()
+				scaled := run.stamp(a.frames.scale(img, run.fullRes.Load()))
+				run.setGeometry(img.Bounds().Size(), scaled.Bounds().Size())
+				var frame []byte
+				var err error
+				if a.frames.lossless && run.tiles.Load() && !run.recorded {
+					if run.resync.Swap(false) {
+						run.tiler.reset()
+					}
+					frame, err = run.tiler.encode(scaled, a.frames.quality)
+				} else {
+					// Binary frame: [type prefix | JPEG bytes]
+					run.tiler.reset()
+					frame, err = encodeJPEG([]byte{protocol.BinScreen}, scaled, a.frames.quality)
+				}
+				if err != nil {
+					log.Printf("Frame encoding failed: %v", err)
+					continue
+				}
+				run.timings.captured(grabbed.Sub(began), time.Since(grabbed))
+				if frame != nil { // nil: nothing changed
+					run.offer(capture{frames: [][]byte{frame}, began: began})
+				}
 			}
 		}
 	}()
 }
 
-// stopCaptureLoop signals the capture goroutine to stop.
-func (a *Agent) stopCaptureLoop() {
+// setGeometry records the size of the display captured and of the frame
+// sent for it, for mapping input (see frameGeometry).
+func (r *captureRun) setGeometry(screen, frame image.Point) {
+	if g := r.geometry.Load(); g != nil && g.screen == screen && g.frame == frame {
+		return
+	}
+	r.geometry.Store(&frameGeometry{screen: screen, frame: frame})
+}
+
+// stamp draws the session watermark, the operator and the UTC time, in
+// the bottom left corner of img when the server asked for one (see
+// protocol.CaptureStart), returning the image drawn on. It is drawn after
+// scaling, so it stays legible at the size the viewer sees.
+func (r *captureRun) stamp(img image.Image) image.Image {
+	if !r.stamped {
+		return img
+	}
+	dst, ok := img.(draw.Image)
+	if !ok {
+		dst = scaleDown(img, 0, 0)
+	}
+	watermark.DrawLeft(dst, "Viewed by "+r.operator, time.Now().UTC().Format("2006-01-02 15:04:05 MST"))
+	return dst
+}
+
+// capture is one capture's frames and when capturing began.
+type capture struct {
+	frames [][]byte
+	began  time.Time
+}
+
+// offer buffers a capture for sending, dropping any older capture still
+// waiting. Only the capture goroutine calls it.
+func (r *captureRun) offer(c capture) {
+	select {
+	case old := <-r.latest:
+		r.dropped.Add(int64(len(old.frames)))
+		r.resync.Store(true)
+	default:
+	}
+	r.latest <- c
+}
+
+// sendFrames writes buffered frames until the run stops. Screen and tile
+// frames are preceded by a "frame_stamp", for the server's latency
+// measurement (see protocol.FrameStamp).
+func (a *Agent) sendFrames(run *captureRun) {
+	var seq uint32
+	for {
+		select {
+		case <-run.stop:
+			return
+		case c := <-run.latest:
+			// Out of credit means earlier frames have not reached the
+			// viewer yet; drop the frame rather than queue it.
+			a.captureMu.Lock()
+			credit := a.screenCredit
+			a.captureMu.Unlock()
+			for _, frame := range c.frames {
+				if credit != nil && !credit.TrySpend(len(frame)) {
+					run.dropped.Add(1)
+					run.noCredit.Add(1)
+					run.resync.Store(true)
+					continue
+				}
+				began := time.Now()
+				if frame[0] != protocol.BinDisplay {
+					seq++
+					stamp, _ := json.Marshal(protocol.FrameStamp{Seq: seq, CapturedAt: c.began.UnixMilli(), AgeMS: ms(began.Sub(c.began))})
+					_ = a.sendMessage(protocol.Message{Type: "frame_stamp", Payload: stamp})
+				}
+				if a.sendBinary(frame) == nil {
+					run.sent.Add(1)
+					run.timings.sent(len(frame), time.Since(began))
+				} else {
+					run.dropped.Add(1)
+					run.resync.Store(true)
+				}
+			}
+		}
+	}
+}
+
+// stopCaptureLoop signals the capture goroutines to stop and reports the
+// run's frame counts to the server, echoing the ID of the stop request.
+func (a *Agent) stopCaptureLoop(payload json.RawMessage) {
 	a.captureMu.Lock()
-	defer a.captureMu.Unlock()
+	run := a.capture
+	a.capture = nil
+	a.captureMu.Unlock()
+	if run == nil {
+		return
+	}
+	close(run.stop)
+	a.tray.setSession(false, "", false, false)
+	a.input.releaseAll()
 
-	if a.capturing && a.stopCapture != nil {
-		close(a.stopCapture)
-		a.capturing = false
-		log.Println("Stopped screen capture")
+	var req struct {
+		ID string `json:"id"`
 	}
+	_ = json.Unmarshal(payload, &req)
+	stats := protocol.CaptureStats{ID: req.ID, FramesSent: run.sent.Load(), FramesDropped: run.dropped.Load()}
+	log.Printf("Stopped screen capture (%d frames sent, %d dropped)", stats.FramesSent, stats.FramesDropped)
+	data, _ := json.Marshal(stats)
+	_ = a.sendMessage(protocol.Message{Type: "capture_stats", Payload: data})
 }
 
 // handleSwitchDisplay processes a display-switch request from the viewer.
@@ -101,6 +267,7 @@ func (a *Agent) handleSwitchDisplay(payload json.RawMessage) {
 
 	a.captureMu.Lock()
 	a.currentDisplay = req.Display
+	a.viewMode = protocol.ViewSingle
 	a.captureMu.Unlock()
 
 	log.Printf("Switched to display %d", req.Display)
@@ -115,118 +282,60 @@ func (a *Agent) handleSwitchDisplay(payload json.RawMessage) {
 	})
 }
 
-// captureScreen dispatches to the platform-specific capture implementation.
-func captureScreen(display int) ([]byte, error) {
-	switch runtime.GOOS {
-	case "darwin":
-		return captureScreenMacOS(display)
-	case "linux":
-		return captureScreenLinux()
-	case "windows":
-		return captureScreenWindows()
-	default:
-		return generateTestPattern()
+// handleSetResolution switches the session between frames scaled down to
+// -capture-max-size and full resolution, and confirms with
+// "resolution_changed".
+func (a *Agent) handleSetResolution(payload json.RawMessage) {
+	var req protocol.SetResolution
+	if err := json.Unmarshal(payload, &req); err != nil {
+		log.Printf("Failed to parse set_resolution payload: %v", err)
+		return
 	}
-}
-
-// getDisplayCount returns the number of connected displays.
-// The result is cached because shelling out to system_profiler is expensive.
-func getDisplayCount() int {
-	displayCountOnce.Do(func() {
-		if runtime.GOOS != "darwin" {
-			cachedDisplayCount = 1
-			return
-		}
-		cmd := exec.Command("system_profiler", "SPDisplaysDataType")
-		output, err := cmd.Output()
-		if err != nil {
-			cachedDisplayCount = 1
-			return
-		}
-		count := 0
-		for _, line := range bytes.Split(output, []byte("\n")) {
-			if bytes.Contains(line, []byte("Resolution:")) {
-				count++
-			}
-		}
-		if count == 0 {
-			count = 1
-		}
-		cachedDisplayCount = count
-	})
-	return cachedDisplayCount
-}
-
-func captureScreenMacOS(display int) ([]byte, error) {
-	tmpFile := fmt.Sprintf("/tmp/screen_%d.jpg", time.Now().UnixNano())
-	defer os.Remove(tmpFile) //nolint:errcheck
-
-	displayArg := fmt.Sprintf("%d", display)
-	cmd := exec.Command("screencapture", "-x", "-t", "jpg", "-C", "-D", displayArg, tmpFile)
-	if err := cmd.Run(); err != nil {
-		return generateTestPattern()
+	a.captureMu.Lock()
+	run := a.capture
+	a.captureMu.Unlock()
+	if run == nil {
+		return
 	}
+	run.fullRes.Store(req.Full)
 
-	data, err := os.ReadFile(tmpFile)
-	if err != nil {
-		return generateTestPattern()
+	if req.Full {
+		log.Println("Switched to full-resolution frames")
+	} else {
+		log.Println("Switched to scaled frames")
 	}
-	return data, nil
+	data, _ := json.Marshal(protocol.SetResolution{Full: req.Full, MaxSize: a.frames.maxSize})
+	_ = a.sendMessage(protocol.Message{Type: "resolution_changed", Payload: data})
 }
 
-func captureScreenLinux() ([]byte, error) {
-	tmpFile := fmt.Sprintf("/tmp/screen_%d.jpg", time.Now().UnixNano())
-	defer os.Remove(tmpFile) //nolint:errcheck
-
-	cmd := exec.Command("gnome-screenshot", "-f", tmpFile)
-	if err := cmd.Run(); err != nil {
-		cmd = exec.Command("scrot", "-o", tmpFile)
-		if err := cmd.Run(); err != nil {
-			cmd = exec.Command("import", "-window", "root", tmpFile)
-			if err := cmd.Run(); err != nil {
-				return generateTestPattern()
-			}
-		}
-	}
-
-	data, err := os.ReadFile(tmpFile)
+// captureScreen captures a frame for the live stream, substituting a test
+// pattern when the platform capture fails so the viewer still sees that
+// the session is alive.
+func captureScreen(display int) image.Image {
+	img, err := grabDisplay(display)
 	if err != nil {
-		return generateTestPattern()
+		return testPattern()
 	}
-	return data, nil
+	return img
 }
 
-func captureScreenWindows() ([]byte, error) {
-	tmpFile := fmt.Sprintf("%s\\screen_%d.jpg", os.TempDir(), time.Now().UnixNano())
-	defer os.Remove(tmpFile) //nolint:errcheck
-
-	script := fmt.Sprintf(`
-Add-Type -AssemblyName System.Windows.Forms
-Add-Type -AssemblyName System.Drawing
-$screen = [System.Windows.Forms.Screen]::PrimaryScreen.Bounds
-$bitmap = New-Object System.Drawing.Bitmap($screen.Width, $screen.Height)
-$graphics = [System.Drawing.Graphics]::FromImage($bitmap)
-$graphics.CopyFromScreen($screen.Location, [System.Drawing.Point]::Empty, $screen.Size)
-$bitmap.Save('%s', [System.Drawing.Imaging.ImageFormat]::Jpeg)
-$graphics.Dispose()
-$bitmap.Dispose()
-`, tmpFile)
-
-	cmd := exec.Command("powershell", "-NoProfile", "-Command", script)
-	if err := cmd.Run(); err != nil {
-		return generateTestPattern()
-	}
-
-	data, err := os.ReadFile(tmpFile)
+// captureDisplay captures one display as a JPEG at quality, and reports
+// failures.
+func captureDisplay(display, quality int) ([]byte, error) {
+	img, err := grabDisplay(display)
 	if err != nil {
-		return generateTestPattern()
+		return nil, err
 	}
-	return data, nil
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-// generateTestPattern creates a simple test image when capture fails.
+// testPattern creates a simple test image when capture fails.
 // Uses direct pixel buffer writes (4x faster than img.Set per-pixel).
-func generateTestPattern() ([]byte, error) {
+func testPattern() *image.RGBA {
 	const width, height = testPatternWidth, testPatternHeight
 	img := image.NewRGBA(image.Rect(0, 0, width, height))
 	pix := img.Pix
@@ -275,10 +384,5 @@ func generateTestPattern() ([]byte, error) {
 		}
 	}
 
-	var buf bytes.Buffer
-	buf.Grow(width * height / 4) // Pre-size for ≈JPEG output
-	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return img
 }
@@ -0,0 +1,157 @@
+//go:build darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"syscall"
+	"unsafe"
+)
+
+// Capture on macOS is in-process, through CoreGraphics: the display-th
+// active display (the main display first, as screencapture numbers them)
+// is grabbed with CGDisplayCreateImage and its pixels copied out of the
+// image's data provider. The agent has no cgo, so the functions are
+// imported dynamically and called through the runtime's libc call path,
+// the way golang.org/x/sys/unix calls libSystem; capture_darwin.s holds
+// the trampolines. Capture needs the agent's Screen Recording permission;
+// without it macOS returns the desktop without its windows.
+
+//go:cgo_import_dynamic _ _ "/System/Library/Frameworks/CoreGraphics.framework/Versions/A/CoreGraphics"
+//go:cgo_import_dynamic _ _ "/System/Library/Frameworks/CoreFoundation.framework/Versions/A/CoreFoundation"
+
+//go:cgo_import_dynamic cg_CGGetActiveDisplayList CGGetActiveDisplayList "/System/Library/Frameworks/CoreGraphics.framework/Versions/A/CoreGraphics"
+//go:cgo_import_dynamic cg_CGDisplayCreateImage CGDisplayCreateImage "/System/Library/Frameworks/CoreGraphics.framework/Versions/A/CoreGraphics"
+//go:cgo_import_dynamic cg_CGImageGetWidth CGImageGetWidth "/System/Library/Frameworks/CoreGraphics.framework/Versions/A/CoreGraphics"
+//go:cgo_import_dynamic cg_CGImageGetHeight CGImageGetHeight "/System/Library/Frameworks/CoreGraphics.framework/Versions/A/CoreGraphics"
+//go:cgo_import_dynamic cg_CGImageGetBytesPerRow CGImageGetBytesPerRow "/System/Library/Frameworks/CoreGraphics.framework/Versions/A/CoreGraphics"
+//go:cgo_import_dynamic cg_CGImageGetBitsPerPixel CGImageGetBitsPerPixel "/System/Library/Frameworks/CoreGraphics.framework/Versions/A/CoreGraphics"
+//go:cgo_import_dynamic cg_CGImageGetBitmapInfo CGImageGetBitmapInfo "/System/Library/Frameworks/CoreGraphics.framework/Versions/A/CoreGraphics"
+//go:cgo_import_dynamic cg_CGImageGetDataProvider CGImageGetDataProvider "/System/Library/Frameworks/CoreGraphics.framework/Versions/A/CoreGraphics"
+//go:cgo_import_dynamic cg_CGDataProviderCopyData CGDataProviderCopyData "/System/Library/Frameworks/CoreGraphics.framework/Versions/A/CoreGraphics"
+//go:cgo_import_dynamic cf_CFDataGetBytePtr CFDataGetBytePtr "/System/Library/Frameworks/CoreFoundation.framework/Versions/A/CoreFoundation"
+//go:cgo_import_dynamic cf_CFDataGetLength CFDataGetLength "/System/Library/Frameworks/CoreFoundation.framework/Versions/A/CoreFoundation"
+//go:cgo_import_dynamic cf_CFRelease CFRelease "/System/Library/Frameworks/CoreFoundation.framework/Versions/A/CoreFoundation"
+
+// Trampoline addresses, set in capture_darwin.s.
+var (
+	cgGetActiveDisplayList uintptr
+	cgDisplayCreateImage   uintptr
+	cgImageGetWidth        uintptr
+	cgImageGetHeight       uintptr
+	cgImageGetBytesPerRow  uintptr
+	cgImageGetBitsPerPixel uintptr
+	cgImageGetBitmapInfo   uintptr
+	cgImageGetDataProvider uintptr
+	cgDataProviderCopyData uintptr
+	cfDataGetBytePtr       uintptr
+	cfDataGetLength        uintptr
+	cfRelease              uintptr
+)
+
+// syscall_syscall calls the C function at fn; the runtime implements it
+// for golang.org/x/sys/unix.
+//
+//go:linkname syscall_syscall syscall.syscall
+func syscall_syscall(fn, a1, a2, a3 uintptr) (r1, r2 uintptr, err syscall.Errno)
+
+// cgCall calls a CoreGraphics or CoreFoundation function that takes one
+// integer or object argument.
+func cgCall(fn, arg uintptr) uintptr {
+	r, _, _ := syscall_syscall(fn, arg, 0, 0)
+	return r
+}
+
+// maxActiveDisplays bounds the active display list.
+const maxActiveDisplays = 32
+
+// CGBitmapInfo fields: the byte order of 32-bit pixels and where their
+// alpha is.
+const (
+	cgByteOrderMask     = 0x7000
+	cgByteOrderDefault  = 0
+	cgByteOrder32Little = 2 << 12
+	cgByteOrder32Big    = 4 << 12
+
+	cgAlphaInfoMask      = 0x1f
+	cgAlphaNone          = 0
+	cgAlphaPremultLast   = 1
+	cgAlphaPremultFirst  = 2
+	cgAlphaLast          = 3
+	cgAlphaFirst         = 4
+	cgAlphaNoneSkipLast  = 5
+	cgAlphaNoneSkipFirst = 6
+)
+
+// grabDisplay captures display, numbered from 1.
+func grabDisplay(display int) (image.Image, error) {
+	var ids [maxActiveDisplays]uint32
+	var count uint32
+	r, _, _ := syscall_syscall(cgGetActiveDisplayList, maxActiveDisplays,
+		uintptr(unsafe.Pointer(&ids[0])), uintptr(unsafe.Pointer(&count)))
+	if e := int32(r); e != 0 {
+		return nil, fmt.Errorf("CGGetActiveDisplayList: error %d", e)
+	}
+	if display < 1 || display > int(count) {
+		return nil, fmt.Errorf("display %d not found (%d active)", display, count)
+	}
+
+	img := cgCall(cgDisplayCreateImage, uintptr(ids[display-1]))
+	if img == 0 {
+		return nil, errors.New("CGDisplayCreateImage returned no image")
+	}
+	defer cgCall(cfRelease, img)
+	w, h := int(cgCall(cgImageGetWidth, img)), int(cgCall(cgImageGetHeight, img))
+	stride := int(cgCall(cgImageGetBytesPerRow, img))
+	if bpp := int(cgCall(cgImageGetBitsPerPixel, img)); bpp != 32 {
+		return nil, fmt.Errorf("unsupported pixel format: %d bits per pixel", bpp)
+	}
+	info := uint32(cgCall(cgImageGetBitmapInfo, img))
+
+	data := cgCall(cgDataProviderCopyData, cgCall(cgImageGetDataProvider, img))
+	if data == 0 {
+		return nil, errors.New("CGDataProviderCopyData returned no data")
+	}
+	defer cgCall(cfRelease, data)
+	n := int(cgCall(cfDataGetLength, data))
+	if w <= 0 || h <= 0 || stride < w*4 || n < stride*(h-1)+w*4 {
+		return nil, fmt.Errorf("unexpected image layout: %dx%d, %d bytes per row, %d bytes", w, h, stride, n)
+	}
+	src := cBytes(cgCall(cfDataGetBytePtr, data), n)
+
+	// Which byte of each pixel holds red, green and blue.
+	var r0, g0, b0 int
+	order, alpha := info&cgByteOrderMask, info&cgAlphaInfoMask
+	alphaFirst := alpha == cgAlphaPremultFirst || alpha == cgAlphaFirst || alpha == cgAlphaNoneSkipFirst
+	alphaLast := alpha == cgAlphaNone || alpha == cgAlphaPremultLast || alpha == cgAlphaLast || alpha == cgAlphaNoneSkipLast
+	bigEndian := order == cgByteOrderDefault || order == cgByteOrder32Big
+	switch {
+	case order == cgByteOrder32Little && alphaFirst:
+		r0, g0, b0 = 2, 1, 0 // BGRA, the usual display format
+	case order == cgByteOrder32Little && alphaLast:
+		r0, g0, b0 = 3, 2, 1 // ABGR
+	case bigEndian && alphaFirst:
+		r0, g0, b0 = 1, 2, 3 // ARGB
+	case bigEndian && alphaLast:
+		r0, g0, b0 = 0, 1, 2 // RGBA
+	default:
+		return nil, fmt.Errorf("unsupported bitmap info %#x", info)
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		row := src[y*stride : y*stride+w*4]
+		dst := out.Pix[y*out.Stride : y*out.Stride+w*4]
+		for i := 0; i < len(row); i += 4 {
+			dst[i], dst[i+1], dst[i+2], dst[i+3] = row[i+r0], row[i+g0], row[i+b0], 255
+		}
+	}
+	return out, nil
+}
+
+// cBytes returns the n bytes of C memory at addr.
+func cBytes(addr uintptr, n int) []byte {
+	return unsafe.Slice(*(**byte)(unsafe.Pointer(&addr)), n)
+}
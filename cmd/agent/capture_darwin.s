@@ -0,0 +1,65 @@
+// Trampolines for the CoreGraphics and CoreFoundation functions
+// capture_darwin.go imports, as golang.org/x/sys/unix has for libSystem.
+// The same instructions assemble for amd64 and arm64.
+
+#include "textflag.h"
+
+TEXT cg_CGGetActiveDisplayList_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	cg_CGGetActiveDisplayList(SB)
+GLOBL	·cgGetActiveDisplayList(SB), RODATA, $8
+DATA	·cgGetActiveDisplayList(SB)/8, $cg_CGGetActiveDisplayList_trampoline<>(SB)
+
+TEXT cg_CGDisplayCreateImage_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	cg_CGDisplayCreateImage(SB)
+GLOBL	·cgDisplayCreateImage(SB), RODATA, $8
+DATA	·cgDisplayCreateImage(SB)/8, $cg_CGDisplayCreateImage_trampoline<>(SB)
+
+TEXT cg_CGImageGetWidth_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	cg_CGImageGetWidth(SB)
+GLOBL	·cgImageGetWidth(SB), RODATA, $8
+DATA	·cgImageGetWidth(SB)/8, $cg_CGImageGetWidth_trampoline<>(SB)
+
+TEXT cg_CGImageGetHeight_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	cg_CGImageGetHeight(SB)
+GLOBL	·cgImageGetHeight(SB), RODATA, $8
+DATA	·cgImageGetHeight(SB)/8, $cg_CGImageGetHeight_trampoline<>(SB)
+
+TEXT cg_CGImageGetBytesPerRow_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	cg_CGImageGetBytesPerRow(SB)
+GLOBL	·cgImageGetBytesPerRow(SB), RODATA, $8
+DATA	·cgImageGetBytesPerRow(SB)/8, $cg_CGImageGetBytesPerRow_trampoline<>(SB)
+
+TEXT cg_CGImageGetBitsPerPixel_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	cg_CGImageGetBitsPerPixel(SB)
+GLOBL	·cgImageGetBitsPerPixel(SB), RODATA, $8
+DATA	·cgImageGetBitsPerPixel(SB)/8, $cg_CGImageGetBitsPerPixel_trampoline<>(SB)
+
+TEXT cg_CGImageGetBitmapInfo_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	cg_CGImageGetBitmapInfo(SB)
+GLOBL	·cgImageGetBitmapInfo(SB), RODATA, $8
+DATA	·cgImageGetBitmapInfo(SB)/8, $cg_CGImageGetBitmapInfo_trampoline<>(SB)
+
+TEXT cg_CGImageGetDataProvider_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	cg_CGImageGetDataProvider(SB)
+GLOBL	·cgImageGetDataProvider(SB), RODATA, $8
+DATA	·cgImageGetDataProvider(SB)/8, $cg_CGImageGetDataProvider_trampoline<>(SB)
+
+TEXT cg_CGDataProviderCopyData_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	cg_CGDataProviderCopyData(SB)
+GLOBL	·cgDataProviderCopyData(SB), RODATA, $8
+DATA	·cgDataProviderCopyData(SB)/8, $cg_CGDataProviderCopyData_trampoline<>(SB)
+
+TEXT cf_CFDataGetBytePtr_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	cf_CFDataGetBytePtr(SB)
+GLOBL	·cfDataGetBytePtr(SB), RODATA, $8
+DATA	·cfDataGetBytePtr(SB)/8, $cf_CFDataGetBytePtr_trampoline<>(SB)
+
+TEXT cf_CFDataGetLength_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	cf_CFDataGetLength(SB)
+GLOBL	·cfDataGetLength(SB), RODATA, $8
+DATA	·cfDataGetLength(SB)/8, $cf_CFDataGetLength_trampoline<>(SB)
+
+TEXT cf_CFRelease_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	cf_CFRelease(SB)
+GLOBL	·cfRelease(SB), RODATA, $8
+DATA	·cfRelease(SB)/8, $cf_CFRelease_trampoline<>(SB)
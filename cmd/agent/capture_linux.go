@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Capture on Linux reads the X screen in-process (see x11_linux.go); the
+// whole screen is one display, as getDisplayCount reports. Sessions with
+// no X server to talk to, such as Wayland without Xwayland, fall back to
+// a screenshot tool, which is slower.
+
+// grabDisplay captures the X screen, or a screenshot when there is no X
+// server.
+func grabDisplay(int) (image.Image, error) {
+	img, err := grabX11()
+	if err == nil {
+		return img, nil
+	}
+	img, toolErr := screenshotTool()
+	if toolErr != nil {
+		return nil, fmt.Errorf("%w; %w", err, toolErr)
+	}
+	return img, nil
+}
+
+// screenshotTool captures the screen with gnome-screenshot, scrot or
+// ImageMagick's import, whichever succeeds first.
+func screenshotTool() (image.Image, error) {
+	dir, err := os.MkdirTemp("", "rmm-capture-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+	file := filepath.Join(dir, "screen.png")
+
+	for _, args := range [][]string{
+		{"gnome-screenshot", "-f", file},
+		{"scrot", "-o", file},
+		{"import", "-window", "root", file},
+	} {
+		if exec.Command(args[0], args[1:]...).Run() != nil {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("decoding the screenshot: %w", err)
+		}
+		return img, nil
+	}
+	return nil, errors.New("no screenshot tool succeeded (gnome-screenshot, scrot, import)")
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !linux && !windows
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"runtime"
+)
+
+func grabDisplay(int) (image.Image, error) {
+	return nil, fmt.Errorf("screen capture not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,107 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"image"
+	"syscall"
+	"unsafe"
+)
+
+// Capture on Windows is in-process, through GDI: the primary screen is
+// copied (BitBlt) into a bitmap and read back as top-down 32-bit BGRX
+// rows (GetDIBits). Like the PowerShell CopyFromScreen it replaces, it
+// sees the desktop of the session the agent runs in.
+
+var (
+	user32DLL                  = syscall.NewLazyDLL("user32.dll")
+	procGetDC                  = user32DLL.NewProc("GetDC")
+	procReleaseDC              = user32DLL.NewProc("ReleaseDC")
+	procGetSystemMetrics       = user32DLL.NewProc("GetSystemMetrics")
+	gdi32DLL                   = syscall.NewLazyDLL("gdi32.dll")
+	procCreateCompatibleDC     = gdi32DLL.NewProc("CreateCompatibleDC")
+	procCreateCompatibleBitmap = gdi32DLL.NewProc("CreateCompatibleBitmap")
+	procSelectObject           = gdi32DLL.NewProc("SelectObject")
+	procBitBlt                 = gdi32DLL.NewProc("BitBlt")
+	procGetDIBits              = gdi32DLL.NewProc("GetDIBits")
+	procDeleteObject           = gdi32DLL.NewProc("DeleteObject")
+	procDeleteDC               = gdi32DLL.NewProc("DeleteDC")
+)
+
+const (
+	smCXScreen   = 0 // SM_CXSCREEN
+	smCYScreen   = 1 // SM_CYSCREEN
+	srcCopy      = 0x00CC0020
+	captureBlt   = 0x40000000 // include layered windows
+	biRGB        = 0
+	dibRGBColors = 0
+)
+
+// bitmapInfo is BITMAPINFO with one (unused) color entry.
+type bitmapInfo struct {
+	size          uint32
+	width         int32
+	height        int32
+	planes        uint16
+	bitCount      uint16
+	compression   uint32
+	sizeImage     uint32
+	xPelsPerMeter int32
+	yPelsPerMeter int32
+	clrUsed       uint32
+	clrImportant  uint32
+	colors        [1]uint32
+}
+
+// grabDisplay captures the primary screen; Windows agents capture one
+// display (see getDisplayCount).
+func grabDisplay(int) (image.Image, error) {
+	w, _, _ := procGetSystemMetrics.Call(smCXScreen)
+	h, _, _ := procGetSystemMetrics.Call(smCYScreen)
+	if w == 0 || h == 0 {
+		return nil, errors.New("no screen (is the agent running in an interactive session?)")
+	}
+
+	screen, _, err := procGetDC.Call(0)
+	if screen == 0 {
+		return nil, errors.New("GetDC: " + err.Error())
+	}
+	defer procReleaseDC.Call(0, screen) //nolint:errcheck
+	mem, _, err := procCreateCompatibleDC.Call(screen)
+	if mem == 0 {
+		return nil, errors.New("CreateCompatibleDC: " + err.Error())
+	}
+	defer procDeleteDC.Call(mem) //nolint:errcheck
+	bitmap, _, err := procCreateCompatibleBitmap.Call(screen, w, h)
+	if bitmap == 0 {
+		return nil, errors.New("CreateCompatibleBitmap: " + err.Error())
+	}
+	defer procDeleteObject.Call(bitmap) //nolint:errcheck
+	old, _, _ := procSelectObject.Call(mem, bitmap)
+	ok, _, err := procBitBlt.Call(mem, 0, 0, w, h, screen, 0, 0, srcCopy|captureBlt)
+	// The bitmap must not be selected into a DC while GetDIBits reads it.
+	procSelectObject.Call(mem, old) //nolint:errcheck
+	if ok == 0 {
+		return nil, errors.New("BitBlt: " + err.Error())
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, int(w), int(h)))
+	bi := bitmapInfo{
+		width:       int32(w),
+		height:      -int32(h), // top-down rows
+		planes:      1,
+		bitCount:    32,
+		compression: biRGB,
+	}
+	bi.size = uint32(unsafe.Offsetof(bi.colors))
+	if n, _, err := procGetDIBits.Call(mem, bitmap, 0, h, uintptr(unsafe.Pointer(&img.Pix[0])), uintptr(unsafe.Pointer(&bi)), dibRGBColors); n == 0 {
+		return nil, errors.New("GetDIBits: " + err.Error())
+	}
+	// BGRX to RGBA.
+	pix := img.Pix
+	for i := 0; i < len(pix); i += 4 {
+		pix[i], pix[i+2], pix[i+3] = pix[i+2], pix[i], 255
+	}
+	return img, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// commandVerifier checks the platform signature on high-impact commands
+// (see protocol.RequiresSignature).
+type commandVerifier struct {
+	fingerprint string // pinned at enrollment; empty for agents enrolled before it was
+
+	mu   sync.Mutex
+	key  ed25519.PublicKey    // from registration, once it matches the fingerprint
+	seen map[string]time.Time // signatures accepted within CommandMaxAge
+}
+
+// setKey trusts the platform key the server sent at registration if it
+// matches the pinned fingerprint.
+func (v *commandVerifier) setKey(b64 string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.key = nil
+	if v.fingerprint == "" {
+		return errors.New("no platform fingerprint pinned at enrollment")
+	}
+	key, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("server sent no valid platform key")
+	}
+	sum := sha256.Sum256(key)
+	if hex.EncodeToString(sum[:]) != v.fingerprint {
+		return errors.New("platform key does not match the fingerprint pinned at enrollment")
+	}
+	v.key = key
+	return nil
+}
+
+// verify checks msg's signature for agentID and remembers it so it cannot
+// be replayed.
+func (v *commandVerifier) verify(msg protocol.Message, agentID string) error {
+	sig := msg.Signed
+	if sig == nil {
+		return errors.New("command is not signed")
+	}
+	if sig.AgentID != agentID {
+		return errors.New("command is signed for another agent")
+	}
+	if age := time.Since(time.Unix(sig.IssuedAt, 0)); age > protocol.CommandMaxAge || age < -protocol.CommandMaxAge {
+		return fmt.Errorf("command signature is %s out of date", age.Round(time.Second))
+	}
+	// Strict decoding rejects stray trailing bits, which would otherwise
+	// let a relay re-encode one signature as many strings.
+	raw, err := base64.StdEncoding.Strict().DecodeString(sig.Signature)
+	if err != nil {
+		return errors.New("malformed command signature")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.key == nil {
+		return errors.New("no trusted platform key to verify commands with")
+	}
+	if !ed25519.Verify(v.key, protocol.CommandDigest(msg.Type, sig.AgentID, sig.IssuedAt, msg.Payload), raw) {
+		return errors.New("invalid command signature")
+	}
+	now := time.Now()
+	for s, at := range v.seen {
+		if now.Sub(at) > 2*protocol.CommandMaxAge {
+			delete(v.seen, s)
+		}
+	}
+	if _, replay := v.seen[string(raw)]; replay {
+		return errors.New("command signature was already used")
+	}
+	if v.seen == nil {
+		v.seen = make(map[string]time.Time)
+	}
+	v.seen[string(raw)] = now
+	return nil
+}
+
+// refuseCommand answers a command that failed verification with an error
+// result, so the server's caller does not wait for a timeout.
+func (a *Agent) refuseCommand(resultType string, payload json.RawMessage, reason error) {
+	var req struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal(payload, &req)
+	data, _ := json.Marshal(map[string]string{"id": req.ID, "error": "refused: " + reason.Error()})
+	_ = a.sendMessage(protocol.Message{Type: resultType, Payload: data})
+}
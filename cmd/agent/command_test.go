@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+func TestCommandVerifier(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(pub)
+	v := &commandVerifier{fingerprint: hex.EncodeToString(sum[:])}
+
+	if err := v.setKey(base64.StdEncoding.EncodeToString(otherPub)); err == nil {
+		t.Fatal("setKey trusted a key that does not match the pinned fingerprint")
+	}
+	if err := v.setKey(base64.StdEncoding.EncodeToString(pub)); err != nil {
+		t.Fatal(err)
+	}
+
+	const agentID = "agent-1"
+	payload := json.RawMessage(`{"id":"r1","action":"reboot"}`)
+	sign := func(key ed25519.PrivateKey, agent string, at time.Time) protocol.Message {
+		sig := ed25519.Sign(key, protocol.CommandDigest("power_request", agent, at.Unix(), payload))
+		return protocol.Message{Type: "power_request", Payload: payload, Signed: &protocol.CommandSignature{
+			AgentID: agent, IssuedAt: at.Unix(), Signature: base64.StdEncoding.EncodeToString(sig),
+		}}
+	}
+
+	now := time.Now()
+	replayed := sign(priv, agentID, now.Add(-time.Second))
+	retyped := sign(priv, agentID, now)
+	retyped.Type = "registry_request"
+	repayload := sign(priv, agentID, now)
+	repayload.Payload = json.RawMessage(`{"id":"r1","action":"shutdown"}`)
+	// Re-encode a signature with non-zero trailing bits: the same bytes
+	// under another string, which must not slip past the replay check.
+	malleable := sign(priv, agentID, now.Add(-2*time.Second))
+	malleable.Signed.Signature = malleable.Signed.Signature[:len(malleable.Signed.Signature)-3] + "B=="
+
+	tests := []struct {
+		name string
+		msg  protocol.Message
+		err  string
+	}{
+		{"valid", replayed, ""},
+		{"replayed", replayed, "command signature was already used"},
+		{"unsigned", protocol.Message{Type: "power_request", Payload: payload}, "command is not signed"},
+		{"for another agent", sign(priv, "agent-2", now), "command is signed for another agent"},
+		{"expired", sign(priv, agentID, now.Add(-protocol.CommandMaxAge-time.Minute)), "out of date"},
+		{"from the future", sign(priv, agentID, now.Add(protocol.CommandMaxAge+time.Minute)), "out of date"},
+		{"signed by another key", sign(otherPriv, agentID, now), "invalid command signature"},
+		{"another command type", retyped, "invalid command signature"},
+		{"another payload", repayload, "invalid command signature"},
+		{"non-canonical base64", malleable, "malformed command signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.verify(tt.msg, agentID)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("err = %v", err)
+				}
+				return
+			}
+			// Out-of-date signatures report their age, which varies.
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// handleConsentRequest asks the local user whether to allow a remote
+// viewer and reports the answer, telling them when the session will be
+// recorded. The prompt runs in its own goroutine so
+// the message loop keeps serving heartbeats while the user decides.
+func (a *Agent) handleConsentRequest(payload json.RawMessage) {
+	var req struct {
+		Requester string `json:"requester"`
+		Timeout   int    `json:"timeout"`
+		Recording bool   `json:"recording"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+	if req.Timeout <= 0 {
+		req.Timeout = 60
+	}
+
+	go func() {
+		granted := promptConsent(req.Requester, req.Recording, time.Duration(req.Timeout)*time.Second)
+		log.Printf("Remote access request from %q: granted=%t", req.Requester, granted)
+		resp, _ := json.Marshal(map[string]bool{"granted": granted})
+		_ = a.sendMessage(protocol.Message{Type: "consent_response", Payload: resp})
+	}()
+}
+
+// promptConsent shows a yes/no dialog to the logged-in user using the
+// platform's built-in tooling. Any failure, including no dialog tool or
+// no answer within timeout, counts as a refusal.
+func promptConsent(requester string, recording bool, timeout time.Duration) bool {
+	msg := fmt.Sprintf("%s is requesting to view and control this computer. Allow?", sanitizePrompt(requester))
+	if recording {
+		msg = fmt.Sprintf("%s is requesting to view and control this computer. This session will be recorded. Allow?", sanitizePrompt(requester))
+	}
+	secs := int(timeout / time.Second)
+	title := dialogTitle("Remote Access Request")
+
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf(`display dialog "%s" with title "%s" `+
+			`buttons {"Deny", "Allow"} default button "Deny" giving up after %d`, msg, title, secs)
+		out, err := exec.Command("osascript", "-e", script).Output()
+		return err == nil && strings.Contains(string(out), "button returned:Allow") &&
+			!strings.Contains(string(out), "gave up:true")
+	case "linux":
+		if _, err := exec.LookPath("zenity"); err == nil {
+			return exec.Command("zenity", "--question", "--title="+title,
+				"--text="+msg, fmt.Sprintf("--timeout=%d", secs)).Run() == nil
+		}
+		if _, err := exec.LookPath("kdialog"); err == nil {
+			cmd := exec.Command("kdialog", "--title", title, "--yesno", msg)
+			return runWithTimeout(cmd, timeout)
+		}
+		log.Println("Consent prompt unavailable: install zenity or kdialog")
+		return false
+	case "windows":
+		// WScript.Shell Popup: 4 = Yes/No, 32 = question icon; 6 = Yes.
+		return windowsPopup(context.Background(), title, msg, secs, 36) == "6"
+	default:
+		log.Printf("Consent prompt not supported on %s", runtime.GOOS)
+		return false
+	}
+}
+
+// windowsPopup shows a WScript.Shell Popup and returns the code of the
+// button pressed, or "" if it could not be shown. The title and message
+// reach PowerShell through the environment rather than the script text,
+// so nothing in them is ever parsed as code.
+func windowsPopup(ctx context.Context, title, msg string, secs, flags int) string {
+	script := fmt.Sprintf(`(New-Object -ComObject WScript.Shell).Popup($env:RMM_PROMPT_TEXT, %d, $env:RMM_PROMPT_TITLE, %d)`,
+		secs, flags)
+	cmd := exec.CommandContext(ctx, "powershell", "-NoProfile", "-Command", script)
+	cmd.Env = append(os.Environ(), "RMM_PROMPT_TEXT="+msg, "RMM_PROMPT_TITLE="+title)
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// runWithTimeout runs cmd and reports whether it exited successfully
+// before timeout; a dialog still open at the deadline is killed.
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) bool {
+	if err := cmd.Start(); err != nil {
+		return false
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(timeout):
+		_ = cmd.Process.Kill()
+		<-done
+		return false
+	}
+}
+
+// sanitizePrompt strips characters that could break out of the dialog
+// string in AppleScript. (Windows prompts take their text from the
+// environment; see windowsPopup.)
+func sanitizePrompt(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '"' || r == '\\' || r < 0x20 {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		s = "A technician"
+	}
+	return s
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Credential storage: agent.json is readable by whoever can read the
+// agent's configuration directory, so the credential is kept in the
+// platform's secret store where there is one: DPAPI on Windows (the
+// encrypted blob in credential.dpapi next to agent.json), the keychain on
+// macOS, and the Secret Service (libsecret, through secret-tool) on Linux
+// desktops. agent.json then names the store (credential_store) instead of
+// holding the credential. A credential found in agent.json is moved into
+// the store at startup; when the store cannot be used, e.g. a Linux
+// server without a session bus, it stays in the file.
+// -credential-store=file keeps it in, or moves it back to, the file.
+
+// credentialStoreTimeout bounds each call to a store's command-line tool.
+const credentialStoreTimeout = 10 * time.Second
+
+// keepCredentialInFile is set by -credential-store=file.
+var keepCredentialInFile bool
+
+// CredentialStore keeps agents' credentials, keyed by agent ID.
+type CredentialStore interface {
+	// Name is how agent.json refers to the store.
+	Name() string
+	Get(agentID string) (string, error)
+	Set(agentID, credential string) error
+	Delete(agentID string) error
+}
+
+// credentialStore returns the store new credentials go to, or nil to keep
+// them in agent.json.
+func credentialStore() CredentialStore {
+	if keepCredentialInFile {
+		return nil
+	}
+	return platformCredentialStore()
+}
+
+// credentialStoreNamed returns the store agent.json names, if this
+// platform has it.
+func credentialStoreNamed(name string) CredentialStore {
+	if cs := platformCredentialStore(); cs != nil && cs.Name() == name {
+		return cs
+	}
+	return nil
+}
+
+// loadCredential fills in cfg.Credential from the store agent.json names.
+func loadCredential(cfg *AgentConfig) error {
+	if cfg.CredentialStore == "" || cfg.Credential != "" {
+		return nil
+	}
+	cs := credentialStoreNamed(cfg.CredentialStore)
+	if cs == nil {
+		return fmt.Errorf("credential store %q is not available", cfg.CredentialStore)
+	}
+	credential, err := cs.Get(cfg.AgentID)
+	if err != nil {
+		return fmt.Errorf("reading the credential from %s: %w", cs.Name(), err)
+	}
+	if credential == "" {
+		return fmt.Errorf("no credential in %s", cs.Name())
+	}
+	cfg.Credential = credential
+	return nil
+}
+
+// storeCredential puts cfg's credential in the credential store and
+// reports the store's name, or "" when the credential must stay in
+// agent.json. The store is read back, since some tools do not report
+// failure.
+func storeCredential(cfg *AgentConfig) string {
+	cs := credentialStore()
+	if cs == nil || cfg.Credential == "" || cfg.AgentID == "" {
+		return ""
+	}
+	if cfg.CredentialStore == cs.Name() {
+		return cs.Name() // already there
+	}
+	err := cs.Set(cfg.AgentID, cfg.Credential)
+	if err == nil {
+		var got string
+		if got, err = cs.Get(cfg.AgentID); err == nil && got != cfg.Credential {
+			err = errors.New("stored credential does not read back")
+		}
+	}
+	if err != nil {
+		log.Printf("Credential store (%s) unavailable, keeping the credential in %s: %v", cs.Name(), configPath(), err)
+		return ""
+	}
+	return cs.Name()
+}
+
+// migrateCredential moves a loaded credential to where -credential-store
+// wants it: from agent.json into the platform store, or back.
+func migrateCredential(cfg *AgentConfig) {
+	want := ""
+	if cs := credentialStore(); cs != nil {
+		want = cs.Name()
+	}
+	if cfg.Credential == "" || cfg.CredentialStore == want {
+		return
+	}
+	from := cfg.CredentialStore
+	if err := saveConfig(cfg); err != nil {
+		log.Printf("Moving the credential: %v", err)
+		return
+	}
+	if cfg.CredentialStore == from {
+		return // the store is unavailable; logged by storeCredential
+	}
+	if prev := credentialStoreNamed(from); prev != nil {
+		if err := prev.Delete(cfg.AgentID); err != nil {
+			log.Printf("Removing the credential from %s: %v", prev.Name(), err)
+		}
+	}
+	if cfg.CredentialStore == "" {
+		log.Printf("Credential moved to %s", configPath())
+	} else {
+		log.Printf("Credential moved to the platform credential store (%s)", cfg.CredentialStore)
+	}
+}
+
+// runSecretTool runs a store's command-line tool with stdin as its input,
+// returning its output without the trailing newline.
+func runSecretTool(stdin string, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), credentialStoreTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %w: %s", name, err, msg)
+		}
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import "fmt"
+
+// keychainService names the agent's keychain item.
+const keychainService = "com.avaropoint.rmm.agent"
+
+// keychainStore keeps the credential as a generic password in the
+// default keychain (the System keychain for an agent running as root),
+// through security(1).
+type keychainStore struct{}
+
+func platformCredentialStore() CredentialStore { return keychainStore{} }
+
+func (keychainStore) Name() string { return "keychain" }
+
+func (keychainStore) Get(agentID string) (string, error) {
+	return runSecretTool("", "security", "find-generic-password", "-s", keychainService, "-a", agentID, "-w")
+}
+
+// Set passes the credential on security's standard input (interactive
+// mode) rather than its arguments, which other processes can read.
+func (keychainStore) Set(agentID, credential string) error {
+	cmd := fmt.Sprintf("add-generic-password -U -s %q -a %q -l %q -w %q\n",
+		keychainService, agentID, "RMM agent credential", credential)
+	_, err := runSecretTool(cmd, "security", "-i")
+	return err
+}
+
+func (keychainStore) Delete(agentID string) error {
+	_, err := runSecretTool("", "security", "delete-generic-password", "-s", keychainService, "-a", agentID)
+	return err
+}
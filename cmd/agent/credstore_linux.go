@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// secretService is the attribute the agent's secret is filed under.
+const secretService = "rmm-agent"
+
+// secretServiceStore keeps the credential in the desktop's Secret Service
+// (GNOME Keyring, KWallet) through secret-tool(1), from libsecret.
+type secretServiceStore struct{}
+
+// platformCredentialStore returns the Secret Service when secret-tool is
+// installed and there is a session bus to reach it on; servers usually
+// have neither.
+func platformCredentialStore() CredentialStore {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return nil
+	}
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return nil
+	}
+	return secretServiceStore{}
+}
+
+func (secretServiceStore) Name() string { return "libsecret" }
+
+func (secretServiceStore) Get(agentID string) (string, error) {
+	return runSecretTool("", "secret-tool", "lookup", "service", secretService, "account", agentID)
+}
+
+// Set passes the credential on secret-tool's standard input.
+func (secretServiceStore) Set(agentID, credential string) error {
+	_, err := runSecretTool(credential, "secret-tool", "store", "--label=RMM agent credential",
+		"service", secretService, "account", agentID)
+	return err
+}
+
+func (secretServiceStore) Delete(agentID string) error {
+	_, err := runSecretTool("", "secret-tool", "clear", "service", secretService, "account", agentID)
+	return err
+}
@@ -0,0 +1,6 @@
+//go:build !darwin && !linux && !windows
+
+package main
+
+// platformCredentialStore returns nil: the credential stays in agent.json.
+func platformCredentialStore() CredentialStore { return nil }
@@ -0,0 +1,90 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	crypt32DLL             = syscall.NewLazyDLL("crypt32.dll")
+	procCryptProtectData   = crypt32DLL.NewProc("CryptProtectData")
+	procCryptUnprotectData = crypt32DLL.NewProc("CryptUnprotectData")
+	procLocalFree          = kernel32DLL.NewProc("LocalFree")
+)
+
+// cryptProtectUIForbidden fails rather than prompting when DPAPI would
+// need the user.
+const cryptProtectUIForbidden = 0x1
+
+// dataBlob is DATA_BLOB.
+type dataBlob struct {
+	size uint32
+	data *byte
+}
+
+func newDataBlob(b []byte) *dataBlob {
+	if len(b) == 0 {
+		return &dataBlob{}
+	}
+	return &dataBlob{size: uint32(len(b)), data: &b[0]}
+}
+
+// dpapiStore keeps the credential encrypted with DPAPI under the agent's
+// account (SYSTEM for the service) in credential.dpapi, next to
+// agent.json. The agent ID is the optional entropy, so the blob only
+// decrypts for the agent it belongs to.
+type dpapiStore struct{}
+
+func platformCredentialStore() CredentialStore { return dpapiStore{} }
+
+func (dpapiStore) Name() string { return "dpapi" }
+
+func dpapiPath() string {
+	return filepath.Join(filepath.Dir(configPath()), "credential.dpapi")
+}
+
+func (dpapiStore) Get(agentID string) (string, error) {
+	blob, err := os.ReadFile(dpapiPath())
+	if err != nil {
+		return "", err
+	}
+	plain, err := dpapiCall(procCryptUnprotectData, blob, []byte(agentID))
+	return string(plain), err
+}
+
+func (dpapiStore) Set(agentID, credential string) error {
+	blob, err := dpapiCall(procCryptProtectData, []byte(credential), []byte(agentID))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dpapiPath()), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(dpapiPath(), blob, 0600)
+}
+
+func (dpapiStore) Delete(string) error {
+	if err := os.Remove(dpapiPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// dpapiCall runs CryptProtectData or CryptUnprotectData, which take the
+// same arguments, on in.
+func dpapiCall(proc *syscall.LazyProc, in, entropy []byte) ([]byte, error) {
+	var out dataBlob
+	r, _, err := proc.Call(uintptr(unsafe.Pointer(newDataBlob(in))), 0,
+		uintptr(unsafe.Pointer(newDataBlob(entropy))), 0, 0, cryptProtectUIForbidden,
+		uintptr(unsafe.Pointer(&out)))
+	if r == 0 {
+		return nil, err
+	}
+	defer procLocalFree.Call(uintptr(unsafe.Pointer(out.data))) //nolint:errcheck
+	return append([]byte(nil), unsafe.Slice(out.data, out.size)...), nil
+}
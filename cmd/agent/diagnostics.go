@@ -0,0 +1,271 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+const (
+	// diagnosticsCommandTimeout bounds each command run for the archive.
+	diagnosticsCommandTimeout = 30 * time.Second
+
+	// maxDiagnosticsEntry bounds each file in the archive.
+	maxDiagnosticsEntry = 8 << 20
+
+	// diagnosticsChunkSize is the data carried per BinFile frame.
+	diagnosticsChunkSize = 64 << 10
+
+	// recentLogSize is how much of the agent's own log is kept in memory
+	// for diagnostics archives.
+	recentLogSize = 1 << 20
+)
+
+// recentLog keeps the tail of the agent's log output (see main).
+var recentLog = &logTail{max: recentLogSize}
+
+// logTail is an io.Writer that keeps the last max bytes written to it.
+type logTail struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func (t *logTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+func (t *logTail) bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte(nil), t.buf...)
+}
+
+// diagnosticsSource is one file in the archive: the output of a command,
+// or a copy of a file on disk.
+type diagnosticsSource struct {
+	name string   // path in the archive
+	args []string // command to run
+	path string   // or file to copy
+}
+
+// diagnosticsSources lists the event logs and network configuration
+// collected on this platform.
+func diagnosticsSources() []diagnosticsSource {
+	switch runtime.GOOS {
+	case "windows":
+		root := os.Getenv("SystemRoot")
+		return []diagnosticsSource{
+			{name: "events/system.txt", args: []string{"wevtutil", "qe", "System", "/c:500", "/rd:true", "/f:text"}},
+			{name: "events/application.txt", args: []string{"wevtutil", "qe", "Application", "/c:500", "/rd:true", "/f:text"}},
+			{name: "network/ipconfig.txt", args: []string{"ipconfig", "/all"}},
+			{name: "network/routes.txt", args: []string{"route", "print"}},
+			{name: "network/netstat.txt", args: []string{"netstat", "-ano"}},
+			{name: "network/hosts", path: filepath.Join(root, "System32", "drivers", "etc", "hosts")},
+		}
+	case "darwin":
+		return []diagnosticsSource{
+			{name: "events/errors.txt", args: []string{"log", "show", "--last", "1h", "--style", "syslog",
+				"--predicate", "messageType == error OR messageType == fault"}},
+			{name: "network/ifconfig.txt", args: []string{"ifconfig", "-a"}},
+			{name: "network/routes.txt", args: []string{"netstat", "-rn"}},
+			{name: "network/netstat.txt", args: []string{"netstat", "-an"}},
+			{name: "network/dns.txt", args: []string{"scutil", "--dns"}},
+			{name: "network/hosts", path: "/etc/hosts"},
+		}
+	}
+	sources := []diagnosticsSource{
+		{name: "events/kernel.txt", args: []string{"dmesg"}},
+		{name: "network/addresses.txt", args: []string{"ip", "addr"}},
+		{name: "network/routes.txt", args: []string{"ip", "route"}},
+		{name: "network/sockets.txt", args: []string{"ss", "-tuanp"}},
+		{name: "network/resolv.conf", path: "/etc/resolv.conf"},
+		{name: "network/hosts", path: "/etc/hosts"},
+	}
+	if _, err := exec.LookPath("journalctl"); err == nil {
+		sources = append(sources, diagnosticsSource{name: "events/journal.txt",
+			args: []string{"journalctl", "--no-pager", "-o", "short-iso", "-n", "2000"}})
+	} else {
+		for _, p := range []string{"/var/log/syslog", "/var/log/messages"} {
+			if _, err := os.Stat(p); err == nil {
+				sources = append(sources, diagnosticsSource{name: "events/" + filepath.Base(p), path: p})
+				break
+			}
+		}
+	}
+	return sources
+}
+
+// handleCollectDiagnostics builds a diagnostics archive and uploads it
+// to the server, one at a time.
+func (a *Agent) handleCollectDiagnostics(payload json.RawMessage) {
+	var req protocol.DiagnosticsRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+	fail := func(err error) {
+		log.Printf("Diagnostics collection failed: %v", err)
+		data, _ := json.Marshal(protocol.DiagnosticsResult{ID: req.ID, Error: err.Error()})
+		_ = a.sendMessage(protocol.Message{Type: "diagnostics_result", Payload: data})
+	}
+	if !a.diagnosing.CompareAndSwap(false, true) {
+		fail(errors.New("a collection is already in progress"))
+		return
+	}
+	credit := a.uploadCredit
+
+	go func() {
+		defer a.diagnosing.Store(false)
+		path, err := buildDiagnosticsArchive()
+		if err != nil {
+			fail(err)
+			return
+		}
+		defer os.Remove(path) //nolint:errcheck
+		if err := a.uploadDiagnostics(req.ID, path, credit); err != nil {
+			fail(err)
+			return
+		}
+		log.Printf("Diagnostics archive uploaded")
+	}()
+}
+
+// buildDiagnosticsArchive writes the archive to a temp file and returns
+// its path. Sources that fail are recorded in the archive, not fatal.
+func buildDiagnosticsArchive() (string, error) {
+	f, err := os.CreateTemp("", "rmm-diagnostics-*.tar.gz")
+	if err != nil {
+		return "", err
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	add := func(name string, data []byte) error {
+		if len(data) > maxDiagnosticsEntry {
+			data = data[len(data)-maxDiagnosticsEntry:] // keep the most recent
+		}
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	err = add("agent.log", recentLog.bytes())
+	if err == nil {
+		system, _ := json.MarshalIndent(collectSupportBundle(), "", "  ")
+		err = add("system.json", system)
+	}
+	for _, src := range diagnosticsSources() {
+		if err != nil {
+			break
+		}
+		err = add(src.name, collectDiagnosticsSource(src))
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// collectDiagnosticsSource returns a source's content, followed by the
+// error if it could not be collected in full.
+func collectDiagnosticsSource(src diagnosticsSource) []byte {
+	if src.path != "" {
+		data, err := os.ReadFile(src.path)
+		if err != nil {
+			return []byte(fmt.Sprintf("[%v]\n", err))
+		}
+		return data
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsCommandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, src.args[0], src.args[1:]...).CombinedOutput()
+	if err != nil {
+		out = fmt.Appendf(out, "\n[%s: %v]\n", strings.Join(src.args, " "), err)
+	}
+	return out
+}
+
+// uploadDiagnostics sends the archive over the file channel, spending
+// upload credit when the server paces it.
+func (a *Agent) uploadDiagnostics(id, path string, credit *protocol.Credit) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint:errcheck
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > protocol.MaxDiagnosticsSize {
+		return fmt.Errorf("archive is %d bytes, over the %d byte limit", info.Size(), protocol.MaxDiagnosticsSize)
+	}
+
+	start, _ := json.Marshal(protocol.FileStart{
+		ID:      id,
+		Name:    fmt.Sprintf("diagnostics-%s-%s.tar.gz", getHostname(), time.Now().UTC().Format("20060102-150405")),
+		Size:    info.Size(),
+		Purpose: protocol.FilePurposeDiagnostics,
+	})
+	if err := a.sendMessage(protocol.Message{Type: "file_start", Payload: start}); err != nil {
+		return err
+	}
+	h := sha256.New()
+	buf := make([]byte, diagnosticsChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			frame := protocol.FileChunk(buf[:n])
+			if credit != nil && !credit.Spend(len(frame)) {
+				return net.ErrClosed
+			}
+			if err := a.sendBinary(frame); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	end, _ := json.Marshal(protocol.FileEnd{ID: id, SHA256: hex.EncodeToString(h.Sum(nil))})
+	return a.sendMessage(protocol.Message{Type: "file_end", Payload: end})
+}
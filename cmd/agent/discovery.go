@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/mdns"
+)
+
+// Server discovery: instead of a fixed URL, an agent can be given a
+// domain whose DNS names the servers. The SRV records of _rmm._tcp.<domain>
+// list them; the agent tries them in priority order, spreading load across
+// equal priorities by weight (RFC 2782), and fails over down the list. An
+// optional TXT record on the same name sets "path=/prefix" when the server
+// is mounted under a path. Servers discovered through DNS are always
+// reached over TLS.
+//
+// The servers of a domain must present certificates the agent trusts: the
+// CA it received at enrollment, or a public CA.
+//
+// The domain "local" browses the local link over mDNS instead, for
+// networks without DNS: servers with "mdns" in their config answer with
+// their address, port, whether they use TLS and their platform
+// fingerprint. Enrollment refuses to guess when more than one server
+// answers. Once enrolled, the agent only considers servers with its
+// platform's fingerprint, so other deployments on the link are ignored.
+
+// discoveryService and discoveryProto name the SRV records.
+const (
+	discoveryService = "rmm"
+	discoveryProto   = "tcp"
+)
+
+const (
+	// localDomain selects mDNS browsing.
+	localDomain = "local"
+	// browseWait is how long the agent collects mDNS answers.
+	browseWait = 2 * time.Second
+)
+
+// discoverServers returns the WebSocket URLs of the servers domain
+// publishes, in the order to try them. For the local domain, a non-empty
+// fingerprint limits them to one platform's servers.
+func discoverServers(domain, fingerprint string) ([]string, error) {
+	if domain == localDomain {
+		return browseServers(fingerprint)
+	}
+	// LookupSRV sorts by priority and shuffles by weight.
+	_, srvs, err := net.LookupSRV(discoveryService, discoveryProto, domain)
+	if err != nil {
+		return nil, err
+	}
+	path := discoveryPath(domain)
+	var urls []string
+	for _, srv := range srvs {
+		target := strings.TrimSuffix(srv.Target, ".")
+		if target == "" {
+			continue // "." declares the service unavailable
+		}
+		urls = append(urls, "wss://"+net.JoinHostPort(target, strconv.Itoa(int(srv.Port)))+path)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no servers published for %s", domain)
+	}
+	return urls, nil
+}
+
+// discoveryPath returns the path prefix the domain's TXT record sets, or
+// "". A missing record is not an error.
+func discoveryPath(domain string) string {
+	txts, err := net.LookupTXT("_" + discoveryService + "._" + discoveryProto + "." + domain)
+	if err != nil {
+		return ""
+	}
+	for _, txt := range txts {
+		for _, field := range strings.Fields(txt) {
+			if p, ok := strings.CutPrefix(field, "path="); ok && strings.HasPrefix(p, "/") {
+				return strings.TrimRight(p, "/")
+			}
+		}
+	}
+	return ""
+}
+
+// browseServers finds servers on the local link over mDNS, in the order
+// they answered.
+func browseServers(fingerprint string) ([]string, error) {
+	services, err := mdns.Browse(context.Background(), "_"+discoveryService+"._"+discoveryProto, browseWait)
+	if err != nil {
+		return nil, err
+	}
+	var urls []string
+	for _, svc := range services {
+		fp := mdns.TextValue(svc.Text, "fp")
+		if fingerprint != "" && fp != fingerprint {
+			continue
+		}
+		scheme := "wss://"
+		if mdns.TextValue(svc.Text, "tls") == "0" {
+			scheme = "ws://"
+		}
+		u := scheme + net.JoinHostPort(svc.Addr.String(), strconv.Itoa(svc.Port))
+		if fingerprint == "" {
+			log.Printf("Found %s at %s (platform %s)", strings.TrimSuffix(svc.Instance, "."), u, fp)
+		}
+		urls = append(urls, u)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no servers answered on the local link")
+	}
+	return urls, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// displayPollInterval is how often the agent re-enumerates displays to
+// notice monitors being plugged in or removed. Enumeration shells out
+// (xrandr, system_profiler, PowerShell), so it is not done per frame.
+const displayPollInterval = 15 * time.Second
+
+// displays caches the last enumerated display list for capture and
+// screenshots. It is filled at registration and refreshed by
+// watchDisplays.
+var displays struct {
+	mu     sync.Mutex
+	list   []protocol.DisplayInfo
+	primed bool
+}
+
+// setDisplays records list as the current displays and reports whether
+// it differs from the previous list.
+func setDisplays(list []protocol.DisplayInfo) bool {
+	displays.mu.Lock()
+	defer displays.mu.Unlock()
+	changed := displays.primed && !slices.Equal(displays.list, list)
+	displays.list, displays.primed = list, true
+	return changed
+}
+
+// getDisplayCount returns the number of displays capture can switch
+// between. Only macOS captures displays individually; elsewhere the
+// capture covers one screen, so the count is 1.
+func getDisplayCount() int {
+	if runtime.GOOS != "darwin" {
+		return 1
+	}
+	displays.mu.Lock()
+	primed, n := displays.primed, len(displays.list)
+	displays.mu.Unlock()
+	if !primed {
+		list := listDisplays()
+		setDisplays(list)
+		n = len(list)
+	}
+	return max(n, 1)
+}
+
+// watchDisplays re-enumerates displays every displayPollInterval until
+// done is closed. On a change it moves capture back to the first display
+// if the current one is gone, and sends "displays_changed" so the server
+// and viewer pick up the new list.
+func (a *Agent) watchDisplays(done <-chan struct{}) {
+	ticker := time.NewTicker(displayPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		list := listDisplays()
+		if !setDisplays(list) {
+			continue
+		}
+
+		count := getDisplayCount()
+		a.captureMu.Lock()
+		if a.currentDisplay > count {
+			a.currentDisplay = 1
+		}
+		a.captureMu.Unlock()
+
+		log.Printf("Displays changed: %d connected", len(list))
+		payload, _ := json.Marshal(protocol.DisplaysChanged{Displays: list, DisplayCount: max(len(list), 1)})
+		_ = a.sendMessage(protocol.Message{Type: "displays_changed", Payload: payload})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dropboxDir is where files delivered from the server's drop-box are
+// saved: the user's Downloads folder, or the agent's config directory
+// when there is none (e.g. a service account).
+func dropboxDir() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		dir := filepath.Join(home, "Downloads")
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return filepath.Join(filepath.Dir(configPath()), "dropbox")
+}
+
+// saveDropboxFile moves a received temp file in dir to its final name,
+// adding " (n)" before the extension rather than overwriting an existing
+// file. It returns the saved path.
+func saveDropboxFile(tmp, dir, name string) (string, error) {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" || name == ".." || strings.HasPrefix(name, ".rmm-upload-") {
+		name = "download"
+	}
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	for n := 0; n < 1000; n++ {
+		candidate := name
+		if n > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+		}
+		path := filepath.Join(dir, candidate)
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			return path, os.Rename(tmp, path)
+		}
+	}
+	return "", fmt.Errorf("no free file name for %s in %s", name, dir)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"math"
+)
+
+// Frames are compressed in-process with image/jpeg, from the lossless
+// capture grabDisplay returns, so quality and size are the agent's to
+// choose whichever platform it captures on: -jpeg-quality sets
+// the quality, and -capture-max-size scales large displays down to fit,
+// keeping their aspect ratio, so a 5K Retina display streams at about the
+// cost of a 1080p one. The viewer can ask for full resolution for the
+// rest of a session ("set_resolution"); its input arrives in frame
+// pixels, so the agent maps it back onto the display (frameGeometry).
+
+// defaultCaptureMaxSize is the longest side of live frames without
+// -capture-max-size.
+const defaultCaptureMaxSize = 1920
+
+// frameSettings are how live frames are encoded.
+type frameSettings struct {
+	quality  int  // JPEG quality, 1–100
+	maxSize  int  // longest side of a scaled frame; 0 keeps full size
+	lossless bool // send changed tiles, text losslessly (see tiles.go)
+}
+
+// scale returns img scaled down to fit maxSize, or img itself when it
+// fits, scaling is off or full resolution is asked for.
+func (f frameSettings) scale(img image.Image, full bool) image.Image {
+	b := img.Bounds()
+	if full || f.maxSize <= 0 || (b.Dx() <= f.maxSize && b.Dy() <= f.maxSize) {
+		return img
+	}
+	return scaleDown(img, f.maxSize, f.maxSize)
+}
+
+// frameGeometry relates the frames sent to the display they show.
+type frameGeometry struct {
+	screen image.Point // the display's size, in pixels
+	frame  image.Point // the frames' size
+}
+
+// toScreen maps a point in frame pixels, where the viewer's input is,
+// onto the display; nil or unscaled geometry leaves it unchanged.
+func (g *frameGeometry) toScreen(x, y int) (int, int) {
+	if g == nil || g.frame == g.screen || g.frame.X == 0 || g.frame.Y == 0 {
+		return x, y
+	}
+	return x * g.screen.X / g.frame.X, y * g.screen.Y / g.frame.Y
+}
+
+// encodeJPEG JPEG-encodes img at quality after header.
+func encodeJPEG(header []byte, img image.Image, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	b := img.Bounds()
+	buf.Grow(len(header) + b.Dx()*b.Dy()/4) // roughly the size of the JPEG
+	buf.Write(header)
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fitSize returns the size of a width × height image scaled down, keeping
+// its aspect ratio, to fit maxWidth × maxHeight; a zero limit is none.
+func fitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	f := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		f = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		f = min(f, float64(maxHeight)/float64(height))
+	}
+	if f == 1 {
+		return width, height
+	}
+	return max(1, int(math.Round(float64(width)*f))), max(1, int(math.Round(float64(height)*f)))
+}
+
+// scaleDown converts img to RGBA and scales it down to fit maxWidth ×
+// maxHeight (zero: no limit), keeping its aspect ratio. Each pixel is the
+// average of the block of source pixels it covers, so text stays legible
+// rather than aliasing.
+func scaleDown(img image.Image, maxWidth, maxHeight int) *image.RGBA {
+	b := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Rect, img, b.Min, draw.Src)
+	}
+
+	sw, sh := b.Dx(), b.Dy()
+	w, h := fitSize(sw, sh, maxWidth, maxHeight)
+	if w == sw && h == sh {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			var sum [4]uint32
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += uint32(row[i])
+					sum[1] += uint32(row[i+1])
+					sum[2] += uint32(row[i+2])
+					sum[3] += uint32(row[i+3])
+				}
+			}
+			n := uint32((x1 - x0) * (y1 - y0))
+			o := y*dst.Stride + x*4
+			for c := range sum {
+				dst.Pix[o+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
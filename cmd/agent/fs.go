@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// errOutsideRoot is returned for paths that resolve outside the policy
+// directory the server matched them against, e.g. through a symlink.
+var errOutsideRoot = errors.New("path is outside the allowed directory")
+
+// handleFSRequest runs a file system command off the message loop and
+// reports the result. The server has already checked Path against its
+// policy; the agent re-checks it after resolving symlinks.
+func (a *Agent) handleFSRequest(op string, payload json.RawMessage) {
+	var req protocol.FSRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	go func() {
+		res := protocol.FSResult{ID: req.ID}
+		if err := runFSCommand(op, req, &res); err != nil {
+			res.Error = err.Error()
+		}
+		if op != protocol.FSList && op != protocol.FSStat {
+			log.Printf("File system %s %s: err=%v", op, req.Path, res.Error)
+		}
+		data, _ := json.Marshal(res)
+		_ = a.sendMessage(protocol.Message{Type: "fs_result", Payload: data})
+	}()
+}
+
+func runFSCommand(op string, req protocol.FSRequest, res *protocol.FSResult) error {
+	path, err := confine(req.Root, req.Path)
+	if err != nil {
+		return err
+	}
+
+	switch op {
+	case protocol.FSList:
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		res.Entries = make([]protocol.FSEntry, 0, len(entries))
+		for _, e := range entries {
+			if info, err := e.Info(); err == nil {
+				res.Entries = append(res.Entries, fsEntry(filepath.Join(path, e.Name()), info))
+			}
+		}
+		return nil
+
+	case protocol.FSStat:
+		return statInto(path, res)
+
+	case protocol.FSMkdir:
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		return statInto(path, res)
+
+	case protocol.FSDelete:
+		if sameFile(path, req.Root) {
+			return errors.New("refusing to delete the allowed directory itself")
+		}
+		if req.Recursive {
+			return os.RemoveAll(path)
+		}
+		return os.Remove(path)
+
+	case protocol.FSRename:
+		dest, err := confine(req.NewRoot, req.NewPath)
+		if err != nil {
+			return err
+		}
+		if sameFile(path, req.Root) {
+			return errors.New("refusing to move the allowed directory itself")
+		}
+		if _, err := os.Lstat(dest); err == nil {
+			return fmt.Errorf("%s already exists", dest)
+		}
+		if err := os.Rename(path, dest); err != nil {
+			return err
+		}
+		return statInto(dest, res)
+	}
+	return fmt.Errorf("unknown file system command %q", op)
+}
+
+// confine cleans path and checks that it lies within root once symlinks
+// are resolved. Paths that do not exist yet (mkdir and rename targets)
+// are checked through their deepest existing ancestor.
+func confine(root, path string) (string, error) {
+	if root == "" || !filepath.IsAbs(path) {
+		return "", errOutsideRoot
+	}
+	path = filepath.Clean(path)
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	if !within(realRoot, resolveExisting(path)) {
+		return "", errOutsideRoot
+	}
+	return path, nil
+}
+
+// resolveExisting resolves symlinks in the longest existing prefix of
+// path and appends the remainder unchanged.
+func resolveExisting(path string) string {
+	var rest []string
+	for p := path; ; p = filepath.Dir(p) {
+		if real, err := filepath.EvalSymlinks(p); err == nil {
+			return filepath.Join(append([]string{real}, rest...)...)
+		}
+		if filepath.Dir(p) == p {
+			return path
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+	}
+}
+
+// within reports whether path is root or below it. Windows paths compare
+// case-insensitively.
+func within(root, path string) bool {
+	if runtime.GOOS == "windows" {
+		root, path = strings.ToLower(root), strings.ToLower(path)
+	}
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// sameFile reports whether a and b resolve to the same location.
+func sameFile(a, b string) bool {
+	ra, rb := resolveExisting(filepath.Clean(a)), resolveExisting(filepath.Clean(b))
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(ra, rb)
+	}
+	return ra == rb
+}
+
+func statInto(path string, res *protocol.FSResult) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	entry := fsEntry(path, info)
+	res.Entry = &entry
+	return nil
+}
+
+// fsEntry describes info, following a symlink for its size and type.
+func fsEntry(path string, info fs.FileInfo) protocol.FSEntry {
+	symlink := info.Mode()&fs.ModeSymlink != 0
+	if symlink {
+		if target, err := os.Stat(path); err == nil {
+			info = target
+		}
+	}
+	return protocol.FSEntry{
+		Name:    filepath.Base(path),
+		Path:    path,
+		IsDir:   info.IsDir(),
+		Size:    info.Size(),
+		Mode:    info.Mode().String(),
+		ModTime: info.ModTime(),
+		Symlink: symlink,
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Gateway streams relay TCP connections from the agent to hosts on its
+// network (see protocol.GatewayOpen). The server decides which hosts and
+// ports an operator may reach; the agent only connects and copies bytes.
+
+// gatewayDialTimeout bounds how long the agent tries to reach a target.
+const gatewayDialTimeout = 10 * time.Second
+
+// gatewayStream is one relayed connection.
+type gatewayStream struct {
+	conn   net.Conn
+	credit *protocol.Credit // paces data to the server
+
+	mu     sync.Mutex
+	ready  *sync.Cond
+	queue  []byte // data from the server not yet written to conn
+	owed   int    // credit to grant back once queue is written
+	closed bool
+}
+
+// gatewaySet tracks the agent's open streams.
+type gatewaySet struct {
+	mu      sync.Mutex
+	streams map[uint32]*gatewayStream
+}
+
+func (g *gatewaySet) add(id uint32, st *gatewayStream) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, dup := g.streams[id]; dup {
+		return fmt.Errorf("stream %d is already open", id)
+	}
+	if g.streams == nil {
+		g.streams = make(map[uint32]*gatewayStream)
+	}
+	g.streams[id] = st
+	return nil
+}
+
+func (g *gatewaySet) get(id uint32) *gatewayStream {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.streams[id]
+}
+
+// remove takes a stream out of the set, reporting false if it was not
+// there (already closed).
+func (g *gatewaySet) remove(id uint32) (*gatewayStream, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st, ok := g.streams[id]
+	delete(g.streams, id)
+	return st, ok
+}
+
+// closeAll closes every stream, when the server connection is gone.
+func (g *gatewaySet) closeAll() {
+	g.mu.Lock()
+	streams := g.streams
+	g.streams = nil
+	g.mu.Unlock()
+	for _, st := range streams {
+		st.close()
+	}
+}
+
+// close stops the stream's writer and closes its connection.
+func (st *gatewayStream) close() {
+	st.mu.Lock()
+	st.closed = true
+	st.mu.Unlock()
+	st.ready.Broadcast()
+	st.credit.Close()
+	_ = st.conn.Close()
+}
+
+// handleGatewayOpen connects a new stream to its target off the message
+// loop and relays it until either side closes.
+func (a *Agent) handleGatewayOpen(payload json.RawMessage) {
+	var req protocol.GatewayOpen
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	go func() {
+		target := net.JoinHostPort(req.Host, strconv.Itoa(req.Port))
+		res := protocol.GatewayResult{ID: req.ID}
+		var st *gatewayStream
+		conn, err := net.DialTimeout("tcp", target, gatewayDialTimeout)
+		if err == nil {
+			st = &gatewayStream{conn: conn, credit: protocol.NewCredit()}
+			st.ready = sync.NewCond(&st.mu)
+			if err = a.gateways.add(req.Stream, st); err != nil {
+				_ = conn.Close()
+			}
+		}
+		if err != nil {
+			res.Error = err.Error()
+			log.Printf("Gateway to %s for %s failed: %v", target, req.Operator, err)
+		} else {
+			log.Printf("Gateway stream %d to %s opened for %s", req.Stream, target, req.Operator)
+		}
+		data, _ := json.Marshal(res)
+		_ = a.sendMessage(protocol.Message{Type: "gateway_result", Payload: data})
+		if err != nil {
+			return
+		}
+
+		go st.writeLoop(a, req.Stream)
+		a.gatewayReadLoop(req.Stream, st)
+	}()
+}
+
+// gatewayReadLoop copies data from the target to the server, against the
+// stream's credit, until the target closes.
+func (a *Agent) gatewayReadLoop(id uint32, st *gatewayStream) {
+	buf := make([]byte, protocol.GatewayChunkSize)
+	var reason error
+	for {
+		n, err := st.conn.Read(buf)
+		if n > 0 {
+			frame := protocol.GatewayFrame(id, buf[:n])
+			if !st.credit.Spend(len(frame)) {
+				return // closed from the server side
+			}
+			if err := a.sendBinary(frame); err != nil {
+				reason = err
+				break
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				reason = err
+			}
+			break
+		}
+	}
+	a.closeGateway(id, reason, true)
+}
+
+// writeLoop writes data queued by handleGatewayData to the target and
+// grants its credit back to the server.
+func (st *gatewayStream) writeLoop(a *Agent, id uint32) {
+	for {
+		st.mu.Lock()
+		for len(st.queue) == 0 && !st.closed {
+			st.ready.Wait()
+		}
+		if st.closed {
+			st.mu.Unlock()
+			return
+		}
+		data, owed := st.queue, st.owed
+		st.queue, st.owed = nil, 0
+		st.mu.Unlock()
+
+		if _, err := st.conn.Write(data); err != nil {
+			a.closeGateway(id, err, true)
+			return
+		}
+		_ = a.sendBinary(protocol.GatewayCreditGrant(id, owed))
+	}
+}
+
+// handleGatewayData queues a BinGateway frame from the server for its
+// stream's target. The server's credit bounds the queue.
+func (a *Agent) handleGatewayData(frame []byte) {
+	id, data, err := protocol.ParseGatewayFrame(frame)
+	if err != nil {
+		return
+	}
+	st := a.gateways.get(id)
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	st.queue = append(st.queue, data...)
+	st.owed += len(frame)
+	st.mu.Unlock()
+	st.ready.Signal()
+}
+
+// handleGatewayCredit applies a credit grant on a gateway stream.
+func (a *Agent) handleGatewayCredit(stream uint32, n int) {
+	if st := a.gateways.get(stream); st != nil {
+		st.credit.Grant(n)
+	}
+}
+
+// handleGatewayClose closes a stream the server has ended.
+func (a *Agent) handleGatewayClose(payload json.RawMessage) {
+	var req protocol.GatewayClose
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+	a.closeGateway(req.Stream, nil, false)
+}
+
+// closeGateway closes a stream once, telling the server when the agent
+// side ended it.
+func (a *Agent) closeGateway(id uint32, reason error, notify bool) {
+	st, ok := a.gateways.remove(id)
+	if !ok {
+		return
+	}
+	st.close()
+	log.Printf("Gateway stream %d closed", id)
+	if !notify {
+		return
+	}
+	msg := protocol.GatewayClose{Stream: id}
+	if reason != nil {
+		msg.Error = reason.Error()
+	}
+	data, _ := json.Marshal(msg)
+	_ = a.sendMessage(protocol.Message{Type: "gateway_close", Payload: data})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// healthSampler turns the platform's cumulative CPU counters into CPU use
+// between heartbeats. The zero value is ready to use; the first call only
+// records a baseline, so its CPU figure is zero.
+type healthSampler struct {
+	busy, total uint64
+	primed      bool
+}
+
+// sample returns the machine's current health for a heartbeat. CPU stays
+// zero when the platform's counters cannot be read.
+func (h *healthSampler) sample() *protocol.Health {
+	var hl protocol.Health
+	hl.MemoryFree, hl.DiskFree = freeResources()
+	busy, total, err := cpuTimes()
+	if err != nil {
+		return &hl
+	}
+	if h.primed && total > h.total {
+		// Counters can step back on macOS (see cpuTimes); clamp rather
+		// than report a negative share.
+		pct := (float64(busy) - float64(h.busy)) / float64(total-h.total) * 100
+		hl.CPU = math.Round(max(0, min(pct, 100))*10) / 10
+	}
+	h.busy, h.total, h.primed = busy, total, true
+	return &hl
+}
@@ -0,0 +1,35 @@
+//go:build darwin
+
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// cpuEpoch anchors the wall-clock side of cpuTimes.
+var cpuEpoch = time.Now()
+
+// cpuTimes estimates CPU counters in nanoseconds, since the host counters
+// are not reachable without cgo: busy is the CPU time of the processes
+// running now, total the wall time since cpuEpoch on every core.
+// Processes that exit take their CPU time with them, so the estimate can
+// read low, or step back between samples.
+func cpuTimes() (busy, total uint64, err error) {
+	procs, err := listProcesses()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, p := range procs {
+		busy += uint64(p.CPUTime)
+	}
+	total = uint64(time.Since(cpuEpoch)) * uint64(runtime.NumCPU())
+	return busy, total, nil
+}
+
+// freeResources returns available memory and free space on /.
+func freeResources() (memory, disk uint64) {
+	_, memory = macOSMemory()
+	_, disk = diskUsage("/")
+	return memory, disk
+}
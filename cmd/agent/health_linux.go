@@ -0,0 +1,41 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cpuTimes reads the aggregate "cpu" line of /proc/stat, in clock ticks.
+// Busy is everything but idle and iowait; guest time is already included
+// in user time, so the guest columns are skipped.
+func cpuTimes() (busy, total uint64, err error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, errors.New("unexpected /proc/stat format")
+	}
+	var idle uint64
+	for i, f := range fields[1:min(len(fields), 9)] {
+		v, _ := strconv.ParseUint(f, 10, 64)
+		total += v
+		if i == 3 || i == 4 { // idle, iowait
+			idle += v
+		}
+	}
+	return total - idle, total, nil
+}
+
+// freeResources returns available memory and free space on /.
+func freeResources() (memory, disk uint64) {
+	_, memory = linuxMemory()
+	_, disk = diskUsage("/")
+	return memory, disk
+}
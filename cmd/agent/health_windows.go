@@ -0,0 +1,58 @@
+//go:build windows
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Heartbeats read health through the API rather than WMI, which costs a
+// PowerShell process per call.
+var (
+	procGetSystemTimes       = kernel32DLL.NewProc("GetSystemTimes")
+	procGlobalMemoryStatusEx = kernel32DLL.NewProc("GlobalMemoryStatusEx")
+	procGetDiskFreeSpaceExW  = kernel32DLL.NewProc("GetDiskFreeSpaceExW")
+)
+
+// memoryStatusEx is MEMORYSTATUSEX.
+type memoryStatusEx struct {
+	length               uint32
+	memoryLoad           uint32
+	totalPhys            uint64
+	availPhys            uint64
+	totalPageFile        uint64
+	availPageFile        uint64
+	totalVirtual         uint64
+	availVirtual         uint64
+	availExtendedVirtual uint64
+}
+
+// cpuTimes reads the system CPU times, in 100 ns units. Kernel time
+// includes idle time.
+func cpuTimes() (busy, total uint64, err error) {
+	var idle, kernel, user syscall.Filetime
+	r, _, e := procGetSystemTimes.Call(uintptr(unsafe.Pointer(&idle)),
+		uintptr(unsafe.Pointer(&kernel)), uintptr(unsafe.Pointer(&user)))
+	if r == 0 {
+		return 0, 0, e
+	}
+	total = uint64(filetimeTicks(kernel) + filetimeTicks(user))
+	return total - uint64(filetimeTicks(idle)), total, nil
+}
+
+// freeResources returns available physical memory and free space on C:.
+func freeResources() (memory, disk uint64) {
+	var ms memoryStatusEx
+	ms.length = uint32(unsafe.Sizeof(ms))
+	if r, _, _ := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&ms))); r != 0 {
+		memory = ms.availPhys
+	}
+	root, _ := syscall.UTF16PtrFromString(`C:\`)
+	var avail, size, free uint64
+	if r, _, _ := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(root)), uintptr(unsafe.Pointer(&avail)),
+		uintptr(unsafe.Pointer(&size)), uintptr(unsafe.Pointer(&free))); r != 0 {
+		disk = free
+	}
+	return memory, disk
+}
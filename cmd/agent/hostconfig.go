@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Host configuration: the hosts file and system-wide environment
+// variables. The server enforces the write policy and records the diffs;
+// the agent reads and writes them where the OS keeps them.
+
+// windowsEnvKey holds the machine-wide environment on Windows.
+const windowsEnvKey = `HKLM\SYSTEM\CurrentControlSet\Control\Session Manager\Environment`
+
+// linuxEnvFile holds the system-wide environment read by pam_env on Linux.
+const linuxEnvFile = "/etc/environment"
+
+// handleHostConfigRequest runs a host configuration request off the
+// message loop and reports the target as it stands afterwards.
+func (a *Agent) handleHostConfigRequest(payload json.RawMessage) {
+	var req protocol.HostConfigRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	go func() {
+		res := protocol.HostConfigResult{ID: req.ID}
+		var err error
+		switch {
+		case req.Op != protocol.HostConfigRead && req.Op != protocol.HostConfigWrite:
+			err = fmt.Errorf("unknown operation %q", req.Op)
+		case req.Target == protocol.HostConfigHosts:
+			if req.Op == protocol.HostConfigWrite {
+				err = writeHosts(req.Hosts, req.Digest)
+				log.Printf("Hosts file write: err=%v", err)
+			}
+			if err == nil {
+				res.Path = hostsPath()
+				res.Hosts, err = readHosts()
+				res.Digest = protocol.HostsDigest(res.Hosts)
+			}
+		case req.Target == protocol.HostConfigEnvironment:
+			if req.Op == protocol.HostConfigWrite {
+				err = writeEnvironment(req.Environment)
+				log.Printf("Environment write (%d variables): err=%v", len(req.Environment), err)
+			}
+			if err == nil {
+				res.Path, res.Environment, err = readEnvironment()
+			}
+		default:
+			err = fmt.Errorf("unknown target %q", req.Target)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		data, _ := json.Marshal(res)
+		_ = a.sendMessage(protocol.Message{Type: "hostconfig_result", Payload: data})
+	}()
+}
+
+// hostsPath is where the OS keeps the hosts file.
+func hostsPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("SystemRoot"), "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+func readHosts() (string, error) {
+	data, err := os.ReadFile(hostsPath())
+	if err != nil {
+		return "", err
+	}
+	if len(data) > protocol.MaxHostsFileSize {
+		return "", fmt.Errorf("hosts file is larger than %d bytes", protocol.MaxHostsFileSize)
+	}
+	return string(data), nil
+}
+
+// writeHosts replaces the hosts file, keeping its permissions. The new
+// content is written next to it and renamed into place, so resolvers
+// never see a partial file.
+func writeHosts(content, digest string) error {
+	if len(content) > protocol.MaxHostsFileSize {
+		return fmt.Errorf("hosts file content is larger than %d bytes", protocol.MaxHostsFileSize)
+	}
+	current, err := readHosts()
+	if err != nil {
+		return err
+	}
+	if digest != "" && protocol.HostsDigest(current) != digest {
+		return errors.New("hosts file has changed since it was read")
+	}
+	path := hostsPath()
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".hosts-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(content)
+	if err == nil {
+		err = f.Chmod(info.Mode().Perm())
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// readEnvironment returns the system-wide environment variables and
+// where they are stored, with the values of likely secrets redacted.
+func readEnvironment() (string, map[string]string, error) {
+	var env map[string]string
+	var path string
+	switch runtime.GOOS {
+	case "windows":
+		out, err := runSettingsTool("reg", "query", windowsEnvKey)
+		if err != nil {
+			return "", nil, err
+		}
+		env, path = parseRegValues(out), windowsEnvKey
+	case "linux":
+		data, err := os.ReadFile(linuxEnvFile)
+		if err != nil && !os.IsNotExist(err) {
+			return "", nil, err
+		}
+		env, path = make(map[string]string), linuxEnvFile
+		for _, line := range strings.Split(string(data), "\n") {
+			if name, value, ok := parseEnvLine(line); ok {
+				env[name] = value
+			}
+		}
+	default:
+		return "", collectEnvironment(), nil
+	}
+	for name := range env {
+		if protocol.SecretEnvName(name) {
+			env[name] = "[redacted]"
+		}
+	}
+	return path, env, nil
+}
+
+// writeEnvironment sets or, for nil values, removes system-wide
+// environment variables. Processes pick the changes up when they next
+// start (on Windows, after the next sign-in for the desktop).
+func writeEnvironment(changes map[string]*string) error {
+	for name, value := range changes {
+		if name == "" || strings.ContainsAny(name, "= \t\r\n\x00") || strings.HasPrefix(name, "-") || strings.HasPrefix(name, "/") {
+			return fmt.Errorf("invalid variable name %q", name)
+		}
+		if value != nil && strings.ContainsAny(*value, "\r\n\x00") {
+			return fmt.Errorf("invalid value for %s", name)
+		}
+	}
+	switch runtime.GOOS {
+	case "windows":
+		for name, value := range changes {
+			args := []string{"delete", windowsEnvKey, "/v", name, "/f"}
+			if value != nil {
+				typ := "REG_SZ"
+				if strings.Contains(*value, "%") {
+					typ = "REG_EXPAND_SZ"
+				}
+				args = []string{"add", windowsEnvKey, "/v", name, "/t", typ, "/d", *value, "/f"}
+			} else if _, err := runSettingsTool("reg", "query", windowsEnvKey, "/v", name); err != nil {
+				continue // already absent
+			}
+			if _, err := runSettingsTool("reg", args...); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		return nil
+	case "linux":
+		return writeEnvFile(linuxEnvFile, changes)
+	}
+	return fmt.Errorf("system environment variables cannot be changed on %s", runtime.GOOS)
+}
+
+// writeEnvFile applies changes to a KEY=value file such as
+// /etc/environment, keeping comments and other lines as they are.
+func writeEnvFile(path string, changes map[string]*string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	for name, value := range changes {
+		if value != nil && strings.Contains(*value, `"`) {
+			return fmt.Errorf("%s: double quotes are not supported in %s", name, path)
+		}
+	}
+	format := func(name, value string) string {
+		if strings.ContainsAny(value, " \t#'") {
+			value = `"` + value + `"`
+		}
+		return name + "=" + value
+	}
+
+	var lines []string
+	done := make(map[string]bool)
+	text := strings.TrimSuffix(string(data), "\n")
+	if text != "" {
+		lines = strings.Split(text, "\n")
+	}
+	out := lines[:0]
+	for _, line := range lines {
+		name, _, ok := parseEnvLine(line)
+		value, change := changes[name]
+		if !ok || !change {
+			out = append(out, line)
+			continue
+		}
+		if value != nil && !done[name] {
+			out = append(out, format(name, *value))
+		}
+		done[name] = true // later duplicates are dropped
+	}
+	for _, name := range slices.Sorted(maps.Keys(changes)) {
+		if value := changes[name]; value != nil && !done[name] {
+			out = append(out, format(name, *value))
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".environment-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strings.Join(out, "\n") + "\n")
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// parseEnvLine parses one KEY=value line of an environment file,
+// unquoting the value. Comments and blank lines report false.
+func parseEnvLine(line string) (name, value string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	line = strings.TrimPrefix(line, "export ")
+	name, value, ok = strings.Cut(line, "=")
+	if !ok || name == "" {
+		return "", "", false
+	}
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return strings.TrimSpace(name), value, true
+}
+
+// parseRegValues extracts every value from `reg query` output on a key.
+func parseRegValues(out string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "    ") {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimSpace(line), "    ", 3)
+		if len(fields) >= 2 && strings.HasPrefix(fields[1], "REG_") {
+			value := ""
+			if len(fields) == 3 {
+				value = strings.TrimRight(fields[2], "\r")
+			}
+			values[fields[0]] = value
+		}
+	}
+	return values
+}
@@ -6,63 +6,158 @@ import (
 	"log"
 	"os/exec"
 	"runtime"
+	"strconv"
+	"strings"
+	"unicode"
 )
 
-// handleInput parses an input message and dispatches to the
-// appropriate mouse or keyboard handler.
+// handleInput parses an input message and queues it for injection (see
+// inputqueue.go). Input in a session whose permissions exclude it is
+// dropped, whatever the server relays.
 func (a *Agent) handleInput(payload json.RawMessage) {
-	var input struct {
-		Kind   string `json:"kind"`
-		Action string `json:"action"`
-		X      int    `json:"x"`
-		Y      int    `json:"y"`
-		Button int    `json:"button"`
-		Key    string `json:"key"`
-		Code   int    `json:"code"`
+	a.captureMu.Lock()
+	run := a.capture
+	a.captureMu.Unlock()
+	if run != nil && !run.input {
+		return
 	}
+
+	var input inputEvent
 	if err := json.Unmarshal(payload, &input); err != nil {
 		return
 	}
 
+	// Viewer coordinates are frame pixels, which are the display's unless
+	// frames are scaled down.
+	var geometry *frameGeometry
+	if run != nil {
+		geometry = run.geometry.Load()
+	}
+
 	switch input.Kind {
 	case "mouse":
-		injectMouse(input.Action, input.X, input.Y, input.Button)
+		// Viewer coordinates only map onto a display in ViewSingle.
+		if a.multiView() {
+			return
+		}
+		input.X, input.Y = geometry.toScreen(input.X, input.Y)
+	case "touch":
+		if a.multiView() {
+			return
+		}
+		var touch touchEvent
+		if json.Unmarshal(payload, &touch) != nil {
+			return
+		}
+		touch.X, touch.Y = geometry.toScreen(touch.X, touch.Y)
+		for _, m := range touch.mouse() {
+			a.input.push(inputEvent{Kind: "mouse", mouseEvent: m})
+		}
+		return
 	case "key":
-		injectKey(input.Action, input.Key, input.Code)
+		input.mode = a.keyboardMode()
+	case "text":
+		input.Text = cleanText(input.Text)
+		if input.Text == "" {
+			return
+		}
+	default:
+		return
 	}
+	a.input.push(input)
 }
 
-// injectMouse dispatches mouse events to the platform handler.
-func injectMouse(action string, x, y, button int) {
+// maxTextInput caps one text input message, in bytes; composed text is
+// a word or a phrase.
+const maxTextInput = 4096
+
+// cleanText trims composed text to maxTextInput and drops control
+// characters: Enter, Tab and the like arrive as keys.
+func cleanText(text string) string {
+	if len(text) > maxTextInput {
+		text = strings.ToValidUTF8(text[:maxTextInput], "")
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// injectMouse dispatches a run of mouse events to the platform handler,
+// which injects them with one process.
+func injectMouse(events []mouseEvent) {
 	switch runtime.GOOS {
 	case "darwin":
-		injectMouseDarwin(action, x, y, button)
+		injectMouseDarwin(events)
 	case "linux":
-		injectMouseLinux(action, x, y, button)
+		injectMouseLinux(events)
 	case "windows":
-		injectMouseWindows(action, x, y, button)
+		injectMouseWindows(events)
 	default:
 		log.Printf("Mouse injection not supported on %s", runtime.GOOS)
 	}
 }
 
-// injectKey dispatches keyboard events to the platform handler.
-func injectKey(action, key string, code int) {
-	if action != "down" {
-		return // Only inject on keydown to avoid double-typing.
+// injectKey types the character of a key press the platform cannot hold
+// (see holdKey), with its modifiers. Releases of such keys are not
+// injected, so nothing is typed twice.
+func injectKey(ev keyEvent) {
+	if ev.isModifier() {
+		return // a modifier the platform cannot hold rides along with the next key
 	}
 	switch runtime.GOOS {
 	case "darwin":
-		injectKeyDarwin(key, code)
+		injectKeyDarwin(ev)
 	case "linux":
-		injectKeyLinux(key, code)
+		injectKeyLinux(ev)
 	case "windows":
-		injectKeyWindows(key, code)
+		injectKeyWindows(ev)
 	default:
 		log.Printf("Key injection not supported on %s", runtime.GOOS)
 	}
 }
 
+// injectText types composed text as a string. Each platform types
+// characters its keyboard layout lacks as well: xdotool maps a spare
+// keycode, SendKeys and System Events send Unicode.
+func injectText(text string) {
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf(`tell application "System Events" to keystroke "%s"`, appleScriptEscape(text))
+		exec.Command("osascript", "-e", script).Run() //nolint:errcheck
+	case "linux":
+		if haveXdotool() {
+			exec.Command("xdotool", "type", "--clearmodifiers", "--", text).Run() //nolint:errcheck
+		}
+	case "windows":
+		ps := fmt.Sprintf(`
+Add-Type -AssemblyName System.Windows.Forms
+[System.Windows.Forms.SendKeys]::SendWait('%s')
+`, strings.ReplaceAll(sendKeysEscape(text), "'", "''"))
+		exec.Command("powershell", "-Command", ps).Run() //nolint:errcheck
+	default:
+		log.Printf("Text injection not supported on %s", runtime.GOOS)
+	}
+}
+
+// holdKey presses (down) or releases one key natively, for the keys the
+// platform can hold: modifiers and named keys everywhere but macOS, which
+// holds only modifiers, and any key with a scancode in physical mode on
+// Windows. It reports false, injecting nothing, for other keys.
+func holdKey(ev keyEvent, mode keyboardMode, down bool) bool {
+	switch runtime.GOOS {
+	case "darwin":
+		return holdKeyDarwin(ev, down)
+	case "linux":
+		return holdKeyLinux(ev, down)
+	case "windows":
+		return holdKeyWindows(ev, mode, down)
+	}
+	return false
+}
+
 // ---------------------------------------------------------------------------
 // macOS input injection (requires cliclick: brew install cliclick)
 // ---------------------------------------------------------------------------
@@ -73,7 +168,7 @@ var (
 	retinaScale       = 2 // macOS Retina displays use 2x scaling
 )
 
-func injectMouseDarwin(action string, x, y, button int) {
+func injectMouseDarwin(events []mouseEvent) {
 	if !cliclickChecked {
 		cliclickChecked = true
 		if _, err := exec.LookPath("cliclick"); err == nil {
@@ -88,25 +183,25 @@ func injectMouseDarwin(action string, x, y, button int) {
 		return
 	}
 
-	scaledX := x / retinaScale
-	scaledY := y / retinaScale
-
+	// cliclick runs its commands in order. It cannot scroll, so wheel
+	// events from touch only move the pointer.
 	var args []string
-	switch action {
-	case "move":
-		args = []string{"m:" + fmt.Sprintf("%d,%d", scaledX, scaledY)}
-	case "down":
-		args = []string{"m:" + fmt.Sprintf("%d,%d", scaledX, scaledY)}
-	case "up":
-		if button == 2 {
-			args = []string{"rc:" + fmt.Sprintf("%d,%d", scaledX, scaledY)}
-		} else {
-			args = []string{"c:" + fmt.Sprintf("%d,%d", scaledX, scaledY)}
+	for _, ev := range events {
+		at := fmt.Sprintf("%d,%d", ev.X/retinaScale, ev.Y/retinaScale)
+		switch ev.Action {
+		case "move", "down", "wheel":
+			args = append(args, "m:"+at)
+		case "up":
+			if ev.Button == 2 {
+				args = append(args, "rc:"+at)
+			} else {
+				args = append(args, "c:"+at)
+			}
 		}
 	}
 
 	if len(args) > 0 {
-		log.Printf("Running: cliclick %v (original: %d,%d)", args, x, y)
+		log.Printf("Running: cliclick %v", args)
 		cmd := exec.Command("cliclick", args...)
 		output, err := cmd.CombinedOutput()
 		if err != nil {
@@ -115,32 +210,38 @@ func injectMouseDarwin(action string, x, y, button int) {
 	}
 }
 
-func injectKeyDarwin(key string, _ int) {
-	var script string
+var darwinKeyCodes = map[string]int{
+	"Enter": 36, "Tab": 48, "Backspace": 51, "Escape": 53, "Delete": 117,
+	"ArrowUp": 126, "ArrowDown": 125, "ArrowLeft": 123, "ArrowRight": 124,
+	"Home": 115, "End": 119, "PageUp": 116, "PageDown": 121, " ": 49,
+}
 
-	switch key {
-	case "Enter":
-		script = `tell application "System Events" to key code 36`
-	case "Tab":
-		script = `tell application "System Events" to key code 48`
-	case "Backspace":
-		script = `tell application "System Events" to key code 51`
-	case "Escape":
-		script = `tell application "System Events" to key code 53`
-	case "ArrowUp":
-		script = `tell application "System Events" to key code 126`
-	case "ArrowDown":
-		script = `tell application "System Events" to key code 125`
-	case "ArrowLeft":
-		script = `tell application "System Events" to key code 123`
-	case "ArrowRight":
-		script = `tell application "System Events" to key code 124`
-	case "Space", " ":
-		script = `tell application "System Events" to key code 49`
-	default:
-		if len(key) == 1 {
-			script = fmt.Sprintf(`tell application "System Events" to keystroke "%s"`, key)
-		}
+func injectKeyDarwin(ev keyEvent) {
+	var using []string
+	if ev.Ctrl {
+		using = append(using, "control down")
+	}
+	if ev.Alt {
+		using = append(using, "option down")
+	}
+	if ev.Meta {
+		using = append(using, "command down")
+	}
+	if ev.Shift && !ev.printable() {
+		using = append(using, "shift down")
+	}
+	suffix := ""
+	if len(using) > 0 {
+		suffix = " using {" + strings.Join(using, ", ") + "}"
+	}
+
+	// keystroke types the character itself, so the viewer's layout never
+	// has to match the Mac's.
+	var script string
+	if code, ok := darwinKeyCodes[ev.Key]; ok {
+		script = fmt.Sprintf(`tell application "System Events" to key code %d%s`, code, suffix)
+	} else if ev.printable() {
+		script = fmt.Sprintf(`tell application "System Events" to keystroke "%s"%s`, appleScriptEscape(ev.Key), suffix)
 	}
 
 	if script != "" {
@@ -148,6 +249,24 @@ func injectKeyDarwin(key string, _ int) {
 	}
 }
 
+// darwinModifiers names the modifiers System Events can hold.
+var darwinModifiers = map[string]string{
+	"Shift": "shift", "Control": "control", "Alt": "option", "Meta": "command",
+}
+
+func holdKeyDarwin(ev keyEvent, down bool) bool {
+	mod, ok := darwinModifiers[ev.Key]
+	if !ok {
+		return false
+	}
+	verb := "key up"
+	if down {
+		verb = "key down"
+	}
+	exec.Command("osascript", "-e", `tell application "System Events" to `+verb+" "+mod).Run() //nolint:errcheck
+	return true
+}
+
 // ---------------------------------------------------------------------------
 // Linux input injection (requires xdotool: apt install xdotool)
 // ---------------------------------------------------------------------------
@@ -157,123 +276,264 @@ var (
 	xdotoolAvailable bool
 )
 
-func injectMouseLinux(action string, x, y, button int) {
+// haveXdotool reports whether xdotool is installed, looking once.
+func haveXdotool() bool {
 	if !xdotoolChecked {
 		xdotoolChecked = true
 		if _, err := exec.LookPath("xdotool"); err == nil {
 			xdotoolAvailable = true
-			log.Println("Mouse control: xdotool found")
+			log.Println("Input control: xdotool found")
 		} else {
 			log.Println("WARNING: xdotool not found. Install with: sudo apt install xdotool")
 		}
 	}
-	if !xdotoolAvailable {
+	return xdotoolAvailable
+}
+
+func injectMouseLinux(events []mouseEvent) {
+	if !haveXdotool() {
 		return
 	}
 
-	xs, ys := fmt.Sprintf("%d", x), fmt.Sprintf("%d", y)
-	bs := fmt.Sprintf("%d", button+1)
+	// xdotool chains commands given one after another.
+	var args []string
+	for _, ev := range events {
+		args = append(args, "mousemove", strconv.Itoa(ev.X), strconv.Itoa(ev.Y))
+		switch ev.Action {
+		case "down":
+			args = append(args, "mousedown", strconv.Itoa(ev.Button+1))
+		case "up":
+			args = append(args, "mouseup", strconv.Itoa(ev.Button+1))
+		case "wheel":
+			args = append(args, xdotoolWheel(ev)...)
+		}
+	}
+	exec.Command("xdotool", args...).Run() //nolint:errcheck
+}
 
-	switch action {
-	case "move":
-		exec.Command("xdotool", "mousemove", xs, ys).Run() //nolint:errcheck
-	case "down":
-		exec.Command("xdotool", "mousemove", xs, ys).Run() //nolint:errcheck
-		exec.Command("xdotool", "mousedown", bs).Run()     //nolint:errcheck
-	case "up":
-		exec.Command("xdotool", "mousemove", xs, ys).Run() //nolint:errcheck
-		exec.Command("xdotool", "mouseup", bs).Run()       //nolint:errcheck
+// xdotoolWheel returns the xdotool commands for a wheel event: X wheel
+// notches are clicks of buttons 4 (up), 5 (down), 6 (left) and 7 (right).
+func xdotoolWheel(ev mouseEvent) []string {
+	var args []string
+	click := func(n, neg, pos int) {
+		button := pos
+		if n < 0 {
+			n, button = -n, neg
+		}
+		if n > 0 {
+			args = append(args, "click", "--repeat", strconv.Itoa(n), strconv.Itoa(button))
+		}
+	}
+	click(ev.DY, 4, 5)
+	click(ev.DX, 6, 7)
+	if ev.Zoom && len(args) > 0 {
+		args = append(append([]string{"keydown", "Control_L"}, args...), "keyup", "Control_L")
 	}
+	return args
 }
 
-func injectKeyLinux(key string, _ int) {
-	if !xdotoolAvailable {
+var xdotoolKeys = map[string]string{
+	"Enter": "Return", "Backspace": "BackSpace", "Tab": "Tab", "Escape": "Escape",
+	"Delete": "Delete", "Home": "Home", "End": "End", "PageUp": "Prior", "PageDown": "Next",
+	"ArrowUp": "Up", "ArrowDown": "Down", "ArrowLeft": "Left", "ArrowRight": "Right",
+	" ": "space",
+}
+
+// xdotoolModifiers maps modifier keys, by physical position, to keysyms.
+var xdotoolModifiers = map[string]string{
+	"ShiftLeft": "Shift_L", "ShiftRight": "Shift_R",
+	"ControlLeft": "Control_L", "ControlRight": "Control_R",
+	"AltLeft": "Alt_L", "AltRight": "Alt_R",
+	"MetaLeft": "Super_L", "MetaRight": "Super_R",
+	"CapsLock": "Caps_Lock",
+}
+
+func holdKeyLinux(ev keyEvent, down bool) bool {
+	if !haveXdotool() {
+		return false
+	}
+	sym, ok := xdotoolKeys[ev.Key]
+	switch {
+	case ev.Key == "AltGraph":
+		sym, ok = "ISO_Level3_Shift", true
+	case ev.isModifier():
+		sym, ok = xdotoolModifiers[ev.Physical]
+	case !ok && !ev.printable() && strings.HasPrefix(ev.Key, "F"):
+		sym, ok = ev.Key, true
+	}
+	if !ok {
+		return false
+	}
+	verb := "keyup"
+	if down {
+		verb = "keydown"
+	}
+	exec.Command("xdotool", verb, sym).Run() //nolint:errcheck
+	return true
+}
+
+func injectKeyLinux(ev keyEvent) {
+	if !haveXdotool() {
 		return
 	}
-	xdoKey := key
-	switch key {
-	case "Enter":
-		xdoKey = "Return"
-	case "Backspace":
-		xdoKey = "BackSpace"
-	case "ArrowUp":
-		xdoKey = "Up"
-	case "ArrowDown":
-		xdoKey = "Down"
-	case "ArrowLeft":
-		xdoKey = "Left"
-	case "ArrowRight":
-		xdoKey = "Right"
-	case " ":
-		xdoKey = "space"
-	}
-	exec.Command("xdotool", "key", xdoKey).Run() //nolint:errcheck
+
+	// Plain characters go through "xdotool type", which finds (or
+	// temporarily maps) a keycode producing that character in the active
+	// X keymap, so non-US viewer and agent layouts both come out right.
+	if ev.printable() && !ev.Ctrl && !ev.Alt && !ev.Meta {
+		exec.Command("xdotool", "type", "--clearmodifiers", "--", ev.Key).Run() //nolint:errcheck
+		return
+	}
+
+	sym, ok := xdotoolKeys[ev.Key]
+	if !ok {
+		if !ev.printable() {
+			if strings.HasPrefix(ev.Key, "F") {
+				sym = ev.Key // F1–F12 keysyms match the DOM names
+			} else {
+				return
+			}
+		} else {
+			sym = strings.ToLower(ev.Key)
+		}
+	}
+	var combo []string
+	if ev.Ctrl {
+		combo = append(combo, "ctrl")
+	}
+	if ev.Alt {
+		combo = append(combo, "alt")
+	}
+	if ev.Meta {
+		combo = append(combo, "super")
+	}
+	if ev.Shift && (!ev.printable() || ev.Ctrl || ev.Alt || ev.Meta) {
+		combo = append(combo, "shift")
+	}
+	combo = append(combo, sym)
+	exec.Command("xdotool", "key", "--clearmodifiers", strings.Join(combo, "+")).Run() //nolint:errcheck
 }
 
 // ---------------------------------------------------------------------------
 // Windows input injection (PowerShell)
 // ---------------------------------------------------------------------------
 
-// windowsMouseScript builds a PowerShell script that moves the cursor to (x, y)
-// and optionally fires a mouse_event with the given flags (0 = move only).
-func windowsMouseScript(x, y int, mouseEventFlag string) string {
-	base := fmt.Sprintf(`
+// windowsMouseScript builds a PowerShell script that, for each event,
+// moves the cursor to (x, y) and fires mouse_event for a press or release.
+func windowsMouseScript(events []mouseEvent) string {
+	var b strings.Builder
+	b.WriteString(`
 Add-Type -AssemblyName System.Windows.Forms
-[System.Windows.Forms.Cursor]::Position = New-Object System.Drawing.Point(%d, %d)
-`, x, y)
-	if mouseEventFlag == "" {
-		return base
-	}
-	return base + fmt.Sprintf(`$signature = @"
+$signature = @"
 [DllImport("user32.dll")]
 public static extern void mouse_event(int dwFlags, int dx, int dy, int dwData, int dwExtraInfo);
+[DllImport("user32.dll")]
+public static extern void keybd_event(byte bVk, byte bScan, int dwFlags, int dwExtraInfo);
 "@
 $mouse = Add-Type -MemberDefinition $signature -Name "MouseEvent" -Namespace "Win32" -PassThru
-$mouse::mouse_event(%s, 0, 0, 0, 0)
-`, mouseEventFlag)
+`)
+	for _, ev := range events {
+		fmt.Fprintf(&b, "[System.Windows.Forms.Cursor]::Position = New-Object System.Drawing.Point(%d, %d)\n", ev.X, ev.Y)
+		switch ev.Action {
+		case "down":
+			b.WriteString("$mouse::mouse_event(0x0002, 0, 0, 0, 0)\n")
+		case "up":
+			b.WriteString("$mouse::mouse_event(0x0004, 0, 0, 0, 0)\n")
+		case "wheel":
+			// A notch is 120; positive vertical data turns the wheel away
+			// (up). Zoom holds Ctrl (VK_CONTROL) around the turn.
+			if ev.Zoom {
+				b.WriteString("$mouse::keybd_event(0x11, 0, 0, 0)\n")
+			}
+			if ev.DY != 0 {
+				fmt.Fprintf(&b, "$mouse::mouse_event(0x0800, 0, 0, %d, 0)\n", -120*ev.DY)
+			}
+			if ev.DX != 0 {
+				fmt.Fprintf(&b, "$mouse::mouse_event(0x1000, 0, 0, %d, 0)\n", 120*ev.DX)
+			}
+			if ev.Zoom {
+				b.WriteString("$mouse::keybd_event(0x11, 0, 2, 0)\n")
+			}
+		}
+	}
+	return b.String()
 }
 
-func injectMouseWindows(action string, x, y, _ int) {
-	var ps string
-	switch action {
-	case "move":
-		ps = windowsMouseScript(x, y, "")
-	case "down":
-		ps = windowsMouseScript(x, y, "0x0002")
-	case "up":
-		ps = windowsMouseScript(x, y, "0x0004")
-	}
-	if ps != "" {
-		exec.Command("powershell", "-Command", ps).Run() //nolint:errcheck
-	}
+func injectMouseWindows(events []mouseEvent) {
+	exec.Command("powershell", "-Command", windowsMouseScript(events)).Run() //nolint:errcheck
 }
 
-func injectKeyWindows(key string, _ int) {
-	sendKey := key
-	switch key {
-	case "Enter":
-		sendKey = "{ENTER}"
-	case "Tab":
-		sendKey = "{TAB}"
-	case "Backspace":
-		sendKey = "{BACKSPACE}"
-	case "Escape":
-		sendKey = "{ESC}"
-	case "ArrowUp":
-		sendKey = "{UP}"
-	case "ArrowDown":
-		sendKey = "{DOWN}"
-	case "ArrowLeft":
-		sendKey = "{LEFT}"
-	case "ArrowRight":
-		sendKey = "{RIGHT}"
-	case " ":
-		sendKey = " "
+var sendKeysNames = map[string]string{
+	"Enter": "{ENTER}", "Tab": "{TAB}", "Backspace": "{BACKSPACE}", "Escape": "{ESC}",
+	"Delete": "{DELETE}", "Home": "{HOME}", "End": "{END}", "PageUp": "{PGUP}", "PageDown": "{PGDN}",
+	"ArrowUp": "{UP}", "ArrowDown": "{DOWN}", "ArrowLeft": "{LEFT}", "ArrowRight": "{RIGHT}",
+}
+
+// injectKeyWindows types the character the viewer produced via SendKeys,
+// which maps it through the agent's active layout.
+func injectKeyWindows(ev keyEvent) {
+	sendKey, ok := sendKeysNames[ev.Key]
+	if !ok {
+		switch {
+		case ev.printable():
+			sendKey = sendKeysEscape(ev.Key)
+			if ev.Ctrl || ev.Alt {
+				sendKey = strings.ToLower(sendKey)
+			}
+		case strings.HasPrefix(ev.Key, "F") && len(ev.Key) <= 3:
+			sendKey = "{" + ev.Key + "}"
+		default:
+			return
+		}
+	}
+	if ev.Alt {
+		sendKey = "%" + sendKey
+	}
+	if ev.Ctrl {
+		sendKey = "^" + sendKey
+	}
+	if ev.Shift && (!ev.printable() || ev.Ctrl || ev.Alt) {
+		sendKey = "+" + sendKey
 	}
 
 	ps := fmt.Sprintf(`
 Add-Type -AssemblyName System.Windows.Forms
-[System.Windows.Forms.SendKeys]::SendWait("%s")
-`, sendKey)
+[System.Windows.Forms.SendKeys]::SendWait('%s')
+`, strings.ReplaceAll(sendKey, "'", "''"))
+	exec.Command("powershell", "-Command", ps).Run() //nolint:errcheck
+}
+
+// holdKeyWindows presses or releases the physical key the viewer used, by
+// PC scancode. Modifiers and named keys sit in the same place on every
+// layout, so they are held this way in either mode; in physical mode,
+// when both sides run the same layout, every key is, which reproduces
+// dead keys and AltGr combinations exactly.
+func holdKeyWindows(ev keyEvent, mode keyboardMode, down bool) bool {
+	sc, ok := scancodes[ev.Physical]
+	if !ok {
+		return false
+	}
+	// A character, dead key or AltGr in character mode means something
+	// else on the agent's layout.
+	if mode != keyboardPhysical && (ev.printable() || ev.Key == "Dead" || ev.Key == "AltGraph") {
+		return false
+	}
+
+	// keybd_event flags: 0x8 = KEYEVENTF_SCANCODE, 0x2 = KEYUP, 0x1 = EXTENDED.
+	flags := 0x8
+	if !down {
+		flags |= 0x2
+	}
+	if sc&0xE000 == 0xE000 {
+		flags |= 0x1
+	}
+	ps := fmt.Sprintf(`$sig = @"
+[DllImport("user32.dll")]
+public static extern void keybd_event(byte bVk, byte bScan, int dwFlags, int dwExtraInfo);
+"@
+$k = Add-Type -MemberDefinition $sig -Name "Keybd" -Namespace "Win32" -PassThru
+$k::keybd_event(0, %d, %d, 0)
+`, sc&0xFF, flags)
 	exec.Command("powershell", "-Command", ps).Run() //nolint:errcheck
+	return true
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Input is injected off the message loop, in order, by one goroutine that
+// runs while events are waiting. Injection is slow — cliclick, xdotool and
+// PowerShell each cost a process per call — so events pile up while one
+// runs: a mouse move replaces a move queued right before it, since only
+// the latest position matters, and each round injects every waiting mouse
+// event up to the next key event with one process. A browser's stream of
+// moves then costs one process per round instead of one per move, and a
+// move, press and release arrive together.
+//
+// Keys the platform can hold (see holdKey) are pressed on "down" and
+// released on "up", so shortcuts, shift-selection and held keys work;
+// the viewer's auto-repeat arrives as further presses. Other keys are
+// typed on "down". Keys still down when the session ends or the
+// connection drops are released, so no modifier stays stuck.
+//
+// Text is what the viewer's own keyboard composed — dead keys, IME input
+// — sent when the session's viewer types in text mode. It is typed as a
+// string, whatever the agent's layout, in order with the keys around it.
+
+// inputEvent is one viewer input message.
+type inputEvent struct {
+	Kind string `json:"kind"` // "mouse", "key", "text", or "release" to release held keys
+	Text string `json:"text"` // for "text"
+	mouseEvent
+	keyEvent
+	mode keyboardMode // for keys, the session's mode when it arrived
+}
+
+// mouseEvent is a mouse action at viewer coordinates.
+type mouseEvent struct {
+	Action string `json:"action"` // "move", "down" or "up"; "wheel" from touch
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Button int    `json:"button"`
+
+	// For "wheel", which only touch gestures produce (see touch.go).
+	DX, DY int  `json:"-"` // notches; positive scrolls right and down
+	Zoom   bool `json:"-"` // with Ctrl held
+}
+
+// inputQueue holds the events waiting for injection.
+type inputQueue struct {
+	mu      sync.Mutex
+	pending []inputEvent
+	running bool // the injecting goroutine is running
+
+	// held are the keys pressed and not yet released, by physical key;
+	// only the injecting goroutine uses it.
+	held map[string]inputEvent
+}
+
+// push queues ev, coalescing consecutive moves, and starts injecting if
+// nothing is.
+func (q *inputQueue) push(ev inputEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n := len(q.pending); n > 0 && isMove(ev) && isMove(q.pending[n-1]) {
+		q.pending[n-1] = ev
+	} else {
+		q.pending = append(q.pending, ev)
+	}
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+// run injects rounds of waiting events until none are left.
+func (q *inputQueue) run() {
+	for {
+		q.mu.Lock()
+		batch := q.pending
+		q.pending = nil
+		if len(batch) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		q.mu.Unlock()
+
+		for len(batch) > 0 {
+			switch batch[0].Kind {
+			case "key":
+				q.key(batch[0])
+				batch = batch[1:]
+				continue
+			case "release":
+				q.release()
+				batch = batch[1:]
+				continue
+			case "text":
+				injectText(batch[0].Text)
+				batch = batch[1:]
+				continue
+			}
+			n := 0
+			for n < len(batch) && batch[n].Kind == "mouse" {
+				n++
+			}
+			mice := make([]mouseEvent, n)
+			for i, ev := range batch[:n] {
+				mice[i] = ev.mouseEvent
+			}
+			injectMouse(mice)
+			batch = batch[n:]
+		}
+	}
+}
+
+// releaseAll queues the release of every held key.
+func (q *inputQueue) releaseAll() {
+	q.push(inputEvent{Kind: "release"})
+}
+
+// key injects one key event.
+func (q *inputQueue) key(ev inputEvent) {
+	id := ev.Physical
+	if id == "" {
+		id = ev.Key
+	}
+	switch ev.Action {
+	case "down":
+		// X repeats a held key by itself.
+		if _, ok := q.held[id]; ok && runtime.GOOS == "linux" {
+			return
+		}
+		if !holdKey(ev.keyEvent, ev.mode, true) {
+			injectKey(ev.keyEvent)
+			return
+		}
+		if q.held == nil {
+			q.held = make(map[string]inputEvent)
+		}
+		q.held[id] = ev
+	case "up":
+		if down, ok := q.held[id]; ok {
+			delete(q.held, id)
+			holdKey(down.keyEvent, down.mode, false)
+		}
+	}
+}
+
+// release releases every held key.
+func (q *inputQueue) release() {
+	for id, ev := range q.held {
+		holdKey(ev.keyEvent, ev.mode, false)
+		delete(q.held, id)
+	}
+}
+
+func isMove(ev inputEvent) bool {
+	return ev.Kind == "mouse" && ev.Action == "move"
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// keyboardMode selects how key events are injected.
+type keyboardMode int
+
+const (
+	// keyboardCharacter injects the character the viewer's layout
+	// produced. Correct whenever the two layouts differ.
+	keyboardCharacter keyboardMode = iota
+	// keyboardPhysical injects the physical key (scancode) the viewer
+	// pressed. Only chosen when both sides use the same layout.
+	keyboardPhysical
+)
+
+func (m keyboardMode) String() string {
+	if m == keyboardPhysical {
+		return "physical"
+	}
+	return "character"
+}
+
+// keyEvent is a key input from the viewer. Key is the DOM KeyboardEvent.key
+// (the character or named key), Physical is KeyboardEvent.code (the
+// layout-independent key position).
+type keyEvent struct {
+	Key      string `json:"key"`
+	Code     int    `json:"code"`
+	Physical string `json:"physical"`
+	Ctrl     bool   `json:"ctrl"`
+	Alt      bool   `json:"alt"`
+	Shift    bool   `json:"shift"`
+	Meta     bool   `json:"meta"`
+}
+
+// printable reports whether the event produces a single character.
+func (ev keyEvent) printable() bool {
+	return utf8.RuneCountInString(ev.Key) == 1
+}
+
+// isModifier reports whether the event is a bare modifier press.
+func (ev keyEvent) isModifier() bool {
+	switch ev.Key {
+	case "Shift", "Control", "Alt", "AltGraph", "Meta", "CapsLock", "Dead":
+		return true
+	}
+	return false
+}
+
+// handleSessionSetup records the viewer's keyboard layout and locale and
+// picks the injection mode for this session, and notes whether the viewer
+// draws tile frames (see tiles.go).
+func (a *Agent) handleSessionSetup(payload json.RawMessage) {
+	var setup protocol.SessionSetup
+	if err := json.Unmarshal(payload, &setup); err != nil {
+		return
+	}
+	a.captureMu.Lock()
+	if a.capture != nil {
+		a.capture.tiles.Store(setup.Tiles)
+	}
+	a.captureMu.Unlock()
+
+	local := localKeyboardLayout()
+	mode := keyboardCharacter
+	if setup.Layout != "" && strings.EqualFold(setup.Layout, local) {
+		mode = keyboardPhysical
+	}
+
+	a.keyboardMu.Lock()
+	a.keyboard = mode
+	a.keyboardMu.Unlock()
+
+	log.Printf("Viewer keyboard: layout=%q locale=%q, local layout=%q, injecting %s keys",
+		setup.Layout, setup.Locale, local, mode)
+}
+
+// keyboardMode returns the injection mode negotiated for the current
+// viewer session.
+func (a *Agent) keyboardMode() keyboardMode {
+	a.keyboardMu.Lock()
+	defer a.keyboardMu.Unlock()
+	return a.keyboard
+}
+
+// localKeyboardLayout returns the active layout as a short code comparable
+// with the viewer's ("us", "de", "fr", ...), or "" if unknown.
+func localKeyboardLayout() string {
+	switch runtime.GOOS {
+	case "linux":
+		out, err := exec.Command("setxkbmap", "-query").Output()
+		if err != nil {
+			return ""
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if v, ok := strings.CutPrefix(line, "layout:"); ok {
+				// Multiple layouts are comma-separated; the first is active.
+				return strings.TrimSpace(strings.Split(v, ",")[0])
+			}
+		}
+	case "windows":
+		out, err := exec.Command("powershell", "-NoProfile", "-Command",
+			"Add-Type -AssemblyName System.Windows.Forms; "+
+				"[System.Windows.Forms.InputLanguage]::CurrentInputLanguage.Culture.Name").Output()
+		if err != nil {
+			return ""
+		}
+		return layoutFromCulture(strings.TrimSpace(string(out)))
+	}
+	return ""
+}
+
+// layoutFromCulture maps a culture name to a layout code: the region for
+// English ("en-GB" -> "gb"), otherwise the language ("de-CH" -> "de").
+func layoutFromCulture(name string) string {
+	lang, region, _ := strings.Cut(strings.ToLower(name), "-")
+	if lang == "en" && region != "" {
+		return region
+	}
+	return lang
+}
+
+// appleScriptEscape quotes s for use inside an AppleScript string literal.
+func appleScriptEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// sendKeysEscape wraps characters that SendKeys treats as syntax in braces.
+func sendKeysEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '+', '^', '%', '~', '(', ')', '{', '}', '[', ']':
+			b.WriteString("{" + string(r) + "}")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// scancodes maps DOM KeyboardEvent.code to PC set-1 scancodes. Extended
+// keys carry an 0xE0 prefix in the high byte.
+var scancodes = map[string]uint16{
+	"Escape": 0x01, "Digit1": 0x02, "Digit2": 0x03, "Digit3": 0x04, "Digit4": 0x05,
+	"Digit5": 0x06, "Digit6": 0x07, "Digit7": 0x08, "Digit8": 0x09, "Digit9": 0x0A,
+	"Digit0": 0x0B, "Minus": 0x0C, "Equal": 0x0D, "Backspace": 0x0E, "Tab": 0x0F,
+	"KeyQ": 0x10, "KeyW": 0x11, "KeyE": 0x12, "KeyR": 0x13, "KeyT": 0x14,
+	"KeyY": 0x15, "KeyU": 0x16, "KeyI": 0x17, "KeyO": 0x18, "KeyP": 0x19,
+	"BracketLeft": 0x1A, "BracketRight": 0x1B, "Enter": 0x1C, "ControlLeft": 0x1D,
+	"KeyA": 0x1E, "KeyS": 0x1F, "KeyD": 0x20, "KeyF": 0x21, "KeyG": 0x22,
+	"KeyH": 0x23, "KeyJ": 0x24, "KeyK": 0x25, "KeyL": 0x26, "Semicolon": 0x27,
+	"Quote": 0x28, "Backquote": 0x29, "ShiftLeft": 0x2A, "Backslash": 0x2B,
+	"KeyZ": 0x2C, "KeyX": 0x2D, "KeyC": 0x2E, "KeyV": 0x2F, "KeyB": 0x30,
+	"KeyN": 0x31, "KeyM": 0x32, "Comma": 0x33, "Period": 0x34, "Slash": 0x35,
+	"ShiftRight": 0x36, "NumpadMultiply": 0x37, "AltLeft": 0x38, "Space": 0x39,
+	"CapsLock": 0x3A, "F1": 0x3B, "F2": 0x3C, "F3": 0x3D, "F4": 0x3E, "F5": 0x3F,
+	"F6": 0x40, "F7": 0x41, "F8": 0x42, "F9": 0x43, "F10": 0x44,
+	"Numpad7": 0x47, "Numpad8": 0x48, "Numpad9": 0x49, "NumpadSubtract": 0x4A,
+	"Numpad4": 0x4B, "Numpad5": 0x4C, "Numpad6": 0x4D, "NumpadAdd": 0x4E,
+	"Numpad1": 0x4F, "Numpad2": 0x50, "Numpad3": 0x51, "Numpad0": 0x52,
+	"NumpadDecimal": 0x53, "IntlBackslash": 0x56, "F11": 0x57, "F12": 0x58,
+	"IntlRo": 0x73, "IntlYen": 0x7D,
+	"NumpadEnter": 0xE01C, "ControlRight": 0xE01D, "NumpadDivide": 0xE035,
+	"AltRight": 0xE038, "Home": 0xE047, "ArrowUp": 0xE048, "PageUp": 0xE049,
+	"ArrowLeft": 0xE04B, "ArrowRight": 0xE04D, "End": 0xE04F, "ArrowDown": 0xE050,
+	"PageDown": 0xE051, "Insert": 0xE052, "Delete": 0xE053,
+	"MetaLeft": 0xE05B, "MetaRight": 0xE05C, "ContextMenu": 0xE05D,
+}
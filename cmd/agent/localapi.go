@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/version"
+)
+
+// Local API: with -local-api, the agent serves a small HTTP API on a
+// loopback address so configuration-management tools on the machine
+// (Ansible, Puppet, Intune scripts) can query and nudge it without going
+// through the server. Every request carries the token from
+// local-api.token, next to the agent's configuration, as a bearer token;
+// the file is created on first start, readable by the agent's own
+// account only, so reading it is the proof of local administrative
+// access. Requests whose Host is not a loopback name are refused, which
+// keeps web pages from reaching the API through DNS rebinding.
+//
+//	GET  /v1/status     agent ID, version, connection and session state
+//	POST /v1/inventory  collect and send a fresh inventory to the server
+//	GET  /v1/logs       the tail of the agent's log (?lines=, 100 by default)
+
+const (
+	// localAPITokenFile holds the local API's bearer token.
+	localAPITokenFile = "local-api.token"
+
+	// defaultLogLines is how many log lines /v1/logs returns by default.
+	defaultLogLines = 100
+)
+
+func localAPITokenPath() string {
+	return filepath.Join(filepath.Dir(configPath()), localAPITokenFile)
+}
+
+// localStatus is the body of GET /v1/status.
+type localStatus struct {
+	AgentID              string    `json:"agent_id"`
+	Name                 string    `json:"name"`
+	Version              string    `json:"version"`
+	StartedAt            time.Time `json:"started_at"`
+	Connected            bool      `json:"connected"`
+	Session              bool      `json:"session"`  // a viewer is watching
+	Buffered             int       `json:"buffered"` // messages awaiting the server
+	DisabledCapabilities []string  `json:"disabled_capabilities,omitempty"`
+}
+
+// startedAt is when the agent process started.
+var startedAt = time.Now()
+
+// serveLocalAPI listens on addr, which must be a loopback address, and
+// serves the local API until the process exits.
+func (a *Agent) serveLocalAPI(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%s is not a loopback address", host)
+	}
+	token, err := localAPIToken()
+	if err != nil {
+		return fmt.Errorf("token: %w", err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/status", a.handleLocalStatus)
+	mux.HandleFunc("POST /v1/inventory", a.handleLocalInventory)
+	mux.HandleFunc("GET /v1/logs", handleLocalLogs)
+	srv := &http.Server{
+		Handler:           localAPIAuth(token, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("Local API on http://%s (token in %s)", ln.Addr(), localAPITokenPath())
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			log.Printf("Local API: %v", err)
+		}
+	}()
+	return nil
+}
+
+// localAPIToken reads the token file, creating it with a random token on
+// first use.
+func localAPIToken() (string, error) {
+	path := localAPITokenPath()
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b[:])
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	return token, os.WriteFile(path, []byte(token+"\n"), 0600)
+}
+
+// localAPIAuth admits requests to a loopback host name that carry token.
+func localAPIAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			http.Error(w, `{"error":"forbidden host"}`, http.StatusForbidden)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, `{"error":"invalid token"}`, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *Agent) handleLocalStatus(w http.ResponseWriter, r *http.Request) {
+	a.captureMu.Lock()
+	session := a.capture != nil
+	a.captureMu.Unlock()
+	st := localStatus{
+		AgentID:              a.agentID,
+		Name:                 a.name,
+		Version:              version.Version,
+		StartedAt:            startedAt,
+		Connected:            a.connected.Load(),
+		Session:              session,
+		DisabledCapabilities: a.capabilities.list(),
+	}
+	if a.outbox != nil {
+		st.Buffered = a.outbox.size()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st) //nolint:errcheck
+}
+
+// handleLocalInventory collects the system information sent at
+// registration, with the startup inventory and environment, and sends it
+// to the server ("inventory"), e.g. after a configuration run installed
+// software.
+func (a *Agent) handleLocalInventory(w http.ResponseWriter, r *http.Request) {
+	if !a.connected.Load() {
+		http.Error(w, `{"error":"not connected to the server"}`, http.StatusServiceUnavailable)
+		return
+	}
+	info := CollectSystemInfo(a.name)
+	info.DisabledCapabilities = a.capabilities.list()
+	if err := a.sendMessage(protocol.Message{Type: "inventory", Payload: info.ToJSON()}); err != nil {
+		http.Error(w, `{"error":"failed to send the inventory"}`, http.StatusBadGateway)
+		return
+	}
+	log.Println("Inventory refreshed through the local API")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "sent"}) //nolint:errcheck
+}
+
+// handleLocalLogs returns the last ?lines= lines of the agent's log, as
+// far back as recentLog reaches.
+func handleLocalLogs(w http.ResponseWriter, r *http.Request) {
+	n := defaultLogLines
+	if v := r.URL.Query().Get("lines"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			http.Error(w, `{"error":"lines must be a positive number"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	buf := bytes.TrimRight(recentLog.bytes(), "\n")
+	for i := len(buf) - 1; i >= 0; i-- {
+		if buf[i] == '\n' {
+			if n--; n == 0 {
+				buf = buf[i+1:]
+				break
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(append(buf, '\n')) //nolint:errcheck
+}
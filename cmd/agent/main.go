@@ -4,19 +4,30 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/fips140"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/avaropoint/rmm/internal/protocol"
 	"github.com/avaropoint/rmm/internal/version"
 )
 
@@ -27,9 +38,33 @@ const reconnectDelay = 5 * time.Second
 type AgentConfig struct {
 	ServerURL   string `json:"server_url"`
 	AgentID     string `json:"agent_id"`
-	Credential  string `json:"credential"`
+	Credential  string `json:"credential,omitempty"`
 	CACert      string `json:"ca_certificate,omitempty"`
 	Fingerprint string `json:"platform_fingerprint,omitempty"`
+
+	// Discovery is the domain whose DNS SRV records name the servers, or
+	// "local" for mDNS, if the agent finds its server that way; ServerURL
+	// is then the last one it connected to.
+	Discovery string `json:"discovery,omitempty"`
+
+	// Servers are the server URLs (wss://…) in order of preference, as the
+	// server last sent them.
+	Servers []string `json:"servers,omitempty"`
+
+	// DisabledCapabilities lists the capability classes the agent refuses
+	// ("input", "files", "shell", "gateway"), whatever the server sends. The
+	// server's policy can add to it.
+	DisabledCapabilities []string `json:"disabled_capabilities,omitempty"`
+
+	// CredentialStore names the platform secret store holding the
+	// credential ("dpapi", "keychain", "libsecret"), in which case
+	// Credential is empty; see credstore.go.
+	CredentialStore string `json:"credential_store,omitempty"`
+
+	// MachineID is the machine the agent enrolled on. An agent that finds
+	// a different one has been cloned, and enrolls afresh from its
+	// provisioning file.
+	MachineID string `json:"machine_id,omitempty"`
 }
 
 func configPath() string {
@@ -46,26 +81,46 @@ func loadConfig() (*AgentConfig, error) {
 		return nil, err
 	}
 	var cfg AgentConfig
-	return &cfg, json.Unmarshal(data, &cfg)
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	if err := loadCredential(&cfg); err != nil {
+		log.Printf("Credential: %v", err)
+		return nil, err
+	}
+	return &cfg, nil
 }
 
+// saveConfig writes cfg to agent.json, with the credential in the
+// platform's secret store when it can be (see credstore.go).
 func saveConfig(cfg *AgentConfig) error {
 	dir := filepath.Dir(configPath())
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return err
 	}
-	data, err := json.MarshalIndent(cfg, "", "  ")
+	out := *cfg
+	if out.CredentialStore = storeCredential(cfg); out.CredentialStore != "" {
+		out.Credential = ""
+	}
+	data, err := json.MarshalIndent(&out, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(configPath(), data, 0600)
+	if err := os.WriteFile(configPath(), data, 0600); err != nil {
+		return err
+	}
+	cfg.CredentialStore = out.CredentialStore
+	return nil
 }
 
 // enroll performs the HTTPS enrollment handshake with the server.
-func enroll(serverURL, code, name string, insecure bool) (*AgentConfig, error) {
-	tlsCfg := &tls.Config{InsecureSkipVerify: insecure} //nolint:gosec
+// With bindKey set, a TPM key is registered when one is available.
+// prov is reported by agents enrolling from a provisioning file. With
+// fingerprint set, the reply must be signed by that platform (see
+// verifyEnrollment).
+func enroll(serverURL, code, name, fingerprint string, tlsCfg *tls.Config, bindKey bool, prov *protocol.Provenance) (*AgentConfig, error) {
 	client := &http.Client{
-		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+		Transport: &http.Transport{TLSClientConfig: tlsCfg, DialContext: serverDialer().DialContext},
 		Timeout:   30 * time.Second,
 	}
 
@@ -73,14 +128,26 @@ func enroll(serverURL, code, name string, insecure bool) (*AgentConfig, error) {
 	if name == "" {
 		name = hostname
 	}
+	machine := machineID()
 
-	body, _ := json.Marshal(map[string]string{
-		"code":     code,
-		"name":     name,
-		"hostname": hostname,
-		"os":       runtime.GOOS,
-		"arch":     runtime.GOARCH,
-	})
+	req := map[string]interface{}{
+		"code":          code,
+		"name":          name,
+		"hostname":      hostname,
+		"os":            runtime.GOOS,
+		"arch":          runtime.GOARCH,
+		"mac_addresses": collectMACs(),
+		"machine_id":    machine,
+	}
+	if prov != nil {
+		req["provenance"] = prov
+	}
+	if bindKey {
+		if att := enrollAttestation(code); att != nil {
+			req["attestation"] = att
+		}
+	}
+	body, _ := json.Marshal(req)
 
 	base := strings.TrimRight(serverURL, "/")
 	if !strings.HasPrefix(base, "http") {
@@ -101,33 +168,111 @@ func enroll(serverURL, code, name string, insecure bool) (*AgentConfig, error) {
 		return nil, fmt.Errorf("enrollment rejected: %s", errResp.Error)
 	}
 
-	var result struct {
-		AgentID     string `json:"agent_id"`
-		Credential  string `json:"credential"`
-		Fingerprint string `json:"platform_fingerprint"`
-		CACert      string `json:"ca_certificate"`
-	}
+	var result enrollResult
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, fmt.Errorf("failed to parse enrollment response: %w", err)
 	}
+	if err := verifyEnrollment(&result, fingerprint); err != nil {
+		return nil, err
+	}
 
-	wsURL := strings.Replace(base, "https://", "wss://", 1)
-	wsURL = strings.Replace(wsURL, "http://", "ws://", 1)
+	var servers []string
+	for _, s := range result.Servers {
+		servers = append(servers, webSocketURL(s))
+	}
 
 	return &AgentConfig{
-		ServerURL:   wsURL,
+		ServerURL:   webSocketURL(base),
+		Servers:     servers,
 		AgentID:     result.AgentID,
 		Credential:  result.Credential,
 		CACert:      result.CACert,
 		Fingerprint: result.Fingerprint,
+		MachineID:   machine,
 	}, nil
 }
 
+// enrollResult is the server's reply to an enrollment.
+type enrollResult struct {
+	AgentID     string   `json:"agent_id"`
+	Credential  string   `json:"credential"`
+	Fingerprint string   `json:"platform_fingerprint"`
+	CACert      string   `json:"ca_certificate"`
+	Servers     []string `json:"servers"`
+
+	PlatformKey string `json:"platform_key"` // base64 Ed25519
+	Signature   string `json:"signature"`    // base64, over protocol.EnrollmentDigest
+}
+
+// verifyEnrollment checks the platform signature on an enrollment reply:
+// the signing key must match the reply's fingerprint and, when the agent
+// was given one out of band, the expected fingerprint. Without an
+// expected fingerprint an unsigned reply, from a server older than
+// signed enrollment, is accepted with a warning.
+func verifyEnrollment(r *enrollResult, expected string) error {
+	if r.PlatformKey == "" || r.Signature == "" {
+		if expected != "" {
+			return errors.New("enrollment response is not signed; refusing it since a platform fingerprint was given")
+		}
+		log.Printf("Warning: enrollment response is not signed; trusting platform %s unverified", r.Fingerprint)
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(r.PlatformKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("enrollment response carries an invalid platform key")
+	}
+	sum := sha256.Sum256(key)
+	if fp := hex.EncodeToString(sum[:]); fp != r.Fingerprint {
+		return errors.New("enrollment response platform key does not match its fingerprint")
+	}
+	if expected != "" && !strings.EqualFold(r.Fingerprint, expected) {
+		return fmt.Errorf("server platform fingerprint %s does not match the expected %s; the connection may be intercepted", r.Fingerprint, expected)
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return errors.New("enrollment response carries an invalid signature")
+	}
+	var caCertHash string
+	if r.CACert != "" {
+		sum := sha256.Sum256([]byte(r.CACert))
+		caCertHash = hex.EncodeToString(sum[:])
+	}
+	credSum := sha256.Sum256([]byte(r.Credential))
+	if !ed25519.Verify(key, protocol.EnrollmentDigest(r.AgentID, hex.EncodeToString(credSum[:]), caCertHash), sig) {
+		return errors.New("enrollment response signature is invalid; the connection may be intercepted")
+	}
+	if expected == "" {
+		log.Printf("Enrollment response signed by platform %s (pass -platform-fingerprint to check it against the one shown with the code)", r.Fingerprint)
+	}
+	return nil
+}
+
+// parseEnrollURL splits an enrollment URL of the form
+// https://host:port/enroll?code=XXXX-XXXX&fp=<fingerprint> (as encoded in
+// the dashboard's QR codes) into the server base URL, the code and the
+// platform fingerprint, which older URLs lack.
+func parseEnrollURL(s string) (serverURL, code, fingerprint string, ok bool) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", "", "", false
+	}
+	code = u.Query().Get("code")
+	if code == "" {
+		return "", "", "", false
+	}
+	base := strings.TrimSuffix(u.Path, "/enroll")
+	return u.Scheme + "://" + u.Host + base, code, u.Query().Get(protocol.EnrollURLFingerprint), true
+}
+
 // buildTLSConfig creates a TLS configuration from the agent config.
 // Trust is established via the CA certificate received during enrollment
 // (self-signed mode) or the system CA store (ACME / custom cert mode).
 func buildTLSConfig(cfg *AgentConfig, insecure bool) *tls.Config {
-	if !strings.HasPrefix(cfg.ServerURL, "wss://") {
+	secure := strings.HasPrefix(cfg.ServerURL, "wss://") || cfg.Discovery != ""
+	for _, s := range cfg.Servers {
+		secure = secure || strings.HasPrefix(s, "wss://")
+	}
+	if !secure {
 		return nil // plain WS — no TLS needed.
 	}
 
@@ -149,28 +294,106 @@ func buildTLSConfig(cfg *AgentConfig, insecure bool) *tls.Config {
 
 func main() {
 	serverURL := flag.String("server", "", "Server URL (e.g. https://server:8443)")
-	enrollCode := flag.String("enroll", "", "Enrollment code for initial registration")
+	discover := flag.String("discover", "", "Domain whose _rmm._tcp SRV records name the servers, or \"local\" for mDNS, instead of a fixed -server URL")
+	enrollCode := flag.String("enroll", "", "Enrollment code (or enrollment URL from a QR code) for initial registration")
+	platformFP := flag.String("platform-fingerprint", "", "Platform fingerprint shown with the enrollment code; the server's signed enrollment reply must match it")
 	name := flag.String("name", "", "Agent name (defaults to hostname)")
 	insecure := flag.Bool("insecure", false, "Skip TLS certificate verification")
+	bindKey := flag.Bool("key-binding", true, "Bind the agent to a key in this machine's TPM at enrollment, when one is available")
+	topProcesses := flag.Bool("top-processes", true, "Report the busiest processes by CPU and memory with each heartbeat")
+	jpegQuality := flag.Int("jpeg-quality", defaultJPEGQuality, "JPEG quality of live frames and screenshots, 1-100")
+	captureMaxSize := flag.Int("capture-max-size", defaultCaptureMaxSize, "Scale live frames down so neither side exceeds this many pixels, keeping the aspect ratio (0: full size)")
+	losslessRegions := flag.Bool("lossless-regions", true, "Send only the changed parts of the screen, text losslessly, to viewers that support it")
+	outboxSize := flag.Int("outbox-size", defaultOutboxSize, "Heartbeats and support requests kept while the server is unreachable, replayed on reconnect (0: none)")
+	plugins := flag.String("plugins", pluginsPath(), "Directory of plugin executables run on a schedule and on command (empty disables plugins)")
+	pluginInterval := flag.Duration("plugin-interval", defaultPluginInterval, "How often plugins run, unless a plugin asks otherwise")
+	localAPI := flag.String("local-api", "", "Serve the local scripting API on this loopback address (e.g. 127.0.0.1:8701); empty disables it")
+	tray := flag.Bool("tray", true, "Show connection status and an active-session indicator in the tray or menu bar")
+	fips := flag.Bool("fips", false, "Enforce FIPS 140-3 approved cryptography; refuse to start otherwise")
+	verifySelfSig := flag.Bool("verify-self", true, "Refuse to start unless this binary carries a valid release signature from the signer built into it (builds without one skip the check)")
+	requireOSSig := flag.Bool("require-os-signature", false, "Also refuse to start unless the operating system trusts this binary's code signature (Authenticode on Windows, Gatekeeper on macOS)")
+	raiseHand := flag.Bool("raise-hand", false, "Ask for a technician, with the remaining arguments as the message, and exit")
+	credStore := flag.String("credential-store", "auto", "Where the agent credential is kept: auto (the platform's secret store when available) or file (agent.json)")
+	provision := flag.String("provision", provisioningPath(), "Provisioning file that enrolls the agent on first boot, or again on a cloned machine")
 	flag.Parse()
 
+	// Keep the recent log for diagnostics archives.
+	log.SetOutput(io.MultiWriter(os.Stderr, recentLog))
 	log.Printf("Agent v%s (built %s)", version.Version, version.BuildTime)
 	log.Printf("OS: %s, Arch: %s", runtime.GOOS, runtime.GOARCH)
 
+	if *jpegQuality < 1 || *jpegQuality > 100 {
+		log.Fatalf("-jpeg-quality must be between 1 and 100")
+	}
+	if *captureMaxSize < 0 {
+		log.Fatalf("-capture-max-size must not be negative")
+	}
+	switch *credStore {
+	case "auto":
+	case "file":
+		keepCredentialInFile = true
+	default:
+		log.Fatalf("-credential-store must be auto or file")
+	}
+	if *outboxSize < 0 {
+		log.Fatalf("-outbox-size must not be negative")
+	}
+	if *pluginInterval < minPluginInterval {
+		log.Fatalf("-plugin-interval must be at least %s", minPluginInterval)
+	}
+
+	if *fips {
+		if !fips140.Enabled() {
+			log.Fatal("FIPS mode: the Go FIPS 140-3 module is not active (build with GOFIPS140=v1.0.0 or run with GODEBUG=fips140=on)")
+		}
+		if *insecure {
+			log.Fatal("FIPS mode: -insecure is not allowed")
+		}
+	}
+
+	if checkRelease := *verifySelfSig && releaseSigner != ""; checkRelease || *requireOSSig {
+		if err := verifySelf(checkRelease, *requireOSSig); err != nil {
+			log.Fatalf("Refusing to start: %v", err)
+		}
+		log.Println("Agent binary signature verified")
+	}
+
 	var cfg *AgentConfig
 
 	if *enrollCode != "" {
-		// Enrollment mode.
+		// Enrollment mode. A scanned QR URL carries both server and code.
+		if srv, code, fp, ok := parseEnrollURL(*enrollCode); ok {
+			if *serverURL == "" {
+				*serverURL = srv
+			}
+			if *platformFP == "" {
+				*platformFP = fp
+			}
+			*enrollCode = code
+		}
+		if *serverURL == "" && *discover != "" {
+			urls, err := discoverServers(*discover, "")
+			if err != nil {
+				log.Fatalf("Server discovery for %s failed: %v", *discover, err)
+			}
+			if *discover == localDomain && len(urls) > 1 {
+				// Enrolling with whichever answered first could pick the
+				// wrong deployment.
+				log.Fatalf("%d servers answered on the local link; choose one with -server", len(urls))
+			}
+			*serverURL = httpURL(urls[0])
+		}
 		if *serverURL == "" {
-			log.Fatal("Server URL required for enrollment (-server)")
+			log.Fatal("Server URL required for enrollment (-server or -discover)")
 		}
 		log.Printf("Enrolling with server %s...", *serverURL)
 
 		var err error
-		cfg, err = enroll(*serverURL, *enrollCode, *name, *insecure)
+		cfg, err = enroll(*serverURL, *enrollCode, *name, *platformFP, &tls.Config{InsecureSkipVerify: *insecure}, *bindKey, nil) //nolint:gosec
 		if err != nil {
 			log.Fatalf("Enrollment failed: %v", err)
 		}
+		cfg.Discovery = *discover
 
 		if err := saveConfig(cfg); err != nil {
 			log.Fatalf("Failed to save config: %v", err)
@@ -178,9 +401,17 @@ func main() {
 		log.Printf("Enrolled successfully (agent ID: %s)", cfg.AgentID)
 		log.Printf("Config saved to %s", configPath())
 	} else {
-		// Reconnection mode — load saved config.
+		// Reconnection mode — load saved config, unless this is the first
+		// boot of a provisioned machine.
 		var err error
 		cfg, err = loadConfig()
+		if p, perr := loadProvisioning(*provision); perr == nil {
+			if reason := provisionReason(cfg, err); reason != "" {
+				cfg, err = provisionAgent(p, cfg, reason, *name, *insecure, *bindKey), nil
+			}
+		} else if !os.IsNotExist(perr) {
+			log.Printf("Ignoring provisioning file: %v", perr)
+		}
 		if err != nil {
 			if *serverURL != "" {
 				// Legacy mode: connect without enrollment.
@@ -196,20 +427,96 @@ func main() {
 		}
 	}
 
+	if cfg.AgentID != "" {
+		migrateCredential(cfg)
+	}
+
+	if *discover != "" && cfg.AgentID != "" && cfg.Discovery != *discover {
+		// Switch an enrolled agent to discovery, e.g. ahead of a migration.
+		cfg.Discovery = *discover
+		if err := saveConfig(cfg); err != nil {
+			log.Fatalf("Failed to save config: %v", err)
+		}
+	}
+
+	if *raiseHand {
+		if err := raiseHandCLI(cfg, *insecure, strings.Join(flag.Args(), " ")); err != nil {
+			log.Fatalf("Support request failed: %v", err)
+		}
+		log.Println("Support requested; a technician has been notified")
+		return
+	}
+
 	log.Printf("Server: %s", cfg.ServerURL)
+	if cfg.Discovery != "" {
+		log.Printf("Server discovery: _%s._%s.%s", discoveryService, discoveryProto, cfg.Discovery)
+	}
+
+	tlsConfig := buildTLSConfig(cfg, *insecure)
+	if *fips {
+		if tlsConfig == nil {
+			log.Fatal("FIPS mode: the server URL must use TLS (wss://)")
+		}
+		// TLS 1.3 with NIST curves only; the FIPS module limits the
+		// cipher suites to AES-GCM.
+		tlsConfig.CurvePreferences = []tls.CurveID{tls.CurveP384, tls.CurveP256}
+		log.Println("FIPS mode: enforced")
+	}
 
 	agent := &Agent{
-		serverURL:  cfg.ServerURL,
-		name:       *name,
-		credential: cfg.Credential,
-		tlsConfig:  buildTLSConfig(cfg, *insecure),
+		serverURL:    cfg.ServerURL,
+		discovery:    cfg.Discovery,
+		servers:      cfg.Servers,
+		name:         *name,
+		agentID:      cfg.AgentID,
+		credential:   cfg.Credential,
+		tlsConfig:    tlsConfig,
+		topProcesses: *topProcesses,
+		frames:       frameSettings{quality: *jpegQuality, maxSize: *captureMaxSize, lossless: *losslessRegions},
+		commands:     commandVerifier{fingerprint: cfg.Fingerprint},
+		capabilities: newCapabilityPolicy(cfg.DisabledCapabilities),
+	}
+	if *outboxSize > 0 {
+		agent.outbox = openOutbox(outboxPath(), *outboxSize)
+	}
+	if *plugins != "" {
+		agent.plugins = newPluginRunner(*plugins, *pluginInterval)
+	}
+	if disabled := agent.capabilities.list(); len(disabled) > 0 {
+		log.Printf("Disabled capabilities: %v", disabled)
+	}
+	if *tray {
+		agent.tray = newTrayIndicator(func() {
+			_ = agent.sendMessage(protocol.Message{Type: "end_session"})
+		}, agent.raiseHand)
+		agent.tray.setConnected(false)
+
+		// Take the indicator down with the agent.
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			<-sig
+			agent.tray.close()
+			os.Exit(0)
+		}()
 	}
 
+	if *localAPI != "" {
+		if err := agent.serveLocalAPI(*localAPI); err != nil {
+			log.Fatalf("Local API: %v", err)
+		}
+	}
+	go agent.runHeartbeats()
+	if agent.plugins != nil {
+		go agent.runPlugins()
+	}
 	for {
-		if err := agent.run(); err != nil {
+		err := agent.run()
+		if err != nil {
 			log.Printf("Connection error: %v", err)
 		}
-		log.Printf("Reconnecting in %s...", reconnectDelay)
-		time.Sleep(reconnectDelay)
+		delay := agent.nextDelay(err)
+		log.Printf("Reconnecting in %s...", delay)
+		time.Sleep(delay)
 	}
 }
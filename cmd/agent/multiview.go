@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/draw"
+	"log"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Multi-display views ("set_view"): every display is captured in turn,
+// shrunk and re-encoded at lower quality and frame rate, so showing all
+// of them costs about as much bandwidth as streaming one.
+const (
+	// multiCaptureInterval is the frame interval in the multi-display
+	// views (~2 FPS).
+	multiCaptureInterval = 500 * time.Millisecond
+
+	// multiJPEGQuality is the JPEG quality of multi-display frames.
+	multiJPEGQuality = 50
+
+	// multiMaxWidth caps each display's width in a multi-display frame;
+	// wider displays are scaled down to fit.
+	multiMaxWidth = 1280
+)
+
+// handleSetView switches between the single-display stream and the
+// stitched or separate views of all displays, and confirms the mode with
+// "view_changed".
+func (a *Agent) handleSetView(payload json.RawMessage) {
+	var req protocol.SetView
+	if err := json.Unmarshal(payload, &req); err != nil {
+		log.Printf("Failed to parse set_view payload: %v", err)
+		return
+	}
+	switch req.Mode {
+	case protocol.ViewSingle, protocol.ViewStitched, protocol.ViewSeparate:
+	default:
+		log.Printf("Unknown view mode %q", req.Mode)
+		return
+	}
+
+	a.captureMu.Lock()
+	a.viewMode = req.Mode
+	a.captureMu.Unlock()
+
+	log.Printf("Switched to %s view", req.Mode)
+
+	data, _ := json.Marshal(protocol.SetView{Mode: req.Mode, DisplayCount: getDisplayCount()})
+	_ = a.sendMessage(protocol.Message{Type: "view_changed", Payload: data})
+}
+
+// multiView reports whether a multi-display view is active.
+func (a *Agent) multiView() bool {
+	a.captureMu.Lock()
+	defer a.captureMu.Unlock()
+	return a.viewMode != "" && a.viewMode != protocol.ViewSingle
+}
+
+// captureAllDisplays captures every display for mode: one BinScreen frame
+// with the displays side by side for ViewStitched, or one BinDisplay
+// frame per display for ViewSeparate. Each frame goes through stamp
+// before it is encoded.
+func captureAllDisplays(mode string, stamp func(image.Image) image.Image) ([][]byte, error) {
+	count := getDisplayCount()
+	shots := make([]*image.RGBA, 0, count)
+	for d := 1; d <= count; d++ {
+		shots = append(shots, scaleDown(captureScreen(d), multiMaxWidth, 0))
+	}
+
+	if mode == protocol.ViewStitched {
+		frame, err := encodeJPEG([]byte{protocol.BinScreen}, stamp(stitch(shots)), multiJPEGQuality)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{frame}, nil
+	}
+	frames := make([][]byte, 0, len(shots))
+	for i, img := range shots {
+		frame, err := encodeJPEG([]byte{protocol.BinDisplay, byte(i + 1)}, stamp(img), multiJPEGQuality)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// stitch places images left to right, top-aligned, on a black canvas.
+func stitch(imgs []*image.RGBA) *image.RGBA {
+	width, height := 0, 0
+	for _, img := range imgs {
+		width += img.Rect.Dx()
+		height = max(height, img.Rect.Dy())
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Rect, image.Black, image.Point{}, draw.Src)
+	x := 0
+	for _, img := range imgs {
+		r := image.Rect(x, 0, x+img.Rect.Dx(), img.Rect.Dy())
+		draw.Draw(dst, r, img, img.Rect.Min, draw.Src)
+		x += img.Rect.Dx()
+	}
+	return dst
+}
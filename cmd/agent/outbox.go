@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Store and forward: heartbeats and support requests that cannot reach
+// the server, because it is down for maintenance or the network is, are
+// appended to a file next to the agent's configuration, one JSON message
+// per line, and replayed ("backlog") after the next registration, oldest
+// first and with their original times, so the server's health history
+// has no gap. The file holds at most -outbox-size messages; when it is
+// full the oldest quarter is dropped. It survives agent restarts.
+
+// defaultOutboxSize keeps a day of heartbeats.
+const defaultOutboxSize = int(24 * time.Hour / heartbeatInterval)
+
+// maxOutboxLine bounds one buffered message.
+const maxOutboxLine = 1 << 20
+
+func outboxPath() string {
+	return filepath.Join(filepath.Dir(configPath()), "outbox.jsonl")
+}
+
+// outbox is the bounded file of messages awaiting the server.
+type outbox struct {
+	mu      sync.Mutex
+	path    string
+	limit   int
+	count   int // messages in the file
+	dropped int // discarded since the last replay
+}
+
+// openOutbox returns the outbox at path, counting the messages an earlier
+// run left in it.
+func openOutbox(path string, limit int) *outbox {
+	o := &outbox{path: path, limit: limit}
+	lines, _ := o.read()
+	o.count = len(lines)
+	if o.count > 0 {
+		log.Printf("Outbox: %d messages awaiting the server", o.count)
+	}
+	return o
+}
+
+// add appends msg, first dropping the oldest messages if the file is full.
+func (o *outbox) add(msg protocol.Message) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.count >= o.limit {
+		lines, err := o.read()
+		if err != nil {
+			return err
+		}
+		keep := lines[len(lines)-min(len(lines), o.limit*3/4):]
+		if err := o.write(keep); err != nil {
+			return err
+		}
+		o.dropped += len(lines) - len(keep)
+		o.count = len(keep)
+	}
+	if err := os.MkdirAll(filepath.Dir(o.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	}
+	o.count++
+	return f.Close()
+}
+
+// size returns how many messages are buffered.
+func (o *outbox) size() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.count
+}
+
+// drain replays the buffered messages through send, in batches of
+// protocol.MaxBacklogBatch, and empties the file. On a send error the
+// messages not yet sent stay buffered.
+func (o *outbox) drain(send func(protocol.Backlog) error) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.count == 0 && o.dropped == 0 {
+		return 0, nil
+	}
+	lines, err := o.read()
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for sent < len(lines) || o.dropped > 0 {
+		batch := protocol.Backlog{Dropped: o.dropped}
+		n := 0
+		for _, line := range lines[sent:min(len(lines), sent+protocol.MaxBacklogBatch)] {
+			var msg protocol.Message
+			if json.Unmarshal(line, &msg) == nil {
+				batch.Messages = append(batch.Messages, msg)
+			}
+			n++
+		}
+		if err := send(batch); err != nil {
+			rest := lines[sent:]
+			if werr := o.write(rest); werr == nil {
+				o.count = len(rest)
+			}
+			return sent, err
+		}
+		sent += n
+		o.dropped = 0
+	}
+	o.count = 0
+	if err := os.Remove(o.path); err != nil && !os.IsNotExist(err) {
+		return sent, err
+	}
+	return sent, nil
+}
+
+// read returns the file's lines; a missing file has none.
+func (o *outbox) read() ([][]byte, error) {
+	f, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	var lines [][]byte
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, maxOutboxLine)
+	for sc.Scan() {
+		if line := bytes.TrimSpace(sc.Bytes()); len(line) > 0 {
+			lines = append(lines, bytes.Clone(line))
+		}
+	}
+	return lines, sc.Err()
+}
+
+// write replaces the file's contents with lines.
+func (o *outbox) write(lines [][]byte) error {
+	tmp := o.path + ".tmp"
+	data := append(bytes.Join(lines, []byte{'\n'}), '\n')
+	if len(lines) == 0 {
+		data = nil
+	}
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.path)
+}
+
+// buffer keeps msg for the next connection; false if there is no outbox
+// or the message could not be written.
+func (a *Agent) buffer(msg protocol.Message) bool {
+	if a.outbox == nil {
+		return false
+	}
+	if err := a.outbox.add(msg); err != nil {
+		log.Printf("Outbox: %v", err)
+		return false
+	}
+	return true
+}
+
+// replayOutbox sends what was buffered while the server was unreachable.
+func (a *Agent) replayOutbox() {
+	if a.outbox == nil {
+		return
+	}
+	n, err := a.outbox.drain(func(b protocol.Backlog) error {
+		payload, _ := json.Marshal(b)
+		return a.sendMessage(protocol.Message{Type: "backlog", Payload: payload})
+	})
+	if err != nil {
+		log.Printf("Outbox replay stopped after %d messages: %v", n, err)
+	} else if n > 0 {
+		log.Printf("Outbox: replayed %d messages", n)
+	}
+}
+
+// runHeartbeats takes a heartbeat every heartbeatInterval for as long as
+// the agent runs: sent while the agent is connected, buffered otherwise.
+func (a *Agent) runHeartbeats() {
+	var procs processSampler
+	if a.topProcesses {
+		procs.top() // baseline for the first heartbeat's CPU figures
+	}
+	var health healthSampler
+	health.sample()
+	a.reboot.status()
+	a.timeSync.status()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var hb protocol.Heartbeat
+		if boot := a.bootTime.Load(); boot > 0 {
+			hb.UptimeSeconds = time.Now().Unix() - boot
+		}
+		hb.RebootRequired, hb.RebootReasons = a.reboot.status()
+		if a.topProcesses {
+			hb.TopCPU, hb.TopMemory = procs.top()
+		}
+		hb.Health = health.sample()
+		hb.TimeSync = a.timeSync.status()
+		hb.Time = time.Now().UnixMilli()
+		if a.connected.Load() {
+			payload, _ := json.Marshal(hb)
+			if a.sendMessage(protocol.Message{Type: "heartbeat", Payload: payload}) == nil {
+				continue
+			}
+		}
+		// The server keeps only the health of replayed heartbeats.
+		hb.TopCPU, hb.TopMemory = nil, nil
+		payload, _ := json.Marshal(hb)
+		a.buffer(protocol.Message{Type: "heartbeat", Payload: payload})
+	}
+}
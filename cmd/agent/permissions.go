@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// handlePermissionsRequest reports the agent's OS permissions, prompting
+// the local user for missing ones first when asked to.
+func (a *Agent) handlePermissionsRequest(payload json.RawMessage) {
+	var req protocol.PermissionsRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	go func() {
+		res := protocol.PermissionsResult{ID: req.ID}
+		if req.Prompt {
+			if err := requestPermissions(checkPermissions()); err != nil {
+				res.Error = err.Error()
+			} else {
+				log.Println("Requested missing permissions from the local user")
+			}
+		}
+		res.Permissions = checkPermissions()
+		data, _ := json.Marshal(res)
+		_ = a.sendMessage(protocol.Message{Type: "permissions_result", Payload: data})
+	}()
+}
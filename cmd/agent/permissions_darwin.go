@@ -0,0 +1,77 @@
+//go:build darwin
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// The checks run as JavaScript for Automation through osascript, since
+// the agent has no cgo. macOS charges a helper's permissions to the
+// process that launched it, so they report and prompt for the agent's
+// own permissions, which are also what its in-process capture and its
+// osascript helpers run under.
+const (
+	screenRecordingCheck = `ObjC.bindFunction('CGPreflightScreenCaptureAccess', ['bool', []]);
+$.CGPreflightScreenCaptureAccess()`
+	screenRecordingPrompt = `ObjC.bindFunction('CGRequestScreenCaptureAccess', ['bool', []]);
+$.CGRequestScreenCaptureAccess()`
+	accessibilityCheck = `ObjC.import('ApplicationServices');
+$.AXIsProcessTrusted()`
+	accessibilityPrompt = `ObjC.import('ApplicationServices');
+$.AXIsProcessTrustedWithOptions($({AXTrustedCheckOptionPrompt: true}))`
+)
+
+// System Settings panes for each permission.
+const (
+	screenRecordingPane = "x-apple.systempreferences:com.apple.preference.security?Privacy_ScreenCapture"
+	accessibilityPane   = "x-apple.systempreferences:com.apple.preference.security?Privacy_Accessibility"
+)
+
+// checkPermissions reports the Screen Recording and Accessibility
+// permissions.
+func checkPermissions() *protocol.Permissions {
+	return &protocol.Permissions{
+		ScreenRecording: permissionState(screenRecordingCheck),
+		Accessibility:   permissionState(accessibilityCheck),
+	}
+}
+
+// permissionState runs a check script that prints true or false.
+func permissionState(script string) string {
+	out, err := runJXA(script)
+	switch {
+	case err != nil:
+		return protocol.PermissionUnknown
+	case out == "true":
+		return protocol.PermissionGranted
+	default:
+		return protocol.PermissionDenied
+	}
+}
+
+// requestPermissions shows the OS prompt for each permission missing in
+// current and opens System Settings on its pane, where the local user
+// can grant it.
+func requestPermissions(current *protocol.Permissions) error {
+	var errs []error
+	if current.ScreenRecording != protocol.PermissionGranted {
+		_, err := runJXA(screenRecordingPrompt)
+		errs = append(errs, err, exec.Command("open", screenRecordingPane).Run())
+	}
+	if current.Accessibility != protocol.PermissionGranted {
+		_, err := runJXA(accessibilityPrompt)
+		errs = append(errs, err, exec.Command("open", accessibilityPane).Run())
+	}
+	return errors.Join(errs...)
+}
+
+// runJXA runs script with osascript and returns its trimmed result.
+func runJXA(script string) (string, error) {
+	out, err := exec.Command("osascript", "-l", "JavaScript", "-e", script).Output()
+	return strings.TrimSpace(string(out)), err
+}
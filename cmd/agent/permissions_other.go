@@ -0,0 +1,16 @@
+//go:build !darwin
+
+package main
+
+import "github.com/avaropoint/rmm/internal/protocol"
+
+// checkPermissions returns nil: only macOS gates capture and input
+// behind per-application permissions.
+func checkPermissions() *protocol.Permissions {
+	return nil
+}
+
+// requestPermissions has nothing to ask for outside macOS.
+func requestPermissions(*protocol.Permissions) error {
+	return nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Plugins: executables an operator drops into the plugins directory
+// (-plugins, "plugins" next to agent.json by default) are bespoke checks
+// the agent runs on a schedule, every -plugin-interval unless the plugin
+// asks otherwise, and on command (protocol.PluginRequest). Each run is
+// given a protocol.PluginInput on standard input and must write one
+// protocol.PluginOutput to standard output within pluginTimeout; its
+// status, metrics and inventory go to the server ("plugin_results"). The
+// directory is rescanned every pluginTick, so plugins come and go
+// without restarting the agent.
+//
+// Plugins run as the agent's user, so the agent runs only files it
+// trusts (see pluginTrusted): on Linux and macOS, executables that, with
+// their directory, belong to root or the agent's user and are writable
+// by no one else; on Windows, .exe, .bat and .cmd files.
+
+const (
+	// defaultPluginInterval is how often plugins run on schedule.
+	defaultPluginInterval = 5 * time.Minute
+	// minPluginInterval is the shortest interval a plugin may ask for.
+	minPluginInterval = 30 * time.Second
+	// pluginTimeout bounds each run, so a run on command answers within
+	// the server's call timeout.
+	pluginTimeout = 10 * time.Second
+	// pluginTick is how often the directory is rescanned for plugins
+	// that are due.
+	pluginTick = 15 * time.Second
+	// maxPluginOutput bounds a plugin's standard output; maxPluginStderr
+	// the standard error kept for the result's error.
+	maxPluginOutput = 64 << 10
+	maxPluginStderr = 512
+)
+
+func pluginsPath() string {
+	return filepath.Join(filepath.Dir(configPath()), "plugins")
+}
+
+// pluginRunner runs the plugins in dir.
+type pluginRunner struct {
+	dir      string
+	interval time.Duration
+
+	mu      sync.Mutex
+	plugins map[string]*plugin // by name
+	refused map[string]string  // files not run, with why; logged once
+}
+
+// plugin is one executable in the plugins directory.
+type plugin struct {
+	name string
+	path string
+	busy sync.Mutex // held while running
+
+	next time.Time              // next scheduled run, guarded by pluginRunner.mu
+	last *protocol.PluginResult // guarded by pluginRunner.mu
+}
+
+func newPluginRunner(dir string, interval time.Duration) *pluginRunner {
+	return &pluginRunner{dir: dir, interval: interval, plugins: map[string]*plugin{}, refused: map[string]string{}}
+}
+
+// scan brings the plugin list up to date with the directory and returns
+// the plugins due to run on schedule.
+func (r *pluginRunner) scan(now time.Time) []*plugin {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Plugins: %v", err)
+	}
+	found := map[string]string{}
+	refused := map[string]string{}
+	for _, e := range entries {
+		file := e.Name()
+		name := strings.TrimSuffix(file, filepath.Ext(file))
+		if e.IsDir() || strings.HasPrefix(file, ".") {
+			continue
+		}
+		path := filepath.Join(r.dir, file)
+		switch {
+		case !protocol.ValidPluginName(name):
+			refused[path] = "invalid name"
+		case found[name] != "":
+			refused[path] = "another file is plugin " + name
+		default:
+			if err := pluginTrusted(path); err != nil {
+				refused[path] = err.Error()
+			} else {
+				found[name] = path
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for path, why := range refused {
+		if r.refused[path] != why {
+			log.Printf("Plugins: not running %s: %s", path, why)
+		}
+	}
+	r.refused = refused
+	for name, p := range r.plugins {
+		if found[name] != p.path {
+			delete(r.plugins, name)
+			log.Printf("Plugins: %s removed", name)
+		}
+	}
+	var due []*plugin
+	for name, path := range found {
+		p, ok := r.plugins[name]
+		if !ok {
+			p = &plugin{name: name, path: path, next: now}
+			r.plugins[name] = p
+			log.Printf("Plugins: %s added (%s)", name, path)
+		}
+		if !now.Before(p.next) {
+			p.next = now.Add(r.interval) // until the run says otherwise
+			due = append(due, p)
+		}
+	}
+	return due
+}
+
+// lookup returns the plugin called name, rescanning the directory so a
+// plugin dropped in moments ago is found.
+func (r *pluginRunner) lookup(name string) *plugin {
+	r.mu.Lock()
+	p := r.plugins[name]
+	r.mu.Unlock()
+	if p != nil {
+		return p
+	}
+	r.scan(time.Now())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.plugins[name]
+}
+
+// latest returns the last result of every plugin, by name.
+func (r *pluginRunner) latest() []protocol.PluginResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var results []protocol.PluginResult
+	for _, p := range r.plugins {
+		if p.last != nil {
+			results = append(results, *p.last)
+		}
+	}
+	slices.SortFunc(results, func(a, b protocol.PluginResult) int { return strings.Compare(a.Plugin, b.Plugin) })
+	return results
+}
+
+// run runs p once, unless it is already running, and records the result.
+func (r *pluginRunner) run(p *plugin, in protocol.PluginInput) (protocol.PluginResult, error) {
+	if !p.busy.TryLock() {
+		return protocol.PluginResult{}, fmt.Errorf("plugin %s is already running", p.name)
+	}
+	defer p.busy.Unlock()
+	in.Plugin = p.name
+	res := execPlugin(p.path, r.dir, in)
+
+	r.mu.Lock()
+	p.last = &res
+	if in.Trigger == protocol.PluginScheduled && res.Interval > 0 {
+		p.next = time.UnixMilli(res.Time).Add(min(max(time.Duration(res.Interval)*time.Second, minPluginInterval), protocol.MaxPluginInterval*time.Second))
+	}
+	r.mu.Unlock()
+	if res.Error != "" {
+		log.Printf("Plugin %s: %s", p.name, res.Error)
+	}
+	return res, nil
+}
+
+// execPlugin runs the executable at path with in on its standard input
+// and decodes its output.
+func execPlugin(path, dir string, in protocol.PluginInput) protocol.PluginResult {
+	start := time.Now()
+	res := protocol.PluginResult{Plugin: in.Plugin, Trigger: in.Trigger}
+	input, _ := json.Marshal(in)
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(input)
+	stdout := &cappedBuffer{limit: maxPluginOutput + 1}
+	stderr := &cappedBuffer{limit: maxPluginStderr}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	cmd.WaitDelay = time.Second // children left holding the pipes
+	err := cmd.Run()
+
+	end := time.Now()
+	res.Time, res.DurationMS = end.UnixMilli(), end.Sub(start).Milliseconds()
+	switch {
+	case ctx.Err() != nil:
+		err = fmt.Errorf("timed out after %s", pluginTimeout)
+	case err != nil:
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+	case stdout.Len() > maxPluginOutput:
+		err = fmt.Errorf("output exceeds %d bytes", maxPluginOutput)
+	default:
+		err = json.Unmarshal(stdout.Bytes(), &res.PluginOutput)
+		if err == nil {
+			err = checkPluginOutput(&res.PluginOutput)
+		} else {
+			err = fmt.Errorf("invalid output: %w", err)
+		}
+	}
+	if err != nil {
+		res.PluginOutput = protocol.PluginOutput{Status: protocol.PluginCritical}
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// checkPluginOutput defaults an empty status and rejects unknown ones.
+func checkPluginOutput(out *protocol.PluginOutput) error {
+	switch out.Status {
+	case "":
+		out.Status = protocol.PluginOK
+	case protocol.PluginOK, protocol.PluginWarning, protocol.PluginCritical:
+	default:
+		return fmt.Errorf("invalid status %q", out.Status)
+	}
+	if out.Interval < 0 {
+		return errors.New("negative interval")
+	}
+	return nil
+}
+
+// cappedBuffer keeps the first limit bytes written to it and discards
+// the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		b.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// runPlugins runs plugins on schedule for as long as the agent runs,
+// reporting their results while the agent is connected.
+func (a *Agent) runPlugins() {
+	log.Printf("Plugins: %s, every %s", a.plugins.dir, a.plugins.interval)
+	ticker := time.NewTicker(pluginTick)
+	defer ticker.Stop()
+	for {
+		for _, p := range a.plugins.scan(time.Now()) {
+			go func() {
+				res, err := a.plugins.run(p, a.pluginInput(protocol.PluginScheduled, nil))
+				if err == nil {
+					a.reportPlugins(res)
+				}
+			}()
+		}
+		<-ticker.C
+	}
+}
+
+func (a *Agent) pluginInput(trigger string, args map[string]string) protocol.PluginInput {
+	return protocol.PluginInput{Trigger: trigger, AgentID: a.agentID, OS: runtime.GOOS, Arch: runtime.GOARCH, Args: args}
+}
+
+// reportPlugins sends results to the server if the agent is connected.
+// Results of runs while it is not are sent by reportPluginState.
+func (a *Agent) reportPlugins(results ...protocol.PluginResult) {
+	if len(results) == 0 || !a.connected.Load() {
+		return
+	}
+	payload, _ := json.Marshal(protocol.PluginResults{Results: results})
+	_ = a.sendMessage(protocol.Message{Type: "plugin_results", Payload: payload})
+}
+
+// reportPluginState sends the latest result of every plugin, after
+// registration.
+func (a *Agent) reportPluginState() {
+	if a.plugins != nil {
+		a.reportPlugins(a.plugins.latest()...)
+	}
+}
+
+// handlePluginRequest runs a plugin on command off the message loop.
+func (a *Agent) handlePluginRequest(payload json.RawMessage) {
+	var req protocol.PluginRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	go func() {
+		reply := protocol.PluginReply{ID: req.ID}
+		var p *plugin
+		switch {
+		case a.plugins == nil:
+			reply.Error = "plugins are disabled on this agent"
+		case !protocol.ValidPluginName(req.Plugin):
+			reply.Error = "invalid plugin name"
+		default:
+			if p = a.plugins.lookup(req.Plugin); p == nil {
+				reply.Error = fmt.Sprintf("no plugin named %q", req.Plugin)
+			}
+		}
+		if p != nil {
+			res, err := a.plugins.run(p, a.pluginInput(protocol.PluginCommanded, req.Args))
+			if err != nil {
+				reply.Error = err.Error()
+			} else {
+				reply.Result = &res
+			}
+		}
+		log.Printf("Plugin %s run on command: %s", req.Plugin, reply.Error)
+		data, _ := json.Marshal(reply)
+		_ = a.sendMessage(protocol.Message{Type: "plugin_result", Payload: data})
+	}()
+}
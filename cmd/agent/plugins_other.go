@@ -0,0 +1,28 @@
+//go:build !darwin && !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pluginTrusted returns why the agent will not run the file at path, or
+// nil: it must be an .exe, .bat or .cmd file. Access to the directory is
+// left to its ACL.
+func pluginTrusted(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("not a file")
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".exe", ".bat", ".cmd":
+		return nil
+	}
+	return errors.New("not an .exe, .bat or .cmd file")
+}
@@ -0,0 +1,37 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// pluginTrusted returns why the agent will not run the file at path, or
+// nil: it must be an executable regular file, and it and its directory
+// owned by root or the agent's user and writable by no one else.
+func pluginTrusted(path string) error {
+	for _, p := range []string{filepath.Dir(path), path} {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.New("owner unknown")
+		}
+		if st.Uid != 0 && int(st.Uid) != os.Getuid() {
+			return fmt.Errorf("%s is owned by uid %d", p, st.Uid)
+		}
+		if info.Mode().Perm()&0o022 != 0 {
+			return fmt.Errorf("%s is writable by group or others", p)
+		}
+		if p == path && (!info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0) {
+			return errors.New("not an executable file")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// capabilityPolicy holds the capability classes the agent refuses (see
+// protocol.CommandCapability). Classes are only ever added while the
+// agent runs; re-enabling one means editing agent.json locally.
+type capabilityPolicy struct {
+	mu       sync.Mutex
+	disabled []string
+}
+
+// newCapabilityPolicy disables the classes listed in the local config.
+// Unknown names are logged and ignored.
+func newCapabilityPolicy(classes []string) *capabilityPolicy {
+	p := &capabilityPolicy{}
+	for _, c := range classes {
+		if !protocol.ValidCapability(c) {
+			log.Printf("Ignoring unknown capability class %q in config", c)
+			continue
+		}
+		p.add(c)
+	}
+	return p
+}
+
+// allows reports whether commands in class may run.
+func (p *capabilityPolicy) allows(class string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !slices.Contains(p.disabled, class)
+}
+
+// lock disables the classes the server's policy locks off, and reports
+// whether any of them was not disabled already.
+func (p *capabilityPolicy) lock(classes []string) bool {
+	added := false
+	for _, c := range classes {
+		if protocol.ValidCapability(c) && p.add(c) {
+			added = true
+		}
+	}
+	return added
+}
+
+func (p *capabilityPolicy) add(class string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if slices.Contains(p.disabled, class) {
+		return false
+	}
+	p.disabled = append(p.disabled, class)
+	slices.Sort(p.disabled)
+	return true
+}
+
+// list returns the disabled classes, sorted.
+func (p *capabilityPolicy) list() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.disabled)
+}
+
+// lockCapabilities applies the classes locked off by the server's policy
+// and records them in agent.json, so they stay disabled even if a later
+// server stops sending them.
+func (a *Agent) lockCapabilities(classes []string) {
+	if !a.capabilities.lock(classes) {
+		return
+	}
+	disabled := a.capabilities.list()
+	log.Printf("Server policy disabled capabilities; now disabled: %v", disabled)
+	cfg, err := loadConfig()
+	if err != nil {
+		return // not enrolled: nothing to record them in
+	}
+	cfg.DisabledCapabilities = disabled
+	if err := saveConfig(cfg); err != nil {
+		log.Printf("Failed to record disabled capabilities: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// handlePowerRequest reboots or shuts down the machine. The result is
+// sent once the OS has accepted the command, which on every platform
+// returns before the machine goes down.
+func (a *Agent) handlePowerRequest(payload json.RawMessage) {
+	var req protocol.PowerRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	go func() {
+		res := protocol.PowerResult{ID: req.ID}
+		if err := runPowerAction(req.Action); err != nil {
+			res.Error = err.Error()
+		} else {
+			log.Printf("Power action %q accepted", req.Action)
+		}
+		data, _ := json.Marshal(res)
+		_ = a.sendMessage(protocol.Message{Type: "power_result", Payload: data})
+	}()
+}
+
+// runPowerAction asks the OS to reboot or shut down now.
+func runPowerAction(action string) error {
+	var args []string
+	switch {
+	case runtime.GOOS == "windows" && action == protocol.PowerReboot:
+		args = []string{"shutdown", "/r", "/t", "5"}
+	case runtime.GOOS == "windows" && action == protocol.PowerShutdown:
+		args = []string{"shutdown", "/s", "/t", "5"}
+	case action == protocol.PowerReboot:
+		args = []string{"shutdown", "-r", "now"}
+	case action == protocol.PowerShutdown:
+		args = []string{"shutdown", "-h", "now"}
+	default:
+		return fmt.Errorf("unknown power action %q", action)
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s: %s", args[0], msg)
+		}
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	return nil
+}
+
+// Answers from the reboot countdown dialog. No answer (the countdown ran
+// out, or there is no dialog tool) is "".
+const (
+	rebootNow      = "restart"
+	rebootPostpone = "postpone"
+)
+
+// handleRebootNotice warns the local user of a scheduled reboot and
+// reboots when the countdown ends or they choose to restart now, unless
+// they postpone it. The countdown runs off the message loop; one shows at
+// a time.
+func (a *Agent) handleRebootNotice(payload json.RawMessage) {
+	var req protocol.RebootNotice
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+	reply := func(res protocol.RebootNoticeResult) {
+		data, _ := json.Marshal(res)
+		_ = a.sendMessage(protocol.Message{Type: "reboot_notice_result", Payload: data})
+	}
+	if !a.counting.CompareAndSwap(false, true) {
+		reply(protocol.RebootNoticeResult{ID: req.ID, Error: "a reboot countdown is already showing"})
+		return
+	}
+
+	go func() {
+		defer a.counting.Store(false)
+		countdown := time.Duration(max(req.Countdown, 0)) * time.Second
+		deadline := time.Now().Add(countdown)
+		res := protocol.RebootNoticeResult{ID: req.ID}
+		answer := promptRebootCountdown(req, countdown)
+		if answer == rebootPostpone {
+			log.Printf("Scheduled reboot postponed by the local user for %d minutes", req.DeferMinutes)
+			res.Deferred = true
+			reply(res)
+			return
+		}
+		if answer != rebootNow {
+			time.Sleep(time.Until(deadline))
+		}
+		if err := runPowerAction(protocol.PowerReboot); err != nil {
+			res.Error = err.Error()
+		} else {
+			log.Printf("Scheduled reboot accepted")
+		}
+		reply(res)
+	}()
+}
+
+// promptRebootCountdown shows the logged-in user the coming reboot with
+// "Restart Now" and, while deferrals are left, "Postpone" buttons, using
+// the platform's built-in tooling. The dialog closes when the countdown
+// ends.
+func promptRebootCountdown(req protocol.RebootNotice, countdown time.Duration) string {
+	title := dialogTitle("Scheduled Restart")
+	msg := fmt.Sprintf("This computer will restart for maintenance in %d minutes. Save your work.",
+		int((countdown+time.Minute-1)/time.Minute))
+	if req.Message != "" {
+		msg = sanitizePrompt(req.Message) + " " + msg
+	}
+	later, postpone := "Later", ""
+	if req.DeferralsLeft > 0 {
+		later, postpone = "Postpone", rebootPostpone
+		msg += fmt.Sprintf(" You can postpone it by %d minutes (%d more times).", req.DeferMinutes, req.DeferralsLeft)
+	}
+	secs := int(countdown / time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), countdown)
+	defer cancel()
+
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf(`display dialog "%s" with title "%s" buttons {"%s", "Restart Now"} `+
+			`default button "Restart Now" giving up after %d`, msg, title, later, secs)
+		out, err := exec.CommandContext(ctx, "osascript", "-e", script).Output()
+		switch {
+		case err != nil || strings.Contains(string(out), "gave up:true"):
+			return ""
+		case strings.Contains(string(out), "button returned:Restart Now"):
+			return rebootNow
+		}
+		return postpone
+	case "linux":
+		var cmd *exec.Cmd
+		if _, err := exec.LookPath("zenity"); err == nil {
+			cmd = exec.CommandContext(ctx, "zenity", "--question", "--title="+title, "--text="+msg,
+				"--ok-label=Restart Now", "--cancel-label="+later, fmt.Sprintf("--timeout=%d", secs))
+		} else if _, err := exec.LookPath("kdialog"); err == nil {
+			cmd = exec.CommandContext(ctx, "kdialog", "--title", title,
+				"--yes-label", "Restart Now", "--no-label", later, "--yesno", msg)
+		} else {
+			log.Println("Reboot countdown prompt unavailable: install zenity or kdialog")
+			return ""
+		}
+		// Both exit 0 for the first button and 1 for the second; zenity
+		// exits 5 when its timeout expires.
+		err := cmd.Run()
+		var exit *exec.ExitError
+		switch {
+		case err == nil:
+			return rebootNow
+		case ctx.Err() == nil && errors.As(err, &exit) && exit.ExitCode() == 1:
+			return postpone
+		}
+		return ""
+	case "windows":
+		// WScript.Shell Popup: 4 = Yes/No, 48 = warning icon; 6 = Yes,
+		// 7 = No, -1 = timed out.
+		msg += " Restart now?"
+		switch windowsPopup(ctx, title, msg, secs, 52) {
+		case "6":
+			return rebootNow
+		case "7":
+			return postpone
+		}
+		return ""
+	}
+	return ""
+}
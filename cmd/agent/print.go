@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// printPollInterval and printPollTimeout bound how long a submitted job is
+// watched for completion.
+const (
+	printPollInterval = 2 * time.Second
+	printPollTimeout  = 10 * time.Minute
+)
+
+// printFile submits a received upload to the default printer, reports the result, and
+// where the spooler allows it, follows the job until it leaves the queue.
+func (a *Agent) printFile(id, title, path string) {
+	defer os.Remove(path) //nolint:errcheck
+
+	if !isPDF(path) {
+		a.sendPrintStatus(id, protocol.PrintFailed, "", "not a PDF document")
+		return
+	}
+	job, err := submitPrintJob(title, path)
+	if err != nil {
+		log.Printf("Print %q failed: %v", title, err)
+		a.sendPrintStatus(id, protocol.PrintFailed, "", err.Error())
+		return
+	}
+	log.Printf("Print %q submitted (job %q)", title, job)
+	a.sendPrintStatus(id, protocol.PrintSubmitted, job, "")
+
+	if job == "" {
+		return // No job ID to follow.
+	}
+	deadline := time.Now().Add(printPollTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(printPollInterval)
+		if !printJobPending(job) {
+			a.sendPrintStatus(id, protocol.PrintCompleted, job, "")
+			return
+		}
+	}
+}
+
+// lpJobPattern extracts the job ID from lp's "request id is X (1 file(s))".
+var lpJobPattern = regexp.MustCompile(`request id is (\S+)`)
+
+// submitPrintJob hands a PDF to the platform spooler and returns the job
+// ID when the spooler reports one.
+func submitPrintJob(title, path string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		cmd = exec.Command("lp", "-t", title, path)
+	case "darwin":
+		cmd = exec.Command("lpr", "-T", title, path)
+	case "windows":
+		// Out-Printer only renders text, so PDFs go through the
+		// registered handler's print verb.
+		script := fmt.Sprintf(`Start-Process -FilePath '%s' -Verb Print -WindowStyle Hidden -PassThru | `+
+			`Wait-Process -Timeout 120 -ErrorAction SilentlyContinue`, strings.ReplaceAll(path, "'", "''"))
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", script)
+	default:
+		return "", fmt.Errorf("printing not supported on %s", runtime.GOOS)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return "", errors.New(msg)
+		}
+		return "", err
+	}
+	if m := lpJobPattern.FindSubmatch(out); m != nil {
+		return string(m[1]), nil
+	}
+	return "", nil
+}
+
+// printJobPending reports whether a CUPS job is still queued.
+func printJobPending(job string) bool {
+	out, err := exec.Command("lpstat", "-W", "not-completed", "-o").Output()
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if f := strings.Fields(line); len(f) > 0 && f[0] == job {
+			return true
+		}
+	}
+	return false
+}
+
+// isPDF checks the file header for the PDF magic.
+func isPDF(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close() //nolint:errcheck
+	head := make([]byte, 5)
+	_, err = f.Read(head)
+	return err == nil && bytes.Equal(head, []byte("%PDF-"))
+}
+
+func (a *Agent) sendPrintStatus(id, status, job, errMsg string) {
+	payload, _ := json.Marshal(protocol.PrintStatus{ID: id, Status: status, Job: job, Error: errMsg})
+	_ = a.sendMessage(protocol.Message{Type: "print_status", Payload: payload})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// processSample is one process's cumulative CPU time and current memory,
+// as read by the platform's listProcesses.
+type processSample struct {
+	PID     int
+	Name    string
+	CPUTime time.Duration
+	Memory  uint64
+}
+
+// processSampler turns successive process listings into per-interval CPU
+// usage. The zero value is ready to use; the first call only records a
+// baseline, so its CPU figures are zero.
+type processSampler struct {
+	prev map[int]time.Duration
+	at   time.Time
+}
+
+// top lists processes and returns the busiest by CPU and by memory, or
+// nothing if the listing failed.
+func (p *processSampler) top() (byCPU, byMemory []protocol.ProcessInfo) {
+	samples, err := listProcesses()
+	if err != nil || len(samples) == 0 {
+		return nil, nil
+	}
+	now := time.Now()
+	elapsed := now.Sub(p.at)
+
+	procs := make([]protocol.ProcessInfo, 0, len(samples))
+	cur := make(map[int]time.Duration, len(samples))
+	for _, s := range samples {
+		cur[s.PID] = s.CPUTime
+		info := protocol.ProcessInfo{PID: s.PID, Name: s.Name, Memory: s.Memory}
+		// A PID missing from the previous listing started since then (or
+		// was reused); its usage is counted from the next heartbeat.
+		if before, ok := p.prev[s.PID]; ok && elapsed > 0 && s.CPUTime >= before {
+			pct := float64(s.CPUTime-before) / float64(elapsed) * 100
+			info.CPU = math.Round(pct*10) / 10
+		}
+		procs = append(procs, info)
+	}
+	p.prev, p.at = cur, now
+
+	sort.Slice(procs, func(i, j int) bool { return procs[i].CPU > procs[j].CPU })
+	for _, pi := range procs[:min(protocol.TopProcessCount, len(procs))] {
+		if pi.CPU > 0 {
+			byCPU = append(byCPU, pi)
+		}
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Memory > procs[j].Memory })
+	byMemory = append(byMemory, procs[:min(protocol.TopProcessCount, len(procs))]...)
+	return byCPU, byMemory
+}
@@ -0,0 +1,55 @@
+//go:build darwin
+
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listProcesses reads every process's CPU time and resident set with a
+// single ps invocation; libproc is not reachable without cgo.
+func listProcesses() ([]processSample, error) {
+	out, err := exec.Command("ps", "-axo", "pid=,time=,rss=,comm=").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var procs []processSample
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		rss, _ := strconv.ParseUint(fields[2], 10, 64)
+		procs = append(procs, processSample{
+			PID:     pid,
+			Name:    filepath.Base(strings.Join(fields[3:], " ")),
+			CPUTime: parsePSTime(fields[1]),
+			Memory:  rss * 1024, // ps reports KiB
+		})
+	}
+	return procs, nil
+}
+
+// parsePSTime parses ps's cumulative CPU time, "[[dd-]hh:]mm:ss.cc".
+func parsePSTime(s string) time.Duration {
+	var days int
+	if d, rest, ok := strings.Cut(s, "-"); ok {
+		days, _ = strconv.Atoi(d)
+		s = rest
+	}
+	var secs float64
+	for _, part := range strings.Split(s, ":") {
+		v, _ := strconv.ParseFloat(part, 64)
+		secs = secs*60 + v
+	}
+	return time.Duration((float64(days)*86400 + secs) * float64(time.Second))
+}
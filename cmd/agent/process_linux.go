@@ -0,0 +1,63 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc/<pid>/stat. It is
+// 100 on every mainstream architecture.
+const clockTicks = 100
+
+// listProcesses reads every process's CPU time and resident set from
+// /proc/<pid>/stat.
+func listProcesses() ([]processSample, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	pageSize := uint64(os.Getpagesize())
+
+	var out []processSample
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			continue // exited, or not ours to read
+		}
+		// "pid (comm) state ppid ...": comm may contain spaces and
+		// parentheses, so split at the last ')'.
+		s := string(data)
+		lp, rp := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+		if lp < 0 || rp < lp {
+			continue
+		}
+		fields := strings.Fields(s[rp+1:])
+		// fields[0] is state (field 3); utime, stime and rss are fields
+		// 14, 15 and 24.
+		if len(fields) < 22 {
+			continue
+		}
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		rss, _ := strconv.ParseInt(fields[21], 10, 64)
+		if rss < 0 {
+			rss = 0
+		}
+		out = append(out, processSample{
+			PID:     pid,
+			Name:    s[lp+1 : rp],
+			CPUTime: time.Duration(utime+stime) * time.Second / clockTicks,
+			Memory:  uint64(rss) * pageSize,
+		})
+	}
+	return out, nil
+}
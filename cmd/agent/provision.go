@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// provisionRetryDelay is the pause between enrollment attempts from the
+// provisioning file. A first boot may come before the network is up.
+const provisionRetryDelay = 30 * time.Second
+
+// provisioningPath is where a golden image or MDM profile places the
+// provisioning file by default: next to the agent's configuration.
+func provisioningPath() string {
+	return filepath.Join(filepath.Dir(configPath()), protocol.ProvisioningFile)
+}
+
+// loadProvisioning reads a provisioning file from /api/provisioning.
+func loadProvisioning(path string) (*protocol.Provisioning, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p protocol.Provisioning
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if p.ServerURL == "" || p.Code == "" {
+		return nil, fmt.Errorf("%s: server_url and code required", path)
+	}
+	if p.CACert != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(p.CACert)) {
+		return nil, fmt.Errorf("%s: invalid CA certificate", path)
+	}
+	return &p, nil
+}
+
+// provisionReason reports why the agent must enroll from its provisioning
+// file: it has no configuration yet (loadErr), or its configuration was
+// enrolled on another machine, as when an image is captured from an
+// enrolled machine. It is empty when the configuration is the agent's own.
+func provisionReason(cfg *AgentConfig, loadErr error) string {
+	if loadErr != nil || cfg == nil {
+		return protocol.ProvisionFirstBoot
+	}
+	if cfg.MachineID == "" {
+		return "" // enrolled before machine IDs were recorded
+	}
+	if id := machineID(); id != "" && !strings.EqualFold(id, cfg.MachineID) {
+		return protocol.ProvisionCloned
+	}
+	return ""
+}
+
+// provisionAgent enrolls from the provisioning file, retrying until it
+// succeeds, and saves the resulting configuration. The server must answer
+// with the platform fingerprint the file pins. prev is the cloned
+// configuration being replaced, if any.
+func provisionAgent(p *protocol.Provisioning, prev *AgentConfig, reason, name string, insecure, bindKey bool) *AgentConfig {
+	prov := protocol.Provenance{
+		TokenID:   p.TokenID,
+		Image:     p.Image,
+		Reason:    reason,
+		CreatedAt: p.CreatedAt,
+	}
+	if reason == protocol.ProvisionCloned && prev != nil {
+		prov.ClonedFrom = prev.AgentID
+		log.Printf("Machine ID changed since enrollment as %s; enrolling this clone afresh", prev.AgentID)
+	}
+	log.Printf("Provisioning from image %q with server %s...", p.Image, p.ServerURL)
+
+	for {
+		cfg, err := enrollProvisioned(p, name, insecure, bindKey, &prov)
+		if err != nil {
+			log.Printf("Provisioning failed: %v; retrying in %s", err, provisionRetryDelay)
+			time.Sleep(provisionRetryDelay)
+			continue
+		}
+		// Retrying cannot fix a mismatch, and would use the token again.
+		if p.Fingerprint != "" && cfg.Fingerprint != p.Fingerprint {
+			log.Fatalf("Provisioning refused: server platform fingerprint %s does not match the pinned %s", cfg.Fingerprint, p.Fingerprint)
+		}
+		if prev != nil {
+			cfg.DisabledCapabilities = prev.DisabledCapabilities
+			cfg.Discovery = prev.Discovery
+		}
+		if err := saveConfig(cfg); err != nil {
+			log.Fatalf("Failed to save config: %v", err)
+		}
+		log.Printf("Provisioned (agent ID: %s)", cfg.AgentID)
+		return cfg
+	}
+}
+
+// enrollProvisioned enrolls with the file's code, checking the server's
+// certificate against the file's CA certificate when it has one and its
+// signed reply against the file's platform fingerprint.
+func enrollProvisioned(p *protocol.Provisioning, name string, insecure, bindKey bool, prov *protocol.Provenance) (*AgentConfig, error) {
+	tlsCfg := &tls.Config{InsecureSkipVerify: insecure} //nolint:gosec
+	if p.CACert != "" {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM([]byte(p.CACert))
+		tlsCfg = &tls.Config{RootCAs: pool}
+	}
+	return enroll(p.ServerURL, p.Code, name, p.Fingerprint, tlsCfg, bindKey, prov)
+}
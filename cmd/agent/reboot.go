@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rebootCheck caches the pending-reboot state between heartbeats. Checks
+// run in the background so a slow one (macOS asks Apple's update catalog)
+// never delays a heartbeat.
+type rebootCheck struct {
+	mu       sync.Mutex
+	required bool
+	reasons  []string
+	checked  time.Time
+	running  bool
+}
+
+// rebootCheckInterval is how long a check result is reused.
+func rebootCheckInterval() time.Duration {
+	if runtime.GOOS == "darwin" {
+		return time.Hour
+	}
+	return 5 * time.Minute
+}
+
+// status returns the last result and starts a new check when it is stale.
+func (c *rebootCheck) status() (bool, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running && time.Since(c.checked) >= rebootCheckInterval() {
+		c.running = true
+		go func() {
+			required, reasons := rebootPending()
+			c.mu.Lock()
+			c.required, c.reasons, c.checked, c.running = required, reasons, time.Now(), false
+			c.mu.Unlock()
+		}()
+	}
+	return c.required, c.reasons
+}
+
+// rebootPending reports whether the operating system is waiting for a
+// reboot to finish installing updates, and what is waiting.
+func rebootPending() (bool, []string) {
+	var reasons []string
+	switch runtime.GOOS {
+	case "windows":
+		// PendingFileRenameOperations is left out: installers and
+		// antivirus set it routinely, so it would rarely be clear.
+		keys := []struct{ key, reason string }{
+			{`HKLM\SOFTWARE\Microsoft\Windows\CurrentVersion\Component Based Servicing\RebootPending`, "Component Based Servicing"},
+			{`HKLM\SOFTWARE\Microsoft\Windows\CurrentVersion\WindowsUpdate\Auto Update\RebootRequired`, "Windows Update"},
+		}
+		for _, k := range keys {
+			if exec.Command("reg", "query", k.key).Run() == nil {
+				reasons = append(reasons, k.reason)
+			}
+		}
+	case "linux":
+		// Debian and Ubuntu flag the reboot in a file, with the packages
+		// that asked for it; Fedora and RHEL answer via needs-restarting.
+		if _, err := os.Stat("/var/run/reboot-required"); err == nil {
+			if f, err := os.Open("/var/run/reboot-required.pkgs"); err == nil {
+				sc := bufio.NewScanner(f)
+				for sc.Scan() {
+					if pkg := strings.TrimSpace(sc.Text()); pkg != "" {
+						reasons = append(reasons, pkg)
+					}
+				}
+				f.Close() //nolint:errcheck
+			}
+			if len(reasons) == 0 {
+				reasons = append(reasons, "reboot-required")
+			}
+		} else if path, err := exec.LookPath("needs-restarting"); err == nil {
+			var exit *exec.ExitError
+			if err := exec.Command(path, "-r").Run(); err != nil && errors.As(err, &exit) && exit.ExitCode() == 1 {
+				reasons = append(reasons, "needs-restarting")
+			}
+		}
+	case "darwin":
+		out, err := exec.Command("softwareupdate", "-l").Output()
+		if err == nil {
+			reasons = parseSoftwareUpdateRestarts(string(out))
+		}
+	}
+	return len(reasons) > 0, reasons
+}
+
+// parseSoftwareUpdateRestarts returns the labels of updates in
+// `softwareupdate -l` output that need a restart. Newer releases put
+// "Action: restart" on the line after "* Label: …"; older ones end the
+// update's line with "[restart]".
+func parseSoftwareUpdateRestarts(out string) []string {
+	var labels []string
+	var label string
+	for _, line := range strings.Split(out, "\n") {
+		t := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(t, "* Label:"):
+			label = strings.TrimSpace(strings.TrimPrefix(t, "* Label:"))
+		case strings.Contains(t, "Action: restart") && label != "":
+			labels = append(labels, label)
+			label = ""
+		case strings.HasSuffix(t, "[restart]"):
+			name, _, _ := strings.Cut(t, ",")
+			labels = append(labels, strings.TrimSpace(name))
+		}
+	}
+	return labels
+}
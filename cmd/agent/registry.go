@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Remote settings access. The server enforces the path allowlist; the
+// agent only maps each request onto the platform's own tool so values
+// are read and written exactly as a local administrator would.
+
+// regTypes maps request types to reg.exe value types.
+var regTypes = map[string]string{
+	"":              "REG_SZ",
+	"string":        "REG_SZ",
+	"expand_string": "REG_EXPAND_SZ",
+	"dword":         "REG_DWORD",
+	"qword":         "REG_QWORD",
+}
+
+// defaultsTypes lists the value types accepted by `defaults write`.
+var defaultsTypes = map[string]bool{"": true, "string": true, "int": true, "float": true, "bool": true}
+
+// handleRegistryRequest runs a registry request off the message loop and
+// reports the result.
+func (a *Agent) handleRegistryRequest(payload json.RawMessage) {
+	var req protocol.RegistryRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	go func() {
+		res := protocol.RegistryResult{ID: req.ID}
+		var err error
+		switch req.Op {
+		case protocol.RegistryRead:
+			res.Value, res.Type, err = registryRead(req.Path, req.Name)
+		case protocol.RegistryWrite:
+			err = registryWrite(req.Path, req.Name, req.Value, req.Type)
+			log.Printf("Registry write %s %s: err=%v", req.Path, req.Name, err)
+		default:
+			err = fmt.Errorf("unknown operation %q", req.Op)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		data, _ := json.Marshal(res)
+		_ = a.sendMessage(protocol.Message{Type: "registry_result", Payload: data})
+	}()
+}
+
+// checkRegistryArgs rejects arguments the platform tools would parse as
+// options.
+func checkRegistryArgs(args ...string) error {
+	for _, s := range args {
+		if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "/") || strings.ContainsAny(s, "\x00\n") {
+			return fmt.Errorf("invalid path or name %q", s)
+		}
+	}
+	return nil
+}
+
+// registryRead returns the current value and its type.
+func registryRead(path, name string) (value, typ string, err error) {
+	if err := checkRegistryArgs(path, name); err != nil {
+		return "", "", err
+	}
+	switch runtime.GOOS {
+	case "windows":
+		args := []string{"query", path, "/v", name}
+		if name == "" {
+			args = []string{"query", path, "/ve"}
+		}
+		out, err := runSettingsTool("reg", args...)
+		if err != nil {
+			return "", "", err
+		}
+		return parseRegQuery(out)
+	case "darwin":
+		if name == "" {
+			return "", "", errors.New("name required")
+		}
+		out, err := runSettingsTool("defaults", "read", path, name)
+		if err != nil {
+			return "", "", err
+		}
+		typ, _ := runSettingsTool("defaults", "read-type", path, name)
+		return strings.TrimRight(out, "\n"), strings.TrimPrefix(strings.TrimSpace(typ), "Type is "), nil
+	case "linux":
+		if name == "" {
+			return "", "", errors.New("name required")
+		}
+		out, err := runSettingsTool("gsettings", "get", path, name)
+		if err != nil {
+			return "", "", err
+		}
+		return strings.TrimSpace(out), "gvariant", nil
+	}
+	return "", "", fmt.Errorf("settings access not supported on %s", runtime.GOOS)
+}
+
+// registryWrite sets a value, creating the key or domain if needed.
+func registryWrite(path, name, value, typ string) error {
+	if err := checkRegistryArgs(path, name); err != nil {
+		return err
+	}
+	switch runtime.GOOS {
+	case "windows":
+		regType, ok := regTypes[typ]
+		if !ok {
+			return fmt.Errorf("unsupported type %q", typ)
+		}
+		args := []string{"add", path, "/v", name, "/t", regType, "/d", value, "/f"}
+		if name == "" {
+			args = []string{"add", path, "/ve", "/t", regType, "/d", value, "/f"}
+		}
+		_, err := runSettingsTool("reg", args...)
+		return err
+	case "darwin":
+		if name == "" {
+			return errors.New("name required")
+		}
+		if !defaultsTypes[typ] {
+			return fmt.Errorf("unsupported type %q", typ)
+		}
+		if typ == "" {
+			typ = "string"
+		}
+		_, err := runSettingsTool("defaults", "write", path, name, "-"+typ, value)
+		return err
+	case "linux":
+		if name == "" {
+			return errors.New("name required")
+		}
+		_, err := runSettingsTool("gsettings", "set", path, name, value)
+		return err
+	}
+	return fmt.Errorf("settings access not supported on %s", runtime.GOOS)
+}
+
+// regTypeName maps a reg.exe type back to the request type name.
+func regTypeName(regType string) string {
+	for name, t := range regTypes {
+		if name != "" && t == regType {
+			return name
+		}
+	}
+	return strings.ToLower(strings.TrimPrefix(regType, "REG_"))
+}
+
+// runSettingsTool runs a command and folds its stderr into the error.
+func runSettingsTool(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return "", errors.New(msg)
+		}
+		return "", err
+	}
+	return string(out), nil
+}
+
+// parseRegQuery extracts the value from `reg query` output, whose data
+// lines read "    Name    REG_TYPE    data".
+func parseRegQuery(out string) (value, typ string, err error) {
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "    ") {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimSpace(line), "    ", 3)
+		if len(fields) >= 2 && strings.HasPrefix(fields[1], "REG_") {
+			if len(fields) == 3 {
+				value = strings.TrimRight(fields[2], "\r")
+			}
+			return value, regTypeName(strings.TrimRight(fields[1], "\r")), nil
+		}
+	}
+	return "", "", errors.New("value not found")
+}
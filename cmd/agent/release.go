@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// releaseSigner is the base64 Ed25519 public key that signs this build's
+// releases, set at build time:
+//
+//	go build -ldflags "-X main.releaseSigner=<key>" ./cmd/agent
+//
+// "make agents AGENT_SIGNER=<key>" does the same. Builds without one
+// cannot check their own signature.
+var releaseSigner string
+
+// verifySelf checks the running binary: with release, its release
+// signature against the built-in signer; with osSig, the operating
+// system's own code signature (Authenticode on Windows, Gatekeeper on
+// macOS).
+func verifySelf(release, osSig bool) error {
+	path, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate agent binary: %w", err)
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return fmt.Errorf("locate agent binary: %w", err)
+	}
+	if release {
+		if err := verifyRelease(path, releaseSigner); err != nil {
+			return err
+		}
+	}
+	if osSig {
+		if err := verifyOSSignature(path); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+// verifyRelease checks that the binary at path carries signer's release
+// signature in its detached signature file.
+func verifyRelease(path, signer string) error {
+	key, err := base64.StdEncoding.DecodeString(signer)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("the built-in release signer is not an Ed25519 public key")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("hash %s: %w", filepath.Base(path), err)
+	}
+	sigPath := path + protocol.ReleaseSignatureSuffix
+	raw, err := os.ReadFile(sigPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s is not signed (no %s)", filepath.Base(path), filepath.Base(sigPath))
+	}
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || !ed25519.Verify(key, protocol.ReleaseDigest(h.Sum(nil)), sig) {
+		return fmt.Errorf("%s does not match its release signature; it was altered or signed by another platform", filepath.Base(path))
+	}
+	return nil
+}
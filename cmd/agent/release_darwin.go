@@ -0,0 +1,22 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// verifyOSSignature checks the binary's code signature and that Gatekeeper
+// accepts it, which for a binary from outside the App Store means it is
+// signed with a Developer ID and notarized.
+func verifyOSSignature(path string) error {
+	if out, err := exec.Command("codesign", "--verify", "--strict", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("code signature invalid: %s", strings.TrimSpace(string(out)))
+	}
+	if out, err := exec.Command("spctl", "--assess", "--type", "execute", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("rejected by Gatekeeper: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// handleScreenshotRequest captures one frame off the message loop for the
+// server's screenshot archive. Unlike the live stream it never falls back
+// to a test pattern.
+func (a *Agent) handleScreenshotRequest(payload json.RawMessage) {
+	var req protocol.ScreenshotRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	go func() {
+		res := protocol.ScreenshotResult{ID: req.ID, Display: req.Display}
+		if res.Display == 0 {
+			res.Display = 1
+		}
+		if n := getDisplayCount(); res.Display > n {
+			res.Error = fmt.Sprintf("display %d not found (have %d)", res.Display, n)
+		} else if img, err := captureDisplay(res.Display, a.frames.quality); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Image = img
+		}
+		data, _ := json.Marshal(res)
+		_ = a.sendMessage(protocol.Message{Type: "screenshot_result", Payload: data})
+	}()
+}
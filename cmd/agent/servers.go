@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Server failover: an agent knows its servers in order of preference —
+// those discovered through DNS, then the list the server hands out
+// (server_urls in its config), then the last one it connected to — and
+// connects to the first that answers. A server that answers but does not
+// confirm registration is demoted to the end of the list for demoteFor.
+// Connected to any but the first, the agent checks the ones before it
+// every failbackInterval, and moves back once one has passed
+// failbackChecks health checks in a row, outside remote sessions.
+//
+// A server shutting down for a restart says when to reconnect
+// ("server_closing"), as does one that refuses the agent for a quota;
+// the agent waits that long instead of reconnectDelay, so the fleet
+// comes back spread out.
+
+const (
+	// failbackInterval is how often a preferred server is checked.
+	failbackInterval = time.Minute
+	// failbackChecks is how many health checks in a row a preferred
+	// server must pass before the agent moves back to it, so a flapping
+	// server does not bounce the fleet.
+	failbackChecks = 2
+	// healthTimeout bounds one health check.
+	healthTimeout = 5 * time.Second
+	// demoteFor is how long a server that failed registration is tried
+	// last.
+	demoteFor = 10 * time.Minute
+	// maxReconnectAfter caps the wait a closing server can ask for.
+	maxReconnectAfter = 5 * time.Minute
+)
+
+// webSocketURL turns a server URL (https://host:port/prefix) into the
+// base the agent connects to (wss://host:port/prefix).
+func webSocketURL(base string) string {
+	base = strings.TrimRight(base, "/")
+	base = strings.Replace(base, "https://", "wss://", 1)
+	return strings.Replace(base, "http://", "ws://", 1)
+}
+
+// httpURL is the inverse of webSocketURL.
+func httpURL(base string) string {
+	base = strings.Replace(base, "wss://", "https://", 1)
+	return strings.Replace(base, "ws://", "http://", 1)
+}
+
+// candidates returns the servers to try, most preferred first.
+func (a *Agent) candidates() []string {
+	var urls []string
+	if a.discovery != "" {
+		found, err := discoverServers(a.discovery, a.commands.fingerprint)
+		if err != nil {
+			log.Printf("Server discovery for %s failed: %v", a.discovery, err)
+		}
+		urls = append(urls, found...)
+	}
+	a.serversMu.Lock()
+	urls = append(urls, a.servers...)
+	a.serversMu.Unlock()
+	urls = append(urls, a.serverURL)
+
+	var out, demoted []string
+	for _, u := range urls {
+		switch {
+		case u == "" || slices.Contains(out, u) || slices.Contains(demoted, u):
+		case time.Now().Before(a.demoted[u]):
+			demoted = append(demoted, u)
+		default:
+			out = append(out, u)
+		}
+	}
+	return append(out, demoted...)
+}
+
+// demote moves a server that failed registration to the end of the list
+// for a while.
+func (a *Agent) demote(u string) {
+	if a.demoted == nil {
+		a.demoted = make(map[string]time.Time)
+	}
+	a.demoted[u] = time.Now().Add(demoteFor)
+}
+
+// dial connects to the first of the candidate servers that answers, and
+// records the ones preferred over it for failback.
+func (a *Agent) dial() (net.Conn, *bufio.Reader, error) {
+	urls := a.candidates()
+	var errs []error
+	for i, u := range urls {
+		conn, reader, err := dialWebSocket(u, a.tlsConfig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", u, err))
+			continue
+		}
+		a.preferred = slices.DeleteFunc(slices.Clone(urls[:i]), func(p string) bool {
+			return time.Now().Before(a.demoted[p])
+		})
+		if u != a.serverURL {
+			log.Printf("Switching to server %s", u)
+			a.serverURL = u
+		}
+		return conn, reader, nil
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// rememberServer saves the server the agent registered with, so it
+// starts with that one if DNS or the others are down at its next start.
+func (a *Agent) rememberServer() {
+	u := a.serverURL
+	a.updateConfig(func(cfg *AgentConfig) { cfg.ServerURL = u })
+}
+
+// setServers records the server list the server sent at registration.
+func (a *Agent) setServers(servers []string) {
+	urls := make([]string, 0, len(servers))
+	for _, s := range servers {
+		urls = append(urls, webSocketURL(s))
+	}
+	a.serversMu.Lock()
+	changed := !slices.Equal(a.servers, urls)
+	a.servers = urls
+	a.serversMu.Unlock()
+	if changed {
+		log.Printf("Servers: %s", strings.Join(urls, ", "))
+		a.updateConfig(func(cfg *AgentConfig) { cfg.Servers = urls })
+	}
+}
+
+// updateConfig applies change to the saved configuration, if the agent
+// has one of its own.
+func (a *Agent) updateConfig(change func(*AgentConfig)) {
+	cfg, err := loadConfig()
+	if err != nil || cfg.AgentID != a.agentID {
+		return
+	}
+	before, _ := json.Marshal(cfg)
+	change(cfg)
+	if after, _ := json.Marshal(cfg); bytes.Equal(before, after) {
+		return
+	}
+	if err := saveConfig(cfg); err != nil {
+		log.Printf("Failed to save config: %v", err)
+	}
+}
+
+// watchFailback checks the servers preferred over the current one until
+// done is closed, and closes conn, the current connection, once one is
+// healthy, so the agent reconnects to it.
+func (a *Agent) watchFailback(done <-chan struct{}, conn net.Conn, preferred []string) {
+	ticker := time.NewTicker(failbackInterval)
+	defer ticker.Stop()
+	passed := make(map[string]int)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		for _, u := range preferred {
+			if !a.healthy(u) {
+				passed[u] = 0
+				continue
+			}
+			if passed[u]++; passed[u] < failbackChecks {
+				continue
+			}
+			a.captureMu.Lock()
+			busy := a.capture != nil
+			a.captureMu.Unlock()
+			if busy {
+				break // wait for the session to end
+			}
+			log.Printf("Server %s is healthy again; moving back to it", u)
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// healthy reports whether the server at u answers its health check.
+func (a *Agent) healthy(u string) bool {
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: a.tlsConfig, DialContext: serverDialer().DialContext},
+		Timeout:   healthTimeout,
+	}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(httpURL(u) + "/healthz")
+	if err != nil {
+		return false
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// handleServerClosing records when the closing server wants the agent
+// back.
+func (a *Agent) handleServerClosing(payload json.RawMessage) {
+	var notice protocol.ServerClosing
+	if err := json.Unmarshal(payload, &notice); err != nil || notice.ReconnectAfterMS <= 0 {
+		return
+	}
+	a.reconnectAfter = min(time.Duration(notice.ReconnectAfterMS)*time.Millisecond, maxReconnectAfter)
+	log.Printf("Server is shutting down; reconnecting in %s", a.reconnectAfter)
+}
+
+// retryLater is a server's refusal that says when to try again: a
+// registration turned away for a quota, or a full server's 503.
+type retryLater struct {
+	reason string
+	after  time.Duration
+}
+
+func (e *retryLater) Error() string { return e.reason }
+
+// nextDelay returns the pause before the next connection attempt after
+// run returned err: the one the server asked for when it refused or
+// closed the connection, or reconnectDelay.
+func (a *Agent) nextDelay(err error) time.Duration {
+	d := reconnectDelay
+	var later *retryLater
+	if errors.As(err, &later) && later.after > 0 {
+		d = min(later.after, maxReconnectAfter)
+	}
+	if a.reconnectAfter > 0 {
+		d, a.reconnectAfter = a.reconnectAfter, 0
+	}
+	return d
+}
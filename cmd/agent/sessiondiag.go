@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Session diagnostics: each capture run keeps moving averages of how long
+// a frame takes to capture, encode and send, so "why is it slow?" has an
+// answer. Slow captures point at the agent's CPU or the platform tool;
+// slow sends, and frames dropped for want of credit, at the connection.
+
+// timingWeight is the weight of the newest sample in each moving average.
+const timingWeight = 0.2
+
+// frameTimings are a capture run's moving averages, in milliseconds.
+type frameTimings struct {
+	mu         sync.Mutex
+	capture    float64
+	encode     float64
+	send       float64
+	frameBytes float64
+	interval   float64 // between frames sent
+	lastSent   time.Time
+}
+
+// ewma folds sample into avg, starting from the first sample.
+func ewma(avg, sample float64) float64 {
+	if avg == 0 {
+		return sample
+	}
+	return avg + timingWeight*(sample-avg)
+}
+
+func ms(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+// captured records the time to grab and to encode one capture.
+func (t *frameTimings) captured(capture, encode time.Duration) {
+	t.mu.Lock()
+	t.capture = ewma(t.capture, ms(capture))
+	t.encode = ewma(t.encode, ms(encode))
+	t.mu.Unlock()
+}
+
+// sent records one frame written to the connection.
+func (t *frameTimings) sent(size int, took time.Duration) {
+	now := time.Now()
+	t.mu.Lock()
+	t.send = ewma(t.send, ms(took))
+	t.frameBytes = ewma(t.frameBytes, float64(size))
+	if !t.lastSent.IsZero() {
+		t.interval = ewma(t.interval, ms(now.Sub(t.lastSent)))
+	}
+	t.lastSent = now
+	t.mu.Unlock()
+}
+
+// handleSessionDiagnosticsRequest answers with the capture run's timings.
+func (a *Agent) handleSessionDiagnosticsRequest(payload json.RawMessage) {
+	var req protocol.SessionDiagnosticsRequest
+	if json.Unmarshal(payload, &req) != nil {
+		return
+	}
+	res := protocol.SessionDiagnostics{ID: req.ID}
+
+	a.captureMu.Lock()
+	run, credit := a.capture, a.screenCredit
+	a.captureMu.Unlock()
+	if run != nil {
+		res.Active = true
+		res.IntervalMS = int(captureInterval.Milliseconds())
+		res.Pending = len(run.latest)
+		res.CreditBytes = -1
+		if credit != nil {
+			res.CreditBytes = credit.Balance()
+		}
+		res.FramesSent, res.FramesDropped = run.sent.Load(), run.dropped.Load()
+		res.DroppedNoCredit = run.noCredit.Load()
+
+		t := &run.timings
+		t.mu.Lock()
+		res.CaptureMS, res.EncodeMS, res.SendMS = round1(t.capture), round1(t.encode), round1(t.send)
+		res.FrameBytes = int(t.frameBytes)
+		if t.interval > 0 {
+			res.FPS = round1(1000 / t.interval)
+		}
+		t.mu.Unlock()
+	}
+	data, _ := json.Marshal(res)
+	_ = a.sendMessage(protocol.Message{Type: "session_diagnostics_result", Payload: data})
+}
+
+// round1 rounds to one decimal place.
+func round1(v float64) float64 {
+	return float64(int64(v*10+0.5)) / 10
+}
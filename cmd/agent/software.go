@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// softwareStep is one package manager command run for a request.
+// Optional steps (refreshing package lists) may fail without failing the
+// request.
+type softwareStep struct {
+	args     []string
+	optional bool
+}
+
+// rebootExitCodes are the Windows Installer exit codes, also passed on
+// by Chocolatey, for success with a reboot needed to finish.
+var rebootExitCodes = []int{1641, 3010}
+
+// aptOptions run apt-get unattended, keeping existing configuration
+// files rather than prompting.
+var aptOptions = []string{"-y", "-q", "-o", "Dpkg::Options::=--force-confdef", "-o", "Dpkg::Options::=--force-confold"}
+
+// stagedPackageMaxAge is how long a staged installer waits for its
+// software request before it is discarded.
+const stagedPackageMaxAge = 24 * time.Hour
+
+// stagedPackages holds installers received over the file channel
+// (FilePurposePackage) until the software request naming them runs.
+type stagedPackages struct {
+	mu    sync.Mutex
+	paths map[string]string // by upload ID
+}
+
+// add renames a received installer to the upload ID with the original
+// extension, which some installers (apt-get) require, and records it.
+func (p *stagedPackages) add(id, tmp, name string) (string, error) {
+	path := filepath.Join(filepath.Dir(tmp), filepath.Base(id)+strings.ToLower(filepath.Ext(name)))
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paths == nil {
+		p.paths = make(map[string]string)
+	}
+	p.paths[id] = path
+	return path, nil
+}
+
+// take removes the installer staged by the upload from the set and
+// returns its path, or "" if there is none.
+func (p *stagedPackages) take(id string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	path := p.paths[id]
+	delete(p.paths, id)
+	return path
+}
+
+// packagesDir is where installers are staged.
+func packagesDir() string {
+	return filepath.Join(filepath.Dir(configPath()), "packages")
+}
+
+// pruneStagedPackages removes installers whose request never came, such
+// as those staged before the agent restarted.
+func pruneStagedPackages(dir string) {
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > stagedPackageMaxAge {
+			_ = os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+// handleSoftwareRequest installs or removes a package off the message
+// loop. Requests run one at a time, since package managers lock their
+// databases.
+func (a *Agent) handleSoftwareRequest(payload json.RawMessage) {
+	var req protocol.SoftwareRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	installer := ""
+	if protocol.InstallerManager(req.Manager) {
+		installer = a.staged.take(req.Artifact)
+	}
+	go func() {
+		if installer != "" {
+			defer os.Remove(installer) //nolint:errcheck
+		}
+		a.softwareMu.Lock()
+		res := runSoftwareRequest(req, installer)
+		a.softwareMu.Unlock()
+		log.Printf("Software %s of %q with %s: exit=%d error=%q", req.Action, req.Package, req.Manager, res.ExitCode, res.Error)
+		data, _ := json.Marshal(res)
+		_ = a.sendMessage(protocol.Message{Type: "software_result", Payload: data})
+	}()
+}
+
+// runSoftwareRequest runs the request's commands within its timeout,
+// collecting their combined output. installer is the staged file for an
+// installer format.
+func runSoftwareRequest(req protocol.SoftwareRequest, installer string) protocol.SoftwareResult {
+	res := protocol.SoftwareResult{ID: req.ID, ExitCode: -1}
+	steps, env, err := softwareSteps(req, installer)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	timeout := time.Duration(req.Timeout) * time.Second
+	if req.Timeout <= 0 || req.Timeout > protocol.MaxSoftwareTimeout {
+		timeout = protocol.DefaultSoftwareTimeout * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	out := &logTail{max: protocol.MaxSoftwareOutput}
+	for _, step := range steps {
+		fmt.Fprintf(out, "$ %s\n", strings.Join(step.args, " "))
+		cmd := exec.CommandContext(ctx, step.args[0], step.args[1:]...)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdout, cmd.Stderr = out, out
+		err := cmd.Run()
+		res.ExitCode = -1
+		if cmd.ProcessState != nil {
+			res.ExitCode = cmd.ProcessState.ExitCode()
+		}
+		switch {
+		case ctx.Err() != nil:
+			res.Error = fmt.Sprintf("%s timed out after %s", step.args[0], timeout)
+		case err == nil || step.optional:
+		case (req.Manager == protocol.ManagerChoco || req.Manager == protocol.ManagerMSI) && slices.Contains(rebootExitCodes, res.ExitCode):
+			fmt.Fprintln(out, "(a reboot is required to finish)")
+		default:
+			res.Error = fmt.Sprintf("%s failed: %v", step.args[0], err)
+		}
+		if res.Error != "" {
+			break
+		}
+	}
+	res.Output = string(out.bytes())
+	return res
+}
+
+// softwareSteps builds the commands, and extra environment, that carry
+// out the request with its package manager.
+func softwareSteps(req protocol.SoftwareRequest, installer string) ([]softwareStep, []string, error) {
+	if goos, ok := protocol.ManagerOS[req.Manager]; !ok || goos != runtime.GOOS {
+		return nil, nil, fmt.Errorf("package manager %q is not supported on %s", req.Manager, runtime.GOOS)
+	}
+	if protocol.InstallerManager(req.Manager) {
+		return installerSteps(req, installer)
+	}
+	if req.Action != protocol.SoftwareInstall && req.Action != protocol.SoftwareUninstall {
+		return nil, nil, fmt.Errorf("unknown action %q", req.Action)
+	}
+	if !protocol.ValidPackageName(req.Package) || (req.Version != "" && !protocol.ValidPackageVersion(req.Version)) {
+		return nil, nil, errors.New("invalid package name or version")
+	}
+	install := req.Action == protocol.SoftwareInstall
+
+	switch req.Manager {
+	case protocol.ManagerApt:
+		if _, err := exec.LookPath("apt-get"); err != nil {
+			return nil, nil, errors.New("apt-get is not installed")
+		}
+		env := []string{"DEBIAN_FRONTEND=noninteractive"}
+		if !install {
+			return []softwareStep{{args: slices.Concat([]string{"apt-get", "remove"}, aptOptions, []string{req.Package})}}, env, nil
+		}
+		pkg := req.Package
+		if req.Version != "" {
+			pkg += "=" + req.Version
+		}
+		return []softwareStep{
+			{args: []string{"apt-get", "update", "-q"}, optional: true},
+			{args: slices.Concat([]string{"apt-get", "install"}, aptOptions, []string{pkg})},
+		}, env, nil
+
+	case protocol.ManagerBrew:
+		brew, err := brewCommand()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !install {
+			return []softwareStep{{args: append(brew, "uninstall", req.Package)}}, nil, nil
+		}
+		pkg := req.Package
+		if req.Version != "" {
+			pkg += "@" + req.Version // versioned formulae, e.g. python@3.12
+		}
+		return []softwareStep{{args: append(brew, "install", pkg)}}, nil, nil
+
+	default:
+		choco, err := exec.LookPath("choco")
+		if err != nil {
+			choco = filepath.Join(os.Getenv("ProgramData"), "chocolatey", "bin", "choco.exe")
+			if _, err := os.Stat(choco); err != nil {
+				return nil, nil, errors.New("Chocolatey is not installed")
+			}
+		}
+		args := []string{choco, req.Action, req.Package, "-y", "--no-progress"}
+		if install && req.Version != "" {
+			args = append(args, "--version", req.Version)
+		}
+		return []softwareStep{{args: args}}, nil, nil
+	}
+}
+
+// installerSteps builds the commands that install a staged installer,
+// once its digest has been checked against the signed request.
+func installerSteps(req protocol.SoftwareRequest, installer string) ([]softwareStep, []string, error) {
+	if req.Action != protocol.SoftwareInstall {
+		return nil, nil, fmt.Errorf("%s installers can only be installed", req.Manager)
+	}
+	if installer == "" {
+		return nil, nil, errors.New("installer was not staged on the agent")
+	}
+	f, err := os.Open(installer)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	_ = f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), req.SHA256) {
+		return nil, nil, errors.New("installer SHA-256 does not match the request")
+	}
+
+	switch req.Manager {
+	case protocol.ManagerDeb:
+		if _, err := exec.LookPath("apt-get"); err != nil {
+			return []softwareStep{{args: []string{"dpkg", "-i", installer}}}, nil, nil
+		}
+		// apt-get resolves the package's dependencies, which dpkg does not.
+		args := slices.Concat([]string{"apt-get", "install"}, aptOptions, []string{installer})
+		return []softwareStep{{args: args}}, []string{"DEBIAN_FRONTEND=noninteractive"}, nil
+	case protocol.ManagerPkg:
+		return []softwareStep{{args: []string{"installer", "-pkg", installer, "-target", "/"}}}, nil, nil
+	default:
+		return []softwareStep{{args: []string{"msiexec", "/i", installer, "/qn", "/norestart"}}}, nil, nil
+	}
+}
+
+// brewCommand returns the command prefix that runs Homebrew. Homebrew
+// refuses to run as root, so a root agent runs it as the owner of the
+// installation.
+func brewCommand() ([]string, error) {
+	brew, err := exec.LookPath("brew")
+	if err != nil {
+		for _, p := range []string{"/opt/homebrew/bin/brew", "/usr/local/bin/brew"} {
+			if _, err := os.Stat(p); err == nil {
+				brew = p
+				break
+			}
+		}
+	}
+	if brew == "" {
+		return nil, errors.New("Homebrew is not installed")
+	}
+	if os.Geteuid() != 0 {
+		return []string{brew}, nil
+	}
+	out, err := exec.Command("stat", "-L", "-f", "%Su", brew).Output()
+	owner := strings.TrimSpace(string(out))
+	if err != nil || owner == "" || owner == "root" {
+		return nil, errors.New("cannot find a non-root owner of the Homebrew installation")
+	}
+	return []string{"sudo", "-u", owner, "-H", brew}, nil
+}
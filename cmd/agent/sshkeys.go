@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// SSH key management. The server keeps the inventory and decides which
+// keys each local user gets; the agent only rewrites the managed block of
+// the user's authorized_keys (see protocol.SSHKeysBegin) and reports what
+// the file holds, so the server can detect drift.
+
+// handleSSHKeysRequest runs an SSH key request off the message loop and
+// reports the result.
+func (a *Agent) handleSSHKeysRequest(payload json.RawMessage) {
+	var req protocol.SSHKeysRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	go func() {
+		res := protocol.SSHKeysResult{ID: req.ID}
+		var err error
+		switch req.Op {
+		case protocol.SSHKeysList:
+			res.Managed, res.Unmanaged, err = readAuthorizedKeys(req.User)
+		case protocol.SSHKeysApply:
+			if err = applyAuthorizedKeys(req.User, req.Keys); err == nil {
+				res.Managed, res.Unmanaged, err = readAuthorizedKeys(req.User)
+			}
+			log.Printf("SSH keys for %s: %d managed, err=%v", req.User, len(req.Keys), err)
+		default:
+			err = fmt.Errorf("unknown operation %q", req.Op)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		data, _ := json.Marshal(res)
+		_ = a.sendMessage(protocol.Message{Type: "ssh_keys_result", Payload: data})
+	}()
+}
+
+// authorizedKeysPath returns the user's authorized_keys path. The .ssh
+// directory must not be a symlink, so a user cannot redirect the agent's
+// writes into another account.
+func authorizedKeysPath(username string) (*user.User, string, error) {
+	if runtime.GOOS == "windows" {
+		return nil, "", errors.New("SSH key management is only supported on Linux and macOS")
+	}
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, "", err
+	}
+	dir := filepath.Join(u.HomeDir, ".ssh")
+	if info, err := os.Lstat(dir); err == nil && !info.IsDir() {
+		return nil, "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return u, filepath.Join(dir, "authorized_keys"), nil
+}
+
+// splitAuthorizedKeys separates the lines of an authorized_keys file into
+// those outside the managed block and the keys inside it.
+func splitAuthorizedKeys(data string) (outside, managed []string) {
+	in := false
+	for _, line := range strings.Split(strings.TrimRight(data, "\n"), "\n") {
+		switch trimmed := strings.TrimSpace(line); {
+		case trimmed == protocol.SSHKeysBegin:
+			in = true
+		case trimmed == protocol.SSHKeysEnd:
+			in = false
+		case in:
+			if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+				managed = append(managed, trimmed)
+			}
+		case line != "" || len(outside) > 0:
+			outside = append(outside, line)
+		}
+	}
+	return outside, managed
+}
+
+// readAuthorizedKeys returns the keys in the user's managed block and
+// the other keys in the file. A missing file holds none.
+func readAuthorizedKeys(username string) (managed, unmanaged []string, err error) {
+	_, path, err := authorizedKeysPath(username)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	outside, managed := splitAuthorizedKeys(string(data))
+	for _, line := range outside {
+		if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			unmanaged = append(unmanaged, trimmed)
+		}
+	}
+	if managed == nil {
+		managed = []string{}
+	}
+	return managed, unmanaged, nil
+}
+
+// applyAuthorizedKeys replaces the user's managed block with keys,
+// removing it when there are none. The file is replaced atomically and,
+// when the agent runs as root, owned by the user.
+func applyAuthorizedKeys(username string, keys []string) error {
+	for _, k := range keys {
+		if _, _, _, err := protocol.ParseSSHKey(k); err != nil {
+			return fmt.Errorf("invalid key: %w", err)
+		}
+	}
+	u, path, err := authorizedKeysPath(username)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	outside, _ := splitAuthorizedKeys(string(data))
+	for len(outside) > 0 && strings.TrimSpace(outside[len(outside)-1]) == "" {
+		outside = outside[:len(outside)-1]
+	}
+
+	var b strings.Builder
+	for _, line := range outside {
+		b.WriteString(line + "\n")
+	}
+	if len(keys) > 0 {
+		if len(outside) > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(protocol.SSHKeysBegin + "\n")
+		for _, k := range keys {
+			b.WriteString(strings.TrimSpace(k) + "\n")
+		}
+		b.WriteString(protocol.SSHKeysEnd + "\n")
+	}
+
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	chown := os.Geteuid() == 0
+	dir := filepath.Dir(path)
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return err
+		}
+		if chown {
+			_ = os.Chown(dir, uid, gid)
+		}
+	}
+	f, err := os.CreateTemp(dir, ".authorized_keys-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) //nolint:errcheck
+	if _, err := f.WriteString(b.String()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if chown {
+		if err := f.Chown(uid, gid); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Startup inventory: entries that run automatically at boot, login or on
+// a schedule. Collection and disabling are platform-specific
+// (startup_<os>.go); disabling is always reversible through the platform's
+// own mechanism rather than by deleting the entry.
+
+// startupItemID derives a stable handle for an entry so a later disable
+// request can find it again without the agent keeping any state.
+func startupItemID(kind, location, name string) string {
+	sum := sha256.Sum256([]byte(kind + "\x00" + location + "\x00" + name))
+	return hex.EncodeToString(sum[:8])
+}
+
+// newStartupItem builds an item with its ID filled in.
+func newStartupItem(kind, location, name, command string, enabled bool) protocol.StartupItem {
+	return protocol.StartupItem{
+		ID:       startupItemID(kind, location, name),
+		Kind:     kind,
+		Name:     name,
+		Command:  command,
+		Location: location,
+		Enabled:  enabled,
+	}
+}
+
+// collectEnvironment returns the agent's environment with the values of
+// likely secrets redacted. Variables such as PATH or LD_PRELOAD are the
+// interesting part for triage.
+func collectEnvironment() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			continue
+		}
+		if protocol.SecretEnvName(name) {
+			value = "[redacted]"
+		}
+		env[name] = value
+	}
+	return env
+}
+
+// handleStartupRequest lists or disables startup items off the message
+// loop and reports the resulting inventory.
+func (a *Agent) handleStartupRequest(payload json.RawMessage) {
+	var req protocol.StartupRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	go func() {
+		res := protocol.StartupResult{ID: req.ID}
+		switch req.Op {
+		case protocol.StartupList:
+		case protocol.StartupDisable:
+			if err := disableStartupItemByID(req.Item); err != nil {
+				res.Error = err.Error()
+			}
+		default:
+			res.Error = fmt.Sprintf("unknown operation %q", req.Op)
+		}
+		res.Items = collectStartupItems()
+		res.Environment = collectEnvironment()
+		data, _ := json.Marshal(res)
+		_ = a.sendMessage(protocol.Message{Type: "startup_result", Payload: data})
+	}()
+}
+
+// disableStartupItemByID re-collects the inventory, finds the item and
+// disables it.
+func disableStartupItemByID(id string) error {
+	for _, item := range collectStartupItems() {
+		if item.ID != id {
+			continue
+		}
+		if !item.Enabled {
+			return nil
+		}
+		err := disableStartupItem(item)
+		log.Printf("Disable startup item %s %q (%s): err=%v", item.Kind, item.Name, item.Location, err)
+		return err
+	}
+	return fmt.Errorf("startup item %s not found", id)
+}
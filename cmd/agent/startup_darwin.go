@@ -0,0 +1,117 @@
+//go:build darwin
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// launchdDirs are the launchd plist directories and the item kind each
+// holds. The user directory is resolved at collection time.
+var launchdDirs = []struct {
+	dir  string
+	kind string
+}{
+	{"~/Library/LaunchAgents", protocol.StartupLaunchAgent},
+	{"/Library/LaunchAgents", protocol.StartupLaunchAgent},
+	{"/Library/LaunchDaemons", protocol.StartupLaunchDaemon},
+}
+
+// collectStartupItems lists third-party launchd jobs and crontab lines.
+// Apple's own jobs under /System are left out.
+func collectStartupItems() []protocol.StartupItem {
+	home, _ := os.UserHomeDir()
+	disabled := launchdDisabled()
+
+	var items []protocol.StartupItem
+	for _, d := range launchdDirs {
+		dir := strings.Replace(d.dir, "~", home, 1)
+		files, _ := filepath.Glob(filepath.Join(dir, "*.plist"))
+		for _, path := range files {
+			job, ok := readLaunchdPlist(path)
+			if !ok {
+				continue
+			}
+			enabled := !job.Disabled && !disabled[job.Label]
+			items = append(items, newStartupItem(d.kind, path, job.Label, job.command(), enabled))
+		}
+	}
+	return append(items, cronStartupItems()...)
+}
+
+// disableStartupItem turns an entry off without deleting it.
+func disableStartupItem(item protocol.StartupItem) error {
+	switch item.Kind {
+	case protocol.StartupLaunchAgent, protocol.StartupLaunchDaemon:
+		_, err := runSettingsTool("launchctl", "disable", launchdDomain(item.Kind)+"/"+item.Name)
+		return err
+	case protocol.StartupCron:
+		return disableCronItem(item)
+	}
+	return fmt.Errorf("cannot disable %s entries", item.Kind)
+}
+
+// launchdJob holds the plist keys the inventory reports.
+type launchdJob struct {
+	Label            string   `json:"Label"`
+	Program          string   `json:"Program"`
+	ProgramArguments []string `json:"ProgramArguments"`
+	Disabled         bool     `json:"Disabled"`
+}
+
+func (j launchdJob) command() string {
+	if len(j.ProgramArguments) > 0 {
+		return strings.Join(j.ProgramArguments, " ")
+	}
+	return j.Program
+}
+
+// readLaunchdPlist converts a (possibly binary) plist to JSON with plutil.
+func readLaunchdPlist(path string) (launchdJob, bool) {
+	var job launchdJob
+	out, err := exec.Command("plutil", "-convert", "json", "-o", "-", path).Output()
+	if err != nil || json.Unmarshal(out, &job) != nil || job.Label == "" {
+		return job, false
+	}
+	return job, true
+}
+
+// launchdDomain returns the launchctl domain target for an item kind:
+// the console user's GUI session for agents, the system for daemons.
+func launchdDomain(kind string) string {
+	if kind == protocol.StartupLaunchDaemon {
+		return "system"
+	}
+	return fmt.Sprintf("gui/%d", os.Getuid())
+}
+
+// launchdDisabled returns the labels launchctl has marked disabled in
+// the user's GUI domain and the system domain.
+func launchdDisabled() map[string]bool {
+	disabled := make(map[string]bool)
+	for _, domain := range []string{launchdDomain(protocol.StartupLaunchAgent), "system"} {
+		out, err := exec.Command("launchctl", "print-disabled", domain).Output()
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			// "com.example.job" => disabled   (older macOS: => true)
+			label, state, ok := strings.Cut(strings.TrimSpace(line), "=>")
+			if !ok {
+				continue
+			}
+			state = strings.TrimSpace(state)
+			if state == "disabled" || state == "true" {
+				disabled[strings.Trim(strings.TrimSpace(label), `"`)] = true
+			}
+		}
+	}
+	return disabled
+}
@@ -0,0 +1,158 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// collectStartupItems lists enabled systemd units, XDG autostart entries
+// and crontab lines.
+func collectStartupItems() []protocol.StartupItem {
+	var items []protocol.StartupItem
+	items = append(items, systemdStartupItems(protocol.StartupSystemd)...)
+	items = append(items, systemdStartupItems(protocol.StartupSystemdUser)...)
+	items = append(items, xdgStartupItems()...)
+	items = append(items, cronStartupItems()...)
+	return items
+}
+
+// disableStartupItem turns an entry off without deleting it.
+func disableStartupItem(item protocol.StartupItem) error {
+	switch item.Kind {
+	case protocol.StartupSystemd:
+		_, err := runSettingsTool("systemctl", "disable", item.Name)
+		return err
+	case protocol.StartupSystemdUser:
+		_, err := runSettingsTool("systemctl", "--user", "disable", item.Name)
+		return err
+	case protocol.StartupXDG:
+		return disableXDGAutostart(item.Location)
+	case protocol.StartupCron:
+		return disableCronItem(item)
+	}
+	return fmt.Errorf("cannot disable %s entries", item.Kind)
+}
+
+// systemdStartupItems lists enabled service and timer units.
+func systemdStartupItems(kind string) []protocol.StartupItem {
+	args := []string{"list-unit-files", "--state=enabled", "--type=service,timer", "--no-legend", "--no-pager"}
+	location := "system"
+	if kind == protocol.StartupSystemdUser {
+		args = append([]string{"--user"}, args...)
+		location = "user"
+	}
+	out, err := exec.Command("systemctl", args...).Output()
+	if err != nil {
+		return nil
+	}
+	var items []protocol.StartupItem
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		items = append(items, newStartupItem(kind, location, fields[0], "", true))
+	}
+	return items
+}
+
+// xdgAutostartDirs returns the autostart directories, user first so its
+// entries override system ones with the same file name.
+func xdgAutostartDirs() []string {
+	var dirs []string
+	if cfg, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(cfg, "autostart"))
+	}
+	return append(dirs, "/etc/xdg/autostart")
+}
+
+// xdgStartupItems lists .desktop autostart entries. A user file shadows
+// the system file of the same name.
+func xdgStartupItems() []protocol.StartupItem {
+	var items []protocol.StartupItem
+	seen := make(map[string]bool)
+	for _, dir := range xdgAutostartDirs() {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.desktop"))
+		for _, path := range files {
+			base := filepath.Base(path)
+			if seen[base] {
+				continue
+			}
+			seen[base] = true
+			entry := parseDesktopEntry(path)
+			name := entry["Name"]
+			if name == "" {
+				name = strings.TrimSuffix(base, ".desktop")
+			}
+			enabled := entry["Hidden"] != "true" && entry["X-GNOME-Autostart-enabled"] != "false"
+			items = append(items, newStartupItem(protocol.StartupXDG, path, name, entry["Exec"], enabled))
+		}
+	}
+	return items
+}
+
+// parseDesktopEntry reads the [Desktop Entry] group of a .desktop file.
+func parseDesktopEntry(path string) map[string]string {
+	entry := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return entry
+	}
+	inGroup := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inGroup = line == "[Desktop Entry]"
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok && inGroup {
+			entry[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return entry
+}
+
+// disableXDGAutostart hides an autostart entry. System entries get a user
+// override rather than being edited, per the XDG autostart spec.
+func disableXDGAutostart(path string) error {
+	cfg, err := os.UserConfigDir()
+	if err != nil {
+		return err
+	}
+	userDir := filepath.Join(cfg, "autostart")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var out []string
+	inGroup, done := false, false
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			if inGroup && !done {
+				out = append(out, "Hidden=true")
+				done = true
+			}
+			inGroup = trimmed == "[Desktop Entry]"
+		} else if inGroup && strings.HasPrefix(trimmed, "Hidden=") {
+			line, done = "Hidden=true", true
+		}
+		out = append(out, line)
+	}
+	if !done {
+		out = append(out, "Hidden=true")
+	}
+
+	if err := os.MkdirAll(userDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(userDir, filepath.Base(path)), []byte(strings.Join(out, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,112 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// userCrontabLocation is the Location reported for the agent user's crontab.
+const userCrontabLocation = "crontab -l"
+
+// cronStartupItems lists the agent user's crontab and the system crontabs.
+func cronStartupItems() []protocol.StartupItem {
+	var items []protocol.StartupItem
+	if out, err := exec.Command("crontab", "-l").Output(); err == nil {
+		items = append(items, parseCrontab(string(out), userCrontabLocation, false)...)
+	}
+	files, _ := filepath.Glob("/etc/cron.d/*")
+	for _, path := range append([]string{"/etc/crontab"}, files...) {
+		if data, err := os.ReadFile(path); err == nil {
+			items = append(items, parseCrontab(string(data), path, true)...)
+		}
+	}
+	return items
+}
+
+// disableCronItem comments out the item's line in its crontab.
+func disableCronItem(item protocol.StartupItem) error {
+	if item.Location == userCrontabLocation {
+		out, err := exec.Command("crontab", "-l").Output()
+		if err != nil {
+			return err
+		}
+		updated, ok := disableCronLine(string(out), item.Name)
+		if !ok {
+			return errors.New("crontab line not found")
+		}
+		cmd := exec.Command("crontab", "-")
+		cmd.Stdin = strings.NewReader(updated)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("crontab: %s", strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+
+	data, err := os.ReadFile(item.Location)
+	if err != nil {
+		return err
+	}
+	updated, ok := disableCronLine(string(data), item.Name)
+	if !ok {
+		return errors.New("crontab line not found")
+	}
+	return os.WriteFile(item.Location, []byte(updated), 0644)
+}
+
+// parseCrontab returns the command lines of a crontab: user crontabs
+// have five schedule fields, system ones (withUser) a sixth user field.
+// Lines disabled by disableCronLine are returned with enabled false.
+func parseCrontab(data, location string, withUser bool) []protocol.StartupItem {
+	var items []protocol.StartupItem
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		enabled := true
+		if rest, ok := strings.CutPrefix(line, cronDisabledPrefix); ok {
+			line, enabled = rest, false
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.Contains(fields[0], "=") {
+			continue // environment assignment
+		}
+		skip := 5
+		if strings.HasPrefix(fields[0], "@") {
+			skip = 1
+		}
+		if withUser {
+			skip++
+		}
+		if len(fields) <= skip {
+			continue
+		}
+		items = append(items, newStartupItem(protocol.StartupCron, location, line,
+			strings.Join(fields[skip:], " "), enabled))
+	}
+	return items
+}
+
+// cronDisabledPrefix marks a crontab line commented out by the agent, so
+// it is still listed (as disabled) and easy to restore by hand.
+const cronDisabledPrefix = "#rmm-disabled: "
+
+// disableCronLine comments out line in a crontab's content.
+func disableCronLine(data, line string) (string, bool) {
+	lines := strings.Split(data, "\n")
+	for i, l := range lines {
+		if strings.TrimSpace(l) == line {
+			lines[i] = cronDisabledPrefix + line
+			return strings.Join(lines, "\n"), true
+		}
+	}
+	return data, false
+}
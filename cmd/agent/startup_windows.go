@@ -0,0 +1,129 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// approvedRoot is where Explorer and Task Manager record per-entry
+// enable/disable state; the entries themselves are left untouched.
+const approvedRoot = `\Software\Microsoft\Windows\CurrentVersion\Explorer\StartupApproved\`
+
+// approvedDisabled is the StartupApproved value Task Manager writes to
+// disable an entry (first byte odd = disabled).
+const approvedDisabled = "030000000000000000000000"
+
+// runKeys are the Run registry keys and their StartupApproved keys.
+// RunOnce entries have no approval key and cannot be disabled this way.
+var runKeys = []struct{ key, approved string }{
+	{`HKLM\SOFTWARE\Microsoft\Windows\CurrentVersion\Run`, `HKLM` + approvedRoot + `Run`},
+	{`HKLM\SOFTWARE\WOW6432Node\Microsoft\Windows\CurrentVersion\Run`, `HKLM` + approvedRoot + `Run32`},
+	{`HKCU\Software\Microsoft\Windows\CurrentVersion\Run`, `HKCU` + approvedRoot + `Run`},
+	{`HKLM\SOFTWARE\Microsoft\Windows\CurrentVersion\RunOnce`, ""},
+	{`HKCU\Software\Microsoft\Windows\CurrentVersion\RunOnce`, ""},
+}
+
+// startupFolders returns the per-user and all-users Startup folders and
+// their StartupApproved keys.
+func startupFolders() []struct{ dir, approved string } {
+	const sub = `Microsoft\Windows\Start Menu\Programs\Startup`
+	return []struct{ dir, approved string }{
+		{filepath.Join(os.Getenv("APPDATA"), sub), `HKCU` + approvedRoot + `StartupFolder`},
+		{filepath.Join(os.Getenv("ProgramData"), sub), `HKLM` + approvedRoot + `StartupFolder`},
+	}
+}
+
+// collectStartupItems lists Run key values and Startup folder entries.
+func collectStartupItems() []protocol.StartupItem {
+	var items []protocol.StartupItem
+	for _, rk := range runKeys {
+		approved := regValues(rk.approved)
+		for name, data := range regValues(rk.key) {
+			items = append(items, newStartupItem(protocol.StartupRunKey, rk.key, name, data, approvedEnabled(approved[name])))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Location != items[j].Location {
+			return items[i].Location < items[j].Location
+		}
+		return items[i].Name < items[j].Name
+	})
+	for _, sf := range startupFolders() {
+		approved := regValues(sf.approved)
+		entries, _ := os.ReadDir(sf.dir)
+		for _, e := range entries {
+			if e.IsDir() || strings.EqualFold(e.Name(), "desktop.ini") {
+				continue
+			}
+			items = append(items, newStartupItem(protocol.StartupFolder, sf.dir, e.Name(),
+				filepath.Join(sf.dir, e.Name()), approvedEnabled(approved[e.Name()])))
+		}
+	}
+	return items
+}
+
+// disableStartupItem marks an entry disabled in StartupApproved, exactly
+// as Task Manager's Startup tab does, so it can be re-enabled there.
+func disableStartupItem(item protocol.StartupItem) error {
+	var approved string
+	switch item.Kind {
+	case protocol.StartupRunKey:
+		for _, rk := range runKeys {
+			if rk.key == item.Location {
+				approved = rk.approved
+			}
+		}
+	case protocol.StartupFolder:
+		for _, sf := range startupFolders() {
+			if sf.dir == item.Location {
+				approved = sf.approved
+			}
+		}
+	}
+	if approved == "" {
+		return fmt.Errorf("cannot disable %s entries in %s", item.Kind, item.Location)
+	}
+	_, err := runSettingsTool("reg", "add", approved, "/v", item.Name, "/t", "REG_BINARY", "/d", approvedDisabled, "/f")
+	return err
+}
+
+// approvedEnabled interprets a StartupApproved value: missing or an even
+// first byte means enabled.
+func approvedEnabled(data string) bool {
+	if len(data) < 2 {
+		return true
+	}
+	b, err := strconv.ParseUint(data[:2], 16, 8)
+	return err != nil || b&1 == 0
+}
+
+// regValues returns the values directly under key as name -> data.
+func regValues(key string) map[string]string {
+	values := make(map[string]string)
+	if key == "" {
+		return values
+	}
+	out, err := exec.Command("reg", "query", key).Output()
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.HasPrefix(line, "    ") {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimSpace(line), "    ", 3)
+		if len(fields) == 3 && strings.HasPrefix(fields[1], "REG_") {
+			values[fields[0]] = strings.TrimRight(fields[2], "\r")
+		}
+	}
+	return values
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Support requests ("raise hand"): the local user asks for a technician,
+// from the tray indicator or with agent -raise-hand. The server raises an
+// alert and lets the next technician connect without a consent prompt.
+
+// supportPromptTimeout bounds how long the message dialog stays open.
+const supportPromptTimeout = 5 * time.Minute
+
+// raiseHand asks the local user what they need help with and sends the
+// request over the agent connection, or buffers it with the time it was
+// made while the server is unreachable. Canceling the dialog sends
+// nothing.
+func (a *Agent) raiseHand() {
+	msg, ok := promptSupportMessage()
+	if !ok {
+		return
+	}
+	req := protocol.SupportRequest{Message: msg, User: localUsername()}
+	if a.connected.Load() {
+		payload, _ := json.Marshal(req)
+		err := a.sendMessage(protocol.Message{Type: "support_request", Payload: payload})
+		if err == nil {
+			log.Println("Support requested by the local user")
+			return
+		}
+		log.Printf("Support request failed: %v", err)
+	}
+	req.Time = time.Now().UnixMilli()
+	payload, _ := json.Marshal(req)
+	if a.buffer(protocol.Message{Type: "support_request", Payload: payload}) {
+		log.Println("Support request queued until the server is reachable")
+	}
+}
+
+// raiseHandCLI sends a support request for the enrolled agent straight to
+// the server, authenticated with its credential, for agent -raise-hand.
+func raiseHandCLI(cfg *AgentConfig, insecure bool, message string) error {
+	if cfg.Credential == "" {
+		return errors.New("agent is not enrolled")
+	}
+	base := httpURL(cfg.ServerURL)
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: buildTLSConfig(cfg, insecure), DialContext: serverDialer().DialContext},
+		Timeout:   30 * time.Second,
+	}
+
+	body, _ := json.Marshal(protocol.SupportRequest{Message: message, User: localUsername()})
+	req, err := http.NewRequest(http.MethodPost, base+"/api/agent/support", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Agent "+cfg.Credential)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errResp) //nolint:errcheck
+		return fmt.Errorf("server refused the request: %s", errResp.Error)
+	}
+	return nil
+}
+
+// localUsername names the logged-in account, or "" if unknown.
+func localUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// promptSupportMessage asks the local user to describe the problem with
+// the platform's built-in tooling. It reports false if the user cancels;
+// without any dialog tool the request goes out without a message.
+func promptSupportMessage() (string, bool) {
+	title := dialogTitle("Request Support")
+	const text = "Describe what you need help with (optional). A technician will be notified."
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("osascript", "-e", fmt.Sprintf(`text returned of (display dialog "%s" `+
+			`with title "%s" default answer "" buttons {"Cancel", "Send"} default button "Send")`, text, title))
+	case "linux":
+		if _, err := exec.LookPath("zenity"); err == nil {
+			cmd = exec.Command("zenity", "--entry", "--title="+title, "--text="+text)
+		} else if _, err := exec.LookPath("kdialog"); err == nil {
+			cmd = exec.Command("kdialog", "--title", title, "--inputbox", text)
+		}
+	case "windows":
+		// InputBox returns "" for Cancel as well, so an empty answer
+		// counts as canceled here.
+		// The title carries the branded product name, so it reaches
+		// PowerShell through the environment, as in windowsPopup.
+		cmd = exec.Command("powershell", "-NoProfile", "-Command",
+			`Add-Type -AssemblyName Microsoft.VisualBasic; `+
+				`$m = [Microsoft.VisualBasic.Interaction]::InputBox($env:RMM_PROMPT_TEXT, $env:RMM_PROMPT_TITLE); `+
+				`if ($m -eq '') { exit 1 }; [Console]::Out.Write($m)`)
+		cmd.Env = append(os.Environ(), "RMM_PROMPT_TEXT="+text, "RMM_PROMPT_TITLE="+title)
+	}
+	if cmd == nil {
+		return "", true
+	}
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if !runWithTimeout(cmd, supportPromptTimeout) {
+		return "", false
+	}
+	msg := strings.TrimSpace(out.String())
+	if len(msg) > protocol.MaxSupportMessage {
+		msg = msg[:protocol.MaxSupportMessage]
+	}
+	return msg, true
+}
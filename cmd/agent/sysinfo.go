@@ -33,6 +33,12 @@ type SystemInfo struct {
 	Username      string                 `json:"username"`
 	UptimeSeconds int64                  `json:"uptime_seconds"`
 	AgentVersion  string                 `json:"agent_version"`
+	FlowControl   bool                   `json:"flow_control,omitempty"`
+	StartupItems  []protocol.StartupItem `json:"startup_items,omitempty"`
+	Environment   map[string]string      `json:"environment,omitempty"`
+	Permissions   *protocol.Permissions  `json:"permissions,omitempty"`
+
+	DisabledCapabilities []string `json:"disabled_capabilities,omitempty"`
 }
 
 // CollectSystemInfo gathers device information using stdlib and
@@ -63,6 +69,13 @@ func CollectSystemInfo(name string) SystemInfo {
 		info.Username = u.Username
 	}
 
+	// Autostart inventory (platform-specific) and environment
+	info.StartupItems = collectStartupItems()
+	info.Environment = collectEnvironment()
+
+	// OS permissions remote control depends on (macOS only)
+	info.Permissions = checkPermissions()
+
 	// Ensure display count matches the displays slice
 	if len(info.Displays) > 0 {
 		info.DisplayCount = len(info.Displays)
@@ -113,6 +126,24 @@ func collectLocalIPs() []string {
 	return ips
 }
 
+// collectMACs returns the hardware addresses of all non-loopback
+// interfaces, including ones that are down, so an enrollment binding to a
+// NIC holds regardless of which link is active.
+func collectMACs() []string {
+	var macs []string
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return macs
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		macs = append(macs, iface.HardwareAddr.String())
+	}
+	return macs
+}
+
 // extractIP returns the string form of a non-loopback, non-link-local address.
 func extractIP(addr net.Addr) string {
 	switch v := addr.(type) {
@@ -16,7 +16,7 @@ func collectPlatformInfo(info *SystemInfo) {
 	info.OSVersion = macOSVersion()
 	info.MemoryTotal, info.MemoryFree = macOSMemory()
 	info.DiskTotal, info.DiskFree = diskUsage("/")
-	info.Displays = macOSDisplays()
+	info.Displays = listDisplays()
 	info.UptimeSeconds = macOSUptime()
 }
 
@@ -66,6 +66,11 @@ func parseVMStatValue(line string) uint64 {
 	return v
 }
 
+// listDisplays enumerates the connected displays.
+func listDisplays() []protocol.DisplayInfo {
+	return macOSDisplays()
+}
+
 // macOSDisplays reads per-display resolution from system_profiler.
 func macOSDisplays() []protocol.DisplayInfo {
 	out, err := exec.Command("system_profiler", "SPDisplaysDataType").Output()
@@ -157,3 +162,21 @@ func sysctlUint64(name string) uint64 {
 	v, _ := strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
 	return v
 }
+
+// machineID returns the hardware UUID (IOPlatformUUID) from the I/O Registry.
+func machineID() string {
+	out, err := exec.Command("ioreg", "-rd1", "-c", "IOPlatformExpertDevice").Output()
+	if err != nil {
+		return ""
+	}
+	// Line: "IOPlatformUUID" = "564D...-..."
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.Contains(line, `"IOPlatformUUID"`) {
+			continue
+		}
+		if i := strings.LastIndex(line, "="); i >= 0 {
+			return strings.Trim(strings.TrimSpace(line[i+1:]), `"`)
+		}
+	}
+	return ""
+}
@@ -16,7 +16,7 @@ func collectPlatformInfo(info *SystemInfo) {
 	info.OSVersion = linuxOSVersion()
 	info.MemoryTotal, info.MemoryFree = linuxMemory()
 	info.DiskTotal, info.DiskFree = diskUsage("/")
-	info.Displays = linuxDisplays()
+	info.Displays = listDisplays()
 	info.UptimeSeconds = linuxUptime()
 }
 
@@ -59,6 +59,11 @@ func linuxMemory() (total, free uint64) {
 	return total, free
 }
 
+// listDisplays enumerates the connected displays.
+func listDisplays() []protocol.DisplayInfo {
+	return linuxDisplays()
+}
+
 // linuxDisplays queries xrandr for connected display resolutions.
 func linuxDisplays() []protocol.DisplayInfo {
 	out, err := exec.Command("xrandr", "--query").Output()
@@ -117,3 +122,16 @@ func linuxUptime() int64 {
 	}
 	return int64(sec)
 }
+
+// machineID returns the SMBIOS system UUID, falling back to the systemd
+// machine ID when the DMI table is unreadable (non-root, containers).
+func machineID() string {
+	for _, p := range []string{"/sys/class/dmi/id/product_uuid", "/etc/machine-id"} {
+		if data, err := os.ReadFile(p); err == nil {
+			if id := strings.TrimSpace(string(data)); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
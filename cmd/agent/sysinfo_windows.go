@@ -15,7 +15,7 @@ func collectPlatformInfo(info *SystemInfo) {
 	info.OSVersion = windowsOSVersion()
 	info.MemoryTotal, info.MemoryFree = windowsMemory()
 	info.DiskTotal, info.DiskFree = windowsDisk()
-	info.Displays = windowsDisplays()
+	info.Displays = listDisplays()
 	info.UptimeSeconds = windowsUptime()
 }
 
@@ -67,6 +67,11 @@ func windowsDisk() (total, free uint64) {
 	return total, free
 }
 
+// listDisplays enumerates the connected displays.
+func listDisplays() []protocol.DisplayInfo {
+	return windowsDisplays()
+}
+
 // windowsDisplays queries connected display resolutions via WMI.
 func windowsDisplays() []protocol.DisplayInfo {
 	out, err := exec.Command("powershell", "-NoProfile", "-Command",
@@ -105,3 +110,13 @@ func windowsUptime() int64 {
 	sec, _ := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
 	return sec
 }
+
+// machineID returns the SMBIOS system UUID via WMI.
+func machineID() string {
+	out, err := exec.Command("powershell", "-NoProfile", "-Command",
+		"(Get-CimInstance Win32_ComputerSystemProduct).UUID").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
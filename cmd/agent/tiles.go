@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Lossless regions: JPEG blurs the edges of text, which is most of what a
+// terminal or IDE shows. With -lossless-regions, and a viewer that draws
+// tile frames (protocol.BinTiles), the single-display stream is cut into
+// tiles and only the tiles that changed since the last frame are sent,
+// each in the format that suits it: tiles of few distinct colours (text,
+// flat UI) as PNG, the rest (photos, video) as JPEG. A tile last sent as
+// JPEG that then stays still for refineAfter frames and looks like text
+// is sent again losslessly, so a screen of text sharpens as soon as it
+// stops scrolling. When most of the screen changes at once a whole JPEG
+// frame is cheaper and is sent instead, as it is after a frame is
+// dropped: the tiles are relative to what the viewer has drawn. A whole
+// frame also goes out every keyframeInterval, so a viewer that has somehow
+// drawn something else (a frame lost between server and browser, a tile
+// that failed to decode) is put right without waiting for the screen to
+// change.
+//
+// Recorded sessions stay on whole frames, which the server watermarks.
+const (
+	// tileSize is the side of a tile, in pixels; a multiple of JPEG's
+	// 16-pixel blocks.
+	tileSize = 64
+
+	// textColors is the most distinct colours a tile may have to count as
+	// text: antialiased text on a flat background uses a few dozen.
+	textColors = 48
+
+	// refineAfter is how many frames a lossy text tile must stay
+	// unchanged before it is resent losslessly (~0.5 s).
+	refineAfter = 5
+
+	// maxRefine caps the tiles refined per frame, spreading the
+	// refinement of a whole screen over a few frames.
+	maxRefine = 64
+
+	// keyframeInterval is how often a whole frame is sent even when
+	// tiles would do.
+	keyframeInterval = 30 * time.Second
+)
+
+// pngTiles encodes tiles for speed over size: they are small and sent
+// up to twenty times a second.
+var pngTiles = png.Encoder{CompressionLevel: png.BestSpeed}
+
+// tiler remembers what the viewer has drawn, tile by tile.
+type tiler struct {
+	prev   *image.RGBA // the last frame sent, or nil to send a whole frame
+	lossy  []bool      // the tile was last sent as JPEG
+	static []int       // frames since the tile last changed
+	keyed  time.Time   // when the last whole frame was sent
+}
+
+// reset makes the next frame a whole one.
+func (t *tiler) reset() { t.prev = nil }
+
+// encode returns the frame that brings the viewer from the last frame to
+// img: a BinScreen JPEG, a BinTiles frame, or nil when nothing changed.
+func (t *tiler) encode(img image.Image, quality int) ([]byte, error) {
+	cur := scaleDown(img, 0, 0) // RGBA, at its own size
+	b := cur.Rect
+	cols, rows := (b.Dx()+tileSize-1)/tileSize, (b.Dy()+tileSize-1)/tileSize
+
+	var changed []int
+	if t.prev != nil && t.prev.Rect == b {
+		for i := 0; i < cols*rows; i++ {
+			if !sameTile(t.prev, cur, tileRect(b, cols, i)) {
+				changed = append(changed, i)
+			}
+		}
+	}
+	if t.prev == nil || t.prev.Rect != b || len(changed)*2 > cols*rows || time.Since(t.keyed) >= keyframeInterval {
+		t.prev, t.keyed = cur, time.Now()
+		t.lossy = make([]bool, cols*rows)
+		t.static = make([]int, cols*rows)
+		for i := range t.lossy {
+			t.lossy[i] = true
+		}
+		return encodeJPEG([]byte{protocol.BinScreen}, cur, quality)
+	}
+	t.prev = cur
+
+	frame := protocol.TilesHeader(b.Dx(), b.Dy())
+	sent := false
+	add := func(i int, lossless bool) error {
+		r := tileRect(b, cols, i)
+		tile := cur.SubImage(r)
+		var buf bytes.Buffer
+		format := protocol.TileJPEG
+		var err error
+		if lossless {
+			format = protocol.TilePNG
+			err = pngTiles.Encode(&buf, tile)
+		} else {
+			err = jpeg.Encode(&buf, tile, &jpeg.Options{Quality: quality})
+		}
+		if err != nil {
+			return err
+		}
+		frame = protocol.AppendTile(frame, r.Min.X, r.Min.Y, format, buf.Bytes())
+		t.lossy[i], t.static[i], sent = !lossless, 0, true
+		return nil
+	}
+
+	for i := range t.static {
+		t.static[i]++
+	}
+	for _, i := range changed {
+		if err := add(i, textLike(cur, tileRect(b, cols, i))); err != nil {
+			return nil, err
+		}
+	}
+	refined := 0
+	for i := range t.static {
+		if t.static[i] < refineAfter || !t.lossy[i] || refined == maxRefine {
+			continue
+		}
+		if textLike(cur, tileRect(b, cols, i)) {
+			if err := add(i, true); err != nil {
+				return nil, err
+			}
+			refined++
+		} else {
+			t.static[i] = 0 // check again later, in case it becomes text
+		}
+	}
+	if !sent {
+		return nil, nil
+	}
+	return frame, nil
+}
+
+// tileRect returns the bounds of tile i of a frame cols tiles wide.
+func tileRect(b image.Rectangle, cols, i int) image.Rectangle {
+	x, y := (i%cols)*tileSize, (i/cols)*tileSize
+	return image.Rect(x, y, x+tileSize, y+tileSize).Intersect(b)
+}
+
+// sameTile reports whether a and b have the same pixels in r.
+func sameTile(a, b *image.RGBA, r image.Rectangle) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		if !bytes.Equal(a.Pix[a.PixOffset(r.Min.X, y):a.PixOffset(r.Max.X, y)], b.Pix[b.PixOffset(r.Min.X, y):b.PixOffset(r.Max.X, y)]) {
+			return false
+		}
+	}
+	return true
+}
+
+// textLike reports whether the pixels in r use at most textColors
+// distinct colours, as text and flat interface elements do.
+func textLike(img *image.RGBA, r image.Rectangle) bool {
+	colors := make([]uint32, 0, textColors)
+	var last uint32
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(r.Min.X, y):img.PixOffset(r.Max.X, y)]
+	pixels:
+		for i := 0; i < len(row); i += 4 {
+			c := uint32(row[i])<<16 | uint32(row[i+1])<<8 | uint32(row[i+2])
+			if c == last && len(colors) > 0 {
+				continue
+			}
+			last = c
+			for _, seen := range colors {
+				if seen == c {
+					continue pixels
+				}
+			}
+			if len(colors) == textColors {
+				return false
+			}
+			colors = append(colors, c)
+		}
+	}
+	return true
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// timeSyncCheckInterval is how long a time-sync result is reused.
+const timeSyncCheckInterval = 5 * time.Minute
+
+// timeSyncCheck caches the time service's state between heartbeats, like
+// rebootCheck: the OS tools can be slow (sntp waits for a server), so
+// checks run in the background.
+type timeSyncCheck struct {
+	mu      sync.Mutex
+	state   *protocol.TimeSync
+	checked time.Time
+	running bool
+}
+
+// status returns the last result, nil when the state is unknown, and
+// starts a new check when it is stale.
+func (c *timeSyncCheck) status() *protocol.TimeSync {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running && time.Since(c.checked) >= timeSyncCheckInterval {
+		c.running = true
+		go func() {
+			state := timeSyncState()
+			c.mu.Lock()
+			c.state, c.checked, c.running = state, time.Now(), false
+			c.mu.Unlock()
+		}()
+	}
+	return c.state
+}
+
+// timeSyncState asks the OS time service how it is doing, or returns nil
+// when there is no service the agent knows how to ask.
+func timeSyncState() *protocol.TimeSync {
+	switch runtime.GOOS {
+	case "windows":
+		return w32tmState()
+	case "linux":
+		if ts := chronyState(); ts != nil {
+			return ts
+		}
+		return timedatectlState()
+	case "darwin":
+		return sntpState()
+	}
+	return nil
+}
+
+// w32tmState reads `w32tm /query /status /verbose`. A stopped Windows
+// Time service makes w32tm fail, which is reported as disabled.
+func w32tmState() *protocol.TimeSync {
+	ts := &protocol.TimeSync{Service: "w32time"}
+	out, err := exec.Command("w32tm", "/query", "/status", "/verbose").Output()
+	if err != nil {
+		return ts
+	}
+	ts.Enabled = true
+	fields := colonFields(string(out))
+	ts.Source = fields["Source"]
+	// The local clock as source means no time server is reachable or
+	// configured; leap indicator 3 means not synchronized.
+	leap := fields["Leap Indicator"]
+	ts.Synchronized = ts.Source != "" && !strings.HasPrefix(leap, "3") &&
+		!strings.EqualFold(ts.Source, "Local CMOS Clock") && !strings.EqualFold(ts.Source, "Free-running System Clock")
+	if off, err := strconv.ParseFloat(strings.TrimSuffix(fields["Phase Offset"], "s"), 64); err == nil {
+		ts.OffsetMS = roundMS(off * 1000)
+	}
+	return ts
+}
+
+// chronyState reads `chronyc -c tracking`: comma-separated reference ID,
+// reference name, stratum, reference time, system time offset, last
+// offset, … and leap status last.
+func chronyState() *protocol.TimeSync {
+	if _, err := exec.LookPath("chronyc"); err != nil {
+		return nil
+	}
+	out, err := exec.Command("chronyc", "-c", "tracking").Output()
+	if err != nil {
+		// chronyc without chronyd running.
+		return nil
+	}
+	rec, err := csv.NewReader(strings.NewReader(string(out))).Read()
+	if err != nil || len(rec) < 14 {
+		return nil
+	}
+	ts := &protocol.TimeSync{Service: "chrony", Enabled: true, Source: rec[1]}
+	ts.Synchronized = rec[13] != "Not synchronised" && rec[2] != "0"
+	if off, err := strconv.ParseFloat(rec[5], 64); err == nil {
+		ts.OffsetMS = roundMS(off * 1000) // positive: local clock ahead
+	}
+	return ts
+}
+
+// timedatectlState reads systemd's view, which covers systemd-timesyncd
+// and any NTP daemon systemd manages.
+func timedatectlState() *protocol.TimeSync {
+	out, err := exec.Command("timedatectl", "show").Output()
+	if err != nil {
+		return nil
+	}
+	props := make(map[string]string)
+	sc := bufio.NewScanner(strings.NewReader(string(out)))
+	for sc.Scan() {
+		if k, v, ok := strings.Cut(sc.Text(), "="); ok {
+			props[k] = v
+		}
+	}
+	ts := &protocol.TimeSync{
+		Enabled:      props["NTP"] == "yes",
+		Synchronized: props["NTPSynchronized"] == "yes",
+	}
+	// Only timesyncd answers show-timesync.
+	if out, err := exec.Command("timedatectl", "show-timesync", "-p", "ServerName", "--value").Output(); err == nil {
+		ts.Service = "systemd-timesyncd"
+		ts.Source = strings.TrimSpace(string(out))
+	} else if _, err := os.Stat("/etc/ntp.conf"); err == nil {
+		ts.Service = "ntpd"
+	}
+	return ts
+}
+
+// sntpOffset matches the offset sntp prints first: "+0.006378 +/- …".
+var sntpOffset = regexp.MustCompile(`^([+-]\d+\.\d+) `)
+
+// sntpState checks macOS's network time setting and measures the offset
+// from the configured server with sntp, since timed reports nothing
+// itself.
+func sntpState() *protocol.TimeSync {
+	ts := &protocol.TimeSync{Service: "sntp", Source: "time.apple.com"}
+	if out, err := exec.Command("systemsetup", "-getusingnetworktime").Output(); err == nil {
+		ts.Enabled = strings.Contains(string(out), ": On")
+	}
+	if out, err := exec.Command("systemsetup", "-getnetworktimeserver").Output(); err == nil {
+		if server := colonFields(string(out))["Network Time Server"]; server != "" {
+			ts.Source = server
+		}
+	}
+	out, err := exec.Command("sntp", "-t", "5", ts.Source).Output()
+	if err != nil {
+		return ts
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := sntpOffset.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			off, _ := strconv.ParseFloat(m[1], 64)
+			// sntp prints the correction to apply, the opposite of how
+			// far ahead the local clock is.
+			ts.OffsetMS = roundMS(-off * 1000)
+			ts.Synchronized = ts.Enabled
+			break
+		}
+	}
+	return ts
+}
+
+// colonFields parses "Key: value" lines.
+func colonFields(out string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			fields[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return fields
+}
+
+// roundMS rounds a millisecond figure to a tenth.
+func roundMS(ms float64) float64 {
+	return math.Round(ms*10) / 10
+}
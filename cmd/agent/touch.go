@@ -0,0 +1,73 @@
+package main
+
+import "math"
+
+// Touch input: a viewer on a tablet sends gestures rather than mouse
+// events, and the agent plays each as the mouse would:
+//
+//   - tap: a left click where the finger touched
+//   - long_press: a right click there, for context menus
+//   - scroll: two fingers moving together, as wheel notches (dx, dy;
+//     positive scrolls right and down)
+//   - pinch: two fingers spreading or closing, as Ctrl+wheel, the zoom
+//     gesture of browsers, editors and image viewers
+//
+// One-finger drags arrive as ordinary mouse down, move and up events.
+
+// touchEvent is one gesture at viewer coordinates.
+type touchEvent struct {
+	Gesture string  `json:"gesture"`
+	X       int     `json:"x"`
+	Y       int     `json:"y"`
+	DX      int     `json:"dx"`    // scroll: horizontal notches
+	DY      int     `json:"dy"`    // scroll: vertical notches
+	Scale   float64 `json:"scale"` // pinch: finger distance now over before
+}
+
+const (
+	// maxWheelNotches caps the notches of one gesture.
+	maxWheelNotches = 20
+	// zoomStep is the pinch ratio that makes one zoom notch.
+	zoomStep = 1.25
+)
+
+// mouse returns the mouse events that play t, or none for an unknown or
+// empty gesture.
+func (t touchEvent) mouse() []mouseEvent {
+	at := mouseEvent{Action: "move", X: t.X, Y: t.Y}
+	switch t.Gesture {
+	case "tap":
+		return clickAt(at, 0)
+	case "long_press":
+		return clickAt(at, 2)
+	case "scroll":
+		dx, dy := clampNotches(t.DX), clampNotches(t.DY)
+		if dx == 0 && dy == 0 {
+			return nil
+		}
+		return []mouseEvent{{Action: "wheel", X: t.X, Y: t.Y, DX: dx, DY: dy}}
+	case "pinch":
+		if t.Scale <= 0 {
+			return nil
+		}
+		// Spreading zooms in, which is the wheel turned away (up).
+		notches := clampNotches(-int(math.Round(math.Log(t.Scale) / math.Log(zoomStep))))
+		if notches == 0 {
+			return nil
+		}
+		return []mouseEvent{{Action: "wheel", X: t.X, Y: t.Y, DY: notches, Zoom: true}}
+	}
+	return nil
+}
+
+// clickAt returns a move to at and a click of button there.
+func clickAt(at mouseEvent, button int) []mouseEvent {
+	down, up := at, at
+	down.Action, down.Button = "down", button
+	up.Action, up.Button = "up", button
+	return []mouseEvent{at, down, up}
+}
+
+func clampNotches(n int) int {
+	return min(max(n, -maxWheelNotches), maxWheelNotches)
+}
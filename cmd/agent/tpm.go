@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Minimal TPM 2.0 client: just enough of the command set (Part 3 of the
+// TPM 2.0 Library spec) to derive an ECDSA P-256 signing key and sign
+// digests with it. No third-party TPM stack is required.
+//
+// The key is a primary object created from a fixed template, so the TPM
+// re-derives the same key from its hierarchy seed every time. Nothing is
+// persisted on disk and the private half never leaves the chip.
+
+// TPM 2.0 constants (Part 2: Structures).
+const (
+	tpmSTNoSessions = 0x8001
+	tpmSTSessions   = 0x8002
+	tpmSTHashCheck  = 0x8024
+
+	tpmCCCreatePrimary = 0x00000131
+	tpmCCSign          = 0x0000015D
+	tpmCCFlushContext  = 0x00000165
+
+	tpmRHOwner       = 0x40000001
+	tpmRHNull        = 0x40000007
+	tpmRHEndorsement = 0x4000000B
+	tpmRSPW          = 0x40000009
+
+	tpmAlgECC    = 0x0023
+	tpmAlgSHA256 = 0x000B
+	tpmAlgNull   = 0x0010
+	tpmAlgECDSA  = 0x0018
+
+	tpmECCNistP256 = 0x0003
+
+	// fixedTPM | fixedParent | sensitiveDataOrigin | userWithAuth | noDA | sign
+	tpmKeyAttributes = 0x00000002 | 0x00000010 | 0x00000020 | 0x00000040 | 0x00000400 | 0x00040000
+)
+
+// tpmTransport sends one marshalled command and returns the response.
+type tpmTransport interface {
+	transmit(cmd []byte) ([]byte, error)
+	Close() error
+}
+
+// tpmKey is a loaded signing key.
+type tpmKey struct {
+	tpm    tpmTransport
+	handle uint32
+	pub    *ecdsa.PublicKey
+}
+
+// tpmBuf is a big-endian command builder.
+type tpmBuf []byte
+
+func (b *tpmBuf) u8(v uint8)   { *b = append(*b, v) }
+func (b *tpmBuf) u16(v uint16) { *b = binary.BigEndian.AppendUint16(*b, v) }
+func (b *tpmBuf) u32(v uint32) { *b = binary.BigEndian.AppendUint32(*b, v) }
+func (b *tpmBuf) tpm2b(v []byte) {
+	b.u16(uint16(len(v)))
+	*b = append(*b, v...)
+}
+
+// tpmReader is a big-endian response parser. The first short read sets
+// err and every later read returns zero.
+type tpmReader struct {
+	buf []byte
+	err error
+}
+
+func (r *tpmReader) next(n int) []byte {
+	if r.err != nil || len(r.buf) < n {
+		r.err = errors.New("tpm: short response")
+		return make([]byte, n)
+	}
+	v := r.buf[:n]
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *tpmReader) u16() uint16   { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *tpmReader) u32() uint32   { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *tpmReader) tpm2b() []byte { return r.next(int(r.u16())) }
+
+// tpmCommand frames params as a command, runs it, and returns the
+// response body after the 10-byte header.
+func tpmCommand(t tpmTransport, tag uint16, cc uint32, body tpmBuf) ([]byte, error) {
+	var cmd tpmBuf
+	cmd.u16(tag)
+	cmd.u32(uint32(10 + len(body)))
+	cmd.u32(cc)
+	cmd = append(cmd, body...)
+
+	resp, err := t.transmit(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 10 {
+		return nil, errors.New("tpm: short response")
+	}
+	if rc := binary.BigEndian.Uint32(resp[6:10]); rc != 0 {
+		return nil, fmt.Errorf("tpm: command 0x%x failed: rc 0x%x", cc, rc)
+	}
+	return resp[10:], nil
+}
+
+// passwordAuth appends an authorization area holding a single empty
+// password session, as used for hierarchies and keys with no auth value.
+func passwordAuth(b *tpmBuf) {
+	b.u32(9) // authorizationSize
+	b.u32(tpmRSPW)
+	b.tpm2b(nil) // nonce
+	b.u8(0)      // sessionAttributes
+	b.tpm2b(nil) // hmac (empty password)
+}
+
+// tpmCreatePrimary derives the agent's signing key. The owner hierarchy
+// is tried first; Windows usually holds the owner auth value, so the
+// endorsement hierarchy is the fallback. The order is fixed so the same
+// key is derived on every run.
+func tpmCreatePrimary(t tpmTransport) (*tpmKey, error) {
+	var lastErr error
+	for _, hierarchy := range []uint32{tpmRHOwner, tpmRHEndorsement} {
+		key, err := tpmCreatePrimaryIn(t, hierarchy)
+		if err == nil {
+			return key, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func tpmCreatePrimaryIn(t tpmTransport, hierarchy uint32) (*tpmKey, error) {
+	// TPMT_PUBLIC: unrestricted ECDSA P-256 / SHA-256 signing key. The
+	// unique field separates this key from other applications' primaries.
+	var tmpl tpmBuf
+	tmpl.u16(tpmAlgECC)
+	tmpl.u16(tpmAlgSHA256)
+	tmpl.u32(tpmKeyAttributes)
+	tmpl.tpm2b(nil) // authPolicy
+	tmpl.u16(tpmAlgNull)
+	tmpl.u16(tpmAlgECDSA)
+	tmpl.u16(tpmAlgSHA256)
+	tmpl.u16(tpmECCNistP256)
+	tmpl.u16(tpmAlgNull)
+	tmpl.tpm2b([]byte("rmm-agent"))
+	tmpl.tpm2b(nil)
+
+	var b tpmBuf
+	b.u32(hierarchy)
+	passwordAuth(&b)
+	b.u16(4) // inSensitive: empty userAuth and data
+	b.u16(0)
+	b.u16(0)
+	b.tpm2b(tmpl)
+	b.tpm2b(nil) // outsideInfo
+	b.u32(0)     // creationPCR: no selections
+
+	resp, err := tpmCommand(t, tpmSTSessions, tpmCCCreatePrimary, b)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &tpmReader{buf: resp}
+	handle := r.u32()
+	r.u32() // parameterSize
+	pub := &tpmReader{buf: r.tpm2b()}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	pub.next(8)  // type, nameAlg, objectAttributes
+	pub.tpm2b()  // authPolicy
+	pub.next(10) // symmetric, scheme+hash, curveID, kdf (as in the template)
+	x, y := pub.tpm2b(), pub.tpm2b()
+	if pub.err != nil {
+		_ = tpmFlush(t, handle)
+		return nil, pub.err
+	}
+
+	key := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	return &tpmKey{tpm: t, handle: handle, pub: key}, nil
+}
+
+// sign returns an ASN.1 ECDSA signature over a SHA-256 digest.
+func (k *tpmKey) sign(digest []byte) ([]byte, error) {
+	var b tpmBuf
+	b.u32(k.handle)
+	passwordAuth(&b)
+	b.tpm2b(digest)
+	b.u16(tpmAlgECDSA)
+	b.u16(tpmAlgSHA256)
+	b.u16(tpmSTHashCheck) // validation: null ticket (key is unrestricted)
+	b.u32(tpmRHNull)
+	b.tpm2b(nil)
+
+	resp, err := tpmCommand(k.tpm, tpmSTSessions, tpmCCSign, b)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &tpmReader{buf: resp}
+	r.u32() // parameterSize
+	if alg := r.u16(); alg != tpmAlgECDSA {
+		return nil, fmt.Errorf("tpm: unexpected signature algorithm 0x%x", alg)
+	}
+	r.u16() // hash
+	sr, ss := r.tpm2b(), r.tpm2b()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(sr), new(big.Int).SetBytes(ss)})
+}
+
+// close unloads the key from the TPM.
+func (k *tpmKey) close() error {
+	return tpmFlush(k.tpm, k.handle)
+}
+
+func tpmFlush(t tpmTransport, handle uint32) error {
+	var b tpmBuf
+	b.u32(handle)
+	_, err := tpmCommand(t, tpmSTNoSessions, tpmCCFlushContext, b)
+	return err
+}
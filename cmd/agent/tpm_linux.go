@@ -0,0 +1,41 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// linuxTPM talks to the kernel TPM device. The resource-managed node is
+// preferred so transient handles are cleaned up if the agent dies.
+type linuxTPM struct {
+	f *os.File
+}
+
+func openTPM() (tpmTransport, error) {
+	for _, path := range []string{"/dev/tpmrm0", "/dev/tpm0"} {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err == nil {
+			return &linuxTPM{f: f}, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, errNoTPM
+}
+
+func (t *linuxTPM) transmit(cmd []byte) ([]byte, error) {
+	if _, err := t.f.Write(cmd); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 4096)
+	n, err := t.f.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp[:n], nil
+}
+
+func (t *linuxTPM) Close() error { return t.f.Close() }
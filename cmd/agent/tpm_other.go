@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+
+package main
+
+// openTPM reports that no TPM is reachable. macOS has no TPM, and the
+// Secure Enclave is only reachable through the Security framework (cgo),
+// which the agent does not link.
+func openTPM() (tpmTransport, error) {
+	return nil, errNoTPM
+}
@@ -0,0 +1,53 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// windowsTPM submits commands through the TPM Base Services (tbs.dll).
+type windowsTPM struct {
+	ctx uintptr
+}
+
+var (
+	tbsDLL             = syscall.NewLazyDLL("tbs.dll")
+	tbsContextCreate   = tbsDLL.NewProc("Tbsi_Context_Create")
+	tbsSubmitCommand   = tbsDLL.NewProc("Tbsip_Submit_Command")
+	tbsContextClose    = tbsDLL.NewProc("Tbsip_Context_Close")
+	tbsCommandPriority = uintptr(200) // TBS_COMMAND_PRIORITY_NORMAL
+)
+
+func openTPM() (tpmTransport, error) {
+	if err := tbsDLL.Load(); err != nil {
+		return nil, errNoTPM
+	}
+	// TBS_CONTEXT_PARAMS2: version 2, includeTpm20.
+	params := struct{ version, flags uint32 }{2, 1 << 2}
+	var ctx uintptr
+	rc, _, _ := tbsContextCreate.Call(uintptr(unsafe.Pointer(&params)), uintptr(unsafe.Pointer(&ctx)))
+	if rc != 0 {
+		return nil, errNoTPM
+	}
+	return &windowsTPM{ctx: ctx}, nil
+}
+
+func (t *windowsTPM) transmit(cmd []byte) ([]byte, error) {
+	resp := make([]byte, 4096)
+	n := uint32(len(resp))
+	rc, _, _ := tbsSubmitCommand.Call(t.ctx, 0, tbsCommandPriority,
+		uintptr(unsafe.Pointer(&cmd[0])), uintptr(len(cmd)),
+		uintptr(unsafe.Pointer(&resp[0])), uintptr(unsafe.Pointer(&n)))
+	if rc != 0 {
+		return nil, fmt.Errorf("tbs: submit failed: 0x%x", rc)
+	}
+	return resp[:n], nil
+}
+
+func (t *windowsTPM) Close() error {
+	_, _, _ = tbsContextClose.Call(t.ctx)
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// progressInterval limits how often file_progress is reported while
+// receiving.
+const progressInterval = 250 * time.Millisecond
+
+// fileTransfer is an upload in progress from a viewer or the drop-box. Chunks are fed
+// from the message loop into pipe; a goroutine decompresses them into the
+// temp file, hashing and counting as it goes.
+type fileTransfer struct {
+	protocol.FileStart
+	f    *os.File
+	pipe *io.PipeWriter
+	done chan error // receiver result, after pipe is closed
+
+	hash     hash.Hash
+	mu       sync.Mutex // guards received
+	received int64      // uncompressed bytes written to f
+}
+
+// Write counts bytes for progress reporting; the receiver writes through
+// it alongside the file and the hash.
+func (t *fileTransfer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	t.received += int64(len(p))
+	t.mu.Unlock()
+	return len(p), nil
+}
+
+func (t *fileTransfer) progress() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.received
+}
+
+// handleFileStart opens a temp file for a new upload, replacing any
+// transfer left unfinished by a previous sender. The server has already
+// checked the size against its transfer policy.
+func (a *Agent) handleFileStart(payload json.RawMessage) {
+	var start protocol.FileStart
+	if err := json.Unmarshal(payload, &start); err != nil {
+		return
+	}
+	a.abortTransfer()
+
+	fail := func(msg string) {
+		a.sendFileProgress(protocol.FileProgress{ID: start.ID, Size: start.Size, Error: msg})
+	}
+	// Drop-box files are received next to their destination so they can
+	// be renamed into place, and installers where they are staged.
+	tmpDir := ""
+	switch start.Purpose {
+	case protocol.FilePurposePrint:
+	case protocol.FilePurposeDropbox:
+		tmpDir = dropboxDir()
+		if err := os.MkdirAll(tmpDir, 0755); err != nil {
+			fail(err.Error())
+			return
+		}
+	case protocol.FilePurposePackage:
+		tmpDir = packagesDir()
+		if err := os.MkdirAll(tmpDir, 0700); err != nil {
+			fail(err.Error())
+			return
+		}
+		pruneStagedPackages(tmpDir)
+	default:
+		fail("unsupported file purpose")
+		return
+	}
+	if start.Size <= 0 {
+		fail("file size out of range")
+		return
+	}
+	if start.Compression != "" && start.Compression != protocol.CompressionDeflate {
+		fail("unsupported compression " + start.Compression)
+		return
+	}
+
+	f, err := os.CreateTemp(tmpDir, ".rmm-upload-*")
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	pr, pw := io.Pipe()
+	t := &fileTransfer{FileStart: start, f: f, pipe: pw, done: make(chan error, 1), hash: sha256.New()}
+	a.setTransfer(t)
+
+	go func() {
+		var src io.Reader = pr
+		if start.Compression == protocol.CompressionDeflate {
+			src = flate.NewReader(pr)
+		}
+		// Read one byte past Size so oversized (or decompression-bomb)
+		// content is detected rather than silently truncated.
+		_, err := io.Copy(io.MultiWriter(f, t.hash, t), io.LimitReader(src, start.Size+1))
+		_ = pr.CloseWithError(err)
+		t.done <- err
+	}()
+	go a.reportProgress(t)
+
+	log.Printf("Receiving %q (%d bytes, compression %q) to %s", start.Name, start.Size, start.Compression, start.Purpose)
+}
+
+// reportProgress sends file_progress at most every progressInterval
+// until the transfer finishes.
+func (a *Agent) reportProgress(t *fileTransfer) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	var last int64
+	for range ticker.C {
+		n := t.progress()
+		if a.currentTransfer() != t || n >= t.Size {
+			return
+		}
+		if n != last {
+			a.sendFileProgress(protocol.FileProgress{ID: t.ID, Received: n, Size: t.Size})
+			last = n
+		}
+	}
+}
+
+// handleFileChunk verifies a BinFile frame and feeds its data to the
+// current upload. A corrupt chunk fails the whole transfer.
+func (a *Agent) handleFileChunk(frame []byte) {
+	t := a.currentTransfer()
+	if t == nil {
+		return
+	}
+	data, err := protocol.ParseFileChunk(frame)
+	if err != nil {
+		_ = t.pipe.CloseWithError(err)
+		return
+	}
+	_, _ = t.pipe.Write(data) // errors surface through done at file_end
+}
+
+// handleFileEnd completes the upload, checks its size and digest and
+// hands it on according to its purpose.
+func (a *Agent) handleFileEnd(payload json.RawMessage) {
+	var end protocol.FileEnd
+	if err := json.Unmarshal(payload, &end); err != nil {
+		return
+	}
+	t := a.currentTransfer()
+	if t == nil || t.ID != end.ID {
+		return
+	}
+	a.setTransfer(nil)
+
+	_ = t.pipe.Close()
+	err := <-t.done
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+	received := t.progress()
+	digest := hex.EncodeToString(t.hash.Sum(nil))
+	switch {
+	case err != nil:
+	case received > t.Size:
+		err = errors.New("received more data than announced")
+	case received != t.Size:
+		err = fmt.Errorf("received %d of %d bytes", received, t.Size)
+	case !protocol.ValidSHA256(end.SHA256):
+		err = errors.New("no SHA-256 digest in file_end")
+	case !strings.EqualFold(end.SHA256, digest):
+		err = errors.New("SHA-256 mismatch")
+	}
+
+	path := t.f.Name()
+	switch {
+	case err != nil:
+	case t.Purpose == protocol.FilePurposeDropbox:
+		path, err = saveDropboxFile(path, filepath.Dir(path), t.Name)
+	case t.Purpose == protocol.FilePurposePackage:
+		path, err = a.staged.add(t.ID, path, t.Name)
+	}
+	if err != nil {
+		_ = os.Remove(t.f.Name())
+		log.Printf("Upload %q failed: %v", t.Name, err)
+		a.sendFileProgress(protocol.FileProgress{ID: t.ID, Received: received, Size: t.Size, Error: err.Error()})
+		return
+	}
+
+	done := protocol.FileProgress{ID: t.ID, Received: received, Size: t.Size, Done: true, SHA256: digest}
+	switch t.Purpose {
+	case protocol.FilePurposeDropbox:
+		log.Printf("Saved %q to %s", t.Name, path)
+		done.Path = path
+		a.sendFileProgress(done)
+		return
+	case protocol.FilePurposePackage:
+		log.Printf("Staged installer %q at %s", t.Name, path)
+		a.sendFileProgress(done)
+		return
+	}
+	a.sendFileProgress(done)
+
+	// Spooling and polling run off the message loop.
+	go a.printFile(t.ID, t.Name, path)
+}
+
+// abortTransfer discards an unfinished upload.
+func (a *Agent) abortTransfer() {
+	t := a.currentTransfer()
+	if t == nil {
+		return
+	}
+	a.setTransfer(nil)
+	_ = t.pipe.CloseWithError(errors.New("transfer aborted"))
+	<-t.done
+	_ = t.f.Close()
+	_ = os.Remove(t.f.Name())
+}
+
+// currentTransfer and setTransfer guard a.transfer, which the progress
+// reporter reads from its own goroutine.
+func (a *Agent) currentTransfer() *fileTransfer {
+	a.transferMu.Lock()
+	defer a.transferMu.Unlock()
+	return a.transfer
+}
+
+func (a *Agent) setTransfer(t *fileTransfer) {
+	a.transferMu.Lock()
+	a.transfer = t
+	a.transferMu.Unlock()
+}
+
+func (a *Agent) sendFileProgress(p protocol.FileProgress) {
+	payload, _ := json.Marshal(p)
+	_ = a.sendMessage(protocol.Message{Type: "file_progress", Payload: payload})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+)
+
+// trayIndicator shows the agent in the desktop's tray or menu bar:
+// whether it is connected to the server and, while a remote session is
+// active, a prominent indicator naming the operator with an "End remote
+// session" item, so the local user always knows when they are being
+// watched. While connected outside a session it offers "Request
+// support…" (see raiseHand). Each state is drawn by a helper process
+// built from the platform's own tooling (osascript, PowerShell, yad),
+// restarted when the state changes; the helper prints "end_session" or
+// "raise_hand" when the user clicks an item. A nil *trayIndicator is
+// disabled.
+type trayIndicator struct {
+	mu         sync.Mutex
+	connected  bool
+	session    bool
+	operator   string
+	control    bool // the operator may inject input
+	recording  bool // the server is recording the session
+	helper     *exec.Cmd
+	warned     bool
+	closed     bool
+	endSession func() // called when the local user ends the session
+	raiseHand  func() // called when the local user requests support
+}
+
+// newTrayIndicator returns an indicator that calls endSession when the
+// local user ends a session from it, and raiseHand when they request
+// support.
+func newTrayIndicator(endSession, raiseHand func()) *trayIndicator {
+	return &trayIndicator{endSession: endSession, raiseHand: raiseHand}
+}
+
+// setConnected records whether the agent is connected. A disconnect also
+// ends the session.
+func (t *trayIndicator) setConnected(connected bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connected = connected
+	if !connected {
+		t.session, t.operator = false, ""
+	}
+	t.redraw()
+}
+
+// setSession records whether a remote session is active, who is viewing,
+// whether they may also control the computer and whether the session is
+// being recorded.
+func (t *trayIndicator) setSession(active bool, operator string, control, recording bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.session, t.operator, t.control, t.recording = active, operator, control, recording
+	t.redraw()
+}
+
+// refresh redraws the indicator, e.g. after the product name changed.
+func (t *trayIndicator) refresh() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.redraw()
+}
+
+// close removes the indicator when the agent exits; helpers would
+// otherwise outlive it.
+func (t *trayIndicator) close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if t.helper != nil {
+		_ = t.helper.Process.Kill()
+		t.helper = nil
+	}
+}
+
+// redraw replaces the helper with one showing the current state. The
+// caller holds t.mu.
+func (t *trayIndicator) redraw() {
+	if t.closed {
+		return
+	}
+	if t.helper != nil {
+		_ = t.helper.Process.Kill()
+		t.helper = nil
+	}
+
+	server := "the management server"
+	if name := productName(); name != "" {
+		server = name
+	}
+	status := "Not connected to " + server
+	if t.connected {
+		status = "Connected to " + server
+	}
+	if t.session {
+		status = "Remote session active: " + sanitizePrompt(t.operator) + " can see this computer"
+		if t.control {
+			status = "Remote session active: " + sanitizePrompt(t.operator) + " can see and control this computer"
+		}
+		if t.recording {
+			status += " (this session is being recorded)"
+		}
+	}
+	cmd := trayCommand(t.connected, t.session, status)
+	if cmd == nil {
+		if !t.warned {
+			t.warned = true
+			log.Printf("Tray indicator unavailable on this desktop")
+		}
+		return
+	}
+
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Printf("Tray indicator failed: %v", err)
+		return
+	}
+	t.helper = cmd
+	go func() {
+		lines := bufio.NewScanner(out)
+		for lines.Scan() {
+			switch lines.Text() {
+			case "end_session":
+				log.Println("Remote session ended by the local user")
+				t.endSession()
+			case "raise_hand":
+				go t.raiseHand()
+			}
+		}
+		_ = cmd.Wait()
+	}()
+}
+
+// trayCommand builds the helper that draws one state, or nil when the
+// platform has no usable tooling.
+func trayCommand(connected, session bool, status string) *exec.Cmd {
+	switch runtime.GOOS {
+	case "darwin":
+		title := "RMM"
+		if name := productName(); name != "" {
+			title = name
+		}
+		switch {
+		case session:
+			title = "● Remote session"
+		case !connected:
+			title += " (offline)"
+		}
+		mode := ""
+		switch {
+		case session:
+			mode = "session"
+		case connected:
+			mode = "online"
+		}
+		return exec.Command("osascript", "-l", "JavaScript", "-e", trayScriptMacOS, title, status, mode)
+	case "windows":
+		cmd := exec.Command("powershell", "-NoProfile", "-WindowStyle", "Hidden", "-Command", trayScriptWindows)
+		cmd.Env = append(os.Environ(), "RMM_TRAY_STATUS="+status)
+		switch {
+		case session:
+			cmd.Env = append(cmd.Env, "RMM_TRAY_SESSION=1")
+		case connected:
+			cmd.Env = append(cmd.Env, "RMM_TRAY_ONLINE=1")
+		}
+		return cmd
+	case "linux":
+		if _, err := exec.LookPath("yad"); err == nil {
+			icon, menu := "network-idle", "Request support…!echo raise_hand"
+			switch {
+			case session:
+				icon, menu = "dialog-warning", "End remote session!echo end_session"
+			case !connected:
+				icon, menu = "network-offline", ""
+			}
+			return exec.Command("yad", "--notification", "--image="+icon, "--text="+status, "--menu="+menu, "--command=")
+		}
+		// Without a tray, at least announce the session.
+		if _, err := exec.LookPath("notify-send"); err == nil && session {
+			return exec.Command("notify-send", "--urgency=critical", "Remote session started", status)
+		}
+	}
+	return nil
+}
+
+// trayScriptMacOS puts a status item in the menu bar: run(argv) takes the
+// title, the status line and "session" while a session is active or
+// "online" while connected outside one.
+const trayScriptMacOS = `ObjC.import('Cocoa');
+function run(argv) {
+	ObjC.registerSubclass({
+		name: 'RMMTrayTarget',
+		methods: {
+			'endSession:': {
+				types: ['void', ['id']],
+				implementation: function () {
+					$.NSFileHandle.fileHandleWithStandardOutput.writeData(
+						$('end_session\n').dataUsingEncoding($.NSUTF8StringEncoding));
+				},
+			},
+			'raiseHand:': {
+				types: ['void', ['id']],
+				implementation: function () {
+					$.NSFileHandle.fileHandleWithStandardOutput.writeData(
+						$('raise_hand\n').dataUsingEncoding($.NSUTF8StringEncoding));
+				},
+			},
+		},
+	});
+	var app = $.NSApplication.sharedApplication;
+	app.setActivationPolicy($.NSApplicationActivationPolicyAccessory);
+	var item = $.NSStatusBar.systemStatusBar.statusItemWithLength($.NSVariableStatusItemLength);
+	item.button.title = argv[0];
+	var menu = $.NSMenu.alloc.init;
+	menu.addItem($.NSMenuItem.alloc.initWithTitleActionKeyEquivalent(argv[1], null, ''));
+	if (argv[2] === 'session') {
+		var end = $.NSMenuItem.alloc.initWithTitleActionKeyEquivalent('End remote session', 'endSession:', '');
+		end.target = $.RMMTrayTarget.alloc.init;
+		menu.addItem(end);
+	} else if (argv[2] === 'online') {
+		var help = $.NSMenuItem.alloc.initWithTitleActionKeyEquivalent('Request support…', 'raiseHand:', '');
+		help.target = $.RMMTrayTarget.alloc.init;
+		menu.addItem(help);
+	}
+	item.menu = menu;
+	app.run;
+}`
+
+// trayScriptWindows shows a notification-area icon, with a balloon when
+// a session starts. The status comes from the environment so it needs no
+// quoting.
+const trayScriptWindows = `
+Add-Type -AssemblyName System.Windows.Forms
+Add-Type -AssemblyName System.Drawing
+$status = $env:RMM_TRAY_STATUS
+$icon = New-Object System.Windows.Forms.NotifyIcon
+$icon.Icon = [System.Drawing.SystemIcons]::Information
+$icon.Text = $status.Substring(0, [Math]::Min(63, $status.Length))
+$menu = New-Object System.Windows.Forms.ContextMenuStrip
+$menu.Items.Add($status).Enabled = $false
+if ($env:RMM_TRAY_SESSION) {
+	$icon.Icon = [System.Drawing.SystemIcons]::Warning
+	$end = $menu.Items.Add('End remote session')
+	$end.add_Click({ [Console]::Out.WriteLine('end_session'); [Console]::Out.Flush() })
+} elseif ($env:RMM_TRAY_ONLINE) {
+	$help = $menu.Items.Add('Request support...')
+	$help.add_Click({ [Console]::Out.WriteLine('raise_hand'); [Console]::Out.Flush() })
+}
+$icon.ContextMenuStrip = $menu
+$icon.Visible = $true
+if ($env:RMM_TRAY_SESSION) { $icon.ShowBalloonTip(10000, 'Remote session started', $status, 'Warning') }
+[System.Windows.Forms.Application]::Run()
+`
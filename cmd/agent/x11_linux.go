@@ -0,0 +1,515 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A minimal X11 client, enough of the core protocol and the MIT-SHM
+// extension to read the root window's pixels. The agent has no cgo, so it
+// speaks the wire protocol itself rather than linking Xlib. With MIT-SHM,
+// which a local server offers, the server copies each frame into a shared
+// memory segment (ShmGetImage) instead of sending it over the socket;
+// without it, GetImage is used. The connection stays open between frames
+// and is reopened after an error.
+
+// x11Timeout bounds each round trip to the X server.
+const x11Timeout = 5 * time.Second
+
+// X11 request opcodes, and MIT-SHM minor opcodes.
+const (
+	xGetGeometry    = 14
+	xGetInputFocus  = 43
+	xGetImage       = 73
+	xQueryExtension = 98
+
+	xShmAttach   = 1
+	xShmDetach   = 2
+	xShmGetImage = 4
+
+	xZPixmap = 2
+)
+
+var x11 struct {
+	mu   sync.Mutex
+	conn *xConn
+}
+
+// grabX11 captures the X screen named by $DISPLAY (":0" when unset).
+func grabX11() (image.Image, error) {
+	x11.mu.Lock()
+	defer x11.mu.Unlock()
+	if x11.conn == nil {
+		c, err := dialX11(os.Getenv("DISPLAY"))
+		if err != nil {
+			return nil, err
+		}
+		x11.conn = c
+	}
+	img, err := x11.conn.grab()
+	if err != nil {
+		x11.conn.close()
+		x11.conn = nil
+	}
+	return img, err
+}
+
+// xConn is a connection to an X server.
+type xConn struct {
+	c  net.Conn
+	rd *bufio.Reader
+
+	ridBase, ridMask, ridNext uint32
+
+	root          uint32
+	width, height int
+	// lsb is the server's image byte order: BGRX pixels when set, XRGB
+	// when not.
+	lsb bool
+
+	shmOpcode byte // MIT-SHM's major opcode; 0 when unusable
+	shm       *xShmSegment
+}
+
+// xShmSegment is a shared memory segment attached to both ends.
+type xShmSegment struct {
+	seg  uint32 // the server's ID for it
+	data []byte
+}
+
+// dialX11 connects and authenticates to the X server named by display.
+func dialX11(display string) (*xConn, error) {
+	if display == "" {
+		display = ":0"
+	}
+	host, rest, ok := strings.Cut(display, ":")
+	if i := strings.LastIndex(display, ":"); ok && i > len(host) {
+		host, rest = display[:i], display[i+1:] // an IPv6 host
+	}
+	num, screenStr, _ := strings.Cut(rest, ".")
+	n, err := strconv.Atoi(num)
+	if !ok || err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid DISPLAY %q", display)
+	}
+	screen := 0
+	if screenStr != "" {
+		if screen, err = strconv.Atoi(screenStr); err != nil || screen < 0 {
+			return nil, fmt.Errorf("invalid DISPLAY %q", display)
+		}
+	}
+
+	local := host == "" || host == "unix"
+	var c net.Conn
+	if local {
+		path := "/tmp/.X11-unix/X" + num
+		if c, err = net.DialTimeout("unix", path, x11Timeout); err != nil {
+			c, err = net.DialTimeout("unix", "@"+path, x11Timeout) // abstract
+		}
+	} else {
+		c, err = net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(6000+n)), x11Timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to X display %s: %w", display, err)
+	}
+	x := &xConn{c: c, rd: bufio.NewReaderSize(c, 64<<10)}
+	if err := x.setup(num, screen, local); err != nil {
+		c.Close() //nolint:errcheck
+		return nil, fmt.Errorf("X display %s: %w", display, err)
+	}
+	if local {
+		x.initShm()
+	}
+	return x, nil
+}
+
+// setup performs the connection handshake and reads the screen's root
+// window, size and pixel format.
+func (x *xConn) setup(display string, screen int, local bool) error {
+	authName, authData := xAuthCookie(display, local)
+	req := []byte{'l', 0}
+	req = binary.LittleEndian.AppendUint16(req, 11) // protocol 11.0
+	req = binary.LittleEndian.AppendUint16(req, 0)
+	req = binary.LittleEndian.AppendUint16(req, uint16(len(authName)))
+	req = binary.LittleEndian.AppendUint16(req, uint16(len(authData)))
+	req = append(req, 0, 0)
+	req = append(req, xPad([]byte(authName))...)
+	req = append(req, xPad(authData)...)
+
+	x.c.SetDeadline(time.Now().Add(x11Timeout)) //nolint:errcheck
+	defer x.c.SetDeadline(time.Time{})          //nolint:errcheck
+	if _, err := x.c.Write(req); err != nil {
+		return err
+	}
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(x.rd, head); err != nil {
+		return err
+	}
+	body := make([]byte, 4*int(binary.LittleEndian.Uint16(head[6:])))
+	if _, err := io.ReadFull(x.rd, body); err != nil {
+		return err
+	}
+	if head[0] != 1 {
+		reason := body[:min(int(head[1]), len(body))]
+		return fmt.Errorf("connection refused: %s", strings.TrimSpace(string(reason)))
+	}
+
+	if len(body) < 32 {
+		return errors.New("short connection setup")
+	}
+	x.ridBase = binary.LittleEndian.Uint32(body[4:])
+	x.ridMask = binary.LittleEndian.Uint32(body[8:])
+	vendorLen := int(binary.LittleEndian.Uint16(body[16:]))
+	screens, formats := int(body[20]), int(body[21])
+	x.lsb = body[22] == 0
+	off := 32 + (vendorLen+3)&^3
+
+	// Pixmap formats: the bits per pixel of each depth.
+	bpp := map[byte]byte{}
+	for i := 0; i < formats; i++ {
+		if off+8 > len(body) {
+			return errors.New("short connection setup")
+		}
+		bpp[body[off]] = body[off+1]
+		off += 8
+	}
+	if screen >= screens {
+		return fmt.Errorf("screen %d not found (%d screens)", screen, screens)
+	}
+	for i := 0; ; i++ {
+		if off+40 > len(body) {
+			return errors.New("short connection setup")
+		}
+		s := body[off:]
+		if i == screen {
+			x.root = binary.LittleEndian.Uint32(s)
+			x.width, x.height = int(binary.LittleEndian.Uint16(s[20:])), int(binary.LittleEndian.Uint16(s[22:]))
+			visual, depth := binary.LittleEndian.Uint32(s[32:]), s[38]
+			if bpp[depth] != 32 {
+				return fmt.Errorf("unsupported pixel format: depth %d, %d bits per pixel", depth, bpp[depth])
+			}
+			return checkVisual(body[off+40:], int(s[39]), visual)
+		}
+		off += 40 + xDepthsLen(body[off+40:], int(s[39]))
+	}
+}
+
+// checkVisual finds visual among a screen's allowed depths and requires
+// 8-bit red, green and blue channels in the usual places.
+func checkVisual(depths []byte, n int, visual uint32) error {
+	off := 0
+	for range n {
+		if off+8 > len(depths) {
+			break
+		}
+		visuals := int(binary.LittleEndian.Uint16(depths[off+2:]))
+		for v := range visuals {
+			p := off + 8 + 24*v
+			if p+24 > len(depths) {
+				break
+			}
+			if binary.LittleEndian.Uint32(depths[p:]) != visual {
+				continue
+			}
+			r, g, b := binary.LittleEndian.Uint32(depths[p+8:]), binary.LittleEndian.Uint32(depths[p+12:]), binary.LittleEndian.Uint32(depths[p+16:])
+			if r != 0xff0000 || g != 0xff00 || b != 0xff {
+				return fmt.Errorf("unsupported visual: masks %#x %#x %#x", r, g, b)
+			}
+			return nil
+		}
+		off += 8 + 24*visuals
+	}
+	return errors.New("root visual not found")
+}
+
+// xDepthsLen returns the length of a screen's n allowed depths.
+func xDepthsLen(depths []byte, n int) int {
+	off := 0
+	for range n {
+		if off+8 > len(depths) {
+			return len(depths)
+		}
+		off += 8 + 24*int(binary.LittleEndian.Uint16(depths[off+2:]))
+	}
+	return off
+}
+
+// xAuthCookie returns the MIT-MAGIC-COOKIE-1 for display from
+// $XAUTHORITY (~/.Xauthority by default), if there is one.
+func xAuthCookie(display string, local bool) (string, []byte) {
+	const magic = "MIT-MAGIC-COOKIE-1"
+	path := os.Getenv("XAUTHORITY")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", nil
+		}
+		path = filepath.Join(home, ".Xauthority")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil
+	}
+	hostname, _ := os.Hostname()
+
+	// Entries are a family and four length-prefixed fields: address,
+	// display number, auth name and auth data.
+	var fallback []byte
+	r := bytes.NewReader(data)
+entries:
+	for {
+		var family uint16
+		if binary.Read(r, binary.BigEndian, &family) != nil {
+			break
+		}
+		var fields [4][]byte
+		for i := range fields {
+			var n uint16
+			if binary.Read(r, binary.BigEndian, &n) != nil {
+				break entries
+			}
+			fields[i] = make([]byte, n)
+			if _, err := io.ReadFull(r, fields[i]); err != nil {
+				break entries
+			}
+		}
+		addr, num, name, cookie := string(fields[0]), string(fields[1]), string(fields[2]), fields[3]
+		if name != magic || (num != display && num != "") {
+			continue
+		}
+		const familyLocal, familyWild = 256, 65535
+		if family == familyWild || (local && family == familyLocal && addr == hostname) {
+			return magic, cookie
+		}
+		if fallback == nil {
+			fallback = cookie
+		}
+	}
+	if fallback == nil {
+		return "", nil
+	}
+	return magic, fallback
+}
+
+// xPad pads b to a multiple of four bytes.
+func xPad(b []byte) []byte {
+	return append(b, make([]byte, (4-len(b)%4)%4)...)
+}
+
+// newID allocates a resource ID.
+func (x *xConn) newID() uint32 {
+	x.ridNext++
+	return x.ridBase | (x.ridNext & x.ridMask)
+}
+
+// send writes a request with header op, data and the body, and the length
+// the header needs.
+func (x *xConn) send(op, data byte, body []byte) error {
+	req := []byte{op, data}
+	req = binary.LittleEndian.AppendUint16(req, uint16(1+len(body)/4))
+	_, err := x.c.Write(append(req, body...))
+	return err
+}
+
+// xError is an error the X server reported for a request.
+type xError struct {
+	code, major byte
+	minor       uint16
+}
+
+func (e *xError) Error() string {
+	return fmt.Sprintf("X error %d (request %d.%d)", e.code, e.major, e.minor)
+}
+
+// reply reads the next reply, skipping events and failing with an
+// *xError on an error. The reply's extra data is appended to its 32-byte
+// header.
+func (x *xConn) reply() ([]byte, error) {
+	for {
+		head := make([]byte, 32)
+		if _, err := io.ReadFull(x.rd, head); err != nil {
+			return nil, err
+		}
+		switch head[0] {
+		case 0:
+			return nil, &xError{code: head[1], major: head[10], minor: binary.LittleEndian.Uint16(head[8:])}
+		case 1:
+			extra := int(binary.LittleEndian.Uint32(head[4:])) * 4
+			buf := make([]byte, 32+extra)
+			copy(buf, head)
+			if _, err := io.ReadFull(x.rd, buf[32:]); err != nil {
+				return nil, err
+			}
+			return buf, nil
+		}
+	}
+}
+
+// sync waits for the server to process every request sent so far,
+// returning the error of the first that failed.
+func (x *xConn) sync() error {
+	if err := x.send(xGetInputFocus, 0, nil); err != nil {
+		return err
+	}
+	var failed error
+	for {
+		_, err := x.reply()
+		var xe *xError
+		switch {
+		case err == nil:
+			return failed
+		case !errors.As(err, &xe):
+			return err
+		case failed == nil:
+			failed = err
+		}
+	}
+}
+
+// initShm sets up MIT-SHM, leaving shmOpcode 0 when the server lacks it.
+func (x *xConn) initShm() {
+	const name = "MIT-SHM"
+	body := binary.LittleEndian.AppendUint16(nil, uint16(len(name)))
+	body = append(body, 0, 0)
+	body = append(body, xPad([]byte(name))...)
+	x.c.SetDeadline(time.Now().Add(x11Timeout)) //nolint:errcheck
+	defer x.c.SetDeadline(time.Time{})          //nolint:errcheck
+	if x.send(xQueryExtension, 0, body) != nil {
+		return
+	}
+	rep, err := x.reply()
+	if err != nil || rep[8] == 0 {
+		return
+	}
+	x.shmOpcode = rep[9]
+}
+
+// attachShm creates a segment of size bytes and attaches the server to
+// it. The segment is marked for removal once both ends have attached, so
+// it goes away with the agent.
+func (x *xConn) attachShm(size int) (*xShmSegment, error) {
+	id, err := unix.SysvShmGet(unix.IPC_PRIVATE, size, unix.IPC_CREAT|0o600)
+	if err != nil {
+		return nil, fmt.Errorf("shmget: %w", err)
+	}
+	defer unix.SysvShmCtl(id, unix.IPC_RMID, nil) //nolint:errcheck
+	data, err := unix.SysvShmAttach(id, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("shmat: %w", err)
+	}
+	seg := &xShmSegment{seg: x.newID(), data: data}
+	body := binary.LittleEndian.AppendUint32(nil, seg.seg)
+	body = binary.LittleEndian.AppendUint32(body, uint32(id))
+	body = append(body, 0, 0, 0, 0) // read-write, so the server can write
+	if err = x.send(x.shmOpcode, xShmAttach, body); err == nil {
+		err = x.sync()
+	}
+	if err != nil {
+		unix.SysvShmDetach(data) //nolint:errcheck
+		return nil, fmt.Errorf("ShmAttach: %w", err)
+	}
+	return seg, nil
+}
+
+// detachShm detaches both ends from the segment.
+func (x *xConn) detachShm() {
+	if x.shm == nil {
+		return
+	}
+	x.send(x.shmOpcode, xShmDetach, binary.LittleEndian.AppendUint32(nil, x.shm.seg)) //nolint:errcheck
+	unix.SysvShmDetach(x.shm.data)                                                    //nolint:errcheck
+	x.shm = nil
+}
+
+func (x *xConn) close() {
+	x.detachShm()
+	x.c.Close() //nolint:errcheck
+}
+
+// grab reads the root window.
+func (x *xConn) grab() (image.Image, error) {
+	x.c.SetDeadline(time.Now().Add(x11Timeout)) //nolint:errcheck
+	defer x.c.SetDeadline(time.Time{})          //nolint:errcheck
+
+	// The screen's size changes with its resolution or monitors.
+	if err := x.send(xGetGeometry, 0, binary.LittleEndian.AppendUint32(nil, x.root)); err != nil {
+		return nil, err
+	}
+	geom, err := x.reply()
+	if err != nil {
+		return nil, fmt.Errorf("GetGeometry: %w", err)
+	}
+	if w, h := int(binary.LittleEndian.Uint16(geom[16:])), int(binary.LittleEndian.Uint16(geom[18:])); w != x.width || h != x.height {
+		x.width, x.height = w, h
+		x.detachShm()
+	}
+
+	area := binary.LittleEndian.AppendUint32(nil, x.root)
+	area = binary.LittleEndian.AppendUint16(area, 0)
+	area = binary.LittleEndian.AppendUint16(area, 0)
+	area = binary.LittleEndian.AppendUint16(area, uint16(x.width))
+	area = binary.LittleEndian.AppendUint16(area, uint16(x.height))
+	area = binary.LittleEndian.AppendUint32(area, 0xffffffff) // all planes
+	size := x.width * x.height * 4
+
+	if x.shmOpcode != 0 && x.shm == nil {
+		seg, err := x.attachShm(size)
+		if err != nil {
+			x.shmOpcode = 0 // e.g. a server in another IPC namespace
+		}
+		x.shm = seg
+	}
+	if x.shm != nil {
+		body := append(area, xZPixmap, 0, 0, 0)
+		body = binary.LittleEndian.AppendUint32(body, x.shm.seg)
+		body = binary.LittleEndian.AppendUint32(body, 0)
+		if err := x.send(x.shmOpcode, xShmGetImage, body); err != nil {
+			return nil, err
+		}
+		if _, err := x.reply(); err != nil {
+			return nil, fmt.Errorf("ShmGetImage: %w", err)
+		}
+		return x.image(x.shm.data[:size]), nil
+	}
+
+	if err := x.send(xGetImage, xZPixmap, area); err != nil {
+		return nil, err
+	}
+	rep, err := x.reply()
+	if err != nil {
+		return nil, fmt.Errorf("GetImage: %w", err)
+	}
+	if len(rep) < 32+size {
+		return nil, errors.New("GetImage: short reply")
+	}
+	return x.image(rep[32 : 32+size]), nil
+}
+
+// image converts 32-bit ZPixmap pixels to RGBA.
+func (x *xConn) image(src []byte) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, x.width, x.height))
+	dst := img.Pix
+	r0, g0, b0 := 2, 1, 0 // BGRX
+	if !x.lsb {
+		r0, g0, b0 = 1, 2, 3 // XRGB
+	}
+	for i := 0; i < len(dst); i += 4 {
+		dst[i], dst[i+1], dst[i+2], dst[i+3] = src[i+r0], src[i+g0], src[i+b0], 255
+	}
+	return img
+}
@@ -0,0 +1,273 @@
+// Command rmmctl administers a running server through its local Unix
+// socket. It needs no API key: access is granted by filesystem permissions
+// on the socket, so it works even if every HTTP credential has been lost.
+//
+// Usage:
+//
+//	rmmctl [-socket data/admin.sock] status
+//	rmmctl keys list
+//	rmmctl keys create <name> [role]
+//	rmmctl keys delete <id>
+//	rmmctl backup [path]
+//	rmmctl reload
+//	rmmctl escrow [qr.png]
+//	rmmctl sign <binary>...
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/qr"
+)
+
+func main() {
+	socket := flag.String("socket", "data/admin.sock", "Path to the server admin socket")
+	flag.Usage = usage
+	flag.Parse()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", *socket)
+			},
+		},
+		Timeout: 5 * time.Minute, // backups of large databases can take a while
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch {
+	case args[0] == "status":
+		err = call(client, http.MethodGet, "/admin/status", nil)
+	case args[0] == "keys" && len(args) == 2 && args[1] == "list":
+		err = call(client, http.MethodGet, "/admin/keys", nil)
+	case args[0] == "keys" && (len(args) == 3 || len(args) == 4) && args[1] == "create":
+		body := map[string]string{"name": args[2]}
+		if len(args) == 4 {
+			body["role"] = args[3]
+		}
+		err = call(client, http.MethodPost, "/admin/keys", body)
+	case args[0] == "keys" && len(args) == 3 && args[1] == "delete":
+		err = call(client, http.MethodDelete, "/admin/keys?id="+url.QueryEscape(args[2]), nil)
+	case args[0] == "backup":
+		body := map[string]string{}
+		if len(args) > 1 {
+			body["path"] = args[1]
+		}
+		err = call(client, http.MethodPost, "/admin/backup", body)
+	case args[0] == "reload":
+		err = call(client, http.MethodPost, "/admin/reload", nil)
+	case args[0] == "escrow" && len(args) <= 2:
+		qrPath := ""
+		if len(args) == 2 {
+			qrPath = args[1]
+		}
+		err = escrow(client, qrPath)
+	case args[0] == "sign" && len(args) >= 2:
+		err = sign(client, args[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rmmctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// call sends a request to the admin socket and pretty-prints the JSON reply.
+func call(client *http.Client, method, path string, body interface{}) error {
+	data, err := send(client, method, path, body)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if json.Indent(&out, data, "", "  ") != nil {
+		out.Write(data)
+	}
+	fmt.Println(out.String())
+	return nil
+}
+
+// send sends a request to the admin socket and returns the reply body.
+func send(client *http.Client, method, path string, body interface{}) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://admin"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, data)
+	}
+	return data, nil
+}
+
+// escrow asks for a recovery passphrase, twice and without echo when
+// stdin is a terminal, and prints the platform key encrypted under it.
+// With qrPath the code is also written there as a QR code PNG.
+func escrow(client *http.Client, qrPath string) error {
+	var passphrase string
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		readPassword := func(prompt string) (string, error) {
+			fmt.Fprint(os.Stderr, prompt)
+			raw, err := term.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			return string(raw), err
+		}
+		var err error
+		if passphrase, err = readPassword("Recovery passphrase: "); err != nil {
+			return err
+		}
+		repeat, err := readPassword("Repeat passphrase: ")
+		if err != nil {
+			return err
+		}
+		if repeat != passphrase {
+			return errors.New("passphrases do not match")
+		}
+	} else {
+		fmt.Fprint(os.Stderr, "Recovery passphrase: ")
+		stdin := bufio.NewScanner(os.Stdin)
+		stdin.Scan()
+		passphrase = strings.TrimRight(stdin.Text(), "\r")
+	}
+
+	data, err := send(client, http.MethodPost, "/admin/escrow", map[string]string{"passphrase": passphrase})
+	if err != nil {
+		return err
+	}
+	var reply struct {
+		Platform string `json:"platform"`
+		Code     string `json:"code"`
+	}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return err
+	}
+
+	fmt.Printf("Platform:      %s\nRecovery code: %s\n", reply.Platform, reply.Code)
+	fmt.Fprintln(os.Stderr, "Keep the code and the passphrase apart, and both away from this server.")
+	fmt.Fprintln(os.Stderr, "Restore with: server -restore-platform")
+	if qrPath == "" {
+		return nil
+	}
+	code, err := qr.Encode(reply.Code)
+	if err != nil {
+		return err
+	}
+	png, err := code.PNG(8)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(qrPath, png, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "QR code written to %s\n", qrPath)
+	return nil
+}
+
+// sign has the server sign each agent binary and writes the signature
+// beside it (see protocol.ReleaseDigest). Only the binary's SHA-256
+// travels to the server.
+func sign(client *http.Client, paths []string) error {
+	var platformKey string
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close() //nolint:errcheck
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		data, err := send(client, http.MethodPost, "/admin/sign", map[string]string{
+			"sha256": hex.EncodeToString(h.Sum(nil)),
+			"name":   filepath.Base(path),
+		})
+		if err != nil {
+			return err
+		}
+		var reply struct {
+			Signature   string `json:"signature"`
+			PlatformKey string `json:"platform_key"`
+		}
+		if err := json.Unmarshal(data, &reply); err != nil {
+			return err
+		}
+		sigPath := path + protocol.ReleaseSignatureSuffix
+		if err := os.WriteFile(sigPath, []byte(reply.Signature+"\n"), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Signed %s (%s)\n", path, sigPath)
+		platformKey = reply.PlatformKey
+	}
+	fmt.Printf("Signer key: %s\n", platformKey)
+	fmt.Fprintln(os.Stderr, "Build agents that check their signature with: make agents AGENT_SIGNER=<signer key>")
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: rmmctl [-socket path] <command>
+
+Commands:
+  status                 Show server identity and connection counts
+  keys list              List API keys
+  keys create <name> [role]
+                         Create an API key (printed once); role is
+                         admin (default), technician or auditor
+  keys delete <id>       Delete an API key
+  backup [path]          Snapshot the database (default <data>/backups/)
+  reload                 Reload the config file and TLS certificate
+  escrow [qr.png]        Export platform.key encrypted under a recovery
+                         passphrase read from stdin, optionally as a
+                         QR code; restore with server -restore-platform
+  sign <binary>...       Sign agent binaries with the platform key,
+                         writing <binary>.sig beside each`)
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Access schedules: an organization's business hours for a group of
+// agents (every agent in an organization and/or at a site). Outside them,
+// handleViewer refuses remote control of the group (store.AccessBlock),
+// or allows it only with an access override (store.AccessApproval): the
+// operator asks with a reason, a different admin key approves or denies
+// the request, and an approved override lets the operator's key open
+// sessions to that agent until it expires. Sessions already open when
+// hours end carry on. Overrides are kept in memory; every request,
+// decision and use is audited.
+
+const (
+	// Override lengths, in minutes: the default and the most a request
+	// may ask for.
+	defaultOverrideMinutes = 60
+	maxOverrideMinutes     = 8 * 60
+	// overridePendingTTL is how long a request waits for a decision.
+	overridePendingTTL = time.Hour
+	maxOverrideReason  = 500
+
+	auditAccessScheduleCreated   = "access_schedule_created"
+	auditAccessScheduleDeleted   = "access_schedule_deleted"
+	auditAccessDenied            = "access_denied_after_hours"
+	auditAccessOverrideRequested = "access_override_requested"
+	auditAccessOverrideApproved  = "access_override_approved"
+	auditAccessOverrideDenied    = "access_override_denied"
+	auditAccessOverrideUsed      = "access_override_used"
+
+	eventAccessOverride = "access.override"
+)
+
+// Access override states.
+const (
+	overridePending  = "pending"
+	overrideApproved = "approved"
+	overrideDenied   = "denied"
+)
+
+// accessOverride is a request to control an agent after hours. ExpiresAt
+// is when a pending request lapses, or when an approved override ends.
+type accessOverride struct {
+	ID            string     `json:"id"`
+	AgentID       string     `json:"agent_id"`
+	RequestedByID string     `json:"requested_by_id"`
+	RequestedBy   string     `json:"requested_by"`
+	Reason        string     `json:"reason"`
+	Minutes       int        `json:"minutes"`
+	Status        string     `json:"status"`
+	DecidedBy     string     `json:"decided_by,omitempty"`
+	RequestedAt   time.Time  `json:"requested_at"`
+	DecidedAt     *time.Time `json:"decided_at,omitempty"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+}
+
+// handleAccessSchedules lists (GET) or creates (POST) access schedules.
+func (s *Server) handleAccessSchedules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		scheds, err := s.store.ListAccessSchedules(r.Context())
+		if err != nil {
+			http.Error(w, `{"error":"failed to list schedules"}`, http.StatusInternalServerError)
+			return
+		}
+		if scheds == nil {
+			scheds = []*store.AccessSchedule{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scheds) //nolint:errcheck
+
+	case http.MethodPost:
+		apiKey := security.APIKeyFromContext(r.Context())
+		if apiKey.Role != store.RoleAdmin {
+			http.Error(w, `{"error":"access schedules require an admin key"}`, http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Name     string   `json:"name"`
+			OrgID    string   `json:"org_id"`
+			Site     string   `json:"site"`
+			Days     []string `json:"days"`
+			Start    string   `json:"start"`
+			End      string   `json:"end"`
+			TimeZone string   `json:"timezone"`
+			Mode     string   `json:"mode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		sched := &store.AccessSchedule{
+			ID:        security.NewID(),
+			Name:      strings.TrimSpace(req.Name),
+			OrgID:     req.OrgID,
+			Site:      strings.TrimSpace(req.Site),
+			Days:      []string{},
+			Start:     req.Start,
+			End:       req.End,
+			TimeZone:  req.TimeZone,
+			Mode:      req.Mode,
+			CreatedBy: apiKey.Name,
+			CreatedAt: time.Now(),
+		}
+		if sched.Name == "" {
+			sched.Name = "Business hours"
+		}
+		if sched.TimeZone == "" {
+			sched.TimeZone = "UTC"
+		}
+		if sched.Mode == "" {
+			sched.Mode = store.AccessBlock
+		}
+		for _, day := range req.Days {
+			day = strings.ToLower(day)
+			if _, ok := rebootDays[day]; !ok {
+				http.Error(w, `{"error":"days must be mon, tue, wed, thu, fri, sat or sun"}`, http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(sched.Days, day) {
+				sched.Days = append(sched.Days, day)
+			}
+		}
+		if err := s.checkAccessSchedule(r.Context(), sched); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.store.CreateAccessSchedule(r.Context(), sched); err != nil {
+			http.Error(w, `{"error":"failed to create schedule"}`, http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditAccessScheduleCreated,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail: fmt.Sprintf("schedule=%s target=%s days=%v hours=%s-%s timezone=%s mode=%s",
+				sched.ID, accessTarget(sched), sched.Days, sched.Start, sched.End, sched.TimeZone, sched.Mode),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(sched) //nolint:errcheck
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkAccessSchedule validates a new schedule's target, hours and mode.
+func (s *Server) checkAccessSchedule(ctx context.Context, sc *store.AccessSchedule) error {
+	if sc.OrgID == "" && sc.Site == "" {
+		return fmt.Errorf("org_id or site required")
+	}
+	if sc.OrgID != "" {
+		if org, err := s.store.GetOrg(ctx, sc.OrgID); err != nil || org == nil {
+			return fmt.Errorf("organization not found")
+		}
+	}
+	if _, err := time.Parse("15:04", sc.Start); err != nil {
+		return fmt.Errorf("start must be HH:MM")
+	}
+	if _, err := time.Parse("15:04", sc.End); err != nil {
+		return fmt.Errorf("end must be HH:MM")
+	}
+	if sc.Start == sc.End {
+		return fmt.Errorf("start and end must differ")
+	}
+	if _, err := time.LoadLocation(sc.TimeZone); err != nil {
+		return fmt.Errorf("unknown timezone %q", sc.TimeZone)
+	}
+	if sc.Mode != store.AccessBlock && sc.Mode != store.AccessApproval {
+		return fmt.Errorf("mode must be %s or %s", store.AccessBlock, store.AccessApproval)
+	}
+	return nil
+}
+
+// handleAccessSchedule returns (GET) or deletes (DELETE) an access
+// schedule.
+func (s *Server) handleAccessSchedule(w http.ResponseWriter, r *http.Request) {
+	sched, err := s.store.GetAccessSchedule(r.Context(), r.PathValue("id"))
+	if err != nil || sched == nil {
+		http.Error(w, `{"error":"schedule not found"}`, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sched) //nolint:errcheck
+
+	case http.MethodDelete:
+		apiKey := security.APIKeyFromContext(r.Context())
+		if apiKey.Role != store.RoleAdmin {
+			http.Error(w, `{"error":"access schedules require an admin key"}`, http.StatusForbidden)
+			return
+		}
+		if err := s.store.DeleteAccessSchedule(r.Context(), sched.ID); err != nil {
+			http.Error(w, `{"error":"failed to delete schedule"}`, http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditAccessScheduleDeleted,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail:    "schedule=" + sched.ID,
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// accessTarget describes a schedule's group for audit events.
+func accessTarget(sc *store.AccessSchedule) string {
+	var parts []string
+	if sc.OrgID != "" {
+		parts = append(parts, "org:"+sc.OrgID)
+	}
+	if sc.Site != "" {
+		parts = append(parts, fmt.Sprintf("site:%q", sc.Site))
+	}
+	return strings.Join(parts, ",")
+}
+
+// inBusinessHours reports whether now falls within the schedule's hours.
+// Hours past midnight count for the day they start, so yesterday's may
+// still be open.
+func inBusinessHours(sc *store.AccessSchedule, now time.Time) bool {
+	loc, err := time.LoadLocation(sc.TimeZone)
+	if err != nil {
+		return false
+	}
+	from, err1 := time.Parse("15:04", sc.Start)
+	to, err2 := time.Parse("15:04", sc.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	length := to.Sub(from)
+	if length <= 0 {
+		length += 24 * time.Hour
+	}
+	local := now.In(loc)
+	for back := 0; back < 2; back++ {
+		day := local.AddDate(0, 0, -back)
+		start := time.Date(day.Year(), day.Month(), day.Day(), from.Hour(), from.Minute(), 0, 0, loc)
+		if len(sc.Days) > 0 && !slices.ContainsFunc(sc.Days, func(d string) bool { return rebootDays[d] == start.Weekday() }) {
+			continue
+		}
+		if !now.Before(start) && now.Before(start.Add(length)) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessSchedulesFor returns the schedules whose group includes agents
+// in orgID at site.
+func (s *Server) accessSchedulesFor(ctx context.Context, orgID, site string) ([]*store.AccessSchedule, error) {
+	scheds, err := s.store.ListAccessSchedules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(scheds, func(sc *store.AccessSchedule) bool {
+		return (sc.OrgID != "" && sc.OrgID != orgID) || (sc.Site != "" && sc.Site != site)
+	}), nil
+}
+
+// afterHours returns the schedule restricting remote control of agent at
+// now, a blocking one first, or nil when none does.
+func (s *Server) afterHours(ctx context.Context, agent *LiveAgent, now time.Time) (*store.AccessSchedule, error) {
+	agent.mu.Lock()
+	orgID, site := agent.OrgID, agent.Site
+	agent.mu.Unlock()
+	scheds, err := s.accessSchedulesFor(ctx, orgID, site)
+	if err != nil {
+		return nil, err
+	}
+	var restricting *store.AccessSchedule
+	for _, sc := range scheds {
+		if inBusinessHours(sc, now) {
+			continue
+		}
+		if sc.Mode == store.AccessBlock {
+			return sc, nil
+		}
+		restricting = sc
+	}
+	return restricting, nil
+}
+
+// checkAccessHours reports whether the ticket's key may open a session
+// to agent now, answering the request when it may not.
+func (s *Server) checkAccessHours(w http.ResponseWriter, r *http.Request, agent *LiveAgent, ticket *viewerTicket) bool {
+	sc, err := s.afterHours(r.Context(), agent, time.Now())
+	if err != nil {
+		log.Printf("Access schedules: %v", err)
+		http.Error(w, "failed to check access schedules", http.StatusInternalServerError)
+		return false
+	}
+	if sc == nil {
+		return true
+	}
+	if sc.Mode == store.AccessApproval {
+		if o := s.approvedOverride(agent.ID, ticket.keyID); o != nil {
+			s.recordAudit(&store.AuditEvent{
+				Action:    auditAccessOverrideUsed,
+				ActorID:   ticket.keyID,
+				ActorName: ticket.keyName,
+				AgentID:   agent.ID,
+				Detail:    fmt.Sprintf("override=%s schedule=%s approved_by=%q", o.ID, sc.ID, o.DecidedBy),
+			})
+			return true
+		}
+	}
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditAccessDenied,
+		ActorID:   ticket.keyID,
+		ActorName: ticket.keyName,
+		AgentID:   agent.ID,
+		Detail:    fmt.Sprintf("schedule=%s mode=%s remote_addr=%s", sc.ID, sc.Mode, r.RemoteAddr),
+	})
+	msg := "remote control of this agent is blocked outside business hours"
+	if sc.Mode == store.AccessApproval {
+		msg = "remote control of this agent outside business hours needs an approved access override"
+	}
+	http.Error(w, msg, http.StatusForbidden)
+	return false
+}
+
+// liveOverrides drops lapsed overrides and returns the rest. The caller
+// holds overridesMu.
+func (s *Server) liveOverrides(now time.Time) map[string]*accessOverride {
+	maps.DeleteFunc(s.overrides, func(_ string, o *accessOverride) bool { return !now.Before(o.ExpiresAt) })
+	return s.overrides
+}
+
+// approvedOverride returns keyID's unexpired, approved override for
+// agentID, if any.
+func (s *Server) approvedOverride(agentID, keyID string) *accessOverride {
+	s.overridesMu.Lock()
+	defer s.overridesMu.Unlock()
+	for _, o := range s.liveOverrides(time.Now()) {
+		if o.AgentID == agentID && o.RequestedByID == keyID && o.Status == overrideApproved {
+			c := *o
+			return &c
+		}
+	}
+	return nil
+}
+
+// handleAccessOverrides lists overrides, pending and approved, newest
+// first (GET), or requests one (POST {"agent_id", "reason", "minutes"}).
+// Keys other than admin keys see their own.
+func (s *Server) handleAccessOverrides(w http.ResponseWriter, r *http.Request) {
+	apiKey := security.APIKeyFromContext(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+		s.overridesMu.Lock()
+		list := []accessOverride{}
+		for _, o := range s.liveOverrides(time.Now()) {
+			if apiKey.Role == store.RoleAdmin || o.RequestedByID == apiKey.ID {
+				list = append(list, *o)
+			}
+		}
+		s.overridesMu.Unlock()
+		slices.SortFunc(list, func(a, b accessOverride) int { return b.RequestedAt.Compare(a.RequestedAt) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list) //nolint:errcheck
+
+	case http.MethodPost:
+		var req struct {
+			AgentID string `json:"agent_id"`
+			Reason  string `json:"reason"`
+			Minutes int    `json:"minutes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AgentID == "" {
+			http.Error(w, `{"error":"agent_id required"}`, http.StatusBadRequest)
+			return
+		}
+		reason := strings.TrimSpace(req.Reason)
+		switch {
+		case reason == "":
+			http.Error(w, `{"error":"reason required"}`, http.StatusBadRequest)
+			return
+		case len(reason) > maxOverrideReason:
+			http.Error(w, fmt.Sprintf(`{"error":"reason is longer than %d bytes"}`, maxOverrideReason), http.StatusBadRequest)
+			return
+		}
+		if req.Minutes == 0 {
+			req.Minutes = defaultOverrideMinutes
+		}
+		if req.Minutes < 1 || req.Minutes > maxOverrideMinutes {
+			http.Error(w, fmt.Sprintf(`{"error":"minutes must be 1-%d"}`, maxOverrideMinutes), http.StatusBadRequest)
+			return
+		}
+		agent, err := s.store.GetAgent(r.Context(), req.AgentID)
+		if err != nil || agent == nil {
+			http.Error(w, `{"error":"agent not found"}`, http.StatusNotFound)
+			return
+		}
+		scheds, err := s.accessSchedulesFor(r.Context(), agent.OrgID, agent.Site)
+		if err != nil {
+			http.Error(w, `{"error":"failed to check access schedules"}`, http.StatusInternalServerError)
+			return
+		}
+		if !slices.ContainsFunc(scheds, func(sc *store.AccessSchedule) bool { return sc.Mode == store.AccessApproval }) {
+			http.Error(w, `{"error":"no access schedule of this agent takes overrides"}`, http.StatusConflict)
+			return
+		}
+
+		now := time.Now()
+		o := &accessOverride{
+			ID:            security.NewID(),
+			AgentID:       agent.ID,
+			RequestedByID: apiKey.ID,
+			RequestedBy:   apiKey.Name,
+			Reason:        reason,
+			Minutes:       req.Minutes,
+			Status:        overridePending,
+			RequestedAt:   now,
+			ExpiresAt:     now.Add(overridePendingTTL),
+		}
+		s.overridesMu.Lock()
+		s.liveOverrides(now)[o.ID] = o
+		created := *o
+		s.overridesMu.Unlock()
+
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditAccessOverrideRequested,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			AgentID:   agent.ID,
+			Detail:    fmt.Sprintf("override=%s minutes=%d reason=%q", o.ID, o.Minutes, reason),
+		})
+		s.publishEvent(eventAccessOverride, agent.ID, &created)
+		log.Printf("Access override requested for agent %s by %s: %s", agent.ID, apiKey.Name, reason)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&created) //nolint:errcheck
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAccessOverrideDecision approves or denies a pending override
+// (POST /api/access/overrides/{id}/approve or /deny). It takes an admin
+// key other than the requester's.
+func (s *Server) handleAccessOverrideDecision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, action := overrideApproved, auditAccessOverrideApproved
+	switch r.PathValue("decision") {
+	case "approve":
+	case "deny":
+		status, action = overrideDenied, auditAccessOverrideDenied
+	default:
+		http.Error(w, `{"error":"decision must be approve or deny"}`, http.StatusNotFound)
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	if apiKey.Role != store.RoleAdmin {
+		http.Error(w, `{"error":"deciding an access override requires an admin key"}`, http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	s.overridesMu.Lock()
+	o := s.liveOverrides(now)[r.PathValue("id")]
+	var errMsg string
+	var code int
+	switch {
+	case o == nil:
+		errMsg, code = "override not found", http.StatusNotFound
+	case o.Status != overridePending:
+		errMsg, code = "override already "+o.Status, http.StatusConflict
+	case o.RequestedByID == apiKey.ID:
+		errMsg, code = "an override must be decided by another key", http.StatusForbidden
+	default:
+		o.Status, o.DecidedBy, o.DecidedAt = status, apiKey.Name, &now
+		if status == overrideApproved {
+			o.ExpiresAt = now.Add(time.Duration(o.Minutes) * time.Minute)
+		}
+	}
+	var decided accessOverride
+	if errMsg == "" {
+		decided = *o
+	}
+	s.overridesMu.Unlock()
+	if errMsg != "" {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, errMsg), code)
+		return
+	}
+
+	s.recordAudit(&store.AuditEvent{
+		Action:    action,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   decided.AgentID,
+		Detail:    fmt.Sprintf("override=%s requested_by=%q expires=%s", decided.ID, decided.RequestedBy, decided.ExpiresAt.UTC().Format(time.RFC3339)),
+	})
+	s.publishEvent(eventAccessOverride, decided.AgentID, &decided)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&decided) //nolint:errcheck
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+const (
+	// auditQuickAction records each quick action run on an agent.
+	auditQuickAction = "quick_action"
+
+	// operationQuickAction is the kind of operations that run a quick
+	// action on several agents.
+	operationQuickAction = "quick_action"
+	// maxBulkActionAgents bounds the agents of one bulk quick action.
+	maxBulkActionAgents = 5000
+	// bulkActionConcurrency is how many agents a bulk quick action waits
+	// on at a time.
+	bulkActionConcurrency = 16
+)
+
+// quickAction describes a built-in agent action in the catalog.
+type quickAction struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Platforms   []string `json:"platforms"`
+}
+
+// quickActions is the catalog served by GET /api/agents/{id}/actions.
+var quickActions = []quickAction{
+	{protocol.ActionFlushDNS, "Clear the DNS resolver cache", []string{"windows", "darwin", "linux"}},
+	{protocol.ActionClearSpooler, "Cancel every queued print job and restart the print spooler", []string{"windows", "darwin", "linux"}},
+	{protocol.ActionRestartShell, "Restart Explorer (Windows) or Finder (macOS)", []string{"windows", "darwin"}},
+	{protocol.ActionSupportBundle, "Snapshot system, network and process state for triage", []string{"windows", "darwin", "linux"}},
+}
+
+// handleAgentActions lists the quick actions available on a connected
+// agent (GET) or runs one (POST {"action": name}), answering with the
+// agent's structured result.
+func (s *Server) handleAgentActions(w http.ResponseWriter, r *http.Request) {
+	agent := s.liveAgentOr404(w, r)
+	if agent == nil {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		available := []quickAction{}
+		for _, qa := range quickActions {
+			if slices.Contains(qa.Platforms, agent.OS) {
+				available = append(available, qa)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(available) //nolint:errcheck
+
+	case http.MethodPost:
+		var body struct {
+			Action string `json:"action"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, `{"error":"action required"}`, http.StatusBadRequest)
+			return
+		}
+		i := slices.IndexFunc(quickActions, func(qa quickAction) bool { return qa.Name == body.Action })
+		if i < 0 {
+			http.Error(w, `{"error":"unknown action"}`, http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(quickActions[i].Platforms, agent.OS) {
+			http.Error(w, `{"error":"action not available on this agent's platform"}`, http.StatusBadRequest)
+			return
+		}
+
+		req := protocol.ActionRequest{ID: security.NewID(), Action: body.Action}
+		var res protocol.ActionResult
+		if !agent.callOrFail(r.Context(), w, "action_request", req.ID, req, &res) {
+			return
+		}
+
+		s.recordQuickAction(security.APIKeyFromContext(r.Context()), agent, req.Action, &res)
+
+		w.Header().Set("Content-Type", "application/json")
+		if res.Error != "" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		json.NewEncoder(w).Encode(res) //nolint:errcheck
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// recordQuickAction audits a quick action run on agent.
+func (s *Server) recordQuickAction(apiKey *store.APIKey, agent *LiveAgent, action string, res *protocol.ActionResult) {
+	detail := "action=" + action
+	if res.Error != "" {
+		detail += fmt.Sprintf(" error=%q", res.Error)
+	}
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditQuickAction,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   agent.ID,
+		Detail:    detail,
+	})
+	log.Printf("Agent %s: quick action %s by %s", agent.Name, action, apiKey.Name)
+}
+
+// bulkActionResult is one agent's outcome in a bulk quick action's
+// operation result.
+type bulkActionResult struct {
+	AgentID string                 `json:"agent_id"`
+	Name    string                 `json:"name,omitempty"`
+	Result  *protocol.ActionResult `json:"result,omitempty"`
+	Error   string                 `json:"error,omitempty"` // the agent could not run it
+}
+
+// handleBulkActions runs a quick action on several agents (POST
+// {"action", "agent_ids"}) as an operation, whose result lists each
+// agent's outcome. Agents that are offline or on another platform are
+// listed with an error.
+func (s *Server) handleBulkActions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Action   string   `json:"action"`
+		AgentIDs []string `json:"agent_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, `{"error":"action and agent_ids required"}`, http.StatusBadRequest)
+		return
+	}
+	i := slices.IndexFunc(quickActions, func(qa quickAction) bool { return qa.Name == body.Action })
+	if i < 0 {
+		http.Error(w, `{"error":"unknown action"}`, http.StatusBadRequest)
+		return
+	}
+	platforms := quickActions[i].Platforms
+	slices.Sort(body.AgentIDs)
+	body.AgentIDs = slices.Compact(body.AgentIDs)
+	if len(body.AgentIDs) == 0 || len(body.AgentIDs) > maxBulkActionAgents {
+		http.Error(w, fmt.Sprintf(`{"error":"agent_ids must list 1-%d agents"}`, maxBulkActionAgents), http.StatusBadRequest)
+		return
+	}
+
+	apiKey := security.APIKeyFromContext(r.Context())
+	rec, err := s.startOperation(operationQuickAction, apiKey, func(ctx context.Context, op *operation) (any, error) {
+		results := make([]bulkActionResult, len(body.AgentIDs))
+		var done atomic.Int64
+		sem := make(chan struct{}, bulkActionConcurrency)
+		var wg sync.WaitGroup
+		for i, id := range body.AgentIDs {
+			res := &results[i]
+			res.AgentID = id
+			s.mu.RLock()
+			agent := s.agents[id]
+			s.mu.RUnlock()
+			switch {
+			case agent == nil:
+				res.Error = "agent not connected"
+			case !slices.Contains(platforms, agent.OS):
+				res.Name, res.Error = agent.Name, "action not available on this agent's platform"
+			}
+			if res.Error != "" {
+				done.Add(1)
+				continue
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				wg.Wait()
+				return nil, ctx.Err()
+			}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				res.Name = agent.Name
+				req := protocol.ActionRequest{ID: security.NewID(), Action: body.Action}
+				var ar protocol.ActionResult
+				if err := agent.call(ctx, "action_request", req.ID, req, &ar); err != nil {
+					res.Error = "agent unreachable"
+					if errors.Is(err, errAgentTimeout) {
+						res.Error = "agent did not respond"
+					}
+				} else {
+					res.Result = &ar
+					s.recordQuickAction(apiKey, agent, body.Action, &ar)
+				}
+				n := done.Add(1)
+				op.progress(int(n*100/int64(len(results))), fmt.Sprintf("%d of %d agents done", n, len(results)))
+			}()
+		}
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return results, nil
+	})
+	writeOperation(w, rec, err)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+	"github.com/avaropoint/rmm/internal/version"
+)
+
+const (
+	// operationBackup is the kind of operations that back the database
+	// up.
+	operationBackup = "backup"
+
+	auditDatabaseBackedUp = "database_backed_up"
+	auditReleaseSigned    = "release_signed"
+)
+
+// adminAPI serves the local administration API over a Unix domain socket.
+// Access control is delegated to filesystem permissions on the socket
+// (owner-only), so no API key is required. This lets an operator on the
+// server host recover from a lost admin key.
+type adminAPI struct {
+	srv     *Server
+	dataDir string
+}
+
+// listenPrivate listens on the Unix socket at path, owner-only from the
+// moment the path exists: the socket is bound in a fresh 0700 directory
+// beside path, restricted to 0600 there and only then renamed into place,
+// so no other local user can connect while it still has the umask's
+// permissions. On Windows file modes do not restrict AF_UNIX sockets,
+// so the socket is only as private as the directory's ACL.
+func listenPrivate(path string) (net.Listener, error) {
+	if runtime.GOOS == "windows" {
+		return net.Listen("unix", path)
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".admin-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+	tmp := filepath.Join(dir, "admin.sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// The bound name moves; the next start removes the stale socket.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// serveAdminSocket listens on the Unix socket at path and serves the admin
+// API until the listener fails. Any stale socket file is removed first.
+func serveAdminSocket(path string, srv *Server, dataDir string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	_ = os.Remove(path)
+
+	ln, err := listenPrivate(path)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", path, err)
+	}
+
+	api := &adminAPI{srv: srv, dataDir: dataDir}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/status", api.handleStatus)
+	mux.HandleFunc("/admin/keys", api.handleKeys)
+	mux.HandleFunc("/admin/backup", api.handleBackup)
+	mux.HandleFunc("/admin/reload", api.handleReload)
+	mux.HandleFunc("/admin/escrow", api.handleEscrow)
+	mux.HandleFunc("/admin/sign", api.handleSign)
+
+	log.Printf("Admin socket: %s", path)
+	return http.Serve(ln, mux)
+}
+
+// handleStatus reports server identity and live connection counts.
+func (a *adminAPI) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enrolled, err := a.srv.store.ListAgents(r.Context())
+	if err != nil {
+		http.Error(w, `{"error":"failed to list agents"}`, http.StatusInternalServerError)
+		return
+	}
+
+	a.srv.mu.RLock()
+	online, viewers := len(a.srv.agents), len(a.srv.viewers)
+	a.srv.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+		"version":        version.Version,
+		"build_time":     version.BuildTime,
+		"platform":       a.srv.platform.Fingerprint(),
+		"started_at":     a.srv.startedAt,
+		"uptime_seconds": int64(time.Since(a.srv.startedAt).Seconds()),
+		"agents_online":  online,
+		"agents_total":   len(enrolled),
+		"viewers":        viewers,
+	})
+}
+
+// handleKeys lists, creates, and deletes API keys. New keys are admin
+// keys unless the request names another role.
+func (a *adminAPI) handleKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := a.srv.store.ListAPIKeys(r.Context())
+		if err != nil {
+			http.Error(w, `{"error":"failed to list keys"}`, http.StatusInternalServerError)
+			return
+		}
+		if keys == nil {
+			keys = []*store.APIKey{}
+		}
+		json.NewEncoder(w).Encode(keys) //nolint:errcheck
+
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			http.Error(w, `{"error":"name required"}`, http.StatusBadRequest)
+			return
+		}
+		if req.Role != "" && !validRole(req.Role) {
+			http.Error(w, `{"error":"role must be admin, technician or auditor"}`, http.StatusBadRequest)
+			return
+		}
+		apiKey, rawKey, err := security.GenerateAPIKey(req.Name)
+		if err != nil {
+			http.Error(w, `{"error":"failed to generate key"}`, http.StatusInternalServerError)
+			return
+		}
+		if req.Role != "" {
+			apiKey.Role = req.Role
+		}
+		if err := a.srv.store.CreateAPIKey(r.Context(), apiKey); err != nil {
+			http.Error(w, `{"error":"failed to store key"}`, http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Admin socket: API key created: %s (%s, %s)", apiKey.Name, apiKey.Prefix, apiKey.Role)
+		json.NewEncoder(w).Encode(map[string]string{ //nolint:errcheck
+			"id":   apiKey.ID,
+			"name": apiKey.Name,
+			"role": apiKey.Role,
+			"key":  rawKey,
+		})
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, `{"error":"id required"}`, http.StatusBadRequest)
+			return
+		}
+		if err := a.srv.store.DeleteAPIKey(r.Context(), id); err != nil {
+			http.Error(w, `{"error":"failed to delete"}`, http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Admin socket: API key deleted: %s", id)
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"}) //nolint:errcheck
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleBackup writes a consistent snapshot of the database. The target
+// defaults to <data>/backups/platform-<timestamp>.db.
+func (a *adminAPI) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+
+	if req.Path == "" {
+		var err error
+		if req.Path, err = newBackupPath(filepath.Join(a.dataDir, "backups")); err != nil {
+			http.Error(w, `{"error":"failed to create backup directory"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := a.srv.store.Backup(r.Context(), req.Path); err != nil {
+		log.Printf("Admin socket: backup failed: %v", err)
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Admin socket: database backed up to %s", req.Path)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"path": req.Path}) //nolint:errcheck
+}
+
+// newBackupPath creates dir if need be and returns a new backup's path
+// in it, platform-<timestamp>.db.
+func newBackupPath(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "platform-"+time.Now().UTC().Format("20060102-150405")+".db"), nil
+}
+
+// handleBackup backs the database up to <data>/backups as an operation,
+// whose result is the backup's path and size. Admin keys only.
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	if apiKey.Role != store.RoleAdmin {
+		http.Error(w, `{"error":"backing up the database requires an admin key"}`, http.StatusForbidden)
+		return
+	}
+	rec, err := s.startOperation(operationBackup, apiKey, func(ctx context.Context, op *operation) (any, error) {
+		path, err := newBackupPath(s.backupDir)
+		if err != nil {
+			return nil, err
+		}
+		op.progress(0, "writing "+filepath.Base(path))
+		if err := s.store.Backup(ctx, path); err != nil {
+			_ = os.Remove(path)
+			return nil, err
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Database backed up to %s by %s", path, apiKey.Name)
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditDatabaseBackedUp,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail:    fmt.Sprintf("path=%s size=%d", path, fi.Size()),
+		})
+		return map[string]any{"path": path, "size": fi.Size()}, nil
+	})
+	writeOperation(w, rec, err)
+}
+
+// handleReload reloads the config file and certificate (see reload.go).
+func (a *adminAPI) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pending, err := a.srv.reload("", "admin socket")
+	writeReload(w, pending, err)
+}
+
+// handleEscrow returns the platform key encrypted under the recovery
+// passphrase in the request, as a code for -restore-platform (see
+// escrow.go).
+func (a *adminAPI) handleEscrow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Passphrase string `json:"passphrase"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"passphrase required"}`, http.StatusBadRequest)
+		return
+	}
+	code, err := a.srv.platform.Escrow(req.Passphrase)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Admin socket: platform key escrow exported")
+	a.srv.recordAudit(&store.AuditEvent{
+		Action:    auditPlatformEscrowed,
+		ActorName: "admin socket",
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{ //nolint:errcheck
+		"platform": a.srv.platform.Fingerprint(),
+		"code":     code,
+	})
+}
+
+// handleSign signs an agent binary, given its SHA-256 as hex, with the
+// platform key (see protocol.ReleaseDigest). The reply carries the
+// signature and the platform's public key, both base64, the latter for
+// building agents that check their own binary.
+func (a *adminAPI) handleSign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		SHA256 string `json:"sha256"`
+		Name   string `json:"name"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	sum, err := hex.DecodeString(req.SHA256)
+	if err != nil || len(sum) != sha256.Size {
+		http.Error(w, `{"error":"sha256 must be a hex SHA-256 digest"}`, http.StatusBadRequest)
+		return
+	}
+	sig := a.srv.platform.Sign(protocol.ReleaseDigest(sum))
+
+	log.Printf("Admin socket: signed release %s (%s)", req.Name, req.SHA256)
+	a.srv.recordAudit(&store.AuditEvent{
+		Action:    auditReleaseSigned,
+		ActorName: "admin socket",
+		Detail:    fmt.Sprintf("name=%q sha256=%s", req.Name, req.SHA256),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{ //nolint:errcheck
+		"signature":    base64.StdEncoding.EncodeToString(sig),
+		"platform_key": base64.StdEncoding.EncodeToString(a.srv.platform.PublicKey),
+	})
+}
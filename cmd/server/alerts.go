@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Alerting: rules of a given type are evaluated against every connected
+// agent they cover. An alert is raised once a rule's condition has held
+// for the rule's for_minutes, and resolved when the condition clears.
+
+// alertTick is how often rules are evaluated.
+const alertTick = 30 * time.Second
+
+const (
+	eventAlertRaised   = "alert.raised"
+	eventAlertResolved = "alert.resolved"
+)
+
+// alertCondition reports whether an agent currently meets a rule's
+// condition, and the message for an alert raised from it.
+type alertCondition func(a *LiveAgent, rule *store.AlertRule) (bool, string)
+
+// alertConditions maps each rule type to its condition.
+var alertConditions = map[string]alertCondition{
+	store.AlertRebootRequired: func(a *LiveAgent, _ *store.AlertRule) (bool, string) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if !a.RebootRequired {
+			return false, ""
+		}
+		msg := "Reboot required"
+		if len(a.RebootReasons) > 0 {
+			msg += " (" + strings.Join(a.RebootReasons, ", ") + ")"
+		}
+		return true, msg
+	},
+	store.AlertCPUHigh: func(a *LiveAgent, rule *store.AlertRule) (bool, string) {
+		a.mu.Lock()
+		cpu := a.CPUPercent
+		a.mu.Unlock()
+		return cpu >= rule.Threshold, fmt.Sprintf("CPU at %.0f%%", cpu)
+	},
+	store.AlertMemoryLow: func(a *LiveAgent, rule *store.AlertRule) (bool, string) {
+		a.mu.Lock()
+		free := a.MemoryFree
+		a.mu.Unlock()
+		return freeBelow(free, a.MemoryTotal, rule.Threshold, "memory")
+	},
+	store.AlertDiskLow: func(a *LiveAgent, rule *store.AlertRule) (bool, string) {
+		a.mu.Lock()
+		free := a.DiskFree
+		a.mu.Unlock()
+		return freeBelow(free, a.DiskTotal, rule.Threshold, "disk")
+	},
+	store.AlertTimeDrift: func(a *LiveAgent, rule *store.AlertRule) (bool, string) {
+		a.mu.Lock()
+		drift, ts := a.ClockDriftMS, a.TimeSync
+		a.mu.Unlock()
+		if drift == nil {
+			return false, "" // agent predates clock reports
+		}
+		secs := float64(*drift) / 1000
+		dir := "ahead"
+		if secs < 0 {
+			dir = "behind"
+		}
+		msg := fmt.Sprintf("Clock %.0f s %s", math.Abs(secs), dir)
+		switch {
+		case ts == nil:
+		case !ts.Enabled:
+			msg += " (time sync disabled)"
+		case !ts.Synchronized:
+			msg += " (time sync not synchronized)"
+		}
+		return math.Abs(secs) >= rule.Threshold, msg
+	},
+	store.AlertPluginCritical: func(a *LiveAgent, _ *store.AlertRule) (bool, string) {
+		var failing []string
+		for _, res := range a.pluginResults() {
+			if res.Status == protocol.PluginCritical {
+				failing = append(failing, res.Plugin)
+			}
+		}
+		if len(failing) == 0 {
+			return false, ""
+		}
+		return true, "Plugin critical: " + strings.Join(failing, ", ")
+	},
+}
+
+// thresholdRules are the rule types that compare against a threshold,
+// a percentage except for time_drift; rules of these types must set one.
+var thresholdRules = map[string]bool{
+	store.AlertCPUHigh:   true,
+	store.AlertMemoryLow: true,
+	store.AlertDiskLow:   true,
+	store.AlertTimeDrift: true,
+}
+
+// freeBelow reports whether free is at most pct percent of total. Agents
+// that reported no total never match.
+func freeBelow(free, total uint64, pct float64, what string) (bool, string) {
+	if total == 0 {
+		return false, ""
+	}
+	share := float64(free) / float64(total) * 100
+	return share <= pct, fmt.Sprintf("Free %s at %.0f%% (%.1f GiB)", what, share, float64(free)/(1<<30))
+}
+
+// alertState tracks how long each rule's condition has held per agent.
+// It is in memory only, so a server restart restarts the for_minutes
+// clock.
+type alertState struct {
+	mu    sync.Mutex
+	since map[string]time.Time // keyed by rule ID + "/" + agent ID
+}
+
+// handleAlertRules lists (GET) or creates (POST) alert rules.
+func (s *Server) handleAlertRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rules, err := s.store.ListAlertRules(r.Context())
+		if err != nil {
+			http.Error(w, `{"error":"failed to list rules"}`, http.StatusInternalServerError)
+			return
+		}
+		if rules == nil {
+			rules = []*store.AlertRule{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rules) //nolint:errcheck
+
+	case http.MethodPost:
+		var req struct {
+			Name       string  `json:"name"`
+			Type       string  `json:"type"`
+			AgentID    string  `json:"agent_id"`
+			ForMinutes int     `json:"for_minutes"`
+			Threshold  float64 `json:"threshold"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		if _, ok := alertConditions[req.Type]; !ok {
+			http.Error(w, `{"error":"unknown rule type"}`, http.StatusBadRequest)
+			return
+		}
+		if req.ForMinutes < 0 {
+			http.Error(w, `{"error":"for_minutes must not be negative"}`, http.StatusBadRequest)
+			return
+		}
+		switch {
+		case !thresholdRules[req.Type]:
+			req.Threshold = 0
+		case req.Type == store.AlertTimeDrift:
+			if req.Threshold <= 0 {
+				http.Error(w, `{"error":"threshold must be a positive number of seconds"}`, http.StatusBadRequest)
+				return
+			}
+		case req.Threshold <= 0 || req.Threshold > 100:
+			http.Error(w, `{"error":"threshold must be a percentage between 0 and 100"}`, http.StatusBadRequest)
+			return
+		}
+		if req.AgentID != "" {
+			if rec, err := s.store.GetAgent(r.Context(), req.AgentID); err != nil || rec == nil {
+				http.Error(w, `{"error":"agent not found"}`, http.StatusNotFound)
+				return
+			}
+		}
+		if req.Name == "" {
+			req.Name = req.Type
+		}
+
+		apiKey := security.APIKeyFromContext(r.Context())
+		rule := &store.AlertRule{
+			ID:         security.NewID(),
+			Name:       req.Name,
+			Type:       req.Type,
+			AgentID:    req.AgentID,
+			ForMinutes: req.ForMinutes,
+			Threshold:  req.Threshold,
+			CreatedBy:  apiKey.Name,
+			CreatedAt:  time.Now(),
+		}
+		if err := s.store.CreateAlertRule(r.Context(), rule); err != nil {
+			http.Error(w, `{"error":"failed to create rule"}`, http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditAlertRuleCreated,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			AgentID:   rule.AgentID,
+			Detail:    fmt.Sprintf("rule=%s type=%s for_minutes=%d threshold=%g", rule.ID, rule.Type, rule.ForMinutes, rule.Threshold),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule) //nolint:errcheck
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAlertRule deletes a rule and resolves its open alerts.
+func (s *Server) handleAlertRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rule, err := s.store.GetAlertRule(r.Context(), r.PathValue("id"))
+	if err != nil || rule == nil {
+		http.Error(w, `{"error":"rule not found"}`, http.StatusNotFound)
+		return
+	}
+	if err := s.store.DeleteAlertRule(r.Context(), rule.ID); err != nil {
+		http.Error(w, `{"error":"failed to delete rule"}`, http.StatusInternalServerError)
+		return
+	}
+	open, _ := s.store.ListAlerts(r.Context(), store.AlertFilter{RuleID: rule.ID, Open: true, Limit: math.MaxInt32})
+	for _, a := range open {
+		s.resolveAlert(a)
+	}
+
+	apiKey := security.APIKeyFromContext(r.Context())
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditAlertRuleDeleted,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   rule.AgentID,
+		Detail:    fmt.Sprintf("rule=%s type=%s", rule.ID, rule.Type),
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListAlerts returns alerts, newest first, filtered by ?agent=,
+// ?rule=, ?open=1 and ?limit=.
+func (s *Server) handleListAlerts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := store.AlertFilter{
+		AgentID: q.Get("agent"),
+		RuleID:  q.Get("rule"),
+		Open:    q.Get("open") == "1",
+	}
+	filter.Limit, _ = strconv.Atoi(q.Get("limit"))
+
+	alerts, err := s.store.ListAlerts(r.Context(), filter)
+	if err != nil {
+		http.Error(w, `{"error":"failed to list alerts"}`, http.StatusInternalServerError)
+		return
+	}
+	if alerts == nil {
+		alerts = []*store.Alert{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts) //nolint:errcheck
+}
+
+// runAlerts evaluates alert rules until the server shuts down.
+func (s *Server) runAlerts() {
+	ticker := time.NewTicker(alertTick)
+	defer ticker.Stop()
+	for s.tick(ticker) {
+		s.evaluateAlerts(nil)
+	}
+}
+
+// evaluateAlerts raises and resolves alerts for the connected agents, or
+// just for only when it is non-nil (after a heartbeat brought new health
+// figures). Offline and stale agents are skipped, leaving their alerts as
+// they were.
+func (s *Server) evaluateAlerts(only *LiveAgent) {
+	var agents []*LiveAgent
+	filter := store.AlertFilter{Open: true, Limit: math.MaxInt32}
+	if only != nil {
+		agents = []*LiveAgent{only}
+		filter.AgentID = only.ID
+	} else {
+		s.mu.RLock()
+		for _, a := range s.agents {
+			agents = append(agents, a)
+		}
+		s.mu.RUnlock()
+	}
+
+	// Reading open alerts under st.mu keeps concurrent evaluations from
+	// raising the same alert twice.
+	st := &s.alerts
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	ctx := s.ctx
+	rules, err := s.store.ListAlertRules(ctx)
+	if err != nil {
+		log.Printf("Alert rules: %v", err)
+		return
+	}
+	open, err := s.store.ListAlerts(ctx, filter)
+	if err != nil {
+		log.Printf("Open alerts: %v", err)
+		return
+	}
+	openBy := make(map[string]*store.Alert, len(open))
+	for _, a := range open {
+		openBy[a.RuleID+"/"+a.AgentID] = a
+	}
+
+	if st.since == nil {
+		st.since = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for _, rule := range rules {
+		cond := alertConditions[rule.Type]
+		if cond == nil {
+			continue
+		}
+		for _, agent := range agents {
+			if rule.AgentID != "" && rule.AgentID != agent.ID {
+				continue
+			}
+			if agent.status().Status == agentStale {
+				continue
+			}
+			key := rule.ID + "/" + agent.ID
+			firing, msg := cond(agent, rule)
+			if !firing {
+				delete(st.since, key)
+				if a := openBy[key]; a != nil {
+					s.resolveAlert(a)
+				}
+				continue
+			}
+			since, ok := st.since[key]
+			if !ok {
+				since = now
+				st.since[key] = now
+			}
+			if openBy[key] != nil || now.Sub(since) < time.Duration(rule.ForMinutes)*time.Minute {
+				continue
+			}
+			alert := &store.Alert{
+				ID:       security.NewID(),
+				RuleID:   rule.ID,
+				Type:     rule.Type,
+				AgentID:  agent.ID,
+				Message:  msg,
+				RaisedAt: now,
+			}
+			if err := s.store.CreateAlert(ctx, alert); err != nil {
+				log.Printf("Alert for %s: %v", agent.Name, err)
+				continue
+			}
+			log.Printf("Alert raised for %s: %s", agent.Name, msg)
+			s.publishEvent(eventAlertRaised, agent.ID, alert)
+			go s.openTickets(alert, agent.Name)
+		}
+	}
+}
+
+// resolveAlert closes an open alert and publishes the change.
+func (s *Server) resolveAlert(a *store.Alert) {
+	now := time.Now()
+	if err := s.store.ResolveAlert(context.Background(), a.ID, now); err != nil {
+		log.Printf("Resolve alert %s: %v", a.ID, err)
+		return
+	}
+	a.ResolvedAt = &now
+	s.publishEvent(eventAlertResolved, a.AgentID, a)
+	go s.noteAlertTickets(a.ID, ticketContent{
+		Subject:   "Alert resolved",
+		AgentID:   a.AgentID,
+		AlertType: a.Type,
+		Text:      fmt.Sprintf("Alert resolved at %s: %s\n", now.UTC().Format(time.RFC3339), a.Message),
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Four-eyes approval: an unattended session to a sensitive agent (one
+// marked sensitive in its settings, or in a group the sensitive policy
+// names) waits, before capture starts, for an admin key other than the
+// operator's to approve it. The request goes out on the event stream and
+// to the policy's notification channels, and the viewer is told it is
+// pending; a request nobody decides within the policy's window lapses.
+// Attended sessions are exempt, since the local user's consent is the
+// second pair of eyes. Requests are kept in memory; every request,
+// decision and lapse is audited.
+
+const (
+	auditSessionApprovalRequested = "session_approval_requested"
+	auditSessionApprovalApproved  = "session_approval_approved"
+	auditSessionApprovalDenied    = "session_approval_denied"
+	auditSessionApprovalExpired   = "session_approval_expired"
+
+	eventSessionApproval = "session.approval"
+)
+
+// Session approval states.
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalDenied   = "denied"
+	approvalExpired  = "expired"
+)
+
+// sessionApproval is an unattended session waiting for a second admin.
+type sessionApproval struct {
+	ID            string     `json:"id"`
+	SessionID     string     `json:"session_id"`
+	AgentID       string     `json:"agent_id"`
+	AgentName     string     `json:"agent_name"`
+	RequestedByID string     `json:"requested_by_id"`
+	RequestedBy   string     `json:"requested_by"`
+	Status        string     `json:"status"`
+	DecidedBy     string     `json:"decided_by,omitempty"`
+	RequestedAt   time.Time  `json:"requested_at"`
+	DecidedAt     *time.Time `json:"decided_at,omitempty"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+
+	decided chan bool // receives the decision
+}
+
+// isSensitive reports whether sessions to agent need four-eyes approval.
+func (s *Server) isSensitive(agent *LiveAgent) bool {
+	agent.mu.Lock()
+	sensitive, orgID, site := agent.Sensitive, agent.OrgID, agent.Site
+	agent.mu.Unlock()
+	return sensitive || s.config().Sensitive.covers(orgID, site)
+}
+
+// requestApproval asks for a second admin's approval of session and
+// blocks until one decides or the policy's window passes. The viewer is
+// told the request is pending, and told again if it is not approved.
+func (s *Server) requestApproval(agent *LiveAgent, viewer protocol.Conn, tracker *inputTracker) bool {
+	policy := s.config().Sensitive
+	now := time.Now()
+	a := &sessionApproval{
+		ID:            security.NewID(),
+		SessionID:     tracker.session.ID,
+		AgentID:       agent.ID,
+		AgentName:     agent.Name,
+		RequestedByID: tracker.session.APIKeyID,
+		RequestedBy:   tracker.session.APIKeyName,
+		Status:        approvalPending,
+		RequestedAt:   now,
+		ExpiresAt:     now.Add(policy.window()),
+		decided:       make(chan bool, 1),
+	}
+	s.approvalsMu.Lock()
+	s.approvals[a.ID] = a
+	pending := *a
+	s.approvalsMu.Unlock()
+
+	s.recordAudit(tracker.event(auditSessionApprovalRequested, now, "approval="+a.ID))
+	s.publishEvent(eventSessionApproval, agent.ID, &pending)
+	if len(policy.Notify) > 0 {
+		go func() {
+			_, err := s.notify(policy.Notify, notification{
+				Subject: fmt.Sprintf("Session to %s awaits approval", agent.Name),
+				Text: fmt.Sprintf("%s wants to open an unattended session to %s, which is marked sensitive.\n\n"+
+					"Approve it with POST /api/session-approvals/%s/approve before %s, or deny it with .../deny.\n",
+					pending.RequestedBy, agent.Name, a.ID, a.ExpiresAt.UTC().Format(time.RFC1123)),
+			})
+			if err != nil {
+				log.Printf("Session approval %s: notification failed: %v", a.ID, err)
+			}
+		}()
+	}
+	writeViewerStatus(viewer, "approval_pending", "")
+
+	approved, lapsed := false, false
+	select {
+	case approved = <-a.decided:
+	case <-time.After(time.Until(a.ExpiresAt)):
+		lapsed = true
+	}
+
+	s.approvalsMu.Lock()
+	delete(s.approvals, a.ID)
+	if lapsed && a.Status == approvalPending {
+		a.Status = approvalExpired
+	} else {
+		lapsed = false // decided as the window closed
+		approved = a.Status == approvalApproved
+	}
+	final := *a
+	s.approvalsMu.Unlock()
+
+	if lapsed {
+		s.recordAudit(tracker.event(auditSessionApprovalExpired, time.Now(), "approval="+a.ID))
+		s.publishEvent(eventSessionApproval, agent.ID, &final)
+	}
+	if !approved {
+		reason := "a second admin denied the session"
+		if lapsed {
+			reason = "no second admin approved the session in time"
+		}
+		writeViewerStatus(viewer, "approval_denied", reason)
+	}
+	return approved
+}
+
+// handleSessionApprovals lists the sessions awaiting approval, oldest
+// first. Keys other than admin keys see their own.
+func (s *Server) handleSessionApprovals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	list := []sessionApproval{}
+	s.approvalsMu.Lock()
+	for _, a := range s.approvals {
+		if a.Status == approvalPending && (apiKey.Role == store.RoleAdmin || a.RequestedByID == apiKey.ID) {
+			list = append(list, *a)
+		}
+	}
+	s.approvalsMu.Unlock()
+	slices.SortFunc(list, func(a, b sessionApproval) int { return a.RequestedAt.Compare(b.RequestedAt) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list) //nolint:errcheck
+}
+
+// handleSessionApprovalDecision approves or denies a waiting session
+// (POST /api/session-approvals/{id}/approve or /deny). It takes an admin
+// key other than the operator's.
+func (s *Server) handleSessionApprovalDecision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, action := approvalApproved, auditSessionApprovalApproved
+	switch r.PathValue("decision") {
+	case "approve":
+	case "deny":
+		status, action = approvalDenied, auditSessionApprovalDenied
+	default:
+		http.Error(w, `{"error":"decision must be approve or deny"}`, http.StatusNotFound)
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	if apiKey.Role != store.RoleAdmin {
+		http.Error(w, `{"error":"approving a session requires an admin key"}`, http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	s.approvalsMu.Lock()
+	a := s.approvals[r.PathValue("id")]
+	var errMsg string
+	var code int
+	switch {
+	case a == nil:
+		errMsg, code = "approval request not found", http.StatusNotFound
+	case a.Status != approvalPending:
+		errMsg, code = "session already "+a.Status, http.StatusConflict
+	case a.RequestedByID == apiKey.ID:
+		errMsg, code = "a session must be approved by another key", http.StatusForbidden
+	default:
+		a.Status, a.DecidedBy, a.DecidedAt = status, apiKey.Name, &now
+		a.decided <- status == approvalApproved
+	}
+	var decided sessionApproval
+	if errMsg == "" {
+		decided = *a
+	}
+	s.approvalsMu.Unlock()
+	if errMsg != "" {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, errMsg), code)
+		return
+	}
+
+	s.recordAudit(&store.AuditEvent{
+		Action:    action,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   decided.AgentID,
+		SessionID: decided.SessionID,
+		Detail:    fmt.Sprintf("approval=%s requested_by=%q", decided.ID, decided.RequestedBy),
+	})
+	s.publishEvent(eventSessionApproval, decided.AgentID, &decided)
+	log.Printf("Session to agent %s by %s %s by %s", decided.AgentName, decided.RequestedBy, decided.Status, apiKey.Name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&decided) //nolint:errcheck
+}
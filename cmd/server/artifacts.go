@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Package repository: installers (MSI, PKG, DEB) uploaded to the server
+// are kept under <data>/artifacts and staged on agents over their file
+// channel when a deployment names them, so agents on locked-down networks
+// need no route to a vendor's CDN.
+
+const (
+	auditArtifactUploaded = "artifact_uploaded"
+	auditArtifactDeleted  = "artifact_deleted"
+)
+
+// artifactKinds maps installer file extensions to their format.
+var artifactKinds = map[string]string{
+	".deb": protocol.ManagerDeb,
+	".pkg": protocol.ManagerPkg,
+	".msi": protocol.ManagerMSI,
+}
+
+// artifactPath is where an artifact's content is kept.
+func (s *Server) artifactPath(id string) string {
+	return filepath.Join(s.artifactDir, id)
+}
+
+// handleArtifacts lists the repository (GET) or uploads an installer
+// (POST ?name=, with the content as the raw request body). An optional
+// ?sha256= is checked against the upload.
+func (s *Server) handleArtifacts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		artifacts, err := s.store.ListArtifacts(r.Context())
+		if err != nil {
+			http.Error(w, `{"error":"failed to list artifacts"}`, http.StatusInternalServerError)
+			return
+		}
+		if artifacts == nil {
+			artifacts = []*store.Artifact{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(artifacts) //nolint:errcheck
+	case http.MethodPost:
+		s.uploadArtifact(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// uploadArtifact stores an uploaded installer, checking it against the
+// transfer size limit for installers.
+func (s *Server) uploadArtifact(w http.ResponseWriter, r *http.Request) {
+	name, ok := dropboxName(r.URL.Query().Get("name"))
+	kind := artifactKinds[strings.ToLower(filepath.Ext(name))]
+	if !ok || kind == "" {
+		http.Error(w, `{"error":"name ending in .msi, .pkg or .deb required"}`, http.StatusBadRequest)
+		return
+	}
+	want := strings.ToLower(r.URL.Query().Get("sha256"))
+	limit := s.config().TransferPolicy.limit(protocol.FilePurposePackage)
+	if limit == 0 {
+		http.Error(w, `{"error":"installers disabled by transfer policy"}`, http.StatusForbidden)
+		return
+	}
+	if r.ContentLength > limit {
+		http.Error(w, `{"error":"file exceeds the transfer size limit"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := os.MkdirAll(s.artifactDir, 0700); err != nil {
+		http.Error(w, `{"error":"failed to store file"}`, http.StatusInternalServerError)
+		return
+	}
+	tmp, err := os.CreateTemp(s.artifactDir, ".upload-*")
+	if err != nil {
+		http.Error(w, `{"error":"failed to store file"}`, http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // no-op once renamed
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), http.MaxBytesReader(w, r.Body, limit))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, `{"error":"file exceeds the transfer size limit"}`, http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, `{"error":"upload failed"}`, http.StatusBadRequest)
+		return
+	case size == 0:
+		http.Error(w, `{"error":"empty file"}`, http.StatusBadRequest)
+		return
+	case want != "" && want != digest:
+		http.Error(w, fmt.Sprintf(`{"error":"SHA-256 mismatch: received %s"}`, digest), http.StatusBadRequest)
+		return
+	}
+
+	apiKey := security.APIKeyFromContext(r.Context())
+	a := &store.Artifact{
+		ID:        security.NewID(),
+		Name:      name,
+		Kind:      kind,
+		Size:      size,
+		SHA256:    digest,
+		CreatedBy: apiKey.Name,
+		CreatedAt: time.Now(),
+	}
+	err = os.Rename(tmp.Name(), s.artifactPath(a.ID))
+	if err == nil {
+		err = s.store.CreateArtifact(r.Context(), a)
+	}
+	if err != nil {
+		_ = os.Remove(s.artifactPath(a.ID))
+		http.Error(w, `{"error":"failed to store file"}`, http.StatusInternalServerError)
+		return
+	}
+
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditArtifactUploaded,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		Detail:    fmt.Sprintf("artifact=%s name=%q size=%d sha256=%s", a.ID, a.Name, a.Size, a.SHA256),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a) //nolint:errcheck
+}
+
+// handleArtifact returns an artifact's metadata (GET) or deletes it
+// (DELETE). An artifact still waiting to be installed by a deployment
+// cannot be deleted.
+func (s *Server) handleArtifact(w http.ResponseWriter, r *http.Request) {
+	a, err := s.store.GetArtifact(r.Context(), r.PathValue("id"))
+	if err != nil || a == nil {
+		http.Error(w, `{"error":"artifact not found"}`, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a) //nolint:errcheck
+
+	case http.MethodDelete:
+		s.deployMu.Lock()
+		inUse, err := s.artifactInUse(r.Context(), a.ID)
+		if err == nil && !inUse {
+			err = s.store.DeleteArtifact(r.Context(), a.ID)
+		}
+		s.deployMu.Unlock()
+		switch {
+		case err != nil:
+			http.Error(w, `{"error":"failed to delete artifact"}`, http.StatusInternalServerError)
+			return
+		case inUse:
+			http.Error(w, `{"error":"artifact is used by a deployment in progress"}`, http.StatusConflict)
+			return
+		}
+		_ = os.Remove(s.artifactPath(a.ID))
+		apiKey := security.APIKeyFromContext(r.Context())
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditArtifactDeleted,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail:    fmt.Sprintf("artifact=%s name=%q", a.ID, a.Name),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// artifactInUse reports whether a deployment has yet to install the
+// artifact on some agent. Callers hold deployMu.
+func (s *Server) artifactInUse(ctx context.Context, id string) (bool, error) {
+	checked := make(map[string]bool)
+	for _, status := range []string{store.DeploymentPending, store.DeploymentRunning} {
+		results, err := s.store.ListDeploymentResults(ctx, store.DeploymentResultFilter{Status: status})
+		if err != nil {
+			return false, err
+		}
+		for _, res := range results {
+			if checked[res.DeploymentID] {
+				continue
+			}
+			checked[res.DeploymentID] = true
+			d, err := s.store.GetDeployment(ctx, res.DeploymentID)
+			if err != nil {
+				return false, err
+			}
+			if d != nil && d.ArtifactID == id {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// verifyEnrollAttestation checks the optional key binding sent with an
+// enrollment request. The agent proves possession of its key by signing
+// the enrollment code. This is not attestation: nothing proves the key is
+// resident in a TPM, since the endorsement key is never checked. With
+// -require-key-binding, enrollments without a key are refused.
+func (s *Server) verifyEnrollAttestation(code string, att *protocol.Attestation) error {
+	if att == nil {
+		if s.requireKeyBinding {
+			return errors.New("TPM key binding required")
+		}
+		return nil
+	}
+	if att.Type != protocol.AttestationTPM2 {
+		return fmt.Errorf("unsupported key binding type: %s", att.Type)
+	}
+	return security.VerifyAttestation(att.PublicKey, protocol.AttestationEnrollDigest(code), att.Signature)
+}
+
+// challengeAgent sends a fresh nonce to a key-bound agent and verifies the
+// signature it returns against the key recorded at enrollment. It runs
+// under the registration read deadline.
+func (s *Server) challengeAgent(conn protocol.Conn, agent *store.AgentRecord) error {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	payload, _ := json.Marshal(protocol.Challenge{Nonce: base64.StdEncoding.EncodeToString(nonce)})
+	msg, _ := json.Marshal(protocol.Message{Type: "challenge", Payload: payload})
+	if err := conn.WriteFrame(protocol.OpText, msg); err != nil {
+		return err
+	}
+
+	opcode, data, err := conn.ReadFrame()
+	if err != nil {
+		return err
+	}
+	if opcode != protocol.OpText {
+		return errors.New("unexpected frame")
+	}
+	var m protocol.Message
+	if err := json.Unmarshal(data, &m); err != nil || m.Type != "challenge_response" {
+		return errors.New("no challenge response")
+	}
+	var resp protocol.ChallengeResponse
+	if err := json.Unmarshal(m.Payload, &resp); err != nil {
+		return errors.New("malformed challenge response")
+	}
+
+	return security.VerifyAttestation(agent.AttestationKey,
+		protocol.AttestationChallengeDigest(nonce, agent.ID), resp.Signature)
+}
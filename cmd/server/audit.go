@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// controlIdleTimeout is how long a viewer may go without injecting input
+// before control is considered released. The next input event opens a new
+// control period.
+const controlIdleTimeout = 60 * time.Second
+
+// Audit actions recorded for remote-control sessions and enrollment.
+const (
+	auditViewerConnected       = "viewer_connected"
+	auditViewerDisconnected    = "viewer_disconnected"
+	auditSessionTicket         = "session_ticket_issued"
+	auditSessionTicketRejected = "session_ticket_rejected"
+	auditControlTaken          = "control_taken"
+	auditControlReleased       = "control_released"
+	auditEnrollmentMismatch    = "enrollment_hostname_mismatch"
+	auditEnrollmentRejected    = "enrollment_rejected"
+	auditAttestationFailed     = "attestation_failed"
+	auditConsentGranted        = "consent_granted"
+	auditConsentDenied         = "consent_denied"
+	auditSessionEndedLocally   = "session_ended_locally"
+	auditAgentSettings         = "agent_settings_changed"
+	auditAgentDeleted          = "agent_deleted"
+	auditFileUpload            = "file_upload"
+	auditFileRejected          = "file_rejected"
+	auditDropboxQueued         = "dropbox_queued"
+	auditDropboxCanceled       = "dropbox_canceled"
+	auditDropboxDelivered      = "dropbox_delivered"
+	auditDropboxFailed         = "dropbox_failed"
+	auditDropboxExpired        = "dropbox_expired"
+	auditScreenshotSchedule    = "screenshot_schedule_set"
+	auditScreenshotUnschedule  = "screenshot_schedule_deleted"
+	auditAlertRuleCreated      = "alert_rule_created"
+	auditAlertRuleDeleted      = "alert_rule_deleted"
+	auditPowerAction           = "power_action"
+	auditPermissionsRequested  = "permissions_requested"
+	auditReportGenerated       = "report_generated"
+	auditReportScheduleCreated = "report_schedule_created"
+	auditReportScheduleDeleted = "report_schedule_deleted"
+	auditOrgCreated            = "org_created"
+	auditOrgDeleted            = "org_deleted"
+	auditIntegrationCreated    = "integration_created"
+	auditIntegrationUpdated    = "integration_updated"
+	auditIntegrationDeleted    = "integration_deleted"
+	auditOrgStatus             = "org_status_page"
+	auditPrintStatus           = "print_status"
+	auditRegistryRead          = "registry_read"
+	auditRegistryWrite         = "registry_write"
+	auditRegistryDenied        = "registry_denied"
+	auditStartupDisabled       = "startup_item_disabled"
+	auditFSDenied              = "fs_denied" // fs_mkdir, fs_delete, fs_rename use the command name
+)
+
+// recordAudit persists an audit event and mirrors it to the server log.
+func (s *Server) recordAudit(ev *store.AuditEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if err := s.store.CreateAuditEvent(context.Background(), ev); err != nil {
+		log.Printf("Audit write failed: %v", err)
+	}
+	s.forwardAudit(ev)
+	log.Printf("AUDIT %s actor=%s agent=%s session=%s %s",
+		ev.Action, ev.ActorName, ev.AgentID, ev.SessionID, ev.Detail)
+}
+
+// inputTracker follows one viewer session's input stream, counting events
+// and emitting control taken/released audit events.
+type inputTracker struct {
+	srv       *Server
+	session   *store.ViewerSession
+	inControl bool
+	since     time.Time // start of the current control period
+	lastInput time.Time
+	periodKey int64 // key events in the current control period
+	periodMse int64 // mouse events in the current control period
+	dropped   int64 // input messages discarded by the rate limit
+}
+
+// observe records one input message. Control periods separated by more
+// than controlIdleTimeout are audited individually; the release is
+// timestamped at the last input of the previous period.
+func (t *inputTracker) observe(payload json.RawMessage) {
+	var in struct {
+		Kind string `json:"kind"`
+	}
+	if json.Unmarshal(payload, &in) != nil {
+		return
+	}
+
+	now := time.Now()
+	if t.inControl && now.Sub(t.lastInput) > controlIdleTimeout {
+		t.release(t.lastInput)
+	}
+	if !t.inControl {
+		t.inControl = true
+		t.since = now
+		t.srv.recordAudit(t.event(auditControlTaken, now, ""))
+	}
+	t.lastInput = now
+
+	switch in.Kind {
+	case "key", "text":
+		t.session.KeyEvents++
+		t.periodKey++
+	case "mouse", "touch":
+		t.session.MouseEvents++
+		t.periodMse++
+	}
+}
+
+// release closes the current control period, if any.
+func (t *inputTracker) release(at time.Time) {
+	if !t.inControl {
+		return
+	}
+	detail := "key_events=" + strconv.FormatInt(t.periodKey, 10) +
+		" mouse_events=" + strconv.FormatInt(t.periodMse, 10) +
+		" duration=" + at.Sub(t.since).Round(time.Second).String()
+	t.srv.recordAudit(t.event(auditControlReleased, at, detail))
+	t.inControl = false
+	t.periodKey, t.periodMse = 0, 0
+}
+
+func (t *inputTracker) event(action string, at time.Time, detail string) *store.AuditEvent {
+	return &store.AuditEvent{
+		Time:      at,
+		Action:    action,
+		ActorID:   t.session.APIKeyID,
+		ActorName: t.session.APIKeyName,
+		AgentID:   t.session.AgentID,
+		SessionID: t.session.ID,
+		Detail:    detail,
+	}
+}
+
+// handleListViewerSessions returns recent remote-control sessions,
+// optionally filtered by ?agent=<id>.
+func (s *Server) handleListViewerSessions(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	sessions, err := s.store.ListViewerSessions(r.Context(), r.URL.Query().Get("agent"), limit)
+	if err != nil {
+		http.Error(w, `{"error":"failed to list sessions"}`, http.StatusInternalServerError)
+		return
+	}
+	if sessions == nil {
+		sessions = []*store.ViewerSession{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions) //nolint:errcheck
+}
+
+// handleListAuditEvents returns audit events filtered by ?agent=,
+// ?session=, ?since= (RFC 3339) and ?limit=.
+func (s *Server) handleListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := store.AuditFilter{
+		AgentID:   q.Get("agent"),
+		SessionID: q.Get("session"),
+	}
+	filter.Limit, _ = strconv.Atoi(q.Get("limit"))
+	if since := q.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, `{"error":"since must be RFC 3339"}`, http.StatusBadRequest)
+			return
+		}
+		filter.Since = t
+	}
+
+	events, err := s.store.ListAuditEvents(r.Context(), filter)
+	if err != nil {
+		http.Error(w, `{"error":"failed to list audit events"}`, http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []*store.AuditEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events) //nolint:errcheck
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Branding: an organization can white-label the product with a name, a
+// logo and two colors. The dashboard, which loads before anyone signs in,
+// looks its branding up by the host name it is served under, so each
+// tenant gets its own look at its own domain; agents get the product name
+// of their organization for their dialogs and tray.
+
+const (
+	auditBrandingSet     = "branding_set"
+	auditBrandingDeleted = "branding_deleted"
+
+	// maxProductName bounds a branded product name.
+	maxProductName = 64
+	// maxLogoSize bounds an uploaded logo.
+	maxLogoSize = 256 << 10
+	// maxBrandingDomains bounds how many host names one organization's
+	// branding applies to.
+	maxBrandingDomains = 16
+)
+
+var (
+	brandingColor  = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+	brandingDomain = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+)
+
+// logoPath is where an organization's logo is kept.
+func (s *Server) logoPath(orgID string) string {
+	return filepath.Join(s.brandingDir, orgID)
+}
+
+// brandingRequest is the body of PUT /api/orgs/{id}/branding.
+type brandingRequest struct {
+	ProductName  string   `json:"product_name"`
+	PrimaryColor string   `json:"primary_color"`
+	AccentColor  string   `json:"accent_color"`
+	Domains      []string `json:"domains"`
+}
+
+// handleOrgBranding returns (GET), sets (PUT) or removes (DELETE) an
+// organization's branding. PUT replaces the name, colors and domains and
+// keeps any logo, which is uploaded separately.
+func (s *Server) handleOrgBranding(w http.ResponseWriter, r *http.Request) {
+	org, err := s.store.GetOrg(r.Context(), r.PathValue("id"))
+	if err != nil || org == nil {
+		http.Error(w, `{"error":"organization not found"}`, http.StatusNotFound)
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		b, err := s.store.GetBranding(r.Context(), org.ID)
+		if err != nil || b == nil {
+			http.Error(w, `{"error":"no branding"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b) //nolint:errcheck
+
+	case http.MethodPut:
+		var req brandingRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		b, err := s.store.GetBranding(r.Context(), org.ID)
+		if err != nil {
+			http.Error(w, `{"error":"failed to read branding"}`, http.StatusInternalServerError)
+			return
+		}
+		if b == nil {
+			b = &store.Branding{OrgID: org.ID}
+		}
+		if msg := s.applyBranding(r.Context(), b, req); msg != "" {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, msg), http.StatusBadRequest)
+			return
+		}
+		b.UpdatedBy, b.UpdatedAt = apiKey.Name, time.Now()
+		if err := s.store.SetBranding(r.Context(), b); err != nil {
+			http.Error(w, `{"error":"failed to save branding"}`, http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditBrandingSet,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail: fmt.Sprintf("org=%s product_name=%q primary=%s accent=%s domains=%s",
+				org.ID, b.ProductName, b.PrimaryColor, b.AccentColor, strings.Join(b.Domains, ",")),
+		})
+		s.pushBranding(org.ID, b)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b) //nolint:errcheck
+
+	case http.MethodDelete:
+		if err := s.store.DeleteBranding(r.Context(), org.ID); err != nil {
+			http.Error(w, `{"error":"failed to delete branding"}`, http.StatusInternalServerError)
+			return
+		}
+		_ = os.Remove(s.logoPath(org.ID))
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditBrandingDeleted,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail:    "org=" + org.ID,
+		})
+		s.pushBranding(org.ID, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// applyBranding validates req and copies it into b, returning a message
+// for the client when it is invalid. Colors are stored lowercase, and
+// domains as bare lowercase host names claimed by no other organization.
+func (s *Server) applyBranding(ctx context.Context, b *store.Branding, req brandingRequest) string {
+	name := strings.TrimSpace(req.ProductName)
+	if len(name) > maxProductName {
+		return fmt.Sprintf("product_name must be at most %d bytes", maxProductName)
+	}
+	if strings.ContainsFunc(name, unicode.IsControl) {
+		return "product_name must not contain control characters"
+	}
+	colors := [2]string{strings.ToLower(strings.TrimSpace(req.PrimaryColor)), strings.ToLower(strings.TrimSpace(req.AccentColor))}
+	for _, c := range colors {
+		if c != "" && !brandingColor.MatchString(c) {
+			return "colors must be #rrggbb"
+		}
+	}
+	if len(req.Domains) > maxBrandingDomains {
+		return fmt.Sprintf("at most %d domains", maxBrandingDomains)
+	}
+	var domains []string
+	for _, d := range req.Domains {
+		d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+		if !brandingDomain.MatchString(d) || len(d) > 253 {
+			return fmt.Sprintf("invalid domain %q: use a bare host name", d)
+		}
+		if !slices.Contains(domains, d) {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) > 0 {
+		others, err := s.store.ListBrandings(ctx)
+		if err != nil {
+			return "failed to check domains"
+		}
+		for _, o := range others {
+			if o.OrgID == b.OrgID {
+				continue
+			}
+			for _, d := range domains {
+				if slices.Contains(o.Domains, d) {
+					return fmt.Sprintf("domain %q is used by another organization", d)
+				}
+			}
+		}
+	}
+	b.ProductName, b.PrimaryColor, b.AccentColor, b.Domains = name, colors[0], colors[1], domains
+	return ""
+}
+
+// handleOrgBrandingLogo returns (GET), uploads (PUT, the PNG or JPEG
+// image as the body) or removes (DELETE) an organization's logo. SVG is
+// refused: the logo is served to visitors before sign-in, and SVG can
+// carry script.
+func (s *Server) handleOrgBrandingLogo(w http.ResponseWriter, r *http.Request) {
+	org, err := s.store.GetOrg(r.Context(), r.PathValue("id"))
+	if err != nil || org == nil {
+		http.Error(w, `{"error":"organization not found"}`, http.StatusNotFound)
+		return
+	}
+	b, err := s.store.GetBranding(r.Context(), org.ID)
+	if err != nil {
+		http.Error(w, `{"error":"failed to read branding"}`, http.StatusInternalServerError)
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		s.serveLogo(w, r, b)
+
+	case http.MethodPut:
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxLogoSize))
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			http.Error(w, fmt.Sprintf(`{"error":"logo exceeds %d KiB"}`, maxLogoSize>>10), http.StatusRequestEntityTooLarge)
+			return
+		case err != nil:
+			http.Error(w, `{"error":"upload failed"}`, http.StatusBadRequest)
+			return
+		}
+		logoType := http.DetectContentType(data)
+		if logoType != "image/png" && logoType != "image/jpeg" {
+			http.Error(w, `{"error":"logo must be a PNG or JPEG image"}`, http.StatusUnsupportedMediaType)
+			return
+		}
+		if err := os.MkdirAll(s.brandingDir, 0700); err != nil {
+			http.Error(w, `{"error":"failed to store logo"}`, http.StatusInternalServerError)
+			return
+		}
+		tmp, err := os.CreateTemp(s.brandingDir, ".upload-*")
+		if err != nil {
+			http.Error(w, `{"error":"failed to store logo"}`, http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(tmp.Name()) //nolint:errcheck // no-op once renamed
+		_, err = tmp.Write(data)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), s.logoPath(org.ID))
+		}
+		if err != nil {
+			http.Error(w, `{"error":"failed to store logo"}`, http.StatusInternalServerError)
+			return
+		}
+		if b == nil {
+			b = &store.Branding{OrgID: org.ID}
+		}
+		b.LogoType, b.UpdatedBy, b.UpdatedAt = logoType, apiKey.Name, time.Now()
+		if err := s.store.SetBranding(r.Context(), b); err != nil {
+			http.Error(w, `{"error":"failed to save branding"}`, http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditBrandingSet,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail:    fmt.Sprintf("org=%s logo=%s size=%d", org.ID, logoType, len(data)),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b) //nolint:errcheck
+
+	case http.MethodDelete:
+		if b == nil || b.LogoType == "" {
+			http.Error(w, `{"error":"no logo"}`, http.StatusNotFound)
+			return
+		}
+		b.LogoType, b.UpdatedBy, b.UpdatedAt = "", apiKey.Name, time.Now()
+		if err := s.store.SetBranding(r.Context(), b); err != nil {
+			http.Error(w, `{"error":"failed to save branding"}`, http.StatusInternalServerError)
+			return
+		}
+		_ = os.Remove(s.logoPath(org.ID))
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditBrandingSet,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail:    fmt.Sprintf("org=%s logo=none", org.ID),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveLogo writes b's logo, or 404 when there is none.
+func (s *Server) serveLogo(w http.ResponseWriter, r *http.Request, b *store.Branding) {
+	if b == nil || b.LogoType == "" {
+		http.Error(w, `{"error":"no logo"}`, http.StatusNotFound)
+		return
+	}
+	data, err := os.ReadFile(s.logoPath(b.OrgID))
+	if err != nil {
+		http.Error(w, `{"error":"no logo"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", b.LogoType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", b.UpdatedAt, bytes.NewReader(data))
+}
+
+// brandingForHost returns the branding whose domains include the host the
+// request was made to, or nil.
+func (s *Server) brandingForHost(r *http.Request) *store.Branding {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	brandings, err := s.store.ListBrandings(r.Context())
+	if err != nil {
+		return nil
+	}
+	for _, b := range brandings {
+		if slices.Contains(b.Domains, host) {
+			return b
+		}
+	}
+	return nil
+}
+
+// handlePublicBranding serves the dashboard's branding for the host it is
+// served under, without authentication: {"product_name", "primary_color",
+// "accent_color", "logo"}, or {} for the default look. Only what the
+// dashboard shows is returned.
+func (s *Server) handlePublicBranding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := map[string]string{}
+	if b := s.brandingForHost(r); b != nil {
+		for k, v := range map[string]string{
+			"product_name":  b.ProductName,
+			"primary_color": b.PrimaryColor,
+			"accent_color":  b.AccentColor,
+		} {
+			if v != "" {
+				resp[k] = v
+			}
+		}
+		if b.LogoType != "" {
+			resp["logo"] = fmt.Sprintf("/api/branding/logo?v=%d", b.UpdatedAt.Unix())
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Vary", "Host")
+	json.NewEncoder(w).Encode(resp) //nolint:errcheck
+}
+
+// handlePublicBrandingLogo serves the logo of the host's branding.
+func (s *Server) handlePublicBrandingLogo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Vary", "Host")
+	s.serveLogo(w, r, s.brandingForHost(r))
+}
+
+// agentBranding returns what agents of an organization are told of its
+// branding, or nil for the default look.
+func (s *Server) agentBranding(ctx context.Context, orgID string) *protocol.Branding {
+	if orgID == "" {
+		return nil
+	}
+	b, err := s.store.GetBranding(ctx, orgID)
+	if err != nil || b == nil || b.ProductName == "" {
+		return nil
+	}
+	return &protocol.Branding{ProductName: b.ProductName}
+}
+
+// pushBranding sends an organization's new branding (nil once removed) to
+// its connected agents.
+func (s *Server) pushBranding(orgID string, b *store.Branding) {
+	msg := protocol.Branding{}
+	if b != nil {
+		msg.ProductName = b.ProductName
+	}
+	var members []*LiveAgent
+	s.mu.RLock()
+	for _, a := range s.agents {
+		a.mu.Lock()
+		if a.OrgID == orgID {
+			members = append(members, a)
+		}
+		a.mu.Unlock()
+	}
+	s.mu.RUnlock()
+	for _, a := range members {
+		if err := a.send("branding", msg); err != nil {
+			log.Printf("Branding for %s: %v", a.Name, err)
+		}
+	}
+}
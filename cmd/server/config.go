@@ -0,0 +1,598 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Config holds optional server settings loaded from a JSON file (-config).
+// Every field has a working default, so the file may be omitted entirely.
+// Command-line flags take precedence over values from the file.
+type Config struct {
+	// Listen lists additional addresses to serve on alongside -addr,
+	// e.g. "[::]:8443" for IPv6 or "10.0.0.5:9443" for an internal
+	// admin interface. Each listener uses the same TLS mode as -addr.
+	Listen []string `json:"listen,omitempty"`
+
+	// HTTPRedirect is a plain-HTTP address (typically ":80") that
+	// redirects every request to HTTPS. In ACME mode it also answers
+	// HTTP-01 challenges and defaults to ":80".
+	HTTPRedirect string `json:"http_redirect,omitempty"`
+
+	// ACMEDomains are further domains to obtain Let's Encrypt certificates
+	// for, alongside the one given with -acme.
+	ACMEDomains []string `json:"acme_domains,omitempty"`
+
+	// ServerURLs lists the URLs agents may reach this deployment at, in
+	// order of preference, e.g. both servers of a pair sharing one
+	// database. Agents get the list at enrollment and registration, try
+	// the URLs in order and return to the first one once it is healthy.
+	// Empty means agents keep the URL they enrolled through.
+	ServerURLs []string `json:"server_urls,omitempty"`
+
+	// MDNS, when set, advertises the server on the local link so agents
+	// started with -discover local find it without a URL, for networks
+	// with no DNS.
+	MDNS *MDNSConfig `json:"mdns,omitempty"`
+
+	// AdminSocket is the Unix socket path for the local admin API used by
+	// rmmctl. Defaults to <data>/admin.sock; set to "-" to disable.
+	AdminSocket string `json:"admin_socket,omitempty"`
+
+	// RegistryPolicy allowlists the registry keys, defaults domains and
+	// gsettings schemas reachable through /api/agents/{id}/registry.
+	// Nothing is reachable when it is empty.
+	RegistryPolicy []PathRule `json:"registry_policy,omitempty"`
+
+	// FSPolicy allowlists the directories reachable through the file
+	// system API (/api/agents/{id}/fs). Nothing is reachable when it is
+	// empty.
+	FSPolicy []PathRule `json:"fs_policy,omitempty"`
+
+	// GatewayPolicy allowlists the hosts and ports agents may relay
+	// connections to through /ws/gateway. Nothing is reachable when it is
+	// empty.
+	GatewayPolicy []GatewayRule `json:"gateway_policy,omitempty"`
+
+	// HostConfigPolicy permits changes to agents' hosts files and system
+	// environment variables, which are read-only by default.
+	HostConfigPolicy HostConfigPolicy `json:"host_config_policy,omitempty"`
+
+	// TransferPolicy caps the size of file uploads to agents, from
+	// viewers and from the drop-box.
+	TransferPolicy TransferPolicy `json:"transfer_policy,omitempty"`
+
+	// Dropbox sets the quota and expiry for files queued for offline
+	// agents.
+	Dropbox DropboxPolicy `json:"dropbox,omitempty"`
+
+	// Recording records viewer sessions.
+	Recording RecordingPolicy `json:"recording,omitempty"`
+
+	// Watermark has agents draw the operator's name and the time onto
+	// the frames of every viewer session.
+	Watermark bool `json:"watermark,omitempty"`
+
+	// Sensitive names the groups of agents whose unattended sessions
+	// need a second admin's approval, besides agents marked sensitive one
+	// by one (see approvals.go).
+	Sensitive SensitivePolicy `json:"sensitive,omitempty"`
+
+	// InputRate caps the input messages a viewer session relays to its
+	// agent per second. Defaults to 500; negative disables the cap.
+	InputRate int `json:"input_rate,omitempty"`
+
+	// Quotas caps simultaneous agent connections, server-wide and per
+	// organization, and each organization's enrollment rate.
+	Quotas QuotaPolicy `json:"quotas,omitempty"`
+
+	// EnrollmentAlertAddresses is how many distinct client addresses an
+	// enrollment token may be tried from before an enrollment_anomaly
+	// alert is raised. Defaults to 3; negative disables the alert.
+	EnrollmentAlertAddresses int `json:"enrollment_alert_addresses,omitempty"`
+
+	// DisabledCapabilities locks capability classes ("input", "files",
+	// "shell", "gateway") off on every agent. Agents record them in their local
+	// config, so removing a class here does not re-enable it.
+	DisabledCapabilities []string `json:"disabled_capabilities,omitempty"`
+
+	// Notifications are the channels reports are delivered through,
+	// referred to by name.
+	Notifications []NotificationChannel `json:"notifications,omitempty"`
+
+	// SIEM lists the destinations audit events are forwarded to over
+	// syslog.
+	SIEM []SIEMDestination `json:"siem,omitempty"`
+
+	// Redis, when set, mirrors the event stream and agent presence to a
+	// Redis server for external consumers.
+	Redis *RedisConfig `json:"redis,omitempty"`
+
+	// Telemetry, when set, subscribes to an MQTT or NATS broker for the
+	// reports of telemetry-only agents (see telemetry.go).
+	Telemetry *TelemetryConfig `json:"telemetry,omitempty"`
+
+	// FIPS enforces FIPS 140-3 approved cryptography (see -fips). The
+	// server refuses to start if it cannot.
+	FIPS bool `json:"fips,omitempty"`
+
+	// LogLevel is "info" (the default) or "debug", which also logs every
+	// HTTP request and every message from agents.
+	LogLevel string `json:"log_level,omitempty"`
+
+	// WebSocket is the WebSocket implementation agent, viewer and gateway
+	// connections use: "native" (the default) or, in a server built with
+	// -tags gorilla, "gorilla" (see websocket.go).
+	WebSocket string `json:"websocket,omitempty"`
+
+	// HTTP2 is "on" (the default) to negotiate HTTP/2 over TLS, "off" to
+	// serve HTTP/1.1 only, or "h2c" to also accept cleartext HTTP/2 on
+	// plain-HTTP listeners (see http2.go).
+	HTTP2 string `json:"http2,omitempty"`
+
+	// SlowQueryMS is the store call latency, in milliseconds, above which
+	// calls are logged. Defaults to 250; negative disables the log.
+	SlowQueryMS int `json:"slow_query_ms,omitempty"`
+}
+
+// Log levels.
+const (
+	logInfo  = "info"
+	logDebug = "debug"
+)
+
+// webSocket returns the WebSocket backend's name.
+func (c *Config) webSocket() string {
+	if c.WebSocket == "" {
+		return backendNative
+	}
+	return c.WebSocket
+}
+
+// http2 returns the HTTP/2 setting.
+func (c *Config) http2() string {
+	if c.HTTP2 == "" {
+		return http2On
+	}
+	return c.HTTP2
+}
+
+// slowQuery returns the slow store call threshold, or 0 when disabled.
+func (c *Config) slowQuery() time.Duration {
+	switch {
+	case c.SlowQueryMS < 0:
+		return 0
+	case c.SlowQueryMS == 0:
+		return 250 * time.Millisecond
+	}
+	return time.Duration(c.SlowQueryMS) * time.Millisecond
+}
+
+// enrollAlertAddresses returns the distinct addresses a token may be
+// tried from before it raises an alert, or 0 when the alert is disabled.
+func (c *Config) enrollAlertAddresses() int {
+	switch {
+	case c.EnrollmentAlertAddresses < 0:
+		return 0
+	case c.EnrollmentAlertAddresses == 0:
+		return defaultEnrollAlertAddresses
+	}
+	return c.EnrollmentAlertAddresses
+}
+
+// inputRate returns the per-session input cap, or 0 for none.
+func (c *Config) inputRate() int {
+	switch {
+	case c.InputRate < 0:
+		return 0
+	case c.InputRate == 0:
+		return defaultInputRate
+	}
+	return c.InputRate
+}
+
+// RedisConfig locates the Redis server events and presence are published
+// to.
+type RedisConfig struct {
+	// URL is redis://[user:password@]host[:port][/db], or rediss:// for
+	// TLS.
+	URL string `json:"url"`
+	// Prefix namespaces the keys and channel. Defaults to "rmm".
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// TelemetryConfig is the broker telemetry-only agents publish to.
+type TelemetryConfig struct {
+	// URL is mqtt://[user:password@]host[:port], mqtts:// for TLS, or
+	// nats://[user:password@]host[:port]; a NATS server that requires
+	// TLS gets it.
+	URL string `json:"url"`
+	// Topic is the MQTT topic, or NATS subject, devices publish one
+	// level under. Defaults to "rmm/telemetry", or "rmm.telemetry" for
+	// NATS.
+	Topic string `json:"topic,omitempty"`
+	// CACert is a PEM file of CA certificates the broker's certificate
+	// is verified against, instead of the system's.
+	CACert string `json:"ca_cert,omitempty"`
+	// IntervalSeconds is how often devices report, which their status
+	// is judged by. Defaults to 60.
+	IntervalSeconds int `json:"interval_seconds,omitempty"`
+}
+
+// interval returns how often devices report.
+func (c *TelemetryConfig) interval() time.Duration {
+	if c.IntervalSeconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.IntervalSeconds) * time.Second
+}
+
+// MDNSConfig names the advertised service instance.
+type MDNSConfig struct {
+	// Name is the instance name agents list. Defaults to the host name.
+	Name string `json:"name,omitempty"`
+	// Interface restricts advertising to one network interface, e.g.
+	// "eth1". Defaults to the system's multicast interface.
+	Interface string `json:"interface,omitempty"`
+}
+
+// SIEMDestination is a syslog receiver audit events are forwarded to.
+type SIEMDestination struct {
+	Name    string `json:"name"`
+	Address string `json:"address"` // host:port
+
+	// Transport is "tls" (RFC 5425, the default), "tcp" or "udp".
+	Transport string `json:"transport,omitempty"`
+	// CACert is a PEM file of CA certificates the receiver's certificate
+	// is verified against, instead of the system's (tls).
+	CACert string `json:"ca_cert,omitempty"`
+
+	// Format is "rfc5424" (the event as structured data, the default),
+	// "cef" or "leef".
+	Format string `json:"format,omitempty"`
+	// AppName is the syslog APP-NAME. Defaults to "rmm".
+	AppName string `json:"app_name,omitempty"`
+
+	// Actions lists the audit actions forwarded; an entry ending in "*"
+	// matches a prefix, e.g. "recording_*". All are forwarded when it is
+	// empty.
+	Actions []string `json:"actions,omitempty"`
+}
+
+// transport, format and appName apply the defaults.
+func (d SIEMDestination) transport() string {
+	if d.Transport == "" {
+		return siemTLS
+	}
+	return d.Transport
+}
+
+func (d SIEMDestination) format() string {
+	if d.Format == "" {
+		return siemRFC5424
+	}
+	return d.Format
+}
+
+func (d SIEMDestination) appName() string {
+	if d.AppName == "" {
+		return "rmm"
+	}
+	return syslogToken(d.AppName, 48)
+}
+
+// admits reports whether the destination's filter forwards action.
+func (d SIEMDestination) admits(action string) bool {
+	if len(d.Actions) == 0 {
+		return true
+	}
+	for _, a := range d.Actions {
+		if prefix, ok := strings.CutSuffix(a, "*"); ok && strings.HasPrefix(action, prefix) || a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Notification channel types.
+const (
+	channelWebhook = "webhook"
+	channelEmail   = "email"
+)
+
+// NotificationChannel is a destination for server notifications.
+type NotificationChannel struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // "webhook" or "email"
+
+	// URL receives a JSON POST (webhook).
+	URL string `json:"url,omitempty"`
+	// Headers are added to webhook requests, e.g. an Authorization token.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// SMTP is the mail server as host:port (email). STARTTLS is used when
+	// the server offers it, and Username/Password authenticate with PLAIN.
+	SMTP     string   `json:"smtp,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+}
+
+// TransferPolicy limits uploads by their uncompressed size, in bytes.
+type TransferPolicy struct {
+	// MaxSize applies to every purpose without its own limit. Defaults
+	// to 64 MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+	// Purposes overrides MaxSize per purpose, e.g. {"print": 10485760}.
+	// A negative value disables that purpose.
+	Purposes map[string]int64 `json:"purposes,omitempty"`
+}
+
+// DropboxPolicy bounds the files held for delivery to offline agents.
+// The size of each file is limited by the transfer policy's "dropbox"
+// purpose.
+type DropboxPolicy struct {
+	// Quota is the total size of undelivered files per agent, in bytes.
+	// Defaults to 256 MiB.
+	Quota int64 `json:"quota,omitempty"`
+	// ExpiryHours is how long a file waits for its agent before it is
+	// discarded. Defaults to 168 (one week).
+	ExpiryHours int `json:"expiry_hours,omitempty"`
+}
+
+// quota and expiry apply the defaults.
+func (p DropboxPolicy) quota() int64 {
+	if p.Quota > 0 {
+		return p.Quota
+	}
+	return 256 << 20
+}
+
+func (p DropboxPolicy) expiry() time.Duration {
+	if p.ExpiryHours > 0 {
+		return time.Duration(p.ExpiryHours) * time.Hour
+	}
+	return 7 * 24 * time.Hour
+}
+
+// RecordingPolicy configures session recording. Recordings are kept for
+// RetentionDays, 90 by default, unless placed on legal hold.
+type RecordingPolicy struct {
+	Enabled       bool `json:"enabled,omitempty"`
+	RetentionDays int  `json:"retention_days,omitempty"`
+}
+
+// retention applies the default.
+func (p RecordingPolicy) retention() time.Duration {
+	if p.RetentionDays > 0 {
+		return time.Duration(p.RetentionDays) * 24 * time.Hour
+	}
+	return 90 * 24 * time.Hour
+}
+
+// SensitivePolicy configures four-eyes approval of unattended sessions.
+// Every agent in one of Orgs (organization IDs, "" for unassigned
+// agents) or at one of Sites is sensitive. Approval requests are also
+// sent to the Notify channels, and wait ApprovalSeconds, 300 by default,
+// for a decision.
+type SensitivePolicy struct {
+	Orgs            []string `json:"orgs,omitempty"`
+	Sites           []string `json:"sites,omitempty"`
+	Notify          []string `json:"notify,omitempty"`
+	ApprovalSeconds int      `json:"approval_seconds,omitempty"`
+}
+
+// covers reports whether the policy makes agents in orgID at site
+// sensitive.
+func (p SensitivePolicy) covers(orgID, site string) bool {
+	return slices.Contains(p.Orgs, orgID) || (site != "" && slices.Contains(p.Sites, site))
+}
+
+// window applies the default.
+func (p SensitivePolicy) window() time.Duration {
+	if p.ApprovalSeconds > 0 {
+		return time.Duration(p.ApprovalSeconds) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// limit returns the largest upload allowed for purpose, or 0 when the
+// purpose is disabled.
+func (p TransferPolicy) limit(purpose string) int64 {
+	if n, ok := p.Purposes[purpose]; ok {
+		return max(n, 0)
+	}
+	if p.MaxSize > 0 {
+		return p.MaxSize
+	}
+	return protocol.MaxFileSize
+}
+
+// QuotaPolicy caps agent connections and enrollments (see quotas.go).
+// Zero means no cap.
+type QuotaPolicy struct {
+	// MaxAgents caps simultaneous agent connections to this server.
+	MaxAgents int `json:"max_agents,omitempty"`
+	// MaxAgentsPerOrg caps each organization's simultaneous agent
+	// connections.
+	MaxAgentsPerOrg int `json:"max_agents_per_org,omitempty"`
+	// EnrollmentsPerHour caps each organization's enrollments in any
+	// hour.
+	EnrollmentsPerHour int `json:"enrollments_per_hour,omitempty"`
+	// Orgs overrides the per-organization caps by organization ID; ""
+	// is the unassigned agents.
+	Orgs map[string]OrgQuota `json:"orgs,omitempty"`
+}
+
+// OrgQuota is one organization's caps. Zero keeps the policy's default;
+// a negative value lifts the cap for the organization.
+type OrgQuota struct {
+	MaxAgents          int `json:"max_agents,omitempty"`
+	EnrollmentsPerHour int `json:"enrollments_per_hour,omitempty"`
+}
+
+// orgAgents and orgEnrollments return org's caps, 0 meaning none.
+func (p QuotaPolicy) orgAgents(org string) int {
+	return quotaFor(p.MaxAgentsPerOrg, p.Orgs[org].MaxAgents)
+}
+
+func (p QuotaPolicy) orgEnrollments(org string) int {
+	return quotaFor(p.EnrollmentsPerHour, p.Orgs[org].EnrollmentsPerHour)
+}
+
+// quotaFor applies an organization's override to the default cap.
+func quotaFor(def, override int) int {
+	switch {
+	case override < 0:
+		return 0
+	case override > 0:
+		return override
+	}
+	return def
+}
+
+// HostConfigPolicy permits changes through /api/agents/{id}/hosts and
+// /api/agents/{id}/environment.
+type HostConfigPolicy struct {
+	// HostsWrite allows replacing the hosts file.
+	HostsWrite bool `json:"hosts_write,omitempty"`
+	// Environment lists the system environment variables that may be set
+	// or removed, matched case-insensitively; "*" allows any.
+	Environment []string `json:"environment,omitempty"`
+}
+
+// envWritable reports whether the policy allows changing variable name.
+func (p HostConfigPolicy) envWritable(name string) bool {
+	for _, allowed := range p.Environment {
+		if allowed == "*" || strings.EqualFold(allowed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// PathRule grants access to one path and everything below it.
+type PathRule struct {
+	// Path is a registry key (HKLM\SOFTWARE\Vendor), defaults domain
+	// (com.apple.screensaver) or gsettings schema
+	// (org.gnome.desktop.interface) in registry_policy, and an absolute
+	// directory (/srv/share, C:\Users\Public) in fs_policy.
+	Path string `json:"path"`
+	// Write allows changes; rules are read-only by default.
+	Write bool `json:"write,omitempty"`
+}
+
+// GatewayRule allows gateway streams to one host or network.
+type GatewayRule struct {
+	// Host is an IP address, a CIDR network (10.0.5.0/24) or a host name,
+	// which must then be requested by that name.
+	Host string `json:"host"`
+	// Ports lists the reachable ports. Defaults to 5900 (VNC) and 3389
+	// (RDP).
+	Ports []int `json:"ports,omitempty"`
+}
+
+// loadServerConfig reads a Config from path. An empty path yields the
+// zero Config.
+func loadServerConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for _, ch := range cfg.Notifications {
+		switch {
+		case ch.Name == "" || seen[ch.Name]:
+			return nil, fmt.Errorf("%s: notification channels need unique names", path)
+		case ch.Type == channelWebhook && ch.URL == "":
+			return nil, fmt.Errorf("%s: webhook channel %q needs a url", path, ch.Name)
+		case ch.Type == channelEmail && (ch.SMTP == "" || ch.From == "" || len(ch.To) == 0):
+			return nil, fmt.Errorf("%s: email channel %q needs smtp, from and to", path, ch.Name)
+		case ch.Type != channelWebhook && ch.Type != channelEmail:
+			return nil, fmt.Errorf("%s: channel %q has unknown type %q", path, ch.Name, ch.Type)
+		}
+		seen[ch.Name] = true
+	}
+	for _, name := range cfg.Sensitive.Notify {
+		if !seen[name] {
+			return nil, fmt.Errorf("%s: sensitive policy notifies unknown channel %q", path, name)
+		}
+	}
+	seen = make(map[string]bool)
+	for _, d := range cfg.SIEM {
+		switch {
+		case d.Name == "" || seen[d.Name]:
+			return nil, fmt.Errorf("%s: siem destinations need unique names", path)
+		case d.Address == "":
+			return nil, fmt.Errorf("%s: siem destination %q needs an address", path, d.Name)
+		case d.transport() != siemTLS && d.transport() != siemTCP && d.transport() != siemUDP:
+			return nil, fmt.Errorf("%s: siem destination %q has unknown transport %q", path, d.Name, d.Transport)
+		case d.format() != siemRFC5424 && d.format() != siemCEF && d.format() != siemLEEF:
+			return nil, fmt.Errorf("%s: siem destination %q has unknown format %q", path, d.Name, d.Format)
+		}
+		seen[d.Name] = true
+	}
+	for i, raw := range cfg.ServerURLs {
+		u, err := url.Parse(strings.TrimRight(raw, "/"))
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("%s: server url %q must be an http or https URL", path, raw)
+		}
+		cfg.ServerURLs[i] = u.String()
+	}
+	if cfg.MDNS != nil && cfg.MDNS.Interface != "" {
+		if _, err := net.InterfaceByName(cfg.MDNS.Interface); err != nil {
+			return nil, fmt.Errorf("%s: mdns interface %q: %w", path, cfg.MDNS.Interface, err)
+		}
+	}
+	for _, rule := range cfg.GatewayPolicy {
+		if rule.Host == "" {
+			return nil, fmt.Errorf("%s: gateway rules need a host", path)
+		}
+		for _, port := range rule.Ports {
+			if port < 1 || port > 65535 {
+				return nil, fmt.Errorf("%s: gateway rule %q has invalid port %d", path, rule.Host, port)
+			}
+		}
+	}
+	if q := cfg.Quotas; q.MaxAgents < 0 || q.MaxAgentsPerOrg < 0 || q.EnrollmentsPerHour < 0 {
+		return nil, fmt.Errorf("%s: quotas cannot be negative", path)
+	}
+	if cfg.LogLevel != "" && cfg.LogLevel != logInfo && cfg.LogLevel != logDebug {
+		return nil, fmt.Errorf("%s: log_level must be %q or %q", path, logInfo, logDebug)
+	}
+	for _, c := range cfg.DisabledCapabilities {
+		if !protocol.ValidCapability(c) {
+			return nil, fmt.Errorf("%s: unknown capability class %q", path, c)
+		}
+	}
+	if _, ok := webSocketBackends[cfg.webSocket()]; !ok {
+		return nil, fmt.Errorf("%s: websocket backend %q is not built in (have %s)", path, cfg.WebSocket, webSocketBackendNames())
+	}
+	if cfg.Telemetry != nil {
+		if _, err := newTelemetryBroker(cfg.Telemetry); err != nil {
+			return nil, fmt.Errorf("%s: telemetry: %w", path, err)
+		}
+	}
+	switch cfg.http2() {
+	case http2On, http2Off, http2H2C:
+	default:
+		return nil, fmt.Errorf("%s: http2 must be %q, %q or %q", path, http2On, http2Off, http2H2C)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// consentTimeout is how long the local user has to answer a consent
+// prompt before the request is treated as denied.
+const consentTimeout = 60 * time.Second
+
+// requestConsent asks the agent's local user to approve a viewer and
+// blocks until they answer or consentTimeout passes. The viewer is told
+// the request is pending, and told again if it is denied. Only one prompt
+// may be outstanding per agent. The prompt says so when the session will
+// be recorded.
+func (s *Server) requestConsent(agent *LiveAgent, viewer protocol.Conn, requester string) bool {
+	ch := make(chan bool, 1)
+
+	agent.mu.Lock()
+	if agent.consent != nil {
+		agent.mu.Unlock()
+		writeViewerStatus(viewer, "consent_denied", "another consent request is pending")
+		return false
+	}
+	agent.consent = ch
+	payload, _ := json.Marshal(map[string]interface{}{
+		"requester": requester,
+		"timeout":   int(consentTimeout / time.Second),
+		"recording": s.config().Recording.Enabled,
+	})
+	req, _ := json.Marshal(protocol.Message{Type: "consent_request", Payload: payload})
+	err := agent.conn.WriteFrame(protocol.OpText, req)
+	agent.mu.Unlock()
+
+	granted := false
+	if err == nil {
+		writeViewerStatus(viewer, "consent_pending", "")
+		select {
+		case granted = <-ch:
+		case <-time.After(consentTimeout):
+		}
+	}
+
+	agent.mu.Lock()
+	agent.consent = nil
+	agent.mu.Unlock()
+
+	if !granted {
+		writeViewerStatus(viewer, "consent_denied", "the user declined or did not respond")
+	}
+	return granted
+}
+
+// resolveConsent delivers the agent's answer to a pending consent request.
+func (a *LiveAgent) resolveConsent(granted bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.consent != nil {
+		select {
+		case a.consent <- granted:
+		default:
+		}
+	}
+}
+
+// writeViewerStatus sends a control message to a viewer WebSocket.
+func writeViewerStatus(viewer protocol.Conn, msgType, reason string) {
+	var payload json.RawMessage
+	if reason != "" {
+		payload, _ = json.Marshal(map[string]string{"reason": reason})
+	}
+	msg, _ := json.Marshal(protocol.Message{Type: msgType, Payload: payload})
+	_ = viewer.WriteFrame(protocol.OpText, msg)
+}
+
+// handleAgentSettings updates per-agent settings: whether unattended
+// access (capture without consent) is allowed, the organization the
+// agent is metered under ("" unassigns it), its site, the viewer
+// permissions sessions on it are limited to (an empty list lifts the
+// limit), and whether it is sensitive (see approvals.go), which takes an
+// admin key. Omitted settings are left unchanged.
+func (s *Server) handleAgentSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Unattended        *bool     `json:"unattended"`
+		OrgID             *string   `json:"org_id"`
+		Site              *string   `json:"site"`
+		ViewerPermissions *[]string `json:"viewer_permissions"`
+		Sensitive         *bool     `json:"sensitive"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+		(req.Unattended == nil && req.OrgID == nil && req.Site == nil && req.ViewerPermissions == nil && req.Sensitive == nil) {
+		http.Error(w, `{"error":"unattended, org_id, site, viewer_permissions or sensitive required"}`, http.StatusBadRequest)
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	// Each of these loosens or tightens what every session to the agent
+	// needs: consent, a second admin, or the permission mask.
+	if (req.Unattended != nil || req.Sensitive != nil || req.ViewerPermissions != nil) && apiKey.Role != store.RoleAdmin {
+		http.Error(w, `{"error":"changing unattended, sensitive or viewer_permissions requires an admin key"}`, http.StatusForbidden)
+		return
+	}
+	var perms []string
+	if req.ViewerPermissions != nil && len(*req.ViewerPermissions) > 0 {
+		var ok bool
+		perms, ok = parsePermissions(*req.ViewerPermissions)
+		if !ok || !slices.Contains(perms, protocol.PermView) {
+			http.Error(w, `{"error":"viewer_permissions must include view and name only view, input, files or terminal"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	if req.OrgID != nil && !s.orgExists(r.Context(), *req.OrgID) {
+		http.Error(w, `{"error":"organization not found"}`, http.StatusBadRequest)
+		return
+	}
+
+	id := r.PathValue("id")
+	rec, err := s.store.GetAgent(r.Context(), id)
+	if err != nil || rec == nil {
+		http.Error(w, `{"error":"agent not found"}`, http.StatusNotFound)
+		return
+	}
+	var changes []string
+	if req.Unattended != nil {
+		if err := s.store.SetAgentUnattended(r.Context(), id, *req.Unattended); err != nil {
+			http.Error(w, `{"error":"failed to update agent"}`, http.StatusInternalServerError)
+			return
+		}
+		rec.Unattended = *req.Unattended
+		changes = append(changes, fmt.Sprintf("unattended=%t", rec.Unattended))
+	}
+	if req.OrgID != nil {
+		if err := s.store.SetAgentOrg(r.Context(), id, *req.OrgID); err != nil {
+			http.Error(w, `{"error":"failed to update agent"}`, http.StatusInternalServerError)
+			return
+		}
+		rec.OrgID = *req.OrgID
+		changes = append(changes, "org="+rec.OrgID)
+	}
+	if req.Site != nil {
+		site := strings.TrimSpace(*req.Site)
+		if err := s.store.SetAgentSite(r.Context(), id, site); err != nil {
+			http.Error(w, `{"error":"failed to update agent"}`, http.StatusInternalServerError)
+			return
+		}
+		rec.Site = site
+		changes = append(changes, fmt.Sprintf("site=%q", rec.Site))
+	}
+	if req.ViewerPermissions != nil {
+		if err := s.store.SetAgentViewerPermissions(r.Context(), id, perms); err != nil {
+			http.Error(w, `{"error":"failed to update agent"}`, http.StatusInternalServerError)
+			return
+		}
+		rec.ViewerPermissions = perms
+		if perms == nil {
+			changes = append(changes, "viewer_permissions=any")
+		} else {
+			changes = append(changes, "viewer_permissions="+permissionList(perms))
+		}
+	}
+	if req.Sensitive != nil {
+		if err := s.store.SetAgentSensitive(r.Context(), id, *req.Sensitive); err != nil {
+			http.Error(w, `{"error":"failed to update agent"}`, http.StatusInternalServerError)
+			return
+		}
+		rec.Sensitive = *req.Sensitive
+		changes = append(changes, fmt.Sprintf("sensitive=%t", rec.Sensitive))
+	}
+
+	s.mu.RLock()
+	live, online := s.agents[id]
+	if online {
+		live.mu.Lock()
+		live.Unattended, live.OrgID, live.Site = rec.Unattended, rec.OrgID, rec.Site
+		live.ViewerPermissions, live.Sensitive = rec.ViewerPermissions, rec.Sensitive
+		live.mu.Unlock()
+	}
+	s.mu.RUnlock()
+	if online && req.OrgID != nil {
+		// The agent takes on its new organization's branding.
+		b := s.agentBranding(r.Context(), rec.OrgID)
+		if b == nil {
+			b = &protocol.Branding{}
+		}
+		_ = live.send("branding", b)
+	}
+
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditAgentSettings,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   id,
+		Detail:    strings.Join(changes, " "),
+	})
+	log.Printf("Agent %s: settings %s", id, strings.Join(changes, " "))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+		"id":                 id,
+		"unattended":         rec.Unattended,
+		"org_id":             rec.OrgID,
+		"site":               rec.Site,
+		"viewer_permissions": rec.ViewerPermissions,
+		"sensitive":          rec.Sensitive,
+	})
+}
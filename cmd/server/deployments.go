@@ -0,0 +1,549 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Software deployments: install or remove a package with apt, Homebrew or
+// Chocolatey, or install an installer from the package repository (see
+// artifacts.go), on a list of agents or a group (an organization and/or a
+// site). Targets are fixed when the deployment is created; the server
+// sends each its request as it comes online, at most max_concurrent at a
+// time, and records the package manager's exit code and output.
+
+const (
+	// deploymentTick is how often pending and running results are
+	// checked.
+	deploymentTick = 15 * time.Second
+
+	// deploymentAnswerGrace is how long past its timeout the server waits
+	// for an agent's result before failing it.
+	deploymentAnswerGrace = 2 * time.Minute
+
+	// Deployment defaults and bounds.
+	defaultDeploymentExpiry = 72 // hours
+	maxDeploymentExpiry     = 30 * 24
+	maxDeploymentList       = 100
+
+	auditDeploymentCreated  = "deployment_created"
+	auditDeploymentCanceled = "deployment_canceled"
+	auditDeploymentResult   = "deployment_result"
+
+	eventDeploymentStarted   = "deployment.started"
+	eventDeploymentSucceeded = "deployment.succeeded"
+	eventDeploymentFailed    = "deployment.failed"
+)
+
+// deploymentSummary is a deployment with the number of its results in
+// each state.
+type deploymentSummary struct {
+	*store.Deployment
+	Counts map[string]int `json:"counts"`
+}
+
+// handleDeployments lists recent deployments (GET, ?limit=) or creates
+// one (POST).
+func (s *Server) handleDeployments(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit <= 0 || limit > maxDeploymentList {
+			limit = maxDeploymentList
+		}
+		deployments, err := s.store.ListDeployments(r.Context(), limit)
+		if err != nil {
+			http.Error(w, `{"error":"failed to list deployments"}`, http.StatusInternalServerError)
+			return
+		}
+		summaries := make([]deploymentSummary, 0, len(deployments))
+		for _, d := range deployments {
+			results, err := s.store.ListDeploymentResults(r.Context(), store.DeploymentResultFilter{DeploymentID: d.ID})
+			if err != nil {
+				http.Error(w, `{"error":"failed to list deployments"}`, http.StatusInternalServerError)
+				return
+			}
+			counts := make(map[string]int)
+			for _, res := range results {
+				counts[res.Status]++
+			}
+			summaries = append(summaries, deploymentSummary{Deployment: d, Counts: counts})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summaries) //nolint:errcheck
+
+	case http.MethodPost:
+		var req struct {
+			Manager       string   `json:"manager"`
+			Action        string   `json:"action"`
+			Package       string   `json:"package"`
+			Version       string   `json:"version"`
+			ArtifactID    string   `json:"artifact_id"`
+			AgentIDs      []string `json:"agent_ids"`
+			OrgID         string   `json:"org_id"`
+			Site          string   `json:"site"`
+			Timeout       int      `json:"timeout_minutes"`
+			MaxConcurrent int      `json:"max_concurrent"`
+			Expiry        int      `json:"expires_hours"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		apiKey := security.APIKeyFromContext(r.Context())
+		now := time.Now()
+		d := &store.Deployment{
+			ID:            security.NewID(),
+			Manager:       strings.ToLower(req.Manager),
+			Action:        req.Action,
+			Package:       req.Package,
+			Version:       req.Version,
+			ArtifactID:    req.ArtifactID,
+			OrgID:         req.OrgID,
+			Site:          strings.TrimSpace(req.Site),
+			Timeout:       req.Timeout,
+			MaxConcurrent: req.MaxConcurrent,
+			CreatedBy:     apiKey.Name,
+			CreatedAt:     now,
+		}
+		for _, id := range req.AgentIDs {
+			if !slices.Contains(d.AgentIDs, id) {
+				d.AgentIDs = append(d.AgentIDs, id)
+			}
+		}
+		if d.Action == "" {
+			d.Action = protocol.SoftwareInstall
+		}
+		if d.ArtifactID != "" {
+			a, err := s.store.GetArtifact(r.Context(), d.ArtifactID)
+			if err != nil || a == nil {
+				http.Error(w, `{"error":"artifact not found"}`, http.StatusBadRequest)
+				return
+			}
+			if d.Manager != "" && d.Manager != a.Kind || d.Package != "" || d.Version != "" {
+				http.Error(w, `{"error":"artifact_id cannot be combined with manager, package or version"}`, http.StatusBadRequest)
+				return
+			}
+			d.Manager, d.Package = a.Kind, a.Name
+		}
+		if d.Timeout == 0 {
+			d.Timeout = protocol.DefaultSoftwareTimeout / 60
+		}
+		if req.Expiry == 0 {
+			req.Expiry = defaultDeploymentExpiry
+		}
+		if req.Expiry < 1 || req.Expiry > maxDeploymentExpiry {
+			http.Error(w, fmt.Sprintf(`{"error":"expires_hours must be 1-%d"}`, maxDeploymentExpiry), http.StatusBadRequest)
+			return
+		}
+		d.ExpiresAt = now.Add(time.Duration(req.Expiry) * time.Hour)
+		if err := checkDeployment(d); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		targets, err := s.deploymentTargets(r, d)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.store.CreateDeployment(r.Context(), d, targets); err != nil {
+			http.Error(w, `{"error":"failed to create deployment"}`, http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditDeploymentCreated,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail: fmt.Sprintf("deployment=%s %s %s package=%q version=%q artifact=%q target=%s agents=%d",
+				d.ID, d.Manager, d.Action, d.Package, d.Version, d.ArtifactID, deploymentTarget(d), len(targets)),
+		})
+		go s.advanceDeployments()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(deploymentSummary{ //nolint:errcheck
+			Deployment: d,
+			Counts:     map[string]int{store.DeploymentPending: len(targets)},
+		})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkDeployment validates a new deployment's package and limits.
+func checkDeployment(d *store.Deployment) error {
+	if _, ok := protocol.ManagerOS[d.Manager]; !ok || protocol.InstallerManager(d.Manager) && d.ArtifactID == "" {
+		return fmt.Errorf("manager must be %s, %s or %s, or artifact_id set", protocol.ManagerApt, protocol.ManagerBrew, protocol.ManagerChoco)
+	}
+	switch {
+	case d.Action != protocol.SoftwareInstall && d.Action != protocol.SoftwareUninstall:
+		return fmt.Errorf("action must be %s or %s", protocol.SoftwareInstall, protocol.SoftwareUninstall)
+	case d.ArtifactID != "" && d.Action != protocol.SoftwareInstall:
+		return fmt.Errorf("artifacts can only be installed")
+	case d.ArtifactID == "" && !protocol.ValidPackageName(d.Package):
+		return fmt.Errorf("invalid package name")
+	case d.Version != "" && d.Action != protocol.SoftwareInstall:
+		return fmt.Errorf("version only applies to installs")
+	case d.Version != "" && !protocol.ValidPackageVersion(d.Version):
+		return fmt.Errorf("invalid version")
+	case d.Timeout < 1 || d.Timeout > protocol.MaxSoftwareTimeout/60:
+		return fmt.Errorf("timeout_minutes must be 1-%d", protocol.MaxSoftwareTimeout/60)
+	case d.MaxConcurrent < 0:
+		return fmt.Errorf("max_concurrent cannot be negative")
+	case len(d.AgentIDs) == 0 && d.OrgID == "" && d.Site == "":
+		return fmt.Errorf("agent_ids, org_id or site required")
+	case len(d.AgentIDs) > 0 && (d.OrgID != "" || d.Site != ""):
+		return fmt.Errorf("agent_ids cannot be combined with org_id or site")
+	}
+	return nil
+}
+
+// deploymentTargets resolves a new deployment's targets to enrolled
+// agents. Listed agents must run the manager's OS; a group takes those of
+// its agents that do.
+func (s *Server) deploymentTargets(r *http.Request, d *store.Deployment) ([]string, error) {
+	goos := protocol.ManagerOS[d.Manager]
+	if d.OrgID != "" {
+		if org, err := s.store.GetOrg(r.Context(), d.OrgID); err != nil || org == nil {
+			return nil, fmt.Errorf("organization not found")
+		}
+	}
+	agents, err := s.store.ListAgents(r.Context())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list agents")
+	}
+	var targets []string
+	for _, id := range d.AgentIDs {
+		i := slices.IndexFunc(agents, func(a *store.AgentRecord) bool { return a.ID == id })
+		switch {
+		case i < 0:
+			return nil, fmt.Errorf("agent %s not found", id)
+		case agents[i].TelemetryOnly:
+			return nil, fmt.Errorf("agent %s is telemetry-only", agents[i].Name)
+		case agents[i].OS != goos:
+			return nil, fmt.Errorf("agent %s runs %s; %s needs %s", agents[i].Name, agents[i].OS, d.Manager, goos)
+		}
+		targets = append(targets, id)
+	}
+	if len(d.AgentIDs) == 0 {
+		for _, a := range agents {
+			if a.OS == goos && !a.TelemetryOnly && (d.OrgID == "" || a.OrgID == d.OrgID) && (d.Site == "" || a.Site == d.Site) {
+				targets = append(targets, a.ID)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no %s agents match the target", goos)
+	}
+	return targets, nil
+}
+
+// handleDeployment returns a deployment with its results, including the
+// package manager output (GET), or cancels it (DELETE). Canceling skips
+// agents that have not started; those already running carry on.
+func (s *Server) handleDeployment(w http.ResponseWriter, r *http.Request) {
+	d, err := s.store.GetDeployment(r.Context(), r.PathValue("id"))
+	if err != nil || d == nil {
+		http.Error(w, `{"error":"deployment not found"}`, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		results, err := s.store.ListDeploymentResults(r.Context(), store.DeploymentResultFilter{DeploymentID: d.ID})
+		if err != nil {
+			http.Error(w, `{"error":"failed to list results"}`, http.StatusInternalServerError)
+			return
+		}
+		if results == nil {
+			results = []*store.DeploymentResult{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct { //nolint:errcheck
+			*store.Deployment
+			Results []*store.DeploymentResult `json:"results"`
+		}{d, results})
+
+	case http.MethodDelete:
+		s.deployMu.Lock()
+		pending, err := s.store.ListDeploymentResults(r.Context(),
+			store.DeploymentResultFilter{DeploymentID: d.ID, Status: store.DeploymentPending})
+		for _, res := range pending {
+			if err != nil {
+				break
+			}
+			res.Status = store.DeploymentCanceled
+			err = s.store.UpdateDeploymentResult(r.Context(), res)
+		}
+		s.deployMu.Unlock()
+		if err != nil {
+			http.Error(w, `{"error":"failed to cancel deployment"}`, http.StatusInternalServerError)
+			return
+		}
+		apiKey := security.APIKeyFromContext(r.Context())
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditDeploymentCanceled,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail:    fmt.Sprintf("deployment=%s canceled=%d", d.ID, len(pending)),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAgentDeployments lists an agent's deployment results, with the
+// package manager output.
+func (s *Server) handleAgentDeployments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	results, err := s.store.ListDeploymentResults(r.Context(), store.DeploymentResultFilter{AgentID: r.PathValue("id")})
+	if err != nil {
+		http.Error(w, `{"error":"failed to list results"}`, http.StatusInternalServerError)
+		return
+	}
+	if results == nil {
+		results = []*store.DeploymentResult{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results) //nolint:errcheck
+}
+
+// deploymentTarget describes a deployment's target for audit events.
+func deploymentTarget(d *store.Deployment) string {
+	if len(d.AgentIDs) > 0 {
+		return "agents:" + strings.Join(d.AgentIDs, ",")
+	}
+	var parts []string
+	if d.OrgID != "" {
+		parts = append(parts, "org:"+d.OrgID)
+	}
+	if d.Site != "" {
+		parts = append(parts, fmt.Sprintf("site:%q", d.Site))
+	}
+	return strings.Join(parts, ",")
+}
+
+// runDeployments advances deployments until the server shuts down.
+func (s *Server) runDeployments() {
+	ticker := time.NewTicker(deploymentTick)
+	defer ticker.Stop()
+	for s.tick(ticker) {
+		s.advanceDeployments()
+	}
+}
+
+// advanceDeployments fails running results whose agent has not answered
+// in time, expires pending ones past their deployment's expiry, and sends
+// pending ones to their agents if online and the deployment's
+// concurrency allows.
+func (s *Server) advanceDeployments() {
+	s.deployMu.Lock()
+	defer s.deployMu.Unlock()
+	now := time.Now()
+	deployments := make(map[string]*store.Deployment)
+	deployment := func(id string) *store.Deployment {
+		if d, ok := deployments[id]; ok {
+			return d
+		}
+		d, err := s.store.GetDeployment(s.ctx, id)
+		if err != nil {
+			log.Printf("Deployment %s: %v", id, err)
+		}
+		deployments[id] = d
+		return d
+	}
+
+	running, err := s.store.ListDeploymentResults(s.ctx, store.DeploymentResultFilter{Status: store.DeploymentRunning})
+	if err != nil {
+		log.Printf("Deployments: %v", err)
+		return
+	}
+	active := make(map[string]int)
+	for _, res := range running {
+		d := deployment(res.DeploymentID)
+		if d != nil && res.StartedAt != nil &&
+			now.After(res.StartedAt.Add(time.Duration(d.Timeout)*time.Minute+deploymentAnswerGrace)) {
+			s.finishDeployment(d, res, protocol.SoftwareResult{ExitCode: -1, Error: "no result from the agent"})
+			continue
+		}
+		active[res.DeploymentID]++
+	}
+
+	pending, err := s.store.ListDeploymentResults(s.ctx, store.DeploymentResultFilter{Status: store.DeploymentPending})
+	if err != nil {
+		log.Printf("Deployments: %v", err)
+		return
+	}
+	for _, res := range pending {
+		d := deployment(res.DeploymentID)
+		switch {
+		case d == nil:
+			continue
+		case now.After(d.ExpiresAt):
+			res.Status, res.FinishedAt = store.DeploymentExpired, &now
+			_ = s.store.UpdateDeploymentResult(s.ctx, res)
+			continue
+		case d.MaxConcurrent > 0 && active[d.ID] >= d.MaxConcurrent:
+			continue
+		}
+		s.mu.RLock()
+		agent, online := s.agents[res.AgentID]
+		s.mu.RUnlock()
+		if !online {
+			continue
+		}
+		if slices.Contains(agent.Disabled, protocol.CapSoftware) {
+			res.StartedAt = &now
+			s.finishDeployment(d, res, protocol.SoftwareResult{ExitCode: -1, Error: "software deployment is disabled on this agent"})
+			continue
+		}
+		if s.startDeployment(agent, d, res, now) {
+			active[d.ID]++
+		}
+	}
+}
+
+// startDeployment sends the deployment's request to the agent, staging
+// its installer first if it has one. The result is marked running first,
+// so the request is not sent twice. Callers hold deployMu.
+func (s *Server) startDeployment(agent *LiveAgent, d *store.Deployment, res *store.DeploymentResult, now time.Time) bool {
+	res.Status, res.StartedAt = store.DeploymentRunning, &now
+	if err := s.store.UpdateDeploymentResult(s.ctx, res); err != nil {
+		log.Printf("Deployment %s: %v", d.ID, err)
+		return false
+	}
+	req := protocol.SoftwareRequest{
+		ID:      d.ID,
+		Manager: d.Manager,
+		Action:  d.Action,
+		Package: d.Package,
+		Version: d.Version,
+		Timeout: d.Timeout * 60,
+	}
+	if d.ArtifactID != "" {
+		// Staging runs over the file channel, which may take a while.
+		go s.stageArtifact(agent, d, res, req)
+	} else if err := agent.send("software_request", req); err != nil {
+		res.Status, res.StartedAt = store.DeploymentPending, nil
+		_ = s.store.UpdateDeploymentResult(s.ctx, res)
+		return false
+	}
+	log.Printf("Agent %s: deployment %s started (%s %s %s)", agent.Name, d.ID, d.Manager, d.Action, d.Package)
+	s.publishEvent(eventDeploymentStarted, agent.ID, res)
+	return true
+}
+
+// stageArtifact sends the deployment's installer over the agent's file
+// channel, then the request to install it. If the channel is busy the
+// result goes back to pending, to be retried on a later tick.
+func (s *Server) stageArtifact(agent *LiveAgent, d *store.Deployment, res *store.DeploymentResult, req protocol.SoftwareRequest) {
+	fail := func(msg string) {
+		s.deployMu.Lock()
+		s.finishDeployment(d, res, protocol.SoftwareResult{ExitCode: -1, Error: msg})
+		s.deployMu.Unlock()
+	}
+	a, err := s.store.GetArtifact(s.ctx, d.ArtifactID)
+	if err != nil || a == nil {
+		fail("artifact no longer in the package repository")
+		return
+	}
+	content, err := os.Open(s.artifactPath(a.ID))
+	if err != nil {
+		fail("artifact content missing on server")
+		return
+	}
+	defer content.Close() //nolint:errcheck
+
+	if !agent.beginTransfer() {
+		s.deployMu.Lock()
+		res.Status, res.StartedAt = store.DeploymentPending, nil
+		_ = s.store.UpdateDeploymentResult(s.ctx, res)
+		s.deployMu.Unlock()
+		return
+	}
+	req.Artifact, req.SHA256 = security.NewID(), a.SHA256
+	result := agent.expect(req.Artifact)
+	start := protocol.FileStart{ID: req.Artifact, Name: a.Name, Size: a.Size, Purpose: protocol.FilePurposePackage}
+	err = sendFile(agent, start, content, a.SHA256)
+	var p protocol.FileProgress
+	if err == nil {
+		select {
+		case data := <-result:
+			_ = json.Unmarshal(data, &p)
+		case <-time.After(dropboxResultTimeout):
+			err = errAgentTimeout
+		}
+	}
+	agent.forget(req.Artifact)
+	agent.endTransfer()
+	go s.deliverDropbox(agent) // anything queued meanwhile
+
+	switch {
+	case err != nil:
+		fail("staging the installer failed: " + err.Error())
+	case p.Error != "":
+		fail("staging the installer failed: " + p.Error)
+	case agent.send("software_request", req) != nil:
+		fail("agent disconnected")
+	}
+}
+
+// handleSoftwareResult records an agent's result for a running
+// deployment.
+func (s *Server) handleSoftwareResult(agent *LiveAgent, payload json.RawMessage) {
+	var sr protocol.SoftwareResult
+	if json.Unmarshal(payload, &sr) != nil || sr.ID == "" {
+		return
+	}
+	s.deployMu.Lock()
+	defer s.deployMu.Unlock()
+	results, err := s.store.ListDeploymentResults(s.ctx,
+		store.DeploymentResultFilter{DeploymentID: sr.ID, AgentID: agent.ID, Status: store.DeploymentRunning})
+	if err != nil || len(results) == 0 {
+		return // already timed out
+	}
+	d, err := s.store.GetDeployment(s.ctx, sr.ID)
+	if err != nil || d == nil {
+		return
+	}
+	s.finishDeployment(d, results[0], sr)
+}
+
+// finishDeployment records the outcome of the deployment on one agent.
+func (s *Server) finishDeployment(d *store.Deployment, res *store.DeploymentResult, sr protocol.SoftwareResult) {
+	now := time.Now()
+	res.Status, res.ExitCode, res.Output, res.Error, res.FinishedAt = store.DeploymentSucceeded, sr.ExitCode, sr.Output, sr.Error, &now
+	event := eventDeploymentSucceeded
+	if sr.Error != "" {
+		res.Status, event = store.DeploymentFailed, eventDeploymentFailed
+	}
+	if err := s.store.UpdateDeploymentResult(s.ctx, res); err != nil {
+		log.Printf("Deployment %s: %v", d.ID, err)
+	}
+	s.recordAudit(&store.AuditEvent{
+		Action:  auditDeploymentResult,
+		AgentID: res.AgentID,
+		Detail: fmt.Sprintf("deployment=%s %s %s package=%q status=%s exit=%d error=%q",
+			d.ID, d.Manager, d.Action, d.Package, res.Status, res.ExitCode, res.Error),
+	})
+	summary := *res
+	summary.Output = "" // fetched from the deployment
+	s.publishEvent(event, res.AgentID, summary)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Diagnostics archives: POST /api/agents/{id}/diagnostics asks the agent
+// to collect its recent log, system information, recent OS event logs
+// and network configuration into a .tar.gz, which it uploads over its
+// file channel. Archives are kept under <data>/diagnostics and listed
+// with the agent, newest first, until deleted or pushed out by newer ones.
+
+const (
+	// diagnosticsKeep is how many archives are kept per agent.
+	diagnosticsKeep = 10
+
+	// diagnosticsTimeout bounds a collection, from the request to the
+	// end of the upload.
+	diagnosticsTimeout = 15 * time.Minute
+
+	auditDiagnosticsRequested = "diagnostics_requested"
+	auditDiagnosticsDeleted   = "diagnostics_deleted"
+
+	eventDiagnosticsCollected = "diagnostics.collected"
+	eventDiagnosticsFailed    = "diagnostics.failed"
+)
+
+// diagnosticsCollection is an agent's collection in progress, guarded by
+// the agent's mu.
+type diagnosticsCollection struct {
+	id          string
+	requestedBy string
+	timer       *time.Timer
+
+	// Set once the agent starts the upload.
+	start    *protocol.FileStart
+	f        *os.File
+	hash     hash.Hash
+	received int64
+}
+
+// diagnosticsPath is where an archive is kept.
+func (s *Server) diagnosticsPath(agentID, id string) string {
+	return filepath.Join(s.diagnosticsDir, agentID, id+".tar.gz")
+}
+
+// handleAgentDiagnostics lists an agent's archives (GET) or asks the
+// agent for a new one (POST), answering 202 with its ID; the outcome is
+// published as diagnostics.collected or diagnostics.failed.
+func (s *Server) handleAgentDiagnostics(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		archives, err := s.store.ListDiagnosticsArchives(r.Context(), r.PathValue("id"))
+		if err != nil {
+			http.Error(w, `{"error":"failed to list diagnostics"}`, http.StatusInternalServerError)
+			return
+		}
+		if archives == nil {
+			archives = []*store.DiagnosticsArchive{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(archives) //nolint:errcheck
+
+	case http.MethodPost:
+		agent := s.liveAgentOr404(w, r)
+		if agent == nil {
+			return
+		}
+		apiKey := security.APIKeyFromContext(r.Context())
+		req := protocol.DiagnosticsRequest{ID: security.NewID()}
+		c := &diagnosticsCollection{id: req.ID, requestedBy: apiKey.Name}
+		agent.mu.Lock()
+		if agent.diagnostics != nil {
+			agent.mu.Unlock()
+			http.Error(w, `{"error":"a collection is already in progress"}`, http.StatusConflict)
+			return
+		}
+		agent.diagnostics = c
+		c.timer = time.AfterFunc(diagnosticsTimeout, func() {
+			s.failDiagnostics(agent, req.ID, "timed out")
+		})
+		agent.mu.Unlock()
+
+		payload, _ := json.Marshal(req)
+		msg, _ := json.Marshal(protocol.Message{Type: "collect_diagnostics", Payload: payload})
+		if err := agent.write(protocol.OpText, msg); err != nil {
+			s.failDiagnostics(agent, req.ID, "agent unreachable")
+			http.Error(w, `{"error":"agent unreachable"}`, http.StatusBadGateway)
+			return
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditDiagnosticsRequested,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			AgentID:   agent.ID,
+			Detail:    "id=" + req.ID,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"id": req.ID, "status": "collecting"}) //nolint:errcheck
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDiagnosticsArchive downloads (GET) or deletes (DELETE) one of an
+// agent's archives.
+func (s *Server) handleDiagnosticsArchive(w http.ResponseWriter, r *http.Request) {
+	archive, err := s.store.GetDiagnosticsArchive(r.Context(), r.PathValue("archive"))
+	if err != nil || archive == nil || archive.AgentID != r.PathValue("id") {
+		http.Error(w, `{"error":"archive not found"}`, http.StatusNotFound)
+		return
+	}
+	path := s.diagnosticsPath(archive.AgentID, archive.ID)
+
+	switch r.Method {
+	case http.MethodGet:
+		f, err := os.Open(path)
+		if err != nil {
+			http.Error(w, `{"error":"archive not found"}`, http.StatusNotFound)
+			return
+		}
+		defer f.Close() //nolint:errcheck
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", archive.Name))
+		http.ServeContent(w, r, "", archive.CollectedAt, f)
+
+	case http.MethodDelete:
+		if err := s.store.DeleteDiagnosticsArchive(r.Context(), archive.ID); err != nil {
+			http.Error(w, `{"error":"failed to delete archive"}`, http.StatusInternalServerError)
+			return
+		}
+		_ = os.Remove(path)
+		apiKey := security.APIKeyFromContext(r.Context())
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditDiagnosticsDeleted,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			AgentID:   archive.AgentID,
+			Detail:    "id=" + archive.ID,
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startDiagnosticsUpload opens the temp file for an archive the agent is
+// about to upload. Uploads nobody asked for are refused.
+func (s *Server) startDiagnosticsUpload(agent *LiveAgent, payload json.RawMessage) {
+	var start protocol.FileStart
+	if json.Unmarshal(payload, &start) != nil || start.Purpose != protocol.FilePurposeDiagnostics {
+		return
+	}
+	agent.mu.Lock()
+	c := agent.diagnostics
+	if c == nil || c.id != start.ID || c.start != nil {
+		agent.mu.Unlock()
+		log.Printf("Agent %s: unexpected diagnostics upload %q", agent.Name, start.ID)
+		return
+	}
+	agent.mu.Unlock()
+
+	if start.Size <= 0 || start.Size > protocol.MaxDiagnosticsSize {
+		s.failDiagnostics(agent, start.ID, fmt.Sprintf("archive size %d out of range", start.Size))
+		return
+	}
+	if name, ok := dropboxName(start.Name); ok {
+		start.Name = name
+	} else {
+		start.Name = "diagnostics-" + start.ID + ".tar.gz"
+	}
+	dir := filepath.Join(s.diagnosticsDir, agent.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		s.failDiagnostics(agent, start.ID, err.Error())
+		return
+	}
+	f, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		s.failDiagnostics(agent, start.ID, err.Error())
+		return
+	}
+
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if agent.diagnostics != c {
+		// Failed or timed out meanwhile.
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return
+	}
+	c.start, c.f, c.hash = &start, f, sha256.New()
+}
+
+// receiveDiagnosticsChunk writes a BinFile frame from the agent to the
+// upload in progress. The frame's credit is returned even when the
+// upload has failed, so the agent is never left waiting on it.
+func (s *Server) receiveDiagnosticsChunk(agent *LiveAgent, frame []byte) {
+	if agent.fileCredit != nil {
+		defer agent.write(protocol.OpBinary, protocol.CreditGrant(protocol.BinFile, len(frame))) //nolint:errcheck
+	}
+	data, err := protocol.ParseFileChunk(frame)
+	agent.mu.Lock()
+	c := agent.diagnostics
+	if c == nil || c.f == nil {
+		agent.mu.Unlock()
+		return
+	}
+	if err == nil && c.received+int64(len(data)) > c.start.Size {
+		err = fmt.Errorf("archive exceeds its declared size")
+	}
+	if err == nil {
+		_, err = c.f.Write(data)
+		c.hash.Write(data)
+		c.received += int64(len(data))
+	}
+	agent.mu.Unlock()
+	if err != nil {
+		s.failDiagnostics(agent, c.id, err.Error())
+	}
+}
+
+// finishDiagnosticsUpload checks a completed upload against its declared
+// size and digest and adds the archive to the agent's record.
+func (s *Server) finishDiagnosticsUpload(agent *LiveAgent, payload json.RawMessage) {
+	var end protocol.FileEnd
+	if json.Unmarshal(payload, &end) != nil {
+		return
+	}
+	agent.mu.Lock()
+	c := agent.diagnostics
+	if c == nil || c.id != end.ID || c.f == nil {
+		agent.mu.Unlock()
+		return
+	}
+	agent.diagnostics = nil
+	c.timer.Stop()
+	agent.mu.Unlock()
+
+	tmp := c.f.Name()
+	err := c.f.Close()
+	sum := hex.EncodeToString(c.hash.Sum(nil))
+	if err == nil && c.received != c.start.Size {
+		err = fmt.Errorf("received %d of %d bytes", c.received, c.start.Size)
+	} else if err == nil && !strings.EqualFold(end.SHA256, sum) {
+		err = fmt.Errorf("checksum mismatch")
+	}
+	archive := &store.DiagnosticsArchive{
+		ID:          c.id,
+		AgentID:     agent.ID,
+		Name:        c.start.Name,
+		Size:        c.received,
+		SHA256:      sum,
+		RequestedBy: c.requestedBy,
+		CollectedAt: time.Now(),
+	}
+	path := s.diagnosticsPath(agent.ID, archive.ID)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err == nil {
+		err = s.store.CreateDiagnosticsArchive(context.Background(), archive)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		_ = os.Remove(path)
+		s.diagnosticsFailed(agent, c.id, err.Error())
+		return
+	}
+
+	ids, err := s.store.PruneDiagnosticsArchives(s.ctx, agent.ID, diagnosticsKeep)
+	if err != nil {
+		log.Printf("Diagnostics retention for %s: %v", agent.Name, err)
+	}
+	for _, id := range ids {
+		_ = os.Remove(s.diagnosticsPath(agent.ID, id))
+	}
+	log.Printf("Agent %s: diagnostics archive %s collected (%d bytes)", agent.Name, archive.ID, archive.Size)
+	s.publishEvent(eventDiagnosticsCollected, agent.ID, archive)
+}
+
+// handleDiagnosticsResult handles the agent reporting that a collection
+// failed.
+func (s *Server) handleDiagnosticsResult(agent *LiveAgent, payload json.RawMessage) {
+	var res protocol.DiagnosticsResult
+	if json.Unmarshal(payload, &res) == nil {
+		s.failDiagnostics(agent, res.ID, res.Error)
+	}
+}
+
+// failDiagnostics ends the agent's collection id, if still in progress,
+// discarding any partial upload.
+func (s *Server) failDiagnostics(agent *LiveAgent, id, reason string) {
+	agent.mu.Lock()
+	c := agent.diagnostics
+	if c == nil || c.id != id {
+		agent.mu.Unlock()
+		return
+	}
+	agent.diagnostics = nil
+	c.timer.Stop()
+	agent.mu.Unlock()
+
+	if c.f != nil {
+		_ = c.f.Close()
+		_ = os.Remove(c.f.Name())
+	}
+	s.diagnosticsFailed(agent, id, reason)
+}
+
+func (s *Server) diagnosticsFailed(agent *LiveAgent, id, reason string) {
+	log.Printf("Agent %s: diagnostics collection failed: %s", agent.Name, reason)
+	s.publishEvent(eventDiagnosticsFailed, agent.ID, map[string]string{"id": id, "error": reason})
+}
+
+// abortDiagnostics fails the agent's collection in progress, if any, when
+// it disconnects.
+func (s *Server) abortDiagnostics(agent *LiveAgent) {
+	agent.mu.Lock()
+	c := agent.diagnostics
+	agent.mu.Unlock()
+	if c != nil {
+		s.failDiagnostics(agent, c.id, "agent disconnected")
+	}
+}
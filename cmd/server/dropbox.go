@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Drop-box: files uploaded for an agent are held under <data>/dropbox and
+// sent over the agent's file channel the next time it connects (or
+// straight away if it is online). The agent saves them to the user's
+// Downloads folder.
+
+// Event types published on the dashboard event stream.
+const (
+	eventDropboxQueued    = "dropbox.queued"
+	eventDropboxProgress  = "dropbox.progress"
+	eventDropboxDelivered = "dropbox.delivered"
+	eventDropboxFailed    = "dropbox.failed"
+	eventDropboxExpired   = "dropbox.expired"
+	eventDropboxCanceled  = "dropbox.canceled"
+)
+
+// dropboxOutcomes maps a final state to its event and audit action.
+var dropboxOutcomes = map[string][2]string{
+	store.DropboxDelivered: {eventDropboxDelivered, auditDropboxDelivered},
+	store.DropboxFailed:    {eventDropboxFailed, auditDropboxFailed},
+	store.DropboxExpired:   {eventDropboxExpired, auditDropboxExpired},
+	store.DropboxCanceled:  {eventDropboxCanceled, auditDropboxCanceled},
+}
+
+const (
+	// dropboxChunkSize is the data carried per BinFile frame.
+	dropboxChunkSize = 64 << 10
+
+	// dropboxResultTimeout bounds how long a delivery waits for the
+	// agent to confirm the file once it has been sent.
+	dropboxResultTimeout = 2 * time.Minute
+
+	// dropboxSweepInterval is how often expired files are discarded.
+	dropboxSweepInterval = 10 * time.Minute
+)
+
+// dropboxPath is where a queued file's content is kept.
+func (s *Server) dropboxPath(id string) string {
+	return filepath.Join(s.dropboxDir, id)
+}
+
+// dropboxName reduces an uploaded file name to a plain base name.
+func dropboxName(raw string) (string, bool) {
+	name := strings.TrimSpace(path.Base(strings.ReplaceAll(raw, `\`, "/")))
+	if name == "" || name == "." || name == ".." || name == "/" || len(name) > 255 {
+		return "", false
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", false
+	}
+	return name, true
+}
+
+// handleAgentDropbox lists an agent's drop-box files (GET) or queues a
+// new one (POST ?name=, with the content as the raw request body). The
+// agent does not need to be online.
+func (s *Server) handleAgentDropbox(w http.ResponseWriter, r *http.Request) {
+	agentID := r.PathValue("id")
+	rec, err := s.store.GetAgent(r.Context(), agentID)
+	if err != nil || rec == nil {
+		http.Error(w, `{"error":"agent not found"}`, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		files, err := s.store.ListDropboxFiles(r.Context(), agentID)
+		if err != nil {
+			http.Error(w, `{"error":"failed to list files"}`, http.StatusInternalServerError)
+			return
+		}
+		if files == nil {
+			files = []*store.DropboxFile{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(files) //nolint:errcheck
+	case http.MethodPost:
+		s.queueDropboxFile(w, r, agentID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// queueDropboxFile stores an uploaded file, checking it against the
+// transfer size limit and the agent's quota.
+func (s *Server) queueDropboxFile(w http.ResponseWriter, r *http.Request, agentID string) {
+	name, ok := dropboxName(r.URL.Query().Get("name"))
+	if !ok {
+		http.Error(w, `{"error":"valid name required"}`, http.StatusBadRequest)
+		return
+	}
+	limit := s.config().TransferPolicy.limit(protocol.FilePurposeDropbox)
+	if limit == 0 {
+		http.Error(w, `{"error":"drop-box disabled by transfer policy"}`, http.StatusForbidden)
+		return
+	}
+	if r.ContentLength > limit {
+		http.Error(w, `{"error":"file exceeds the transfer size limit"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := os.MkdirAll(s.dropboxDir, 0700); err != nil {
+		http.Error(w, `{"error":"failed to store file"}`, http.StatusInternalServerError)
+		return
+	}
+	tmp, err := os.CreateTemp(s.dropboxDir, ".upload-*")
+	if err != nil {
+		http.Error(w, `{"error":"failed to store file"}`, http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // no-op once renamed
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), http.MaxBytesReader(w, r.Body, limit))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, `{"error":"file exceeds the transfer size limit"}`, http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, `{"error":"upload failed"}`, http.StatusBadRequest)
+		return
+	case size == 0:
+		http.Error(w, `{"error":"empty file"}`, http.StatusBadRequest)
+		return
+	}
+
+	apiKey := security.APIKeyFromContext(r.Context())
+	now := time.Now()
+	f := &store.DropboxFile{
+		ID:        security.NewID(),
+		AgentID:   agentID,
+		Name:      name,
+		Size:      size,
+		SHA256:    hex.EncodeToString(h.Sum(nil)),
+		CreatedBy: apiKey.Name,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.config().Dropbox.expiry()),
+		Status:    store.DropboxPending,
+	}
+
+	// The quota check and insert are atomic with respect to other
+	// uploads and to deliverDropbox finding the queue empty.
+	s.dropboxMu.Lock()
+	used, err := s.dropboxUsage(r.Context(), agentID)
+	if err == nil && used+size > s.config().Dropbox.quota() {
+		s.dropboxMu.Unlock()
+		http.Error(w, `{"error":"agent drop-box quota exceeded"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.dropboxPath(f.ID))
+	}
+	if err == nil {
+		err = s.store.CreateDropboxFile(r.Context(), f)
+	}
+	s.dropboxMu.Unlock()
+	if err != nil {
+		_ = os.Remove(s.dropboxPath(f.ID))
+		http.Error(w, `{"error":"failed to store file"}`, http.StatusInternalServerError)
+		return
+	}
+
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditDropboxQueued,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   agentID,
+		Detail:    fmt.Sprintf("file=%s name=%q size=%d sha256=%s", f.ID, f.Name, f.Size, f.SHA256),
+	})
+	s.publishEvent(eventDropboxQueued, agentID, f)
+
+	s.mu.RLock()
+	agent, online := s.agents[agentID]
+	s.mu.RUnlock()
+	if online {
+		go s.deliverDropbox(agent)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(f) //nolint:errcheck
+}
+
+// dropboxUsage totals the agent's undelivered files.
+func (s *Server) dropboxUsage(ctx context.Context, agentID string) (int64, error) {
+	files, err := s.store.ListDropboxFiles(ctx, agentID)
+	if err != nil {
+		return 0, err
+	}
+	var used int64
+	for _, f := range files {
+		if f.Status == store.DropboxPending {
+			used += f.Size
+		}
+	}
+	return used, nil
+}
+
+// handleDropboxFile cancels an undelivered file (DELETE).
+func (s *Server) handleDropboxFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := s.store.GetDropboxFile(r.Context(), r.PathValue("file"))
+	if err != nil || f == nil || f.AgentID != r.PathValue("id") {
+		http.Error(w, `{"error":"file not found"}`, http.StatusNotFound)
+		return
+	}
+
+	// Holding dropboxMu keeps a delivery from picking the file up while
+	// it is being canceled.
+	s.dropboxMu.Lock()
+	f, err = s.store.GetDropboxFile(r.Context(), f.ID)
+	if err != nil || f == nil || f.Status != store.DropboxPending || s.delivering(f) {
+		s.dropboxMu.Unlock()
+		http.Error(w, `{"error":"file is no longer pending"}`, http.StatusConflict)
+		return
+	}
+	s.finishDropbox(f, store.DropboxCanceled, security.APIKeyFromContext(r.Context()))
+	s.dropboxMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f) //nolint:errcheck
+}
+
+// delivering reports whether f is being sent to its agent right now.
+func (s *Server) delivering(f *store.DropboxFile) bool {
+	s.mu.RLock()
+	agent, ok := s.agents[f.AgentID]
+	s.mu.RUnlock()
+	return ok && agent.awaiting(f.ID)
+}
+
+// finishDropbox moves a pending file to its final state, discards its
+// content and reports the outcome. actor is nil for outcomes reported by
+// the agent or the expiry sweep.
+func (s *Server) finishDropbox(f *store.DropboxFile, status string, actor *store.APIKey) {
+	f.Status = status
+	if status == store.DropboxDelivered {
+		now := time.Now()
+		f.DeliveredAt = &now
+	}
+	if err := s.store.UpdateDropboxFile(context.Background(), f); err != nil {
+		log.Printf("Drop-box update failed for %s: %v", f.ID, err)
+	}
+	_ = os.Remove(s.dropboxPath(f.ID))
+
+	detail := fmt.Sprintf("file=%s name=%q size=%d", f.ID, f.Name, f.Size)
+	if f.Path != "" {
+		detail += fmt.Sprintf(" path=%q", f.Path)
+	}
+	if f.Error != "" {
+		detail += fmt.Sprintf(" error=%q", f.Error)
+	}
+	outcome := dropboxOutcomes[status]
+	ev := &store.AuditEvent{Action: outcome[1], AgentID: f.AgentID, Detail: detail}
+	if actor != nil {
+		ev.ActorID, ev.ActorName = actor.ID, actor.Name
+	}
+	s.recordAudit(ev)
+	s.publishEvent(outcome[0], f.AgentID, f)
+}
+
+// deliverDropbox sends the agent's pending files one at a time. It runs
+// whenever the agent connects, a file is queued for it, or a viewer
+// upload releases its file channel; if the channel is busy it returns
+// and the holder's release retries.
+func (s *Server) deliverDropbox(agent *LiveAgent) {
+	for {
+		if !agent.beginTransfer() {
+			return
+		}
+		f, result := s.nextDropboxFile(agent)
+		if f == nil {
+			return // nextDropboxFile released the channel
+		}
+		err := s.sendDropboxFile(agent, f, result)
+		agent.forget(f.ID)
+		agent.endTransfer()
+		if err != nil {
+			log.Printf("Drop-box delivery of %s to %s interrupted: %v", f.ID, agent.Name, err)
+			return
+		}
+	}
+}
+
+// nextDropboxFile returns the agent's oldest pending file, expiring any
+// that are past due, and the channel its delivery result arrives on. The
+// file is marked as awaited before dropboxMu is released, so it cannot be
+// canceled mid-delivery. When there is no file it releases the agent's
+// file channel while still holding dropboxMu, so a file queued
+// concurrently is never left behind.
+func (s *Server) nextDropboxFile(agent *LiveAgent) (*store.DropboxFile, chan json.RawMessage) {
+	s.dropboxMu.Lock()
+	defer s.dropboxMu.Unlock()
+
+	files, err := s.store.ListDropboxFiles(s.ctx, agent.ID)
+	if err != nil {
+		log.Printf("Drop-box list failed for %s: %v", agent.ID, err)
+	}
+	for _, f := range files {
+		if f.Status != store.DropboxPending {
+			continue
+		}
+		if time.Now().After(f.ExpiresAt) {
+			s.finishDropbox(f, store.DropboxExpired, nil)
+			continue
+		}
+		return f, agent.expect(f.ID)
+	}
+	agent.endTransfer()
+	return nil, nil
+}
+
+// sendDropboxFile streams one file over the agent's file channel and
+// records the agent's verdict. It returns an error, leaving the file
+// pending, only if the agent could not be reached or did not answer.
+func (s *Server) sendDropboxFile(agent *LiveAgent, f *store.DropboxFile, result chan json.RawMessage) error {
+	content, err := os.Open(s.dropboxPath(f.ID))
+	if err != nil {
+		f.Error = "file content missing on server"
+		s.finishDropbox(f, store.DropboxFailed, nil)
+		return nil
+	}
+	defer content.Close() //nolint:errcheck
+
+	start := protocol.FileStart{ID: f.ID, Name: f.Name, Size: f.Size, Purpose: protocol.FilePurposeDropbox}
+	if err := sendFile(agent, start, content, f.SHA256); err != nil {
+		return err
+	}
+
+	select {
+	case data := <-result:
+		var p protocol.FileProgress
+		_ = json.Unmarshal(data, &p)
+		if p.Error != "" {
+			f.Error = p.Error
+			s.finishDropbox(f, store.DropboxFailed, nil)
+		} else {
+			f.Path = p.Path
+			s.finishDropbox(f, store.DropboxDelivered, nil)
+		}
+		return nil
+	case <-time.After(dropboxResultTimeout):
+		return errAgentTimeout
+	}
+}
+
+// sendFile streams content over the agent's file channel, which the
+// caller holds (see beginTransfer), framed by file_start and file_end.
+// The agent's verdict arrives as a final file_progress.
+func sendFile(agent *LiveAgent, start protocol.FileStart, content io.Reader, digest string) error {
+	send := func(msgType string, v any) error {
+		payload, _ := json.Marshal(v)
+		msg, _ := json.Marshal(protocol.Message{Type: msgType, Payload: payload})
+		return agent.write(protocol.OpText, msg)
+	}
+	if err := send("file_start", start); err != nil {
+		return err
+	}
+	buf := make([]byte, dropboxChunkSize)
+	for {
+		n, err := io.ReadFull(content, buf)
+		if n > 0 {
+			if werr := agent.sendFileChunk(protocol.FileChunk(buf[:n])); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return send("file_end", protocol.FileEnd{ID: start.ID, SHA256: digest})
+}
+
+// sweepDropbox periodically expires files whose agents never came back,
+// until the server shuts down.
+func (s *Server) sweepDropbox() {
+	ticker := time.NewTicker(dropboxSweepInterval)
+	defer ticker.Stop()
+	for {
+		s.dropboxMu.Lock()
+		files, err := s.store.ListDropboxFiles(s.ctx, "")
+		if err != nil {
+			log.Printf("Drop-box sweep failed: %v", err)
+		}
+		for _, f := range files {
+			if f.Status == store.DropboxPending && time.Now().After(f.ExpiresAt) {
+				s.finishDropbox(f, store.DropboxExpired, nil)
+			}
+		}
+		s.dropboxMu.Unlock()
+		if !s.tick(ticker) {
+			return
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Enrollment activity: every request to /api/enroll is counted by outcome,
+// by the token its code belongs to and by the client address, and served
+// on /api/metrics. A token tried from more distinct addresses than
+// "enrollment_alert_addresses" (default 3) raises an enrollment_anomaly
+// alert once: a code meant for one machine turning up elsewhere is an
+// early sign that it has leaked. Provisioning tokens, which enroll whole
+// fleets, are counted but never alerted on. Counts live in memory and
+// restart at zero with the server.
+
+// Enrollment outcomes.
+const (
+	enrollOutcomeEnrolled = "enrolled" // credential issued
+	enrollOutcomeRejected = "rejected" // known code refused (used, expired, bound, attestation, quota)
+	enrollOutcomeInvalid  = "invalid"  // malformed request or unknown code
+)
+
+const (
+	// defaultEnrollAlertAddresses is the distinct addresses a token may
+	// be tried from before it raises an alert.
+	defaultEnrollAlertAddresses = 3
+	// maxEnrollAddresses bounds the client addresses tracked; the least
+	// recently seen is dropped first.
+	maxEnrollAddresses = 1024
+	// enrollStatsTTL is how long a token or address without attempts is
+	// kept.
+	enrollStatsTTL = 7 * 24 * time.Hour
+
+	auditEnrollmentAnomaly = "enrollment_anomaly"
+)
+
+// enrollCounts are the attempts and successes of one token or address.
+type enrollCounts struct {
+	attempts  uint64
+	successes uint64
+	lastSeen  time.Time
+}
+
+// enrollTokenStats adds the distinct addresses a token was tried from.
+type enrollTokenStats struct {
+	enrollCounts
+	addresses map[string]bool
+	alerted   bool
+}
+
+// enrollStats tracks enrollment activity.
+type enrollStats struct {
+	mu        sync.Mutex
+	outcomes  map[string]uint64
+	tokens    map[string]*enrollTokenStats // by token ID
+	addresses map[string]*enrollCounts     // by client IP
+}
+
+// clientAddress is the IP address of the request's peer.
+func clientAddress(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// recordEnrollment counts an enrollment attempt from remoteAddr with the
+// code of token, nil when the code matched none, and raises an alert if
+// the token has now been tried from too many addresses.
+func (s *Server) recordEnrollment(token *store.EnrollmentToken, remoteAddr, outcome string) {
+	addr := clientAddress(remoteAddr)
+	now := time.Now()
+	st := &s.enrollStats
+
+	st.mu.Lock()
+	if st.outcomes == nil {
+		st.outcomes = make(map[string]uint64)
+		st.tokens = make(map[string]*enrollTokenStats)
+		st.addresses = make(map[string]*enrollCounts)
+	}
+	st.outcomes[outcome]++
+	st.prune(now)
+
+	ac := st.addresses[addr]
+	if ac == nil {
+		ac = &enrollCounts{}
+		st.addresses[addr] = ac
+	}
+	ac.attempts++
+	ac.lastSeen = now
+	if outcome == enrollOutcomeEnrolled {
+		ac.successes++
+	}
+
+	var alertAddrs []string
+	if token != nil {
+		tc := st.tokens[token.ID]
+		if tc == nil {
+			tc = &enrollTokenStats{addresses: make(map[string]bool)}
+			st.tokens[token.ID] = tc
+		}
+		tc.attempts++
+		tc.lastSeen = now
+		if outcome == enrollOutcomeEnrolled {
+			tc.successes++
+		}
+		tc.addresses[addr] = true
+		limit := s.config().enrollAlertAddresses()
+		if limit > 0 && !tc.alerted && token.Type != store.TokenProvisioning && len(tc.addresses) > limit {
+			tc.alerted = true
+			for a := range tc.addresses {
+				alertAddrs = append(alertAddrs, a)
+			}
+			sort.Strings(alertAddrs)
+		}
+	}
+	st.mu.Unlock()
+
+	if alertAddrs != nil {
+		s.raiseEnrollmentAnomaly(token, alertAddrs)
+	}
+}
+
+// prune drops tokens and addresses not seen within enrollStatsTTL, and
+// the least recently seen addresses beyond maxEnrollAddresses. The caller
+// holds st.mu.
+func (st *enrollStats) prune(now time.Time) {
+	cutoff := now.Add(-enrollStatsTTL)
+	for id, tc := range st.tokens {
+		if tc.lastSeen.Before(cutoff) {
+			delete(st.tokens, id)
+		}
+	}
+	for addr, ac := range st.addresses {
+		if ac.lastSeen.Before(cutoff) {
+			delete(st.addresses, addr)
+		}
+	}
+	for len(st.addresses) >= maxEnrollAddresses {
+		var oldest string
+		for addr, ac := range st.addresses {
+			if oldest == "" || ac.lastSeen.Before(st.addresses[oldest].lastSeen) {
+				oldest = addr
+			}
+		}
+		delete(st.addresses, oldest)
+	}
+}
+
+// raiseEnrollmentAnomaly alerts that token was tried from addrs.
+func (s *Server) raiseEnrollmentAnomaly(token *store.EnrollmentToken, addrs []string) {
+	name := token.ID
+	if token.Label != "" {
+		name += " (" + token.Label + ")"
+	}
+	alert := &store.Alert{
+		ID:       security.NewID(),
+		Type:     store.AlertEnrollmentAnomaly,
+		AgentID:  token.UsedBy,
+		Message:  fmt.Sprintf("Enrollment token %s tried from %d addresses: %s", name, len(addrs), strings.Join(addrs, ", ")),
+		RaisedAt: time.Now(),
+	}
+	if err := s.store.CreateAlert(s.ctx, alert); err != nil {
+		log.Printf("Enrollment anomaly alert: %v", err)
+		return
+	}
+	s.recordAudit(&store.AuditEvent{
+		Action:  auditEnrollmentAnomaly,
+		AgentID: token.UsedBy,
+		Detail:  fmt.Sprintf("token=%s type=%s addresses=%s", token.ID, token.Type, strings.Join(addrs, ",")),
+	})
+	log.Printf("Enrollment token %s tried from %d addresses", token.ID, len(addrs))
+	s.publishEvent(eventAlertRaised, token.UsedBy, alert)
+}
+
+// writeEnrollmentMetrics writes the enrollment counters.
+func (s *Server) writeEnrollmentMetrics(w io.Writer) {
+	st := &s.enrollStats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP rmm_enrollment_attempts_total Enrollment requests by outcome.\n"+ //nolint:errcheck
+		"# TYPE rmm_enrollment_attempts_total counter\n")
+	for _, outcome := range []string{enrollOutcomeEnrolled, enrollOutcomeRejected, enrollOutcomeInvalid} {
+		fmt.Fprintf(w, "rmm_enrollment_attempts_total{outcome=%q} %d\n", outcome, st.outcomes[outcome]) //nolint:errcheck
+	}
+
+	ids := make([]string, 0, len(st.tokens))
+	for id := range st.tokens {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	fmt.Fprintf(w, "# HELP rmm_enrollment_token_attempts_total Enrollment requests with each token's code.\n"+ //nolint:errcheck
+		"# TYPE rmm_enrollment_token_attempts_total counter\n")
+	for _, id := range ids {
+		fmt.Fprintf(w, "rmm_enrollment_token_attempts_total{token=%q} %d\n", id, st.tokens[id].attempts) //nolint:errcheck
+	}
+	fmt.Fprintf(w, "# HELP rmm_enrollment_token_successes_total Enrollments with each token.\n"+ //nolint:errcheck
+		"# TYPE rmm_enrollment_token_successes_total counter\n")
+	for _, id := range ids {
+		fmt.Fprintf(w, "rmm_enrollment_token_successes_total{token=%q} %d\n", id, st.tokens[id].successes) //nolint:errcheck
+	}
+	fmt.Fprintf(w, "# HELP rmm_enrollment_token_addresses Distinct client addresses each token's code was tried from.\n"+ //nolint:errcheck
+		"# TYPE rmm_enrollment_token_addresses gauge\n")
+	for _, id := range ids {
+		fmt.Fprintf(w, "rmm_enrollment_token_addresses{token=%q} %d\n", id, len(st.tokens[id].addresses)) //nolint:errcheck
+	}
+
+	addrs := make([]string, 0, len(st.addresses))
+	for addr := range st.addresses {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	fmt.Fprintf(w, "# HELP rmm_enrollment_address_attempts_total Enrollment requests from each client address.\n"+ //nolint:errcheck
+		"# TYPE rmm_enrollment_address_attempts_total counter\n")
+	for _, addr := range addrs {
+		fmt.Fprintf(w, "rmm_enrollment_address_attempts_total{address=%q} %d\n", addr, st.addresses[addr].attempts) //nolint:errcheck
+	}
+	fmt.Fprintf(w, "# HELP rmm_enrollment_address_successes_total Enrollments from each client address.\n"+ //nolint:errcheck
+		"# TYPE rmm_enrollment_address_successes_total counter\n")
+	for _, addr := range addrs {
+		fmt.Fprintf(w, "rmm_enrollment_address_successes_total{address=%q} %d\n", addr, st.addresses[addr].successes) //nolint:errcheck
+	}
+}
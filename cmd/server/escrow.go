@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Platform key escrow. Agent credentials are HMACs under a key derived
+// from platform.key, so a server rebuilt without that file cannot
+// authenticate a single enrolled agent. `rmmctl escrow` exports the key
+// encrypted under a recovery passphrase (see security.Escrow), to be kept
+// on paper or as a QR code away from the server; `server
+// -restore-platform` puts it back, after checking it against the
+// credentials the database holds.
+
+const auditPlatformEscrowed = "platform_key_escrowed"
+
+// maxListedMismatches bounds the agents a restore names when their
+// credentials do not verify.
+const maxListedMismatches = 10
+
+// restorePlatform reads a recovery code and passphrase from in, checks
+// the recovered key against the agents enrolled in dataDir's database
+// and writes it to <data>/platform.key, keeping any key already there as
+// platform.key.<time>.bak. A key that verifies none of the enrolled
+// agents' credentials is refused. Prompts and the report go to out; the
+// passphrase is not echoed when in is a terminal.
+func restorePlatform(dataDir string, in io.Reader, out io.Writer) error {
+	lines := bufio.NewScanner(in)
+	prompt := func(label string) string {
+		fmt.Fprint(out, label) //nolint:errcheck
+		if !lines.Scan() {
+			return ""
+		}
+		return strings.TrimSpace(lines.Text())
+	}
+	code := prompt("Recovery code: ")
+	if code == "" {
+		return errors.New("no recovery code")
+	}
+	var passphrase string
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(out, "Recovery passphrase: ") //nolint:errcheck
+		raw, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(out) //nolint:errcheck
+		if err != nil {
+			return fmt.Errorf("reading passphrase: %w", err)
+		}
+		passphrase = strings.TrimSpace(string(raw))
+	} else {
+		passphrase = prompt("Recovery passphrase: ")
+	}
+	platform, err := security.RecoverPlatform(code, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Platform fingerprint: %s\n", platform.Fingerprint()) //nolint:errcheck
+
+	keyPath := filepath.Join(dataDir, "platform.key")
+	_, err = os.Stat(keyPath)
+	haveKey := err == nil
+	if haveKey {
+		if current, err := security.LoadOrCreatePlatform(dataDir); err == nil && current.Fingerprint() == platform.Fingerprint() {
+			fmt.Fprintln(out, "This key is already in place.") //nolint:errcheck
+			return nil
+		}
+	}
+	if err := checkRestoredPlatform(dataDir, platform, out); err != nil {
+		return err
+	}
+
+	if haveKey {
+		backup := keyPath + "." + time.Now().UTC().Format("20060102-150405") + ".bak"
+		if err := os.Rename(keyPath, backup); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Previous key kept as %s\n", backup) //nolint:errcheck
+	}
+	if err := platform.WriteKey(keyPath); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Platform key restored to %s\n", keyPath) //nolint:errcheck
+	return nil
+}
+
+// checkRestoredPlatform verifies the stored credential hash of every
+// enrolled agent against the credential the recovered key issues it,
+// and fails if agents are enrolled but none of them verifies.
+func checkRestoredPlatform(dataDir string, platform *security.Platform, out io.Writer) error {
+	dbPath := filepath.Join(dataDir, "platform.db")
+	if _, err := os.Stat(dbPath); err != nil {
+		fmt.Fprintln(out, "No database yet: there are no agent credentials to check.") //nolint:errcheck
+		return nil
+	}
+	db, err := store.NewSQLiteStore(dbPath)
+	if err != nil {
+		return fmt.Errorf("database: %w", err)
+	}
+	defer db.Close() //nolint:errcheck
+
+	agents, err := db.ListAgents(context.Background())
+	if err != nil {
+		return fmt.Errorf("listing agents: %w", err)
+	}
+	var verified int
+	var mismatched []string
+	for _, a := range agents {
+		if a.CredentialHash == security.CredentialHash(platform.SignCredential(a.ID)) {
+			verified++
+		} else {
+			mismatched = append(mismatched, a.Name+" ("+a.ID+")")
+		}
+	}
+	fmt.Fprintf(out, "Agent credentials verified: %d of %d\n", verified, len(agents)) //nolint:errcheck
+	if len(agents) > 0 && verified == 0 {
+		return errors.New("this key issued none of the enrolled agents' credentials; it belongs to another server or database")
+	}
+	if len(mismatched) > 0 {
+		fmt.Fprintln(out, "These agents' credentials do not verify and they will need to re-enroll:") //nolint:errcheck
+		for i, name := range mismatched {
+			if i == maxListedMismatches {
+				fmt.Fprintf(out, "  ... and %d more\n", len(mismatched)-i) //nolint:errcheck
+				break
+			}
+			fmt.Fprintf(out, "  %s\n", name) //nolint:errcheck
+		}
+	}
+	return nil
+}
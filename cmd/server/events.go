@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventKeepalive is how often an idle event stream gets a comment line,
+// so proxies do not close it.
+const eventKeepalive = 30 * time.Second
+
+// eventBuffer is how many events a slow subscriber may fall behind before
+// further events are dropped for it.
+const eventBuffer = 64
+
+// Event is a state change published on the dashboard event stream.
+type Event struct {
+	Type    string    `json:"type"` // e.g. "dropbox.delivered"
+	Time    time.Time `json:"time"`
+	AgentID string    `json:"agent_id,omitempty"`
+	Data    any       `json:"data,omitempty"`
+}
+
+// eventHub fans events out to the connected /api/events streams.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func (h *eventHub) subscribe() chan Event {
+	ch := make(chan Event, eventBuffer)
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[chan Event]struct{})
+	}
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+// publish never blocks: subscribers that are not keeping up miss events.
+func (h *eventHub) publish(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// publishEvent stamps and publishes an event.
+func (s *Server) publishEvent(typ, agentID string, data any) {
+	ev := Event{Type: typ, Time: time.Now().UTC(), AgentID: agentID, Data: data}
+	s.events.publish(ev)
+	if s.redis != nil {
+		s.redis.publishEvent(ev)
+	}
+}
+
+// handleEvents streams events as Server-Sent Events until the client
+// disconnects. Each event's SSE name is its type, and its data is the
+// JSON-encoded Event.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, `{"error":"streaming unsupported"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, ": connected\n\n") //nolint:errcheck
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			data, _ := json.Marshal(ev)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
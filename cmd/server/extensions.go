@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/extension"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Compiled-in extensions (see internal/extension): at start each gets
+// its migrations applied, is initialized with an extensionHost, has its
+// routes served under /api/ext/<name>/ and, if it listens, a
+// subscription to the event stream.
+
+// extensionInfo describes a loaded extension for /api/extensions.
+type extensionInfo struct {
+	Name       string   `json:"name"`
+	Routes     []string `json:"routes"`
+	Migrations int      `json:"migrations"`
+	Listens    bool     `json:"listens"`
+}
+
+// extensionHost is the server as an extension sees it.
+type extensionHost struct {
+	srv *Server
+}
+
+func (h extensionHost) Context() context.Context { return h.srv.ctx }
+func (h extensionHost) Store() store.Store       { return h.srv.store }
+func (h extensionHost) DB() *sql.DB              { return h.srv.store.DB() }
+
+func (h extensionHost) Publish(typ, agentID string, data any) {
+	h.srv.publishEvent(typ, agentID, data)
+}
+
+func (h extensionHost) Audit(ev *store.AuditEvent) {
+	h.srv.recordAudit(ev)
+}
+
+// startExtensions migrates, initializes and wires up the registered
+// extensions, registering their routes on mux behind auth.
+func (s *Server) startExtensions(mux *http.ServeMux, auth *security.AuthMiddleware) error {
+	host := extensionHost{srv: s}
+	for _, ext := range extension.All() {
+		name := ext.Name()
+		info := extensionInfo{Name: name, Routes: []string{}}
+		if m, ok := ext.(extension.Migrator); ok {
+			migrations := m.Migrations()
+			if err := s.store.MigrateExtension(s.ctx, name, migrations); err != nil {
+				return fmt.Errorf("extension %s: %w", name, err)
+			}
+			info.Migrations = len(migrations)
+		}
+		if err := ext.Init(host); err != nil {
+			return fmt.Errorf("extension %s: %w", name, err)
+		}
+		if rt, ok := ext.(extension.Router); ok {
+			for pattern, handler := range rt.Routes() {
+				full := extensionPattern(name, pattern)
+				mux.HandleFunc(full, auth.Wrap(handler))
+				info.Routes = append(info.Routes, full)
+			}
+			sort.Strings(info.Routes)
+		}
+		if l, ok := ext.(extension.Listener); ok {
+			go s.feedExtension(l, s.events.subscribe())
+			info.Listens = true
+		}
+		s.extensions = append(s.extensions, info)
+		log.Printf("Extension loaded: %s (%d routes, %d migrations)", name, len(info.Routes), info.Migrations)
+	}
+	return nil
+}
+
+// extensionPattern places an extension's route pattern, "[METHOD ]path",
+// under /api/ext/<name>/.
+func extensionPattern(name, pattern string) string {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		method, path = "", pattern
+	}
+	full := "/api/ext/" + name + "/" + strings.TrimLeft(strings.TrimSpace(path), "/")
+	if method != "" {
+		full = method + " " + full
+	}
+	return full
+}
+
+// feedExtension passes events to a listening extension until the server
+// shuts down.
+func (s *Server) feedExtension(l extension.Listener, ch chan Event) {
+	defer s.events.unsubscribe(ch)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case ev := <-ch:
+			deliverExtensionEvent(l, extension.Event{Type: ev.Type, Time: ev.Time, AgentID: ev.AgentID, Data: ev.Data})
+		}
+	}
+}
+
+// deliverExtensionEvent calls l.OnEvent, logging rather than crashing
+// the server if it panics.
+func deliverExtensionEvent(l extension.Listener, ev extension.Event) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Extension %s: panic handling %s: %v", l.(extension.Extension).Name(), ev.Type, p)
+		}
+	}()
+	l.OnEvent(ev)
+}
+
+// handleExtensions lists the extensions built in.
+func (s *Server) handleExtensions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	exts := s.extensions
+	if exts == nil {
+		exts = []extensionInfo{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(exts) //nolint:errcheck
+}
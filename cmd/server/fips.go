@@ -0,0 +1,20 @@
+package main
+
+import (
+	"crypto/tls"
+
+	"github.com/avaropoint/rmm/internal/security"
+)
+
+// checkFIPSTLS restricts tlsCfg to FIPS-approved key exchanges and
+// checks its certificates' keys. ACME certificates are issued for the
+// ECDSA P-256 keys autocert generates, so they need no check.
+func checkFIPSTLS(tlsCfg *tls.Config) error {
+	security.RestrictTLS(tlsCfg)
+	for i := range tlsCfg.Certificates {
+		if err := security.CheckFIPSCertificate(&tlsCfg.Certificates[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
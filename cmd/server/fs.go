@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// agentPath is a file system path on an agent, cleaned for policy
+// matching. Windows paths use backslashes and compare case-insensitively;
+// internally both forms are handled with forward slashes.
+type agentPath struct {
+	slash   string // cleaned, forward slashes
+	windows bool
+}
+
+// parseAgentPath cleans p as an absolute path on an agent running goos.
+// Relative paths and Windows UNC paths are rejected.
+func parseAgentPath(p, goos string) (agentPath, bool) {
+	ap := agentPath{windows: goos == "windows"}
+	if ap.windows {
+		p = strings.ReplaceAll(p, `\`, "/")
+		if len(p) < 3 || p[1] != ':' || p[2] != '/' {
+			return ap, false
+		}
+		ap.slash = p[:2] + path.Clean(p[2:])
+		return ap, true
+	}
+	if !strings.HasPrefix(p, "/") {
+		return ap, false
+	}
+	ap.slash = path.Clean(p)
+	return ap, true
+}
+
+// native returns the path in the agent's own form.
+func (p agentPath) native() string {
+	if p.windows {
+		return strings.ReplaceAll(p.slash, "/", `\`)
+	}
+	return p.slash
+}
+
+// equal and under compare against another path on the same agent.
+func (p agentPath) equal(o agentPath) bool {
+	if p.windows {
+		return strings.EqualFold(p.slash, o.slash)
+	}
+	return p.slash == o.slash
+}
+
+func (p agentPath) under(root agentPath) bool {
+	prefix := root.slash
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if p.windows {
+		return p.equal(root) || strings.HasPrefix(strings.ToLower(p.slash), strings.ToLower(prefix))
+	}
+	return p.equal(root) || strings.HasPrefix(p.slash, prefix)
+}
+
+// fsRoot returns the fs_policy directory covering p that permits the
+// access, in the agent's native form. Changes to a policy directory
+// itself are never permitted.
+func (s *Server) fsRoot(p agentPath, goos string, write bool) (string, bool) {
+	for _, rule := range s.config().FSPolicy {
+		root, ok := parseAgentPath(rule.Path, goos)
+		if !ok || !p.under(root) || (write && (!rule.Write || p.equal(root))) {
+			continue
+		}
+		return root.native(), true
+	}
+	return "", false
+}
+
+// handleAgentFS lists a directory (GET ?path=) or deletes a file or
+// directory (DELETE ?path=&recursive=1) on a connected agent.
+func (s *Server) handleAgentFS(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		s.fsCommand(w, r, protocol.FSList, q.Get("path"), "", false)
+	case http.MethodDelete:
+		s.fsCommand(w, r, protocol.FSDelete, q.Get("path"), "", q.Get("recursive") == "1")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAgentFSOp serves the remaining file system commands:
+// GET stat?path=, POST mkdir {"path"} and POST rename {"path","new_path"}.
+func (s *Server) handleAgentFSOp(w http.ResponseWriter, r *http.Request) {
+	op := r.PathValue("op")
+	switch {
+	case op == "stat" && r.Method == http.MethodGet:
+		s.fsCommand(w, r, protocol.FSStat, r.URL.Query().Get("path"), "", false)
+	case (op == "mkdir" || op == "rename") && r.Method == http.MethodPost:
+		var body struct {
+			Path    string `json:"path"`
+			NewPath string `json:"new_path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		if op == "mkdir" {
+			s.fsCommand(w, r, protocol.FSMkdir, body.Path, "", false)
+		} else {
+			s.fsCommand(w, r, protocol.FSRename, body.Path, body.NewPath, false)
+		}
+	case op == "stat" || op == "mkdir" || op == "rename":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fsCommand checks a file system command against fs_policy, runs it on
+// the agent and writes the result. Changes and denials are audited;
+// reads are not, since a file manager lists directories constantly.
+func (s *Server) fsCommand(w http.ResponseWriter, r *http.Request, op, rawPath, rawNewPath string, recursive bool) {
+	agent := s.liveAgentOr404(w, r)
+	if agent == nil {
+		return
+	}
+	write := op != protocol.FSList && op != protocol.FSStat
+
+	apiKey := security.APIKeyFromContext(r.Context())
+	audit := func(action, detail string) {
+		s.recordAudit(&store.AuditEvent{
+			Action:    action,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			AgentID:   agent.ID,
+			Detail:    detail,
+		})
+	}
+	detail := fmt.Sprintf("op=%s path=%q", op, rawPath)
+	if op == protocol.FSRename {
+		detail += fmt.Sprintf(" new_path=%q", rawNewPath)
+	}
+	if op == protocol.FSDelete && recursive {
+		detail += " recursive=true"
+	}
+	deny := func() {
+		audit(auditFSDenied, detail)
+		http.Error(w, `{"error":"path not permitted by fs policy"}`, http.StatusForbidden)
+	}
+
+	p, ok := parseAgentPath(rawPath, agent.OS)
+	if !ok {
+		http.Error(w, `{"error":"absolute path required"}`, http.StatusBadRequest)
+		return
+	}
+	root, ok := s.fsRoot(p, agent.OS, write)
+	if !ok {
+		deny()
+		return
+	}
+	req := protocol.FSRequest{ID: security.NewID(), Path: p.native(), Root: root, Recursive: recursive}
+
+	if op == protocol.FSRename {
+		np, ok := parseAgentPath(rawNewPath, agent.OS)
+		if !ok {
+			http.Error(w, `{"error":"absolute new_path required"}`, http.StatusBadRequest)
+			return
+		}
+		if req.NewRoot, ok = s.fsRoot(np, agent.OS, true); !ok {
+			deny()
+			return
+		}
+		req.NewPath = np.native()
+	}
+
+	var res protocol.FSResult
+	if !agent.callOrFail(r.Context(), w, op, req.ID, req, &res) {
+		return
+	}
+	if write {
+		if res.Error != "" {
+			detail += fmt.Sprintf(" error=%q", res.Error)
+		}
+		audit(op, detail)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if res.Error != "" {
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": res.Error}) //nolint:errcheck
+		return
+	}
+	switch op {
+	case protocol.FSList:
+		json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+			"path":    req.Path,
+			"entries": res.Entries,
+		})
+	case protocol.FSDelete:
+		json.NewEncoder(w).Encode(map[string]string{"deleted": req.Path}) //nolint:errcheck
+	default:
+		json.NewEncoder(w).Encode(res.Entry) //nolint:errcheck
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Audit actions for gateway streams.
+const (
+	auditGatewayOpened = "gateway_opened"
+	auditGatewayClosed = "gateway_closed"
+	auditGatewayDenied = "gateway_denied"
+)
+
+// defaultGatewayPorts are reachable under a gateway rule without ports.
+var defaultGatewayPorts = []int{5900, 3389}
+
+// gatewayAllowed reports whether a rule allows a stream to host:port.
+// IP addresses match address and network rules; host names match rules
+// with the same name.
+func gatewayAllowed(rules []GatewayRule, host string, port int) bool {
+	addr, addrErr := netip.ParseAddr(host)
+	for _, rule := range rules {
+		ports := rule.Ports
+		if len(ports) == 0 {
+			ports = defaultGatewayPorts
+		}
+		if !slices.Contains(ports, port) {
+			continue
+		}
+		if addrErr != nil {
+			if strings.EqualFold(rule.Host, host) {
+				return true
+			}
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(rule.Host); err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+		if ruleAddr, err := netip.ParseAddr(rule.Host); err == nil && ruleAddr.Unmap() == addr.Unmap() {
+			return true
+		}
+	}
+	return false
+}
+
+// gatewayRelay is the server's end of one gateway stream: the client
+// WebSocket it is relayed to, and the credit for data sent to the agent.
+type gatewayRelay struct {
+	viewer  protocol.Conn
+	credit  *protocol.Credit
+	toAgent atomic.Int64 // bytes from the client
+	toPeer  atomic.Int64 // bytes from the target
+}
+
+// addGateway registers relay under a new stream number.
+func (a *LiveAgent) addGateway(relay *gatewayRelay) uint32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.gateways == nil {
+		a.gateways = make(map[uint32]*gatewayRelay)
+	}
+	a.nextStream++
+	a.gateways[a.nextStream] = relay
+	return a.nextStream
+}
+
+// gateway returns the relay for stream, or nil once it is closed.
+func (a *LiveAgent) gateway(stream uint32) *gatewayRelay {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.gateways[stream]
+}
+
+// removeGateway unregisters stream, reporting false if it was already
+// gone.
+func (a *LiveAgent) removeGateway(stream uint32) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.gateways[stream]
+	delete(a.gateways, stream)
+	return ok
+}
+
+// closeGateways closes the client end of every stream, when the agent
+// disconnects.
+func (a *LiveAgent) closeGateways() {
+	a.mu.Lock()
+	relays := a.gateways
+	a.gateways = nil
+	a.mu.Unlock()
+	for _, relay := range relays {
+		relay.credit.Close()
+		_ = relay.viewer.Close()
+	}
+}
+
+// handleGateway relays a WebSocket to a TCP service on the agent's
+// network, such as a VNC or RDP server on a machine without an agent.
+// Like /ws/viewer it requires a single-use ticket issued for the agent;
+// the target (host and port parameters) must be allowed by the gateway
+// policy. Binary messages carry the raw TCP stream in both directions,
+// so an RFB client such as noVNC can connect directly and authenticate
+// with the target itself. A stream is remote control, so the session's
+// permission mask must include input.
+func (s *Server) handleGateway(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	agentID, host := q.Get("agent"), q.Get("host")
+	port, err := strconv.Atoi(q.Get("port"))
+	if agentID == "" || host == "" || err != nil || port < 1 || port > 65535 {
+		http.Error(w, "agent, host and port parameters required", http.StatusBadRequest)
+		return
+	}
+
+	ticket := s.redeemViewerTicket(q.Get("ticket"), agentID)
+	if ticket == nil || ticket.viewerOnly {
+		http.Error(w, "invalid or expired ticket", http.StatusUnauthorized)
+		return
+	}
+
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	audit := func(action, detail string) {
+		s.recordAudit(&store.AuditEvent{
+			Action:    action,
+			ActorID:   ticket.keyID,
+			ActorName: ticket.keyName,
+			AgentID:   agentID,
+			Detail:    "target=" + target + detail,
+		})
+	}
+	if !gatewayAllowed(s.config().GatewayPolicy, host, port) {
+		audit(auditGatewayDenied, "")
+		http.Error(w, "target not allowed by gateway policy", http.StatusForbidden)
+		return
+	}
+
+	s.mu.RLock()
+	agent, exists := s.agents[agentID]
+	s.mu.RUnlock()
+	switch {
+	case !exists:
+		http.Error(w, "agent not found", http.StatusNotFound)
+		return
+	case !slices.Contains(agent.sessionPermissions(ticket.permissions), protocol.PermInput):
+		audit(auditPermissionDenied, " permission=input")
+		http.Error(w, "remote control of this agent is not permitted", http.StatusForbidden)
+		return
+	case agent.fileCredit == nil:
+		http.Error(w, "agent does not support gateway streams", http.StatusNotImplemented)
+		return
+	case slices.Contains(agent.Disabled, protocol.CapGateway):
+		http.Error(w, "gateway capability is disabled on this agent", http.StatusForbidden)
+		return
+	}
+
+	conn, err := s.upgradeWebSocket(w, r)
+	if err != nil {
+		log.Printf("Gateway upgrade error: %v", err)
+		return
+	}
+	defer s.watchConn(conn, nil)()
+
+	relay := &gatewayRelay{viewer: conn, credit: protocol.NewCredit()}
+	stream := agent.addGateway(relay)
+	defer func() {
+		if agent.removeGateway(stream) {
+			payload, _ := json.Marshal(protocol.GatewayClose{Stream: stream})
+			msg, _ := json.Marshal(protocol.Message{Type: "gateway_close", Payload: payload})
+			_ = agent.write(protocol.OpText, msg)
+		}
+		relay.credit.Close()
+		_ = conn.Close()
+	}()
+
+	req := protocol.GatewayOpen{ID: security.NewID(), Stream: stream, Host: host, Port: port, Operator: ticket.keyName}
+	var res protocol.GatewayResult
+	if err := agent.call(r.Context(), "gateway_open", req.ID, req, &res); err != nil {
+		res.Error = err.Error()
+	}
+	if res.Error != "" {
+		log.Printf("Gateway to %s via %s failed: %s", target, agent.Name, res.Error)
+		_ = conn.WriteFrame(protocol.OpClose, closePayload(1011, res.Error))
+		return
+	}
+
+	started := time.Now()
+	audit(auditGatewayOpened, " remote_addr="+r.RemoteAddr)
+	log.Printf("Gateway stream %d to %s via %s opened by %s", stream, target, agent.Name, ticket.keyName)
+
+	s.gatewayClientLoop(agent, stream, relay)
+
+	audit(auditGatewayClosed, fmt.Sprintf(" duration_seconds=%d bytes_sent=%d bytes_received=%d",
+		int(time.Since(started).Seconds()), relay.toAgent.Load(), relay.toPeer.Load()))
+}
+
+// gatewayClientLoop relays the client's binary messages to the agent,
+// split into BinGateway frames paced by the stream's credit, until the
+// client or the stream closes.
+func (s *Server) gatewayClientLoop(agent *LiveAgent, stream uint32, relay *gatewayRelay) {
+	for {
+		opcode, data, err := relay.viewer.ReadFrame()
+		if err != nil || opcode == protocol.OpClose {
+			return
+		}
+		switch opcode {
+		case protocol.OpPing:
+			_ = relay.viewer.WriteFrame(protocol.OpPong, data)
+		case protocol.OpBinary:
+			for chunk := range slices.Chunk(data, protocol.GatewayChunkSize) {
+				frame := protocol.GatewayFrame(stream, chunk)
+				if !relay.credit.Spend(len(frame)) || agent.write(protocol.OpBinary, frame) != nil {
+					return
+				}
+				relay.toAgent.Add(int64(len(chunk)))
+				agent.relayed.Add(int64(len(frame)))
+			}
+		}
+	}
+}
+
+// relayGateway forwards a BinGateway frame from the agent to its
+// stream's client and grants the credit back once it is written.
+func (s *Server) relayGateway(agent *LiveAgent, frame []byte) {
+	stream, data, err := protocol.ParseGatewayFrame(frame)
+	if err != nil {
+		return
+	}
+	relay := agent.gateway(stream)
+	if relay == nil {
+		return
+	}
+	_ = relay.viewer.WriteFrame(protocol.OpBinary, data)
+	relay.toPeer.Add(int64(len(data)))
+	agent.relayed.Add(int64(len(frame)))
+	_ = agent.write(protocol.OpBinary, protocol.GatewayCreditGrant(stream, len(frame)))
+}
+
+// endGateway closes the client end of a stream the agent has ended.
+func (s *Server) endGateway(agent *LiveAgent, payload json.RawMessage) {
+	var msg protocol.GatewayClose
+	if json.Unmarshal(payload, &msg) != nil {
+		return
+	}
+	relay := agent.gateway(msg.Stream)
+	if relay == nil || !agent.removeGateway(msg.Stream) {
+		return
+	}
+	reason := "connection closed by the target"
+	if msg.Error != "" {
+		reason = msg.Error
+	}
+	_ = relay.viewer.WriteFrame(protocol.OpClose, closePayload(1000, reason))
+	relay.credit.Close()
+	_ = relay.viewer.Close()
+}
+
+// closePayload builds a WebSocket close frame payload: the status code
+// followed by the reason, truncated to fit a control frame.
+func closePayload(code uint16, reason string) []byte {
+	if len(reason) > 123 {
+		reason = strings.ToValidUTF8(reason[:123], "")
+	}
+	return append(binary.BigEndian.AppendUint16(nil, code), reason...)
+}
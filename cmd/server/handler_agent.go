@@ -1,33 +1,73 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	"github.com/avaropoint/rmm/internal/protocol"
 	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
 )
 
+// Presence events, published as agents connect and disconnect, and when
+// a connected agent's displays change.
+const (
+	eventAgentOnline   = "agent.online"
+	eventAgentOffline  = "agent.offline"
+	eventAgentDisplays = "agent.displays_changed"
+)
+
+// agentPresence describes a connected agent in presence events and
+// Redis presence keys.
+type agentPresence struct {
+	Name     string `json:"name"`
+	Hostname string `json:"hostname"`
+	OS       string `json:"os"`
+	IP       string `json:"ip"`
+	OrgID    string `json:"org_id,omitempty"`
+	Site     string `json:"site,omitempty"`
+}
+
+func (a *LiveAgent) presence() agentPresence {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return agentPresence{Name: a.Name, Hostname: a.Hostname, OS: a.OS, IP: a.IP, OrgID: a.OrgID, Site: a.Site}
+}
+
 // handleAgent manages the lifecycle of an agent connection.
 // Agents must present a valid credential in their registration message.
 func (s *Server) handleAgent(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgradeWebSocket(w, r)
+	if s.agentsFull() {
+		refuseFull(w)
+		return
+	}
+	conn, err := s.upgradeWebSocket(w, r)
 	if err != nil {
 		log.Printf("WebSocket upgrade failed: %v", err)
 		http.Error(w, "WebSocket upgrade failed", http.StatusBadRequest)
 		return
 	}
-
-	reader := bufio.NewReader(conn)
+	// The agent is told when to come back if the server shuts down
+	// once it has registered.
+	var live atomic.Pointer[LiveAgent]
+	defer s.watchConn(conn, func() {
+		if agent := live.Load(); agent != nil {
+			s.sendClosing(agent)
+		}
+	})()
 
 	// Read registration message.
 	_ = conn.SetReadDeadline(time.Now().Add(registrationTimeout))
-	opcode, data, err := protocol.ReadFrame(reader)
+	opcode, data, err := conn.ReadFrame()
 	if err != nil || opcode != protocol.OpText {
 		_ = conn.Close()
 		return
@@ -61,68 +101,166 @@ func (s *Server) handleAgent(w http.ResponseWriter, r *http.Request) {
 
 	// Confirm agent exists in enrollment database.
 	credHash := security.CredentialHash(reg.Credential)
-	enrolled, err := s.store.GetAgentByCredential(context.Background(), credHash)
+	enrolled, err := s.store.GetAgentByCredential(r.Context(), credHash)
 	if err != nil || enrolled == nil {
 		log.Printf("Agent rejected: not enrolled (id=%s)", agentID)
 		_ = conn.Close()
 		return
 	}
 
+	if enrolled.AttestationKey != "" {
+		if err := s.challengeAgent(conn, enrolled); err != nil {
+			log.Printf("Agent rejected: attestation failed (id=%s): %v", agentID, err)
+			s.recordAudit(&store.AuditEvent{
+				Action:  auditAttestationFailed,
+				AgentID: enrolled.ID,
+				Detail:  fmt.Sprintf("reason=%q remote_addr=%s", err.Error(), r.RemoteAddr),
+			})
+			_ = conn.Close()
+			return
+		}
+	}
+
 	displayCount := reg.DisplayCount
 	if displayCount < 1 {
 		displayCount = 1
 	}
 
 	agent := newLiveAgent(enrolled, &reg, r.RemoteAddr, displayCount, conn)
+	agent.signer = s.platform
+	cfg := s.config()
+	// The agent adds the locked classes to its own on receipt.
+	for _, c := range cfg.DisabledCapabilities {
+		if !slices.Contains(agent.Disabled, c) {
+			agent.Disabled = append(agent.Disabled, c)
+		}
+	}
+	slices.Sort(agent.Disabled)
 
-	s.mu.Lock()
-	s.agents[agent.ID] = agent
-	s.mu.Unlock()
+	if err := s.admitAgent(agent); err != nil {
+		log.Printf("Agent refused: %s (%s): %v", agent.Name, agent.ID, err)
+		refusal, _ := json.Marshal(protocol.RegistrationRefused{
+			Error:        err.Error(),
+			RetryAfterMS: quotaRetry().Milliseconds(),
+		})
+		msg, _ := json.Marshal(protocol.Message{Type: "registration_refused", Payload: refusal})
+		_ = conn.WriteFrame(protocol.OpText, msg)
+		_ = conn.Close()
+		return
+	}
 
 	log.Printf("Agent registered: %s (%s) - %s/%s", agent.Name, agent.ID, agent.OS, agent.Arch)
+	presence := agent.presence()
+	s.publishEvent(eventAgentOnline, agent.ID, presence)
+	if s.redis != nil {
+		s.redis.setPresence(agent.ID, presence)
+	}
+
+	respPayload, _ := json.Marshal(protocol.Registered{
+		ID:          enrolled.ID,
+		FlowControl: true,
+		PlatformKey: base64.StdEncoding.EncodeToString(s.platform.PublicKey),
 
-	respPayload, _ := json.Marshal(map[string]string{"id": enrolled.ID})
+		DisabledCapabilities: cfg.DisabledCapabilities,
+		Branding:             s.agentBranding(r.Context(), enrolled.OrgID),
+		Servers:              cfg.ServerURLs,
+	})
 	resp, _ := json.Marshal(protocol.Message{
 		Type:    "registered",
 		Payload: respPayload,
 	})
-	_ = protocol.WriteServerFrame(conn, protocol.OpText, resp)
+	_ = conn.WriteFrame(protocol.OpText, resp)
 	_ = conn.SetReadDeadline(time.Time{})
+	live.Store(agent)
+
+	go s.deliverDropbox(agent)
+	go s.checkSSHDrift(agent)
 
 	defer func() {
-		s.mu.Lock()
-		delete(s.agents, agent.ID)
-		s.mu.Unlock()
+		current := s.forgetAgent(agent)
 		_ = conn.Close()
+		if agent.fileCredit != nil {
+			agent.fileCredit.Close()
+		}
+		agent.closeGateways()
+		s.abortDiagnostics(agent)
+		if !current {
+			// A newer connection of the agent took over; it is still
+			// online.
+			log.Printf("Agent connection replaced: %s", agent.Name)
+			return
+		}
+		// Not r.Context(): this runs during shutdown too.
 		_ = s.store.UpdateAgentSeen(context.Background(), agent.ID, time.Now())
 		log.Printf("Agent disconnected: %s", agent.Name)
+		s.publishEvent(eventAgentOffline, agent.ID, agent.presence())
+		if s.redis != nil {
+			s.redis.clearPresence(agent.ID)
+		}
 	}()
 
-	s.agentMessageLoop(agent, reader, conn)
+	s.agentMessageLoop(agent, conn)
 }
 
 // agentMessageLoop reads and dispatches messages from an agent connection.
-func (s *Server) agentMessageLoop(agent *LiveAgent, reader *bufio.Reader, conn net.Conn) {
+// Frames are read into a reused buffer, so every message is handled (or
+// relayed) before the next one is read.
+func (s *Server) agentMessageLoop(agent *LiveAgent, conn protocol.Conn) {
 	for {
-		opcode, data, err := protocol.ReadFrame(reader)
+		opcode, data, err := conn.ReadFrame()
 		if err != nil {
 			break
 		}
 
-		agent.LastSeen = time.Now()
+		if agent.seen(time.Now()) {
+			s.publishEvent(eventAgentStatus, agent.ID, agent.status())
+		}
 
 		switch opcode {
 		case protocol.OpClose:
 			return
 		case protocol.OpPing:
-			_ = protocol.WriteServerFrame(conn, protocol.OpPong, data)
+			_ = conn.WriteFrame(protocol.OpPong, data)
+			continue
+		case protocol.OpPong:
+			agent.latency.pong(agentLink, data)
 			continue
 		case protocol.OpBinary:
+			if len(data) == 0 {
+				continue
+			}
+			switch data[0] {
+			case protocol.BinControl:
+				s.handleAgentCredit(agent, data)
+				continue
+			case protocol.BinGateway:
+				s.relayGateway(agent, data)
+				continue
+			case protocol.BinFile:
+				s.receiveDiagnosticsChunk(agent, data)
+				continue
+			}
 			s.mu.RLock()
 			if vc, ok := s.viewers[agent.ID]; ok {
-				_ = protocol.WriteServerFrame(vc, protocol.OpBinary, data)
+				began := time.Now()
+				_ = vc.WriteFrame(protocol.OpBinary, data)
+				agent.relay.relayed(len(data), time.Since(began))
+				agent.relayed.Add(int64(len(data)))
 			}
 			s.mu.RUnlock()
+			// Screen credit comes back once the frame is on its way to the
+			// viewer (or dropped), so a slow viewer slows the agent down
+			// instead of queueing frames ahead of its control messages.
+			// Per-display and tile frames spend the same screen credit.
+			switch data[0] {
+			case protocol.BinScreen, protocol.BinDisplay:
+				agent.recordFrame(data)
+				fallthrough
+			case protocol.BinTiles:
+				if agent.fileCredit != nil {
+					_ = agent.write(protocol.OpBinary, protocol.CreditGrant(protocol.BinScreen, len(data)))
+				}
+			}
 		case protocol.OpText:
 			s.handleAgentTextMessage(agent, data)
 		}
@@ -135,15 +273,306 @@ func (s *Server) handleAgentTextMessage(agent *LiveAgent, data []byte) {
 	if err := json.Unmarshal(data, &m); err != nil {
 		return
 	}
+	s.debugf("Agent %s: %s message (%d bytes)", agent.ID, m.Type, len(data))
 
 	switch m.Type {
-	case "display_switched":
-		s.mu.RLock()
-		if vc, ok := s.viewers[agent.ID]; ok {
-			_ = protocol.WriteServerFrame(vc, protocol.OpText, data)
+	case "print_status":
+		var st protocol.PrintStatus
+		_ = json.Unmarshal(m.Payload, &st)
+		detail := fmt.Sprintf("status=%s job=%q", st.Status, st.Job)
+		if st.Error != "" {
+			detail += fmt.Sprintf(" error=%q", st.Error)
 		}
-		s.mu.RUnlock()
+		s.recordAudit(&store.AuditEvent{Action: auditPrintStatus, AgentID: agent.ID, Detail: detail})
+		s.relayToViewer(agent, data)
+	case "file_progress":
+		// Progress on a drop-box delivery goes to the delivery, not the
+		// viewer.
+		var p protocol.FileProgress
+		_ = json.Unmarshal(m.Payload, &p)
+		if !agent.awaiting(p.ID) {
+			s.relayToViewer(agent, data)
+		} else if p.Done || p.Error != "" {
+			agent.resolveCall(m.Payload)
+		} else {
+			s.publishEvent(eventDropboxProgress, agent.ID, p)
+		}
+	case "display_switched", "view_changed", "resolution_changed":
+		s.relayToViewer(agent, data)
+	case "frame_stamp":
+		var st protocol.FrameStamp
+		if json.Unmarshal(m.Payload, &st) != nil {
+			return
+		}
+		agent.latency.stamped(st)
+		s.relayToViewer(agent, data)
+	case "displays_changed":
+		var dc protocol.DisplaysChanged
+		if json.Unmarshal(m.Payload, &dc) != nil {
+			return
+		}
+		dc.DisplayCount = max(dc.DisplayCount, 1)
+		agent.mu.Lock()
+		agent.Displays, agent.DisplayCount = dc.Displays, dc.DisplayCount
+		agent.mu.Unlock()
+		log.Printf("Agent %s: displays changed (%d connected)", agent.ID, dc.DisplayCount)
+		s.relayToViewer(agent, data)
+		s.publishEvent(eventAgentDisplays, agent.ID, dc)
 	case "heartbeat":
-		agent.Status = "online"
+		var hb protocol.Heartbeat
+		if len(m.Payload) > 0 && json.Unmarshal(m.Payload, &hb) == nil {
+			agent.mu.Lock()
+			if hb.UptimeSeconds > 0 {
+				agent.UptimeSeconds = hb.UptimeSeconds
+			}
+			agent.RebootRequired, agent.RebootReasons = hb.RebootRequired, hb.RebootReasons
+			agent.TopCPU, agent.TopMemory = hb.TopCPU, hb.TopMemory
+			if hb.Health != nil {
+				agent.CPUPercent = hb.Health.CPU
+				agent.MemoryFree, agent.DiskFree = hb.Health.MemoryFree, hb.Health.DiskFree
+			}
+			if hb.Time > 0 {
+				// Transit time counts against the agent, which is noise
+				// next to the drift worth alerting on.
+				drift := hb.Time - time.Now().UnixMilli()
+				agent.ClockDriftMS = &drift
+			}
+			if hb.TimeSync != nil {
+				agent.TimeSync = hb.TimeSync
+			}
+			agent.mu.Unlock()
+			if hb.Health != nil {
+				go s.evaluateAlerts(agent)
+				go s.recordHealth(agent.ID, hb.Health)
+			}
+		}
+		if s.redis != nil {
+			s.redis.setPresence(agent.ID, agent.presence())
+		}
+	case "registry_result", "startup_result", "fs_result", "screenshot_result", "power_result", "permissions_result", "ssh_keys_result", "gateway_result", "action_result", "plugin_result", "hostconfig_result", "capture_stats", "session_diagnostics_result":
+		agent.resolveCall(m.Payload)
+	case "support_request":
+		var req protocol.SupportRequest
+		if json.Unmarshal(m.Payload, &req) == nil {
+			s.raiseHand(agent.ID, agent.Name, req)
+		}
+	case "backlog":
+		s.handleBacklog(agent, m.Payload)
+	case "plugin_results":
+		s.handlePluginResults(agent, m.Payload)
+	case "inventory":
+		var reg protocol.Registration
+		if json.Unmarshal(m.Payload, &reg) == nil {
+			agent.applyInventory(&reg)
+			log.Printf("Agent %s: inventory refreshed", agent.ID)
+			if s.redis != nil {
+				s.redis.setPresence(agent.ID, agent.presence())
+			}
+		}
+	case "gateway_close":
+		s.endGateway(agent, m.Payload)
+	case "file_start":
+		s.startDiagnosticsUpload(agent, m.Payload)
+	case "file_end":
+		s.finishDiagnosticsUpload(agent, m.Payload)
+	case "diagnostics_result":
+		s.handleDiagnosticsResult(agent, m.Payload)
+	case "reboot_notice_result":
+		s.handleRebootNoticeResult(agent, m.Payload)
+	case "software_result":
+		s.handleSoftwareResult(agent, m.Payload)
+	case "end_session":
+		// The local user ended the session from the agent's tray
+		// indicator. Closing the viewer runs the usual teardown.
+		s.mu.RLock()
+		vc, ok := s.viewers[agent.ID]
+		s.mu.RUnlock()
+		if !ok {
+			return
+		}
+		log.Printf("Agent %s: session ended by the local user", agent.Name)
+		s.recordAudit(&store.AuditEvent{Action: auditSessionEndedLocally, AgentID: agent.ID})
+		msg, _ := json.Marshal(protocol.Message{Type: "session_ended",
+			Payload: json.RawMessage(`{"reason":"ended by the local user"}`)})
+		_ = vc.WriteFrame(protocol.OpText, msg)
+		_ = vc.Close()
+	case "consent_response":
+		var resp struct {
+			Granted bool `json:"granted"`
+		}
+		_ = json.Unmarshal(m.Payload, &resp)
+		agent.resolveConsent(resp.Granted)
+	}
+}
+
+// relayToViewer forwards an agent message to the agent's viewer, if any.
+func (s *Server) relayToViewer(agent *LiveAgent, data []byte) {
+	s.mu.RLock()
+	if vc, ok := s.viewers[agent.ID]; ok {
+		_ = vc.WriteFrame(protocol.OpText, data)
+		agent.relayed.Add(int64(len(data)))
+	}
+	s.mu.RUnlock()
+}
+
+// agentCallTimeout bounds how long an API call waits for the agent to
+// answer a request.
+const agentCallTimeout = 15 * time.Second
+
+// errAgentTimeout is returned when the agent does not answer in time.
+var errAgentTimeout = errors.New("agent did not respond")
+
+// call sends a request message to the agent and decodes the "*_result"
+// message that answers it into result. id must be the request's own ID
+// (a fresh security.NewID()); the agent echoes it in the result. It gives
+// up early when ctx is done, e.g. because the API client went away.
+func (a *LiveAgent) call(ctx context.Context, msgType, id string, req, result any) error {
+	ch := a.expect(id)
+	defer a.forget(id)
+
+	if err := a.send(msgType, req); err != nil {
+		return err
+	}
+	select {
+	case data := <-ch:
+		return json.Unmarshal(data, result)
+	case <-time.After(agentCallTimeout):
+		return errAgentTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// send writes a message to the agent without waiting for an answer,
+// signing it if it is a high-impact command.
+func (a *LiveAgent) send(msgType string, req any) error {
+	payload, _ := json.Marshal(req)
+	m := protocol.Message{Type: msgType, Payload: payload}
+	if _, signed := protocol.RequiresSignature(msgType); signed {
+		m.Signed = a.signCommand(msgType, payload)
+	}
+	msg, _ := json.Marshal(m)
+	return a.write(protocol.OpText, msg)
+}
+
+// signCommand authorizes a high-impact command for this agent with the
+// platform key (see protocol.CommandDigest).
+func (a *LiveAgent) signCommand(msgType string, payload []byte) *protocol.CommandSignature {
+	issued := time.Now().Unix()
+	sig := a.signer.Sign(protocol.CommandDigest(msgType, a.ID, issued, payload))
+	return &protocol.CommandSignature{
+		AgentID:   a.ID,
+		IssuedAt:  issued,
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	}
+}
+
+// expect registers id as awaiting a result from the agent; resolveCall
+// delivers it on the returned channel. Callers must forget the ID when
+// done.
+func (a *LiveAgent) expect(id string) chan json.RawMessage {
+	ch := make(chan json.RawMessage, 1)
+	a.mu.Lock()
+	if a.pending == nil {
+		a.pending = make(map[string]chan json.RawMessage)
+	}
+	a.pending[id] = ch
+	a.mu.Unlock()
+	return ch
+}
+
+func (a *LiveAgent) forget(id string) {
+	a.mu.Lock()
+	delete(a.pending, id)
+	a.mu.Unlock()
+}
+
+// awaiting reports whether a server-side call is waiting on id.
+func (a *LiveAgent) awaiting(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.pending[id]
+	return ok
+}
+
+// write sends one frame to the agent.
+func (a *LiveAgent) write(opcode byte, data []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.conn.WriteFrame(opcode, data)
+}
+
+// handleAgentCredit applies a credit grant from the agent.
+func (s *Server) handleAgentCredit(agent *LiveAgent, frame []byte) {
+	if stream, n, err := protocol.ParseGatewayCreditGrant(frame); err == nil {
+		if relay := agent.gateway(stream); relay != nil {
+			relay.credit.Grant(n)
+		}
+		return
+	}
+	ch, n, err := protocol.ParseCreditGrant(frame)
+	if err != nil || agent.fileCredit == nil {
+		return
+	}
+	if ch == protocol.BinFile {
+		agent.fileCredit.Grant(n)
+	}
+}
+
+// sendFileChunk writes a BinFile frame to the agent, waiting for credit
+// if the agent paces its file channel.
+func (a *LiveAgent) sendFileChunk(frame []byte) error {
+	if a.fileCredit != nil && !a.fileCredit.Spend(len(frame)) {
+		return net.ErrClosed
+	}
+	return a.write(protocol.OpBinary, frame)
+}
+
+// beginTransfer claims the agent's file channel, which carries one upload
+// at a time; it reports false if another upload holds it.
+func (a *LiveAgent) beginTransfer() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.transferring {
+		return false
+	}
+	a.transferring = true
+	return true
+}
+
+func (a *LiveAgent) endTransfer() {
+	a.mu.Lock()
+	a.transferring = false
+	a.mu.Unlock()
+}
+
+// callOrFail runs call and writes a gateway error to w on failure.
+func (a *LiveAgent) callOrFail(ctx context.Context, w http.ResponseWriter, msgType, id string, req, result any) bool {
+	err := a.call(ctx, msgType, id, req, result)
+	if errors.Is(err, errAgentTimeout) {
+		http.Error(w, `{"error":"agent did not respond"}`, http.StatusGatewayTimeout)
+		return false
+	} else if err != nil {
+		http.Error(w, `{"error":"agent unreachable"}`, http.StatusBadGateway)
+		return false
+	}
+	return true
+}
+
+// resolveCall delivers a result payload to the call waiting on its ID.
+func (a *LiveAgent) resolveCall(payload json.RawMessage) {
+	var res struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal(payload, &res) != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ch, ok := a.pending[res.ID]; ok {
+		select {
+		case ch <- payload:
+		default:
+		}
 	}
 }
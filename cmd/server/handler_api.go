@@ -1,15 +1,23 @@
 package main
 
 import (
-	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/avaropoint/rmm/internal/protocol"
 	"github.com/avaropoint/rmm/internal/security"
 	"github.com/avaropoint/rmm/internal/store"
+	"github.com/avaropoint/rmm/internal/version"
 )
 
 // handleListAgents returns a JSON list of all connected agents.
@@ -19,28 +27,53 @@ func (s *Server) handleListAgents(w http.ResponseWriter, _ *http.Request) {
 	s.mu.RLock()
 	agents := make([]LiveAgent, 0, len(s.agents))
 	for _, a := range s.agents {
+		a.mu.Lock()
+		uptime := a.UptimeSeconds
+		rebootRequired, rebootReasons := a.RebootRequired, a.RebootReasons
+		topCPU, topMemory := a.TopCPU, a.TopMemory
+		clockDrift, timeSync := a.ClockDriftMS, a.TimeSync
+		cpu, memFree, diskFree := a.CPUPercent, a.MemoryFree, a.DiskFree
+		orgID, site, sensitive := a.OrgID, a.Site, a.Sensitive
+		displays, displayCount := a.Displays, a.DisplayCount
+		permissions := a.Permissions
+		status, lastSeen := a.Status, a.LastSeen
+		a.mu.Unlock()
 		agents = append(agents, LiveAgent{
-			ID:            a.ID,
-			Name:          a.Name,
-			Hostname:      a.Hostname,
-			OS:            a.OS,
-			OSVersion:     a.OSVersion,
-			Arch:          a.Arch,
-			IP:            a.IP,
-			Status:        a.Status,
-			LastSeen:      a.LastSeen,
-			CPUCount:      a.CPUCount,
-			MemoryTotal:   a.MemoryTotal,
-			MemoryFree:    a.MemoryFree,
-			DiskTotal:     a.DiskTotal,
-			DiskFree:      a.DiskFree,
-			Displays:      a.Displays,
-			DisplayCount:  a.DisplayCount,
-			LocalIPs:      a.LocalIPs,
-			Username:      a.Username,
-			UptimeSeconds: a.UptimeSeconds,
-			AgentVersion:  a.AgentVersion,
-			EnrolledAt:    a.EnrolledAt,
+			ID:             a.ID,
+			Name:           a.Name,
+			Hostname:       a.Hostname,
+			OS:             a.OS,
+			OSVersion:      a.OSVersion,
+			Arch:           a.Arch,
+			IP:             a.IP,
+			Status:         status,
+			LastSeen:       lastSeen,
+			CPUCount:       a.CPUCount,
+			MemoryTotal:    a.MemoryTotal,
+			MemoryFree:     memFree,
+			DiskTotal:      a.DiskTotal,
+			DiskFree:       diskFree,
+			Displays:       displays,
+			DisplayCount:   displayCount,
+			LocalIPs:       a.LocalIPs,
+			Username:       a.Username,
+			UptimeSeconds:  uptime,
+			CPUPercent:     cpu,
+			AgentVersion:   a.AgentVersion,
+			EnrolledAt:     a.EnrolledAt,
+			Unattended:     a.Unattended,
+			Sensitive:      sensitive,
+			OrgID:          orgID,
+			Site:           site,
+			Image:          a.Image,
+			RebootRequired: rebootRequired,
+			RebootReasons:  rebootReasons,
+			TopCPU:         topCPU,
+			TopMemory:      topMemory,
+			ClockDriftMS:   clockDrift,
+			TimeSync:       timeSync,
+			Permissions:    permissions,
+			Disabled:       a.Disabled,
 		})
 	}
 	s.mu.RUnlock()
@@ -48,6 +81,110 @@ func (s *Server) handleListAgents(w http.ResponseWriter, _ *http.Request) {
 	json.NewEncoder(w).Encode(agents) //nolint:errcheck
 }
 
+// handleDeleteAgent deletes an agent: its credential stops working, a
+// live connection is closed and work queued for it (drop-box files,
+// schedules, pending deployments) is dropped. Unlike a purge, its history
+// is kept. It takes an admin key.
+func (s *Server) handleDeleteAgent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	if apiKey.Role != store.RoleAdmin {
+		http.Error(w, `{"error":"deleting an agent requires an admin key"}`, http.StatusForbidden)
+		return
+	}
+	agentID := r.PathValue("id")
+	rec, err := s.store.GetAgent(r.Context(), agentID)
+	if err != nil || rec == nil {
+		http.Error(w, `{"error":"agent not found"}`, http.StatusNotFound)
+		return
+	}
+	dropbox, err := s.store.ListDropboxFiles(r.Context(), agentID)
+	if err != nil {
+		http.Error(w, `{"error":"failed to list drop-box files"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// The row goes first: once it is gone the agent cannot register
+	// again, so closing its connection below cannot race a reconnect.
+	counts, err := s.store.DeleteAgent(r.Context(), agentID)
+	if err != nil {
+		log.Printf("Delete of %s: %v", agentID, err)
+		http.Error(w, `{"error":"failed to delete agent"}`, http.StatusInternalServerError)
+		return
+	}
+	for _, f := range dropbox {
+		if f.Status == store.DropboxPending {
+			_ = os.Remove(s.dropboxPath(f.ID))
+		}
+	}
+	s.mu.RLock()
+	live, online := s.agents[agentID]
+	s.mu.RUnlock()
+	if online {
+		// The agent's connection handler unregisters it and publishes it
+		// offline.
+		_ = live.conn.Close()
+	}
+	s.forgetTelemetry(agentID)
+
+	tables := make([]string, 0, len(counts))
+	for table, n := range counts {
+		tables = append(tables, fmt.Sprintf("%s=%d", table, n))
+	}
+	sort.Strings(tables)
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditAgentDeleted,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   agentID,
+		Detail:    fmt.Sprintf("name=%q hostname=%q online=%t %s", rec.Name, rec.Hostname, online, strings.Join(tables, " ")),
+	})
+	log.Printf("Agent deleted: %s (%s) by %s", rec.Name, agentID, apiKey.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{ //nolint:errcheck
+		"deleted":      agentID,
+		"disconnected": online,
+		"rows":         counts,
+	})
+}
+
+// handleServerStatus reports the server's version, identity and
+// cryptographic mode.
+func (s *Server) handleServerStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+		"version":        version.Version,
+		"build_time":     version.BuildTime,
+		"platform":       s.platform.Fingerprint(),
+		"uptime_seconds": int64(time.Since(s.startedAt).Seconds()),
+		"fips": map[string]bool{
+			"enforced":      s.fips,
+			"module_active": security.FIPSEnabled(),
+		},
+	})
+}
+
+// handleHealth answers health checks from agents choosing among servers
+// and from load balancers: 200 while serving, 503 once shutting down.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if s.ctx.Err() != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"status":"shutting down"}`))
+		return
+	}
+	_, _ = w.Write([]byte(`{"status":"ok"}`))
+}
+
 // handleEnroll processes agent enrollment requests.
 // Agents POST with an enrollment code and receive credentials in return.
 func (s *Server) handleEnroll(w http.ResponseWriter, r *http.Request) {
@@ -56,12 +193,24 @@ func (s *Server) handleEnroll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Counted for the enrollment metrics and leaked-token alerts (see
+	// enrollstats.go) once the outcome is known.
+	var pending *store.EnrollmentToken
+	outcome := enrollOutcomeInvalid
+	defer func() { s.recordEnrollment(pending, r.RemoteAddr, outcome) }()
+
 	var req struct {
 		Code     string `json:"code"`
 		Name     string `json:"name"`
 		Hostname string `json:"hostname"`
 		OS       string `json:"os"`
 		Arch     string `json:"arch"`
+
+		MACAddresses []string `json:"mac_addresses"`
+		MachineID    string   `json:"machine_id"`
+
+		Attestation *protocol.Attestation `json:"attestation"`
+		Provenance  *protocol.Provenance  `json:"provenance"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
@@ -76,7 +225,56 @@ func (s *Server) handleEnroll(w http.ResponseWriter, r *http.Request) {
 	codeHash := security.HashEnrollmentCode(req.Code)
 	agentID := security.HashAPIKey(req.Code + s.platform.Fingerprint())[:16]
 
-	token, err := s.store.ConsumeEnrollmentToken(context.Background(), codeHash, agentID)
+	if err := s.verifyEnrollAttestation(req.Code, req.Attestation); err != nil {
+		outcome = enrollOutcomeRejected
+		s.recordAudit(&store.AuditEvent{
+			Action: auditEnrollmentRejected,
+			Detail: fmt.Sprintf("reason=%q hostname=%s remote_addr=%s", err.Error(), req.Hostname, r.RemoteAddr),
+		})
+		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusForbidden)
+		return
+	}
+
+	pending, err := s.store.GetEnrollmentToken(r.Context(), codeHash)
+	if err != nil {
+		pending = nil
+	}
+	if pending != nil {
+		outcome = enrollOutcomeRejected
+	}
+	// A provisioning token enrolls every clone of an image, so its agents
+	// cannot take their IDs from the code.
+	if pending != nil && pending.Type == store.TokenProvisioning {
+		agentID = security.NewID()
+	}
+
+	// Bound tokens are checked before consumption so a leaked code tried
+	// from the wrong machine stays usable by the intended one.
+	if pending != nil && pending.Bound() {
+		id := security.MachineIdentity{Hostname: req.Hostname, MACs: req.MACAddresses, MachineID: req.MachineID}
+		if err := security.CheckBinding(pending, id); err != nil {
+			s.recordAudit(&store.AuditEvent{
+				Action: auditEnrollmentRejected,
+				Detail: fmt.Sprintf("token=%s reason=%q hostname=%s machine_id=%s remote_addr=%s",
+					pending.ID, err.Error(), req.Hostname, req.MachineID, r.RemoteAddr),
+			})
+			http.Error(w, `{"error":"enrollment code is bound to a different machine"}`, http.StatusForbidden)
+			return
+		}
+	}
+
+	if pending != nil && !s.enrollments.allow(pending.OrgID, s.config().Quotas.orgEnrollments(pending.OrgID)) {
+		s.recordAudit(&store.AuditEvent{
+			Action: auditEnrollmentRejected,
+			Detail: fmt.Sprintf("token=%s reason=%q hostname=%s remote_addr=%s",
+				pending.ID, "enrollment rate quota", req.Hostname, r.RemoteAddr),
+		})
+		w.Header().Set("Retry-After", strconv.Itoa(int(quotaRetry().Seconds())))
+		http.Error(w, `{"error":"the organization has reached its enrollment rate limit; try again later"}`, http.StatusTooManyRequests)
+		return
+	}
+
+	token, err := s.store.ConsumeEnrollmentToken(r.Context(), codeHash, agentID, req.Hostname)
 	if err != nil {
 		log.Printf("Enrollment failed: %v", err)
 		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusForbidden)
@@ -100,14 +298,42 @@ func (s *Server) handleEnroll(w http.ResponseWriter, r *http.Request) {
 		CredentialHash: credHash,
 		EnrolledAt:     now,
 		LastSeen:       now,
+		Unattended:     token.Type == "unattended",
+		OrgID:          token.OrgID,
+		Site:           token.Site,
+		Image:          token.Image,
+	}
+	if token.Type == store.TokenProvisioning && req.Provenance != nil && req.Provenance.Image != "" {
+		agentRec.Image = provenanceImage(req.Provenance.Image)
 	}
-	if err := s.store.CreateAgent(context.Background(), agentRec); err != nil {
+	if req.Attestation != nil {
+		agentRec.AttestationType = req.Attestation.Type
+		agentRec.AttestationKey = req.Attestation.PublicKey
+	}
+	if err := s.store.CreateAgent(r.Context(), agentRec); err != nil {
 		log.Printf("Failed to store agent: %v", err)
 		http.Error(w, `{"error":"enrollment failed"}`, http.StatusInternalServerError)
 		return
 	}
+	outcome = enrollOutcomeEnrolled
 
+	if token.Type == store.TokenProvisioning {
+		s.recordProvisioned(agentRec, token, req.Provenance, req.MachineID, r.RemoteAddr)
+	} else {
+		s.forgetCode(token.ID)
+	}
 	log.Printf("Agent enrolled: %s (%s) via %s token", req.Name, agentID, token.Type)
+	if agentRec.AttestationType != "" {
+		log.Printf("Agent %s bound to a %s key", agentID, agentRec.AttestationType)
+	}
+	if token.HostnameMismatch {
+		s.recordAudit(&store.AuditEvent{
+			Action:  auditEnrollmentMismatch,
+			AgentID: agentID,
+			Detail: fmt.Sprintf("token=%s expected=%s actual=%s remote_addr=%s",
+				token.ID, token.ExpectedHostname, req.Hostname, r.RemoteAddr),
+		})
+	}
 
 	var caCert string
 	if s.tlsPaths != nil {
@@ -116,14 +342,26 @@ func (s *Server) handleEnroll(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	resp := map[string]string{
+	// Signed so an agent bootstrapping without TLS verification can check
+	// the reply against the fingerprint printed with its code.
+	var caCertHash string
+	if caCert != "" {
+		sum := sha256.Sum256([]byte(caCert))
+		caCertHash = hex.EncodeToString(sum[:])
+	}
+	resp := map[string]any{
 		"agent_id":             agentID,
 		"credential":           credential,
 		"platform_fingerprint": s.platform.Fingerprint(),
+		"platform_key":         base64.StdEncoding.EncodeToString(s.platform.PublicKey),
+		"signature":            base64.StdEncoding.EncodeToString(s.platform.Sign(protocol.EnrollmentDigest(agentID, credHash, caCertHash))),
 	}
 	if caCert != "" {
 		resp["ca_certificate"] = caCert
 	}
+	if servers := s.config().ServerURLs; len(servers) > 0 {
+		resp["servers"] = servers
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp) //nolint:errcheck
@@ -135,7 +373,7 @@ func (s *Server) handleEnrollmentTokens(w http.ResponseWriter, r *http.Request)
 
 	switch r.Method {
 	case http.MethodGet:
-		tokens, err := s.store.ListEnrollmentTokens(context.Background())
+		tokens, err := s.store.ListEnrollmentTokens(r.Context())
 		if err != nil {
 			http.Error(w, `{"error":"failed to list tokens"}`, http.StatusInternalServerError)
 			return
@@ -147,13 +385,22 @@ func (s *Server) handleEnrollmentTokens(w http.ResponseWriter, r *http.Request)
 
 	case http.MethodPost:
 		var req struct {
-			Type  string `json:"type"`
-			Label string `json:"label"`
+			Type          string `json:"type"`
+			Label         string `json:"label"`
+			BindHostname  string `json:"bind_hostname"`
+			BindMAC       string `json:"bind_mac"`
+			BindMachineID string `json:"bind_machine_id"`
+			OrgID         string `json:"org_id"`
+			Site          string `json:"site"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
 			return
 		}
+		if !s.orgExists(r.Context(), req.OrgID) {
+			http.Error(w, `{"error":"organization not found"}`, http.StatusBadRequest)
+			return
+		}
 		if req.Type == "" {
 			req.Type = "attended"
 		}
@@ -163,11 +410,17 @@ func (s *Server) handleEnrollmentTokens(w http.ResponseWriter, r *http.Request)
 			http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusBadRequest)
 			return
 		}
-		if err := s.store.CreateEnrollmentToken(context.Background(), token); err != nil {
+		if err := bindToken(token, req.BindHostname, req.BindMAC, req.BindMachineID); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		token.OrgID, token.Site = req.OrgID, strings.TrimSpace(req.Site)
+		if err := s.store.CreateEnrollmentToken(r.Context(), token); err != nil {
 			http.Error(w, `{"error":"failed to create token"}`, http.StatusInternalServerError)
 			return
 		}
 
+		s.rememberCode(token.ID, code, token.ExpiresAt)
 		log.Printf("Enrollment token created: %s (%s)", token.ID, req.Type)
 		json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
 			"id":         token.ID,
@@ -175,6 +428,14 @@ func (s *Server) handleEnrollmentTokens(w http.ResponseWriter, r *http.Request)
 			"type":       token.Type,
 			"label":      token.Label,
 			"expires_at": token.ExpiresAt,
+
+			"platform_fingerprint": s.platform.Fingerprint(),
+
+			"bind_hostname":   token.BindHostname,
+			"bind_mac":        token.BindMAC,
+			"bind_machine_id": token.BindMachineID,
+			"org_id":          token.OrgID,
+			"site":            token.Site,
 		})
 
 	case http.MethodDelete:
@@ -183,10 +444,11 @@ func (s *Server) handleEnrollmentTokens(w http.ResponseWriter, r *http.Request)
 			http.Error(w, `{"error":"id required"}`, http.StatusBadRequest)
 			return
 		}
-		if err := s.store.DeleteEnrollmentToken(context.Background(), id); err != nil {
+		if err := s.store.DeleteEnrollmentToken(r.Context(), id); err != nil {
 			http.Error(w, `{"error":"failed to delete"}`, http.StatusInternalServerError)
 			return
 		}
+		s.forgetCode(id)
 		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"}) //nolint:errcheck
 
 	default:
@@ -194,6 +456,21 @@ func (s *Server) handleEnrollmentTokens(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// bindToken applies optional machine bindings to a new token, normalising
+// the MAC address and machine UUID so they compare reliably at enrollment.
+func bindToken(t *store.EnrollmentToken, hostname, mac, machineID string) error {
+	t.BindHostname = strings.TrimSpace(hostname)
+	if mac = strings.TrimSpace(mac); mac != "" {
+		n, err := security.NormalizeMAC(mac)
+		if err != nil {
+			return err
+		}
+		t.BindMAC = n
+	}
+	t.BindMachineID = security.NormalizeMachineID(machineID)
+	return nil
+}
+
 // handleAuthVerify validates an API key.
 func (s *Server) handleAuthVerify(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -210,7 +487,7 @@ func (s *Server) handleAuthVerify(w http.ResponseWriter, r *http.Request) {
 	}
 
 	keyHash := security.HashAPIKey(req.Key)
-	apiKey, err := s.store.VerifyAPIKey(context.Background(), keyHash)
+	apiKey, err := s.store.VerifyAPIKey(r.Context(), keyHash)
 	if err != nil || apiKey == nil {
 		http.Error(w, `{"error":"invalid API key"}`, http.StatusUnauthorized)
 		return
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// maxBulkTokens caps how many tokens a single bulk request may mint.
+const maxBulkTokens = 500
+
+// bulkEntry describes one token to mint in a bulk request.
+type bulkEntry struct {
+	label     string
+	hostname  string
+	mac       string
+	machineID string
+}
+
+// handleBulkEnrollment mints many enrollment tokens in one call and returns
+// them as CSV (id, label, expected_hostname, type, code, expires_at).
+//
+// The request body is either JSON:
+//
+//	{"type": "unattended", "labels": ["site-a", "site-b"]}
+//	{"type": "unattended", "count": 20, "label": "branch"}
+//
+// or a CSV of expected machines (Content-Type: text/csv), one per row as
+// hostname[,label[,mac[,machine_id]]], with an optional header row. Each
+// row gets its own token expecting that hostname; enrollment from a
+// different machine is allowed but flagged in the token list and audit log.
+// A MAC or machine UUID in the row binds the token, and ?bind=hostname
+// binds the hostname too; bound tokens reject any other machine. The token
+// type for CSV imports comes from ?type= and defaults to unattended.
+// ?org= and ?site= assign every enrolled agent to an organization and a
+// site.
+func (s *Server) handleBulkEnrollment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		tokenType string
+		entries   []bulkEntry
+		err       error
+	)
+	bindHost := r.URL.Query().Get("bind") == "hostname"
+	orgID := r.URL.Query().Get("org")
+	site := strings.TrimSpace(r.URL.Query().Get("site"))
+	if !s.orgExists(r.Context(), orgID) {
+		http.Error(w, `{"error":"organization not found"}`, http.StatusBadRequest)
+		return
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "text/csv" {
+		tokenType = r.URL.Query().Get("type")
+		entries, err = parseHostnameCSV(io.LimitReader(r.Body, 1<<20))
+	} else {
+		tokenType, entries, err = parseBulkJSON(r.Body)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	if len(entries) == 0 {
+		http.Error(w, `{"error":"no tokens requested"}`, http.StatusBadRequest)
+		return
+	}
+	if len(entries) > maxBulkTokens {
+		http.Error(w, fmt.Sprintf(`{"error":"at most %d tokens per request"}`, maxBulkTokens), http.StatusBadRequest)
+		return
+	}
+	if tokenType == "" {
+		tokenType = "unattended"
+	}
+
+	// Mint every token before storing any, then store them together, so a
+	// failure leaves no tokens behind that the caller never saw.
+	type minted struct {
+		token *store.EnrollmentToken
+		code  string
+	}
+	out := make([]minted, 0, len(entries))
+	tokens := make([]*store.EnrollmentToken, 0, len(entries))
+	for _, e := range entries {
+		token, code, err := security.GenerateEnrollmentToken(tokenType, e.label)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		token.ExpectedHostname = e.hostname
+		token.OrgID, token.Site = orgID, site
+		host := ""
+		if bindHost {
+			host = e.hostname
+		}
+		if err := bindToken(token, host, e.mac, e.machineID); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":"%s: %s"}`, e.hostname, err.Error()), http.StatusBadRequest)
+			return
+		}
+		out = append(out, minted{token, code})
+		tokens = append(tokens, token)
+	}
+	if err := s.store.CreateEnrollmentTokens(r.Context(), tokens); err != nil {
+		log.Printf("Bulk enrollment failed: %v", err)
+		http.Error(w, `{"error":"failed to create tokens; none were created"}`, http.StatusInternalServerError)
+		return
+	}
+	for _, m := range out {
+		s.rememberCode(m.token.ID, m.code, m.token.ExpiresAt)
+	}
+	log.Printf("Bulk enrollment: %d %s tokens created", len(out), tokenType)
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(
+		`attachment; filename="enrollment-tokens-%s.csv"`, time.Now().UTC().Format("20060102-150405")))
+	w.Header().Set("Cache-Control", "no-store")
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"id", "label", "expected_hostname", "type", "code", "expires_at"})
+	for _, m := range out {
+		_ = cw.Write([]string{
+			m.token.ID, m.token.Label, m.token.ExpectedHostname, m.token.Type, m.code,
+			m.token.ExpiresAt.UTC().Format(time.RFC3339),
+		})
+	}
+	cw.Flush()
+}
+
+// parseBulkJSON reads a JSON bulk request. Explicit labels take precedence
+// over count; with count, each token is labelled "<label> #n".
+func parseBulkJSON(body io.Reader) (string, []bulkEntry, error) {
+	var req struct {
+		Type   string   `json:"type"`
+		Count  int      `json:"count"`
+		Label  string   `json:"label"`
+		Labels []string `json:"labels"`
+	}
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return "", nil, fmt.Errorf("invalid request")
+	}
+
+	var entries []bulkEntry
+	if len(req.Labels) > 0 {
+		for _, l := range req.Labels {
+			entries = append(entries, bulkEntry{label: strings.TrimSpace(l)})
+		}
+		return req.Type, entries, nil
+	}
+	if req.Count > maxBulkTokens {
+		return "", nil, fmt.Errorf("at most %d tokens per request", maxBulkTokens)
+	}
+	for i := 1; i <= req.Count; i++ {
+		label := req.Label
+		if req.Count > 1 {
+			label = strings.TrimSpace(fmt.Sprintf("%s #%d", req.Label, i))
+		}
+		entries = append(entries, bulkEntry{label: label})
+	}
+	return req.Type, entries, nil
+}
+
+// parseHostnameCSV reads hostname[,label[,mac[,machine_id]]] rows. A first
+// row whose first cell is "hostname" is treated as a header; blank rows are
+// skipped and the label defaults to the hostname.
+func parseHostnameCSV(body io.Reader) ([]bulkEntry, error) {
+	cr := csv.NewReader(body)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+
+	var entries []bulkEntry
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: line %d", line)
+		}
+		host := strings.TrimSpace(rec[0])
+		if line == 1 && strings.EqualFold(host, "hostname") {
+			continue
+		}
+		if host == "" {
+			continue
+		}
+		label := host
+		if len(rec) > 1 && strings.TrimSpace(rec[1]) != "" {
+			label = strings.TrimSpace(rec[1])
+		}
+		e := bulkEntry{label: label, hostname: host}
+		if len(rec) > 2 {
+			e.mac = strings.TrimSpace(rec[2])
+		}
+		if len(rec) > 3 {
+			e.machineID = strings.TrimSpace(rec[3])
+		}
+		entries = append(entries, e)
+		if len(entries) > maxBulkTokens {
+			break
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/qr"
+)
+
+// pendingCode is a freshly issued enrollment code kept in memory so the
+// dashboard can render it as a QR code. Only the hash is persisted; the
+// plaintext lives here until the token is used, deleted, or expires, and
+// is lost on restart.
+type pendingCode struct {
+	code      string
+	expiresAt time.Time
+}
+
+// rememberCode stores the plaintext code for token id until it expires.
+func (s *Server) rememberCode(id, code string, expiresAt time.Time) {
+	s.codesMu.Lock()
+	defer s.codesMu.Unlock()
+
+	now := time.Now()
+	for k, p := range s.pendingCodes {
+		if now.After(p.expiresAt) {
+			delete(s.pendingCodes, k)
+		}
+	}
+	s.pendingCodes[id] = pendingCode{code: code, expiresAt: expiresAt}
+}
+
+// forgetCode drops the plaintext code for token id.
+func (s *Server) forgetCode(id string) {
+	s.codesMu.Lock()
+	delete(s.pendingCodes, id)
+	s.codesMu.Unlock()
+}
+
+// lookupCode returns the plaintext code for token id if it is still pending.
+func (s *Server) lookupCode(id string) (string, bool) {
+	s.codesMu.Lock()
+	defer s.codesMu.Unlock()
+
+	p, ok := s.pendingCodes[id]
+	if !ok || time.Now().After(p.expiresAt) {
+		return "", false
+	}
+	return p.code, true
+}
+
+// handleEnrollmentQR renders an enrollment URL for token {id} as a QR code.
+// The URL has the form <server>/enroll?code=<CODE>&fp=<fingerprint>, which
+// the agent accepts directly as its -enroll argument; fp is the platform
+// fingerprint the agent checks the signed enrollment reply against.
+//
+// Query parameters:
+//   - format: "png" (default) or "svg"
+//   - scale:  PNG pixels per module (default 8)
+//   - server: base URL to embed (defaults to the URL this request used)
+func (s *Server) handleEnrollmentQR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	code, ok := s.lookupCode(r.PathValue("id"))
+	if !ok {
+		http.Error(w, `{"error":"enrollment code no longer available; create a new token"}`, http.StatusGone)
+		return
+	}
+
+	base := r.URL.Query().Get("server")
+	if base == "" {
+		base = requestBaseURL(r)
+	}
+	target := base + "/enroll?code=" + url.QueryEscape(code) +
+		"&" + protocol.EnrollURLFingerprint + "=" + s.platform.Fingerprint()
+
+	sym, err := qr.Encode(target)
+	if err != nil {
+		http.Error(w, `{"error":"server URL too long for QR code"}`, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Query().Get("format") == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_, _ = w.Write([]byte(sym.SVG()))
+		return
+	}
+
+	scale, _ := strconv.Atoi(r.URL.Query().Get("scale"))
+	if scale < 1 || scale > 32 {
+		scale = 8
+	}
+	data, err := sym.PNG(scale)
+	if err != nil {
+		http.Error(w, `{"error":"failed to render QR code"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	_, _ = w.Write(data)
+}
+
+// requestBaseURL is the server URL the request was made to, which agents
+// enrolling through the same address will reach.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
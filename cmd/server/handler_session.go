@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// viewerTicketTTL is how long a viewer ticket remains redeemable.
+const viewerTicketTTL = 30 * time.Second
+
+// Lifetimes of session tickets for external portals (see
+// handleSessionTicket): the default, and the most a portal may ask for.
+const (
+	sessionTicketTTL    = 60 * time.Second
+	maxSessionTicketTTL = 5 * time.Minute
+
+	// maxOperatorName bounds the portal user's name on a session ticket.
+	maxOperatorName = 100
+)
+
+// viewerTicket authorises a single /ws/viewer or /ws/gateway upgrade for
+// one agent. It travels as a viewer token signed by the platform key
+// (see security.ViewerClaims), so the server keeps only the IDs of
+// tickets already redeemed, until they expire.
+type viewerTicket struct {
+	agentID   string
+	keyID     string
+	keyName   string
+	expiresAt time.Time
+
+	// Session tickets minted for external portals open the viewer only,
+	// and, when origin is set, only from that origin or the embedded
+	// viewer page.
+	viewerOnly bool
+	origin     string
+
+	// permissions are what the key's role allows, narrowed by the portal
+	// for session tickets; see sessionPermissions for the session's mask.
+	permissions []string
+}
+
+// allowsOrigin reports whether a WebSocket upgrade with the request's
+// Origin header may redeem the ticket: any origin for tickets not bound
+// to one, else the bound origin or the server's own (the /embed page).
+func (t *viewerTicket) allowsOrigin(r *http.Request) bool {
+	if t.origin == "" {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == t.origin {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && u.Host == r.Host
+}
+
+// handleLogin exchanges an API key for a session cookie and CSRF token.
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" {
+		http.Error(w, `{"error":"key required"}`, http.StatusBadRequest)
+		return
+	}
+
+	apiKey, err := s.store.VerifyAPIKey(r.Context(), security.HashAPIKey(req.Key))
+	if err != nil || apiKey == nil {
+		http.Error(w, `{"error":"invalid API key"}`, http.StatusUnauthorized)
+		return
+	}
+
+	sess, token, err := security.GenerateSession(apiKey)
+	if err != nil {
+		http.Error(w, `{"error":"failed to create session"}`, http.StatusInternalServerError)
+		return
+	}
+	_ = s.store.DeleteExpiredSessions(r.Context())
+	if err := s.store.CreateSession(r.Context(), sess); err != nil {
+		http.Error(w, `{"error":"failed to create session"}`, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Dashboard login: %s", apiKey.Name)
+
+	http.SetCookie(w, security.SessionCookieFor(r, token, sess.ExpiresAt))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+		"name":       apiKey.Name,
+		"platform":   s.platform.Fingerprint(),
+		"csrf_token": sess.CSRFToken,
+		"expires_at": sess.ExpiresAt,
+	})
+}
+
+// handleLogout revokes the current session and clears the cookie.
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if sess := s.auth.Session(r); sess != nil {
+		if !security.TokensEqual(r.Header.Get(security.CSRFHeader), sess.CSRFToken) {
+			http.Error(w, `{"error":"invalid CSRF token"}`, http.StatusForbidden)
+			return
+		}
+		_ = s.store.DeleteSession(r.Context(), sess.TokenHash)
+	}
+
+	http.SetCookie(w, security.ClearSessionCookie(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "logged out"}) //nolint:errcheck
+}
+
+// handleSession reports the current session so a reloaded dashboard can
+// recover its CSRF token without asking for the API key again.
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	sess := s.auth.Session(r)
+	if sess == nil {
+		http.Error(w, `{"error":"no session"}`, http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+		"name":       sess.APIKeyName,
+		"platform":   s.platform.Fingerprint(),
+		"csrf_token": sess.CSRFToken,
+		"expires_at": sess.ExpiresAt,
+	})
+}
+
+// handleViewerTicket issues a short-lived, single-use ticket for opening a
+// viewer WebSocket to the requested agent.
+func (s *Server) handleViewerTicket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Agent string `json:"agent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Agent == "" {
+		http.Error(w, `{"error":"agent required"}`, http.StatusBadRequest)
+		return
+	}
+
+	apiKey := security.APIKeyFromContext(r.Context())
+	ticket, expires, err := s.issueViewerTicket(&viewerTicket{
+		agentID:     req.Agent,
+		keyID:       apiKey.ID,
+		keyName:     apiKey.Name,
+		permissions: rolePermissions(apiKey.Role),
+	}, viewerTicketTTL)
+	if err != nil {
+		http.Error(w, `{"error":"failed to create ticket"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+		"ticket":     ticket,
+		"expires_at": expires,
+	})
+}
+
+// handleSessionTicket issues a single-use ticket that lets an external
+// portal embed the viewer for one agent without holding an API key in the
+// browser. The portal's backend asks with {"agent", "ttl_seconds",
+// "operator", "origin"}: operator names the portal user, shown to the
+// agent's user and recorded with the API key's name, and origin binds the
+// ticket to the portal's web origin. "permissions" narrows what the
+// session may do below what the key's role allows. The ticket opens
+// /ws/viewer only.
+func (s *Server) handleSessionTicket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Agent       string   `json:"agent"`
+		TTLSeconds  int      `json:"ttl_seconds"`
+		Operator    string   `json:"operator"`
+		Origin      string   `json:"origin"`
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil || req.Agent == "" {
+		http.Error(w, `{"error":"agent required"}`, http.StatusBadRequest)
+		return
+	}
+	ttl := sessionTicketTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > maxSessionTicketTTL {
+		http.Error(w, fmt.Sprintf(`{"error":"ttl_seconds must be between 1 and %d"}`, int(maxSessionTicketTTL.Seconds())), http.StatusBadRequest)
+		return
+	}
+	origin := strings.TrimRight(req.Origin, "/")
+	if origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			http.Error(w, `{"error":"origin must be a scheme and host, e.g. https://portal.example.com"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	operator := strings.Join(strings.Fields(req.Operator), " ")
+	if len(operator) > maxOperatorName {
+		http.Error(w, `{"error":"operator name too long"}`, http.StatusBadRequest)
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	perms := rolePermissions(apiKey.Role)
+	if req.Permissions != nil {
+		narrowed, ok := parsePermissions(req.Permissions)
+		if !ok {
+			http.Error(w, `{"error":"unknown permission"}`, http.StatusBadRequest)
+			return
+		}
+		perms = narrowPermissions(perms, narrowed)
+	}
+	if rec, err := s.store.GetAgent(r.Context(), req.Agent); err != nil || rec == nil {
+		http.Error(w, `{"error":"agent not found"}`, http.StatusNotFound)
+		return
+	}
+
+	name := apiKey.Name
+	if operator != "" {
+		name = operator + " (" + apiKey.Name + ")"
+	}
+	ticket, expires, err := s.issueViewerTicket(&viewerTicket{
+		agentID:     req.Agent,
+		keyID:       apiKey.ID,
+		keyName:     name,
+		viewerOnly:  true,
+		origin:      origin,
+		permissions: perms,
+	}, ttl)
+	if err != nil {
+		http.Error(w, `{"error":"failed to create ticket"}`, http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditSessionTicket,
+		ActorID:   apiKey.ID,
+		ActorName: name,
+		AgentID:   req.Agent,
+		Detail:    fmt.Sprintf("origin=%q permissions=%s expires=%s", origin, permissionList(perms), expires.UTC().Format(time.RFC3339)),
+	})
+
+	base := requestBaseURL(r)
+	ws := "ws" + strings.TrimPrefix(base, "http")
+	query := "agent=" + url.QueryEscape(req.Agent) + "&ticket=" + url.QueryEscape(ticket)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+		"ticket":        ticket,
+		"agent":         req.Agent,
+		"permissions":   perms,
+		"expires_at":    expires,
+		"embed_url":     base + "/embed?" + query,
+		"websocket_url": ws + "/ws/viewer?" + query,
+	})
+}
+
+// handleEmbedPage serves the embeddable viewer page for a session ticket,
+// which it checks without redeeming. Only the ticket's origin may frame
+// the page.
+func (s *Server) handleEmbedPage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	t := s.peekViewerTicket(q.Get("ticket"), q.Get("agent"))
+	if t == nil || !t.viewerOnly {
+		http.Error(w, "invalid or expired ticket", http.StatusUnauthorized)
+		return
+	}
+	ancestors := "*"
+	if t.origin != "" {
+		ancestors = t.origin
+	}
+	w.Header().Set("Content-Security-Policy", "frame-ancestors "+ancestors)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.ServeFileFS(w, r, s.assets, "embed.html")
+}
+
+// issueViewerTicket signs t as a viewer token valid for ttl, returning
+// the token and when it expires.
+func (s *Server) issueViewerTicket(t *viewerTicket, ttl time.Duration) (string, time.Time, error) {
+	claims := &security.ViewerClaims{
+		Subject:     t.agentID,
+		KeyID:       t.keyID,
+		KeyName:     t.keyName,
+		Permissions: t.permissions,
+		ViewerOnly:  t.viewerOnly,
+		Origin:      t.origin,
+	}
+	token, err := s.platform.SignViewerToken(claims, ttl)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, time.Unix(claims.ExpiresAt, 0), nil
+}
+
+// peekViewerTicket returns a ticket issued for agentID that has not
+// expired or been redeemed, without consuming it.
+func (s *Server) peekViewerTicket(ticket, agentID string) *viewerTicket {
+	t, id := s.verifyViewerTicket(ticket, agentID)
+	if t == nil {
+		return nil
+	}
+	s.ticketMu.Lock()
+	defer s.ticketMu.Unlock()
+	if _, used := s.redeemedTickets[id]; used {
+		return nil
+	}
+	return t
+}
+
+// redeemViewerTicket consumes a ticket, returning it only if its
+// signature verifies, it has not expired or been redeemed before, and it
+// was issued for agentID.
+func (s *Server) redeemViewerTicket(ticket, agentID string) *viewerTicket {
+	t, id := s.verifyViewerTicket(ticket, agentID)
+	if t == nil {
+		return nil
+	}
+	s.ticketMu.Lock()
+	defer s.ticketMu.Unlock()
+	now := time.Now()
+	for k, exp := range s.redeemedTickets {
+		if now.After(exp) {
+			delete(s.redeemedTickets, k)
+		}
+	}
+	if _, used := s.redeemedTickets[id]; used {
+		return nil
+	}
+	s.redeemedTickets[id] = t.expiresAt
+	return t
+}
+
+// verifyViewerTicket checks a viewer token against the platform key and
+// agentID, returning the ticket and the token's ID.
+func (s *Server) verifyViewerTicket(ticket, agentID string) (*viewerTicket, string) {
+	c, err := security.VerifyViewerToken(s.platform.PublicKey, ticket, time.Now())
+	if err != nil || c.Subject != agentID {
+		return nil, ""
+	}
+	return &viewerTicket{
+		agentID:     c.Subject,
+		keyID:       c.KeyID,
+		keyName:     c.KeyName,
+		expiresAt:   time.Unix(c.ExpiresAt, 0),
+		viewerOnly:  c.ViewerOnly,
+		origin:      c.Origin,
+		permissions: c.Permissions,
+	}, c.ID
+}
+
+// handleJWKS publishes the platform public key, which verifies viewer
+// tokens, as a JWK set for relays.
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	json.NewEncoder(w).Encode(s.platform.JWKS()) //nolint:errcheck
+}
@@ -1,34 +1,56 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"time"
 
 	"github.com/avaropoint/rmm/internal/protocol"
 	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+const (
+	eventSessionStarted = "session.started"
+	eventSessionEnded   = "session.ended"
 )
 
 // handleViewer manages the lifecycle of a viewer connection.
-// Requires valid API key via "token" query parameter.
+// Requires a single-use ticket from /api/viewer/ticket or
+// /api/sessions/ticket via the "ticket" query parameter, issued for the
+// same agent and, for an origin-bound ticket, redeemed from its origin.
+// The session may do what its permission mask allows (see
+// sessionPermissions), which the viewer and agent are told. Outside the
+// agent's business hours the session needs an access override, if it is
+// allowed at all (see checkAccessHours). Capture on agents without
+// unattended access starts only after the local user consents, and
+// unattended capture on sensitive agents only after a second admin
+// approves (see requestApproval).
 func (s *Server) handleViewer(w http.ResponseWriter, r *http.Request) {
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		http.Error(w, "authentication required", http.StatusUnauthorized)
+	agentID := r.URL.Query().Get("agent")
+	if agentID == "" {
+		http.Error(w, "agent parameter required", http.StatusBadRequest)
 		return
 	}
-	keyHash := security.HashAPIKey(token)
-	apiKey, err := s.store.VerifyAPIKey(context.Background(), keyHash)
-	if err != nil || apiKey == nil {
-		http.Error(w, "invalid API key", http.StatusUnauthorized)
+
+	ticket := s.redeemViewerTicket(r.URL.Query().Get("ticket"), agentID)
+	if ticket == nil {
+		http.Error(w, "invalid or expired ticket", http.StatusUnauthorized)
 		return
 	}
-
-	agentID := r.URL.Query().Get("agent")
-	if agentID == "" {
-		http.Error(w, "agent parameter required", http.StatusBadRequest)
+	if !ticket.allowsOrigin(r) {
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditSessionTicketRejected,
+			ActorID:   ticket.keyID,
+			ActorName: ticket.keyName,
+			AgentID:   agentID,
+			Detail:    fmt.Sprintf("origin=%q expected=%q remote_addr=%s", r.Header.Get("Origin"), ticket.origin, r.RemoteAddr),
+		})
+		http.Error(w, "ticket not valid from this origin", http.StatusForbidden)
 		return
 	}
 
@@ -40,50 +62,233 @@ func (s *Server) handleViewer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "agent not found", http.StatusNotFound)
 		return
 	}
+	perms := agent.sessionPermissions(ticket.permissions)
+	if !slices.Contains(perms, protocol.PermView) {
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditPermissionDenied,
+			ActorID:   ticket.keyID,
+			ActorName: ticket.keyName,
+			AgentID:   agentID,
+			Detail:    "permission=view remote_addr=" + r.RemoteAddr,
+		})
+		http.Error(w, "viewing this agent is not permitted", http.StatusForbidden)
+		return
+	}
+	if !s.checkAccessHours(w, r, agent, ticket) {
+		return
+	}
 
-	conn, err := upgradeWebSocket(w, r)
+	conn, err := s.upgradeWebSocket(w, r)
 	if err != nil {
 		log.Printf("Viewer upgrade error: %v", err)
 		return
 	}
-
-	reader := bufio.NewReader(conn)
+	defer s.watchConn(conn, nil)()
 
 	s.mu.Lock()
 	s.viewers[agentID] = conn
 	s.mu.Unlock()
 
-	log.Printf("Viewer connected to agent: %s", agent.Name)
+	session := &store.ViewerSession{
+		ID:         security.NewID(),
+		AgentID:    agentID,
+		APIKeyID:   ticket.keyID,
+		APIKeyName: ticket.keyName,
+		RemoteAddr: r.RemoteAddr,
+		StartedAt:  time.Now(),
+	}
+	if err := s.store.CreateViewerSession(r.Context(), session); err != nil {
+		log.Printf("Viewer session record failed: %v", err)
+	}
+	started := *session
+	s.publishEvent(eventSessionStarted, agentID, &started)
+	tracker := &inputTracker{srv: s, session: session}
+	s.recordAudit(tracker.event(auditViewerConnected, session.StartedAt, "remote_addr="+r.RemoteAddr+" permissions="+permissionList(perms)))
+	permPayload, _ := json.Marshal(protocol.SessionPermissions{Permissions: perms})
+	permMsg, _ := json.Marshal(protocol.Message{Type: "session_permissions", Payload: permPayload})
+	_ = conn.WriteFrame(protocol.OpText, permMsg)
 
-	agent.mu.Lock()
-	startMsg, _ := json.Marshal(protocol.Message{Type: "start_capture"})
-	_ = protocol.WriteServerFrame(agent.conn, protocol.OpText, startMsg)
-	agent.mu.Unlock()
+	log.Printf("Viewer connected to agent: %s (key %s)", agent.Name, ticket.keyName)
 
+	capturing := false
+	var recorder *sessionRecorder
 	defer func() {
 		s.mu.Lock()
 		delete(s.viewers, agentID)
 		s.mu.Unlock()
 
-		agent.mu.Lock()
-		stopMsg, _ := json.Marshal(protocol.Message{Type: "stop_capture"})
-		_ = protocol.WriteServerFrame(agent.conn, protocol.OpText, stopMsg)
-		agent.mu.Unlock()
+		var statsID string
+		var stats chan json.RawMessage
+		if capturing {
+			statsID = security.NewID()
+			stats = agent.expect(statsID)
+			stopPayload, _ := json.Marshal(map[string]string{"id": statsID})
+			agent.mu.Lock()
+			stopMsg, _ := json.Marshal(protocol.Message{Type: "stop_capture", Payload: stopPayload})
+			_ = agent.conn.WriteFrame(protocol.OpText, stopMsg)
+			agent.mu.Unlock()
+		}
 
 		_ = conn.Close()
+		if recorder != nil {
+			s.stopRecording(agent, recorder)
+		}
+
+		ended := time.Now()
+		tracker.release(tracker.lastInput)
+		session.EndedAt = &ended
+		if capturing {
+			agent.awaitCaptureStats(statsID, stats, session)
+			lat := agent.latency.snapshot()
+			session.LatencyMS, session.MaxLatencyMS = lat.GlassMS, lat.MaxGlassMS
+		}
+		// Not r.Context(): the session is closed out during shutdown too.
+		if err := s.store.EndViewerSession(context.Background(), session); err != nil {
+			log.Printf("Viewer session update failed: %v", err)
+		}
+		s.recordAudit(tracker.event(auditViewerDisconnected, ended, fmt.Sprintf(
+			"key_events=%d mouse_events=%d input_dropped=%d frames_sent=%d frames_dropped=%d latency_ms=%g",
+			session.KeyEvents, session.MouseEvents, tracker.dropped, session.FramesSent, session.FramesDropped, session.LatencyMS)))
+		s.meterSession(agent, session)
+		summary := *session
+		s.publishEvent(eventSessionEnded, agentID, &summary)
+		go s.noteSessionTickets(agent.Name, session)
+
 		log.Printf("Viewer disconnected from agent: %s", agent.Name)
 	}()
 
-	s.viewerInputLoop(agent, reader)
+	// Attended agents need the local user's approval before capture
+	// starts, unless the user asked for support (see raiseHand).
+	agent.mu.Lock()
+	unattended := agent.Unattended
+	agent.mu.Unlock()
+	if hand := s.takeRaisedHand(agentID); hand != nil {
+		s.resolveAlert(hand.alert)
+		if !unattended {
+			s.recordAudit(tracker.event(auditConsentGranted, time.Now(), "support_request="+hand.alert.ID))
+			unattended = true
+		}
+	}
+	if unattended && s.isSensitive(agent) && !s.requestApproval(agent, conn, tracker) {
+		return
+	}
+	if !unattended {
+		granted := s.requestConsent(agent, conn, ticket.keyName)
+		action := auditConsentDenied
+		if granted {
+			action = auditConsentGranted
+		}
+		s.recordAudit(tracker.event(action, time.Now(), ""))
+		if !granted {
+			return
+		}
+	}
+
+	if s.config().Recording.Enabled {
+		recorder = s.startRecording(agent, session)
+	}
+	agent.mu.Lock()
+	startPayload, _ := json.Marshal(protocol.CaptureStart{
+		Operator:    ticket.keyName,
+		Permissions: perms,
+		Recording:   recorder != nil,
+		Watermark:   s.config().Watermark,
+	})
+	startMsg, _ := json.Marshal(protocol.Message{Type: "start_capture", Payload: startPayload})
+	_ = agent.conn.WriteFrame(protocol.OpText, startMsg)
+	agent.mu.Unlock()
+	capturing = true
+	agent.relay.reset()
+	agent.latency.reset()
+	defer s.probeLatency(agent, conn)()
+
+	s.viewerInputLoop(agent, conn, tracker, perms)
+}
+
+// captureStatsTimeout bounds how long a finished session waits for the
+// agent's frame counts.
+const captureStatsTimeout = 2 * time.Second
+
+// awaitCaptureStats copies the agent's frame counts for the capture run
+// just stopped (see protocol.CaptureStats) onto session. Agents that
+// predate the report leave them at zero after captureStatsTimeout.
+func (a *LiveAgent) awaitCaptureStats(id string, ch chan json.RawMessage, session *store.ViewerSession) {
+	defer a.forget(id)
+	select {
+	case data := <-ch:
+		var st protocol.CaptureStats
+		if json.Unmarshal(data, &st) == nil {
+			session.FramesSent, session.FramesDropped = st.FramesSent, st.FramesDropped
+		}
+	case <-time.After(captureStatsTimeout):
+	}
 }
 
 // viewerInputLoop reads viewer input and forwards it to the target agent.
-func (s *Server) viewerInputLoop(agent *LiveAgent, reader *bufio.Reader) {
+// Every input event is counted against the session for the audit trail,
+// and input over the session's rate limit is discarded (see
+// input_limit.go).
+// File chunks are only relayed inside an announced upload and never past
+// its declared size; uploads over the transfer policy, or made while a
+// drop-box delivery holds the agent's file channel, are refused here and
+// never reach the agent. Chunks wait for the agent's file credit, so the
+// agent paces an upload instead of it queueing ahead of input. Messages
+// the session's permission mask does not allow are dropped, and the first
+// of each kind audited.
+func (s *Server) viewerInputLoop(agent *LiveAgent, viewer protocol.Conn, tracker *inputTracker, perms []string) {
+	var uploadRemaining int64
+	uploading := false // this viewer holds the agent's file channel
+	release := func() {
+		if uploading {
+			uploading = false
+			agent.endTransfer()
+			go s.deliverDropbox(agent) // anything queued meanwhile
+		}
+	}
+	defer release()
+	reject := func(id string, size int64, reason string) {
+		reply, _ := json.Marshal(protocol.FileProgress{ID: id, Size: size, Error: reason})
+		msg, _ := json.Marshal(protocol.Message{Type: "file_progress", Payload: reply})
+		_ = viewer.WriteFrame(protocol.OpText, msg)
+	}
+	denied := map[string]bool{}
+	permitted := func(perm, what string) bool {
+		if slices.Contains(perms, perm) {
+			return true
+		}
+		if !denied[perm] {
+			denied[perm] = true
+			s.recordAudit(tracker.event(auditPermissionDenied, time.Now(), "permission="+perm+" message="+what))
+		}
+		return false
+	}
+
+	rate := s.config().inputRate()
+	limiter := newInputLimiter(rate)
+
 	for {
-		opcode, data, err := protocol.ReadFrame(reader)
+		opcode, data, err := viewer.ReadFrame()
 		if err != nil || opcode == protocol.OpClose {
 			break
 		}
+		if opcode == protocol.OpPong {
+			agent.latency.pong(viewerLink, data)
+			continue
+		}
+
+		if opcode == protocol.OpBinary && len(data) > 0 {
+			if perm, ok := protocol.ViewerChannelPermission(data[0]); !ok || !permitted(perm, fmt.Sprintf("channel=%d", data[0])) {
+				continue
+			}
+		}
+		if opcode == protocol.OpBinary && len(data) > 0 && data[0] == protocol.BinFile {
+			if n := int64(len(data) - protocol.FileChunkOverhead); n >= 0 && n <= uploadRemaining {
+				uploadRemaining -= n
+				_ = agent.sendFileChunk(data)
+				agent.relayed.Add(int64(len(data)))
+			}
+			continue
+		}
 
 		if opcode != protocol.OpText {
 			continue
@@ -93,11 +298,73 @@ func (s *Server) viewerInputLoop(agent *LiveAgent, reader *bufio.Reader) {
 		if err := json.Unmarshal(data, &m); err != nil {
 			continue
 		}
+		if perm, ok := protocol.ViewerMessagePermission(m.Type); !ok || !permitted(perm, m.Type) {
+			if m.Type == "file_start" {
+				var start protocol.FileStart
+				_ = json.Unmarshal(m.Payload, &start)
+				reject(start.ID, start.Size, "file transfer is not permitted in this session")
+			}
+			continue
+		}
+
+		switch m.Type {
+		case "input":
+			var in struct {
+				Action string `json:"action"`
+			}
+			_ = json.Unmarshal(m.Payload, &in)
+			if !limiter.allow(in.Action == "up", time.Now()) {
+				tracker.throttled(rate)
+				continue
+			}
+			tracker.observe(m.Payload)
+		case "file_start":
+			var start protocol.FileStart
+			if json.Unmarshal(m.Payload, &start) != nil {
+				continue
+			}
+			uploadRemaining = 0
+			detail := fmt.Sprintf("purpose=%s name=%q size=%d", start.Purpose, start.Name, start.Size)
+			if limit := s.config().TransferPolicy.limit(start.Purpose); start.Size <= 0 || start.Size > limit {
+				s.recordAudit(tracker.event(auditFileRejected, time.Now(), fmt.Sprintf("%s limit=%d", detail, limit)))
+				reject(start.ID, start.Size, "file exceeds the transfer size limit")
+				continue
+			}
+			if !uploading && !agent.beginTransfer() {
+				reject(start.ID, start.Size, "another file transfer to this agent is in progress")
+				continue
+			}
+			uploading = true
+			uploadRemaining = protocol.MaxWireSize(start.Size, start.Compression)
+			s.recordAudit(tracker.event(auditFileUpload, time.Now(), detail))
+		case "file_end":
+			uploadRemaining = 0
+			// Every upload must end with its digest. One without is still
+			// relayed, so the agent closes and discards the partial file.
+			var end protocol.FileEnd
+			if json.Unmarshal(m.Payload, &end) == nil && !protocol.ValidSHA256(end.SHA256) {
+				s.recordAudit(tracker.event(auditFileRejected, time.Now(), fmt.Sprintf("id=%s no sha256", end.ID)))
+				reject(end.ID, 0, "file_end must carry the file's SHA-256")
+			}
+		case "frame_displayed":
+			var d protocol.FrameDisplayed
+			if json.Unmarshal(m.Payload, &d) != nil {
+				continue
+			}
+			if glass, ok := agent.latency.displayed(d); ok {
+				s.glassLatency.observe(glass)
+			}
+		}
 
-		if m.Type == "input" || m.Type == "switch_display" {
+		switch m.Type {
+		case "input", "switch_display", "set_view", "set_resolution", "session_setup", "file_start", "file_end":
 			agent.mu.Lock()
-			_ = protocol.WriteServerFrame(agent.conn, protocol.OpText, data)
+			_ = agent.conn.WriteFrame(protocol.OpText, data)
 			agent.mu.Unlock()
+			agent.relayed.Add(int64(len(data)))
+		}
+		if m.Type == "file_end" {
+			release()
 		}
 	}
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Restarts without reconnection churn. Two things keep a routine upgrade
+// from costing the fleet minutes of failed reconnects:
+//
+//   - Socket activation: started by systemd with a .socket unit, the
+//     server serves on the sockets systemd passes it instead of binding
+//     its own. systemd keeps them open across a restart, so agents that
+//     reconnect while the new binary starts wait in the listen backlog
+//     rather than being refused.
+//   - A closing notice: as it shuts down, the server sends every agent a
+//     "server_closing" message naming when to reconnect, spread over a
+//     window that grows with the fleet, so the agents return a few
+//     seconds later a few at a time instead of together.
+
+const (
+	// restartGrace is the least an agent is asked to wait, time for the
+	// new process to start.
+	restartGrace = 2 * time.Second
+	// reconnectSpread is the window agents are spread over per connected
+	// agent, between minSpread and maxSpread.
+	reconnectSpread = 10 * time.Millisecond
+	minSpread       = time.Second
+	maxSpread       = time.Minute
+
+	// listenFDsStart is the first file descriptor systemd passes
+	// (SD_LISTEN_FDS_START).
+	listenFDsStart = 3
+)
+
+// activatedListeners returns the sockets systemd passed the process, or
+// nil when it was not socket-activated. It unsets the variables that
+// name them, so child processes do not take them for their own.
+func activatedListeners() ([]net.Listener, error) {
+	pid, count := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	names := os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")     //nolint:errcheck
+	os.Unsetenv("LISTEN_FDS")     //nolint:errcheck
+	os.Unsetenv("LISTEN_FDNAMES") //nolint:errcheck
+	if pid != strconv.Itoa(os.Getpid()) || count == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("socket activation: bad LISTEN_FDS %q", count)
+	}
+	nameList := strings.Split(names, ":")
+	var listeners []net.Listener
+	for i := range n {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(nameList) && nameList[i] != "" {
+			name = nameList[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		_ = f.Close() // FileListener holds its own copy
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("socket activation: %s: %w", name, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// listenAll binds every address, or takes the sockets systemd passed in
+// their place.
+func listenAll(addrs []string) ([]net.Listener, error) {
+	activated, err := activatedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(activated) > 0 {
+		for _, ln := range activated {
+			log.Printf("Listening on %s (socket activation)", ln.Addr())
+		}
+		return activated, nil
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("listen %s: %w", addr, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// reconnectAfter picks when an agent should come back after a shutdown
+// with agents connected.
+func reconnectAfter(agents int) time.Duration {
+	spread := min(max(time.Duration(agents)*reconnectSpread, minSpread), maxSpread)
+	return restartGrace + rand.N(spread)
+}
+
+// sendClosing tells agent the server is shutting down and when to
+// reconnect.
+func (s *Server) sendClosing(agent *LiveAgent) {
+	s.mu.RLock()
+	n := len(s.agents)
+	s.mu.RUnlock()
+	after := reconnectAfter(n)
+	_ = agent.send("server_closing", protocol.ServerClosing{ReconnectAfterMS: after.Milliseconds()})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Health history: every heartbeat's health figures are stored as a
+// sample, so /api/agents/{id}/health can chart an agent's load over time.
+// While the server is unreachable the agent keeps taking heartbeats into
+// a bounded file and replays them ("backlog") once it reconnects, with
+// the support requests its user raised meanwhile; replayed samples keep
+// the agent's time and are marked as such, leaving no gap in the history
+// across server maintenance. Replayed heartbeats do not change the live
+// state shown on the dashboard, nor are alert rules evaluated against
+// them: the condition they describe is over.
+
+const (
+	// healthRetention is how long samples are kept.
+	healthRetention = 30 * 24 * time.Hour
+
+	// healthPruneTick is how often retention is applied.
+	healthPruneTick = time.Hour
+
+	// defaultHealthWindow is the history returned without ?since=.
+	defaultHealthWindow = 24 * time.Hour
+)
+
+// recordHealth stores a live heartbeat's health figures.
+func (s *Server) recordHealth(agentID string, h *protocol.Health) {
+	sample := &store.HealthSample{
+		AgentID:    agentID,
+		At:         time.Now(),
+		CPU:        h.CPU,
+		MemoryFree: h.MemoryFree,
+		DiskFree:   h.DiskFree,
+	}
+	if err := s.store.RecordHealthSamples(s.ctx, []*store.HealthSample{sample}); err != nil {
+		log.Printf("Health history for %s: %v", agentID, err)
+	}
+}
+
+// handleBacklog stores what an agent buffered while it was disconnected.
+func (s *Server) handleBacklog(agent *LiveAgent, payload []byte) {
+	var backlog protocol.Backlog
+	if err := json.Unmarshal(payload, &backlog); err != nil {
+		return
+	}
+	if len(backlog.Messages) > protocol.MaxBacklogBatch {
+		backlog.Messages = backlog.Messages[:protocol.MaxBacklogBatch]
+	}
+	now := time.Now()
+	var samples []*store.HealthSample
+	requests := 0
+	for _, m := range backlog.Messages {
+		switch m.Type {
+		case "heartbeat":
+			var hb protocol.Heartbeat
+			if json.Unmarshal(m.Payload, &hb) != nil || hb.Health == nil || hb.Time <= 0 {
+				continue
+			}
+			at := time.UnixMilli(hb.Time)
+			if at.After(now) || now.Sub(at) > healthRetention {
+				continue
+			}
+			samples = append(samples, &store.HealthSample{
+				AgentID:    agent.ID,
+				At:         at,
+				CPU:        hb.Health.CPU,
+				MemoryFree: hb.Health.MemoryFree,
+				DiskFree:   hb.Health.DiskFree,
+				Replayed:   true,
+			})
+		case "support_request":
+			var req protocol.SupportRequest
+			if json.Unmarshal(m.Payload, &req) == nil {
+				s.raiseHand(agent.ID, agent.Name, req)
+				requests++
+			}
+		}
+	}
+	if len(samples) > 0 {
+		if err := s.store.RecordHealthSamples(s.ctx, samples); err != nil {
+			log.Printf("Backlog from %s: %v", agent.Name, err)
+			return
+		}
+	}
+	log.Printf("Backlog from %s: %d heartbeats, %d support requests replayed, %d dropped by the agent",
+		agent.Name, len(samples), requests, backlog.Dropped)
+}
+
+// handleAgentHealth returns an agent's health samples, oldest first,
+// taken between ?since= and ?until= (RFC 3339; the last day by default).
+func (s *Server) handleAgentHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	until := time.Now()
+	since := until.Add(-defaultHealthWindow)
+	q := r.URL.Query()
+	for name, dst := range map[string]*time.Time{"since": &since, "until": &until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf(`{"error":"%s must be RFC 3339"}`, name), http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+
+	samples, err := s.store.ListHealthSamples(r.Context(), r.PathValue("id"), since, until)
+	if err != nil {
+		http.Error(w, `{"error":"failed to read health history"}`, http.StatusInternalServerError)
+		return
+	}
+	if samples == nil {
+		samples = []*store.HealthSample{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(samples) //nolint:errcheck
+}
+
+// runHealthRetention deletes samples older than healthRetention until the
+// server shuts down.
+func (s *Server) runHealthRetention() {
+	ticker := time.NewTicker(healthPruneTick)
+	defer ticker.Stop()
+	for {
+		n, err := s.store.DeleteHealthSamplesBefore(s.ctx, time.Now().Add(-healthRetention))
+		if err != nil {
+			log.Printf("Health retention: %v", err)
+		} else if n > 0 {
+			log.Printf("Health retention: deleted %d samples", n)
+		}
+		if !s.tick(ticker) {
+			return
+		}
+	}
+}
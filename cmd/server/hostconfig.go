@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Host configuration: the hosts file (/api/agents/{id}/hosts) and system
+// environment variables (/api/agents/{id}/environment) of a connected
+// agent. Reads are always allowed; changes only as host_config_policy
+// permits. Every change is audited with a diff of what it changed.
+
+const (
+	auditHostsRead         = "hosts_read"
+	auditHostsChanged      = "hosts_changed"
+	auditEnvironmentRead   = "environment_read"
+	auditEnvironmentChange = "environment_changed"
+	auditHostConfigDenied  = "host_config_denied"
+
+	// maxAuditDiff bounds the diff recorded in an audit event.
+	maxAuditDiff = 8 << 10
+)
+
+// hostConfigChange is the answer to a change: the target as it stands
+// afterwards, and what changed.
+type hostConfigChange struct {
+	protocol.HostConfigResult
+	Diff []string `json:"diff"`
+}
+
+// handleAgentHosts reads (GET) or replaces (PUT {"content", "digest"})
+// the agent's hosts file. digest, from an earlier read, makes the write
+// fail if the file has changed since.
+func (s *Server) handleAgentHosts(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Content *string `json:"content"`
+		Digest  string  `json:"digest"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*protocol.MaxHostsFileSize)).Decode(&body); err != nil || body.Content == nil {
+			http.Error(w, `{"error":"content required"}`, http.StatusBadRequest)
+			return
+		}
+		if len(*body.Content) > protocol.MaxHostsFileSize {
+			http.Error(w, `{"error":"content too large"}`, http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	apiKey := security.APIKeyFromContext(r.Context())
+	audit := s.hostConfigAuditor(apiKey, r.PathValue("id"))
+	if r.Method == http.MethodPut && !s.config().HostConfigPolicy.HostsWrite {
+		audit(auditHostConfigDenied, "target=hosts")
+		http.Error(w, `{"error":"hosts file changes not permitted by host_config_policy"}`, http.StatusForbidden)
+		return
+	}
+	agent := s.liveAgentOr404(w, r)
+	if agent == nil {
+		return
+	}
+
+	before, ok := s.hostConfigCall(w, r, agent, protocol.HostConfigRequest{Op: protocol.HostConfigRead, Target: protocol.HostConfigHosts})
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodGet {
+		audit(auditHostsRead, fmt.Sprintf("path=%q", before.Path))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(before) //nolint:errcheck
+		return
+	}
+
+	if body.Digest == "" {
+		body.Digest = before.Digest
+	}
+	after, ok := s.hostConfigCall(w, r, agent, protocol.HostConfigRequest{
+		Op:     protocol.HostConfigWrite,
+		Target: protocol.HostConfigHosts,
+		Hosts:  *body.Content,
+		Digest: body.Digest,
+	})
+	if !ok {
+		audit(auditHostsChanged, fmt.Sprintf("path=%q error=%q", before.Path, after.Error))
+		return
+	}
+	diff := linesDiff(before.Hosts, after.Hosts)
+	audit(auditHostsChanged, fmt.Sprintf("path=%q diff=%q", after.Path, auditDiff(diff)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hostConfigChange{HostConfigResult: after, Diff: diff}) //nolint:errcheck
+}
+
+// handleAgentEnvironment reads (GET) the agent's system environment
+// variables or changes them (PATCH with {"NAME": "value"}, null to
+// remove), leaving variables not named alone.
+func (s *Server) handleAgentEnvironment(w http.ResponseWriter, r *http.Request) {
+	var changes map[string]*string
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&changes); err != nil || len(changes) == 0 {
+			http.Error(w, `{"error":"variables required"}`, http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	apiKey := security.APIKeyFromContext(r.Context())
+	audit := s.hostConfigAuditor(apiKey, r.PathValue("id"))
+	for name := range changes {
+		if !s.config().HostConfigPolicy.envWritable(name) {
+			audit(auditHostConfigDenied, fmt.Sprintf("target=environment name=%q", name))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{ //nolint:errcheck
+				"error": "changing " + name + " not permitted by host_config_policy",
+			})
+			return
+		}
+	}
+	agent := s.liveAgentOr404(w, r)
+	if agent == nil {
+		return
+	}
+
+	before, ok := s.hostConfigCall(w, r, agent, protocol.HostConfigRequest{Op: protocol.HostConfigRead, Target: protocol.HostConfigEnvironment})
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodGet {
+		audit(auditEnvironmentRead, fmt.Sprintf("path=%q", before.Path))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(before) //nolint:errcheck
+		return
+	}
+
+	after, ok := s.hostConfigCall(w, r, agent, protocol.HostConfigRequest{
+		Op:          protocol.HostConfigWrite,
+		Target:      protocol.HostConfigEnvironment,
+		Environment: changes,
+	})
+	if !ok {
+		audit(auditEnvironmentChange, fmt.Sprintf("names=%q error=%q", slices.Sorted(maps.Keys(changes)), after.Error))
+		return
+	}
+	diff := envDiff(before.Environment, after.Environment, changes)
+	audit(auditEnvironmentChange, fmt.Sprintf("path=%q diff=%q", after.Path, auditDiff(diff)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hostConfigChange{HostConfigResult: after, Diff: diff}) //nolint:errcheck
+}
+
+// hostConfigCall runs one request on the agent. On failure it writes the
+// error response, returning the result so the caller can audit its
+// error.
+func (s *Server) hostConfigCall(w http.ResponseWriter, r *http.Request, agent *LiveAgent, req protocol.HostConfigRequest) (protocol.HostConfigResult, bool) {
+	req.ID = security.NewID()
+	var res protocol.HostConfigResult
+	if !agent.callOrFail(r.Context(), w, "hostconfig_request", req.ID, req, &res) {
+		res.Error = "agent did not answer"
+		return res, false
+	}
+	if res.Error != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": res.Error}) //nolint:errcheck
+		return res, false
+	}
+	return res, true
+}
+
+// hostConfigAuditor returns a function recording host configuration
+// audit events for the agent.
+func (s *Server) hostConfigAuditor(apiKey *store.APIKey, agentID string) func(action, detail string) {
+	return func(action, detail string) {
+		s.recordAudit(&store.AuditEvent{
+			Action:    action,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			AgentID:   agentID,
+			Detail:    detail,
+		})
+	}
+}
+
+// linesDiff lists the lines removed from before ("-line") and added in
+// after ("+line"). Lines are compared as a multiset, so moving a line is
+// not a change.
+func linesDiff(before, after string) []string {
+	count := make(map[string]int)
+	for _, line := range strings.Split(after, "\n") {
+		count[line]++
+	}
+	var removed []string
+	for _, line := range strings.Split(before, "\n") {
+		if count[line] > 0 {
+			count[line]--
+		} else {
+			removed = append(removed, "-"+line)
+		}
+	}
+	diff := removed
+	for _, line := range strings.Split(after, "\n") {
+		if count[line] > 0 {
+			count[line]--
+			diff = append(diff, "+"+line)
+		}
+	}
+	if diff == nil {
+		diff = []string{}
+	}
+	return diff
+}
+
+// envDiff lists variables removed ("-NAME=value"), added ("+NAME=value")
+// and changed (both lines), by name. Agents redact the values of likely
+// secrets, so a secret that was set is listed as "~NAME=[redacted]".
+func envDiff(before, after map[string]string, changes map[string]*string) []string {
+	names := slices.Collect(maps.Keys(before))
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	diff := []string{}
+	for _, name := range names {
+		old, had := before[name]
+		cur, has := after[name]
+		if had && has && old == cur {
+			if _, set := changes[name]; set && protocol.SecretEnvName(name) {
+				diff = append(diff, "~"+name+"="+cur)
+			}
+			continue
+		}
+		if had {
+			diff = append(diff, "-"+name+"="+old)
+		}
+		if has {
+			diff = append(diff, "+"+name+"="+cur)
+		}
+	}
+	return diff
+}
+
+// auditDiff joins a diff for an audit event, truncated to maxAuditDiff.
+func auditDiff(diff []string) string {
+	joined := strings.Join(diff, "\n")
+	if len(joined) > maxAuditDiff {
+		joined = strings.ToValidUTF8(joined[:maxAuditDiff], "") + "\n… (truncated)"
+	}
+	return joined
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// HTTP/2: "http2" in the config picks the HTTP versions the listeners
+// speak. "on", the default, negotiates HTTP/2 over TLS (ALPN) alongside
+// HTTP/1.1, so the dashboard and API share one multiplexed connection;
+// "off" serves HTTP/1.1 only; "h2c" also accepts cleartext HTTP/2 with
+// prior knowledge on plain-HTTP listeners, for a TLS-terminating proxy
+// that speaks HTTP/2 to the server.
+//
+// WebSockets can open over an HTTP/2 stream with an extended CONNECT
+// request (RFC 8441), which Go's HTTP/2 server accepts only when the
+// process runs with GODEBUG=http2xconnect=1; without it, browsers open a
+// separate HTTP/1.1 connection for each WebSocket. The stream carries the
+// same RFC 6455 frames as a hijacked connection, and is read and written
+// with the native framing whichever backend is configured, since
+// gorilla/websocket upgrades HTTP/1.1 only. Agents do not offer h2 and
+// keep upgrading over HTTP/1.1.
+
+// HTTP/2 settings.
+const (
+	http2On  = "on"
+	http2Off = "off"
+	http2H2C = "h2c"
+)
+
+// streamCloseTimeout bounds a write in progress on a WebSocket stream
+// being closed, which a peer that stopped reading would otherwise block
+// for good.
+const streamCloseTimeout = 5 * time.Second
+
+// extendedConnect reports whether the HTTP/2 server accepts extended
+// CONNECT, checked as net/http checks it.
+var extendedConnect = strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1")
+
+// protocols returns the HTTP versions the listeners serve.
+func (c *Config) protocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	switch c.HTTP2 {
+	case http2Off:
+	case http2H2C:
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+	default:
+		p.SetHTTP2(true)
+	}
+	return p
+}
+
+// logHTTP2 logs the HTTP/2 setting at start.
+func logHTTP2(cfg *Config) {
+	if cfg.http2() == http2Off {
+		log.Printf("HTTP/2: off")
+		return
+	}
+	ws := "off (set GODEBUG=http2xconnect=1 to enable)"
+	if extendedConnect {
+		ws = "on"
+	}
+	log.Printf("HTTP/2: %s; WebSocket over HTTP/2: %s", cfg.http2(), ws)
+}
+
+// isExtendedConnect reports whether r opens a WebSocket on an HTTP/2
+// stream (RFC 8441).
+func isExtendedConnect(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodConnect && r.Header.Get(":protocol") == "websocket"
+}
+
+// streamConn is a protocol.Conn over an HTTP/2 stream: frames are read
+// from the request body and written to the response.
+type streamConn struct {
+	frames *protocol.FrameReader
+	body   io.Closer
+	w      io.Writer
+	rc     *http.ResponseController
+	remote net.Addr
+
+	once    sync.Once
+	closed  atomic.Bool
+	writeMu sync.Mutex // serializes frames, and writes with Close
+}
+
+// upgradeStream accepts an extended CONNECT WebSocket request. There is
+// no key to answer: a 200 response opens the stream.
+func upgradeStream(w http.ResponseWriter, r *http.Request) (protocol.Conn, error) {
+	if v := r.Header.Get("Sec-WebSocket-Version"); v != "" && v != "13" {
+		return nil, fmt.Errorf("unsupported WebSocket version %q", v)
+	}
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+	remote, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	return &streamConn{
+		frames: protocol.NewFrameReader(bufio.NewReader(r.Body)),
+		body:   r.Body,
+		w:      w,
+		rc:     rc,
+		remote: remote,
+	}, nil
+}
+
+func (c *streamConn) ReadFrame() (byte, []byte, error) {
+	return c.frames.Next()
+}
+
+func (c *streamConn) WriteFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	if err := protocol.WriteServerFrame(c.w, opcode, payload); err != nil {
+		return err
+	}
+	return c.rc.Flush()
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+// Close ends reads and writes. The stream itself ends when the handler
+// returns, which it must not do before Close returns: the response may
+// not be written after that. Concurrent calls wait for the first.
+func (c *streamConn) Close() error {
+	c.once.Do(func() {
+		_ = c.rc.SetWriteDeadline(time.Now().Add(streamCloseTimeout))
+		_ = c.body.Close()
+		c.writeMu.Lock()
+		c.closed.Store(true)
+		c.writeMu.Unlock()
+	})
+	return nil
+}
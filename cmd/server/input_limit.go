@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Input rate limiting: each viewer session relays at most input_rate input
+// messages a second to the agent (500 by default), with bursts of up to a
+// quarter of a second's worth. The dashboard sends mouse moves at most
+// once a frame, so only scripted input reaches the cap. Excess messages
+// are discarded, not queued, so a flood never backs up behind the agent's
+// injector (a process per event on some platforms). Releases ("up") may
+// overdraw the budget by one burst, so a throttled flood does not leave a
+// key or button held down. A session's first discarded message is audited
+// as input_throttled, and the total is reported when it ends.
+
+const (
+	auditInputThrottled = "input_throttled"
+
+	// defaultInputRate is the per-session cap without input_rate.
+	defaultInputRate = 500
+)
+
+// inputLimiter is a token bucket for one session's input messages.
+type inputLimiter struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newInputLimiter returns a limiter for rate messages a second, or nil
+// for no limit.
+func newInputLimiter(rate int) *inputLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := max(float64(rate)/4, 1)
+	return &inputLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// allow reports whether one more message may be relayed at now. A release
+// may overdraw the bucket by one burst.
+func (l *inputLimiter) allow(release bool, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.burst)
+	l.last = now
+	floor := 0.0
+	if release {
+		floor = -l.burst
+	}
+	if l.tokens-1 < floor {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// throttled counts a discarded input message, auditing the session's
+// first.
+func (t *inputTracker) throttled(rate int) {
+	t.dropped++
+	if t.dropped == 1 {
+		t.srv.recordAudit(t.event(auditInputThrottled, time.Now(), fmt.Sprintf("rate=%d/s", rate)))
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// PSA integrations: when an alert is raised, every enabled integration
+// covering its type opens a ticket for it. Resolving the alert, and each
+// remote-control session on the agent while the alert is open, add a
+// note to those tickets. Provider calls run in the background so a slow
+// PSA never holds up alert evaluation or viewers.
+
+const eventTicketCreated = "ticket.created"
+
+// integrationRequest is the body of POST and PUT /api/integrations.
+// Omitted fields keep their values on PUT.
+type integrationRequest struct {
+	Name       string          `json:"name"`
+	Provider   string          `json:"provider"`
+	Config     json.RawMessage `json:"config"`
+	AlertTypes []string        `json:"alert_types"`
+	Enabled    *bool           `json:"enabled"`
+}
+
+// apply validates req and copies it onto in.
+func (req *integrationRequest) apply(in *store.Integration) error {
+	if req.Name != "" {
+		in.Name = strings.TrimSpace(req.Name)
+	}
+	if req.Provider != "" {
+		in.Provider = req.Provider
+	}
+	if len(req.Config) > 0 {
+		in.Config = req.Config
+	}
+	if req.AlertTypes != nil || in.AlertTypes == nil {
+		in.AlertTypes = append([]string{}, req.AlertTypes...)
+	}
+	if req.Enabled != nil {
+		in.Enabled = *req.Enabled
+	}
+
+	if in.Name == "" {
+		return fmt.Errorf("name required")
+	}
+	newProvider, ok := ticketProviders[in.Provider]
+	if !ok {
+		return fmt.Errorf("unknown provider")
+	}
+	if _, err := newProvider(in.Config); err != nil {
+		return err
+	}
+	for _, t := range in.AlertTypes {
+		if _, ok := alertConditions[t]; !ok && t != store.AlertSupportRequest {
+			return fmt.Errorf("unknown alert type %s", t)
+		}
+	}
+	return nil
+}
+
+// handleIntegrations lists (GET) or creates (POST) integrations.
+// Provider configuration is write-only.
+func (s *Server) handleIntegrations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ins, err := s.store.ListIntegrations(r.Context())
+		if err != nil {
+			http.Error(w, `{"error":"failed to list integrations"}`, http.StatusInternalServerError)
+			return
+		}
+		if ins == nil {
+			ins = []*store.Integration{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ins) //nolint:errcheck
+
+	case http.MethodPost:
+		var req integrationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		apiKey := security.APIKeyFromContext(r.Context())
+		in := &store.Integration{
+			ID:        security.NewID(),
+			Enabled:   true,
+			CreatedBy: apiKey.Name,
+			CreatedAt: time.Now(),
+		}
+		if err := req.apply(in); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()}) //nolint:errcheck
+			return
+		}
+		if err := s.store.CreateIntegration(r.Context(), in); err != nil {
+			http.Error(w, `{"error":"failed to create integration"}`, http.StatusInternalServerError)
+			return
+		}
+		s.auditIntegration(r, auditIntegrationCreated, in)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(in) //nolint:errcheck
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleIntegration reads (GET), updates (PUT) or deletes (DELETE) an
+// integration. Tickets it opened stay listed after deletion.
+func (s *Server) handleIntegration(w http.ResponseWriter, r *http.Request) {
+	in, err := s.store.GetIntegration(r.Context(), r.PathValue("id"))
+	if err != nil || in == nil {
+		http.Error(w, `{"error":"integration not found"}`, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(in) //nolint:errcheck
+
+	case http.MethodPut:
+		var req integrationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		if err := req.apply(in); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()}) //nolint:errcheck
+			return
+		}
+		if err := s.store.UpdateIntegration(r.Context(), in); err != nil {
+			http.Error(w, `{"error":"failed to update integration"}`, http.StatusInternalServerError)
+			return
+		}
+		s.auditIntegration(r, auditIntegrationUpdated, in)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(in) //nolint:errcheck
+
+	case http.MethodDelete:
+		if err := s.store.DeleteIntegration(r.Context(), in.ID); err != nil {
+			http.Error(w, `{"error":"failed to delete integration"}`, http.StatusInternalServerError)
+			return
+		}
+		s.auditIntegration(r, auditIntegrationDeleted, in)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) auditIntegration(r *http.Request, action string, in *store.Integration) {
+	apiKey := security.APIKeyFromContext(r.Context())
+	s.recordAudit(&store.AuditEvent{
+		Action:    action,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		Detail: fmt.Sprintf("integration=%s provider=%s enabled=%t alert_types=%s",
+			in.ID, in.Provider, in.Enabled, strings.Join(in.AlertTypes, ",")),
+	})
+}
+
+// handleListTickets returns the tickets integrations opened, newest
+// first, filtered by ?integration=, ?alert=, ?agent= and ?limit=.
+func (s *Server) handleListTickets(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := store.TicketFilter{
+		IntegrationID: q.Get("integration"),
+		AlertID:       q.Get("alert"),
+		AgentID:       q.Get("agent"),
+	}
+	filter.Limit, _ = strconv.Atoi(q.Get("limit"))
+
+	tickets, err := s.store.ListTickets(r.Context(), filter)
+	if err != nil {
+		http.Error(w, `{"error":"failed to list tickets"}`, http.StatusInternalServerError)
+		return
+	}
+	if tickets == nil {
+		tickets = []*store.Ticket{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tickets) //nolint:errcheck
+}
+
+// openTickets opens a ticket for a newly raised alert in every enabled
+// integration that covers its type.
+func (s *Server) openTickets(alert *store.Alert, agentName string) {
+	ctx := s.ctx
+	ins, err := s.store.ListIntegrations(ctx)
+	if err != nil {
+		log.Printf("Integrations: %v", err)
+		return
+	}
+	content := ticketContent{
+		Subject:   fmt.Sprintf("%s: %s", agentName, alert.Message),
+		AgentID:   alert.AgentID,
+		AgentName: agentName,
+		AlertType: alert.Type,
+		Text: fmt.Sprintf("%s\n\nAgent: %s (%s)\nAlert: %s\nRaised: %s\n",
+			alert.Message, agentName, alert.AgentID, alert.Type, alert.RaisedAt.UTC().Format(time.RFC3339)),
+	}
+	for _, in := range ins {
+		if !in.Enabled || !coversAlert(in, alert.Type) {
+			continue
+		}
+		ticket := &store.Ticket{
+			ID:            security.NewID(),
+			IntegrationID: in.ID,
+			AlertID:       alert.ID,
+			AgentID:       alert.AgentID,
+			CreatedAt:     time.Now(),
+		}
+		provider, err := ticketProviders[in.Provider](in.Config)
+		if err == nil {
+			ticket.ExternalID, err = provider.createTicket(ctx, content)
+		}
+		if err != nil {
+			ticket.Error = err.Error()
+			log.Printf("Integration %s: ticket for alert %s: %v", in.Name, alert.ID, err)
+		} else {
+			log.Printf("Integration %s: opened ticket %s for %s", in.Name, ticket.ExternalID, agentName)
+		}
+		if err := s.store.CreateTicket(ctx, ticket); err != nil {
+			log.Printf("Record ticket: %v", err)
+		}
+		s.publishEvent(eventTicketCreated, alert.AgentID, ticket)
+	}
+}
+
+// coversAlert reports whether the integration files tickets for
+// alertType.
+func coversAlert(in *store.Integration, alertType string) bool {
+	if len(in.AlertTypes) == 0 {
+		return true
+	}
+	for _, t := range in.AlertTypes {
+		if t == alertType {
+			return true
+		}
+	}
+	return false
+}
+
+// noteAlertTickets adds a note to every ticket opened for the alert.
+// Tickets whose integration has been deleted or disabled are skipped.
+func (s *Server) noteAlertTickets(alertID string, content ticketContent) {
+	ctx := s.ctx
+	tickets, err := s.store.ListTickets(ctx, store.TicketFilter{AlertID: alertID, Limit: math.MaxInt32})
+	if err != nil {
+		log.Printf("Tickets for alert %s: %v", alertID, err)
+		return
+	}
+	for _, t := range tickets {
+		if t.ExternalID == "" {
+			continue
+		}
+		in, err := s.store.GetIntegration(ctx, t.IntegrationID)
+		if err != nil || in == nil || !in.Enabled {
+			continue
+		}
+		provider, err := ticketProviders[in.Provider](in.Config)
+		if err == nil {
+			c := content
+			c.TicketID = t.ExternalID
+			err = provider.addNote(ctx, c)
+		}
+		if err != nil {
+			log.Printf("Integration %s: note on ticket %s: %v", in.Name, t.ExternalID, err)
+		}
+	}
+}
+
+// noteSessionTickets attaches a summary of a finished viewer session to
+// the tickets of the agent's open alerts.
+func (s *Server) noteSessionTickets(agentName string, session *store.ViewerSession) {
+	open, err := s.store.ListAlerts(s.ctx,
+		store.AlertFilter{AgentID: session.AgentID, Open: true, Limit: math.MaxInt32})
+	if err != nil || len(open) == 0 || session.EndedAt == nil {
+		return
+	}
+	content := ticketContent{
+		Subject:   fmt.Sprintf("Remote session on %s", agentName),
+		AgentID:   session.AgentID,
+		AgentName: agentName,
+		Text: fmt.Sprintf("Remote session on %s by %s\nFrom: %s\nTo: %s (%s)\nKey events: %d, mouse events: %d\nSession: %s\n",
+			agentName, session.APIKeyName,
+			session.StartedAt.UTC().Format(time.RFC3339), session.EndedAt.UTC().Format(time.RFC3339),
+			session.EndedAt.Sub(session.StartedAt).Round(time.Second),
+			session.KeyEvents, session.MouseEvents, session.ID),
+	}
+	for _, a := range open {
+		c := content
+		c.AlertType = a.Type
+		s.noteAlertTickets(a.ID, c)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Glass-to-glass latency: the time from the agent starting to capture a
+// frame to the viewer drawing it. The agent, the server and the viewer
+// keep their own clocks, so only the server's is used, with each link's
+// one-way delay taken as half its round trip:
+//
+//	latency = age + agent RTT/2 + (displayed − stamped) − viewer RTT/2
+//
+// The agent sends a "frame_stamp" just before each frame, carrying its
+// age (capture to send); the server notes when the stamp arrived and
+// relays it, and the viewer answers "frame_displayed" once the frame is
+// drawn. Round trips are measured with WebSocket pings to the agent and
+// the viewer every latencyProbeInterval during the session. Each session
+// keeps an average and the worst; finished sessions store both, and
+// /api/metrics exports a histogram and the live sessions' averages.
+
+const (
+	// latencyProbeInterval is how often both links are pinged.
+	latencyProbeInterval = 2 * time.Second
+
+	// maxPendingStamps is how many stamps await a frame_displayed; the
+	// viewer skips frames it cannot draw in time, so most are never
+	// answered.
+	maxPendingStamps = 64
+)
+
+// glassBuckets are the upper bounds, in seconds, of the latency histogram.
+var glassBuckets = [...]float64{.025, .05, .1, .15, .2, .3, .5, .75, 1, 2, 5}
+
+// Which link a pong came back on.
+const (
+	agentLink = iota
+	viewerLink
+)
+
+// pendingStamp is a frame_stamp awaiting its frame_displayed.
+type pendingStamp struct {
+	seq   uint32
+	at    time.Time // when the stamp reached the server
+	ageMS float64
+}
+
+// sessionLatency measures one agent's viewer session.
+type sessionLatency struct {
+	mu        sync.Mutex
+	agentRTT  float64 // ms, moving averages; 0 until measured
+	viewerRTT float64
+	stamps    []pendingStamp // ring of the latest maxPendingStamps
+	next      int
+	avg       float64 // ms, moving average of glass-to-glass latency
+	max       float64
+	samples   int64
+}
+
+// latencySnapshot is a session's latency so far, for session diagnostics.
+type latencySnapshot struct {
+	GlassMS    float64 `json:"glass_ms"`     // moving average
+	MaxGlassMS float64 `json:"max_glass_ms"` // the worst frame
+	AgentRTTMS float64 `json:"agent_rtt_ms"`
+	ViewRTTMS  float64 `json:"viewer_rtt_ms"`
+	Samples    int64   `json:"samples"` // frames measured
+}
+
+// reset starts measuring a new session.
+func (l *sessionLatency) reset() {
+	l.mu.Lock()
+	l.agentRTT, l.viewerRTT = 0, 0
+	l.stamps, l.next = make([]pendingStamp, 0, maxPendingStamps), 0
+	l.avg, l.max, l.samples = 0, 0, 0
+	l.mu.Unlock()
+}
+
+// stamped records a frame_stamp as it arrives from the agent.
+func (l *sessionLatency) stamped(st protocol.FrameStamp) {
+	p := pendingStamp{seq: st.Seq, at: time.Now(), ageMS: st.AgeMS}
+	l.mu.Lock()
+	if len(l.stamps) < maxPendingStamps {
+		l.stamps = append(l.stamps, p)
+	} else {
+		l.stamps[l.next] = p
+		l.next = (l.next + 1) % maxPendingStamps
+	}
+	l.mu.Unlock()
+}
+
+// displayed matches a frame_displayed to its stamp and returns the
+// frame's glass-to-glass latency in milliseconds; false if the stamp is
+// unknown or the links have not been measured yet.
+func (l *sessionLatency) displayed(d protocol.FrameDisplayed) (float64, bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.agentRTT == 0 || l.viewerRTT == 0 {
+		return 0, false
+	}
+	for i, p := range l.stamps {
+		if p.seq != d.Seq || p.at.IsZero() {
+			continue
+		}
+		l.stamps[i].at = time.Time{} // answered
+		glass := p.ageMS + l.agentRTT/2 + ms(now.Sub(p.at)) - l.viewerRTT/2
+		glass = max(glass, p.ageMS)
+		l.avg = ewma(l.avg, glass)
+		l.max = max(l.max, glass)
+		l.samples++
+		return glass, true
+	}
+	return 0, false
+}
+
+// pong records the round trip of a ping sent by probeLatency.
+func (l *sessionLatency) pong(link int, payload []byte) {
+	if len(payload) != 8 {
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+	rtt := ms(time.Since(sent))
+	if rtt < 0 || rtt > float64(time.Minute.Milliseconds()) {
+		return
+	}
+	l.mu.Lock()
+	if link == agentLink {
+		l.agentRTT = ewma(l.agentRTT, rtt)
+	} else {
+		l.viewerRTT = ewma(l.viewerRTT, rtt)
+	}
+	l.mu.Unlock()
+}
+
+func (l *sessionLatency) snapshot() latencySnapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return latencySnapshot{
+		GlassMS:    round1(l.avg),
+		MaxGlassMS: round1(l.max),
+		AgentRTTMS: round1(l.agentRTT),
+		ViewRTTMS:  round1(l.viewerRTT),
+		Samples:    l.samples,
+	}
+}
+
+// probeLatency pings the agent and the viewer every latencyProbeInterval
+// until stop is called. The pong echoes the send time.
+func (s *Server) probeLatency(agent *LiveAgent, viewer protocol.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(latencyProbeInterval)
+		defer ticker.Stop()
+		for {
+			var payload [8]byte
+			binary.BigEndian.PutUint64(payload[:], uint64(time.Now().UnixNano()))
+			_ = agent.write(protocol.OpPing, payload[:])
+			_ = viewer.WriteFrame(protocol.OpPing, payload[:])
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// latencyHistogram counts glass-to-glass latencies across sessions.
+type latencyHistogram struct {
+	buckets [len(glassBuckets)]atomic.Uint64 // per bucket, not cumulative
+	count   atomic.Uint64
+	micros  atomic.Int64
+}
+
+// observe records a latency of ms milliseconds.
+func (h *latencyHistogram) observe(ms float64) {
+	h.count.Add(1)
+	h.micros.Add(int64(ms * 1000))
+	for i, le := range glassBuckets {
+		if ms/1000 <= le {
+			h.buckets[i].Add(1)
+			break
+		}
+	}
+}
+
+// writeLatencyMetrics writes the latency histogram and the average of
+// each live session, labelled with its agent.
+func (s *Server) writeLatencyMetrics(w io.Writer) {
+	h := &s.glassLatency
+	fmt.Fprintf(w, "# HELP rmm_session_latency_seconds Glass-to-glass latency of screen frames, capture to display.\n"+ //nolint:errcheck
+		"# TYPE rmm_session_latency_seconds histogram\n")
+	var cum uint64
+	for i, le := range glassBuckets {
+		cum += h.buckets[i].Load()
+		fmt.Fprintf(w, "rmm_session_latency_seconds_bucket{le=\"%g\"} %d\n", le, cum) //nolint:errcheck
+	}
+	count := h.count.Load()
+	fmt.Fprintf(w, "rmm_session_latency_seconds_bucket{le=\"+Inf\"} %d\n"+ //nolint:errcheck
+		"rmm_session_latency_seconds_sum %g\nrmm_session_latency_seconds_count %d\n",
+		count, float64(h.micros.Load())/1e6, count)
+
+	s.mu.RLock()
+	live := make(map[string]latencySnapshot, len(s.viewers))
+	for id := range s.viewers {
+		if agent, ok := s.agents[id]; ok {
+			live[id] = agent.latency.snapshot()
+		}
+	}
+	s.mu.RUnlock()
+	ids := make([]string, 0, len(live))
+	for id, snap := range live {
+		if snap.Samples > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	fmt.Fprintf(w, "# HELP rmm_session_latency_current_seconds Moving average of each live session's glass-to-glass latency.\n"+ //nolint:errcheck
+		"# TYPE rmm_session_latency_current_seconds gauge\n")
+	for _, id := range ids {
+		fmt.Fprintf(w, "rmm_session_latency_current_seconds{agent=%q} %g\n", id, live[id].GlassMS/1000) //nolint:errcheck
+	}
+}
+
+// ewma folds sample into avg with weight 0.2, starting from the first
+// sample.
+func ewma(avg, sample float64) float64 {
+	if avg == 0 {
+		return sample
+	}
+	return avg + 0.2*(sample-avg)
+}
+
+func ms(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+// round1 rounds to one decimal place.
+func round1(v float64) float64 {
+	return float64(int64(v*10+0.5)) / 10
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// shutdownTimeout bounds how long shutdown waits for requests in flight,
+// and then for agent and viewer connections, to finish.
+const shutdownTimeout = 10 * time.Second
+
+// serveAll binds every address (or takes the sockets systemd passed, see
+// listenAll) and serves handler on each of them. A nil tlsCfg serves
+// plain HTTP. Each listener speaks protocols. Every request's context
+// derives from ctx. It blocks until
+// any listener fails, or until ctx is canceled, when it shuts the
+// listeners down gracefully and returns nil.
+func serveAll(ctx context.Context, addrs []string, handler http.Handler, tlsCfg *tls.Config, protocols *http.Protocols) error {
+	listeners, err := listenAll(addrs)
+	if err != nil {
+		return err
+	}
+	errCh := make(chan error, len(listeners))
+	var servers []*http.Server
+
+	for _, ln := range listeners {
+		addr := ln.Addr().String()
+		server := &http.Server{
+			Addr:        addr,
+			Handler:     handler,
+			TLSConfig:   tlsCfg,
+			Protocols:   protocols,
+			BaseContext: func(net.Listener) context.Context { return ctx },
+		}
+		servers = append(servers, server)
+
+		go func() {
+			if tlsCfg != nil {
+				errCh <- fmt.Errorf("serve %s: %w", addr, server.ServeTLS(ln, "", ""))
+			} else {
+				errCh <- fmt.Errorf("serve %s: %w", addr, server.Serve(ln))
+			}
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Shutdown %s: %v", server.Addr, err)
+		}
+	}
+	return nil
+}
+
+// startRedirectListener serves plain HTTP on addr, redirecting every
+// request to the HTTPS listener on httpsAddr. If wrap is non-nil the
+// redirect handler is passed through it first (used to layer the ACME
+// HTTP-01 challenge responder in front).
+func startRedirectListener(addr, httpsAddr string, wrap func(http.Handler) http.Handler) {
+	var handler http.Handler = redirectToHTTPS(httpsAddr)
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+
+	go func() {
+		log.Printf("HTTP redirect listener on %s", addr)
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			log.Printf("HTTP redirect listener error: %v", err)
+		}
+	}()
+}
+
+// redirectToHTTPS returns a handler that permanently redirects to the same
+// host and path over HTTPS, on the port of httpsAddr (omitted for 443).
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]" // bare IPv6 literal
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Agent liveness: agents send a heartbeat every agentHeartbeat, and any
+// frame from an agent counts as a sign of life. An agent silent for more
+// than a heartbeat and a half is "idle", for three heartbeats "stale";
+// after five the server closes its connection, which a host that vanished
+// without a TCP reset would otherwise hold open for good, and the agent
+// goes offline as if it had disconnected. Status changes are published as
+// agent.status events. Alert rules skip stale agents, as they do offline
+// ones, since their figures are out of date.
+
+// Agent statuses, as reported by /api/agents.
+const (
+	agentOnline = "online"
+	agentIdle   = "idle"
+	agentStale  = "stale"
+)
+
+const (
+	// agentHeartbeat is the agents' heartbeat period.
+	agentHeartbeat = 30 * time.Second
+
+	agentIdleAfter    = agentHeartbeat * 3 / 2
+	agentStaleAfter   = 3 * agentHeartbeat
+	agentOfflineAfter = 5 * agentHeartbeat
+
+	// livenessTick is how often agents' silence is checked.
+	livenessTick = 10 * time.Second
+
+	eventAgentStatus = "agent.status"
+)
+
+// agentStatus is the payload of agent.status events.
+type agentStatus struct {
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// statusAfter is the status of an agent silent for d.
+func statusAfter(d time.Duration) string {
+	switch {
+	case d > agentStaleAfter:
+		return agentStale
+	case d > agentIdleAfter:
+		return agentIdle
+	}
+	return agentOnline
+}
+
+// seen records a frame from the agent at now. It reports whether that
+// brought the agent back online from idle or stale.
+func (a *LiveAgent) seen(now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.LastSeen = now
+	if a.Status == agentOnline {
+		return false
+	}
+	a.Status = agentOnline
+	return true
+}
+
+// status returns the agent's status and when it was last heard from.
+func (a *LiveAgent) status() agentStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return agentStatus{Status: a.Status, LastSeen: a.LastSeen}
+}
+
+// runLiveness checks connected agents' silence until the server shuts
+// down.
+func (s *Server) runLiveness() {
+	ticker := time.NewTicker(livenessTick)
+	defer ticker.Stop()
+	for s.tick(ticker) {
+		s.checkLiveness(time.Now())
+	}
+}
+
+// checkLiveness moves agents silent for too long to idle or stale, and
+// closes the connections of those silent for agentOfflineAfter; their
+// connection handlers take them offline.
+func (s *Server) checkLiveness(now time.Time) {
+	s.mu.RLock()
+	agents := make([]*LiveAgent, 0, len(s.agents))
+	for _, a := range s.agents {
+		agents = append(agents, a)
+	}
+	s.mu.RUnlock()
+
+	for _, a := range agents {
+		a.mu.Lock()
+		silent := now.Sub(a.LastSeen)
+		prev := a.Status
+		a.Status = statusAfter(silent)
+		st := agentStatus{Status: a.Status, LastSeen: a.LastSeen}
+		a.mu.Unlock()
+
+		if silent > agentOfflineAfter {
+			log.Printf("Agent %s (%s) silent for %s; closing its connection", a.Name, a.ID, silent.Round(time.Second))
+			_ = a.conn.Close()
+			continue
+		}
+		if st.Status != prev {
+			s.debugf("Agent %s: %s after %s without a frame", a.Name, st.Status, silent.Round(time.Second))
+			s.publishEvent(eventAgentStatus, a.ID, st)
+		}
+	}
+}
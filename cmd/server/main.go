@@ -6,29 +6,67 @@ import (
 	"context"
 	"crypto/tls"
 	"flag"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
+	"github.com/avaropoint/rmm/internal/protocol"
 	"github.com/avaropoint/rmm/internal/security"
 	"github.com/avaropoint/rmm/internal/store"
 	"github.com/avaropoint/rmm/internal/version"
+	"github.com/avaropoint/rmm/web"
 )
 
 func main() {
 	addr := flag.String("addr", ":8443", "Server listen address")
-	webDir := flag.String("web", "", "Web assets directory path")
+	webDir := flag.String("web", "", "Serve web assets from this directory instead of the embedded copy")
 	dataDir := flag.String("data", "data", "Data directory for database and platform identity")
 	certsDir := flag.String("certs", "certs", "Directory for TLS certificates")
 	insecure := flag.Bool("insecure", false, "Run without TLS (development only)")
 	acmeDomain := flag.String("acme", "", "Enable Let's Encrypt for this domain (e.g. rmm.example.com)")
 	certFile := flag.String("cert", "", "Path to TLS certificate file (custom cert mode)")
 	keyFile := flag.String("key", "", "Path to TLS key file (custom cert mode)")
+	configFile := flag.String("config", "", "Path to JSON config file (listeners, redirect)")
+	redirectAddr := flag.String("redirect", "", "Plain-HTTP address that redirects to HTTPS (e.g. :80)")
+	adminSocket := flag.String("admin-socket", "", "Unix socket for the local admin API (default <data>/admin.sock, \"-\" disables)")
+	requireKeyBinding := flag.Bool("require-key-binding", false, "Reject agent enrollments that do not bind a TPM key")
+	fips := flag.Bool("fips", false, "Enforce FIPS 140-3 approved cryptography; refuse to start otherwise")
+	restore := flag.Bool("restore-platform", false, "Restore platform.key from an rmmctl escrow recovery code read from stdin, then exit")
 	flag.Parse()
 
 	log.Printf("Server v%s (built %s)", version.Version, version.BuildTime)
 
+	cfg, err := loadServerConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Config: %v", err)
+	}
+	// Flags win over the file, on reload too.
+	overrides := func(cfg *Config) {
+		if *redirectAddr != "" {
+			cfg.HTTPRedirect = *redirectAddr
+		}
+		if *adminSocket != "" {
+			cfg.AdminSocket = *adminSocket
+		}
+		if *fips {
+			cfg.FIPS = true
+		}
+	}
+	overrides(cfg)
+	if cfg.FIPS {
+		if err := security.CheckFIPS(); err != nil {
+			log.Fatalf("FIPS mode: %v", err)
+		}
+		if *insecure {
+			log.Fatal("FIPS mode: -insecure is not allowed")
+		}
+	}
+
 	// Ensure data and certs directories exist.
 	if err := os.MkdirAll(*dataDir, 0700); err != nil {
 		log.Fatalf("Failed to create data directory: %v", err)
@@ -39,6 +77,13 @@ func main() {
 		}
 	}
 
+	if *restore {
+		if err := restorePlatform(*dataDir, os.Stdin, os.Stderr); err != nil {
+			log.Fatalf("Restore platform key: %v", err)
+		}
+		return
+	}
+
 	// Initialise platform identity.
 	platform, err := security.LoadOrCreatePlatform(*dataDir)
 	if err != nil {
@@ -50,6 +95,8 @@ func main() {
 	var tlsCfg *tls.Config
 	var tlsPaths *security.TLSConfig
 	var tlsResult security.TLSResult
+	rl := &reloader{path: *configFile, overrides: overrides, acmeDomain: *acmeDomain}
+	var certFiles [2]string // certificate and key, when loaded from files
 
 	switch {
 	case *insecure:
@@ -61,7 +108,8 @@ func main() {
 
 	case *acmeDomain != "":
 		tlsResult.Mode = security.TLSModeACME
-		tlsResult.ACMEManager, tlsCfg = security.NewACMEManager(*certsDir, *acmeDomain)
+		rl.acmeHosts = security.NewACMEHosts(append([]string{*acmeDomain}, cfg.ACMEDomains...)...)
+		tlsResult.ACMEManager, tlsCfg = security.NewACMEManager(*certsDir, rl.acmeHosts)
 		if *addr == ":8443" {
 			*addr = ":443" // ACME typically needs port 443.
 		}
@@ -73,6 +121,7 @@ func main() {
 		if err != nil {
 			log.Fatalf("TLS: %v", err)
 		}
+		certFiles = [2]string{*certFile, *keyFile}
 		log.Printf("TLS: Custom certificate (%s)", *certFile)
 
 	default:
@@ -82,9 +131,22 @@ func main() {
 			log.Fatalf("TLS: %v", err)
 		}
 		tlsResult.Paths = tlsPaths
+		certFiles = [2]string{tlsPaths.CertPath, tlsPaths.KeyPath}
 		log.Printf("TLS: Self-signed certificates (%s)", tlsPaths.CertPath)
 	}
 	tlsResult.Config = tlsCfg
+	if cfg.FIPS {
+		if err := checkFIPSTLS(tlsCfg); err != nil {
+			log.Fatalf("FIPS mode: %v", err)
+		}
+		log.Println("FIPS mode: enforced")
+	}
+	if certFiles[0] != "" {
+		// Served through the reloader from here on, so a reload can
+		// swap it.
+		rl.certs = security.NewCertReloader(certFiles[0], certFiles[1], tlsCfg.Certificates[0])
+		tlsCfg.Certificates, tlsCfg.GetCertificate = nil, rl.certs.GetCertificate
+	}
 
 	// Open database.
 	dbPath := filepath.Join(*dataDir, "platform.db")
@@ -97,68 +159,258 @@ func main() {
 	// Ensure at least one API key exists (first-run setup).
 	ensureAdminKey(db)
 
-	// Resolve web directory.
-	if *webDir == "" {
-		*webDir = findWebDir()
-	}
-	if *webDir == "" {
-		log.Fatal("Web directory not found. Use -web flag to specify the path.")
+	// Resolve web assets: embedded by default, on-disk override for development.
+	var assets fs.FS = web.Assets
+	if *webDir != "" {
+		absWebDir, _ := filepath.Abs(*webDir)
+		if _, err := os.Stat(filepath.Join(absWebDir, "index.html")); err != nil {
+			log.Fatalf("Web directory %s: index.html not found", absWebDir)
+		}
+		assets = os.DirFS(absWebDir)
+		log.Printf("Web directory: %s", absWebDir)
+	} else {
+		log.Println("Web assets: embedded")
 	}
-	absWebDir, _ := filepath.Abs(*webDir)
-	log.Printf("Web directory: %s", absWebDir)
 
-	srv := NewServer(absWebDir, db, platform, tlsPaths)
+	// Interrupt or SIGTERM stops the background loops, closes agent and
+	// viewer connections and drains requests before the database closes.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := NewServer(ctx, assets, store.NewInstrumented(db, cfg.slowQuery()), platform, tlsPaths)
+	srv.requireKeyBinding = *requireKeyBinding
+	srv.fips = cfg.FIPS
+	srv.settings.Store(cfg)
+	rl.started, srv.reloader = cfg, rl
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go srv.reloadOnSignal(hup)
+	srv.dropboxDir = filepath.Join(*dataDir, "dropbox")
+	go srv.sweepDropbox()
+	srv.screenshotDir = filepath.Join(*dataDir, "screenshots")
+	srv.diagnosticsDir = filepath.Join(*dataDir, "diagnostics")
+	srv.artifactDir = filepath.Join(*dataDir, "artifacts")
+	srv.recordingDir = filepath.Join(*dataDir, "recordings")
+	srv.brandingDir = filepath.Join(*dataDir, "branding")
+	go srv.runRecordingRetention()
+	go srv.runScreenshotSchedules()
+	go srv.runRebootSchedules()
+	go srv.runDeployments()
+	go srv.runAlerts()
+	go srv.runLiveness()
+	go srv.runHealthRetention()
+	srv.reportDir = filepath.Join(*dataDir, "reports")
+	go srv.runReports()
+	srv.backupDir = filepath.Join(*dataDir, "backups")
+	go srv.runOperations()
+	go srv.runUsage()
+	if cfg.Redis != nil {
+		if srv.redis, err = newRedisMirror(cfg.Redis); err != nil {
+			log.Fatalf("Redis: %v", err)
+		}
+	}
+	if cfg.Telemetry != nil {
+		if srv.telemetry, err = newTelemetryBroker(cfg.Telemetry); err != nil {
+			log.Fatalf("Telemetry: %v", err)
+		}
+		go srv.telemetry.run(srv.ctx, srv.handleTelemetryReport)
+	}
+	for _, dest := range cfg.SIEM {
+		e, err := newSIEMExporter(dest)
+		if err != nil {
+			log.Fatalf("SIEM: %v", err)
+		}
+		srv.siem = append(srv.siem, e)
+	}
 
-	auth := security.NewAuthMiddleware(db)
+	auth := srv.auth
 
 	// Public endpoints (no auth required).
 	http.HandleFunc("/api/enroll", srv.handleEnroll)
+	http.HandleFunc("/healthz", srv.handleHealth)
 	http.HandleFunc("/ws/agent", srv.handleAgent)
+	http.HandleFunc("/api/agent/support", srv.handleAgentSupport) // agent credential
+	http.HandleFunc("/api/status/{org}", srv.handlePublicStatus)  // published orgs only
+	http.HandleFunc("/status/{org}", srv.handleStatusPage)
+	http.HandleFunc("/embed", srv.handleEmbedPage)             // session ticket
+	http.HandleFunc("/api/branding", srv.handlePublicBranding) // by host name
+	http.HandleFunc("/api/branding/logo", srv.handlePublicBrandingLogo)
 	http.HandleFunc("/api/auth/verify", srv.handleAuthVerify)
+	http.HandleFunc("/api/auth/login", srv.handleLogin)
+	http.HandleFunc("/api/auth/logout", srv.handleLogout)
+	http.HandleFunc("/api/auth/session", srv.handleSession)
+	http.HandleFunc("/.well-known/jwks.json", srv.handleJWKS) // viewer token key
 
 	// Authenticated endpoints.
+	http.HandleFunc("/api/status", auth.Wrap(srv.handleServerStatus))
 	http.HandleFunc("/api/agents", auth.Wrap(srv.handleListAgents))
+	http.HandleFunc("/api/agents/{id}", auth.Wrap(srv.handleDeleteAgent))
+	http.HandleFunc("/api/telemetry", auth.Wrap(srv.handleListTelemetry))
+	http.HandleFunc("/api/agents/{id}/settings", auth.Wrap(srv.handleAgentSettings))
+	http.HandleFunc("/api/agents/{id}/export", auth.Wrap(srv.handleAgentExport))
+	http.HandleFunc("/api/agents/{id}/purge", auth.Wrap(srv.handleAgentPurge))
+	http.HandleFunc("/api/agents/{id}/registry", auth.Wrap(srv.readOnlyForAuditors(srv.handleAgentRegistry)))
+	http.HandleFunc("/api/agents/{id}/startup", auth.Wrap(srv.handleAgentStartup))
+	http.HandleFunc("/api/agents/{id}/startup/{item}/disable", auth.Wrap(srv.readOnlyForAuditors(srv.handleDisableStartupItem)))
+	http.HandleFunc("/api/agents/{id}/hosts", auth.Wrap(srv.readOnlyForAuditors(srv.handleAgentHosts)))
+	http.HandleFunc("/api/agents/{id}/environment", auth.Wrap(srv.readOnlyForAuditors(srv.handleAgentEnvironment)))
+	http.HandleFunc("/api/agents/{id}/actions", auth.Wrap(srv.readOnlyForAuditors(srv.handleAgentActions)))
+	http.HandleFunc("/api/agents/{id}/plugins", auth.Wrap(srv.readOnlyForAuditors(srv.handleAgentPlugins)))
+	http.HandleFunc("/api/agents/{id}/plugins/{name}", auth.Wrap(srv.readOnlyForAuditors(srv.handleRunPlugin)))
+	http.HandleFunc("/api/actions", auth.Wrap(srv.readOnlyForAuditors(srv.handleBulkActions)))
+	http.HandleFunc("/api/agents/{id}/fs", auth.Wrap(srv.requirePermission(protocol.PermFiles, srv.handleAgentFS)))
+	http.HandleFunc("/api/agents/{id}/fs/{op}", auth.Wrap(srv.requirePermission(protocol.PermFiles, srv.handleAgentFSOp)))
+	http.HandleFunc("/api/agents/{id}/dropbox", auth.Wrap(srv.requirePermission(protocol.PermFiles, srv.handleAgentDropbox)))
+	http.HandleFunc("/api/agents/{id}/dropbox/{file}", auth.Wrap(srv.requirePermission(protocol.PermFiles, srv.handleDropboxFile)))
+	http.HandleFunc("/api/agents/{id}/screenshots", auth.Wrap(srv.handleListScreenshots))
+	http.HandleFunc("/api/agents/{id}/screenshots/schedule", auth.Wrap(srv.handleScreenshotSchedule))
+	http.HandleFunc("/api/agents/{id}/screenshots/{shot}", auth.Wrap(srv.handleGetScreenshot))
+	http.HandleFunc("/api/recordings", auth.Wrap(srv.handleListRecordings))
+	http.HandleFunc("/api/recordings/{id}", auth.Wrap(srv.handleRecording))
+	http.HandleFunc("/api/recordings/{id}/file", auth.Wrap(srv.handleRecordingFile))
+	http.HandleFunc("/api/recordings/{id}/play", auth.Wrap(srv.handleRecordingPlay))
+	http.HandleFunc("/api/recordings/{id}/hold", auth.Wrap(srv.handleRecordingHold))
+	http.HandleFunc("/api/agents/{id}/session/diagnostics", auth.Wrap(srv.handleSessionDiagnostics))
+	http.HandleFunc("/api/agents/{id}/diagnostics", auth.Wrap(srv.handleAgentDiagnostics))
+	http.HandleFunc("/api/agents/{id}/diagnostics/{archive}", auth.Wrap(srv.handleDiagnosticsArchive))
+	http.HandleFunc("/api/agents/{id}/power", auth.Wrap(srv.readOnlyForAuditors(srv.handleAgentPower)))
+	http.HandleFunc("/api/agents/{id}/reboots", auth.Wrap(srv.handleAgentReboots))
+	http.HandleFunc("/api/agents/{id}/health", auth.Wrap(srv.handleAgentHealth))
+	http.HandleFunc("/api/agents/{id}/deployments", auth.Wrap(srv.readOnlyForAuditors(srv.handleAgentDeployments)))
+	http.HandleFunc("/api/agents/{id}/permissions", auth.Wrap(srv.handleAgentPermissions))
+	http.HandleFunc("/api/agents/{id}/ssh", auth.Wrap(srv.readOnlyForAuditors(srv.handleAgentSSH)))
+	http.HandleFunc("/api/agents/{id}/ssh/sync", auth.Wrap(srv.readOnlyForAuditors(srv.handleAgentSSH)))
+	http.HandleFunc("/api/agents/{id}/ssh/users/{user}", auth.Wrap(srv.readOnlyForAuditors(srv.handleAgentSSHUser)))
+	http.HandleFunc("/api/ssh-keys", auth.Wrap(srv.readOnlyForAuditors(srv.handleSSHKeys)))
+	http.HandleFunc("/api/ssh-keys/{id}", auth.Wrap(srv.readOnlyForAuditors(srv.handleSSHKey)))
+	http.HandleFunc("/api/reboots/schedules", auth.Wrap(srv.readOnlyForAuditors(srv.handleRebootSchedules)))
+	http.HandleFunc("/api/reboots/schedules/{id}", auth.Wrap(srv.readOnlyForAuditors(srv.handleRebootSchedule)))
+	http.HandleFunc("/api/access/schedules", auth.Wrap(srv.handleAccessSchedules))
+	http.HandleFunc("/api/access/schedules/{id}", auth.Wrap(srv.handleAccessSchedule))
+	http.HandleFunc("/api/access/overrides", auth.Wrap(srv.handleAccessOverrides))
+	http.HandleFunc("/api/access/overrides/{id}/{decision}", auth.Wrap(srv.handleAccessOverrideDecision))
+	http.HandleFunc("/api/session-approvals", auth.Wrap(srv.handleSessionApprovals))
+	http.HandleFunc("/api/session-approvals/{id}/{decision}", auth.Wrap(srv.handleSessionApprovalDecision))
+	http.HandleFunc("/api/deployments", auth.Wrap(srv.readOnlyForAuditors(srv.handleDeployments)))
+	http.HandleFunc("/api/deployments/{id}", auth.Wrap(srv.readOnlyForAuditors(srv.handleDeployment)))
+	http.HandleFunc("/api/artifacts", auth.Wrap(srv.readOnlyForAuditors(srv.handleArtifacts)))
+	http.HandleFunc("/api/artifacts/{id}", auth.Wrap(srv.readOnlyForAuditors(srv.handleArtifact)))
+	http.HandleFunc("/api/alerts", auth.Wrap(srv.handleListAlerts))
+	http.HandleFunc("/api/alerts/rules", auth.Wrap(srv.handleAlertRules))
+	http.HandleFunc("/api/alerts/rules/{id}", auth.Wrap(srv.handleAlertRule))
+	http.HandleFunc("/api/reports", auth.Wrap(srv.handleReports))
+	http.HandleFunc("/api/reports/{id}", auth.Wrap(srv.handleGetReport))
+	http.HandleFunc("/api/reports/schedules", auth.Wrap(srv.handleReportSchedules))
+	http.HandleFunc("/api/reports/schedules/{id}", auth.Wrap(srv.handleReportSchedule))
+	http.HandleFunc("/api/integrations", auth.Wrap(srv.handleIntegrations))
+	http.HandleFunc("/api/integrations/tickets", auth.Wrap(srv.handleListTickets))
+	http.HandleFunc("/api/integrations/{id}", auth.Wrap(srv.handleIntegration))
+	http.HandleFunc("/api/orgs", auth.Wrap(srv.handleOrgs))
+	http.HandleFunc("/api/orgs/{id}", auth.Wrap(srv.handleOrg))
+	http.HandleFunc("/api/orgs/{id}/usage", auth.Wrap(srv.handleOrgUsage))
+	http.HandleFunc("/api/orgs/{id}/status", auth.Wrap(srv.handleOrgStatusSettings))
+	http.HandleFunc("/api/orgs/{id}/branding", auth.Wrap(srv.handleOrgBranding))
+	http.HandleFunc("/api/orgs/{id}/branding/logo", auth.Wrap(srv.handleOrgBrandingLogo))
 	http.HandleFunc("/api/enrollment", auth.Wrap(srv.handleEnrollmentTokens))
-	http.HandleFunc("/ws/viewer", srv.handleViewer)
+	http.HandleFunc("/api/enrollment/{id}/qr", auth.Wrap(srv.handleEnrollmentQR))
+	http.HandleFunc("/api/enrollment/bulk", auth.Wrap(srv.handleBulkEnrollment))
+	http.HandleFunc("/api/provisioning", auth.Wrap(srv.handleProvisioning))
+	http.HandleFunc("/api/provisioning/kits/{target}", auth.Wrap(srv.handleProvisioningKit))
+	http.HandleFunc("/api/viewer/ticket", auth.Wrap(srv.handleViewerTicket))
+	http.HandleFunc("/api/sessions/ticket", auth.Wrap(srv.handleSessionTicket))
+	http.HandleFunc("/api/sessions", auth.Wrap(srv.handleListViewerSessions))
+	http.HandleFunc("/api/audit", auth.Wrap(srv.handleListAuditEvents))
+	http.HandleFunc("/api/events", auth.Wrap(srv.handleEvents))
+	http.HandleFunc("/api/metrics", auth.Wrap(srv.handleMetrics))
+	http.HandleFunc("/api/admin/reload", auth.Wrap(srv.handleReload))
+	http.HandleFunc("/api/admin/backup", auth.Wrap(srv.handleBackup))
+	http.HandleFunc("/api/operations", auth.Wrap(srv.handleOperations))
+	http.HandleFunc("/api/operations/{id}", auth.Wrap(srv.handleOperation))
+	http.HandleFunc("/api/extensions", auth.Wrap(srv.handleExtensions))
+	if err := srv.startExtensions(http.DefaultServeMux, auth); err != nil {
+		log.Fatalf("Extensions: %v", err)
+	}
+	http.HandleFunc("/ws/viewer", srv.handleViewer)   // single-use ticket
+	http.HandleFunc("/ws/gateway", srv.handleGateway) // single-use ticket
 
 	// Static files.
-	http.Handle("/", http.FileServer(http.Dir(absWebDir)))
+	http.Handle("/", newStaticHandler(srv.assets))
 
+	// Local admin API (Unix socket, filesystem permissions only).
+	if cfg.AdminSocket != "-" {
+		sockPath := cfg.AdminSocket
+		if sockPath == "" {
+			sockPath = filepath.Join(*dataDir, "admin.sock")
+		}
+		go func() {
+			if err := serveAdminSocket(sockPath, srv, *dataDir); err != nil {
+				log.Printf("Admin socket error: %v", err)
+			}
+		}()
+	}
+
+	addrs := append([]string{*addr}, cfg.Listen...)
+	handler := srv.logRequests(http.DefaultServeMux)
+
+	if cfg.MDNS != nil {
+		if err := srv.startMDNS(cfg.MDNS, *addr, tlsResult.Mode != security.TLSModeOff); err != nil {
+			log.Fatalf("mDNS: %v", err)
+		}
+	}
+
+	logHTTP2(cfg)
 	switch tlsResult.Mode {
 	case security.TLSModeOff:
 		log.Printf("WARNING: Running without TLS (development mode)")
-		log.Printf("Dashboard: http://localhost%s", *addr)
-		log.Fatal(http.ListenAndServe(*addr, nil))
+		for _, a := range addrs {
+			log.Printf("Dashboard: http://%s", dashboardHost(a))
+		}
+		err = serveAll(ctx, addrs, handler, nil, cfg.protocols())
 
 	case security.TLSModeACME:
-		// Start HTTP-01 challenge handler on port 80.
-		go func() {
-			log.Println("ACME: Starting HTTP-01 challenge handler on :80")
-			if err := http.ListenAndServe(":80", tlsResult.ACMEManager.HTTPHandler(nil)); err != nil {
-				log.Printf("ACME HTTP handler error: %v", err)
-			}
-		}()
-		log.Printf("Dashboard: https://%s%s", *acmeDomain, *addr)
-		server := &http.Server{
-			Addr:      *addr,
-			TLSConfig: tlsCfg,
+		// HTTP-01 challenges require port 80; non-challenge requests are
+		// redirected to HTTPS.
+		if cfg.HTTPRedirect == "" {
+			cfg.HTTPRedirect = ":80"
 		}
-		log.Fatal(server.ListenAndServeTLS("", ""))
+		startRedirectListener(cfg.HTTPRedirect, *addr, tlsResult.ACMEManager.HTTPHandler)
+		log.Printf("Dashboard: https://%s%s", *acmeDomain, *addr)
+		err = serveAll(ctx, addrs, handler, tlsCfg, cfg.protocols())
 
 	default: // TLSModeSelfSigned or TLSModeCustom
-		scheme := "https"
-		log.Printf("Dashboard: %s://localhost%s", scheme, *addr)
-		server := &http.Server{
-			Addr:      *addr,
-			TLSConfig: tlsCfg,
+		if cfg.HTTPRedirect != "" {
+			startRedirectListener(cfg.HTTPRedirect, *addr, nil)
+		}
+		for _, a := range addrs {
+			log.Printf("Dashboard: https://%s", dashboardHost(a))
 		}
-		log.Fatal(server.ListenAndServeTLS("", ""))
+		err = serveAll(ctx, addrs, handler, tlsCfg, cfg.protocols())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stop() // a second signal kills the process
+	log.Println("Shutting down")
+	srv.drain(shutdownTimeout)
+}
+
+// dashboardHost turns a listen address into a browsable host:port,
+// substituting localhost for an unspecified host.
+func dashboardHost(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
 	}
+	return net.JoinHostPort(host, port)
 }
 
 // ensureAdminKey creates the initial admin API key if none exist.
 func ensureAdminKey(db store.Store) {
-	keys, err := db.ListAPIKeys(context.TODO())
+	keys, err := db.ListAPIKeys(context.Background())
 	if err != nil {
 		log.Fatalf("Check API keys: %v", err)
 	}
@@ -170,7 +422,7 @@ func ensureAdminKey(db store.Store) {
 	if err != nil {
 		log.Fatalf("Generate admin key: %v", err)
 	}
-	if err := db.CreateAPIKey(context.TODO(), apiKey); err != nil {
+	if err := db.CreateAPIKey(context.Background(), apiKey); err != nil {
 		log.Fatalf("Store admin key: %v", err)
 	}
 
@@ -179,35 +431,3 @@ func ensureAdminKey(db store.Store) {
 	log.Printf("  %s", rawKey)
 	log.Println("==========================================================")
 }
-
-// findWebDir searches common locations for the web assets directory.
-func findWebDir() string {
-	candidates := []string{
-		"web",
-		"../web",
-		filepath.Join(os.Args[0], "..", "web"),
-	}
-
-	if exe, err := os.Executable(); err == nil {
-		candidates = append(candidates,
-			filepath.Join(filepath.Dir(exe), "web"),
-			filepath.Join(filepath.Dir(exe), "..", "web"),
-		)
-	}
-
-	for _, dir := range candidates {
-		abs, err := filepath.Abs(dir)
-		if err != nil {
-			continue
-		}
-		info, err := os.Stat(abs)
-		if err != nil || !info.IsDir() {
-			continue
-		}
-		if _, err := os.Stat(filepath.Join(abs, "index.html")); err == nil {
-			return abs
-		}
-	}
-
-	return ""
-}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// Deployment kits: ready-to-import artifacts for Microsoft Intune, Jamf
+// Pro and Group Policy that install the agent and its provisioning file,
+// so machines enroll themselves when the tool first runs the kit. Each
+// request mints its own provisioning token (see provisioning.go).
+
+// defaultAgentSource is where kits download agent binaries from unless
+// the request names another location.
+const defaultAgentSource = "https://github.com/avaropoint/rmm/releases/latest/download"
+
+// Deployment kit targets.
+const (
+	kitIntune = "intune"
+	kitJamf   = "jamf"
+	kitGPO    = "gpo"
+)
+
+// kitData is what the kit templates are rendered with.
+type kitData struct {
+	Title        string
+	Generated    time.Time
+	TokenID      string
+	ServerURL    string
+	AgentSource  string // URL (or, for Windows kits, UNC path) of the agent binaries
+	Provisioning string // the provisioning file, indented JSON
+}
+
+// handleProvisioningKit creates a provisioning token (the body takes the
+// fields of POST /api/provisioning, plus "agent_source") and returns the
+// deployment kit for the target: a zip of scripts and Win32 app metadata
+// for Intune, a policy script for Jamf, or a startup script for GPO.
+func (s *Server) handleProvisioningKit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target := r.PathValue("target")
+	if target != kitIntune && target != kitJamf && target != kitGPO {
+		http.Error(w, `{"error":"target must be intune, jamf or gpo"}`, http.StatusNotFound)
+		return
+	}
+	var req struct {
+		provisioningRequest
+		AgentSource string `json:"agent_source"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	source := strings.TrimRight(strings.TrimSpace(req.AgentSource), `/\`)
+	if source == "" {
+		source = defaultAgentSource
+	}
+	if err := checkAgentSource(source, target); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	token, p, ok := s.issueProvisioning(w, r, req.provisioningRequest, target)
+	if !ok {
+		return
+	}
+	file, _ := json.MarshalIndent(p, "", "  ")
+	data := kitData{
+		Title:        "Remote Desktop Agent",
+		Generated:    time.Now().UTC(),
+		TokenID:      token.ID,
+		ServerURL:    p.ServerURL,
+		AgentSource:  source,
+		Provisioning: string(file),
+	}
+	if label := strings.Join(strings.Fields(token.Image+" "+token.Label), " "); label != "" {
+		data.Title += " (" + label + ")"
+	}
+
+	var name string
+	var out bytes.Buffer
+	var err error
+	switch target {
+	case kitIntune:
+		name = "rmm-intune.zip"
+		err = renderIntuneKit(&out, data)
+	case kitJamf:
+		name = "rmm-jamf.sh"
+		err = jamfTemplate.Execute(&out, data)
+	default:
+		name = "rmm-gpo-startup.ps1"
+		err = windowsInstallTemplate.Execute(&out, data)
+	}
+	if err != nil {
+		http.Error(w, `{"error":"failed to generate kit"}`, http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "text/plain; charset=utf-8"
+	if target == kitIntune {
+		contentType = "application/zip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Provisioning-Token", token.ID)
+	_, _ = w.Write(out.Bytes())
+}
+
+// checkAgentSource accepts an http(s) URL, or for the Windows kits a UNC
+// path to a file share, without characters the scripts cannot carry.
+func checkAgentSource(source, target string) error {
+	if strings.ContainsAny(source, "\"'`$\r\n") {
+		return fmt.Errorf("agent_source contains characters not allowed in a script")
+	}
+	switch {
+	case strings.HasPrefix(source, "https://"), strings.HasPrefix(source, "http://"):
+		return nil
+	case strings.HasPrefix(source, `\\`) && target != kitJamf:
+		return nil
+	case target == kitJamf:
+		return fmt.Errorf("agent_source must be an http or https URL")
+	default:
+		return fmt.Errorf("agent_source must be an http or https URL or a UNC path")
+	}
+}
+
+// renderIntuneKit writes the Intune kit: the install and uninstall
+// scripts to wrap with the Win32 Content Prep Tool, and the Win32 app's
+// metadata (Graph win32LobApp) with its detection rule.
+func renderIntuneKit(out *bytes.Buffer, data kitData) error {
+	zw := zip.NewWriter(out)
+	for _, f := range []struct {
+		name string
+		tmpl *template.Template
+	}{
+		{"install.ps1", windowsInstallTemplate},
+		{"uninstall.ps1", windowsUninstallTemplate},
+		{"intune-app.json", intuneAppTemplate},
+	} {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: data.Generated})
+		if err != nil {
+			return err
+		}
+		if err := f.tmpl.Execute(fw, data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// kitFuncs quote values for the languages the kits are written in.
+var kitFuncs = template.FuncMap{
+	"date": func(t time.Time) string { return t.Format("2006-01-02 15:04 UTC") },
+	"sh":   func(s string) string { return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'" },
+	"ps":   func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" },
+	"json": func(s string) string { b, _ := json.Marshal(s); return string(b) },
+	"file": func() string { return protocol.ProvisioningFile },
+}
+
+// windowsInstallTemplate is the GPO startup script and the Intune install
+// script. It does nothing once the service exists, so it can run at every
+// startup.
+var windowsInstallTemplate = template.Must(template.New("windows").Funcs(kitFuncs).Parse(`# {{.Title}} — installer generated {{date .Generated}}
+# Installs the agent as a service that enrolls itself with {{.ServerURL}}
+# (provisioning token {{.TokenID}}) the first time it starts. Run as SYSTEM:
+# as a Group Policy computer startup script, or an Intune Win32 app.
+$ErrorActionPreference = "Stop"
+
+$ServiceName = "Agent"
+$InstallDir = Join-Path $env:ProgramFiles "Avaropoint"
+$DataDir = Join-Path $env:ProgramData "Avaropoint"
+$AgentSource = {{ps .AgentSource}}
+
+if (Get-Service -Name $ServiceName -ErrorAction SilentlyContinue) {
+    exit 0
+}
+
+$arch = if ($env:PROCESSOR_ARCHITECTURE -eq "ARM64") { "arm64" } else { "amd64" }
+$binaryName = "agent-windows-$arch.exe"
+New-Item -ItemType Directory -Path $InstallDir, $DataDir -Force | Out-Null
+$binary = Join-Path $InstallDir "agent.exe"
+if ($AgentSource -match '^https?://') {
+    [Net.ServicePointManager]::SecurityProtocol = [Net.SecurityProtocolType]::Tls12
+    Invoke-WebRequest -Uri "$AgentSource/$binaryName" -OutFile $binary -UseBasicParsing
+} else {
+    Copy-Item -Path (Join-Path $AgentSource $binaryName) -Destination $binary -Force
+}
+
+# The provisioning file holds a reusable enrollment token: readable by
+# SYSTEM and administrators only.
+icacls $DataDir /inheritance:r /grant:r "*S-1-5-18:(OI)(CI)F" "*S-1-5-32-544:(OI)(CI)F" | Out-Null
+$provision = Join-Path $DataDir {{ps file}}
+$json = @'
+{{.Provisioning}}
+'@
+[IO.File]::WriteAllText($provision, $json)
+
+$service = @{
+    Name           = $ServiceName
+    BinaryPathName = '"' + $binary + '" -provision "' + $provision + '" -tray=false'
+    DisplayName    = "Remote Desktop Agent"
+    Description    = "Remote desktop agent service"
+    StartupType    = "Automatic"
+}
+New-Service @service | Out-Null
+Start-Service -Name $ServiceName
+`))
+
+// windowsUninstallTemplate is the Intune uninstall script.
+var windowsUninstallTemplate = template.Must(template.New("uninstall").Funcs(kitFuncs).Parse(`# {{.Title}} — uninstaller generated {{date .Generated}}
+$ServiceName = "Agent"
+
+if (Get-Service -Name $ServiceName -ErrorAction SilentlyContinue) {
+    Stop-Service -Name $ServiceName -Force -ErrorAction SilentlyContinue
+    sc.exe delete $ServiceName | Out-Null
+}
+Remove-Item -Path (Join-Path $env:ProgramFiles "Avaropoint\agent.exe") -Force -ErrorAction SilentlyContinue
+Remove-Item -Path (Join-Path $env:ProgramData ("Avaropoint\" + {{ps file}})) -Force -ErrorAction SilentlyContinue
+`))
+
+// intuneAppTemplate is the Win32 app's metadata, in the shape of a Graph
+// win32LobApp. Windows Installer return codes keep their usual meaning.
+var intuneAppTemplate = template.Must(template.New("intune").Funcs(kitFuncs).Parse(`{
+  "@odata.type": "#microsoft.graph.win32LobApp",
+  "displayName": {{json .Title}},
+  "description": {{json (print "Installs the remote desktop agent, which enrolls itself with " .ServerURL " (provisioning token " .TokenID ").")}},
+  "publisher": "Avaropoint",
+  "fileName": "install.intunewin",
+  "setupFilePath": "install.ps1",
+  "installCommandLine": "powershell.exe -NoProfile -ExecutionPolicy Bypass -File install.ps1",
+  "uninstallCommandLine": "powershell.exe -NoProfile -ExecutionPolicy Bypass -File uninstall.ps1",
+  "applicableArchitectures": "x64,arm64",
+  "installExperience": {
+    "runAsAccount": "system",
+    "deviceRestartBehavior": "suppress"
+  },
+  "rules": [
+    {
+      "@odata.type": "#microsoft.graph.win32LobAppFileSystemRule",
+      "ruleType": "detection",
+      "path": "%ProgramFiles%\\Avaropoint",
+      "fileOrFolderName": "agent.exe",
+      "check32BitOn64System": false,
+      "operationType": "exists"
+    }
+  ],
+  "returnCodes": [
+    {"returnCode": 0, "type": "success"},
+    {"returnCode": 1707, "type": "success"},
+    {"returnCode": 3010, "type": "softReboot"},
+    {"returnCode": 1641, "type": "hardReboot"},
+    {"returnCode": 1618, "type": "retry"}
+  ]
+}
+`))
+
+// jamfTemplate is the Jamf Pro policy script. It installs the agent as a
+// launch daemon; Screen Recording and Accessibility still need a PPPC
+// configuration profile for /usr/local/bin/agent.
+var jamfTemplate = template.Must(template.New("jamf").Funcs(kitFuncs).Parse(`#!/bin/bash
+#
+# {{.Title}} — Jamf Pro policy script generated {{date .Generated}}
+# Installs the agent as a launch daemon that enrolls itself with
+# {{.ServerURL}} (provisioning token {{.TokenID}}) the first time it starts.
+#
+set -euo pipefail
+
+INSTALL_DIR="/usr/local/bin"
+DATA_DIR="/Library/Application Support/Avaropoint"
+PLIST="/Library/LaunchDaemons/com.avaropoint.agent.plist"
+AGENT_SOURCE={{sh .AgentSource}}
+
+if [ -f "$PLIST" ]; then
+    echo "Agent already installed"
+    exit 0
+fi
+
+case "$(uname -m)" in
+    arm64) ARCH="arm64" ;;
+    *)     ARCH="amd64" ;;
+esac
+
+mkdir -p "$INSTALL_DIR" "$DATA_DIR"
+chmod 700 "$DATA_DIR"
+curl -fsSL "$AGENT_SOURCE/agent-darwin-$ARCH" -o "$INSTALL_DIR/agent.new"
+chmod 755 "$INSTALL_DIR/agent.new"
+mv -f "$INSTALL_DIR/agent.new" "$INSTALL_DIR/agent"
+
+# The provisioning file holds a reusable enrollment token: root only.
+umask 077
+cat > "$DATA_DIR/{{file}}" <<'RMM_PROVISIONING'
+{{.Provisioning}}
+RMM_PROVISIONING
+umask 022
+
+cat > "$PLIST" <<EOF
+<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key>
+    <string>com.avaropoint.agent</string>
+    <key>ProgramArguments</key>
+    <array>
+        <string>$INSTALL_DIR/agent</string>
+        <string>-provision</string>
+        <string>$DATA_DIR/{{file}}</string>
+        <string>-tray=false</string>
+    </array>
+    <key>RunAtLoad</key>
+    <true/>
+    <key>KeepAlive</key>
+    <true/>
+    <key>StandardOutPath</key>
+    <string>/var/log/avaropoint-agent.log</string>
+    <key>StandardErrorPath</key>
+    <string>/var/log/avaropoint-agent.log</string>
+</dict>
+</plist>
+EOF
+chmod 644 "$PLIST"
+launchctl bootstrap system "$PLIST"
+echo "Agent installed"
+`))
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/avaropoint/rmm/internal/mdns"
+	"github.com/avaropoint/rmm/internal/version"
+)
+
+// mDNS advertising: with "mdns" in the config, the server announces itself
+// as an instance of _rmm._tcp.local on the local link and answers queries
+// for it, so agents on an air-gapped network can enroll with -discover
+// local and no URL. The TXT record tells agents whether to use TLS and the
+// platform fingerprint, which they log at enrollment (to compare with the
+// one logged at startup) and later use to ignore other deployments on the
+// same link.
+//
+// mDNS is unauthenticated: anyone on the link can answer. Trust still
+// comes from TLS, as with a typed URL — the CA pinned at enrollment, or a
+// public CA.
+
+// mdnsService is the DNS-SD service type agents browse for.
+const mdnsService = "_rmm._tcp"
+
+// startMDNS advertises the server listening on addr until the server stops.
+func (s *Server) startMDNS(cfg *MDNSConfig, addr string, useTLS bool) error {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	var ifi *net.Interface
+	if cfg.Interface != "" {
+		if ifi, err = net.InterfaceByName(cfg.Interface); err != nil {
+			return err
+		}
+	}
+	tlsFlag := "0"
+	if useTLS {
+		tlsFlag = "1"
+	}
+	text := []string{
+		"tls=" + tlsFlag,
+		"fp=" + s.platform.Fingerprint(),
+		"v=" + version.Version,
+	}
+	responder := mdns.NewResponder(cfg.Name, mdnsService, port, text, ifi)
+	log.Printf("mDNS: advertising %s on port %d", responder.Instance(), port)
+	go func() {
+		if err := responder.Serve(s.ctx); err != nil {
+			log.Printf("mDNS: %v", err)
+		}
+	}()
+	return nil
+}
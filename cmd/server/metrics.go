@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Prometheus metrics: /api/metrics serves connection gauges, viewer
+// session latency (see latency.go), enrollment activity (see
+// enrollstats.go), agent plugin readings (see plugins.go) and, when the store is instrumented, per-method store
+// latency and error counts, in the text exposition format. Scrapers authenticate with an API key as a
+// bearer token, like any other API client.
+
+// handleMetrics writes the server's metrics.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	agents, viewers := len(s.agents), len(s.viewers)
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintf(w, "# HELP rmm_agents_connected Agents currently connected.\n"+ //nolint:errcheck
+		"# TYPE rmm_agents_connected gauge\nrmm_agents_connected %d\n"+
+		"# HELP rmm_viewers_connected Remote-control sessions in progress.\n"+
+		"# TYPE rmm_viewers_connected gauge\nrmm_viewers_connected %d\n"+
+		"# HELP rmm_uptime_seconds Seconds since the server started.\n"+
+		"# TYPE rmm_uptime_seconds gauge\nrmm_uptime_seconds %d\n",
+		agents, viewers, int64(time.Since(s.startedAt).Seconds()))
+	s.writeLatencyMetrics(w)
+	s.writeEnrollmentMetrics(w)
+	s.writePluginMetrics(w)
+	if inst, ok := s.store.(*store.Instrumented); ok {
+		inst.WriteMetrics(w) //nolint:errcheck
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds one delivery attempt to a channel.
+const notifyTimeout = 30 * time.Second
+
+// notification is a message for a notification channel, optionally with
+// one attached file.
+type notification struct {
+	Subject    string
+	Text       string
+	Attachment *attachment
+}
+
+type attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// channel returns the configured channel with the given name.
+func (s *Server) channel(name string) (NotificationChannel, bool) {
+	for _, ch := range s.config().Notifications {
+		if ch.Name == name {
+			return ch, true
+		}
+	}
+	return NotificationChannel{}, false
+}
+
+// notify sends n to each named channel and returns the names that
+// accepted it, along with an error describing any that did not.
+func (s *Server) notify(names []string, n notification) ([]string, error) {
+	var sent, failed []string
+	for _, name := range names {
+		ch, ok := s.channel(name)
+		var err error
+		switch {
+		case !ok:
+			err = fmt.Errorf("not configured")
+		case ch.Type == channelWebhook:
+			err = sendWebhook(ch, n)
+		case ch.Type == channelEmail:
+			err = sendEmail(ch, n)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		sent = append(sent, name)
+	}
+	if len(failed) > 0 {
+		return sent, fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return sent, nil
+}
+
+// sendWebhook POSTs n as JSON; the attachment's content is base64.
+func sendWebhook(ch NotificationChannel, n notification) error {
+	body := map[string]any{"subject": n.Subject, "text": n.Text}
+	if a := n.Attachment; a != nil {
+		body["attachment"] = map[string]string{
+			"name":         a.Name,
+			"content_type": a.ContentType,
+			"data":         base64.StdEncoding.EncodeToString(a.Data),
+		}
+	}
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequest(http.MethodPost, ch.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range ch.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := (&http.Client{Timeout: notifyTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()        //nolint:errcheck
+	io.Copy(io.Discard, resp.Body) //nolint:errcheck
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// sendEmail mails n through the channel's SMTP server, with the
+// attachment as a second MIME part.
+func sendEmail(ch NotificationChannel, n notification) error {
+	var msg bytes.Buffer
+	mw := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/mixed; boundary=%q\r\n\r\n",
+		ch.From, strings.Join(ch.To, ", "), mime.QEncoding.Encode("utf-8", n.Subject),
+		time.Now().Format(time.RFC1123Z), mw.Boundary())
+
+	part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	part.Write([]byte(n.Text)) //nolint:errcheck
+	if a := n.Attachment; a != nil {
+		part, _ = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+		})
+		enc := base64.StdEncoding.EncodeToString(a.Data)
+		for len(enc) > 76 {
+			fmt.Fprintf(part, "%s\r\n", enc[:76]) //nolint:errcheck
+			enc = enc[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", enc) //nolint:errcheck
+	}
+	mw.Close() //nolint:errcheck
+
+	var auth smtp.Auth
+	if ch.Username != "" {
+		host, _, _ := net.SplitHostPort(ch.SMTP)
+		auth = smtp.PlainAuth("", ch.Username, ch.Password, host)
+	}
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(ch.SMTP, auth, ch.From, ch.To, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(notifyTimeout):
+		return fmt.Errorf("smtp: timed out")
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Operations: long-running server actions — on-demand reports, database
+// backups, quick actions on many agents — run in the background on a pool
+// of operationWorkers workers, so the request that starts one answers at
+// once with 202 and the operation. Each is stored with its state, a
+// progress percentage and, once it succeeds, its result. GET
+// /api/operations/{id} polls it, operation.updated events follow it and
+// DELETE /api/operations/{id} cancels it. Operations a restart cut short
+// are marked failed when the server starts.
+
+const (
+	// operationWorkers is how many operations run at a time.
+	operationWorkers = 4
+	// operationQueueSize caps the operations waiting for a worker.
+	operationQueueSize = 256
+	// operationSaveInterval is how often an operation's progress is
+	// stored and published while it runs.
+	operationSaveInterval = time.Second
+	// operationRetention is how long finished operations are kept.
+	operationRetention = 30 * 24 * time.Hour
+	// operationTick is how often expired operations are deleted.
+	operationTick = time.Hour
+	// maxOperationList bounds GET /api/operations.
+	maxOperationList = 100
+
+	auditOperationCanceled = "operation_canceled"
+
+	eventOperationUpdated = "operation.updated"
+)
+
+// errOperationsBusy is returned when the operation queue is full.
+var errOperationsBusy = errors.New("too many operations queued")
+
+// operationFunc does an operation's work, reporting progress through op,
+// and returns its result, which is stored as JSON. It should return soon
+// after ctx is canceled.
+type operationFunc func(ctx context.Context, op *operation) (any, error)
+
+// operation is a queued or running operation.
+type operation struct {
+	srv    *Server
+	run    operationFunc
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	rec        store.Operation // guarded by mu
+	canceledBy string          // API key name, guarded by mu
+	saved      time.Time       // when rec was last stored, guarded by mu
+
+	// saveMu orders stores of rec, so an older snapshot never
+	// overwrites a newer one.
+	saveMu sync.Mutex
+}
+
+// operationPool holds the active operations and feeds them to the
+// workers.
+type operationPool struct {
+	queue chan *operation
+
+	mu     sync.Mutex
+	active map[string]*operation
+}
+
+func newOperationPool() operationPool {
+	return operationPool{
+		queue:  make(chan *operation, operationQueueSize),
+		active: make(map[string]*operation),
+	}
+}
+
+// startOperation queues fn as an operation of kind started by apiKey (nil
+// for the server itself) and returns its record as stored.
+func (s *Server) startOperation(kind string, apiKey *store.APIKey, fn operationFunc) (*store.Operation, error) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	op := &operation{srv: s, run: fn, ctx: ctx, cancel: cancel}
+	op.rec = store.Operation{
+		ID:        security.NewID(),
+		Kind:      kind,
+		Status:    store.OperationQueued,
+		CreatedAt: time.Now(),
+	}
+	if apiKey != nil {
+		op.rec.CreatedByID, op.rec.CreatedBy = apiKey.ID, apiKey.Name
+	}
+	if err := s.store.CreateOperation(s.ctx, &op.rec); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	p := &s.operations
+	p.mu.Lock()
+	select {
+	case p.queue <- op:
+		p.active[op.rec.ID] = op
+		p.mu.Unlock()
+	default:
+		p.mu.Unlock()
+		op.finish(nil, errOperationsBusy)
+		cancel()
+		return nil, errOperationsBusy
+	}
+	rec := op.snapshot()
+	s.publishEvent(eventOperationUpdated, "", &rec)
+	return &rec, nil
+}
+
+// runOperations marks operations an earlier run left unfinished as
+// failed, starts the workers and expires finished operations until the
+// server shuts down.
+func (s *Server) runOperations() {
+	if n, err := s.store.InterruptOperations(s.ctx, s.startedAt); err != nil {
+		log.Printf("Operations: %v", err)
+	} else if n > 0 {
+		log.Printf("Operations: %d left unfinished by the last run marked failed", n)
+	}
+	for range operationWorkers {
+		go s.operationWorker()
+	}
+
+	ticker := time.NewTicker(operationTick)
+	defer ticker.Stop()
+	for s.tick(ticker) {
+		if _, err := s.store.DeleteOperationsBefore(s.ctx, time.Now().Add(-operationRetention)); err != nil {
+			log.Printf("Operation retention: %v", err)
+		}
+	}
+}
+
+// operationWorker runs queued operations one at a time until the server
+// shuts down.
+func (s *Server) operationWorker() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case op := <-s.operations.queue:
+			op.execute()
+		}
+	}
+}
+
+// execute runs the operation and records its outcome. An operation
+// canceled while it was queued has already finished.
+func (op *operation) execute() {
+	defer op.srv.operations.remove(op.rec.ID)
+	defer op.cancel()
+
+	now := time.Now()
+	op.mu.Lock()
+	if op.rec.FinishedAt != nil {
+		op.mu.Unlock()
+		return
+	}
+	op.rec.Status, op.rec.StartedAt = store.OperationRunning, &now
+	op.mu.Unlock()
+	op.save(true)
+
+	result, err := op.safeRun()
+	op.finish(result, err)
+}
+
+// safeRun runs the operation's function, turning a panic into an error
+// so one faulty operation cannot take the server down.
+func (op *operation) safeRun() (result any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Operation %s (%s) panicked: %v", op.rec.ID, op.rec.Kind, p)
+			result, err = nil, errors.New("internal error")
+		}
+	}()
+	return op.run(op.ctx, op)
+}
+
+// progress records that the operation is percent done and what it is
+// doing. It is stored and published at most every operationSaveInterval.
+// A nil op ignores it, so work that can also run outside an operation
+// can report progress unconditionally.
+func (op *operation) progress(percent int, message string) {
+	if op == nil {
+		return
+	}
+	op.mu.Lock()
+	if op.rec.FinishedAt != nil {
+		op.mu.Unlock()
+		return
+	}
+	op.rec.Progress = min(max(percent, 0), 99)
+	op.rec.Message = message
+	op.mu.Unlock()
+	op.save(false)
+}
+
+// finish records the operation's outcome: its result, or why it failed
+// or who canceled it.
+func (op *operation) finish(result any, err error) {
+	now := time.Now()
+	op.mu.Lock()
+	if op.rec.FinishedAt != nil {
+		op.mu.Unlock()
+		return
+	}
+	op.rec.FinishedAt = &now
+	switch {
+	case op.canceledBy != "":
+		op.rec.Status = store.OperationCanceled
+		op.rec.Error = "canceled by " + op.canceledBy
+	case err != nil:
+		op.rec.Status, op.rec.Error = store.OperationFailed, err.Error()
+	default:
+		op.rec.Status, op.rec.Progress, op.rec.Message = store.OperationSucceeded, 100, ""
+		if result != nil {
+			if data, err := json.Marshal(result); err == nil {
+				op.rec.Result = data
+			}
+		}
+	}
+	status := op.rec.Status
+	op.mu.Unlock()
+	op.save(true)
+	if status == store.OperationFailed {
+		log.Printf("Operation %s (%s) failed: %v", op.rec.ID, op.rec.Kind, err)
+	}
+}
+
+// save stores and publishes the operation's record, unless it was saved
+// less than operationSaveInterval ago and force is not set.
+func (op *operation) save(force bool) {
+	op.saveMu.Lock()
+	defer op.saveMu.Unlock()
+	op.mu.Lock()
+	if !force && time.Since(op.saved) < operationSaveInterval {
+		op.mu.Unlock()
+		return
+	}
+	op.saved = time.Now()
+	rec := op.rec
+	op.mu.Unlock()
+
+	// The server's context may be canceled already; the outcome of an
+	// operation cut short by shutdown is still worth recording.
+	if err := op.srv.store.UpdateOperation(context.Background(), &rec); err != nil {
+		log.Printf("Operation %s: %v", rec.ID, err)
+	}
+	op.srv.publishEvent(eventOperationUpdated, "", &rec)
+}
+
+// snapshot returns a copy of the operation's record.
+func (op *operation) snapshot() store.Operation {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.rec
+}
+
+// get returns the active operation with the ID, or nil.
+func (p *operationPool) get(id string) *operation {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active[id]
+}
+
+func (p *operationPool) remove(id string) {
+	p.mu.Lock()
+	delete(p.active, id)
+	p.mu.Unlock()
+}
+
+// canSeeOperation reports whether apiKey may see or cancel rec: admin
+// keys any operation, other keys those they started.
+func canSeeOperation(apiKey *store.APIKey, rec *store.Operation) bool {
+	return apiKey.Role == store.RoleAdmin || rec.CreatedByID == apiKey.ID
+}
+
+// writeOperation answers a request that started an operation.
+func writeOperation(w http.ResponseWriter, rec *store.Operation, err error) {
+	switch {
+	case errors.Is(err, errOperationsBusy):
+		http.Error(w, `{"error":"too many operations queued; try again later"}`, http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, `{"error":"failed to start operation"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/operations/"+rec.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(rec) //nolint:errcheck
+}
+
+// handleOperations lists recent operations, newest first (?kind=,
+// ?status=, ?limit=). Keys other than admin keys see their own.
+func (s *Server) handleOperations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 || limit > maxOperationList {
+		limit = maxOperationList
+	}
+	filter := store.OperationFilter{Kind: q.Get("kind"), Status: q.Get("status"), Limit: limit}
+	if apiKey := security.APIKeyFromContext(r.Context()); apiKey.Role != store.RoleAdmin {
+		filter.CreatedByID = apiKey.ID
+	}
+	ops, err := s.store.ListOperations(r.Context(), filter)
+	if err != nil {
+		http.Error(w, `{"error":"failed to list operations"}`, http.StatusInternalServerError)
+		return
+	}
+	for i, rec := range ops {
+		// The stored progress of a running operation may lag.
+		if op := s.operations.get(rec.ID); op != nil {
+			live := op.snapshot()
+			ops[i] = &live
+		}
+	}
+	if ops == nil {
+		ops = []*store.Operation{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ops) //nolint:errcheck
+}
+
+// handleOperation returns an operation (GET) or cancels it (DELETE).
+func (s *Server) handleOperation(w http.ResponseWriter, r *http.Request) {
+	apiKey := security.APIKeyFromContext(r.Context())
+	id := r.PathValue("id")
+	op := s.operations.get(id)
+	var rec *store.Operation
+	if op != nil {
+		live := op.snapshot()
+		rec = &live
+	} else if stored, err := s.store.GetOperation(r.Context(), id); err == nil {
+		rec = stored
+	}
+	if rec == nil || !canSeeOperation(apiKey, rec) {
+		http.Error(w, `{"error":"operation not found"}`, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rec) //nolint:errcheck
+
+	case http.MethodDelete:
+		if op == nil || !rec.Active() {
+			http.Error(w, `{"error":"operation has finished"}`, http.StatusConflict)
+			return
+		}
+		op.mu.Lock()
+		op.canceledBy = apiKey.Name
+		queued := op.rec.Status == store.OperationQueued
+		op.mu.Unlock()
+		op.cancel()
+		if queued {
+			// Its worker will skip it; record it now rather than when
+			// the operations ahead of it are done.
+			op.finish(nil, context.Canceled)
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditOperationCanceled,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail:    fmt.Sprintf("operation=%s kind=%s", rec.ID, rec.Kind),
+		})
+		live := op.snapshot()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&live) //nolint:errcheck
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Usage metering: every hour the server samples how many agents each
+// organization has enrolled and connected, and every finished
+// remote-control session adds its duration and relayed bytes to the
+// organization's monthly rollup. Hosting providers bill tenants from
+// /api/orgs/{id}/usage.
+
+// usageTick is how often the sampler checks for a new hour. Samples are
+// keyed by the hour, so restarts and retries never count one twice.
+const usageTick = 5 * time.Minute
+
+// usageMonthLayout is the YYYY-MM form months are named by in the API.
+const usageMonthLayout = "2006-01"
+
+// handleOrgs lists (GET) or creates (POST {"name"}) organizations.
+func (s *Server) handleOrgs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		orgs, err := s.store.ListOrgs(r.Context())
+		if err != nil {
+			http.Error(w, `{"error":"failed to list organizations"}`, http.StatusInternalServerError)
+			return
+		}
+		if orgs == nil {
+			orgs = []*store.Organization{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(orgs) //nolint:errcheck
+
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+			http.Error(w, `{"error":"name required"}`, http.StatusBadRequest)
+			return
+		}
+		apiKey := security.APIKeyFromContext(r.Context())
+		org := &store.Organization{
+			ID:        security.NewID(),
+			Name:      strings.TrimSpace(req.Name),
+			CreatedBy: apiKey.Name,
+			CreatedAt: time.Now(),
+		}
+		if err := s.store.CreateOrg(r.Context(), org); err != nil {
+			http.Error(w, `{"error":"failed to create organization"}`, http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditOrgCreated,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail:    fmt.Sprintf("org=%s name=%q", org.ID, org.Name),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(org) //nolint:errcheck
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleOrg returns (GET) or deletes (DELETE) an organization. Deletion
+// is refused while agents are assigned to it, and removes its branding,
+// usage history and access schedules.
+func (s *Server) handleOrg(w http.ResponseWriter, r *http.Request) {
+	org, err := s.store.GetOrg(r.Context(), r.PathValue("id"))
+	if err != nil || org == nil {
+		http.Error(w, `{"error":"organization not found"}`, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(org) //nolint:errcheck
+
+	case http.MethodDelete:
+		agents, err := s.store.ListAgents(r.Context())
+		if err != nil {
+			http.Error(w, `{"error":"failed to list agents"}`, http.StatusInternalServerError)
+			return
+		}
+		for _, a := range agents {
+			if a.OrgID == org.ID {
+				http.Error(w, `{"error":"organization still has agents"}`, http.StatusConflict)
+				return
+			}
+		}
+		if err := s.store.DeleteOrg(r.Context(), org.ID); err != nil {
+			http.Error(w, `{"error":"failed to delete organization"}`, http.StatusInternalServerError)
+			return
+		}
+		_ = os.Remove(s.logoPath(org.ID))
+		apiKey := security.APIKeyFromContext(r.Context())
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditOrgDeleted,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail:    fmt.Sprintf("org=%s name=%q", org.ID, org.Name),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// orgExists reports whether id names an organization. The empty ID, for
+// unassigned, always exists.
+func (s *Server) orgExists(ctx context.Context, id string) bool {
+	if id == "" {
+		return true
+	}
+	org, err := s.store.GetOrg(ctx, id)
+	return err == nil && org != nil
+}
+
+// usageMonth is a monthly rollup as served by the usage API.
+type usageMonth struct {
+	*store.UsageMonth
+	AgentsAvg      float64 `json:"agents_avg"` // mean of the hourly enrolled counts
+	SessionMinutes int64   `json:"session_minutes"`
+}
+
+// handleOrgUsage returns an organization's monthly usage for
+// ?from=YYYY-MM through ?to=YYYY-MM (default: the last twelve months,
+// including the current one). ?samples=1 adds the hourly agent counts.
+func (s *Server) handleOrgUsage(w http.ResponseWriter, r *http.Request) {
+	org, err := s.store.GetOrg(r.Context(), r.PathValue("id"))
+	if err != nil || org == nil {
+		http.Error(w, `{"error":"organization not found"}`, http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	now := time.Now().UTC()
+	to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, -11, 0)
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(usageMonthLayout, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf(`{"error":"%s must be YYYY-MM"}`, p.name), http.StatusBadRequest)
+				return
+			}
+			*p.dst = t
+		}
+	}
+	if to.Before(from) {
+		http.Error(w, `{"error":"to is before from"}`, http.StatusBadRequest)
+		return
+	}
+
+	months, err := s.store.ListUsageMonths(r.Context(), org.ID,
+		from.Format(usageMonthLayout), to.Format(usageMonthLayout))
+	if err != nil {
+		http.Error(w, `{"error":"failed to read usage"}`, http.StatusInternalServerError)
+		return
+	}
+	out := make([]usageMonth, 0, len(months))
+	for _, m := range months {
+		um := usageMonth{UsageMonth: m, SessionMinutes: (m.SessionSeconds + 59) / 60}
+		if m.Samples > 0 {
+			um.AgentsAvg = float64(m.AgentHours) / float64(m.Samples)
+		}
+		out = append(out, um)
+	}
+
+	resp := map[string]any{
+		"org":    org,
+		"from":   from.Format(usageMonthLayout),
+		"to":     to.Format(usageMonthLayout),
+		"months": out,
+	}
+	if q.Get("samples") == "1" {
+		samples, err := s.store.ListUsageSamples(r.Context(), org.ID, from, to.AddDate(0, 1, 0))
+		if err != nil {
+			http.Error(w, `{"error":"failed to read usage"}`, http.StatusInternalServerError)
+			return
+		}
+		if samples == nil {
+			samples = []*store.UsageSample{}
+		}
+		resp["samples"] = samples
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp) //nolint:errcheck
+}
+
+// runUsage samples per-organization agent counts until the server shuts
+// down.
+// The first sample waits a tick so agents can reconnect after a restart.
+func (s *Server) runUsage() {
+	ticker := time.NewTicker(usageTick)
+	defer ticker.Stop()
+	for s.tick(ticker) {
+		s.sampleUsage()
+	}
+}
+
+// sampleUsage records each organization's enrolled and connected agent
+// counts for the current hour.
+func (s *Server) sampleUsage() {
+	ctx := s.ctx
+	orgs, err := s.store.ListOrgs(ctx)
+	if err != nil || len(orgs) == 0 {
+		return
+	}
+	agents, err := s.store.ListAgents(ctx)
+	if err != nil {
+		log.Printf("Usage sample: %v", err)
+		return
+	}
+	enrolled := make(map[string]int)
+	for _, a := range agents {
+		enrolled[a.OrgID]++
+	}
+	online := make(map[string]int)
+	s.mu.RLock()
+	for _, a := range s.agents {
+		a.mu.Lock()
+		online[a.OrgID]++
+		a.mu.Unlock()
+	}
+	s.mu.RUnlock()
+
+	hour := time.Now().UTC().Truncate(time.Hour)
+	for _, org := range orgs {
+		sample := &store.UsageSample{OrgID: org.ID, At: hour, Agents: enrolled[org.ID], Online: online[org.ID]}
+		if err := s.store.RecordUsageSample(ctx, sample); err != nil {
+			log.Printf("Usage sample for %s: %v", org.Name, err)
+		}
+	}
+}
+
+// meterSession charges a finished viewer session, and the bytes relayed
+// during it, to the agent's organization.
+func (s *Server) meterSession(agent *LiveAgent, session *store.ViewerSession) {
+	bytes := agent.relayed.Swap(0)
+	agent.mu.Lock()
+	orgID := agent.OrgID
+	agent.mu.Unlock()
+	if orgID == "" || session.EndedAt == nil {
+		return
+	}
+	seconds := int64(session.EndedAt.Sub(session.StartedAt).Seconds())
+	if err := s.store.AddSessionUsage(context.Background(), orgID, *session.EndedAt, seconds, bytes); err != nil {
+		log.Printf("Session usage for %s: %v", agent.Name, err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// handleAgentPermissions reports a connected agent's macOS permissions
+// (GET) or asks the local user to grant the missing ones (POST), then
+// reports them again. Agents on other platforms answer with no
+// permissions.
+func (s *Server) handleAgentPermissions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	agent := s.liveAgentOr404(w, r)
+	if agent == nil {
+		return
+	}
+
+	req := protocol.PermissionsRequest{ID: security.NewID(), Prompt: r.Method == http.MethodPost}
+	var res protocol.PermissionsResult
+	if !agent.callOrFail(r.Context(), w, "permissions_request", req.ID, req, &res) {
+		return
+	}
+	agent.mu.Lock()
+	agent.Permissions = res.Permissions
+	agent.mu.Unlock()
+
+	if req.Prompt {
+		apiKey := security.APIKeyFromContext(r.Context())
+		detail := ""
+		if res.Error != "" {
+			detail = fmt.Sprintf("error=%q", res.Error)
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditPermissionsRequested,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			AgentID:   agent.ID,
+			Detail:    detail,
+		})
+		log.Printf("Agent %s: permissions requested by %s", agent.Name, apiKey.Name)
+	}
+	if res.Error != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": res.Error}) //nolint:errcheck
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{ //nolint:errcheck
+		"id":          agent.ID,
+		"permissions": res.Permissions,
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Agent plugins: executables in an agent's plugins directory (see
+// cmd/agent/plugins.go) report a status, metrics and inventory on a
+// schedule. The latest result of each plugin is kept with the live
+// agent: /api/agents/{id}/plugins lists them, /api/metrics exports their
+// status and metrics, plugin_critical alert rules watch them, and a
+// change of status is published as an agent.plugin event. Results are
+// in memory only; agents resend theirs when they reconnect.
+
+const (
+	eventAgentPlugin = "agent.plugin"
+	auditPluginRun   = "plugin_run"
+
+	// maxPlugins caps the plugins kept per agent, and maxPluginEntries
+	// the metrics and the inventory facts kept per result; the rest are
+	// dropped.
+	maxPlugins       = 64
+	maxPluginEntries = 64
+	// maxPluginText caps a result's message and error, and inventory
+	// values, in characters.
+	maxPluginText = 1 << 10
+)
+
+// pluginStatusValues are the values of rmm_agent_plugin_status.
+var pluginStatusValues = map[string]int{
+	protocol.PluginOK:       0,
+	protocol.PluginWarning:  1,
+	protocol.PluginCritical: 2,
+}
+
+// sanitizePluginResult bounds what an agent reported, so a misbehaving
+// plugin cannot bloat the server's memory or metrics.
+func sanitizePluginResult(res *protocol.PluginResult) bool {
+	if !protocol.ValidPluginName(res.Plugin) {
+		return false
+	}
+	if _, ok := pluginStatusValues[res.Status]; !ok {
+		res.Status = protocol.PluginCritical
+	}
+	res.Message, res.Error = truncate(res.Message, maxPluginText), truncate(res.Error, maxPluginText)
+	metrics := map[string]float64{}
+	for _, k := range slices.Sorted(maps.Keys(res.Metrics)) {
+		if len(metrics) < maxPluginEntries && protocol.ValidPluginName(k) {
+			metrics[k] = res.Metrics[k]
+		}
+	}
+	inventory := map[string]string{}
+	for _, k := range slices.Sorted(maps.Keys(res.Inventory)) {
+		if len(inventory) < maxPluginEntries && protocol.ValidPluginName(k) {
+			inventory[k] = truncate(res.Inventory[k], maxPluginText)
+		}
+	}
+	res.Metrics, res.Inventory = metrics, inventory
+	return true
+}
+
+// recordPlugin keeps res as the latest result of its plugin and reports
+// whether the plugin's status changed.
+func (a *LiveAgent) recordPlugin(res protocol.PluginResult) bool {
+	if !sanitizePluginResult(&res) {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	prev, ok := a.plugins[res.Plugin]
+	if !ok && len(a.plugins) >= maxPlugins {
+		return false
+	}
+	if a.plugins == nil {
+		a.plugins = map[string]*protocol.PluginResult{}
+	}
+	a.plugins[res.Plugin] = &res
+	return !ok || prev.Status != res.Status
+}
+
+// pluginResults returns the latest result of each plugin, by name.
+func (a *LiveAgent) pluginResults() []*protocol.PluginResult {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	results := make([]*protocol.PluginResult, 0, len(a.plugins))
+	for _, name := range slices.Sorted(maps.Keys(a.plugins)) {
+		results = append(results, a.plugins[name])
+	}
+	return results
+}
+
+// handlePluginResults records results an agent reported ("plugin_results").
+func (s *Server) handlePluginResults(agent *LiveAgent, payload []byte) {
+	var msg protocol.PluginResults
+	if json.Unmarshal(payload, &msg) != nil {
+		return
+	}
+	changed := false
+	for _, res := range msg.Results {
+		if agent.recordPlugin(res) {
+			changed = true
+			s.publishEvent(eventAgentPlugin, agent.ID, res)
+		}
+	}
+	if changed {
+		go s.evaluateAlerts(agent)
+	}
+}
+
+// handleAgentPlugins lists the latest result of each of the agent's
+// plugins.
+func (s *Server) handleAgentPlugins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	agent := s.liveAgentOr404(w, r)
+	if agent == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(agent.pluginResults()) //nolint:errcheck
+}
+
+// handleRunPlugin runs one of the agent's plugins now, with the optional
+// {"args":{...}} of the request body, and returns the result.
+func (s *Server) handleRunPlugin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	agent := s.liveAgentOr404(w, r)
+	if agent == nil {
+		return
+	}
+	name := r.PathValue("name")
+	if !protocol.ValidPluginName(name) {
+		http.Error(w, `{"error":"invalid plugin name"}`, http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Args map[string]string `json:"args"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	req := protocol.PluginRequest{ID: security.NewID(), Plugin: name, Args: body.Args}
+	var reply protocol.PluginReply
+	if !agent.callOrFail(r.Context(), w, "plugin_request", req.ID, req, &reply) {
+		return
+	}
+	if reply.Result != nil {
+		reply.Result.Plugin = name
+		if agent.recordPlugin(*reply.Result) {
+			s.publishEvent(eventAgentPlugin, agent.ID, reply.Result)
+			go s.evaluateAlerts(agent)
+		}
+	}
+
+	detail := "plugin=" + name
+	switch {
+	case reply.Error != "":
+		detail += fmt.Sprintf(" error=%q", reply.Error)
+	case reply.Result != nil:
+		detail += " status=" + reply.Result.Status
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditPluginRun,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   agent.ID,
+		Detail:    detail,
+	})
+	log.Printf("Agent %s: plugin %s run on command: %s", agent.ID, name, reply.Error)
+
+	w.Header().Set("Content-Type", "application/json")
+	if reply.Error != "" || reply.Result == nil {
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": reply.Error}) //nolint:errcheck
+		return
+	}
+	json.NewEncoder(w).Encode(reply.Result) //nolint:errcheck
+}
+
+// writePluginMetrics writes the status and metrics of connected agents'
+// plugins.
+func (s *Server) writePluginMetrics(w io.Writer) {
+	s.mu.RLock()
+	agents := make([]*LiveAgent, 0, len(s.agents))
+	for _, a := range s.agents {
+		agents = append(agents, a)
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(agents, func(a, b *LiveAgent) int { return strings.Compare(a.ID, b.ID) })
+
+	fmt.Fprintf(w, "# HELP rmm_agent_plugin_status Status each agent plugin last reported: 0 ok, 1 warning, 2 critical.\n"+ //nolint:errcheck
+		"# TYPE rmm_agent_plugin_status gauge\n")
+	for _, a := range agents {
+		for _, res := range a.pluginResults() {
+			fmt.Fprintf(w, "rmm_agent_plugin_status{agent=%q,plugin=%q} %d\n", a.ID, res.Plugin, pluginStatusValues[res.Status]) //nolint:errcheck
+		}
+	}
+	fmt.Fprintf(w, "# HELP rmm_agent_plugin_metric Readings agent plugins last reported.\n"+ //nolint:errcheck
+		"# TYPE rmm_agent_plugin_metric gauge\n")
+	for _, a := range agents {
+		for _, res := range a.pluginResults() {
+			for _, k := range slices.Sorted(maps.Keys(res.Metrics)) {
+				fmt.Fprintf(w, "rmm_agent_plugin_metric{agent=%q,plugin=%q,metric=%q} %g\n", a.ID, res.Plugin, k, res.Metrics[k]) //nolint:errcheck
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// handleAgentPower reboots or shuts down a connected agent's machine
+// ({"action": "reboot"|"shutdown"}). It answers once the agent's OS has
+// accepted the request.
+func (s *Server) handleAgentPower(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Action string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil ||
+		(body.Action != protocol.PowerReboot && body.Action != protocol.PowerShutdown) {
+		http.Error(w, `{"error":"action must be reboot or shutdown"}`, http.StatusBadRequest)
+		return
+	}
+	agent := s.liveAgentOr404(w, r)
+	if agent == nil {
+		return
+	}
+
+	req := protocol.PowerRequest{ID: security.NewID(), Action: body.Action}
+	var res protocol.PowerResult
+	if !agent.callOrFail(r.Context(), w, "power_request", req.ID, req, &res) {
+		return
+	}
+
+	detail := "action=" + req.Action
+	if res.Error != "" {
+		detail += fmt.Sprintf(" error=%q", res.Error)
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditPowerAction,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   agent.ID,
+		Detail:    detail,
+	})
+	if res.Error != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": res.Error}) //nolint:errcheck
+		return
+	}
+	log.Printf("Agent %s: %s requested by %s", agent.Name, req.Action, apiKey.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{ //nolint:errcheck
+		"id":     agent.ID,
+		"action": req.Action,
+	})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Data subject requests: everything the server holds about an agent, and
+// so about the people using it, can be exported as a zip of JSON documents
+// and files, or erased. Erasure deletes the agent's records and files and
+// anonymizes its audit events, which are kept for the audit trail.
+
+const (
+	auditAgentExported = "agent_exported"
+	auditAgentPurged   = "agent_purged"
+
+	// exportLimit caps each list in an export; in practice, everything.
+	exportLimit = 1 << 20
+)
+
+// exportFile is one file of an export archive: a JSON document (doc) or a
+// file copied from the data directory (path).
+type exportFile struct {
+	name string
+	doc  any
+	path string
+}
+
+// handleAgentExport returns a zip archive of everything stored about an
+// agent: its record, live inventory when connected, sessions, audit
+// events, alerts, tickets, schedules, deployment results, drop-box files,
+// and the screenshots, recordings and diagnostics archives themselves
+// (?files=0 leaves those out, keeping their metadata).
+func (s *Server) handleAgentExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	agentID := r.PathValue("id")
+	rec, err := s.store.GetAgent(r.Context(), agentID)
+	if err != nil || rec == nil {
+		http.Error(w, `{"error":"agent not found"}`, http.StatusNotFound)
+		return
+	}
+	files, err := s.collectExport(r, rec, r.URL.Query().Get("files") != "0")
+	if err != nil {
+		log.Printf("Export of %s: %v", agentID, err)
+		http.Error(w, `{"error":"failed to collect agent data"}`, http.StatusInternalServerError)
+		return
+	}
+
+	apiKey := security.APIKeyFromContext(r.Context())
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditAgentExported,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   agentID,
+		Detail:    fmt.Sprintf("files=%d remote_addr=%s", len(files), r.RemoteAddr),
+	})
+
+	now := time.Now().UTC()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="agent-%s-%s.zip"`, agentID, now.Format("20060102")))
+	w.Header().Set("Cache-Control", "no-store")
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		if err := writeExportFile(zw, f, now); err != nil {
+			// The response is under way; a truncated zip fails to open.
+			log.Printf("Export of %s: %s: %v", agentID, f.name, err)
+			return
+		}
+	}
+	_ = zw.Close()
+}
+
+// collectExport gathers the documents and files of an agent's export.
+func (s *Server) collectExport(r *http.Request, rec *store.AgentRecord, withFiles bool) ([]exportFile, error) {
+	ctx, id := r.Context(), rec.ID
+	files := []exportFile{{name: "agent.json", doc: rec}}
+
+	s.mu.RLock()
+	live, online := s.agents[id]
+	s.mu.RUnlock()
+	if online {
+		live.mu.Lock()
+		inventory, err := json.Marshal(map[string]any{
+			"agent":         live,
+			"startup_items": live.StartupItems,
+			"environment":   live.Environment,
+			"collected_at":  live.inventoryAt,
+		})
+		live.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, exportFile{name: "inventory.json", doc: json.RawMessage(inventory)})
+	}
+
+	sessions, err := s.store.ListViewerSessions(ctx, id, exportLimit)
+	if err != nil {
+		return nil, err
+	}
+	events, err := s.store.ListAuditEvents(ctx, store.AuditFilter{AgentID: id, Limit: exportLimit})
+	if err != nil {
+		return nil, err
+	}
+	alerts, err := s.store.ListAlerts(ctx, store.AlertFilter{AgentID: id, Limit: exportLimit})
+	if err != nil {
+		return nil, err
+	}
+	tickets, err := s.store.ListTickets(ctx, store.TicketFilter{AgentID: id, Limit: exportLimit})
+	if err != nil {
+		return nil, err
+	}
+	dropbox, err := s.store.ListDropboxFiles(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	sshKeys, err := s.store.ListSSHKeyAssignments(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	reboots, err := s.store.ListRebootRuns(ctx, store.RebootRunFilter{AgentID: id})
+	if err != nil {
+		return nil, err
+	}
+	deployments, err := s.store.ListDeploymentResults(ctx, store.DeploymentResultFilter{AgentID: id})
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := s.store.GetScreenshotSchedule(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	shots, err := s.store.ListScreenshots(ctx, store.ScreenshotFilter{AgentID: id, Limit: exportLimit})
+	if err != nil {
+		return nil, err
+	}
+	recordings, err := s.store.ListRecordings(ctx, store.RecordingFilter{AgentID: id, Limit: exportLimit})
+	if err != nil {
+		return nil, err
+	}
+	archives, err := s.store.ListDiagnosticsArchives(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	health, err := s.store.ListHealthSamples(ctx, id, time.Time{}, time.Now().Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	rules, err := s.store.ListAlertRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rules = slices.DeleteFunc(rules, func(rule *store.AlertRule) bool { return rule.AgentID != id })
+
+	files = append(files,
+		exportFile{name: "viewer_sessions.json", doc: sessions},
+		exportFile{name: "audit_events.json", doc: events},
+		exportFile{name: "alert_rules.json", doc: rules},
+		exportFile{name: "alerts.json", doc: alerts},
+		exportFile{name: "health_samples.json", doc: health},
+		exportFile{name: "tickets.json", doc: tickets},
+		exportFile{name: "dropbox_files.json", doc: dropbox},
+		exportFile{name: "ssh_key_assignments.json", doc: sshKeys},
+		exportFile{name: "reboot_runs.json", doc: reboots},
+		exportFile{name: "deployment_results.json", doc: deployments},
+		exportFile{name: "screenshot_schedule.json", doc: schedule},
+		exportFile{name: "screenshots.json", doc: shots},
+		exportFile{name: "recordings.json", doc: recordings},
+		exportFile{name: "diagnostics_archives.json", doc: archives},
+	)
+	if !withFiles {
+		return files, nil
+	}
+	for _, shot := range shots {
+		files = append(files, exportFile{name: "screenshots/" + shot.ID + ".jpg", path: s.screenshotPath(id, shot.ID)})
+	}
+	for _, rec := range recordings {
+		if rec.EndedAt != nil {
+			files = append(files, exportFile{name: "recordings/" + rec.ID + ".rec", path: s.recordingPath(id, rec.ID)})
+		}
+	}
+	for _, a := range archives {
+		files = append(files, exportFile{name: "diagnostics/" + a.ID + ".tar.gz", path: s.diagnosticsPath(id, a.ID)})
+	}
+	return files, nil
+}
+
+// writeExportFile adds one file to an export archive. Files missing from
+// the data directory, e.g. removed by retention since they were listed,
+// are skipped.
+func writeExportFile(zw *zip.Writer, f exportFile, modified time.Time) error {
+	if f.path == "" {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		return enc.Encode(f.doc)
+	}
+
+	in, err := os.Open(f.path)
+	if err != nil {
+		return nil
+	}
+	defer in.Close() //nolint:errcheck
+	info, err := in.Stat()
+	if err != nil {
+		return nil
+	}
+	// JPEGs and gzip archives do not compress further.
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Store, Modified: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, in)
+	return err
+}
+
+// handleAgentPurge erases an agent and everything stored about it: its
+// record, sessions, recordings, screenshots, diagnostics, alerts, tickets,
+// schedules and drop-box files. Audit events are kept, anonymized. It
+// takes an admin key, and is refused while the agent is connected, since
+// its sessions would go on recording, or while any of its recordings are
+// on legal hold. Once purged the agent's credential no longer works.
+func (s *Server) handleAgentPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	if apiKey.Role != store.RoleAdmin {
+		http.Error(w, `{"error":"purging an agent requires an admin key"}`, http.StatusForbidden)
+		return
+	}
+	agentID := r.PathValue("id")
+	rec, err := s.store.GetAgent(r.Context(), agentID)
+	if err != nil || rec == nil {
+		http.Error(w, `{"error":"agent not found"}`, http.StatusNotFound)
+		return
+	}
+	s.mu.RLock()
+	_, online := s.agents[agentID]
+	s.mu.RUnlock()
+	if online {
+		http.Error(w, `{"error":"agent is connected; stop or uninstall it first"}`, http.StatusConflict)
+		return
+	}
+	held, err := s.store.ListRecordings(r.Context(), store.RecordingFilter{AgentID: agentID, Held: true})
+	if err != nil {
+		http.Error(w, `{"error":"failed to check legal holds"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(held) > 0 {
+		ids := make([]string, len(held))
+		for i, h := range held {
+			ids[i] = h.ID
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]any{ //nolint:errcheck
+			"error":      "recordings of this agent are on legal hold",
+			"recordings": ids,
+		})
+		return
+	}
+	dropbox, err := s.store.ListDropboxFiles(r.Context(), agentID)
+	if err != nil {
+		http.Error(w, `{"error":"failed to list drop-box files"}`, http.StatusInternalServerError)
+		return
+	}
+
+	counts, err := s.store.PurgeAgent(r.Context(), agentID)
+	if err != nil {
+		log.Printf("Purge of %s: %v", agentID, err)
+		http.Error(w, `{"error":"failed to purge agent"}`, http.StatusInternalServerError)
+		return
+	}
+	for _, dir := range []string{s.screenshotDir, s.recordingDir, s.diagnosticsDir} {
+		_ = os.RemoveAll(filepath.Join(dir, agentID))
+	}
+	s.forgetTelemetry(agentID)
+	for _, f := range dropbox {
+		_ = os.Remove(s.dropboxPath(f.ID))
+	}
+
+	// The purge is audited without the agent's ID or name, which it was
+	// meant to erase.
+	tables := make([]string, 0, len(counts))
+	for table, n := range counts {
+		tables = append(tables, fmt.Sprintf("%s=%d", table, n))
+	}
+	sort.Strings(tables)
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditAgentPurged,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		Detail:    strings.Join(tables, " "),
+	})
+	log.Printf("Agent purged by %s", apiKey.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{ //nolint:errcheck
+		"purged": agentID,
+		"rows":   counts,
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Provisioning: pre-seeded agent configurations for golden images and MDM
+// profiles. Each carries a multi-use provisioning token, so every machine
+// built from the image enrolls itself on first boot; revoking the token
+// (DELETE /api/enrollment?id=) stops further enrollments.
+
+const (
+	auditProvisioningCreated = "provisioning_created"
+	auditAgentProvisioned    = "agent_provisioned"
+
+	// maxProvisioningDays bounds how long a provisioning token stays
+	// valid.
+	maxProvisioningDays = 3650
+
+	// maxImageLabel bounds the image label an agent reports.
+	maxImageLabel = 200
+)
+
+// handleProvisioning lists provisioning tokens (GET) or creates one and
+// returns its provisioning file (POST). The code is only ever returned in
+// the response to the POST; ?format=file returns the file alone, ready to
+// save as provision.json.
+func (s *Server) handleProvisioning(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := s.store.ListEnrollmentTokens(r.Context())
+		if err != nil {
+			http.Error(w, `{"error":"failed to list tokens"}`, http.StatusInternalServerError)
+			return
+		}
+		provisioning := []*store.EnrollmentToken{}
+		for _, t := range tokens {
+			if t.Type == store.TokenProvisioning {
+				provisioning = append(provisioning, t)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(provisioning) //nolint:errcheck
+	case http.MethodPost:
+		s.createProvisioning(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// provisioningRequest describes a provisioning token: {"label", "image",
+// "org_id", "site", "max_uses", "valid_days", "server"}. server is the URL
+// agents enroll through, by default the one the request used.
+type provisioningRequest struct {
+	Label     string `json:"label"`
+	Image     string `json:"image"`
+	OrgID     string `json:"org_id"`
+	Site      string `json:"site"`
+	MaxUses   int    `json:"max_uses"`
+	ValidDays int    `json:"valid_days"`
+	Server    string `json:"server"`
+}
+
+// createProvisioning creates a provisioning token and returns it with its
+// provisioning file.
+func (s *Server) createProvisioning(w http.ResponseWriter, r *http.Request) {
+	var req provisioningRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	token, p, ok := s.issueProvisioning(w, r, req, "")
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Query().Get("format") == "file" {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+protocol.ProvisioningFile+`"`)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(p) //nolint:errcheck
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+		"token":        token,
+		"provisioning": p,
+	})
+}
+
+// issueProvisioning validates req, creates its provisioning token and
+// builds the provisioning file, auditing it with the deployment kit it is
+// for ("" for the file alone). On failure it writes the error response.
+func (s *Server) issueProvisioning(w http.ResponseWriter, r *http.Request, req provisioningRequest, kit string) (*store.EnrollmentToken, *protocol.Provisioning, bool) {
+	switch {
+	case req.MaxUses < 0:
+		http.Error(w, `{"error":"max_uses must not be negative"}`, http.StatusBadRequest)
+		return nil, nil, false
+	case req.ValidDays < 0 || req.ValidDays > maxProvisioningDays:
+		http.Error(w, fmt.Sprintf(`{"error":"valid_days must be between 1 and %d"}`, maxProvisioningDays), http.StatusBadRequest)
+		return nil, nil, false
+	case !s.orgExists(r.Context(), req.OrgID):
+		http.Error(w, `{"error":"organization not found"}`, http.StatusBadRequest)
+		return nil, nil, false
+	}
+	server := strings.TrimRight(strings.TrimSpace(req.Server), "/")
+	if server == "" {
+		server = requestBaseURL(r)
+	}
+	if u, err := url.Parse(server); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		http.Error(w, `{"error":"server must be an http or https URL"}`, http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	token, code, err := security.GenerateEnrollmentToken(store.TokenProvisioning, strings.TrimSpace(req.Label))
+	if err != nil {
+		http.Error(w, `{"error":"failed to create token"}`, http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	if req.ValidDays > 0 {
+		token.ExpiresAt = token.CreatedAt.Add(time.Duration(req.ValidDays) * 24 * time.Hour)
+	}
+	token.OrgID, token.Site = req.OrgID, strings.TrimSpace(req.Site)
+	token.MaxUses, token.Image = req.MaxUses, strings.TrimSpace(req.Image)
+	if err := s.store.CreateEnrollmentToken(r.Context(), token); err != nil {
+		http.Error(w, `{"error":"failed to create token"}`, http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	p := &protocol.Provisioning{
+		ServerURL:   server,
+		Code:        code,
+		Fingerprint: s.platform.Fingerprint(),
+		TokenID:     token.ID,
+		Image:       token.Image,
+		CreatedAt:   token.CreatedAt.UTC(),
+	}
+	if s.tlsPaths != nil {
+		if data, err := security.ReadCACert(s.tlsPaths); err == nil {
+			p.CACert = string(data)
+		}
+	}
+
+	detail := fmt.Sprintf("token=%s image=%q server=%s max_uses=%d expires=%s",
+		token.ID, token.Image, server, token.MaxUses, token.ExpiresAt.UTC().Format(time.RFC3339))
+	if kit != "" {
+		detail += " kit=" + kit
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditProvisioningCreated,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		Detail:    detail,
+	})
+	log.Printf("Provisioning token created: %s (%q)", token.ID, token.Image)
+	return token, p, true
+}
+
+// recordProvisioned audits an enrollment with a provisioning token and
+// announces it, with the provenance the agent reported.
+func (s *Server) recordProvisioned(a *store.AgentRecord, token *store.EnrollmentToken, prov *protocol.Provenance, machineID, remoteAddr string) {
+	if prov == nil {
+		prov = &protocol.Provenance{}
+	}
+	s.recordAudit(&store.AuditEvent{
+		Action:  auditAgentProvisioned,
+		AgentID: a.ID,
+		Detail: fmt.Sprintf("token=%s image=%q reason=%q cloned_from=%q hostname=%s machine_id=%s remote_addr=%s",
+			token.ID, a.Image, prov.Reason, prov.ClonedFrom, a.Hostname, machineID, remoteAddr),
+	})
+	s.publishEvent("agent.provisioned", a.ID, map[string]string{
+		"token":       token.ID,
+		"image":       a.Image,
+		"reason":      prov.Reason,
+		"cloned_from": prov.ClonedFrom,
+		"hostname":    a.Hostname,
+	})
+}
+
+// provenanceImage trims an image label reported by an agent to
+// maxImageLabel bytes.
+func provenanceImage(image string) string {
+	image = strings.TrimSpace(image)
+	if len(image) > maxImageLabel {
+		image = strings.ToValidUTF8(image[:maxImageLabel], "")
+	}
+	return image
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// ticketProvider opens tickets in a PSA or ticketing system and adds
+// notes to them.
+type ticketProvider interface {
+	// createTicket opens a ticket and returns the system's ID for it.
+	createTicket(ctx context.Context, c ticketContent) (string, error)
+	// addNote appends c.Text to the ticket c.TicketID.
+	addNote(ctx context.Context, c ticketContent) error
+}
+
+// ticketContent is what the platform puts in a ticket or a note.
+type ticketContent struct {
+	Subject   string
+	Text      string
+	AgentID   string
+	AgentName string
+	AlertType string
+	TicketID  string // the ticket a note is for
+}
+
+// ticketProviders maps each provider name to a constructor that
+// validates the provider's configuration.
+var ticketProviders = map[string]func(config json.RawMessage) (ticketProvider, error){
+	"connectwise": newConnectWise,
+	"autotask":    newAutotask,
+	"generic":     newRESTProvider,
+}
+
+// psaRequest sends a JSON request and returns the response body.
+// Non-2xx answers are errors.
+func psaRequest(ctx context.Context, method, target string, headers map[string]string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := (&http.Client{Timeout: notifyTimeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return data, nil
+}
+
+// responseID reads the dot-separated field path (e.g. "data.id") from a
+// JSON response. Numeric IDs are returned in their decimal form.
+func responseID(data []byte, path string) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return "", fmt.Errorf("response is not JSON")
+	}
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("response has no %s", path)
+		}
+		v = obj[key]
+	}
+	switch id := v.(type) {
+	case string:
+		if id != "" {
+			return id, nil
+		}
+	case json.Number:
+		return id.String(), nil
+	}
+	return "", fmt.Errorf("response has no %s", path)
+}
+
+// truncate shortens s to at most n runes, for fields with length limits.
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+// connectWise files service tickets in ConnectWise PSA (Manage).
+type connectWise struct {
+	Site       string `json:"site"`    // API host, e.g. https://api-na.myconnectwise.net
+	Company    string `json:"company"` // company ID used to log in
+	PublicKey  string `json:"public_key"`
+	PrivateKey string `json:"private_key"`
+	ClientID   string `json:"client_id"`
+	BoardID    int    `json:"board_id,omitempty"`
+	CompanyID  int    `json:"company_id,omitempty"` // customer the tickets are filed under
+}
+
+func newConnectWise(config json.RawMessage) (ticketProvider, error) {
+	var c connectWise
+	if err := json.Unmarshal(config, &c); err != nil {
+		return nil, fmt.Errorf("invalid connectwise config")
+	}
+	if c.Site == "" || c.Company == "" || c.PublicKey == "" || c.PrivateKey == "" || c.ClientID == "" {
+		return nil, fmt.Errorf("connectwise needs site, company, public_key, private_key and client_id")
+	}
+	return &c, nil
+}
+
+func (c *connectWise) call(ctx context.Context, path string, body any) ([]byte, error) {
+	data, _ := json.Marshal(body)
+	auth := base64.StdEncoding.EncodeToString([]byte(c.Company + "+" + c.PublicKey + ":" + c.PrivateKey))
+	return psaRequest(ctx, http.MethodPost, strings.TrimSuffix(c.Site, "/")+"/v4_6_release/apis/3.0"+path,
+		map[string]string{"Authorization": "Basic " + auth, "clientId": c.ClientID}, data)
+}
+
+func (c *connectWise) createTicket(ctx context.Context, tc ticketContent) (string, error) {
+	body := map[string]any{
+		"summary":            truncate(tc.Subject, 100),
+		"initialDescription": tc.Text,
+	}
+	if c.BoardID != 0 {
+		body["board"] = map[string]int{"id": c.BoardID}
+	}
+	if c.CompanyID != 0 {
+		body["company"] = map[string]int{"id": c.CompanyID}
+	}
+	data, err := c.call(ctx, "/service/tickets", body)
+	if err != nil {
+		return "", err
+	}
+	return responseID(data, "id")
+}
+
+func (c *connectWise) addNote(ctx context.Context, tc ticketContent) error {
+	_, err := c.call(ctx, "/service/tickets/"+url.PathEscape(tc.TicketID)+"/notes", map[string]any{
+		"text":                 tc.Text,
+		"internalAnalysisFlag": true,
+	})
+	return err
+}
+
+// autotask files tickets through the Autotask REST API.
+type autotask struct {
+	Zone            string `json:"zone"` // API zone, e.g. https://webservices5.autotask.net
+	Username        string `json:"username"`
+	Secret          string `json:"secret"`
+	IntegrationCode string `json:"integration_code"`
+	CompanyID       int    `json:"company_id"`
+	QueueID         int    `json:"queue_id,omitempty"`
+	Status          int    `json:"status,omitempty"`   // defaults to 1 (New)
+	Priority        int    `json:"priority,omitempty"` // defaults to 2 (Medium)
+}
+
+func newAutotask(config json.RawMessage) (ticketProvider, error) {
+	var a autotask
+	if err := json.Unmarshal(config, &a); err != nil {
+		return nil, fmt.Errorf("invalid autotask config")
+	}
+	if a.Zone == "" || a.Username == "" || a.Secret == "" || a.IntegrationCode == "" || a.CompanyID == 0 {
+		return nil, fmt.Errorf("autotask needs zone, username, secret, integration_code and company_id")
+	}
+	if a.Status == 0 {
+		a.Status = 1
+	}
+	if a.Priority == 0 {
+		a.Priority = 2
+	}
+	return &a, nil
+}
+
+func (a *autotask) call(ctx context.Context, path string, body any) ([]byte, error) {
+	data, _ := json.Marshal(body)
+	return psaRequest(ctx, http.MethodPost, strings.TrimSuffix(a.Zone, "/")+"/ATServicesRest/V1.0"+path,
+		map[string]string{
+			"ApiIntegrationCode": a.IntegrationCode,
+			"UserName":           a.Username,
+			"Secret":             a.Secret,
+		}, data)
+}
+
+func (a *autotask) createTicket(ctx context.Context, tc ticketContent) (string, error) {
+	body := map[string]any{
+		"companyID":   a.CompanyID,
+		"title":       truncate(tc.Subject, 255),
+		"description": truncate(tc.Text, 8000),
+		"status":      a.Status,
+		"priority":    a.Priority,
+	}
+	if a.QueueID != 0 {
+		body["queueID"] = a.QueueID
+	}
+	data, err := a.call(ctx, "/Tickets", body)
+	if err != nil {
+		return "", err
+	}
+	return responseID(data, "itemId")
+}
+
+func (a *autotask) addNote(ctx context.Context, tc ticketContent) error {
+	_, err := a.call(ctx, "/Tickets/"+url.PathEscape(tc.TicketID)+"/Notes", map[string]any{
+		"title":       truncate(tc.Subject, 250),
+		"description": truncate(tc.Text, 32000),
+		"noteType":    1,
+		"publish":     1,
+	})
+	return err
+}
+
+// restProvider maps tickets onto any JSON REST API. URLs, header values
+// and bodies are Go templates over ticketContent, with "json" to quote a
+// value and "path" to escape a URL path segment:
+//
+//	{"create": {"url": "https://desk.example.com/api/tickets",
+//	            "headers": {"Authorization": "Bearer …"},
+//	            "body": "{\"title\": {{json .Subject}}, \"body\": {{json .Text}}}",
+//	            "id_field": "ticket.id"},
+//	 "note":   {"url": "https://desk.example.com/api/tickets/{{path .TicketID}}/comments",
+//	            "body": "{\"body\": {{json .Text}}}"}}
+type restProvider struct {
+	Create restCall  `json:"create"`
+	Note   *restCall `json:"note,omitempty"` // notes are skipped without it
+}
+
+type restCall struct {
+	Method  string            `json:"method,omitempty"` // defaults to POST
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body"`
+	IDField string            `json:"id_field,omitempty"` // create only; defaults to "id"
+
+	url, body *template.Template
+	headers   map[string]*template.Template
+}
+
+var restFuncs = template.FuncMap{
+	"json": func(v any) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	},
+	"path": url.PathEscape,
+}
+
+func newRESTProvider(config json.RawMessage) (ticketProvider, error) {
+	var p restProvider
+	if err := json.Unmarshal(config, &p); err != nil {
+		return nil, fmt.Errorf("invalid generic config")
+	}
+	if err := p.Create.compile("create"); err != nil {
+		return nil, err
+	}
+	if p.Note != nil {
+		if err := p.Note.compile("note"); err != nil {
+			return nil, err
+		}
+	}
+	if p.Create.IDField == "" {
+		p.Create.IDField = "id"
+	}
+	return &p, nil
+}
+
+// compile parses the call's templates.
+func (c *restCall) compile(name string) error {
+	if c.URL == "" {
+		return fmt.Errorf("%s needs a url", name)
+	}
+	if c.Method == "" {
+		c.Method = http.MethodPost
+	}
+	var err error
+	if c.url, err = template.New("url").Funcs(restFuncs).Parse(c.URL); err != nil {
+		return fmt.Errorf("%s url: %v", name, err)
+	}
+	if c.body, err = template.New("body").Funcs(restFuncs).Parse(c.Body); err != nil {
+		return fmt.Errorf("%s body: %v", name, err)
+	}
+	c.headers = make(map[string]*template.Template, len(c.Headers))
+	for k, v := range c.Headers {
+		if c.headers[k], err = template.New(k).Funcs(restFuncs).Parse(v); err != nil {
+			return fmt.Errorf("%s header %s: %v", name, k, err)
+		}
+	}
+	return nil
+}
+
+// do renders the call for tc and sends it.
+func (c *restCall) do(ctx context.Context, tc ticketContent) ([]byte, error) {
+	render := func(t *template.Template) (string, error) {
+		var b strings.Builder
+		err := t.Execute(&b, tc)
+		return b.String(), err
+	}
+	target, err := render(c.url)
+	if err != nil {
+		return nil, err
+	}
+	body, err := render(c.body)
+	if err != nil {
+		return nil, err
+	}
+	headers := make(map[string]string, len(c.headers))
+	for k, t := range c.headers {
+		if headers[k], err = render(t); err != nil {
+			return nil, err
+		}
+	}
+	return psaRequest(ctx, c.Method, target, headers, []byte(body))
+}
+
+func (p *restProvider) createTicket(ctx context.Context, tc ticketContent) (string, error) {
+	data, err := p.Create.do(ctx, tc)
+	if err != nil {
+		return "", err
+	}
+	return responseID(data, p.Create.IDField)
+}
+
+func (p *restProvider) addNote(ctx context.Context, tc ticketContent) error {
+	if p.Note == nil {
+		return nil
+	}
+	_, err := p.Note.do(ctx, tc)
+	return err
+}
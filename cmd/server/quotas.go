@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Connection quotas: "quotas" in the config caps simultaneous agent
+// connections, server-wide and per organization, and the enrollments each
+// organization may make in an hour, so one tenant on a shared server
+// cannot crowd out the rest. Agents over a cap are refused with a
+// "registration_refused" message saying when to try again; a server at
+// its global cap refuses the WebSocket upgrade itself with 503.
+// Enrollments over the rate are refused with 429. Unassigned agents count
+// as one organization.
+
+const (
+	// quotaRetryAfter is the least an agent refused for a quota waits
+	// before trying again; each adds up to as much again at random.
+	quotaRetryAfter = time.Minute
+	// enrollmentWindow is the period enrollment rates are counted over.
+	enrollmentWindow = time.Hour
+)
+
+// quotaRetry picks when a refused agent should try again.
+func quotaRetry() time.Duration {
+	return quotaRetryAfter + rand.N(quotaRetryAfter)
+}
+
+// agentsFull reports whether the server is at its agent connection cap,
+// checked before the WebSocket upgrade; admitAgent checks again.
+func (s *Server) agentsFull() bool {
+	limit := s.config().Quotas.MaxAgents
+	if limit == 0 {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.agents) >= limit
+}
+
+// refuseFull answers an agent's upgrade request when the server is full.
+func refuseFull(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(quotaRetry().Seconds())))
+	http.Error(w, `{"error":"the server is at its agent connection limit"}`, http.StatusServiceUnavailable)
+}
+
+// admitAgent adds agent to the connected agents unless that would exceed
+// the server's or its organization's cap, giving it the next connection
+// epoch. A reconnecting agent replaces its previous connection, which is
+// closed, and does not count twice.
+func (s *Server) admitAgent(agent *LiveAgent) error {
+	quotas := s.config().Quotas
+	orgLimit := quotas.orgAgents(agent.OrgID)
+	s.mu.Lock()
+	total, inOrg := len(s.agents), 0
+	if _, ok := s.agents[agent.ID]; ok {
+		total--
+	}
+	if orgLimit > 0 {
+		for id, a := range s.agents {
+			if id != agent.ID && a.OrgID == agent.OrgID {
+				inOrg++
+			}
+		}
+	}
+	switch {
+	case quotas.MaxAgents > 0 && total >= quotas.MaxAgents:
+		s.mu.Unlock()
+		return fmt.Errorf("the server is at its limit of %d connected agents", quotas.MaxAgents)
+	case orgLimit > 0 && inOrg >= orgLimit:
+		s.mu.Unlock()
+		return fmt.Errorf("the organization is at its limit of %d connected agents", orgLimit)
+	}
+	prev := s.agents[agent.ID]
+	s.agentEpoch++
+	agent.epoch = s.agentEpoch
+	s.agents[agent.ID] = agent
+	s.mu.Unlock()
+
+	if prev != nil {
+		// Its connection handler sees the newer epoch and leaves the
+		// entry alone (see forgetAgent).
+		log.Printf("Agent %s (%s) reconnected from %s; closing its connection from %s",
+			agent.Name, agent.ID, agent.IP, prev.IP)
+		_ = prev.conn.Close()
+	}
+	return nil
+}
+
+// forgetAgent removes agent from the connected agents unless a newer
+// connection of the same agent has replaced it, and reports whether it
+// did.
+func (s *Server) forgetAgent(agent *LiveAgent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur, ok := s.agents[agent.ID]; !ok || cur.epoch != agent.epoch {
+		return false
+	}
+	delete(s.agents, agent.ID)
+	return true
+}
+
+// enrollmentRate counts recent enrollments per organization.
+type enrollmentRate struct {
+	mu     sync.Mutex
+	recent map[string][]time.Time // by organization ID, oldest first
+}
+
+// allow records an enrollment for org and reports whether it is within
+// limit for the last enrollmentWindow. A refused one is not recorded.
+func (r *enrollmentRate) allow(org string, limit int) bool {
+	if limit == 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.recent == nil {
+		r.recent = make(map[string][]time.Time)
+	}
+	cutoff := time.Now().Add(-enrollmentWindow)
+	times := r.recent[org]
+	for len(times) > 0 && times[0].Before(cutoff) {
+		times = times[1:]
+	}
+	if len(times) >= limit {
+		r.recent[org] = times
+		return false
+	}
+	r.recent[org] = append(times, time.Now())
+	return true
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Scheduled reboots: in each schedule's maintenance window, its online
+// agents warn the logged-in user with a countdown and then reboot. The
+// user may postpone a limited number of times; the server tracks each
+// agent's run (deferrals used, when to warn again) so the count holds
+// across reconnects and restarts.
+
+const (
+	// rebootTick is how often schedules are checked, which bounds how
+	// late a countdown may start.
+	rebootTick = 30 * time.Second
+
+	// rebootAnswerGrace is how long past the countdown the server waits
+	// for the agent's answer before warning the user again.
+	rebootAnswerGrace = 2 * time.Minute
+
+	// Schedule defaults and bounds, in minutes.
+	defaultRebootWindow    = 120
+	defaultRebootCountdown = 15
+	defaultRebootDeferrals = 3
+	defaultRebootDeferFor  = 60
+	maxRebootWindow        = 24 * 60
+	maxRebootCountdown     = 4 * 60
+	maxRebootDeferrals     = 20
+	maxRebootDeferFor      = 24 * 60
+	maxRebootMessage       = 500
+
+	auditRebootScheduleCreated = "reboot_schedule_created"
+	auditRebootScheduleDeleted = "reboot_schedule_deleted"
+	auditScheduledReboot       = "scheduled_reboot"
+
+	eventRebootCountdown = "reboot.countdown"
+	eventRebootDeferred  = "reboot.deferred"
+	eventRebootStarted   = "reboot.started"
+	eventRebootFailed    = "reboot.failed"
+)
+
+// rebootDays maps the day names a schedule accepts to weekdays.
+var rebootDays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// handleRebootSchedules lists (GET) or creates (POST) reboot schedules.
+func (s *Server) handleRebootSchedules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		scheds, err := s.store.ListRebootSchedules(r.Context())
+		if err != nil {
+			http.Error(w, `{"error":"failed to list schedules"}`, http.StatusInternalServerError)
+			return
+		}
+		if scheds == nil {
+			scheds = []*store.RebootSchedule{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scheds) //nolint:errcheck
+
+	case http.MethodPost:
+		var req struct {
+			Name        string   `json:"name"`
+			AgentID     string   `json:"agent_id"`
+			OrgID       string   `json:"org_id"`
+			Site        string   `json:"site"`
+			Days        []string `json:"days"`
+			Start       string   `json:"start"`
+			TimeZone    string   `json:"timezone"`
+			Window      int      `json:"window_minutes"`
+			Countdown   int      `json:"countdown_minutes"`
+			Deferrals   *int     `json:"max_deferrals"`
+			DeferFor    int      `json:"defer_minutes"`
+			PendingOnly bool     `json:"pending_only"`
+			Message     string   `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		apiKey := security.APIKeyFromContext(r.Context())
+		sched := &store.RebootSchedule{
+			ID:          security.NewID(),
+			Name:        strings.TrimSpace(req.Name),
+			AgentID:     req.AgentID,
+			OrgID:       req.OrgID,
+			Site:        strings.TrimSpace(req.Site),
+			Days:        []string{},
+			Start:       req.Start,
+			TimeZone:    req.TimeZone,
+			Window:      req.Window,
+			Countdown:   req.Countdown,
+			Deferrals:   defaultRebootDeferrals,
+			DeferFor:    req.DeferFor,
+			PendingOnly: req.PendingOnly,
+			Message:     strings.TrimSpace(req.Message),
+			CreatedBy:   apiKey.Name,
+			CreatedAt:   time.Now(),
+		}
+		if req.Deferrals != nil {
+			sched.Deferrals = *req.Deferrals
+		}
+		if sched.Window == 0 {
+			sched.Window = defaultRebootWindow
+		}
+		if sched.Countdown == 0 {
+			sched.Countdown = defaultRebootCountdown
+		}
+		if sched.DeferFor == 0 {
+			sched.DeferFor = defaultRebootDeferFor
+		}
+		if sched.Name == "" {
+			sched.Name = "Scheduled reboot"
+		}
+		if sched.TimeZone == "" {
+			sched.TimeZone = "UTC"
+		}
+		for _, day := range req.Days {
+			day = strings.ToLower(day)
+			if _, ok := rebootDays[day]; !ok {
+				http.Error(w, `{"error":"days must be mon, tue, wed, thu, fri, sat or sun"}`, http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(sched.Days, day) {
+				sched.Days = append(sched.Days, day)
+			}
+		}
+		if err := s.checkRebootSchedule(r, sched); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.store.CreateRebootSchedule(r.Context(), sched); err != nil {
+			http.Error(w, `{"error":"failed to create schedule"}`, http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditRebootScheduleCreated,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			AgentID:   sched.AgentID,
+			Detail: fmt.Sprintf("schedule=%s target=%s days=%v start=%s timezone=%s window=%dm countdown=%dm deferrals=%d defer=%dm",
+				sched.ID, rebootTarget(sched), sched.Days, sched.Start, sched.TimeZone, sched.Window,
+				sched.Countdown, sched.Deferrals, sched.DeferFor),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(sched) //nolint:errcheck
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkRebootSchedule validates a new schedule's target, window and
+// limits.
+func (s *Server) checkRebootSchedule(r *http.Request, sc *store.RebootSchedule) error {
+	switch {
+	case sc.AgentID == "" && sc.OrgID == "" && sc.Site == "":
+		return fmt.Errorf("agent_id, org_id or site required")
+	case sc.AgentID != "" && (sc.OrgID != "" || sc.Site != ""):
+		return fmt.Errorf("agent_id cannot be combined with org_id or site")
+	}
+	if sc.AgentID != "" {
+		if rec, err := s.store.GetAgent(r.Context(), sc.AgentID); err != nil || rec == nil {
+			return fmt.Errorf("agent not found")
+		}
+	}
+	if sc.OrgID != "" {
+		if org, err := s.store.GetOrg(r.Context(), sc.OrgID); err != nil || org == nil {
+			return fmt.Errorf("organization not found")
+		}
+	}
+	if _, err := time.Parse("15:04", sc.Start); err != nil {
+		return fmt.Errorf("start must be HH:MM")
+	}
+	if _, err := time.LoadLocation(sc.TimeZone); err != nil {
+		return fmt.Errorf("unknown timezone %q", sc.TimeZone)
+	}
+	switch {
+	case sc.Window < 1 || sc.Window > maxRebootWindow:
+		return fmt.Errorf("window_minutes must be 1-%d", maxRebootWindow)
+	case sc.Countdown < 1 || sc.Countdown > maxRebootCountdown:
+		return fmt.Errorf("countdown_minutes must be 1-%d", maxRebootCountdown)
+	case sc.Deferrals < 0 || sc.Deferrals > maxRebootDeferrals:
+		return fmt.Errorf("max_deferrals must be 0-%d", maxRebootDeferrals)
+	case sc.DeferFor < 1 || sc.DeferFor > maxRebootDeferFor:
+		return fmt.Errorf("defer_minutes must be 1-%d", maxRebootDeferFor)
+	case len(sc.Message) > maxRebootMessage:
+		return fmt.Errorf("message is longer than %d bytes", maxRebootMessage)
+	}
+	return nil
+}
+
+// handleRebootSchedule returns a reboot schedule with its runs (GET) or
+// deletes it (DELETE). Deleting stops countdowns that have not started.
+func (s *Server) handleRebootSchedule(w http.ResponseWriter, r *http.Request) {
+	sched, err := s.store.GetRebootSchedule(r.Context(), r.PathValue("id"))
+	if err != nil || sched == nil {
+		http.Error(w, `{"error":"schedule not found"}`, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		runs, err := s.store.ListRebootRuns(r.Context(), store.RebootRunFilter{ScheduleID: sched.ID})
+		if err != nil {
+			http.Error(w, `{"error":"failed to list runs"}`, http.StatusInternalServerError)
+			return
+		}
+		if runs == nil {
+			runs = []*store.RebootRun{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct { //nolint:errcheck
+			*store.RebootSchedule
+			Runs []*store.RebootRun `json:"runs"`
+		}{sched, runs})
+
+	case http.MethodDelete:
+		s.rebootMu.Lock()
+		err := s.store.DeleteRebootSchedule(r.Context(), sched.ID)
+		s.rebootMu.Unlock()
+		if err != nil {
+			http.Error(w, `{"error":"failed to delete schedule"}`, http.StatusInternalServerError)
+			return
+		}
+		apiKey := security.APIKeyFromContext(r.Context())
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditRebootScheduleDeleted,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			AgentID:   sched.AgentID,
+			Detail:    "schedule=" + sched.ID,
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAgentReboots lists an agent's scheduled reboot runs: where each
+// schedule stands on it and how many deferrals its user has used.
+func (s *Server) handleAgentReboots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	runs, err := s.store.ListRebootRuns(r.Context(), store.RebootRunFilter{AgentID: r.PathValue("id")})
+	if err != nil {
+		http.Error(w, `{"error":"failed to list runs"}`, http.StatusInternalServerError)
+		return
+	}
+	if runs == nil {
+		runs = []*store.RebootRun{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs) //nolint:errcheck
+}
+
+// rebootTarget describes a schedule's target for logs and audit events.
+func rebootTarget(sc *store.RebootSchedule) string {
+	if sc.AgentID != "" {
+		return "agent:" + sc.AgentID
+	}
+	var parts []string
+	if sc.OrgID != "" {
+		parts = append(parts, "org:"+sc.OrgID)
+	}
+	if sc.Site != "" {
+		parts = append(parts, fmt.Sprintf("site:%q", sc.Site))
+	}
+	return strings.Join(parts, ",")
+}
+
+// rebootWindow returns the start of the schedule's window open at now,
+// if any. Windows last at most a day, so only today's and yesterday's
+// can be open.
+func rebootWindow(sc *store.RebootSchedule, now time.Time) (time.Time, bool) {
+	loc, err := time.LoadLocation(sc.TimeZone)
+	if err != nil {
+		return time.Time{}, false
+	}
+	at, err := time.Parse("15:04", sc.Start)
+	if err != nil {
+		return time.Time{}, false
+	}
+	local := now.In(loc)
+	for back := 0; back < 2; back++ {
+		day := local.AddDate(0, 0, -back)
+		start := time.Date(day.Year(), day.Month(), day.Day(), at.Hour(), at.Minute(), 0, 0, loc)
+		if len(sc.Days) > 0 && !slices.ContainsFunc(sc.Days, func(d string) bool { return rebootDays[d] == start.Weekday() }) {
+			continue
+		}
+		if !now.Before(start) && now.Before(start.Add(time.Duration(sc.Window)*time.Minute)) {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// rebootTargets returns the connected agents a schedule applies to.
+func (s *Server) rebootTargets(sc *store.RebootSchedule) []*LiveAgent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var agents []*LiveAgent
+	for _, a := range s.agents {
+		a.mu.Lock()
+		match := a.ID == sc.AgentID || sc.AgentID == "" &&
+			(sc.OrgID == "" || a.OrgID == sc.OrgID) && (sc.Site == "" || a.Site == sc.Site)
+		a.mu.Unlock()
+		if match {
+			agents = append(agents, a)
+		}
+	}
+	return agents
+}
+
+// runRebootSchedules starts countdowns as windows open and deferrals
+// expire, until the server shuts down.
+func (s *Server) runRebootSchedules() {
+	ticker := time.NewTicker(rebootTick)
+	defer ticker.Stop()
+	for s.tick(ticker) {
+		scheds, err := s.store.ListRebootSchedules(s.ctx)
+		if err != nil {
+			log.Printf("Reboot schedules: %v", err)
+			continue
+		}
+		for _, sc := range scheds {
+			s.applyRebootSchedule(sc, time.Now())
+		}
+	}
+}
+
+// applyRebootSchedule warns each of the schedule's connected agents that
+// is due: one with a run whose deferral (or wait for an answer) is over,
+// or, while the window is open, one that has no run in this window yet.
+func (s *Server) applyRebootSchedule(sc *store.RebootSchedule, now time.Time) {
+	s.rebootMu.Lock()
+	defer s.rebootMu.Unlock()
+	runs, err := s.store.ListRebootRuns(s.ctx, store.RebootRunFilter{ScheduleID: sc.ID})
+	if err != nil {
+		log.Printf("Reboot schedule %s: %v", sc.ID, err)
+		return
+	}
+	byAgent := make(map[string]*store.RebootRun, len(runs))
+	for _, run := range runs {
+		byAgent[run.AgentID] = run
+	}
+	window, open := rebootWindow(sc, now)
+
+	for _, agent := range s.rebootTargets(sc) {
+		agent.mu.Lock()
+		booted := now.Add(-time.Duration(agent.UptimeSeconds) * time.Second)
+		pending := agent.RebootRequired
+		agent.mu.Unlock()
+
+		run := byAgent[agent.ID]
+		switch {
+		case run != nil && (run.Status == store.RebootCountdown || run.Status == store.RebootDeferred):
+			if now.Before(run.NextAt) {
+				continue
+			}
+			if run.Status == store.RebootCountdown && booted.After(run.UpdatedAt) {
+				// It rebooted but the answer was lost with the connection.
+				run.Status, run.NoticeID, run.UpdatedAt = store.RebootRebooted, "", now
+				_ = s.store.SetRebootRun(s.ctx, run)
+				continue
+			}
+		case open && (run == nil || run.WindowStart.Before(window)):
+			if sc.PendingOnly && !pending {
+				continue
+			}
+			run = &store.RebootRun{ScheduleID: sc.ID, AgentID: agent.ID, WindowStart: window}
+		default:
+			continue
+		}
+		s.startRebootCountdown(agent, sc, run, now)
+	}
+}
+
+// startRebootCountdown sends the agent a reboot notice for run. The run
+// is saved first, so the countdown is not started twice.
+func (s *Server) startRebootCountdown(agent *LiveAgent, sc *store.RebootSchedule, run *store.RebootRun, now time.Time) {
+	countdown := time.Duration(sc.Countdown) * time.Minute
+	run.Status = store.RebootCountdown
+	run.NoticeID = security.NewID()
+	run.NextAt = now.Add(countdown + rebootAnswerGrace)
+	run.Error = ""
+	run.UpdatedAt = now
+	if err := s.store.SetRebootRun(s.ctx, run); err != nil {
+		log.Printf("Reboot schedule %s: %v", sc.ID, err)
+		return
+	}
+	notice := protocol.RebootNotice{
+		ID:            run.NoticeID,
+		Countdown:     int(countdown / time.Second),
+		DeferralsLeft: max(sc.Deferrals-run.Deferrals, 0),
+		DeferMinutes:  sc.DeferFor,
+		Message:       sc.Message,
+	}
+	if err := agent.send("reboot_notice", notice); err != nil {
+		return // warned again once NextAt passes
+	}
+	log.Printf("Agent %s: reboot countdown started for %q (%d of %d deferrals used)",
+		agent.Name, sc.Name, run.Deferrals, sc.Deferrals)
+	s.publishEvent(eventRebootCountdown, agent.ID, run)
+}
+
+// handleRebootNoticeResult records the user's deferral or the outcome of
+// the reboot.
+func (s *Server) handleRebootNoticeResult(agent *LiveAgent, payload json.RawMessage) {
+	var res protocol.RebootNoticeResult
+	if json.Unmarshal(payload, &res) != nil || res.ID == "" {
+		return
+	}
+	s.rebootMu.Lock()
+	defer s.rebootMu.Unlock()
+	runs, err := s.store.ListRebootRuns(s.ctx, store.RebootRunFilter{AgentID: agent.ID})
+	if err != nil {
+		return
+	}
+	i := slices.IndexFunc(runs, func(run *store.RebootRun) bool { return run.NoticeID == res.ID })
+	if i < 0 {
+		return // the schedule was deleted
+	}
+	run := runs[i]
+	sc, err := s.store.GetRebootSchedule(s.ctx, run.ScheduleID)
+	if err != nil || sc == nil {
+		return
+	}
+
+	now := time.Now()
+	run.NoticeID, run.UpdatedAt = "", now
+	event, detail := eventRebootStarted, "outcome=rebooted"
+	switch {
+	case res.Error != "":
+		run.Status, run.Error = store.RebootFailed, res.Error
+		event, detail = eventRebootFailed, fmt.Sprintf("outcome=failed error=%q", res.Error)
+	case res.Deferred && run.Deferrals < sc.Deferrals:
+		run.Deferrals++
+		run.Status, run.NextAt = store.RebootDeferred, now.Add(time.Duration(sc.DeferFor)*time.Minute)
+		event, detail = eventRebootDeferred, fmt.Sprintf("outcome=deferred deferrals=%d/%d until=%s",
+			run.Deferrals, sc.Deferrals, run.NextAt.UTC().Format(time.RFC3339))
+	case res.Deferred:
+		// Not the agent's to grant: warn again straight away.
+		run.Status, run.NextAt = store.RebootDeferred, now
+		event, detail = eventRebootDeferred, "outcome=deferral_refused"
+	default:
+		run.Status = store.RebootRebooted
+	}
+	if err := s.store.SetRebootRun(s.ctx, run); err != nil {
+		log.Printf("Reboot schedule %s: %v", sc.ID, err)
+	}
+	s.recordAudit(&store.AuditEvent{
+		Action:  auditScheduledReboot,
+		AgentID: agent.ID,
+		Detail:  fmt.Sprintf("schedule=%s %s", sc.ID, detail),
+	})
+	s.publishEvent(event, agent.ID, run)
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+	"github.com/avaropoint/rmm/internal/watermark"
+)
+
+// Session recording: with recording enabled in the config, every viewer
+// session's screen is recorded under <data>/recordings. The local user is
+// told before and during the session, each frame is watermarked with the
+// operator and the time, and recordings are pruned after the retention
+// period unless placed on legal hold.
+//
+// A recording file is a sequence of frames, each
+// [uint64 unix nanoseconds][uint8 display][uint32 length][JPEG], all big
+// endian. Display is 0 for single and stitched views and the 1-based
+// display index for separate views (see protocol.ViewSeparate).
+
+const (
+	auditRecordingStarted      = "recording_started"
+	auditRecordingHoldSet      = "recording_hold_set"
+	auditRecordingHoldReleased = "recording_hold_released"
+	auditRecordingDeleted      = "recording_deleted"
+
+	// recordingInterval is the shortest gap between recorded frames;
+	// frames the agent sends in between are not recorded.
+	recordingInterval = 500 * time.Millisecond
+
+	// recordingQuality is the JPEG quality of watermarked frames.
+	recordingQuality = 70
+
+	// recordingPruneTick is how often retention is applied.
+	recordingPruneTick = time.Hour
+
+	// maxRecordingGap bounds the pause between frames during playback.
+	maxRecordingGap = 5 * time.Second
+
+	// maxHoldReason bounds a legal hold's reason.
+	maxHoldReason = 500
+
+	// recordingFrameHeader is the size of a frame's header in a
+	// recording file; maxRecordingFrame bounds the JPEG it announces.
+	recordingFrameHeader = 8 + 1 + 4
+	maxRecordingFrame    = 32 << 20
+)
+
+// sessionRecorder writes one session's recording. The agent's read loop
+// offers frames; a writer goroutine watermarks and appends them, so a
+// slow disk never holds up the relay.
+type sessionRecorder struct {
+	rec      *store.Recording
+	f        *os.File
+	frames   chan []byte // the newest frame not yet written
+	done     chan struct{}
+	lastSeen time.Time // when the last frame was accepted; read loop only
+}
+
+// recordingPath is where a recording's frames are kept.
+func (s *Server) recordingPath(agentID, id string) string {
+	return filepath.Join(s.recordingDir, agentID, id+".rec")
+}
+
+// startRecording begins recording the viewer session and attaches the
+// recorder to the agent. It returns nil, logging why, if the recording
+// cannot be created; the session goes ahead unrecorded rather than
+// failing after the user has agreed to it.
+func (s *Server) startRecording(agent *LiveAgent, session *store.ViewerSession) *sessionRecorder {
+	rec := &store.Recording{
+		ID:        session.ID,
+		AgentID:   agent.ID,
+		APIKeyID:  session.APIKeyID,
+		Operator:  session.APIKeyName,
+		StartedAt: time.Now(),
+	}
+	path := s.recordingPath(agent.ID, rec.ID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Printf("Recording for %s: %v", agent.Name, err)
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Printf("Recording for %s: %v", agent.Name, err)
+		return nil
+	}
+	if err := s.store.CreateRecording(s.ctx, rec); err != nil {
+		log.Printf("Recording for %s: %v", agent.Name, err)
+		_ = f.Close()
+		_ = os.Remove(path)
+		return nil
+	}
+
+	r := &sessionRecorder{
+		rec:    rec,
+		f:      f,
+		frames: make(chan []byte, 1),
+		done:   make(chan struct{}),
+	}
+	go r.write()
+
+	agent.mu.Lock()
+	agent.recorder = r
+	agent.mu.Unlock()
+
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditRecordingStarted,
+		ActorID:   session.APIKeyID,
+		ActorName: session.APIKeyName,
+		AgentID:   agent.ID,
+		SessionID: session.ID,
+		Detail:    "id=" + rec.ID,
+	})
+	return r
+}
+
+// stopRecording detaches the recorder from the agent, waits for its last
+// frame to be written and closes the recording out.
+func (s *Server) stopRecording(agent *LiveAgent, r *sessionRecorder) {
+	agent.mu.Lock()
+	if agent.recorder == r {
+		agent.recorder = nil
+	}
+	agent.mu.Unlock()
+
+	close(r.frames)
+	<-r.done
+	if info, err := r.f.Stat(); err == nil {
+		r.rec.Size = info.Size()
+	}
+	if err := r.f.Close(); err != nil {
+		log.Printf("Recording %s: %v", r.rec.ID, err)
+	}
+	ended := time.Now()
+	r.rec.EndedAt = &ended
+	// Not s.ctx: the recording is closed out during shutdown too.
+	if err := s.store.FinishRecording(context.Background(), r.rec); err != nil {
+		log.Printf("Recording %s: %v", r.rec.ID, err)
+	}
+}
+
+// recordFrame offers a screen frame relayed from the agent to its
+// session's recorder, if any.
+func (a *LiveAgent) recordFrame(data []byte) {
+	a.mu.Lock()
+	r := a.recorder
+	a.mu.Unlock()
+	if r != nil {
+		r.offer(data)
+	}
+}
+
+// offer queues a copy of a BinScreen or BinDisplay frame unless one was
+// accepted less than recordingInterval ago or the writer is still busy.
+// Only the agent's read loop calls it.
+func (r *sessionRecorder) offer(data []byte) {
+	if time.Since(r.lastSeen) < recordingInterval {
+		return
+	}
+	frame := append([]byte(nil), data...)
+	select {
+	case r.frames <- frame:
+		r.lastSeen = time.Now()
+	default:
+	}
+}
+
+// write watermarks and appends offered frames until frames is closed.
+// A frame that cannot be watermarked is skipped rather than recorded
+// without its caption.
+func (r *sessionRecorder) write() {
+	defer close(r.done)
+	w := bufio.NewWriter(r.f)
+	failed := false
+	for frame := range r.frames {
+		if failed {
+			continue // keep draining so the relay is never blocked
+		}
+		var display byte
+		jpeg := frame[1:]
+		if frame[0] == protocol.BinDisplay {
+			if len(frame) < 2 {
+				continue
+			}
+			display, jpeg = frame[1], frame[2:]
+		}
+		now := time.Now()
+		stamped, err := watermark.StampJPEG(jpeg, recordingQuality,
+			"Recorded session: "+r.rec.Operator, now.UTC().Format("2006-01-02 15:04:05 MST"))
+		if err != nil {
+			continue
+		}
+		var hdr [recordingFrameHeader]byte
+		binary.BigEndian.PutUint64(hdr[0:], uint64(now.UnixNano()))
+		hdr[8] = display
+		binary.BigEndian.PutUint32(hdr[9:], uint32(len(stamped)))
+		_, err = w.Write(hdr[:])
+		if err == nil {
+			_, err = w.Write(stamped)
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Printf("Recording %s: %v", r.rec.ID, err)
+			failed = true
+			continue
+		}
+		r.rec.Frames++
+	}
+}
+
+// readRecordingFrame reads the next frame of a recording file.
+func readRecordingFrame(r io.Reader) (at time.Time, display byte, jpeg []byte, err error) {
+	var hdr [recordingFrameHeader]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	at = time.Unix(0, int64(binary.BigEndian.Uint64(hdr[0:])))
+	display = hdr[8]
+	n := binary.BigEndian.Uint32(hdr[9:])
+	if n > maxRecordingFrame {
+		err = errors.New("frame too large")
+		return
+	}
+	jpeg = make([]byte, n)
+	_, err = io.ReadFull(r, jpeg)
+	return
+}
+
+// handleListRecordings lists recordings, newest first, optionally for one
+// agent (?agent=) or only those on legal hold (?held=1).
+func (s *Server) handleListRecordings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	recs, err := s.store.ListRecordings(r.Context(), store.RecordingFilter{
+		AgentID: q.Get("agent"),
+		Held:    q.Get("held") == "1",
+		Limit:   limit,
+	})
+	if err != nil {
+		http.Error(w, `{"error":"failed to list recordings"}`, http.StatusInternalServerError)
+		return
+	}
+	if recs == nil {
+		recs = []*store.Recording{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recs) //nolint:errcheck
+}
+
+// lookupRecording returns the recording named in the path, writing a 404
+// if there is none.
+func (s *Server) lookupRecording(w http.ResponseWriter, r *http.Request) *store.Recording {
+	rec, err := s.store.GetRecording(r.Context(), r.PathValue("id"))
+	if err != nil || rec == nil {
+		http.Error(w, `{"error":"recording not found"}`, http.StatusNotFound)
+		return nil
+	}
+	return rec
+}
+
+// handleRecording returns (GET) or deletes (DELETE) a recording. A
+// recording on legal hold, or still in progress, cannot be deleted.
+func (s *Server) handleRecording(w http.ResponseWriter, r *http.Request) {
+	rec := s.lookupRecording(w, r)
+	if rec == nil {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rec) //nolint:errcheck
+
+	case http.MethodDelete:
+		switch {
+		case rec.LegalHold:
+			http.Error(w, `{"error":"recording is on legal hold"}`, http.StatusConflict)
+			return
+		case rec.EndedAt == nil:
+			http.Error(w, `{"error":"recording in progress"}`, http.StatusConflict)
+			return
+		}
+		if err := s.store.DeleteRecording(r.Context(), rec.ID); err != nil {
+			http.Error(w, `{"error":"failed to delete recording"}`, http.StatusConflict)
+			return
+		}
+		_ = os.Remove(s.recordingPath(rec.AgentID, rec.ID))
+		apiKey := security.APIKeyFromContext(r.Context())
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditRecordingDeleted,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			AgentID:   rec.AgentID,
+			SessionID: rec.ID,
+			Detail:    "id=" + rec.ID,
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRecordingFile downloads a recording file as stored.
+func (s *Server) handleRecordingFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rec := s.lookupRecording(w, r)
+	if rec == nil {
+		return
+	}
+	f, err := os.Open(s.recordingPath(rec.AgentID, rec.ID))
+	if err != nil {
+		http.Error(w, `{"error":"recording not found"}`, http.StatusNotFound)
+		return
+	}
+	defer f.Close() //nolint:errcheck
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", rec.ID+".rec"))
+	http.ServeContent(w, r, "", rec.StartedAt, f)
+}
+
+// handleRecordingPlay replays a recording as an MJPEG stream
+// (multipart/x-mixed-replace), which browsers show in an <img>, paced by
+// the frames' timestamps with pauses capped at maxRecordingGap.
+// ?display=N plays one display of a separate-view session only.
+func (s *Server) handleRecordingPlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rec := s.lookupRecording(w, r)
+	if rec == nil {
+		return
+	}
+	display := -1
+	if v := r.URL.Query().Get("display"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 255 {
+			http.Error(w, `{"error":"invalid display"}`, http.StatusBadRequest)
+			return
+		}
+		display = n
+	}
+	f, err := os.Open(s.recordingPath(rec.AgentID, rec.ID))
+	if err != nil {
+		http.Error(w, `{"error":"recording not found"}`, http.StatusNotFound)
+		return
+	}
+	defer f.Close() //nolint:errcheck
+
+	const boundary = "recording-frame"
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+boundary)
+	w.Header().Set("Cache-Control", "no-store")
+	flusher, _ := w.(http.Flusher)
+	br := bufio.NewReader(f)
+	var prev time.Time
+	for {
+		at, d, jpeg, err := readRecordingFrame(br)
+		if err != nil {
+			return
+		}
+		if display >= 0 && int(d) != display {
+			continue
+		}
+		if !prev.IsZero() {
+			select {
+			case <-time.After(min(max(at.Sub(prev), 0), maxRecordingGap)):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		prev = at
+		if _, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", boundary, len(jpeg)); err != nil {
+			return
+		}
+		if _, err := w.Write(append(jpeg, "\r\n"...)); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// handleRecordingHold places (PUT, {"reason"}) or releases (DELETE) a
+// legal hold on a recording. Held recordings are exempt from retention
+// pruning and cannot be deleted.
+func (s *Server) handleRecordingHold(w http.ResponseWriter, r *http.Request) {
+	rec := s.lookupRecording(w, r)
+	if rec == nil {
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+
+	var action, detail string
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		reason := strings.TrimSpace(req.Reason)
+		switch {
+		case reason == "":
+			http.Error(w, `{"error":"reason required"}`, http.StatusBadRequest)
+			return
+		case len(reason) > maxHoldReason:
+			http.Error(w, fmt.Sprintf(`{"error":"reason must be at most %d bytes"}`, maxHoldReason), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		rec.LegalHold, rec.HoldReason, rec.HoldBy, rec.HoldAt = true, reason, apiKey.Name, &now
+		action, detail = auditRecordingHoldSet, fmt.Sprintf("id=%s reason=%q", rec.ID, reason)
+
+	case http.MethodDelete:
+		if !rec.LegalHold {
+			http.Error(w, `{"error":"recording is not on legal hold"}`, http.StatusConflict)
+			return
+		}
+		detail = fmt.Sprintf("id=%s reason=%q held_by=%q", rec.ID, rec.HoldReason, rec.HoldBy)
+		rec.LegalHold, rec.HoldReason, rec.HoldBy, rec.HoldAt = false, "", "", nil
+		action = auditRecordingHoldReleased
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.store.SetRecordingHold(r.Context(), rec); err != nil {
+		http.Error(w, `{"error":"failed to update recording"}`, http.StatusInternalServerError)
+		return
+	}
+	s.recordAudit(&store.AuditEvent{
+		Action:    action,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   rec.AgentID,
+		SessionID: rec.ID,
+		Detail:    detail,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec) //nolint:errcheck
+}
+
+// runRecordingRetention deletes recordings past the retention period,
+// except those on legal hold, until the server shuts down.
+func (s *Server) runRecordingRetention() {
+	ticker := time.NewTicker(recordingPruneTick)
+	defer ticker.Stop()
+	for {
+		s.pruneRecordings()
+		if !s.tick(ticker) {
+			return
+		}
+	}
+}
+
+// pruneRecordings applies the retention period once.
+func (s *Server) pruneRecordings() {
+	before := time.Now().Add(-s.config().Recording.retention())
+	recs, err := s.store.PruneRecordings(s.ctx, before)
+	if err != nil {
+		log.Printf("Recording retention: %v", err)
+	}
+	for _, rec := range recs {
+		_ = os.Remove(s.recordingPath(rec.AgentID, rec.ID))
+	}
+	if len(recs) > 0 {
+		log.Printf("Recording retention: deleted %d recordings", len(recs))
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redis mirroring: when configured, every dashboard event is PUBLISHed to
+// <prefix>:events as the same JSON the event stream carries, and each
+// connected agent has a <prefix>:presence:<agent_id> key that expires
+// unless heartbeats keep refreshing it. External systems (and future
+// server replicas) can subscribe or read presence instead of polling
+// the API.
+//
+// Commands are queued and sent by one goroutine over a single
+// connection, so a slow or unreachable Redis never blocks the server;
+// when the queue is full, commands are dropped.
+
+const (
+	// redisQueue is how many commands may wait for the connection.
+	redisQueue = 1024
+	// redisTimeout bounds dialing and each command's round trip.
+	redisTimeout = 5 * time.Second
+	// presenceTTL outlives three missed heartbeats.
+	presenceTTL = 90 * time.Second
+)
+
+// redisMirror publishes events and presence to Redis.
+type redisMirror struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	db       int
+	prefix   string
+
+	queue chan []string
+}
+
+// newRedisMirror parses cfg and starts the sender.
+func newRedisMirror(cfg *RedisConfig) (*redisMirror, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return nil, fmt.Errorf("redis url must be redis://[user:password@]host[:port][/db] or rediss://…")
+	}
+	m := &redisMirror{
+		addr:   u.Host,
+		useTLS: u.Scheme == "rediss",
+		prefix: cfg.Prefix,
+		queue:  make(chan []string, redisQueue),
+	}
+	if u.Port() == "" {
+		m.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		m.username = u.User.Username()
+		m.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if m.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("redis url: invalid database %q", db)
+		}
+	}
+	if m.prefix == "" {
+		m.prefix = "rmm"
+	}
+	go m.run()
+	return m, nil
+}
+
+// enqueue queues a command without blocking.
+func (m *redisMirror) enqueue(args ...string) {
+	select {
+	case m.queue <- args:
+	default:
+		log.Printf("Redis: queue full, dropped %s", args[0])
+	}
+}
+
+// publishEvent mirrors a dashboard event.
+func (m *redisMirror) publishEvent(ev Event) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	m.enqueue("PUBLISH", m.prefix+":events", string(data))
+}
+
+// setPresence marks an agent online until presenceTTL passes without
+// another call.
+func (m *redisMirror) setPresence(agentID string, info agentPresence) {
+	data, _ := json.Marshal(info)
+	m.enqueue("SET", m.prefix+":presence:"+agentID, string(data),
+		"EX", strconv.Itoa(int(presenceTTL/time.Second)))
+}
+
+// clearPresence marks an agent offline.
+func (m *redisMirror) clearPresence(agentID string) {
+	m.enqueue("DEL", m.prefix+":presence:"+agentID)
+}
+
+// run sends queued commands, reconnecting with backoff. The command that
+// failed is retried once on the new connection.
+func (m *redisMirror) run() {
+	var (
+		conn    net.Conn
+		r       *bufio.Reader
+		backoff = time.Second
+		retry   []string
+	)
+	for {
+		if conn == nil {
+			var err error
+			if conn, r, err = m.connect(); err != nil {
+				log.Printf("Redis: %v (retrying in %s)", err, backoff)
+				time.Sleep(backoff)
+				backoff = min(backoff*2, time.Minute)
+				continue
+			}
+			log.Printf("Redis: connected to %s", m.addr)
+			backoff = time.Second
+		}
+
+		cmd := retry
+		if cmd == nil {
+			cmd = <-m.queue
+		}
+		if err := redisDo(conn, r, cmd...); err != nil {
+			if _, isReply := err.(redisError); isReply {
+				log.Printf("Redis: %s: %v", cmd[0], err)
+				retry = nil
+				continue
+			}
+			log.Printf("Redis: %v", err)
+			conn.Close() //nolint:errcheck
+			conn = nil
+			if retry == nil {
+				retry = cmd
+			} else {
+				retry = nil
+			}
+			continue
+		}
+		retry = nil
+	}
+}
+
+// connect dials Redis and authenticates.
+func (m *redisMirror) connect() (net.Conn, *bufio.Reader, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if m.useTLS {
+		host, _, _ := net.SplitHostPort(m.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.addr, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+	} else {
+		conn, err = dialer.Dial("tcp", m.addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	if m.password != "" {
+		args := []string{"AUTH", m.password}
+		if m.username != "" {
+			args = []string{"AUTH", m.username, m.password}
+		}
+		if err := redisDo(conn, r, args...); err != nil {
+			conn.Close() //nolint:errcheck
+			return nil, nil, fmt.Errorf("auth: %w", err)
+		}
+	}
+	if m.db != 0 {
+		if err := redisDo(conn, r, "SELECT", strconv.Itoa(m.db)); err != nil {
+			conn.Close() //nolint:errcheck
+			return nil, nil, fmt.Errorf("select: %w", err)
+		}
+	}
+	return conn, r, nil
+}
+
+// redisError is an error reply from the server, as opposed to a
+// connection failure.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisDo sends one command as a RESP array of bulk strings and reads its
+// reply, discarding the value.
+func redisDo(conn net.Conn, r *bufio.Reader, args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	conn.SetDeadline(time.Now().Add(redisTimeout)) //nolint:errcheck
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		return err
+	}
+	return readRedisReply(r)
+}
+
+// readRedisReply consumes one RESP reply, returning error replies as
+// redisError.
+func readRedisReply(r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return fmt.Errorf("bad reply %q", line)
+		}
+		if n >= 0 {
+			_, err = r.Discard(n + 2)
+		}
+		return err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return fmt.Errorf("bad reply %q", line)
+		}
+		for i := 0; i < n; i++ {
+			if err := readRedisReply(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("bad reply %q", line)
+}
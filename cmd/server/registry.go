@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// registryHives maps long registry hive names to the short forms used
+// when matching policy rules.
+var registryHives = map[string]string{
+	"HKEY_LOCAL_MACHINE":  "HKLM",
+	"HKEY_CURRENT_USER":   "HKCU",
+	"HKEY_CLASSES_ROOT":   "HKCR",
+	"HKEY_USERS":          "HKU",
+	"HKEY_CURRENT_CONFIG": "HKCC",
+}
+
+// normalizeRegistryPath canonicalises a registry key for comparison:
+// short hive name, no trailing separator, upper case.
+func normalizeRegistryPath(p string) string {
+	p = strings.TrimRight(p, `\`)
+	hive, rest, _ := strings.Cut(p, `\`)
+	if short, ok := registryHives[strings.ToUpper(hive)]; ok {
+		hive = short
+	}
+	if rest == "" {
+		return strings.ToUpper(hive)
+	}
+	return strings.ToUpper(hive + `\` + rest)
+}
+
+// registryPathCovers reports whether a policy rule path grants access to
+// path. Registry keys (containing a backslash) match case-insensitively
+// on key boundaries; defaults domains and gsettings schemas match exactly
+// or on a "." boundary.
+func registryPathCovers(rule, path string) bool {
+	if rule == "" || path == "" {
+		return false
+	}
+	if strings.Contains(rule, `\`) || strings.Contains(path, `\`) {
+		rule, path = normalizeRegistryPath(rule), normalizeRegistryPath(path)
+		return path == rule || strings.HasPrefix(path, rule+`\`)
+	}
+	rule = strings.TrimRight(rule, ".")
+	return path == rule || strings.HasPrefix(path, rule+".")
+}
+
+// registryAllowed reports whether the configured policy permits reading
+// (or, with write set, changing) path.
+func (s *Server) registryAllowed(path string, write bool) bool {
+	for _, rule := range s.config().RegistryPolicy {
+		if registryPathCovers(rule.Path, path) && (!write || rule.Write) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAgentRegistry reads (GET ?path=&name=) or writes (PUT with a JSON
+// body) a single registry value, defaults key or gsettings key on a
+// connected agent. Only paths allowlisted by registry_policy are reachable.
+func (s *Server) handleAgentRegistry(w http.ResponseWriter, r *http.Request) {
+	var req protocol.RegistryRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.Op = protocol.RegistryRead
+		req.Path = r.URL.Query().Get("path")
+		req.Name = r.URL.Query().Get("name")
+	case http.MethodPut:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		req.Op = protocol.RegistryWrite
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, `{"error":"path required"}`, http.StatusBadRequest)
+		return
+	}
+
+	id := r.PathValue("id")
+	apiKey := security.APIKeyFromContext(r.Context())
+	write := req.Op == protocol.RegistryWrite
+	detail := fmt.Sprintf("path=%q name=%q", req.Path, req.Name)
+	if write {
+		detail += fmt.Sprintf(" type=%s value=%q", req.Type, req.Value)
+	}
+	audit := func(action, extra string) {
+		s.recordAudit(&store.AuditEvent{
+			Action:    action,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			AgentID:   id,
+			Detail:    detail + extra,
+		})
+	}
+
+	if !s.registryAllowed(req.Path, write) {
+		audit(auditRegistryDenied, " op="+req.Op)
+		http.Error(w, `{"error":"path not permitted by registry policy"}`, http.StatusForbidden)
+		return
+	}
+
+	agent := s.liveAgentOr404(w, r)
+	if agent == nil {
+		return
+	}
+
+	req.ID = security.NewID()
+	var res protocol.RegistryResult
+	if !agent.callOrFail(r.Context(), w, "registry_request", req.ID, req, &res) {
+		return
+	}
+
+	action := auditRegistryRead
+	if write {
+		action = auditRegistryWrite
+	}
+	if res.Error != "" {
+		audit(action, fmt.Sprintf(" error=%q", res.Error))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": res.Error}) //nolint:errcheck
+		return
+	}
+	audit(action, "")
+	if write {
+		res.Value, res.Type = req.Value, req.Type
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{ //nolint:errcheck
+		"path":  req.Path,
+		"name":  req.Name,
+		"value": res.Value,
+		"type":  res.Type,
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Config reload: SIGHUP, POST /api/admin/reload or `rmmctl reload` reads
+// the config file and the TLS certificate files again without a restart,
+// so agents and viewers stay connected. Policies, quotas, the drop-box,
+// recording and notification settings, server URLs, ACME domains and the
+// log level take effect at once; disabled capabilities and server URLs reach
+// connected agents when they next register. Listeners, the admin socket,
+// Redis, SIEM, mDNS, FIPS and the slow query threshold are read at start
+// only, and a reload that changes them says so.
+//
+// A reload is all or nothing: if the config does not load or the
+// certificate is rejected, the server keeps what it had.
+
+const auditConfigReloaded = "config_reloaded"
+
+// reloader holds what a reload needs beyond the server itself.
+type reloader struct {
+	mu sync.Mutex // one reload at a time
+
+	path      string        // -config; empty when there is no file
+	overrides func(*Config) // applies command-line flags over the file
+	started   *Config       // as loaded at start, for the restart-only settings
+
+	certs      *security.CertReloader // custom or self-signed certificate; nil otherwise
+	acmeHosts  *security.ACMEHosts    // nil unless ACME
+	acmeDomain string                 // -acme
+}
+
+// restartOnly returns the names of the settings that differ between the
+// config the server started with and cfg but are only read at start.
+func restartOnly(old, cfg *Config) []string {
+	fields := []struct {
+		name     string
+		old, new any
+	}{
+		{"listen", old.Listen, cfg.Listen},
+		{"http_redirect", old.HTTPRedirect, cfg.HTTPRedirect},
+		{"http2", old.HTTP2, cfg.HTTP2},
+		{"admin_socket", old.AdminSocket, cfg.AdminSocket},
+		{"mdns", old.MDNS, cfg.MDNS},
+		{"siem", old.SIEM, cfg.SIEM},
+		{"redis", old.Redis, cfg.Redis},
+		{"telemetry", old.Telemetry, cfg.Telemetry},
+		{"slow_query_ms", old.SlowQueryMS, cfg.SlowQueryMS},
+	}
+	var changed []string
+	for _, f := range fields {
+		a, _ := json.Marshal(f.old)
+		b, _ := json.Marshal(f.new)
+		if !bytes.Equal(a, b) {
+			changed = append(changed, f.name)
+		}
+	}
+	return changed
+}
+
+// reload reads the config file and certificate again and applies them,
+// auditing the reload as actorName's. It returns the changed settings
+// that need a restart.
+func (s *Server) reload(actorID, actorName string) ([]string, error) {
+	rl := s.reloader
+	if rl == nil {
+		return nil, fmt.Errorf("reload is not available")
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cfg, err := loadServerConfig(rl.path)
+	if err != nil {
+		return nil, err
+	}
+	if rl.overrides != nil {
+		rl.overrides(cfg)
+	}
+	if cfg.FIPS != rl.started.FIPS {
+		return nil, fmt.Errorf("fips cannot change without a restart")
+	}
+	if rl.certs != nil {
+		var check func(*tls.Certificate) error
+		if s.fips {
+			check = security.CheckFIPSCertificate
+		}
+		if err := rl.certs.Reload(check); err != nil {
+			return nil, err
+		}
+	}
+	if rl.acmeHosts != nil {
+		rl.acmeHosts.Set(append([]string{rl.acmeDomain}, cfg.ACMEDomains...)...)
+	}
+	s.settings.Store(cfg)
+
+	pending := restartOnly(rl.started, cfg)
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditConfigReloaded,
+		ActorID:   actorID,
+		ActorName: actorName,
+		Detail:    fmt.Sprintf("restart_required=%v", pending),
+	})
+	if len(pending) > 0 {
+		log.Printf("Config: changes to %v take effect after a restart", pending)
+	}
+	return pending, nil
+}
+
+// handleReload reloads the config (POST). It takes an admin key.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	if apiKey.Role != store.RoleAdmin {
+		http.Error(w, `{"error":"reloading the config requires an admin key"}`, http.StatusForbidden)
+		return
+	}
+	pending, err := s.reload(apiKey.ID, apiKey.Name)
+	writeReload(w, pending, err)
+}
+
+// writeReload answers a reload request with its outcome.
+func writeReload(w http.ResponseWriter, pending []string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		log.Printf("Config reload failed: %v", err)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()}) //nolint:errcheck
+		return
+	}
+	if pending == nil {
+		pending = []string{}
+	}
+	json.NewEncoder(w).Encode(map[string]any{ //nolint:errcheck
+		"status":           "reloaded",
+		"restart_required": pending,
+	})
+}
+
+// reloadOnSignal reloads the config on every SIGHUP until the server
+// stops.
+func (s *Server) reloadOnSignal(hup <-chan os.Signal) {
+	for {
+		select {
+		case <-hup:
+			if _, err := s.reload("", "SIGHUP"); err != nil {
+				log.Printf("Config reload failed: %v", err)
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// logRequests logs each request when the log level is debug.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.debugf("HTTP %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Reports summarise the fleet over a period — availability, pending
+// reboots, alerts and viewer sessions — as CSV (one row per agent) or a
+// self-contained HTML page. They are generated on demand or by schedule,
+// kept under <data>/reports and delivered to notification channels.
+
+const (
+	// reportTick is how often report schedules are checked.
+	reportTick = 5 * time.Minute
+	// reportRetention is how long generated reports are kept.
+	reportRetention = 90 * 24 * time.Hour
+	// maxReportDays bounds the period of an on-demand report.
+	maxReportDays = 366
+
+	eventReportGenerated = "report.generated"
+
+	// operationReport is the kind of operations that generate a report.
+	operationReport = "report"
+)
+
+// fleetReport is the data a report is rendered from.
+type fleetReport struct {
+	Name        string
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	Generated   time.Time
+
+	Enrolled      int
+	Online        int
+	SeenInPeriod  int
+	OnlinePercent float64
+
+	// Pending reboots are only known for connected agents.
+	Reporting       int
+	RebootPending   int
+	UpToDatePercent float64
+
+	AlertsRaised int
+	AlertsOpen   int
+	AlertsByType []reportCount
+
+	Sessions       int
+	SessionMinutes float64
+	ByOperator     []reportCount
+
+	Agents []*reportAgent
+}
+
+type reportCount struct {
+	Name    string
+	Count   int
+	Minutes float64
+}
+
+type reportAgent struct {
+	ID             string
+	Name           string
+	Hostname       string
+	OS             string
+	Online         bool
+	LastSeen       time.Time
+	RebootRequired *bool // nil when offline
+	AlertsRaised   int
+	AlertsOpen     int
+	Sessions       int
+	SessionMinutes float64
+}
+
+// buildFleetReport collects the report data for [start, end).
+func (s *Server) buildFleetReport(ctx context.Context, name string, start, end time.Time) (*fleetReport, error) {
+	recs, err := s.store.ListAgents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	raised, err := s.store.ListAlerts(ctx, store.AlertFilter{Since: start, Limit: math.MaxInt32})
+	if err != nil {
+		return nil, err
+	}
+	open, err := s.store.ListAlerts(ctx, store.AlertFilter{Open: true, Limit: math.MaxInt32})
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := s.store.ListViewerSessions(ctx, "", math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &fleetReport{Name: name, PeriodStart: start, PeriodEnd: end, Generated: time.Now()}
+	byID := make(map[string]*reportAgent, len(recs))
+	for _, rec := range recs {
+		ra := &reportAgent{ID: rec.ID, Name: rec.Name, Hostname: rec.Hostname, OS: rec.OS, LastSeen: rec.LastSeen}
+		s.mu.RLock()
+		live := s.agents[rec.ID]
+		s.mu.RUnlock()
+		if live != nil {
+			live.mu.Lock()
+			pending := live.RebootRequired
+			live.mu.Unlock()
+			ra.Online, ra.RebootRequired, ra.LastSeen = true, &pending, end
+			rep.Online++
+			rep.Reporting++
+			if pending {
+				rep.RebootPending++
+			}
+		}
+		if !ra.LastSeen.Before(start) {
+			rep.SeenInPeriod++
+		}
+		byID[rec.ID] = ra
+		rep.Agents = append(rep.Agents, ra)
+	}
+	rep.Enrolled = len(recs)
+	rep.OnlinePercent = percent(rep.Online, rep.Enrolled)
+	rep.UpToDatePercent = percent(rep.Reporting-rep.RebootPending, rep.Reporting)
+
+	types := make(map[string]*reportCount)
+	for _, a := range raised {
+		if !a.RaisedAt.Before(end) {
+			continue
+		}
+		rep.AlertsRaised++
+		if ra := byID[a.AgentID]; ra != nil {
+			ra.AlertsRaised++
+		}
+		countInto(types, a.Type, 0)
+	}
+	rep.AlertsByType = sortedCounts(types)
+	for _, a := range open {
+		rep.AlertsOpen++
+		if ra := byID[a.AgentID]; ra != nil {
+			ra.AlertsOpen++
+		}
+	}
+
+	operators := make(map[string]*reportCount)
+	for _, vs := range sessions {
+		from, to := vs.StartedAt, end
+		if vs.EndedAt != nil && vs.EndedAt.Before(end) {
+			to = *vs.EndedAt
+		}
+		if !from.Before(end) || to.Before(start) {
+			continue
+		}
+		minutes := to.Sub(maxTime(from, start)).Minutes()
+		rep.Sessions++
+		rep.SessionMinutes += minutes
+		if ra := byID[vs.AgentID]; ra != nil {
+			ra.Sessions++
+			ra.SessionMinutes += minutes
+		}
+		countInto(operators, vs.APIKeyName, minutes)
+	}
+	rep.ByOperator = sortedCounts(operators)
+
+	sort.Slice(rep.Agents, func(i, j int) bool { return rep.Agents[i].Name < rep.Agents[j].Name })
+	return rep, nil
+}
+
+func percent(n, of int) float64 {
+	if of == 0 {
+		return 0
+	}
+	return math.Round(float64(n)/float64(of)*1000) / 10
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func countInto(m map[string]*reportCount, name string, minutes float64) {
+	c := m[name]
+	if c == nil {
+		c = &reportCount{Name: name}
+		m[name] = c
+	}
+	c.Count++
+	c.Minutes += minutes
+}
+
+func sortedCounts(m map[string]*reportCount) []reportCount {
+	out := make([]reportCount, 0, len(m))
+	for _, c := range m {
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// renderCSV writes one row per agent.
+func (rep *fleetReport) renderCSV() []byte {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write([]string{"agent_id", "name", "hostname", "os", "online", "last_seen", "reboot_required", //nolint:errcheck
+		"alerts_raised", "alerts_open", "sessions", "session_minutes"})
+	for _, a := range rep.Agents {
+		reboot := ""
+		if a.RebootRequired != nil {
+			reboot = strconv.FormatBool(*a.RebootRequired)
+		}
+		lastSeen := ""
+		if !a.LastSeen.IsZero() {
+			lastSeen = a.LastSeen.UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{a.ID, a.Name, a.Hostname, a.OS, strconv.FormatBool(a.Online), lastSeen, reboot, //nolint:errcheck
+			strconv.Itoa(a.AlertsRaised), strconv.Itoa(a.AlertsOpen), strconv.Itoa(a.Sessions),
+			strconv.FormatFloat(a.SessionMinutes, 'f', 1, 64)})
+	}
+	cw.Flush()
+	return buf.Bytes()
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"date":    func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04 UTC") },
+	"minutes": func(m float64) string { return strconv.FormatFloat(m, 'f', 0, 64) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"><title>{{.Name}}</title>
+<style>
+body{font:14px/1.4 system-ui,sans-serif;margin:2em;color:#222}
+h1{font-size:1.5em;margin-bottom:0}h2{font-size:1.15em;margin-top:2em}
+.period{color:#666}
+.stats{display:flex;gap:1em;flex-wrap:wrap}
+.stat{border:1px solid #ddd;border-radius:6px;padding:.6em 1em;min-width:9em}
+.stat b{display:block;font-size:1.6em}
+table{border-collapse:collapse;width:100%}th,td{text-align:left;padding:.3em .6em;border-bottom:1px solid #eee}
+th{background:#f6f6f6}.warn{color:#b45309}
+@media print{body{margin:0}.stat{break-inside:avoid}}
+</style></head><body>
+<h1>{{.Name}}</h1>
+<p class="period">{{date .PeriodStart}} – {{date .PeriodEnd}} · generated {{date .Generated}}</p>
+
+<h2>Availability</h2>
+<div class="stats">
+<div class="stat"><b>{{.OnlinePercent}}%</b>online now ({{.Online}} of {{.Enrolled}})</div>
+<div class="stat"><b>{{.SeenInPeriod}}</b>seen in period</div>
+</div>
+
+<h2>Updates</h2>
+<div class="stats">
+<div class="stat"><b>{{.UpToDatePercent}}%</b>without a pending reboot</div>
+<div class="stat"><b>{{.RebootPending}}</b>pending reboot (of {{.Reporting}} online)</div>
+</div>
+
+<h2>Alerts</h2>
+<div class="stats">
+<div class="stat"><b>{{.AlertsRaised}}</b>raised in period</div>
+<div class="stat"><b>{{.AlertsOpen}}</b>open now</div>
+</div>
+{{if .AlertsByType}}<table><tr><th>Type</th><th>Raised</th></tr>
+{{range .AlertsByType}}<tr><td>{{.Name}}</td><td>{{.Count}}</td></tr>{{end}}
+</table>{{end}}
+
+<h2>Remote sessions</h2>
+<div class="stats">
+<div class="stat"><b>{{.Sessions}}</b>sessions</div>
+<div class="stat"><b>{{minutes .SessionMinutes}}</b>minutes</div>
+</div>
+{{if .ByOperator}}<table><tr><th>Operator</th><th>Sessions</th><th>Minutes</th></tr>
+{{range .ByOperator}}<tr><td>{{.Name}}</td><td>{{.Count}}</td><td>{{minutes .Minutes}}</td></tr>{{end}}
+</table>{{end}}
+
+<h2>Agents</h2>
+<table><tr><th>Name</th><th>Hostname</th><th>OS</th><th>Status</th><th>Reboot</th><th>Alerts</th><th>Sessions</th></tr>
+{{range .Agents}}<tr><td>{{.Name}}</td><td>{{.Hostname}}</td><td>{{.OS}}</td>
+<td>{{if .Online}}online{{else}}offline{{if not .LastSeen.IsZero}} since {{date .LastSeen}}{{end}}{{end}}</td>
+<td>{{with .RebootRequired}}{{if .}}<span class="warn">pending</span>{{else}}—{{end}}{{else}}unknown{{end}}</td>
+<td>{{.AlertsRaised}}{{if .AlertsOpen}} ({{.AlertsOpen}} open){{end}}</td>
+<td>{{.Sessions}}{{if .Sessions}} / {{minutes .SessionMinutes}} min{{end}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+// renderHTML renders the report as a standalone, printable page.
+func (rep *fleetReport) renderHTML() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, rep); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// reportPath is where a generated report's file is kept.
+func (s *Server) reportPath(r *store.Report) string {
+	return filepath.Join(s.reportDir, r.ID+"."+r.Format)
+}
+
+func reportContentType(format string) string {
+	if format == store.ReportHTML {
+		return "text/html; charset=utf-8"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// generateReport renders, stores and delivers one report, reporting
+// progress to op when it runs as an operation. Delivery failures are
+// recorded on the report rather than returned.
+func (s *Server) generateReport(ctx context.Context, op *operation, scheduleID, name, format string, start, end time.Time, channels []string) (*store.Report, error) {
+	op.progress(0, "collecting fleet data")
+	rep, err := s.buildFleetReport(ctx, name, start, end)
+	if err != nil {
+		return nil, err
+	}
+	op.progress(60, "rendering "+format)
+	var data []byte
+	if format == store.ReportHTML {
+		if data, err = rep.renderHTML(); err != nil {
+			return nil, err
+		}
+	} else {
+		data = rep.renderCSV()
+	}
+
+	r := &store.Report{
+		ID:          security.NewID(),
+		ScheduleID:  scheduleID,
+		Name:        name,
+		Format:      format,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		CreatedAt:   time.Now(),
+		Size:        int64(len(data)),
+	}
+	if err := os.MkdirAll(s.reportDir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(s.reportPath(r), data, 0600); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		_ = os.Remove(s.reportPath(r))
+		return nil, err
+	}
+	if len(channels) > 0 {
+		op.progress(80, "delivering")
+		n := notification{
+			Subject: fmt.Sprintf("%s (%s – %s)", name, start.UTC().Format("2006-01-02"), end.UTC().Format("2006-01-02")),
+			Text: fmt.Sprintf("%s\n\nAgents online: %d of %d (%.1f%%)\nPending reboots: %d\nAlerts raised: %d (%d open)\nRemote sessions: %d\n",
+				name, rep.Online, rep.Enrolled, rep.OnlinePercent, rep.RebootPending,
+				rep.AlertsRaised, rep.AlertsOpen, rep.Sessions),
+			Attachment: &attachment{
+				Name:        fmt.Sprintf("report-%s.%s", end.UTC().Format("2006-01-02"), format),
+				ContentType: reportContentType(format),
+				Data:        data,
+			},
+		}
+		var err error
+		if r.Delivered, err = s.notify(channels, n); err != nil {
+			r.Error = err.Error()
+			log.Printf("Report %q delivery: %v", name, err)
+		}
+	}
+
+	if err := s.store.CreateReport(ctx, r); err != nil {
+		_ = os.Remove(s.reportPath(r))
+		return nil, err
+	}
+	s.publishEvent(eventReportGenerated, "", r)
+	return r, nil
+}
+
+// checkReportRequest validates a format and channel names.
+func (s *Server) checkReportRequest(format string, channels []string) error {
+	if format != store.ReportCSV && format != store.ReportHTML {
+		return fmt.Errorf("format must be csv or html")
+	}
+	for _, name := range channels {
+		if _, ok := s.channel(name); !ok {
+			return fmt.Errorf("unknown notification channel %q", name)
+		}
+	}
+	return nil
+}
+
+// handleReports lists generated reports (GET, ?limit=) or generates one
+// now (POST {"name", "format", "days", "channels", "async"}). With async
+// set the report is generated as an operation, whose result it is.
+func (s *Server) handleReports(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		reports, err := s.store.ListReports(r.Context(), limit)
+		if err != nil {
+			http.Error(w, `{"error":"failed to list reports"}`, http.StatusInternalServerError)
+			return
+		}
+		if reports == nil {
+			reports = []*store.Report{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reports) //nolint:errcheck
+
+	case http.MethodPost:
+		var req struct {
+			Name     string   `json:"name"`
+			Format   string   `json:"format"`
+			Days     int      `json:"days"`
+			Channels []string `json:"channels"`
+			Async    bool     `json:"async"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		if req.Days == 0 {
+			req.Days = 7
+		}
+		if req.Name == "" {
+			req.Name = "Fleet report"
+		}
+		if err := s.checkReportRequest(req.Format, req.Channels); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		if req.Days < 1 || req.Days > maxReportDays {
+			http.Error(w, fmt.Sprintf(`{"error":"days must be 1-%d"}`, maxReportDays), http.StatusBadRequest)
+			return
+		}
+
+		apiKey := security.APIKeyFromContext(r.Context())
+		end := time.Now()
+		generate := func(ctx context.Context, op *operation) (*store.Report, error) {
+			rep, err := s.generateReport(ctx, op, "", req.Name, req.Format, end.AddDate(0, 0, -req.Days), end, req.Channels)
+			if err != nil {
+				return nil, err
+			}
+			s.recordAudit(&store.AuditEvent{
+				Action:    auditReportGenerated,
+				ActorID:   apiKey.ID,
+				ActorName: apiKey.Name,
+				Detail:    fmt.Sprintf("report=%s format=%s days=%d", rep.ID, rep.Format, req.Days),
+			})
+			return rep, nil
+		}
+		if req.Async {
+			rec, err := s.startOperation(operationReport, apiKey, func(ctx context.Context, op *operation) (any, error) {
+				return generate(ctx, op)
+			})
+			writeOperation(w, rec, err)
+			return
+		}
+
+		rep, err := generate(r.Context(), nil)
+		if err != nil {
+			log.Printf("Report %q: %v", req.Name, err)
+			http.Error(w, `{"error":"failed to generate report"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rep) //nolint:errcheck
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleGetReport serves a generated report's file.
+func (s *Server) handleGetReport(w http.ResponseWriter, r *http.Request) {
+	rep, err := s.store.GetReport(r.Context(), r.PathValue("id"))
+	if err != nil || rep == nil {
+		http.Error(w, `{"error":"report not found"}`, http.StatusNotFound)
+		return
+	}
+	data, err := os.ReadFile(s.reportPath(rep))
+	if err != nil {
+		http.Error(w, `{"error":"report not found"}`, http.StatusNotFound)
+		return
+	}
+	disposition := "attachment"
+	if rep.Format == store.ReportHTML {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", reportContentType(rep.Format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`%s; filename="report-%s.%s"`,
+		disposition, rep.PeriodEnd.UTC().Format("2006-01-02"), rep.Format))
+	// The HTML report is self-contained; nothing in it needs to load.
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Write(data) //nolint:errcheck
+}
+
+// handleReportSchedules lists (GET) or creates (POST) report schedules.
+func (s *Server) handleReportSchedules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		scheds, err := s.store.ListReportSchedules(r.Context())
+		if err != nil {
+			http.Error(w, `{"error":"failed to list schedules"}`, http.StatusInternalServerError)
+			return
+		}
+		if scheds == nil {
+			scheds = []*store.ReportSchedule{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scheds) //nolint:errcheck
+
+	case http.MethodPost:
+		var req struct {
+			Name      string   `json:"name"`
+			Format    string   `json:"format"`
+			Frequency string   `json:"frequency"`
+			Channels  []string `json:"channels"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		if err := s.checkReportRequest(req.Format, req.Channels); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		switch req.Frequency {
+		case store.ReportDaily, store.ReportWeekly, store.ReportMonthly:
+		default:
+			http.Error(w, `{"error":"frequency must be daily, weekly or monthly"}`, http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			req.Name = "Fleet report"
+		}
+		if req.Channels == nil {
+			req.Channels = []string{}
+		}
+
+		apiKey := security.APIKeyFromContext(r.Context())
+		sched := &store.ReportSchedule{
+			ID:        security.NewID(),
+			Name:      req.Name,
+			Format:    req.Format,
+			Frequency: req.Frequency,
+			Channels:  req.Channels,
+			CreatedBy: apiKey.Name,
+			CreatedAt: time.Now(),
+		}
+		if err := s.store.CreateReportSchedule(r.Context(), sched); err != nil {
+			http.Error(w, `{"error":"failed to create schedule"}`, http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditReportScheduleCreated,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail:    fmt.Sprintf("schedule=%s %s %s channels=%v", sched.ID, sched.Frequency, sched.Format, sched.Channels),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(sched) //nolint:errcheck
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleReportSchedule deletes a report schedule. Reports it generated
+// are kept.
+func (s *Server) handleReportSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sched, err := s.store.GetReportSchedule(r.Context(), r.PathValue("id"))
+	if err != nil || sched == nil {
+		http.Error(w, `{"error":"schedule not found"}`, http.StatusNotFound)
+		return
+	}
+	if err := s.store.DeleteReportSchedule(r.Context(), sched.ID); err != nil {
+		http.Error(w, `{"error":"failed to delete schedule"}`, http.StatusInternalServerError)
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditReportScheduleDeleted,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		Detail:    "schedule=" + sched.ID,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// nextReportRun is when a schedule is next due: one period after its
+// previous run, or after its creation.
+func nextReportRun(sched *store.ReportSchedule) (from, next time.Time) {
+	from = sched.CreatedAt
+	if sched.LastRunAt != nil {
+		from = *sched.LastRunAt
+	}
+	switch sched.Frequency {
+	case store.ReportDaily:
+		return from, from.AddDate(0, 0, 1)
+	case store.ReportWeekly:
+		return from, from.AddDate(0, 0, 7)
+	default:
+		return from, from.AddDate(0, 1, 0)
+	}
+}
+
+// runReports generates scheduled reports and expires old ones until the
+// server shuts down.
+func (s *Server) runReports() {
+	ticker := time.NewTicker(reportTick)
+	defer ticker.Stop()
+	for s.tick(ticker) {
+		ctx := s.ctx
+		scheds, err := s.store.ListReportSchedules(ctx)
+		if err != nil {
+			log.Printf("Report schedules: %v", err)
+			continue
+		}
+		for _, sched := range scheds {
+			from, next := nextReportRun(sched)
+			now := time.Now()
+			if now.Before(next) {
+				continue
+			}
+			// Mark the run first so a failing report is retried next
+			// period rather than every tick.
+			if err := s.store.SetReportScheduleRun(ctx, sched.ID, now); err != nil {
+				log.Printf("Report schedule %s: %v", sched.ID, err)
+				continue
+			}
+			if _, err := s.generateReport(ctx, nil, sched.ID, sched.Name, sched.Format, from, now, sched.Channels); err != nil {
+				log.Printf("Report %q: %v", sched.Name, err)
+			}
+		}
+
+		ids, err := s.store.DeleteReportsBefore(ctx, time.Now().Add(-reportRetention))
+		if err != nil {
+			log.Printf("Report retention: %v", err)
+		}
+		for _, id := range ids {
+			for _, format := range []string{store.ReportCSV, store.ReportHTML} {
+				_ = os.Remove(filepath.Join(s.reportDir, id+"."+format))
+			}
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Scheduled screenshots: agents with a schedule are captured every N
+// minutes while online, and the JPEGs are kept under <data>/screenshots
+// in a rolling archive bounded by count and age. A capture has nobody to
+// ask, so only agents that allow unattended access and are not sensitive
+// can be scheduled, and nothing is captured outside business hours.
+
+const (
+	// screenshotTick is how often schedules are checked, which bounds
+	// how late a capture may be.
+	screenshotTick = 30 * time.Second
+
+	// Schedule defaults and bounds.
+	defaultScreenshotKeep      = 1000
+	defaultScreenshotRetention = 30 // days
+	maxScreenshotInterval      = 24 * 60
+	maxScreenshotKeep          = 100000
+	maxScreenshotRetention     = 3650
+
+	eventScreenshotCaptured = "screenshot.captured"
+	eventScreenshotFailed   = "screenshot.failed"
+)
+
+// jpegMagic starts every JPEG; anything else from the agent is refused
+// rather than served back as image/jpeg.
+var jpegMagic = []byte{0xFF, 0xD8, 0xFF}
+
+// screenshotState tracks captures between scheduler ticks.
+type screenshotState struct {
+	mu       sync.Mutex
+	last     map[string]time.Time // last attempt per agent
+	inflight map[string]bool
+}
+
+// screenshotPath is where an archived screenshot's JPEG is kept.
+func (s *Server) screenshotPath(agentID, id string) string {
+	return filepath.Join(s.screenshotDir, agentID, id+".jpg")
+}
+
+// handleScreenshotSchedule reads (GET), sets (PUT) or removes (DELETE,
+// ?purge=1 to also delete the archive) an agent's screenshot schedule.
+func (s *Server) handleScreenshotSchedule(w http.ResponseWriter, r *http.Request) {
+	agentID := r.PathValue("id")
+	rec, err := s.store.GetAgent(r.Context(), agentID)
+	if err != nil || rec == nil {
+		http.Error(w, `{"error":"agent not found"}`, http.StatusNotFound)
+		return
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		sc, err := s.store.GetScreenshotSchedule(r.Context(), agentID)
+		if err != nil || sc == nil {
+			http.Error(w, `{"error":"no schedule"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sc) //nolint:errcheck
+
+	case http.MethodPut:
+		var req struct {
+			Interval      int   `json:"interval_minutes"`
+			Display       int   `json:"display"`
+			Keep          int   `json:"keep"`
+			RetentionDays int   `json:"retention_days"`
+			Enabled       *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+			return
+		}
+		if req.Keep == 0 {
+			req.Keep = defaultScreenshotKeep
+		}
+		if req.RetentionDays == 0 {
+			req.RetentionDays = defaultScreenshotRetention
+		}
+		switch {
+		case req.Interval < 1 || req.Interval > maxScreenshotInterval:
+			http.Error(w, fmt.Sprintf(`{"error":"interval_minutes must be 1-%d"}`, maxScreenshotInterval), http.StatusBadRequest)
+			return
+		case req.Display < 0:
+			http.Error(w, `{"error":"invalid display"}`, http.StatusBadRequest)
+			return
+		case req.Keep < 1 || req.Keep > maxScreenshotKeep:
+			http.Error(w, fmt.Sprintf(`{"error":"keep must be 1-%d"}`, maxScreenshotKeep), http.StatusBadRequest)
+			return
+		case req.RetentionDays < 1 || req.RetentionDays > maxScreenshotRetention:
+			http.Error(w, fmt.Sprintf(`{"error":"retention_days must be 1-%d"}`, maxScreenshotRetention), http.StatusBadRequest)
+			return
+		}
+
+		if reason := s.scheduleBlocked(rec.Unattended, rec.Sensitive || s.config().Sensitive.covers(rec.OrgID, rec.Site)); reason != "" {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, reason), http.StatusConflict)
+			return
+		}
+
+		sc := &store.ScreenshotSchedule{
+			AgentID:       agentID,
+			Interval:      req.Interval,
+			Display:       req.Display,
+			Keep:          req.Keep,
+			RetentionDays: req.RetentionDays,
+			Enabled:       req.Enabled == nil || *req.Enabled,
+			UpdatedBy:     apiKey.Name,
+			UpdatedAt:     time.Now(),
+		}
+		if err := s.store.SetScreenshotSchedule(r.Context(), sc); err != nil {
+			http.Error(w, `{"error":"failed to save schedule"}`, http.StatusInternalServerError)
+			return
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditScreenshotSchedule,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			AgentID:   agentID,
+			Detail: fmt.Sprintf("interval=%dm display=%d keep=%d retention_days=%d enabled=%t",
+				sc.Interval, sc.Display, sc.Keep, sc.RetentionDays, sc.Enabled),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sc) //nolint:errcheck
+
+	case http.MethodDelete:
+		if err := s.store.DeleteScreenshotSchedule(r.Context(), agentID); err != nil {
+			http.Error(w, `{"error":"failed to delete schedule"}`, http.StatusInternalServerError)
+			return
+		}
+		purge := r.URL.Query().Get("purge") == "1"
+		detail := "schedule removed"
+		if purge {
+			n := s.pruneScreenshots(agentID, 0, time.Now().Add(time.Hour))
+			detail += fmt.Sprintf(", %d screenshots purged", n)
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditScreenshotUnschedule,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			AgentID:   agentID,
+			Detail:    detail,
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListScreenshots lists an agent's archived screenshots, newest
+// first, filtered by ?since= and ?until= (RFC 3339) and ?limit=.
+func (s *Server) handleListScreenshots(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := store.ScreenshotFilter{AgentID: r.PathValue("id")}
+	filter.Limit, _ = strconv.Atoi(q.Get("limit"))
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf(`{"error":"%s must be RFC 3339"}`, name), http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+
+	shots, err := s.store.ListScreenshots(r.Context(), filter)
+	if err != nil {
+		http.Error(w, `{"error":"failed to list screenshots"}`, http.StatusInternalServerError)
+		return
+	}
+	if shots == nil {
+		shots = []*store.Screenshot{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shots) //nolint:errcheck
+}
+
+// handleGetScreenshot serves one archived screenshot as image/jpeg.
+func (s *Server) handleGetScreenshot(w http.ResponseWriter, r *http.Request) {
+	shot, err := s.store.GetScreenshot(r.Context(), r.PathValue("shot"))
+	if err != nil || shot == nil || shot.AgentID != r.PathValue("id") {
+		http.Error(w, `{"error":"screenshot not found"}`, http.StatusNotFound)
+		return
+	}
+	data, err := os.ReadFile(s.screenshotPath(shot.AgentID, shot.ID))
+	if err != nil {
+		http.Error(w, `{"error":"screenshot not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("Last-Modified", shot.TakenAt.UTC().Format(http.TimeFormat))
+	w.Write(data) //nolint:errcheck
+}
+
+// runScreenshotSchedules captures due screenshots and applies retention
+// until the server shuts down.
+func (s *Server) runScreenshotSchedules() {
+	ticker := time.NewTicker(screenshotTick)
+	defer ticker.Stop()
+	for s.tick(ticker) {
+		scheds, err := s.store.ListScreenshotSchedules(s.ctx)
+		if err != nil {
+			log.Printf("Screenshot schedules: %v", err)
+			continue
+		}
+		for _, sc := range scheds {
+			s.pruneScreenshots(sc.AgentID, sc.Keep, time.Now().AddDate(0, 0, -sc.RetentionDays))
+			if !sc.Enabled {
+				continue
+			}
+			s.mu.RLock()
+			agent, online := s.agents[sc.AgentID]
+			s.mu.RUnlock()
+			if online && s.mayCapture(agent) && s.claimScreenshot(sc) {
+				go s.takeScreenshot(agent, sc)
+			}
+		}
+	}
+}
+
+// scheduleBlocked says why an agent may not have a screenshot schedule,
+// or "" if it may: an attended agent captures only with the local user's
+// consent, and a sensitive one only with a second admin's approval.
+func (s *Server) scheduleBlocked(unattended, sensitive bool) string {
+	switch {
+	case !unattended:
+		return "the agent does not allow unattended access, so it cannot be captured on a schedule"
+	case sensitive:
+		return "the agent is sensitive, so it cannot be captured on a schedule"
+	}
+	return ""
+}
+
+// mayCapture reports whether a scheduled capture of agent may run now.
+// Settings can change after the schedule was set, so they are checked on
+// every capture, along with the agent's access schedules; overrides belong
+// to a key and do not cover the scheduler.
+func (s *Server) mayCapture(agent *LiveAgent) bool {
+	agent.mu.Lock()
+	unattended := agent.Unattended
+	agent.mu.Unlock()
+	if s.scheduleBlocked(unattended, s.isSensitive(agent)) != "" {
+		return false
+	}
+	sc, err := s.afterHours(s.ctx, agent, time.Now())
+	if err != nil {
+		log.Printf("Screenshot of %s skipped: access schedules: %v", agent.Name, err)
+		return false
+	}
+	return sc == nil
+}
+
+// claimScreenshot reports whether sc is due and no capture for its agent
+// is already running, and if so marks one as started.
+func (s *Server) claimScreenshot(sc *store.ScreenshotSchedule) bool {
+	st := &s.screenshots
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.inflight[sc.AgentID] {
+		return false
+	}
+	last, ok := st.last[sc.AgentID]
+	if !ok {
+		// After a restart, continue from the archive.
+		shots, _ := s.store.ListScreenshots(s.ctx, store.ScreenshotFilter{AgentID: sc.AgentID, Limit: 1})
+		if len(shots) > 0 {
+			last = shots[0].TakenAt
+		}
+	}
+	// Allow half a tick of slack so an N-minute schedule is not pushed
+	// to N minutes plus one tick by scheduling jitter.
+	if time.Since(last) < time.Duration(sc.Interval)*time.Minute-screenshotTick/2 {
+		return false
+	}
+	if st.last == nil {
+		st.last = make(map[string]time.Time)
+		st.inflight = make(map[string]bool)
+	}
+	st.last[sc.AgentID] = time.Now()
+	st.inflight[sc.AgentID] = true
+	return true
+}
+
+// takeScreenshot asks the agent for a capture and archives it.
+func (s *Server) takeScreenshot(agent *LiveAgent, sc *store.ScreenshotSchedule) {
+	defer func() {
+		s.screenshots.mu.Lock()
+		delete(s.screenshots.inflight, agent.ID)
+		s.screenshots.mu.Unlock()
+	}()
+
+	req := protocol.ScreenshotRequest{ID: security.NewID(), Display: sc.Display}
+	var res protocol.ScreenshotResult
+	err := agent.call(s.ctx, "screenshot_request", req.ID, req, &res)
+	if err == nil && res.Error == "" && !bytes.HasPrefix(res.Image, jpegMagic) {
+		err = fmt.Errorf("agent returned a non-JPEG image")
+	} else if err == nil && res.Error != "" {
+		err = fmt.Errorf("%s", res.Error)
+	}
+	if err != nil {
+		log.Printf("Screenshot of %s failed: %v", agent.Name, err)
+		s.publishEvent(eventScreenshotFailed, agent.ID, map[string]string{"error": err.Error()})
+		return
+	}
+
+	shot := &store.Screenshot{
+		ID:      req.ID,
+		AgentID: agent.ID,
+		TakenAt: time.Now(),
+		Display: res.Display,
+		Size:    int64(len(res.Image)),
+	}
+	path := s.screenshotPath(agent.ID, shot.ID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+		err = os.WriteFile(path, res.Image, 0600)
+	}
+	if err == nil {
+		err = s.store.CreateScreenshot(context.Background(), shot)
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		log.Printf("Screenshot of %s not archived: %v", agent.Name, err)
+		return
+	}
+	s.pruneScreenshots(agent.ID, sc.Keep, time.Now().AddDate(0, 0, -sc.RetentionDays))
+	s.publishEvent(eventScreenshotCaptured, agent.ID, shot)
+}
+
+// pruneScreenshots applies retention to an agent's archive and returns
+// how many screenshots were removed.
+func (s *Server) pruneScreenshots(agentID string, keep int, before time.Time) int {
+	ids, err := s.store.PruneScreenshots(s.ctx, agentID, keep, before)
+	if err != nil {
+		log.Printf("Screenshot retention for %s: %v", agentID, err)
+	}
+	for _, id := range ids {
+		_ = os.Remove(s.screenshotPath(agentID, id))
+	}
+	return len(ids)
+}
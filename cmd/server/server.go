@@ -4,15 +4,84 @@
 // Files in this package:
 //   - server.go       — Server struct, LiveAgent, constants
 //   - main.go         — Entry point, flag parsing, TLS mode selection
+//   - config.go       — Optional JSON config file
+//   - listeners.go    — Multi-address listeners, HTTP→HTTPS redirect
 //   - websocket.go    — RFC 6455 WebSocket upgrade
+//   - http2.go        — HTTP/2, WebSockets over HTTP/2 streams
 //   - handler_agent.go  — Agent connection lifecycle
 //   - handler_viewer.go — Viewer connection lifecycle
 //   - handler_api.go    — REST API (agents, enrollment, auth)
+//   - handler_session.go — Dashboard sessions, viewer and portal session tickets
+//   - handler_qr.go     — Enrollment QR codes
+//   - handler_bulk.go   — Bulk enrollment tokens and hostname CSV import
+//   - provisioning.go   — Provisioning files for golden images and MDM
+//   - mdm.go            — Intune, Jamf and GPO deployment kits
+//   - audit.go          — Remote-control audit trail (sessions, control events)
+//   - input_limit.go    — Per-session input rate limit
+//   - attestation.go    — TPM key binding at enrollment and registration
+//   - consent.go        — Local-user consent for attended agents
+//   - approvals.go      — Four-eyes approval of sessions to sensitive agents
+//   - registry.go       — Policy-gated registry / defaults / gsettings access
+//   - startup.go        — Startup-item inventory and disabling
+//   - fs.go             — Policy-gated file system browser API
+//   - dropbox.go        — File drop-box for offline agents
+//   - screenshots.go    — Scheduled screenshot archive
+//   - alerts.go         — Alert rules, evaluation and alert API
+//   - power.go          — Remote reboot and shutdown
+//   - reboots.go        — Scheduled reboot windows with user deferrals
+//   - access.go         — Business hours and after-hours access overrides
+//   - deployments.go    — Software deployments through package managers
+//   - artifacts.go      — Package repository of hosted installers
+//   - sshkeys.go        — SSH key inventory, assignments and drift
+//   - gateway.go        — VNC/RDP gateway streams through agents
+//   - support.go        — Support requests raised by agents' local users
+//   - health.go         — Health history and agents' replayed backlogs
+//   - actions.go        — Quick actions catalog and API
+//   - plugins.go        — Agent plugin results, metrics and on-command runs
+//   - hostconfig.go     — Hosts file and system environment, with audited diffs
+//   - diagnostics.go    — Diagnostics archives uploaded by agents
+//   - session_diagnostics.go — Capture and relay timings of a live session
+//   - latency.go        — Glass-to-glass frame latency of viewer sessions
+//   - recordings.go     — Session recordings, watermarks and legal holds
+//   - privacy.go        — Data subject export and erasure of an agent's data
+//   - permissions.go    — macOS permission status and prompts
+//   - viewer_permissions.go — Viewer permission masks from key roles and agent policy
+//   - reports.go        — Fleet reports (CSV/HTML), schedules and API
+//   - operations.go     — Async operations: worker pool, progress and cancellation
+//   - notify.go         — Notification channels (webhook, email)
+//   - integrations.go   — PSA ticketing integrations and API
+//   - psa.go            — Ticket providers (ConnectWise, Autotask, generic REST)
+//   - orgs.go           — Organizations and per-org usage metering
+//   - quotas.go         — Agent connection and enrollment quotas
+//   - status.go         — Public per-organization status pages
+//   - branding.go       — Per-organization branding for the dashboard and agents
+//   - events.go         — Dashboard event stream (Server-Sent Events)
+//   - extensions.go     — Compiled-in extensions: routes, events and migrations
+//   - redis.go          — Event and presence mirroring to Redis
+//   - telemetry.go      — Telemetry-only agents reporting over MQTT or NATS
+//   - telemetry_mqtt.go — MQTT 3.1.1 subscriber
+//   - telemetry_nats.go — NATS subscriber
+//   - siem.go           — Audit event export over syslog (RFC 5424, CEF, LEEF)
+//   - mdns.go           — Server advertising on the local link (mDNS)
+//   - metrics.go        — Prometheus metrics endpoint
+//   - enrollstats.go    — Enrollment activity metrics and leaked-token alerts
+//   - reload.go         — Config and certificate reload without a restart
+//   - liveness.go       — Agent status from heartbeats; silent agents taken offline
+//   - handover.go       — Socket activation and agents' reconnect notice on shutdown
+//   - static.go         — Dashboard assets (cache headers, gzip)
+//   - admin.go          — Local admin API on a Unix socket
+//   - escrow.go         — Platform key restore from an escrow recovery code
+//   - fips.go           — FIPS mode TLS checks
 package main
 
 import (
-	"net"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/avaropoint/rmm/internal/protocol"
@@ -26,78 +95,324 @@ const registrationTimeout = 30 * time.Second
 
 // LiveAgent represents an active agent connection (in-memory).
 type LiveAgent struct {
-	ID            string                 `json:"id"`
-	Name          string                 `json:"name"`
-	Hostname      string                 `json:"hostname"`
-	OS            string                 `json:"os"`
-	OSVersion     string                 `json:"os_version"`
-	Arch          string                 `json:"arch"`
-	IP            string                 `json:"ip"`
-	Status        string                 `json:"status"`
-	LastSeen      time.Time              `json:"last_seen"`
-	CPUCount      int                    `json:"cpu_count"`
-	MemoryTotal   uint64                 `json:"memory_total"`
-	MemoryFree    uint64                 `json:"memory_free"`
-	DiskTotal     uint64                 `json:"disk_total"`
-	DiskFree      uint64                 `json:"disk_free"`
-	Displays      []protocol.DisplayInfo `json:"displays"`
-	DisplayCount  int                    `json:"display_count"`
-	LocalIPs      []string               `json:"local_ips"`
-	Username      string                 `json:"username"`
-	UptimeSeconds int64                  `json:"uptime_seconds"`
-	AgentVersion  string                 `json:"agent_version"`
-	EnrolledAt    time.Time              `json:"enrolled_at,omitempty"`
-	conn          net.Conn
-	mu            sync.Mutex
+	ID                string                 `json:"id"`
+	Name              string                 `json:"name"`
+	Hostname          string                 `json:"hostname"`
+	OS                string                 `json:"os"`
+	OSVersion         string                 `json:"os_version"`
+	Arch              string                 `json:"arch"`
+	IP                string                 `json:"ip"`
+	Status            string                 `json:"status"`    // online, idle or stale (see liveness.go), guarded by mu
+	LastSeen          time.Time              `json:"last_seen"` // last frame from the agent, guarded by mu
+	CPUCount          int                    `json:"cpu_count"`
+	MemoryTotal       uint64                 `json:"memory_total"`
+	MemoryFree        uint64                 `json:"memory_free"` // updated by heartbeats, guarded by mu
+	DiskTotal         uint64                 `json:"disk_total"`
+	DiskFree          uint64                 `json:"disk_free"`     // updated by heartbeats, guarded by mu
+	Displays          []protocol.DisplayInfo `json:"displays"`      // updated on hot-plug, guarded by mu
+	DisplayCount      int                    `json:"display_count"` // updated on hot-plug, guarded by mu
+	LocalIPs          []string               `json:"local_ips"`
+	Username          string                 `json:"username"`
+	UptimeSeconds     int64                  `json:"uptime_seconds"`
+	AgentVersion      string                 `json:"agent_version"`
+	EnrolledAt        time.Time              `json:"enrolled_at,omitempty"`
+	Unattended        bool                   `json:"unattended"`
+	OrgID             string                 `json:"org_id,omitempty"`                // guarded by mu
+	Site              string                 `json:"site,omitempty"`                  // guarded by mu
+	Image             string                 `json:"image,omitempty"`                 // golden image the agent was provisioned from
+	CPUPercent        float64                `json:"cpu_percent"`                     // from the last heartbeat, guarded by mu
+	RebootRequired    bool                   `json:"reboot_required"`                 // from the last heartbeat, guarded by mu
+	RebootReasons     []string               `json:"reboot_reasons,omitempty"`        // from the last heartbeat, guarded by mu
+	TopCPU            []protocol.ProcessInfo `json:"top_cpu,omitempty"`               // from the last heartbeat, guarded by mu
+	TopMemory         []protocol.ProcessInfo `json:"top_memory,omitempty"`            // from the last heartbeat, guarded by mu
+	ClockDriftMS      *int64                 `json:"clock_drift_ms,omitempty"`        // agent clock minus server clock, from the last heartbeat, guarded by mu
+	TimeSync          *protocol.TimeSync     `json:"time_sync,omitempty"`             // from the last heartbeat, guarded by mu
+	Permissions       *protocol.Permissions  `json:"permissions,omitempty"`           // macOS only, guarded by mu
+	Disabled          []string               `json:"disabled_capabilities,omitempty"` // capability classes the agent refuses
+	ViewerPermissions []string               `json:"viewer_permissions,omitempty"`    // viewer policy, guarded by mu
+	Sensitive         bool                   `json:"sensitive,omitempty"`             // sessions need four-eyes approval, guarded by mu
+	StartupItems      []protocol.StartupItem `json:"-"`                               // see /api/agents/{id}/startup
+	Environment       map[string]string      `json:"-"`
+	inventoryAt       time.Time
+	plugins           map[string]*protocol.PluginResult // latest result of each plugin, guarded by mu (see plugins.go)
+	conn              protocol.Conn
+	epoch             uint64 // connection epoch, set by admitAgent
+	mu                sync.Mutex
+	consent           chan bool // pending consent prompt, guarded by mu
+
+	pending map[string]chan json.RawMessage // in-flight agent calls by ID, guarded by mu
+
+	transferring bool // a file upload to the agent is in flight, guarded by mu
+
+	diagnostics *diagnosticsCollection // collection in progress, guarded by mu
+
+	recorder *sessionRecorder // recording of the viewer session, guarded by mu
+
+	// signer signs high-impact commands to the agent (see call).
+	signer *security.Platform
+
+	// fileCredit paces file chunks to the agent; nil for agents without
+	// flow control (see protocol.Credit).
+	fileCredit *protocol.Credit
+
+	// gateways are the agent's open gateway streams by stream number,
+	// guarded by mu (see handleGateway).
+	gateways   map[uint32]*gatewayRelay
+	nextStream uint32 // guarded by mu
+
+	relayed atomic.Int64 // bytes relayed between the agent and its viewer, for usage metering
+
+	relay   relayStats     // the viewer session's screen relay (see session_diagnostics.go)
+	latency sessionLatency // the viewer session's glass-to-glass latency (see latency.go)
 }
 
 // Server manages agents, viewers, and platform state.
 type Server struct {
+	// ctx is canceled when the server shuts down. Background work runs
+	// under it, and so does every request (see serveAll).
+	ctx context.Context
+
+	// relays tracks agent and viewer connections, which outlive their
+	// HTTP requests once hijacked, so shutdown can wait for them to close.
+	relays sync.WaitGroup
+
 	agents   map[string]*LiveAgent
-	viewers  map[string]net.Conn
+	viewers  map[string]protocol.Conn
 	mu       sync.RWMutex
-	webDir   string
+	assets   fs.FS
 	store    store.Store
 	platform *security.Platform
 	tlsPaths *security.TLSConfig
+	auth     *security.AuthMiddleware
+
+	// agentEpoch numbers agent connections, guarded by mu, so the
+	// cleanup of a connection another has replaced leaves the newer one
+	// registered (see admitAgent).
+	agentEpoch uint64
+
+	// redeemedTickets holds the IDs of redeemed viewer tickets until
+	// they expire, so each is used once (see redeemViewerTicket).
+	redeemedTickets map[string]time.Time
+	ticketMu        sync.Mutex
+
+	pendingCodes map[string]pendingCode
+	codesMu      sync.Mutex
+
+	// hands are pending support requests by agent ID (see raiseHand).
+	hands   map[string]*raisedHand
+	handsMu sync.Mutex
+
+	// overrides are after-hours access overrides by ID (see access.go).
+	overrides   map[string]*accessOverride
+	overridesMu sync.Mutex
+
+	// approvals are the sessions awaiting four-eyes approval, by ID (see
+	// approvals.go).
+	approvals   map[string]*sessionApproval
+	approvalsMu sync.Mutex
+
+	// enrollments counts each organization's recent enrollments for
+	// its quota (see quotas.go).
+	enrollments enrollmentRate
+
+	// enrollStats counts enrollment attempts for the metrics and
+	// leaked-token alerts (see enrollstats.go).
+	enrollStats enrollStats
+
+	startedAt time.Time
+
+	// requireKeyBinding rejects enrollments that do not bind a TPM key.
+	requireKeyBinding bool
+
+	// fips is set when FIPS mode is enforced (see checkFIPSTLS).
+	fips bool
+
+	// settings is the config file's current contents: the policies, the
+	// drop-box and recording settings, the server URLs handed to agents
+	// and the notification channels are read through it on every use, so
+	// a reload (see reload.go) takes effect at once.
+	settings atomic.Pointer[Config]
+	// reloader reloads settings and certificates; nil until main sets it.
+	reloader *reloader
+
+	// dropboxDir holds files queued for offline agents; dropboxMu
+	// serialises quota checks.
+	dropboxDir string
+	dropboxMu  sync.Mutex
+
+	// screenshotDir holds the scheduled screenshot archive.
+	screenshotDir string
+	screenshots   screenshotState
+
+	// diagnosticsDir holds diagnostics archives uploaded by agents.
+	diagnosticsDir string
+
+	// artifactDir holds installers hosted for software deployments.
+	artifactDir string
+
+	// brandingDir holds organizations' logos.
+	brandingDir string
+
+	// recordingDir holds session recordings.
+	recordingDir string
+
+	// rebootMu serialises updates to scheduled reboot runs.
+	rebootMu sync.Mutex
+	// deployMu serialises updates to software deployment results.
+	deployMu sync.Mutex
+
+	// alerts tracks alert rule conditions between evaluations.
+	alerts alertState
+
+	// reportDir holds generated reports.
+	reportDir string
+	// backupDir holds database backups taken through the API.
+	backupDir string
+
+	// operations runs long-running actions in the background (see
+	// operations.go).
+	operations operationPool
+
+	// events feeds the dashboard event stream (/api/events).
+	events eventHub
+	// redis, when configured, mirrors events and presence to Redis.
+	redis *redisMirror
+	// telemetry, when configured, receives telemetry-only agents'
+	// reports.
+	telemetry *telemetryBroker
+	// siem forwards audit events to the configured syslog receivers.
+	siem []*siemExporter
+	// extensions describes the compiled-in extensions started (see
+	// extensions.go).
+	extensions []extensionInfo
+
+	// glassLatency counts viewer sessions' frame latencies for
+	// /api/metrics (see latency.go).
+	glassLatency latencyHistogram
 }
 
-// NewServer creates a new Server instance.
-func NewServer(webDir string, db store.Store, platform *security.Platform, tlsPaths *security.TLSConfig) *Server {
+// NewServer creates a new Server instance that shuts down when ctx is
+// canceled.
+func NewServer(ctx context.Context, assets fs.FS, db store.Store, platform *security.Platform, tlsPaths *security.TLSConfig) *Server {
 	return &Server{
+		ctx:      ctx,
 		agents:   make(map[string]*LiveAgent),
-		viewers:  make(map[string]net.Conn),
-		webDir:   webDir,
+		viewers:  make(map[string]protocol.Conn),
+		assets:   assets,
 		store:    db,
 		platform: platform,
 		tlsPaths: tlsPaths,
+		auth:     security.NewAuthMiddleware(db),
+
+		redeemedTickets: make(map[string]time.Time),
+
+		pendingCodes: make(map[string]pendingCode),
+		hands:        make(map[string]*raisedHand),
+		overrides:    make(map[string]*accessOverride),
+		approvals:    make(map[string]*sessionApproval),
+		operations:   newOperationPool(),
+
+		startedAt: time.Now(),
+	}
+}
+
+// config returns the current settings from the config file.
+func (s *Server) config() *Config {
+	if cfg := s.settings.Load(); cfg != nil {
+		return cfg
+	}
+	return &Config{}
+}
+
+// debugf logs when the log level is debug.
+func (s *Server) debugf(format string, args ...any) {
+	if s.config().LogLevel == logDebug {
+		log.Printf(format, args...)
+	}
+}
+
+// tick waits for the ticker's next tick. It reports false once the server
+// is shutting down, ending the background loop that called it.
+func (s *Server) tick(t *time.Ticker) bool {
+	select {
+	case <-t.C:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// watchConn closes conn when the server shuts down, ending the relay
+// loop reading from it, and counts it until the returned release is
+// called. A non-nil closing runs first, to tell the peer why.
+func (s *Server) watchConn(conn io.Closer, closing func()) (release func()) {
+	s.relays.Add(1)
+	stop := context.AfterFunc(s.ctx, func() {
+		if closing != nil {
+			closing()
+		}
+		_ = conn.Close()
+	})
+	return func() {
+		stop()
+		s.relays.Done()
+	}
+}
+
+// drain waits up to timeout for agent and viewer connections to finish
+// closing after shutdown.
+func (s *Server) drain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.relays.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Shutdown: connections still open after %s", timeout)
 	}
 }
 
 // newLiveAgent creates a LiveAgent from an enrollment record and registration data.
-func newLiveAgent(enrolled *store.AgentRecord, reg *protocol.Registration, remoteAddr string, displayCount int, conn net.Conn) *LiveAgent {
-	return &LiveAgent{
-		ID:            enrolled.ID,
-		Name:          reg.Name,
-		Hostname:      reg.Hostname,
-		OS:            reg.OS,
-		OSVersion:     reg.OSVersion,
-		Arch:          reg.Arch,
-		IP:            remoteAddr,
-		Status:        "online",
-		LastSeen:      time.Now(),
-		CPUCount:      reg.CPUCount,
-		MemoryTotal:   reg.MemoryTotal,
-		MemoryFree:    reg.MemoryFree,
-		DiskTotal:     reg.DiskTotal,
-		DiskFree:      reg.DiskFree,
-		Displays:      reg.Displays,
-		DisplayCount:  displayCount,
-		LocalIPs:      reg.LocalIPs,
-		Username:      reg.Username,
-		UptimeSeconds: reg.UptimeSeconds,
-		AgentVersion:  reg.AgentVersion,
-		EnrolledAt:    enrolled.EnrolledAt,
-		conn:          conn,
+func newLiveAgent(enrolled *store.AgentRecord, reg *protocol.Registration, remoteAddr string, displayCount int, conn protocol.Conn) *LiveAgent {
+	a := &LiveAgent{
+		ID:                enrolled.ID,
+		Name:              reg.Name,
+		Hostname:          reg.Hostname,
+		OS:                reg.OS,
+		OSVersion:         reg.OSVersion,
+		Arch:              reg.Arch,
+		IP:                remoteAddr,
+		Status:            agentOnline,
+		LastSeen:          time.Now(),
+		CPUCount:          reg.CPUCount,
+		MemoryTotal:       reg.MemoryTotal,
+		MemoryFree:        reg.MemoryFree,
+		DiskTotal:         reg.DiskTotal,
+		DiskFree:          reg.DiskFree,
+		Displays:          reg.Displays,
+		DisplayCount:      displayCount,
+		LocalIPs:          reg.LocalIPs,
+		Username:          reg.Username,
+		UptimeSeconds:     reg.UptimeSeconds,
+		AgentVersion:      reg.AgentVersion,
+		EnrolledAt:        enrolled.EnrolledAt,
+		Unattended:        enrolled.Unattended,
+		OrgID:             enrolled.OrgID,
+		Site:              enrolled.Site,
+		Image:             enrolled.Image,
+		ViewerPermissions: enrolled.ViewerPermissions,
+		Sensitive:         enrolled.Sensitive,
+		StartupItems:      reg.StartupItems,
+		Environment:       reg.Environment,
+		Permissions:       reg.Permissions,
+		Disabled:          reg.DisabledCapabilities,
+		inventoryAt:       time.Now(),
+		conn:              conn,
+	}
+	if reg.FlowControl {
+		a.fileCredit = protocol.NewCredit()
 	}
+	return a
 }
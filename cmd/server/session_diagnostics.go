@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+)
+
+// Session diagnostics ("why is it slow?"): GET
+// /api/agents/{id}/session/diagnostics combines the agent's view of its
+// capture run (capture, encode and send times, dropped frames, credit)
+// with the server's view of the relay to the viewer (write times,
+// bytes/sec), and names the likeliest bottleneck:
+//
+//   - "agent": capturing and encoding a frame takes longer than the frame
+//     interval, so the agent's CPU or the platform's capture sets the
+//     frame rate.
+//   - "viewer_network": writes to the viewer are slow; screen credit only
+//     returns once a frame is on its way to the viewer, so the agent
+//     drops frames waiting for it.
+//   - "agent_network": the agent's writes to the server are slow, or it
+//     runs out of credit while the server relays promptly.
+//   - "none": frames keep pace.
+
+// slowWriteMS is the average write time, in milliseconds, above which a
+// link counts as the bottleneck: a frame every 50 ms leaves no room for
+// writes near that.
+const slowWriteMS = 40
+
+// relayStats measures the relay of screen frames to one agent's viewer.
+type relayStats struct {
+	mu          sync.Mutex
+	since       time.Time
+	frames      int64
+	bytes       int64
+	writeMS     float64 // moving average
+	maxWriteMS  float64
+	rate        float64 // bytes/sec over the last full second
+	windowStart time.Time
+	windowBytes int64
+}
+
+// reset starts measuring a new session.
+func (r *relayStats) reset() {
+	now := time.Now()
+	r.mu.Lock()
+	r.since, r.windowStart = now, now
+	r.frames, r.bytes, r.windowBytes = 0, 0, 0
+	r.writeMS, r.maxWriteMS, r.rate = 0, 0, 0
+	r.mu.Unlock()
+}
+
+// relayed records one frame of size bytes written to the viewer in took.
+func (r *relayStats) relayed(size int, took time.Duration) {
+	now := time.Now()
+	writeMS := ms(took)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames++
+	r.bytes += int64(size)
+	r.writeMS = ewma(r.writeMS, writeMS)
+	r.maxWriteMS = max(r.maxWriteMS, writeMS)
+	r.windowBytes += int64(size)
+	if elapsed := now.Sub(r.windowStart); elapsed >= time.Second {
+		r.rate = float64(r.windowBytes) / elapsed.Seconds()
+		r.windowStart, r.windowBytes = now, 0
+	}
+}
+
+// relayDiagnostics is the server's half of a session diagnostics answer.
+type relayDiagnostics struct {
+	SessionSeconds int64   `json:"session_seconds"`
+	FramesRelayed  int64   `json:"frames_relayed"`
+	BytesRelayed   int64   `json:"bytes_relayed"`
+	BytesPerSec    int64   `json:"bytes_per_sec"` // over the last full second
+	AvgBytesPerSec int64   `json:"avg_bytes_per_sec"`
+	ViewerWriteMS  float64 `json:"viewer_write_ms"`
+	MaxWriteMS     float64 `json:"max_viewer_write_ms"`
+}
+
+func (r *relayStats) snapshot() relayDiagnostics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	elapsed := time.Since(r.since)
+	d := relayDiagnostics{
+		SessionSeconds: int64(elapsed.Seconds()),
+		FramesRelayed:  r.frames,
+		BytesRelayed:   r.bytes,
+		BytesPerSec:    int64(r.rate),
+		ViewerWriteMS:  round1(r.writeMS),
+		MaxWriteMS:     round1(r.maxWriteMS),
+	}
+	// A stalled relay has no recent full second; count the partial one.
+	if stalled := time.Since(r.windowStart); stalled > 2*time.Second {
+		d.BytesPerSec = int64(float64(r.windowBytes) / stalled.Seconds())
+	}
+	if elapsed > 0 {
+		d.AvgBytesPerSec = int64(float64(r.bytes) / elapsed.Seconds())
+	}
+	return d
+}
+
+// bottleneck names what limits the session's frame rate (see above).
+func bottleneck(agent protocol.SessionDiagnostics, relay relayDiagnostics) string {
+	switch {
+	case agent.CaptureMS+agent.EncodeMS > float64(agent.IntervalMS):
+		return "agent"
+	case relay.ViewerWriteMS > slowWriteMS:
+		return "viewer_network"
+	case agent.SendMS > slowWriteMS || agent.DroppedNoCredit*10 > agent.FramesSent:
+		return "agent_network"
+	}
+	return "none"
+}
+
+// handleSessionDiagnostics answers GET /api/agents/{id}/session/diagnostics
+// for the agent's active viewer session.
+func (s *Server) handleSessionDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	agent := s.liveAgentOr404(w, r)
+	if agent == nil {
+		return
+	}
+
+	req := protocol.SessionDiagnosticsRequest{ID: security.NewID()}
+	var res protocol.SessionDiagnostics
+	if !agent.callOrFail(r.Context(), w, "session_diagnostics_request", req.ID, req, &res) {
+		return
+	}
+	if !res.Active {
+		http.Error(w, `{"error":"no active viewer session"}`, http.StatusConflict)
+		return
+	}
+	relay := agent.relay.snapshot()
+
+	agent.mu.Lock()
+	cpu := agent.CPUPercent
+	agent.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{ //nolint:errcheck
+		"agent":      res,
+		"agent_cpu":  cpu,
+		"server":     relay,
+		"latency":    agent.latency.snapshot(),
+		"bottleneck": bottleneck(res, relay),
+	})
+}
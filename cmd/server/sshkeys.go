@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// SSH key distribution: a central inventory of public keys, each assigned
+// to local users on agents. The server pushes each user's keys into a
+// managed block of their authorized_keys file and compares the block with
+// the assignments to report drift: keys removed or added by hand, or
+// assignments not yet pushed to an agent that was offline.
+
+// SSH key audit actions and events.
+const (
+	auditSSHKeyCreated  = "ssh_key_created"
+	auditSSHKeyDeleted  = "ssh_key_deleted"
+	auditSSHKeysApplied = "ssh_keys_applied"
+	eventSSHDrift       = "ssh.drift"
+)
+
+// sshUsername matches the local account names keys can be assigned to.
+var sshUsername = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]{0,31}$`)
+
+// sshUserState compares one user's assigned keys with their
+// authorized_keys file. Missing lists fingerprints of assigned keys absent
+// from the managed block; Extra lists managed keys that are not assigned.
+type sshUserState struct {
+	User      string   `json:"user"`
+	Keys      []string `json:"keys"` // assigned key IDs
+	Managed   []string `json:"managed,omitempty"`
+	Unmanaged []string `json:"unmanaged,omitempty"`
+	Missing   []string `json:"missing,omitempty"`
+	Extra     []string `json:"extra,omitempty"`
+	InSync    bool     `json:"in_sync"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// handleSSHKeys lists (GET) or adds (POST {"name", "public_key"}) keys in
+// the inventory.
+func (s *Server) handleSSHKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := s.store.ListSSHKeys(r.Context())
+		if err != nil {
+			http.Error(w, `{"error":"failed to list keys"}`, http.StatusInternalServerError)
+			return
+		}
+		if keys == nil {
+			keys = []*store.SSHKey{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys) //nolint:errcheck
+
+	case http.MethodPost:
+		var req struct {
+			Name      string `json:"name"`
+			PublicKey string `json:"public_key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+			http.Error(w, `{"error":"name and public_key required"}`, http.StatusBadRequest)
+			return
+		}
+		typ, data, fingerprint, err := protocol.ParseSSHKey(req.PublicKey)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid public_key: " + err.Error()}) //nolint:errcheck
+			return
+		}
+		if strings.ContainsAny(req.PublicKey, "\r\n") {
+			http.Error(w, `{"error":"public_key must be a single line"}`, http.StatusBadRequest)
+			return
+		}
+		line := typ + " " + data
+		if fields := strings.Fields(req.PublicKey); len(fields) > 2 {
+			line += " " + strings.Join(fields[2:], " ")
+		}
+		apiKey := security.APIKeyFromContext(r.Context())
+		key := &store.SSHKey{
+			ID:          security.NewID(),
+			Name:        strings.TrimSpace(req.Name),
+			PublicKey:   line,
+			Fingerprint: fingerprint,
+			CreatedBy:   apiKey.Name,
+			CreatedAt:   time.Now(),
+		}
+		if err := s.store.CreateSSHKey(r.Context(), key); err != nil {
+			http.Error(w, `{"error":"failed to add key (already in the inventory?)"}`, http.StatusConflict)
+			return
+		}
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditSSHKeyCreated,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail:    fmt.Sprintf("key=%s name=%q fingerprint=%s", key.ID, key.Name, key.Fingerprint),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(key) //nolint:errcheck
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSSHKey returns (GET) or deletes (DELETE) an inventory key.
+// Deleting drops its assignments; agents keep the key until their users
+// are next synced.
+func (s *Server) handleSSHKey(w http.ResponseWriter, r *http.Request) {
+	key, err := s.store.GetSSHKey(r.Context(), r.PathValue("id"))
+	if err != nil || key == nil {
+		http.Error(w, `{"error":"key not found"}`, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(key) //nolint:errcheck
+
+	case http.MethodDelete:
+		if err := s.store.DeleteSSHKey(r.Context(), key.ID); err != nil {
+			http.Error(w, `{"error":"failed to delete key"}`, http.StatusInternalServerError)
+			return
+		}
+		apiKey := security.APIKeyFromContext(r.Context())
+		s.recordAudit(&store.AuditEvent{
+			Action:    auditSSHKeyDeleted,
+			ActorID:   apiKey.ID,
+			ActorName: apiKey.Name,
+			Detail:    fmt.Sprintf("key=%s name=%q fingerprint=%s", key.ID, key.Name, key.Fingerprint),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAgentSSH reports (GET) each assigned user's keys on the agent,
+// comparing them with the assignments when the agent is connected, or
+// pushes every assigned user's keys (POST, /sync).
+func (s *Server) handleAgentSSH(w http.ResponseWriter, r *http.Request) {
+	sync := strings.HasSuffix(r.URL.Path, "/sync")
+	if (sync && r.Method != http.MethodPost) || (!sync && r.Method != http.MethodGet) {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	agentID := r.PathValue("id")
+	users, keys, err := s.sshAssignments(r.Context(), agentID)
+	if err != nil {
+		http.Error(w, `{"error":"failed to list assignments"}`, http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.RLock()
+	agent := s.agents[agentID]
+	s.mu.RUnlock()
+	if agent == nil && sync {
+		http.Error(w, `{"error":"agent not connected"}`, http.StatusNotFound)
+		return
+	}
+
+	states := make([]*sshUserState, 0, len(users))
+	for _, user := range slices.Sorted(maps.Keys(users)) {
+		state := &sshUserState{User: user, Keys: users[user]}
+		if agent != nil {
+			op := protocol.SSHKeysList
+			if sync {
+				op = protocol.SSHKeysApply
+			}
+			s.sshCall(r.Context(), agent, op, state, keys)
+			if sync {
+				s.auditSSHApply(r, agentID, state, keys)
+			}
+		}
+		states = append(states, state)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{ //nolint:errcheck
+		"agent_id": agentID,
+		"online":   agent != nil,
+		"users":    states,
+	})
+}
+
+// handleAgentSSHUser replaces the keys assigned to one user on the agent
+// (PUT {"keys": [key IDs]}; an empty list removes them all) and pushes
+// them when the agent is connected.
+func (s *Server) handleAgentSSHUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	agentID, user := r.PathValue("id"), r.PathValue("user")
+	if !sshUsername.MatchString(user) {
+		http.Error(w, `{"error":"invalid user name"}`, http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	if rec, err := s.store.GetAgent(r.Context(), agentID); err != nil || rec == nil {
+		http.Error(w, `{"error":"agent not found"}`, http.StatusNotFound)
+		return
+	}
+	req.Keys = slices.Compact(slices.Sorted(slices.Values(req.Keys)))
+	if req.Keys == nil {
+		req.Keys = []string{}
+	}
+	keys := make(map[string]*store.SSHKey)
+	for _, id := range req.Keys {
+		key, err := s.store.GetSSHKey(r.Context(), id)
+		if err != nil || key == nil {
+			http.Error(w, `{"error":"unknown key ID"}`, http.StatusBadRequest)
+			return
+		}
+		keys[id] = key
+	}
+
+	apiKey := security.APIKeyFromContext(r.Context())
+	if err := s.store.SetSSHKeyAssignments(r.Context(), agentID, user, req.Keys, apiKey.Name); err != nil {
+		http.Error(w, `{"error":"failed to save assignments"}`, http.StatusInternalServerError)
+		return
+	}
+
+	state := &sshUserState{User: user, Keys: req.Keys}
+	s.mu.RLock()
+	agent := s.agents[agentID]
+	s.mu.RUnlock()
+	if agent != nil {
+		s.sshCall(r.Context(), agent, protocol.SSHKeysApply, state, keys)
+	}
+	s.auditSSHApply(r, agentID, state, keys)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{ //nolint:errcheck
+		"agent_id": agentID,
+		"online":   agent != nil,
+		"user":     state,
+	})
+}
+
+// sshAssignments returns the agent's assigned key IDs by user and the
+// inventory keys by ID.
+func (s *Server) sshAssignments(ctx context.Context, agentID string) (map[string][]string, map[string]*store.SSHKey, error) {
+	assignments, err := s.store.ListSSHKeyAssignments(ctx, agentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	inventory, err := s.store.ListSSHKeys(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := make(map[string]*store.SSHKey, len(inventory))
+	for _, k := range inventory {
+		keys[k.ID] = k
+	}
+	users := make(map[string][]string)
+	for _, a := range assignments {
+		users[a.Username] = append(users[a.Username], a.KeyID)
+	}
+	return users, keys, nil
+}
+
+// sshCall lists or applies state.User's keys on the agent and fills in
+// the comparison with the assignments.
+func (s *Server) sshCall(ctx context.Context, agent *LiveAgent, op string, state *sshUserState, keys map[string]*store.SSHKey) {
+	req := protocol.SSHKeysRequest{ID: security.NewID(), Op: op, User: state.User}
+	if op == protocol.SSHKeysApply {
+		req.Keys = []string{}
+		for _, id := range state.Keys {
+			req.Keys = append(req.Keys, keys[id].PublicKey)
+		}
+	}
+	var res protocol.SSHKeysResult
+	if err := agent.call(ctx, "ssh_keys_request", req.ID, req, &res); err != nil {
+		state.Error = err.Error()
+		return
+	}
+	if res.Error != "" {
+		state.Error = res.Error
+		return
+	}
+	state.Managed, state.Unmanaged = res.Managed, res.Unmanaged
+
+	// Keys are compared by "<type> <base64>", ignoring comments.
+	want := make(map[string]string) // to fingerprint
+	for _, id := range state.Keys {
+		typ, data, fingerprint, _ := protocol.ParseSSHKey(keys[id].PublicKey)
+		want[typ+" "+data] = fingerprint
+	}
+	present := make(map[string]bool)
+	for _, line := range res.Managed {
+		if typ, data, _, err := protocol.ParseSSHKey(line); err == nil {
+			if _, ok := want[typ+" "+data]; ok {
+				present[typ+" "+data] = true
+				continue
+			}
+		}
+		state.Extra = append(state.Extra, line)
+	}
+	for ident, fingerprint := range want {
+		if !present[ident] {
+			state.Missing = append(state.Missing, fingerprint)
+		}
+	}
+	slices.Sort(state.Missing)
+	state.InSync = len(state.Missing) == 0 && len(state.Extra) == 0
+}
+
+// auditSSHApply records an assignment change or push for one user.
+func (s *Server) auditSSHApply(r *http.Request, agentID string, state *sshUserState, keys map[string]*store.SSHKey) {
+	fingerprints := make([]string, 0, len(state.Keys))
+	for _, id := range state.Keys {
+		fingerprints = append(fingerprints, keys[id].Fingerprint)
+	}
+	detail := fmt.Sprintf("user=%q keys=%s", state.User, strings.Join(fingerprints, ","))
+	if state.Error != "" {
+		detail += fmt.Sprintf(" error=%q", state.Error)
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditSSHKeysApplied,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   agentID,
+		Detail:    detail,
+	})
+}
+
+// checkSSHDrift compares a newly connected agent's keys with its
+// assignments and publishes ssh.drift for each user out of sync.
+func (s *Server) checkSSHDrift(agent *LiveAgent) {
+	ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+	defer cancel()
+	users, keys, err := s.sshAssignments(ctx, agent.ID)
+	if err != nil || len(users) == 0 {
+		return
+	}
+	for _, user := range slices.Sorted(maps.Keys(users)) {
+		state := &sshUserState{User: user, Keys: users[user]}
+		s.sshCall(ctx, agent, protocol.SSHKeysList, state, keys)
+		if state.Error == "" && !state.InSync {
+			log.Printf("Agent %s: SSH keys for %s drifted (missing %d, extra %d)",
+				agent.Name, user, len(state.Missing), len(state.Extra))
+			s.publishEvent(eventSSHDrift, agent.ID, state)
+		}
+	}
+}
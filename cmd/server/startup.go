@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// liveAgentOr404 returns the connected agent named by the {id} path value
+// or writes a 404.
+func (s *Server) liveAgentOr404(w http.ResponseWriter, r *http.Request) *LiveAgent {
+	s.mu.RLock()
+	agent, ok := s.agents[r.PathValue("id")]
+	s.mu.RUnlock()
+	if !ok {
+		http.Error(w, `{"error":"agent not connected"}`, http.StatusNotFound)
+		return nil
+	}
+	return agent
+}
+
+// setInventory replaces the agent's cached startup inventory.
+func (a *LiveAgent) setInventory(items []protocol.StartupItem, env map[string]string) {
+	a.mu.Lock()
+	a.StartupItems, a.Environment, a.inventoryAt = items, env, time.Now()
+	a.mu.Unlock()
+}
+
+// applyInventory updates the agent's details from an inventory it sent
+// on its own ("inventory", the registration payload without the
+// credential), e.g. when asked through its local API. Displays are left
+// to "display_change".
+func (a *LiveAgent) applyInventory(reg *protocol.Registration) {
+	a.mu.Lock()
+	a.Hostname, a.OSVersion = reg.Hostname, reg.OSVersion
+	a.MemoryTotal, a.MemoryFree = reg.MemoryTotal, reg.MemoryFree
+	a.DiskTotal, a.DiskFree = reg.DiskTotal, reg.DiskFree
+	a.LocalIPs, a.Username = reg.LocalIPs, reg.Username
+	if reg.UptimeSeconds > 0 {
+		a.UptimeSeconds = reg.UptimeSeconds
+	}
+	if reg.Permissions != nil {
+		a.Permissions = reg.Permissions
+	}
+	a.StartupItems, a.Environment, a.inventoryAt = reg.StartupItems, reg.Environment, time.Now()
+	a.mu.Unlock()
+}
+
+// writeInventory responds with the agent's cached startup inventory.
+func (a *LiveAgent) writeInventory(w http.ResponseWriter) {
+	a.mu.Lock()
+	resp := map[string]interface{}{
+		"items":        a.StartupItems,
+		"environment":  a.Environment,
+		"collected_at": a.inventoryAt,
+	}
+	a.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp) //nolint:errcheck
+}
+
+// handleAgentStartup returns the autostart inventory and environment the
+// agent reported at registration. ?refresh=1 collects a fresh one.
+func (s *Server) handleAgentStartup(w http.ResponseWriter, r *http.Request) {
+	agent := s.liveAgentOr404(w, r)
+	if agent == nil {
+		return
+	}
+
+	if r.URL.Query().Get("refresh") == "1" {
+		req := protocol.StartupRequest{ID: security.NewID(), Op: protocol.StartupList}
+		var res protocol.StartupResult
+		if !agent.callOrFail(r.Context(), w, "startup_request", req.ID, req, &res) {
+			return
+		}
+		if res.Error != "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(map[string]string{"error": res.Error}) //nolint:errcheck
+			return
+		}
+		agent.setInventory(res.Items, res.Environment)
+	}
+	agent.writeInventory(w)
+}
+
+// handleDisableStartupItem disables one autostart entry on the agent and
+// returns the updated inventory.
+func (s *Server) handleDisableStartupItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	agent := s.liveAgentOr404(w, r)
+	if agent == nil {
+		return
+	}
+
+	itemID := r.PathValue("item")
+	var target protocol.StartupItem
+	agent.mu.Lock()
+	for _, item := range agent.StartupItems {
+		if item.ID == itemID {
+			target = item
+		}
+	}
+	agent.mu.Unlock()
+
+	req := protocol.StartupRequest{ID: security.NewID(), Op: protocol.StartupDisable, Item: itemID}
+	var res protocol.StartupResult
+	if !agent.callOrFail(r.Context(), w, "startup_request", req.ID, req, &res) {
+		return
+	}
+	if res.Error == "" || res.Items != nil { // a refused request carries no inventory
+		agent.setInventory(res.Items, res.Environment)
+	}
+
+	detail := fmt.Sprintf("item=%s kind=%s name=%q location=%q", itemID, target.Kind, target.Name, target.Location)
+	if res.Error != "" {
+		detail += fmt.Sprintf(" error=%q", res.Error)
+	}
+	apiKey := security.APIKeyFromContext(r.Context())
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditStartupDisabled,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   agent.ID,
+		Detail:    detail,
+	})
+	log.Printf("Agent %s: disable startup item %s: %s", agent.ID, itemID, res.Error)
+
+	if res.Error != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": res.Error}) //nolint:errcheck
+		return
+	}
+	agent.writeInventory(w)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// staticMaxAge is the Cache-Control lifetime for CSS/JS/image assets.
+// HTML is always revalidated so a new deploy is picked up immediately;
+// the ETag keeps revalidation cheap.
+const staticMaxAge = "public, max-age=3600"
+
+// compressibleExts lists file extensions worth gzipping on the fly.
+var compressibleExts = map[string]bool{
+	".html": true,
+	".css":  true,
+	".js":   true,
+	".json": true,
+	".svg":  true,
+	".txt":  true,
+}
+
+// staticHandler serves dashboard assets from an fs.FS with cache headers,
+// content-hash ETags, and gzip compression.
+type staticHandler struct {
+	fsys  fs.FS
+	files http.Handler
+
+	etagMu sync.Mutex
+	etags  map[string]etagEntry
+}
+
+// etagEntry is a cached ETag and the file version it was computed for.
+type etagEntry struct {
+	tag     string
+	size    int64
+	modTime time.Time
+}
+
+// newStaticHandler creates a handler serving the given filesystem.
+func newStaticHandler(fsys fs.FS) *staticHandler {
+	return &staticHandler{
+		fsys:  fsys,
+		files: http.FileServer(http.FS(fsys)),
+		etags: make(map[string]etagEntry),
+	}
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	if name == "" || strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+
+	ext := path.Ext(name)
+	if ext == ".html" {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", staticMaxAge)
+	}
+	etag := h.etag(name)
+
+	// Range requests are served uncompressed so byte offsets stay valid.
+	if !compressibleExts[ext] || r.Header.Get("Range") != "" {
+		setETag(w, etag)
+		h.files.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		setETag(w, etag)
+		h.files.ServeHTTP(w, r)
+		return
+	}
+
+	// The gzip body differs from the identity one, so it gets its own
+	// strong ETag.
+	if etag != "" {
+		etag = strings.TrimSuffix(etag, `"`) + `-gz"`
+	}
+	setETag(w, etag)
+	gz := &gzipResponseWriter{ResponseWriter: w}
+	defer gz.Close() //nolint:errcheck
+	h.files.ServeHTTP(gz, r)
+}
+
+// setETag sets the response's ETag, if there is one. http.FileServer
+// answers If-None-Match against it.
+func setETag(w http.ResponseWriter, etag string) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+}
+
+// etag returns a strong ETag derived from the file contents. Results are
+// cached against the file's size and modification time, so files edited
+// under -web get a new tag; a failed lookup (missing file, directory)
+// yields "".
+func (h *staticHandler) etag(name string) string {
+	info, err := fs.Stat(h.fsys, name)
+	if err != nil || info.IsDir() {
+		return ""
+	}
+
+	h.etagMu.Lock()
+	defer h.etagMu.Unlock()
+
+	if e, ok := h.etags[name]; ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+		return e.tag
+	}
+
+	data, err := fs.ReadFile(h.fsys, name)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	tag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	h.etags[name] = etagEntry{tag: tag, size: info.Size(), modTime: info.ModTime()}
+	return tag
+}
+
+// acceptsGzip reports whether the client advertised gzip support.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body of successful responses.
+// Non-200 responses (304 Not Modified, 404) are passed through untouched.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	if status == http.StatusOK {
+		g.Header().Del("Content-Length")
+		g.Header().Set("Content-Encoding", "gzip")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+// Close flushes any buffered compressed data.
+func (g *gzipResponseWriter) Close() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Public status pages: an organization can publish a read-only summary of
+// its agents' availability per site, either to anyone with the link or
+// only with a share token. The summary carries counts, never agent names
+// or addresses.
+
+// orgStatus is the body of GET /api/status/{org}.
+type orgStatus struct {
+	Org          string       `json:"org"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+	Agents       int          `json:"agents"`
+	Online       int          `json:"online"`
+	Availability float64      `json:"availability"` // percent online
+	Sites        []siteStatus `json:"sites"`
+}
+
+type siteStatus struct {
+	Site         string  `json:"site"` // empty for agents without a site
+	Agents       int     `json:"agents"`
+	Online       int     `json:"online"`
+	Availability float64 `json:"availability"`
+}
+
+// availability is online as a percentage of total, to one decimal place.
+func availability(online, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(online)*1000/float64(total)) / 10
+}
+
+// handleOrgStatusSettings sets an organization's status page mode (PUT
+// {"mode": "off"|"public"|"token"}). Token mode returns a new share token,
+// replacing any previous one; it is shown only once.
+func (s *Server) handleOrgStatusSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	org, err := s.store.GetOrg(r.Context(), r.PathValue("id"))
+	if err != nil || org == nil {
+		http.Error(w, `{"error":"organization not found"}`, http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	resp := map[string]string{"id": org.ID, "mode": req.Mode}
+	var mode, token, hash string
+	switch req.Mode {
+	case "off":
+	case store.StatusPublic:
+		mode = store.StatusPublic
+	case store.StatusToken:
+		mode = store.StatusToken
+		token, hash = security.GenerateShareToken()
+		resp["token"] = token
+	default:
+		http.Error(w, `{"error":"mode must be off, public or token"}`, http.StatusBadRequest)
+		return
+	}
+	if err := s.store.SetOrgStatus(r.Context(), org.ID, mode, hash); err != nil {
+		http.Error(w, `{"error":"failed to update organization"}`, http.StatusInternalServerError)
+		return
+	}
+	if mode != "" {
+		resp["url"] = "/status/" + org.ID
+		if token != "" {
+			resp["url"] += "#token=" + token
+		}
+	}
+
+	apiKey := security.APIKeyFromContext(r.Context())
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditOrgStatus,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		Detail:    "org=" + org.ID + " mode=" + req.Mode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp) //nolint:errcheck
+}
+
+// publishedOrg returns the organization named in the path if its status
+// page is published and the request carries any required share token
+// (?token=). Every failure looks the same, so the endpoint does not reveal
+// which organizations exist.
+func (s *Server) publishedOrg(w http.ResponseWriter, r *http.Request) *store.Organization {
+	org, err := s.store.GetOrg(r.Context(), r.PathValue("org"))
+	ok := err == nil && org != nil
+	if ok && org.StatusMode == store.StatusToken {
+		ok = org.StatusTokenHash != "" &&
+			security.TokensEqual(security.HashShareToken(r.URL.Query().Get("token")), org.StatusTokenHash)
+	} else if ok {
+		ok = org.StatusMode == store.StatusPublic
+	}
+	if !ok {
+		http.Error(w, `{"error":"status page not found"}`, http.StatusNotFound)
+		return nil
+	}
+	return org
+}
+
+// handlePublicStatus serves an organization's availability summary
+// without authentication (see publishedOrg).
+func (s *Server) handlePublicStatus(w http.ResponseWriter, r *http.Request) {
+	org := s.publishedOrg(w, r)
+	if org == nil {
+		return
+	}
+	agents, err := s.store.ListAgents(r.Context())
+	if err != nil {
+		http.Error(w, `{"error":"status unavailable"}`, http.StatusInternalServerError)
+		return
+	}
+
+	st := orgStatus{Org: org.Name, UpdatedAt: time.Now().UTC(), Sites: []siteStatus{}}
+	sites := make(map[string]*siteStatus)
+	s.mu.RLock()
+	for _, a := range agents {
+		if a.OrgID != org.ID {
+			continue
+		}
+		site := sites[a.Site]
+		if site == nil {
+			site = &siteStatus{Site: a.Site}
+			sites[a.Site] = site
+		}
+		site.Agents++
+		st.Agents++
+		if _, online := s.agents[a.ID]; online || (a.TelemetryOnly && s.telemetryOnline(a.ID)) {
+			site.Online++
+			st.Online++
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, site := range sites {
+		site.Availability = availability(site.Online, site.Agents)
+		st.Sites = append(st.Sites, *site)
+	}
+	sort.Slice(st.Sites, func(i, j int) bool {
+		a, b := st.Sites[i].Site, st.Sites[j].Site
+		if (a == "") != (b == "") {
+			return b == "" // agents without a site last
+		}
+		return a < b
+	})
+	st.Availability = availability(st.Online, st.Agents)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(st) //nolint:errcheck
+}
+
+// handleStatusPage serves the status page shell from the dashboard assets;
+// the page fetches /api/status/{org} itself.
+func (s *Server) handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.ServeFileFS(w, r, s.assets, "status.html")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Support requests ("raise hand"). An agent's local user asks for help
+// from the tray indicator, or with agent -raise-hand, which reaches the
+// server over the agent connection or, from the command line, over
+// /api/agent/support with the agent's credential. The request raises a
+// support_request alert (and tickets, through the PSA integrations) and
+// pre-authorizes the next attended session: the first viewer to connect
+// within raisedHandTTL skips the consent prompt, and resolves the alert.
+
+// raisedHandTTL is how long a support request pre-authorizes a session.
+const raisedHandTTL = time.Hour
+
+const (
+	auditSupportRequested = "support_requested"
+	eventSupportRequested = "agent.support_requested"
+)
+
+// raisedHand is an agent's pending support request.
+type raisedHand struct {
+	alert   *store.Alert
+	expires time.Time
+}
+
+// raiseHand records a support request from agentID's local user.
+func (s *Server) raiseHand(agentID, agentName string, req protocol.SupportRequest) {
+	req.Message = strings.TrimSpace(req.Message)
+	if len(req.Message) > protocol.MaxSupportMessage {
+		req.Message = strings.ToValidUTF8(req.Message[:protocol.MaxSupportMessage], "")
+	}
+	msg := "Support requested"
+	if req.User != "" {
+		msg += " by " + req.User
+	}
+	if req.Message != "" {
+		msg += ": " + req.Message
+	}
+	// A request replayed from the agent's backlog keeps the time it was
+	// made, so its pre-authorization may already have lapsed.
+	raised := time.Now()
+	if req.Time > 0 && time.UnixMilli(req.Time).Before(raised) {
+		raised = time.UnixMilli(req.Time)
+	}
+	alert := &store.Alert{
+		ID:       security.NewID(),
+		Type:     store.AlertSupportRequest,
+		AgentID:  agentID,
+		Message:  msg,
+		RaisedAt: raised,
+	}
+	if err := s.store.CreateAlert(s.ctx, alert); err != nil {
+		log.Printf("Support request from %s: %v", agentName, err)
+		return
+	}
+
+	s.handsMu.Lock()
+	prev := s.hands[agentID]
+	s.hands[agentID] = &raisedHand{alert: alert, expires: raised.Add(raisedHandTTL)}
+	s.handsMu.Unlock()
+	if prev != nil {
+		s.resolveAlert(prev.alert) // superseded by this request
+	}
+
+	detail := fmt.Sprintf("user=%q message=%q", req.User, req.Message)
+	if req.Time > 0 {
+		detail += " raised_at=" + raised.UTC().Format(time.RFC3339)
+	}
+	s.recordAudit(&store.AuditEvent{
+		Action:  auditSupportRequested,
+		AgentID: agentID,
+		Detail:  detail,
+	})
+	log.Printf("Support requested on %s", agentName)
+	s.publishEvent(eventSupportRequested, agentID, alert)
+	s.publishEvent(eventAlertRaised, agentID, alert)
+	go s.openTickets(alert, agentName)
+}
+
+// takeRaisedHand consumes agentID's pending support request, returning
+// nil if there is none or it has expired.
+func (s *Server) takeRaisedHand(agentID string) *raisedHand {
+	s.handsMu.Lock()
+	defer s.handsMu.Unlock()
+	h, ok := s.hands[agentID]
+	if !ok {
+		return nil
+	}
+	delete(s.hands, agentID)
+	if time.Now().After(h.expires) {
+		return nil
+	}
+	return h
+}
+
+// handleAgentSupport accepts a support request from the agent command
+// line (agent -raise-hand), authenticated with the agent's credential in
+// an "Authorization: Agent <credential>" header.
+func (s *Server) handleAgentSupport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	credential, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Agent ")
+	if !ok {
+		http.Error(w, `{"error":"agent credential required"}`, http.StatusUnauthorized)
+		return
+	}
+	if _, err := s.platform.VerifyCredential(credential); err != nil {
+		http.Error(w, `{"error":"invalid credential"}`, http.StatusUnauthorized)
+		return
+	}
+	rec, err := s.store.GetAgentByCredential(r.Context(), security.CredentialHash(credential))
+	if err != nil || rec == nil {
+		http.Error(w, `{"error":"agent not enrolled"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req protocol.SupportRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+	s.raiseHand(rec.ID, rec.Name, req)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "requested"}) //nolint:errcheck
+}
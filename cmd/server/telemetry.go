@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Telemetry-only agents: devices too small to run the agent publish
+// reports (protocol.TelemetryReport) to an MQTT or NATS broker the server
+// subscribes to, when "telemetry" is configured. A device publishes JSON
+// to <topic>/<device> over MQTT or <topic>.<device> over NATS, <device>
+// naming it uniquely, e.g. its serial number. Its first report carries an
+// enrollment code and a secret of its own; the server enrolls it as a
+// telemetry-only agent, with an ID derived from the device name, and
+// keeps a key derived from the secret (protocol.TelemetryKey). From then
+// on it accepts only reports in an envelope authenticated with that key
+// and sent within telemetryMaxSkew, each later than the last it accepted
+// since it started. A telemetry-only agent has no connection, so nothing
+// can be sent to it: it never appears in /api/agents, and /api/telemetry
+// lists the latest report of each. Reports are published as
+// agent.telemetry events, and their health figures are kept with other
+// agents' history. Anyone subscribed to the topic can read reports and
+// the enrollment report's secret, so the broker's ACLs must let only the
+// server subscribe.
+//
+// The broker clients (telemetry_mqtt.go, telemetry_nats.go) speak just
+// enough of each protocol to subscribe: MQTT 3.1.1 at QoS 0, and NATS
+// core. They reconnect with backoff.
+
+const (
+	telemetryMQTT = "mqtt"
+	telemetryNATS = "nats"
+
+	// telemetryMaxReport caps a report; larger messages are dropped.
+	telemetryMaxReport = 64 << 10
+	// telemetryTimeout bounds dialing a broker and its handshake.
+	telemetryTimeout = 10 * time.Second
+	// telemetrySecretMin is the shortest secret a device may choose.
+	telemetrySecretMin = 16
+	// telemetryMaxSkew bounds how far a report's time may be from the
+	// server's.
+	telemetryMaxSkew = 5 * time.Minute
+	// telemetryDeviceMax is the longest device name.
+	telemetryDeviceMax = 64
+
+	eventAgentTelemetry = "agent.telemetry"
+	auditTelemetryAgent = "telemetry_agent_enrolled"
+	agentOffline        = "offline"
+)
+
+// telemetryBroker is a subscription to the broker in the config.
+type telemetryBroker struct {
+	kind     string // telemetryMQTT or telemetryNATS
+	addr     string
+	username string
+	password string
+	topic    string
+	interval time.Duration
+	tls      *tls.Config // required for mqtts; offered to NATS servers that ask
+
+	mu     sync.Mutex
+	latest map[string]*telemetryState // by agent ID
+}
+
+// telemetryState is a telemetry-only agent's latest report.
+type telemetryState struct {
+	Device   string
+	Report   protocol.TelemetryReport
+	LastSeen time.Time
+	Sent     int64 // the report's envelope time; 0 for an enrollment report
+}
+
+// telemetryAgent is a telemetry-only agent as /api/telemetry lists it and
+// agent.telemetry events carry it.
+type telemetryAgent struct {
+	ID       string                    `json:"id"`
+	Device   string                    `json:"device,omitempty"`
+	Name     string                    `json:"name"`
+	Hostname string                    `json:"hostname,omitempty"`
+	OS       string                    `json:"os,omitempty"`
+	Arch     string                    `json:"arch,omitempty"`
+	OrgID    string                    `json:"org_id,omitempty"`
+	Site     string                    `json:"site,omitempty"`
+	Status   string                    `json:"status"`
+	LastSeen time.Time                 `json:"last_seen"`
+	Report   *protocol.TelemetryReport `json:"report,omitempty"`
+}
+
+// newTelemetryBroker parses cfg. The subscription starts with run.
+func newTelemetryBroker(cfg *TelemetryConfig) (*telemetryBroker, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("url must be mqtt://, mqtts:// or nats://[user:password@]host[:port]")
+	}
+	b := &telemetryBroker{
+		addr:     u.Host,
+		topic:    strings.TrimRight(cfg.Topic, "/."),
+		interval: cfg.interval(),
+		latest:   make(map[string]*telemetryState),
+	}
+	port := ""
+	switch u.Scheme {
+	case "mqtt":
+		b.kind, port = telemetryMQTT, "1883"
+	case "mqtts":
+		b.kind, port = telemetryMQTT, "8883"
+	case "nats":
+		b.kind, port = telemetryNATS, "4222"
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q (want mqtt, mqtts or nats)", u.Scheme)
+	}
+	if u.Port() == "" {
+		b.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.User != nil {
+		b.username = u.User.Username()
+		b.password, _ = u.User.Password()
+	}
+	if b.topic == "" {
+		b.topic = "rmm/telemetry"
+		if b.kind == telemetryNATS {
+			b.topic = "rmm.telemetry"
+		}
+	}
+	if u.Scheme == "mqtts" || b.kind == telemetryNATS {
+		b.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if cfg.CACert != "" {
+			pem, err := os.ReadFile(cfg.CACert)
+			if err != nil {
+				return nil, err
+			}
+			b.tls.RootCAs = x509.NewCertPool()
+			if !b.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", cfg.CACert)
+			}
+		}
+	}
+	return b, nil
+}
+
+// run subscribes until ctx is canceled, passing each report to handle
+// with the device name its topic gives, and reconnecting with backoff.
+func (b *telemetryBroker) run(ctx context.Context, handle func(device string, payload []byte)) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		started := time.Now()
+		var err error
+		if b.kind == telemetryMQTT {
+			err = b.mqttSession(ctx, handle)
+		} else {
+			err = b.natsSession(ctx, handle)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("Telemetry: %v (reconnecting in %s)", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// dial connects to the broker, over TLS when useTLS is set.
+func (b *telemetryBroker) dial(useTLS bool) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: telemetryTimeout}
+	if useTLS {
+		return tls.DialWithDialer(dialer, "tcp", b.addr, b.tls)
+	}
+	return dialer.Dial("tcp", b.addr)
+}
+
+// device returns the device a report published to topic came from, or ""
+// if topic is not one level under the configured topic. sep separates
+// levels.
+func (b *telemetryBroker) device(topic string, sep byte) string {
+	name, ok := strings.CutPrefix(topic, b.topic+string(sep))
+	if !ok || !validDevice(name) {
+		return ""
+	}
+	return name
+}
+
+// validDevice reports whether name is a usable device name: letters,
+// digits, '-', '_' and ':', at most telemetryDeviceMax of them.
+func validDevice(name string) bool {
+	if name == "" || len(name) > telemetryDeviceMax {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// telemetryAgentID derives a device's agent ID from its name, so the
+// device need not learn it.
+func telemetryAgentID(device string) string {
+	return security.HashAPIKey("telemetry:" + device)[:16]
+}
+
+// telemetryKey is the report key stored, hex encoded, as a device's
+// credential. Unlike an agent's credential hash it is what the device
+// authenticates with, so the database holds enough to forge the device's
+// reports, though nothing more.
+func telemetryKey(device, secret string) string {
+	return hex.EncodeToString(protocol.TelemetryKey(secret, device))
+}
+
+// verifyTelemetryEnvelope checks env's MAC under the hex key and that it
+// was sent within telemetryMaxSkew of now.
+func verifyTelemetryEnvelope(env *protocol.TelemetryEnvelope, key string, now time.Time) error {
+	k, err := hex.DecodeString(key)
+	if err != nil || len(k) != sha256.Size {
+		return errors.New("no report key on record")
+	}
+	if !security.TokensEqual(env.MAC, protocol.TelemetryMAC(k, env.Time, env.Report)) {
+		return errors.New("wrong MAC")
+	}
+	if d := now.Sub(time.Unix(env.Time, 0)); d > telemetryMaxSkew || d < -telemetryMaxSkew {
+		return fmt.Errorf("sent %s from the server's time", d.Round(time.Second))
+	}
+	return nil
+}
+
+// telemetryStatus is the status of a device that reports every interval
+// and has been silent for d, on the scale agents' heartbeats use.
+func telemetryStatus(d, interval time.Duration) string {
+	switch {
+	case d > 5*interval:
+		return agentOffline
+	case d > 3*interval:
+		return agentStale
+	case d > interval*3/2:
+		return agentIdle
+	}
+	return agentOnline
+}
+
+// handleTelemetryReport processes a report from device: an enrollment
+// report, which enrolls the device, or an envelope from an enrolled one.
+func (s *Server) handleTelemetryReport(device string, payload []byte) {
+	var env protocol.TelemetryEnvelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		s.debugf("Telemetry: %s: invalid report: %v", device, err)
+		return
+	}
+	ctx := s.ctx
+	now := time.Now()
+	agentID := telemetryAgentID(device)
+	rec, err := s.store.GetAgent(ctx, agentID)
+	if err != nil {
+		log.Printf("Telemetry: %s: %v", device, err)
+		return
+	}
+
+	var rep protocol.TelemetryReport
+	if env.MAC == "" {
+		if err := json.Unmarshal(payload, &rep); err != nil {
+			s.debugf("Telemetry: %s: invalid report: %v", device, err)
+			return
+		}
+		if rec != nil {
+			// An enrollment report sent again, possibly by someone who
+			// saw the first; enrolled devices send envelopes.
+			log.Printf("Telemetry: %s: report rejected: already enrolled", device)
+			return
+		}
+		if rep.Enroll == "" {
+			s.debugf("Telemetry: %s: not enrolled", device)
+			return
+		}
+		if len(rep.Secret) < telemetrySecretMin {
+			s.debugf("Telemetry: %s: enrollment without a valid secret", device)
+			return
+		}
+		if rec, err = s.enrollTelemetryAgent(ctx, device, agentID, &rep); err != nil {
+			log.Printf("Telemetry: %s: enrollment failed: %v", device, err)
+			return
+		}
+		env.Time = 0
+	} else {
+		if rec == nil {
+			s.debugf("Telemetry: %s: not enrolled", device)
+			return
+		}
+		if !rec.TelemetryOnly {
+			log.Printf("Telemetry: %s: report rejected: not a telemetry-only agent", device)
+			return
+		}
+		if err := verifyTelemetryEnvelope(&env, rec.CredentialHash, now); err != nil {
+			log.Printf("Telemetry: %s: report rejected: %v", device, err)
+			return
+		}
+		if err := json.Unmarshal(env.Report, &rep); err != nil {
+			s.debugf("Telemetry: %s: invalid report: %v", device, err)
+			return
+		}
+	}
+
+	rep.Secret, rep.Enroll = "", ""
+	b := s.telemetry
+	b.mu.Lock()
+	if prev := b.latest[agentID]; prev != nil && env.Time != 0 && env.Time <= prev.Sent {
+		b.mu.Unlock()
+		log.Printf("Telemetry: %s: report rejected: replayed or out of order", device)
+		return
+	}
+	b.latest[agentID] = &telemetryState{Device: device, Report: rep, LastSeen: now, Sent: env.Time}
+	b.mu.Unlock()
+	_ = s.store.UpdateAgentSeen(ctx, agentID, now)
+	if rep.Health != nil {
+		s.recordHealth(agentID, rep.Health)
+	}
+	s.publishEvent(eventAgentTelemetry, agentID, s.telemetryView(rec, now))
+}
+
+// enrollTelemetryAgent redeems rep's enrollment code for device, as
+// handleEnroll does for agents, and stores the device as a
+// telemetry-only agent.
+func (s *Server) enrollTelemetryAgent(ctx context.Context, device, agentID string, rep *protocol.TelemetryReport) (*store.AgentRecord, error) {
+	source := "telemetry/" + device
+	var pending *store.EnrollmentToken
+	outcome := enrollOutcomeInvalid
+	defer func() { s.recordEnrollment(pending, source, outcome) }()
+
+	reject := func(reason string) error {
+		s.recordAudit(&store.AuditEvent{
+			Action: auditEnrollmentRejected,
+			Detail: fmt.Sprintf("reason=%q hostname=%s device=%s", reason, rep.Hostname, device),
+		})
+		return errors.New(reason)
+	}
+	if err := s.verifyEnrollAttestation(rep.Enroll, nil); err != nil {
+		outcome = enrollOutcomeRejected
+		return nil, reject(err.Error())
+	}
+	codeHash := security.HashEnrollmentCode(rep.Enroll)
+	pending, _ = s.store.GetEnrollmentToken(ctx, codeHash)
+	if pending != nil {
+		outcome = enrollOutcomeRejected
+		if pending.Bound() {
+			if err := security.CheckBinding(pending, security.MachineIdentity{Hostname: rep.Hostname}); err != nil {
+				return nil, reject(err.Error())
+			}
+		}
+		if !s.enrollments.allow(pending.OrgID, s.config().Quotas.orgEnrollments(pending.OrgID)) {
+			return nil, reject("enrollment rate quota")
+		}
+	}
+	token, err := s.store.ConsumeEnrollmentToken(ctx, codeHash, agentID, rep.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, errors.New("invalid enrollment code")
+	}
+
+	name := rep.Name
+	if name == "" {
+		name = device
+	}
+	now := time.Now()
+	rec := &store.AgentRecord{
+		ID:             agentID,
+		Name:           name,
+		Hostname:       rep.Hostname,
+		OS:             rep.OS,
+		Arch:           rep.Arch,
+		CredentialHash: telemetryKey(device, rep.Secret),
+		EnrolledAt:     now,
+		LastSeen:       now,
+		OrgID:          token.OrgID,
+		Site:           token.Site,
+		Image:          token.Image,
+		TelemetryOnly:  true,
+	}
+	if err := s.store.CreateAgent(ctx, rec); err != nil {
+		return nil, err
+	}
+	outcome = enrollOutcomeEnrolled
+	if token.Type != store.TokenProvisioning {
+		s.forgetCode(token.ID)
+	}
+	log.Printf("Telemetry agent enrolled: %s (%s) via %s token", name, agentID, token.Type)
+	s.recordAudit(&store.AuditEvent{
+		Action:  auditTelemetryAgent,
+		AgentID: agentID,
+		Detail:  fmt.Sprintf("token=%s device=%s hostname=%s", token.ID, device, rep.Hostname),
+	})
+	return rec, nil
+}
+
+// telemetryView describes rec with its latest report as of now.
+func (s *Server) telemetryView(rec *store.AgentRecord, now time.Time) telemetryAgent {
+	v := telemetryAgent{
+		ID:       rec.ID,
+		Name:     rec.Name,
+		Hostname: rec.Hostname,
+		OS:       rec.OS,
+		Arch:     rec.Arch,
+		OrgID:    rec.OrgID,
+		Site:     rec.Site,
+		Status:   agentOffline,
+		LastSeen: rec.LastSeen,
+	}
+	b := s.telemetry
+	if b == nil {
+		return v
+	}
+	b.mu.Lock()
+	st := b.latest[rec.ID]
+	b.mu.Unlock()
+	if st != nil {
+		rep := st.Report
+		v.Device, v.Report, v.LastSeen = st.Device, &rep, st.LastSeen
+		v.Status = telemetryStatus(now.Sub(st.LastSeen), b.interval)
+	}
+	return v
+}
+
+// telemetryOnline reports whether a telemetry-only agent has reported
+// recently enough to count as online.
+func (s *Server) telemetryOnline(agentID string) bool {
+	b := s.telemetry
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.latest[agentID]
+	return st != nil && telemetryStatus(time.Since(st.LastSeen), b.interval) != agentOffline
+}
+
+// forgetTelemetry drops a deleted agent's latest report.
+func (s *Server) forgetTelemetry(agentID string) {
+	if b := s.telemetry; b != nil {
+		b.mu.Lock()
+		delete(b.latest, agentID)
+		b.mu.Unlock()
+	}
+}
+
+// handleListTelemetry lists the telemetry-only agents with their latest
+// reports.
+func (s *Server) handleListTelemetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	recs, err := s.store.ListAgents(r.Context())
+	if err != nil {
+		http.Error(w, `{"error":"failed to list agents"}`, http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	agents := []telemetryAgent{}
+	for _, rec := range recs {
+		if rec.TelemetryOnly {
+			agents = append(agents, s.telemetryView(rec, now))
+		}
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Name < agents[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(agents) //nolint:errcheck
+}
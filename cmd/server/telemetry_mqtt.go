@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// MQTT 3.1.1, as far as subscribing at QoS 0 needs: CONNECT, SUBSCRIBE,
+// PUBLISH received, and PINGREQ to keep the session alive.
+
+// MQTT packet types, in the high nibble of the first byte.
+const (
+	mqttConnect   = 1
+	mqttConnack   = 2
+	mqttPublish   = 3
+	mqttSubscribe = 8
+	mqttSuback    = 9
+	mqttPingreq   = 12
+)
+
+// mqttKeepAlive is the keep-alive the server asks for; it pings at half
+// of it, and gives up on a broker silent for one and a half.
+const mqttKeepAlive = 60 * time.Second
+
+// mqttSession connects, subscribes to one level under the topic and
+// passes reports to handle until the connection fails or ctx is
+// canceled.
+func (b *telemetryBroker) mqttSession(ctx context.Context, handle func(device string, payload []byte)) error {
+	conn, err := b.dial(b.tls != nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint:errcheck
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	r := bufio.NewReader(conn)
+
+	_ = conn.SetDeadline(time.Now().Add(telemetryTimeout))
+	if _, err := conn.Write(b.mqttConnectPacket()); err != nil {
+		return err
+	}
+	typ, body, err := readMQTTPacket(r)
+	if err != nil {
+		return err
+	}
+	if typ != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("unexpected packet %d instead of CONNACK", typ)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("broker refused the connection (return code %d)", body[1])
+	}
+
+	filter := b.topic + "/+"
+	sub := binary.BigEndian.AppendUint16(nil, 1) // packet identifier
+	sub = appendMQTTString(sub, filter)
+	sub = append(sub, 0) // QoS 0
+	if _, err := conn.Write(mqttPacket(mqttSubscribe<<4|0x02, sub)); err != nil {
+		return err
+	}
+	_ = conn.SetWriteDeadline(time.Time{})
+	log.Printf("Telemetry: subscribed to %s on mqtt://%s", filter, b.addr)
+
+	// After the handshake only the pinger writes.
+	pings := time.NewTicker(mqttKeepAlive / 2)
+	defer pings.Stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-pings.C:
+				_ = conn.SetWriteDeadline(time.Now().Add(telemetryTimeout))
+				if _, err := conn.Write([]byte{mqttPingreq << 4, 0}); err != nil {
+					_ = conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		typ, body, err := readMQTTPacket(r)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case mqttSuback:
+			if len(body) >= 3 && body[2] == 0x80 {
+				return fmt.Errorf("broker refused the subscription to %s", filter)
+			}
+		case mqttPublish:
+			topic, payload, err := parseMQTTPublish(body)
+			if err != nil {
+				return err
+			}
+			if device := b.device(topic, '/'); device != "" && payload != nil {
+				handle(device, payload)
+			}
+		}
+	}
+}
+
+// mqttConnectPacket is a clean-session CONNECT with a random client ID,
+// so servers sharing a broker do not take over each other's sessions.
+func (b *telemetryBroker) mqttConnectPacket() []byte {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	var flags byte = 0x02 // clean session
+	if b.username != "" {
+		flags |= 0x80
+		if b.password != "" {
+			flags |= 0x40
+		}
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags) // protocol level 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = appendMQTTString(body, "rmm-server-"+hex.EncodeToString(id))
+	if b.username != "" {
+		body = appendMQTTString(body, b.username)
+		if b.password != "" {
+			body = appendMQTTString(body, b.password)
+		}
+	}
+	return mqttPacket(mqttConnect<<4, body)
+}
+
+// mqttPacket frames body with the fixed header.
+func mqttPacket(first byte, body []byte) []byte {
+	p := []byte{first}
+	n := len(body)
+	for {
+		c := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			c |= 0x80
+		}
+		p = append(p, c)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+// appendMQTTString appends s with its 16-bit length.
+func appendMQTTString(dst []byte, s string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(s)))
+	return append(dst, s...)
+}
+
+// readMQTTPacket reads one packet, returning its type and body. A packet
+// too large to be a report is skipped and returned with a nil body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	typ := first >> 4
+	if n > telemetryMaxReport+1024 {
+		if _, err := r.Discard(n); err != nil {
+			return 0, nil, err
+		}
+		return typ, nil, nil
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	if typ == mqttPublish {
+		// Keep the QoS flags for parseMQTTPublish.
+		body = append([]byte{first & 0x0f}, body...)
+	}
+	return typ, body, nil
+}
+
+// parseMQTTPublish splits a PUBLISH body, as readMQTTPacket returns it,
+// into its topic and payload. A dropped oversized message has no topic.
+func parseMQTTPublish(body []byte) (string, []byte, error) {
+	if body == nil {
+		return "", nil, nil
+	}
+	flags, body := body[0], body[1:]
+	if len(body) < 2 {
+		return "", nil, errors.New("malformed PUBLISH")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return "", nil, errors.New("malformed PUBLISH")
+	}
+	topic, rest := string(body[2:2+n]), body[2+n:]
+	if flags&0x06 != 0 {
+		// QoS 1 or 2 despite the QoS 0 subscription; skip the packet ID.
+		if len(rest) < 2 {
+			return "", nil, errors.New("malformed PUBLISH")
+		}
+		rest = rest[2:]
+	}
+	return topic, rest, nil
+}
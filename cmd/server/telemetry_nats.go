@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NATS core, as far as subscribing needs: INFO, CONNECT, SUB, MSG and
+// PING/PONG. The connection upgrades to TLS when the server's INFO asks
+// for it.
+
+// natsIdleTimeout gives up on a server silent for this long; NATS
+// servers ping their clients every two minutes.
+const natsIdleTimeout = 5 * time.Minute
+
+// natsInfo is the part of the server's INFO the subscriber reads.
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// natsSession connects, subscribes to one token under the topic and
+// passes reports to handle until the connection fails or ctx is
+// canceled.
+func (b *telemetryBroker) natsSession(ctx context.Context, handle func(device string, payload []byte)) error {
+	conn, err := b.dial(false)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer func() {
+		stop()
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(telemetryTimeout))
+	r := bufio.NewReader(conn)
+
+	line, err := readNATSLine(r)
+	if err != nil {
+		return err
+	}
+	rest, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		return fmt.Errorf("unexpected %q instead of INFO", line)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(rest), &info); err != nil {
+		return fmt.Errorf("INFO: %w", err)
+	}
+	if info.TLSRequired {
+		tc := tls.Client(conn, b.tls)
+		if err := tc.Handshake(); err != nil {
+			return err
+		}
+		conn = tc
+		r = bufio.NewReader(conn)
+	}
+
+	opts := map[string]any{"verbose": false, "pedantic": false, "name": "rmm-server", "lang": "go", "version": "1", "protocol": 1}
+	if b.username != "" {
+		opts["user"], opts["pass"] = b.username, b.password
+	}
+	connect, _ := json.Marshal(opts)
+	subject := b.topic + ".*"
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nSUB %s 1\r\nPING\r\n", connect, subject); err != nil {
+		return err
+	}
+	subscribed := false
+
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			return err
+		}
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(args)
+			if len(fields) < 3 {
+				return fmt.Errorf("malformed %q", line)
+			}
+			n, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || n < 0 {
+				return fmt.Errorf("malformed %q", line)
+			}
+			if n > telemetryMaxReport {
+				if _, err := r.Discard(n + 2); err != nil {
+					return err
+				}
+				continue
+			}
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return err
+			}
+			if device := b.device(fields[0], '.'); device != "" {
+				handle(device, payload[:n])
+			}
+		case "PING":
+			_ = conn.SetWriteDeadline(time.Now().Add(telemetryTimeout))
+			if _, err := io.WriteString(conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case "PONG":
+			// The answer to the PING after CONNECT: the server accepted
+			// the connection and the subscription.
+			if !subscribed {
+				subscribed = true
+				_ = conn.SetWriteDeadline(time.Time{})
+				log.Printf("Telemetry: subscribed to %s on nats://%s", subject, b.addr)
+			}
+		case "-ERR":
+			return errors.New("server error: " + args)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(natsIdleTimeout))
+	}
+}
+
+// readNATSLine reads a protocol line without its CRLF.
+func readNATSLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) > telemetryMaxReport {
+		return "", errors.New("protocol line too long")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/internal/security"
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Viewer permissions: each viewer session gets a mask of what it may do
+// (see protocol.PermView), the intersection of what the API key's role
+// allows, what the ticket was narrowed to, the agent's viewer policy and
+// the capability classes the agent refuses. viewerInputLoop relays only
+// the messages the mask allows. REST routes that do the same outside a
+// session are held to the role's mask too (see requirePermission and
+// readOnlyForAuditors).
+
+const auditPermissionDenied = "viewer_permission_denied"
+
+// rolePermissions returns the viewer permissions an API key role grants.
+// Keys that predate roles are admin keys.
+func rolePermissions(role string) []string {
+	switch role {
+	case store.RoleAuditor:
+		return []string{protocol.PermView}
+	case store.RoleTechnician:
+		return []string{protocol.PermView, protocol.PermInput, protocol.PermFiles}
+	}
+	return protocol.AllPermissions
+}
+
+// validRole reports whether role names an API key role.
+func validRole(role string) bool {
+	switch role {
+	case store.RoleAdmin, store.RoleTechnician, store.RoleAuditor:
+		return true
+	}
+	return false
+}
+
+// parsePermissions checks a list of viewer permissions from a request,
+// returning it without duplicates in canonical order.
+func parsePermissions(perms []string) ([]string, bool) {
+	for _, p := range perms {
+		if !protocol.ValidPermission(p) {
+			return nil, false
+		}
+	}
+	return narrowPermissions(protocol.AllPermissions, perms), true
+}
+
+// narrowPermissions returns the permissions in perms that are also in
+// limit.
+func narrowPermissions(perms, limit []string) []string {
+	out := []string{}
+	for _, p := range perms {
+		if slices.Contains(limit, p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// capabilityPermissions maps the capability classes an agent refuses onto
+// the viewer permissions they rule out.
+var capabilityPermissions = map[string]string{
+	protocol.CapInput: protocol.PermInput,
+	protocol.CapFiles: protocol.PermFiles,
+	protocol.CapShell: protocol.PermTerminal,
+}
+
+// sessionPermissions returns the permission mask for a session on agent
+// by a ticket granting perms.
+func (a *LiveAgent) sessionPermissions(perms []string) []string {
+	a.mu.Lock()
+	policy, disabled := a.ViewerPermissions, a.Disabled
+	a.mu.Unlock()
+
+	if policy != nil {
+		perms = narrowPermissions(perms, policy)
+	}
+	for _, class := range disabled {
+		if p, ok := capabilityPermissions[class]; ok {
+			perms = slices.DeleteFunc(slices.Clone(perms), func(q string) bool { return q == p })
+		}
+	}
+	return perms
+}
+
+// permissionList formats a permission mask for audit details.
+func permissionList(perms []string) string {
+	if len(perms) == 0 {
+		return "none"
+	}
+	return strings.Join(perms, ",")
+}
+
+// requirePermission wraps a REST route that does what the viewer
+// permission perm allows, so keys whose role does not grant it are
+// refused.
+func (s *Server) requirePermission(perm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey := security.APIKeyFromContext(r.Context())
+		if !slices.Contains(rolePermissions(apiKey.Role), perm) {
+			s.denyRoute(w, r, apiKey, "permission="+perm)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// readOnlyForAuditors wraps a REST route that changes an agent (power,
+// actions, plugins, registry, hosts, software and the like), so auditor
+// keys can read it but nothing else.
+func (s *Server) readOnlyForAuditors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey := security.APIKeyFromContext(r.Context())
+		if apiKey.Role == store.RoleAuditor && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s.denyRoute(w, r, apiKey, "role=auditor")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// denyRoute audits and refuses a request the key's role does not allow.
+func (s *Server) denyRoute(w http.ResponseWriter, r *http.Request, apiKey *store.APIKey, reason string) {
+	s.recordAudit(&store.AuditEvent{
+		Action:    auditPermissionDenied,
+		ActorID:   apiKey.ID,
+		ActorName: apiKey.Name,
+		AgentID:   r.PathValue("id"),
+		Detail:    reason + " route=" + r.Method + " " + r.URL.Path,
+	})
+	http.Error(w, `{"error":"this key's role does not allow that"}`, http.StatusForbidden)
+}
@@ -1,15 +1,52 @@
 package main
 
 import (
-	"crypto/sha1"
-	"encoding/base64"
 	"fmt"
-	"net"
 	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/protocol"
 )
 
-// upgradeWebSocket performs the HTTP to WebSocket handshake per RFC 6455.
-func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+// WebSocket backends: "websocket" in the config picks the implementation
+// agent, viewer and gateway connections are upgraded with. "native", the
+// default, is this repository's own RFC 6455 framing (internal/protocol),
+// with no dependencies. A build with -tags gorilla adds "gorilla",
+// github.com/gorilla/websocket, for deployments that would rather run a
+// widely used library than a small one (websocket_gorilla.go). Either way
+// the rest of the server sees a protocol.Conn. A config reload applies
+// the choice to new connections.
+
+// backendNative is the default WebSocket backend.
+const backendNative = "native"
+
+// webSocketBackends upgrade a request to a WebSocket connection, by name.
+var webSocketBackends = map[string]func(http.ResponseWriter, *http.Request) (protocol.Conn, error){
+	backendNative: upgradeNative,
+}
+
+// webSocketBackendNames lists the backends built in, for error messages.
+func webSocketBackendNames() string {
+	names := make([]string, 0, len(webSocketBackends))
+	for name := range webSocketBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// upgradeWebSocket upgrades r with the configured backend, or opens an
+// HTTP/2 stream for it (http2.go).
+func (s *Server) upgradeWebSocket(w http.ResponseWriter, r *http.Request) (protocol.Conn, error) {
+	if isExtendedConnect(r) {
+		return upgradeStream(w, r)
+	}
+	return webSocketBackends[s.config().webSocket()](w, r)
+}
+
+// upgradeNative performs the HTTP to WebSocket handshake per RFC 6455.
+func upgradeNative(w http.ResponseWriter, r *http.Request) (protocol.Conn, error) {
 	if r.Header.Get("Upgrade") != "websocket" {
 		return nil, fmt.Errorf("not a websocket request")
 	}
@@ -19,16 +56,12 @@ func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error)
 		return nil, fmt.Errorf("missing Sec-WebSocket-Key")
 	}
 
-	h := sha1.New()
-	h.Write([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
-	acceptKey := base64.StdEncoding.EncodeToString(h.Sum(nil))
-
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		return nil, fmt.Errorf("hijacking not supported")
 	}
 
-	conn, _, err := hj.Hijack()
+	conn, rw, err := hj.Hijack()
 	if err != nil {
 		return nil, err
 	}
@@ -36,12 +69,13 @@ func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error)
 	response := "HTTP/1.1 101 Switching Protocols\r\n" +
 		"Upgrade: websocket\r\n" +
 		"Connection: Upgrade\r\n" +
-		"Sec-WebSocket-Accept: " + acceptKey + "\r\n\r\n"
+		"Sec-WebSocket-Accept: " + protocol.AcceptKey(key) + "\r\n\r\n"
 
 	if _, err := conn.Write([]byte(response)); err != nil {
 		_ = conn.Close()
 		return nil, err
 	}
 
-	return conn, nil
+	// rw's reader holds anything the client sent after its request.
+	return protocol.NewConn(conn, rw.Reader, true), nil
 }
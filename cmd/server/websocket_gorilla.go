@@ -0,0 +1,132 @@
+//go:build gorilla
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+)
+
+// The gorilla WebSocket backend, built with -tags gorilla and chosen
+// with "websocket": "gorilla". gorilla/websocket answers pings itself and
+// hides control frames from its readers; the server uses pings and pongs
+// to measure latency, so this backend forwards them instead, in order
+// with the messages around them.
+
+const backendGorilla = "gorilla"
+
+// controlWriteTimeout bounds a control frame write.
+const controlWriteTimeout = 5 * time.Second
+
+func init() {
+	webSocketBackends[backendGorilla] = upgradeGorilla
+}
+
+var gorillaUpgrader = websocket.Upgrader{
+	// Tickets and credentials, not origins, admit connections; viewer
+	// tokens bound to an origin are checked by handleViewer.
+	CheckOrigin: func(*http.Request) bool { return true },
+	// Handlers answer failed upgrades themselves, as with the native
+	// backend.
+	Error: func(http.ResponseWriter, *http.Request, int, error) {},
+}
+
+// gorillaFrame is a frame passed from the reading goroutine.
+type gorillaFrame struct {
+	opcode  byte
+	payload []byte
+	err     error
+}
+
+// gorillaConn is a protocol.Conn over a gorilla/websocket connection.
+type gorillaConn struct {
+	ws      *websocket.Conn
+	frames  chan gorillaFrame
+	done    chan struct{}
+	once    sync.Once
+	writeMu sync.Mutex // gorilla allows one concurrent writer of messages
+}
+
+// upgradeGorilla upgrades r with gorilla/websocket.
+func upgradeGorilla(w http.ResponseWriter, r *http.Request) (protocol.Conn, error) {
+	ws, err := gorillaUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	ws.SetReadLimit(protocol.MaxFrameSize)
+	c := &gorillaConn{ws: ws, frames: make(chan gorillaFrame), done: make(chan struct{})}
+	ws.SetPingHandler(func(data string) error {
+		c.deliver(gorillaFrame{opcode: protocol.OpPing, payload: []byte(data)})
+		return nil
+	})
+	ws.SetPongHandler(func(data string) error {
+		c.deliver(gorillaFrame{opcode: protocol.OpPong, payload: []byte(data)})
+		return nil
+	})
+	go c.read()
+	return c, nil
+}
+
+// read passes messages, and the control frames handled while reading
+// them, to ReadFrame until the connection fails.
+func (c *gorillaConn) read() {
+	defer close(c.frames)
+	for {
+		mt, payload, err := c.ws.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				c.deliver(gorillaFrame{opcode: protocol.OpClose, payload: closePayload(uint16(ce.Code), ce.Text)})
+			}
+			c.deliver(gorillaFrame{err: err})
+			return
+		}
+		if !c.deliver(gorillaFrame{opcode: byte(mt), payload: payload}) {
+			return
+		}
+	}
+}
+
+// deliver hands f to ReadFrame, reporting false once the connection is
+// closed.
+func (c *gorillaConn) deliver(f gorillaFrame) bool {
+	select {
+	case c.frames <- f:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *gorillaConn) ReadFrame() (byte, []byte, error) {
+	f, ok := <-c.frames
+	if !ok {
+		return 0, nil, net.ErrClosed
+	}
+	return f.opcode, f.payload, f.err
+}
+
+func (c *gorillaConn) WriteFrame(opcode byte, payload []byte) error {
+	if opcode >= protocol.OpClose {
+		return c.ws.WriteControl(int(opcode), payload, time.Now().Add(controlWriteTimeout))
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.ws.WriteMessage(int(opcode), payload)
+}
+
+func (c *gorillaConn) SetReadDeadline(t time.Time) error { return c.ws.SetReadDeadline(t) }
+
+func (c *gorillaConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *gorillaConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.ws.Close()
+}
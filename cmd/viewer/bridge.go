@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/protocol"
+	"github.com/avaropoint/rmm/web"
+)
+
+// The window's page is the dashboard's embedded viewer (embed.html),
+// served from this binary's copy of the web assets on a loopback address.
+// Its WebSocket comes back here, and the bridge relays it, frame for
+// frame, to the server's /ws/viewer with a ticket of its own: the page is
+// admitted with a single-use local token instead, and no credential for
+// the server ever reaches it.
+
+// bridge serves the window's page and relays its session to the server.
+type bridge struct {
+	server *url.URL
+	agent  string
+	apiKey string
+	tls    *tls.Config
+	http   *http.Client
+
+	host  string // the loopback listener's host:port
+	token string // admits the page's WebSocket once
+
+	mu   sync.Mutex
+	used bool
+
+	done     chan struct{} // closed when the session ends
+	doneOnce sync.Once
+}
+
+// checkAgent confirms the API key works and the agent exists.
+func (b *bridge) checkAgent() error {
+	var agents []struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Online bool   `json:"online"`
+	}
+	if err := b.api(http.MethodGet, "/api/agents", nil, &agents); err != nil {
+		return err
+	}
+	for _, a := range agents {
+		if a.ID == b.agent {
+			log.Printf("Connecting to %s", a.Name)
+			return nil
+		}
+	}
+	return fmt.Errorf("agent %s not found", b.agent)
+}
+
+// start listens on addr, which must be a loopback address, and returns
+// the page's URL.
+func (b *bridge) start(addr string) (string, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := ln.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		_ = ln.Close()
+		return "", fmt.Errorf("-listen %s is not a loopback address", addr)
+	}
+	b.host = ln.Addr().String()
+	b.token = rand.Text()
+	b.done = make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/embed", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFileFS(w, r, web.Assets, "embed.html")
+	})
+	mux.HandleFunc("/ws/viewer", b.handleViewer)
+	mux.Handle("/css/", http.FileServerFS(web.Assets))
+	mux.Handle("/js/", http.FileServerFS(web.Assets))
+
+	srv := &http.Server{Handler: b.loopbackOnly(mux), ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(ln) //nolint:errcheck
+
+	q := url.Values{"agent": {b.agent}, "ticket": {b.token}, "desktop": {"1"}}
+	return "http://" + b.host + "/embed?" + q.Encode(), nil
+}
+
+// loopbackOnly refuses requests for any host but the listener's, so a web
+// page cannot reach the bridge through a rebound DNS name.
+func (b *bridge) loopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != b.host {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Frame-Options", "DENY")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleViewer admits the page's WebSocket with the local token and
+// relays it to the server until either side closes.
+func (b *bridge) handleViewer(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	ok := !b.used && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("ticket")), []byte(b.token)) == 1
+	if ok {
+		b.used = true
+	}
+	b.mu.Unlock()
+	if !ok {
+		http.Error(w, "invalid or used ticket", http.StatusUnauthorized)
+		return
+	}
+	defer b.finish()
+
+	remote, remoteReader, err := b.dialViewer()
+	if err != nil {
+		log.Printf("viewer: %v", err)
+		http.Error(w, "could not connect to the server", http.StatusBadGateway)
+		return
+	}
+	defer remote.Close() //nolint:errcheck
+
+	local, localReader, err := acceptWebSocket(w, r)
+	if err != nil {
+		log.Printf("viewer: %v", err)
+		return
+	}
+	defer local.Close() //nolint:errcheck
+
+	// Relay until either side closes; closing both ends the other copy.
+	go func() {
+		for {
+			op, payload, err := protocol.ReadFrame(localReader)
+			if err != nil || protocol.WriteClientFrame(remote, op, payload) != nil || op == protocol.OpClose {
+				_ = remote.Close()
+				_ = local.Close()
+				return
+			}
+		}
+	}()
+	for {
+		op, payload, err := protocol.ReadFrame(remoteReader)
+		if err != nil || protocol.WriteServerFrame(local, op, payload) != nil || op == protocol.OpClose {
+			return
+		}
+	}
+}
+
+// finish marks the session over.
+func (b *bridge) finish() {
+	b.doneOnce.Do(func() { close(b.done) })
+}
+
+// dialViewer takes a viewer ticket and opens the session's WebSocket to
+// the server.
+func (b *bridge) dialViewer() (net.Conn, *bufio.Reader, error) {
+	var ticket struct {
+		Ticket string `json:"ticket"`
+	}
+	if err := b.api(http.MethodPost, "/api/viewer/ticket", map[string]string{"agent": b.agent}, &ticket); err != nil {
+		return nil, nil, err
+	}
+
+	host, port := b.server.Hostname(), b.server.Port()
+	if port == "" {
+		port = "80"
+		if b.server.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+	dialer := &net.Dialer{Timeout: 15 * time.Second}
+	var conn net.Conn
+	var err error
+	if b.server.Scheme == "https" {
+		cfg := b.tls.Clone()
+		cfg.ServerName = host
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, cfg)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	q := url.Values{"agent": {b.agent}, "ticket": {ticket.Ticket}}
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	request := fmt.Sprintf("GET %s/ws/viewer?%s HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n",
+		b.server.Path, q.Encode(), b.server.Host, base64.StdEncoding.EncodeToString(key))
+	if _, err := io.WriteString(conn, request); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("server refused the session: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return conn, reader, nil
+}
+
+// acceptWebSocket completes the page's WebSocket handshake.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, *bufio.Reader, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "websocket required", http.StatusBadRequest)
+		return nil, nil, fmt.Errorf("not a websocket request")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijacking not supported")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + protocol.AcceptKey(key) + "\r\n\r\n"
+	if _, err := io.WriteString(conn, response); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw.Reader, nil
+}
+
+// api makes an authenticated request to the server's REST API, decoding
+// the JSON reply into out.
+func (b *bridge) api(method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, b.server.String()+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(data))
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,126 @@
+// Command viewer is the technician's desktop client: it opens a remote
+// session to one agent in a window of its own, outside the dashboard.
+//
+// It connects as an ordinary viewer over the same protocol, authenticated
+// with the technician's API key, which stays in this process and never
+// reaches a browser. The session is drawn by the dashboard's own viewer
+// page, served from this binary on a loopback address and shown in a
+// Chromium-family browser (Chrome, Edge, Chromium) in app mode: a plain
+// window with its own profile, closed when the session ends. Started
+// fullscreen, the window holds the keyboard (the Keyboard Lock API), so
+// Alt+Tab, the Windows key, Escape and other system shortcuts reach the
+// remote computer instead of the technician's.
+//
+// Usage:
+//
+//	RMM_API_KEY=rmm_… viewer -server https://rmm.example.com -agent <id> [-fullscreen]
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	serverURL := flag.String("server", "", "Server URL, such as https://rmm.example.com")
+	agentID := flag.String("agent", "", "ID of the agent to connect to")
+	apiKey := flag.String("key", "", "API key (default $RMM_API_KEY; the environment keeps it out of the process list)")
+	caFile := flag.String("ca", "", "PEM file of the CA that issued the server's certificate, for a self-signed server")
+	insecure := flag.Bool("insecure", false, "Skip verification of the server's certificate (development only)")
+	fullscreen := flag.Bool("fullscreen", false, "Open fullscreen, holding system shortcuts for the remote computer")
+	browser := flag.String("browser", "", "Chromium-family browser to draw the window with (default: the first found)")
+	listen := flag.String("listen", "127.0.0.1:0", "Loopback address for the window's page")
+	flag.Parse()
+
+	if *apiKey == "" {
+		*apiKey = os.Getenv("RMM_API_KEY")
+	}
+	if *serverURL == "" || *agentID == "" || *apiKey == "" {
+		fmt.Fprintln(os.Stderr, "viewer: -server, -agent and an API key (-key or $RMM_API_KEY) are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(*serverURL, "/"))
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		log.Fatalf("viewer: -server must be an http:// or https:// URL")
+	}
+	tlsConfig, err := clientTLS(*caFile, *insecure)
+	if err != nil {
+		log.Fatalf("viewer: %v", err)
+	}
+
+	b := &bridge{
+		server: u,
+		agent:  *agentID,
+		apiKey: *apiKey,
+		tls:    tlsConfig,
+		http: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   30 * time.Second,
+		},
+	}
+	if err := b.checkAgent(); err != nil {
+		log.Fatalf("viewer: %v", err)
+	}
+	pageURL, err := b.start(*listen)
+	if err != nil {
+		log.Fatalf("viewer: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	window, err := openWindow(ctx, *browser, pageURL, *fullscreen)
+	if err != nil {
+		// Without a browser to drive, the page still works in any browser
+		// on this computer.
+		log.Printf("viewer: %v", err)
+		fmt.Printf("Open this address in a browser on this computer (once):\n\n  %s\n\n", pageURL)
+		select {
+		case <-ctx.Done():
+		case <-b.done:
+		}
+		return
+	}
+
+	// The window stays open after the session ends, to show why.
+	select {
+	case <-ctx.Done():
+	case <-window.exited:
+	}
+	stop() // closes the window if it is still open
+	window.cleanup()
+}
+
+// clientTLS returns the TLS settings for connections to the server.
+func clientTLS(caFile string, insecure bool) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if insecure {
+		cfg.InsecureSkipVerify = true //nolint:gosec // -insecure, for development
+		return cfg, nil
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// appWindow is the browser process drawing the session window.
+type appWindow struct {
+	exited  chan struct{} // closed when the window is closed
+	profile string
+}
+
+// browserCandidates are the Chromium-family browsers looked for, in order.
+func browserCandidates() []string {
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{
+			"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+			"/Applications/Microsoft Edge.app/Contents/MacOS/Microsoft Edge",
+			"/Applications/Chromium.app/Contents/MacOS/Chromium",
+		}
+	case "windows":
+		var paths []string
+		for _, dir := range []string{os.Getenv("ProgramFiles(x86)"), os.Getenv("ProgramFiles"), os.Getenv("LocalAppData")} {
+			if dir != "" {
+				paths = append(paths,
+					filepath.Join(dir, `Microsoft\Edge\Application\msedge.exe`),
+					filepath.Join(dir, `Google\Chrome\Application\chrome.exe`))
+			}
+		}
+		return paths
+	default:
+		return []string{"google-chrome", "google-chrome-stable", "chromium", "chromium-browser", "microsoft-edge"}
+	}
+}
+
+// findBrowser returns the first browser found, or browser if given.
+func findBrowser(browser string) (string, error) {
+	candidates := browserCandidates()
+	if browser != "" {
+		candidates = []string{browser}
+	}
+	for _, c := range candidates {
+		if path, err := exec.LookPath(c); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no Chromium-family browser found (Chrome, Edge or Chromium; see -browser)")
+}
+
+// openWindow opens url in an app-mode window with a throwaway profile,
+// so the window is a process of its own that exits when it is closed.
+func openWindow(ctx context.Context, browser, url string, fullscreen bool) (*appWindow, error) {
+	path, err := findBrowser(browser)
+	if err != nil {
+		return nil, err
+	}
+	profile, err := os.MkdirTemp("", "rmm-viewer-")
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"--app=" + url,
+		"--user-data-dir=" + profile,
+		"--no-first-run",
+		"--no-default-browser-check",
+	}
+	if fullscreen {
+		args = append(args, "--start-fullscreen")
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	if err := cmd.Start(); err != nil {
+		_ = os.RemoveAll(profile)
+		return nil, err
+	}
+	w := &appWindow{exited: make(chan struct{}), profile: profile}
+	go func() {
+		_ = cmd.Wait()
+		close(w.exited)
+	}()
+	return w, nil
+}
+
+// cleanup removes the window's profile once it has closed.
+func (w *appWindow) cleanup() {
+	<-w.exited
+	_ = os.RemoveAll(w.profile)
+}
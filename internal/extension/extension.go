@@ -0,0 +1,140 @@
+// Package extension is the server's compiled-in extension point. A fork
+// adds a feature without patching core handlers by implementing
+// Extension in a package of its own, registering it from an init
+// function, and importing that package for its side effects from a file
+// in cmd/server, optionally behind a build tag:
+//
+//	//go:build inventory
+//
+//	package main
+//
+//	import _ "github.com/avaropoint/rmm/internal/extension/inventory"
+//
+// Extensions are linked into the binary; nothing is loaded at run time.
+// At start the server applies each extension's migrations (Migrator),
+// calls Init, serves its routes (Router) and passes it events
+// (Listener), in the order of their names.
+package extension
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// Lifecycle events a Listener receives, among every event of the
+// dashboard event stream.
+const (
+	EventAgentOnline    = "agent.online"    // Data: the agent's presence
+	EventAgentOffline   = "agent.offline"   // Data: the agent's presence
+	EventSessionStarted = "session.started" // Data: *store.ViewerSession
+	EventSessionEnded   = "session.ended"   // Data: *store.ViewerSession
+)
+
+// Extension is a compiled-in server extension.
+type Extension interface {
+	// Name names the extension: lowercase letters, digits and '-'. Its
+	// routes are served under /api/ext/<name>/.
+	Name() string
+	// Init is called once at start, after the extension's migrations,
+	// with the server's services. An error stops the server.
+	Init(host Host) error
+}
+
+// Migrator is implemented by extensions with tables of their own. Each
+// statement is applied once, in order, before Init; append new ones
+// rather than changing applied ones.
+type Migrator interface {
+	Migrations() []string
+}
+
+// Router is implemented by extensions that serve API routes. Keys are
+// patterns relative to the extension's prefix, optionally with a method:
+// "GET items/{id}" is served as GET /api/ext/<name>/items/{id}. Routes
+// require an API key or a dashboard session, like the core API;
+// security.APIKeyFromContext gives the caller's key.
+type Router interface {
+	Routes() map[string]http.HandlerFunc
+}
+
+// Listener is implemented by extensions that react to events. OnEvent
+// is called from a goroutine of the extension's own, one event at a
+// time; an extension that falls behind misses events.
+type Listener interface {
+	OnEvent(ev Event)
+}
+
+// Event is an event from the dashboard event stream.
+type Event struct {
+	Type    string
+	Time    time.Time
+	AgentID string
+	Data    any
+}
+
+// Host is what the server offers an extension.
+type Host interface {
+	// Context is canceled when the server shuts down; background work
+	// should stop then.
+	Context() context.Context
+	// Store is the platform's store.
+	Store() store.Store
+	// DB is the database, for the extension's own tables.
+	DB() *sql.DB
+	// Publish publishes an event on the dashboard event stream.
+	Publish(typ, agentID string, data any)
+	// Audit records an audit event, which is also forwarded to SIEM
+	// destinations.
+	Audit(ev *store.AuditEvent)
+}
+
+var (
+	mu         sync.Mutex
+	extensions = map[string]Extension{}
+)
+
+// Register adds an extension. It panics if the name is invalid or
+// already registered, so a conflict shows at start.
+func Register(e Extension) {
+	mu.Lock()
+	defer mu.Unlock()
+	name := e.Name()
+	if !ValidName(name) {
+		panic(fmt.Sprintf("extension: invalid name %q", name))
+	}
+	if _, dup := extensions[name]; dup {
+		panic(fmt.Sprintf("extension: %q registered twice", name))
+	}
+	extensions[name] = e
+}
+
+// All returns the registered extensions by name.
+func All() []Extension {
+	mu.Lock()
+	defer mu.Unlock()
+	all := make([]Extension, 0, len(extensions))
+	for _, e := range extensions {
+		all = append(all, e)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name() < all[j].Name() })
+	return all
+}
+
+// ValidName reports whether name is usable as an extension name.
+func ValidName(name string) bool {
+	if name == "" || len(name) > 32 {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
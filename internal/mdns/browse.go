@@ -0,0 +1,99 @@
+package mdns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// Service is an instance of a service found on the local link.
+type Service struct {
+	Instance string   // "<name>._rmm._tcp.local."
+	Host     string   // "<hostname>.local."
+	Port     int      // from the SRV record
+	Text     []string // TXT record strings
+	// Addr is the address the answer came from, which is reachable from
+	// the browsing host whatever addresses the responder lists.
+	Addr net.IP
+}
+
+// Browse asks the local link for instances of service (e.g. "_rmm._tcp")
+// and collects answers until wait has passed or ctx is done. Instances
+// are returned in the order they first answered.
+func Browse(ctx context.Context, service string, wait time.Duration) ([]Service, error) {
+	service = canonical(strings.TrimSuffix(service, ".") + ".local")
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	// Sent from an ephemeral port, the query is a one-shot query, which
+	// responders answer by unicast (RFC 6762 section 5.1).
+	query := (&message{questions: []question{{name: service, qtype: typePTR}}}).encode()
+	if _, err := conn.WriteToUDP(query, group); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetReadDeadline(deadline)
+
+	var order []string
+	found := make(map[string]*Service)
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break // deadline
+		}
+		m, err := parse(buf[:n])
+		if err != nil || m.flags&flagResponse == 0 {
+			continue
+		}
+		for _, r := range m.records {
+			if r.rtype == typePTR && r.name == service && found[canonical(r.target)] == nil {
+				instance := canonical(r.target)
+				found[instance] = &Service{Instance: instance, Addr: src.IP}
+				order = append(order, instance)
+			}
+		}
+		for _, r := range m.records {
+			s := found[r.name]
+			if s == nil {
+				continue
+			}
+			switch r.rtype {
+			case typeSRV:
+				s.Host, s.Port = canonical(r.target), int(r.port)
+			case typeTXT:
+				s.Text = r.text
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	services := make([]Service, 0, len(order))
+	for _, instance := range order {
+		if s := found[instance]; s.Port != 0 {
+			services = append(services, *s)
+		}
+	}
+	return services, nil
+}
+
+// TextValue returns the value of key in TXT strings of the form
+// "key=value", or "".
+func TextValue(text []string, key string) string {
+	for _, t := range text {
+		if k, v, ok := strings.Cut(t, "="); ok && strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
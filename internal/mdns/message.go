@@ -0,0 +1,266 @@
+// Package mdns is a minimal multicast DNS (RFC 6762) responder and browser
+// for DNS-SD (RFC 6763) service discovery on the local link: just enough
+// for a server to advertise one service and for agents to find it, in
+// labs without a DNS server.
+//
+// Files in this package:
+//   - message.go   — DNS message encoding and decoding
+//   - responder.go — Advertising a service instance
+//   - browse.go    — Finding a service's instances
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Port is the mDNS port.
+const Port = 5353
+
+// Record types and classes.
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeTXT  = 16
+	typeAAAA = 28
+	typeSRV  = 33
+	typeANY  = 255
+
+	classIN = 1
+	// classFlag is the top bit of a class: cache-flush in records,
+	// unicast-response-wanted in questions.
+	classFlag = 0x8000
+
+	flagResponse      = 0x8000
+	flagAuthoritative = 0x0400
+)
+
+// group is the IPv4 mDNS multicast group.
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: Port}
+
+var errMalformed = errors.New("mdns: malformed message")
+
+type question struct {
+	name    string
+	qtype   uint16
+	unicast bool // QU: the asker wants a unicast response
+}
+
+type record struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+
+	target string   // PTR, SRV
+	port   uint16   // SRV
+	text   []string // TXT
+	ip     net.IP   // A, AAAA
+}
+
+type message struct {
+	id        uint16
+	flags     uint16
+	questions []question
+	records   []record // answers, authority and additional records alike
+}
+
+// canonical lowercases a name and makes it fully qualified, as names are
+// compared.
+func canonical(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// appendName encodes a name without compression. A label may contain any
+// byte but ".", which separates labels.
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readName decodes a possibly compressed name at off, returning it and
+// the offset past it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 32 {
+				return "", 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		case n&0xC0 != 0:
+			return "", 0, errMalformed
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// encode serializes m. Questions come first, then every record as an
+// answer.
+func (m *message) encode() []byte {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.id)
+	binary.BigEndian.PutUint16(b[2:], m.flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.records)))
+	for _, q := range m.questions {
+		b = appendName(b, q.name)
+		class := uint16(classIN)
+		if q.unicast {
+			class |= classFlag
+		}
+		b = binary.BigEndian.AppendUint16(b, q.qtype)
+		b = binary.BigEndian.AppendUint16(b, class)
+	}
+	for _, r := range m.records {
+		b = appendName(b, r.name)
+		class := uint16(classIN)
+		if r.rtype != typePTR {
+			class |= classFlag // unique records: flush stale cache entries
+		}
+		b = binary.BigEndian.AppendUint16(b, r.rtype)
+		b = binary.BigEndian.AppendUint16(b, class)
+		b = binary.BigEndian.AppendUint32(b, r.ttl)
+		var data []byte
+		switch r.rtype {
+		case typePTR:
+			data = appendName(nil, r.target)
+		case typeSRV:
+			data = binary.BigEndian.AppendUint16(data, 0) // priority
+			data = binary.BigEndian.AppendUint16(data, 0) // weight
+			data = binary.BigEndian.AppendUint16(data, r.port)
+			data = appendName(data, r.target)
+		case typeTXT:
+			for _, t := range r.text {
+				if len(t) > 255 {
+					t = t[:255]
+				}
+				data = append(data, byte(len(t)))
+				data = append(data, t...)
+			}
+			if len(data) == 0 {
+				data = []byte{0}
+			}
+		case typeA:
+			data = r.ip.To4()
+		case typeAAAA:
+			data = r.ip.To16()
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+		b = append(b, data...)
+	}
+	return b
+}
+
+// parse decodes a message. Records of types it does not know are skipped.
+func parse(msg []byte) (*message, error) {
+	if len(msg) < 12 {
+		return nil, errMalformed
+	}
+	m := &message{
+		id:    binary.BigEndian.Uint16(msg[0:]),
+		flags: binary.BigEndian.Uint16(msg[2:]),
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	rr := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for range qd {
+		name, next, err := readName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return nil, errMalformed
+		}
+		class := binary.BigEndian.Uint16(msg[next+2:])
+		m.questions = append(m.questions, question{
+			name:    canonical(name),
+			qtype:   binary.BigEndian.Uint16(msg[next:]),
+			unicast: class&classFlag != 0,
+		})
+		off = next + 4
+	}
+	for range rr {
+		name, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return nil, errMalformed
+		}
+		r := record{
+			name:  canonical(name),
+			rtype: binary.BigEndian.Uint16(msg[next:]),
+			ttl:   binary.BigEndian.Uint32(msg[next+4:]),
+		}
+		size := int(binary.BigEndian.Uint16(msg[next+8:]))
+		start := next + 10
+		if start+size > len(msg) {
+			return nil, errMalformed
+		}
+		data := msg[start : start+size]
+		off = start + size
+		switch r.rtype {
+		case typePTR:
+			if r.target, _, err = readName(msg, start); err != nil {
+				return nil, err
+			}
+		case typeSRV:
+			if size < 7 {
+				return nil, errMalformed
+			}
+			r.port = binary.BigEndian.Uint16(data[4:])
+			if r.target, _, err = readName(msg, start+6); err != nil {
+				return nil, err
+			}
+		case typeTXT:
+			for i := 0; i < len(data); {
+				n := int(data[i])
+				if i+1+n > len(data) {
+					return nil, errMalformed
+				}
+				if n > 0 {
+					r.text = append(r.text, string(data[i+1:i+1+n]))
+				}
+				i += 1 + n
+			}
+		case typeA, typeAAAA:
+			if size != net.IPv4len && size != net.IPv6len {
+				return nil, errMalformed
+			}
+			r.ip = net.IP(append([]byte(nil), data...))
+		default:
+			continue
+		}
+		m.records = append(m.records, r)
+	}
+	return m, nil
+}
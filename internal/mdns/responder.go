@@ -0,0 +1,180 @@
+package mdns
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	// ttl is how long answers may be cached (RFC 6762 recommends 75
+	// minutes for records naming hosts and 120 for others; a short TTL
+	// keeps a moved server from lingering).
+	ttl = 120
+	// legacyTTL caps the TTL in answers to one-shot queriers, which do
+	// not see cache-flush updates (RFC 6762 section 6.7).
+	legacyTTL = 10
+
+	// servicesName lists the service types on the link (RFC 6763
+	// section 9).
+	servicesName = "_services._dns-sd._udp.local."
+)
+
+// Responder advertises one instance of a service on the local link.
+type Responder struct {
+	service  string // "_rmm._tcp.local."
+	instance string // "<name>._rmm._tcp.local."
+	host     string // "<hostname>.local."
+	port     uint16
+	text     []string
+	ifi      *net.Interface
+}
+
+// NewResponder returns a responder for an instance called name (by default
+// the host name) of service (e.g. "_rmm._tcp") listening on port, with
+// text as its TXT record ("key=value" strings). ifi selects the interface
+// to answer on; nil means the system's default multicast interface.
+func NewResponder(name, service string, port int, text []string, ifi *net.Interface) *Responder {
+	hostname, _ := os.Hostname()
+	hostname, _, _ = strings.Cut(hostname, ".")
+	if hostname == "" {
+		hostname = "server"
+	}
+	if name == "" {
+		name = hostname
+	}
+	name = strings.ReplaceAll(name, ".", "-")
+	service = canonical(strings.TrimSuffix(service, ".") + ".local")
+	return &Responder{
+		service:  service,
+		instance: canonical(name + "." + service),
+		host:     canonical(hostname + ".local"),
+		port:     uint16(port),
+		text:     text,
+		ifi:      ifi,
+	}
+}
+
+// Instance returns the advertised instance name.
+func (r *Responder) Instance() string { return r.instance }
+
+// Serve answers queries until ctx is done.
+func (r *Responder) Serve(ctx context.Context) error {
+	conn, err := net.ListenMulticastUDP("udp4", r.ifi, group)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	// Announce the instance, so browsers already listening see it.
+	_, _ = conn.WriteToUDP(r.answer(&message{questions: []question{{name: r.service, qtype: typePTR}}}, false), group)
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		q, err := parse(buf[:n])
+		if err != nil || q.flags&flagResponse != 0 {
+			continue
+		}
+		// A query from a port other than 5353 comes from a one-shot
+		// querier, which expects a conventional unicast reply.
+		legacy := src.Port != Port
+		unicast := legacy
+		for _, question := range q.questions {
+			unicast = unicast || question.unicast
+		}
+		reply := r.answer(q, legacy)
+		if reply == nil {
+			continue
+		}
+		if unicast {
+			_, _ = conn.WriteToUDP(reply, src)
+		} else {
+			_, _ = conn.WriteToUDP(reply, group)
+		}
+	}
+}
+
+// answer builds the response to q, or nil when it asks nothing about this
+// instance. With legacy set the reply echoes the query's ID and questions.
+func (r *Responder) answer(q *message, legacy bool) []byte {
+	var records []record
+	add := func(rec record) {
+		for _, have := range records {
+			if have.name == rec.name && have.rtype == rec.rtype && have.target == rec.target && have.ip.Equal(rec.ip) {
+				return
+			}
+		}
+		records = append(records, rec)
+	}
+	for _, question := range q.questions {
+		any := question.qtype == typeANY
+		switch question.name {
+		case servicesName:
+			if question.qtype == typePTR || any {
+				add(record{name: servicesName, rtype: typePTR, target: r.service})
+			}
+		case r.service:
+			if question.qtype == typePTR || any {
+				add(record{name: r.service, rtype: typePTR, target: r.instance})
+				r.addInstance(add)
+			}
+		case r.instance:
+			if question.qtype == typeSRV || question.qtype == typeTXT || any {
+				r.addInstance(add)
+			}
+		case r.host:
+			if question.qtype == typeA || question.qtype == typeAAAA || any {
+				r.addHost(add)
+			}
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	reply := &message{flags: flagResponse | flagAuthoritative, records: records}
+	for i := range reply.records {
+		reply.records[i].ttl = ttl
+		if legacy {
+			reply.records[i].ttl = legacyTTL
+		}
+	}
+	if legacy {
+		reply.id, reply.questions = q.id, q.questions
+	}
+	return reply.encode()
+}
+
+// addInstance adds the instance's SRV and TXT records and the host's
+// addresses.
+func (r *Responder) addInstance(add func(record)) {
+	add(record{name: r.instance, rtype: typeSRV, target: r.host, port: r.port})
+	add(record{name: r.instance, rtype: typeTXT, text: r.text})
+	r.addHost(add)
+}
+
+// addHost adds the host's IPv4 addresses on the answering interface (all
+// interfaces when none was given), skipping loopback.
+func (r *Responder) addHost(add func(record)) {
+	var addrs []net.Addr
+	if r.ifi != nil {
+		addrs, _ = r.ifi.Addrs()
+	} else {
+		addrs, _ = net.InterfaceAddrs()
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+			continue
+		}
+		add(record{name: r.host, rtype: typeA, ip: ipnet.IP.To4()})
+	}
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import "time"
+
+// Quick actions: fixed troubleshooting routines built into the agent, so
+// common helpdesk fixes need neither a session nor a script.
+const (
+	ActionFlushDNS      = "flush_dns"           // clear the OS resolver cache
+	ActionClearSpooler  = "clear_print_spooler" // cancel every queued print job
+	ActionRestartShell  = "restart_shell"       // restart Explorer (Windows) or Finder (macOS)
+	ActionSupportBundle = "support_bundle"      // snapshot of system, network and process state
+)
+
+// ActionRequest asks the agent to run a quick action.
+type ActionRequest struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+}
+
+// ActionResult reports a quick action: the output of each step it ran,
+// and the snapshot for ActionSupportBundle. Error is set when the action
+// failed or is not available on the agent's platform.
+type ActionResult struct {
+	ID     string         `json:"id"`
+	Action string         `json:"action"`
+	Steps  []ActionStep   `json:"steps,omitempty"`
+	Bundle *SupportBundle `json:"bundle,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// ActionStep is one command run by a quick action.
+type ActionStep struct {
+	Command string `json:"command"`
+	Output  string `json:"output,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SupportBundle is the state of a machine at a glance, for triage.
+type SupportBundle struct {
+	CollectedAt   time.Time      `json:"collected_at"`
+	Hostname      string         `json:"hostname"`
+	OS            string         `json:"os"`
+	OSVersion     string         `json:"os_version"`
+	Arch          string         `json:"arch"`
+	AgentVersion  string         `json:"agent_version"`
+	Username      string         `json:"username"`
+	UptimeSeconds int64          `json:"uptime_seconds"`
+	CPUCount      int            `json:"cpu_count"`
+	MemoryTotal   uint64         `json:"memory_total"`
+	MemoryFree    uint64         `json:"memory_free"`
+	DiskTotal     uint64         `json:"disk_total"`
+	DiskFree      uint64         `json:"disk_free"`
+	Interfaces    []NetInterface `json:"interfaces"`
+	DNSServers    []string       `json:"dns_servers"`
+	TopCPU        []ProcessInfo  `json:"top_cpu"`
+	TopMemory     []ProcessInfo  `json:"top_memory"`
+}
+
+// NetInterface is a network interface and its addresses, in CIDR form.
+type NetInterface struct {
+	Name  string   `json:"name"`
+	MAC   string   `json:"mac,omitempty"`
+	Up    bool     `json:"up"`
+	Addrs []string `json:"addrs,omitempty"`
+}
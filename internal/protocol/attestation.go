@@ -0,0 +1,47 @@
+package protocol
+
+import "crypto/sha256"
+
+// AttestationTPM2 identifies a key resident in a TPM 2.0.
+const AttestationTPM2 = "tpm2"
+
+// Attestation is sent by the agent at enrollment to bind it to a TPM
+// signing key. Signature proves possession of the key over
+// AttestationEnrollDigest(code), not that the key is resident in a TPM.
+type Attestation struct {
+	Type      string `json:"type"`
+	PublicKey string `json:"public_key"` // base64 PKIX, ECDSA P-256
+	Signature string `json:"signature"`  // base64 ASN.1 ECDSA
+}
+
+// Challenge is sent by the server after "register" when the agent has an
+// attestation key on record.
+type Challenge struct {
+	Nonce string `json:"nonce"` // base64
+}
+
+// ChallengeResponse carries the agent's signature over
+// AttestationChallengeDigest(nonce, agentID).
+type ChallengeResponse struct {
+	Signature string `json:"signature"` // base64 ASN.1 ECDSA
+}
+
+// AttestationEnrollDigest is the SHA-256 digest an agent signs at
+// enrollment to prove possession of its attestation key.
+func AttestationEnrollDigest(code string) []byte {
+	h := sha256.New()
+	h.Write([]byte("rmm-attest-enroll-v1\x00"))
+	h.Write([]byte(code))
+	return h.Sum(nil)
+}
+
+// AttestationChallengeDigest is the SHA-256 digest an agent signs to
+// answer a registration challenge. Binding the agent ID prevents a
+// response being replayed for a different agent.
+func AttestationChallengeDigest(nonce []byte, agentID string) []byte {
+	h := sha256.New()
+	h.Write([]byte("rmm-attest-challenge-v1\x00"))
+	h.Write(nonce)
+	h.Write([]byte(agentID))
+	return h.Sum(nil)
+}
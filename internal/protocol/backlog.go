@@ -0,0 +1,16 @@
+package protocol
+
+// MaxBacklogBatch is the most messages one "backlog" message carries.
+const MaxBacklogBatch = 100
+
+// Backlog is sent by an agent ("backlog") after it reconnects, replaying
+// messages it could not send while the server was unreachable, oldest
+// first: heartbeats, whose Time is when they were taken, and support
+// requests, whose Time is when the user asked. The server stores the
+// heartbeats' health as history at their original times without touching
+// the agent's live state. Dropped counts older messages discarded because
+// the agent's buffer was full; it is set on the first batch only.
+type Backlog struct {
+	Messages []Message `json:"messages"`
+	Dropped  int       `json:"dropped,omitempty"`
+}
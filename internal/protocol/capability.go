@@ -0,0 +1,47 @@
+package protocol
+
+// Capability classes. An agent can be configured to refuse every command
+// in a class, whatever the server sends: its local config lists the
+// classes it refuses, and the server's policy can add to the list (see
+// Registered.DisabledCapabilities) but never take from it.
+const (
+	CapInput    = "input"    // input injection
+	CapFiles    = "files"    // file transfer, the file system browser and diagnostics archives
+	CapShell    = "shell"    // running commands and scripts (reserved; see BinTerminal)
+	CapGateway  = "gateway"  // relaying connections to other hosts (see GatewayOpen)
+	CapSoftware = "software" // installing and removing software (see SoftwareRequest)
+	CapPlugins  = "plugins"  // running plugins on command (see PluginRequest)
+)
+
+// capabilityCommands maps each command in a capability class to its
+// class and the type of its result message, empty for commands without
+// one.
+var capabilityCommands = map[string]struct{ class, result string }{
+	"input":               {CapInput, ""},
+	"file_start":          {CapFiles, "file_progress"},
+	FSList:                {CapFiles, "fs_result"},
+	FSStat:                {CapFiles, "fs_result"},
+	FSMkdir:               {CapFiles, "fs_result"},
+	FSDelete:              {CapFiles, "fs_result"},
+	FSRename:              {CapFiles, "fs_result"},
+	"gateway_open":        {CapGateway, "gateway_result"},
+	"collect_diagnostics": {CapFiles, "diagnostics_result"},
+	"software_request":    {CapSoftware, "software_result"},
+	"plugin_request":      {CapPlugins, "plugin_result"},
+}
+
+// CommandCapability reports the capability class msgType belongs to, if
+// any, and the type of the result message to refuse it with.
+func CommandCapability(msgType string) (class, resultType string, ok bool) {
+	c, ok := capabilityCommands[msgType]
+	return c.class, c.result, ok
+}
+
+// ValidCapability reports whether class names a capability class.
+func ValidCapability(class string) bool {
+	switch class {
+	case CapInput, CapFiles, CapShell, CapGateway, CapSoftware, CapPlugins:
+		return true
+	}
+	return false
+}
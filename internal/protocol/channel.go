@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// Channel flow control. Screen frames (agent to server) and file chunks
+// (in either direction, each with its own balance) are sent against
+// credit: the sender starts with CreditWindow bytes per channel, spends a
+// frame's length when it sends the frame, and waits (or, for live screen
+// frames, skips) when none is left. The receiver returns the credit with a grant on BinControl once
+// it has consumed the frame. Bounding the bulk data in flight bounds how
+// long control messages such as input and heartbeats wait behind it on
+// the shared connection.
+//
+// Both sides must opt in (Registration.FlowControl and
+// Registered.FlowControl); otherwise no channel is flow-controlled.
+
+// CreditWindow is the initial credit, in bytes, on each flow-controlled
+// channel.
+const CreditWindow = 256 << 10
+
+// creditGrantSize is the length of a CreditGrant frame.
+const creditGrantSize = 6
+
+// CreditGrant frames a grant of n bytes of credit on channel ch:
+// [BinControl][ch][n, big-endian uint32].
+func CreditGrant(ch byte, n int) []byte {
+	frame := make([]byte, creditGrantSize)
+	frame[0] = BinControl
+	frame[1] = ch
+	binary.BigEndian.PutUint32(frame[2:], uint32(n))
+	return frame
+}
+
+// ParseCreditGrant decodes a CreditGrant frame.
+func ParseCreditGrant(frame []byte) (ch byte, n int, err error) {
+	if len(frame) != creditGrantSize || frame[0] != BinControl {
+		return 0, 0, errors.New("malformed credit grant")
+	}
+	return frame[1], int(binary.BigEndian.Uint32(frame[2:])), nil
+}
+
+// Credit is a sender's balance on one channel. It is safe for concurrent
+// use.
+//
+// A frame may be sent whenever the balance is positive and may overdraw
+// it, so frames larger than the window still get through once the frames
+// before them have been granted back.
+type Credit struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	balance int
+	closed  bool
+}
+
+// NewCredit returns a balance of CreditWindow bytes.
+func NewCredit() *Credit {
+	c := &Credit{balance: CreditWindow}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+// TrySpend takes n bytes of credit if any is available, without waiting.
+func (c *Credit) TrySpend(n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.balance <= 0 {
+		return false
+	}
+	c.balance -= n
+	return true
+}
+
+// Spend waits until credit is available and takes n bytes. It reports
+// false if the Credit is closed first.
+func (c *Credit) Spend(n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for !c.closed && c.balance <= 0 {
+		c.changed.Wait()
+	}
+	if c.closed {
+		return false
+	}
+	c.balance -= n
+	return true
+}
+
+// Grant returns n bytes of credit.
+func (c *Credit) Grant(n int) {
+	c.mu.Lock()
+	c.balance = min(c.balance+n, CreditWindow)
+	c.mu.Unlock()
+	c.changed.Broadcast()
+}
+
+// Balance returns the credit left, which is negative while overdrawn.
+func (c *Credit) Balance() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.balance
+}
+
+// Close fails pending and future Spend calls, when the connection the
+// channel runs over is gone.
+func (c *Credit) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.changed.Broadcast()
+}
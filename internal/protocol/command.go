@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+// Signed commands. Agents accept high-impact commands (rebooting now or
+// after a countdown, deleting or renaming files, writing the registry,
+// disabling startup items, managing SSH keys, opening gateway streams,
+// running quick actions, installing or removing software, reading or
+// changing the hosts file and system environment) only with an Ed25519
+// signature by the platform key over CommandDigest. The server sends
+// its public key in Registered.PlatformKey; the agent trusts it only if
+// it matches the platform fingerprint pinned at enrollment. Since a
+// signature binds the command to one agent and one moment, and agents
+// remember the signatures they have seen, whoever relays the connection
+// can neither forge such a command nor replay or redirect a genuine
+// one.
+
+// CommandMaxAge bounds the difference between a signed command's
+// IssuedAt and the agent's clock, either way. Agents remember signatures
+// this long to reject replays.
+const CommandMaxAge = 5 * time.Minute
+
+// signedCommands maps each command agents only accept signed to the type
+// of its result message, which carries the request's ID and an error.
+var signedCommands = map[string]string{
+	"power_request":      "power_result",
+	"reboot_notice":      "reboot_notice_result",
+	FSDelete:             "fs_result",
+	FSRename:             "fs_result",
+	"registry_request":   "registry_result",
+	"startup_request":    "startup_result",
+	"ssh_keys_request":   "ssh_keys_result",
+	"gateway_open":       "gateway_result",
+	"action_request":     "action_result",
+	"plugin_request":     "plugin_result",
+	"hostconfig_request": "hostconfig_result",
+	"software_request":   "software_result",
+}
+
+// RequiresSignature reports whether agents only accept msgType signed,
+// and if so the type of the result message to refuse it with.
+func RequiresSignature(msgType string) (resultType string, ok bool) {
+	resultType, ok = signedCommands[msgType]
+	return resultType, ok
+}
+
+// CommandSignature authorizes one command for one agent; see Message.
+type CommandSignature struct {
+	AgentID   string `json:"agent_id"`
+	IssuedAt  int64  `json:"issued_at"` // Unix seconds
+	Signature string `json:"signature"` // base64 Ed25519 over CommandDigest
+}
+
+// CommandDigest is the SHA-256 digest the platform key signs for a
+// command: its type and payload, bound to the agent and issue time.
+func CommandDigest(msgType, agentID string, issuedAt int64, payload []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("rmm-command-v1\x00"))
+	h.Write([]byte(msgType))
+	h.Write([]byte{0})
+	h.Write([]byte(agentID))
+	h.Write([]byte{0})
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(issuedAt)))
+	h.Write(payload)
+	return h.Sum(nil)
+}
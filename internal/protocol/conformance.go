@@ -0,0 +1,133 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Conformance cases for the frame reader. FrameCases lists the edge cases
+// a frame reader must handle, and CheckFrames runs any reader against
+// them, so a replacement for ReadFrame can be held to the same rules.
+// websocket_test.go runs them and a native fuzz target; fuzz.go has the
+// go-fuzz entry point.
+
+// FrameCase is a raw frame and what reading it must give.
+type FrameCase struct {
+	Name    string
+	Raw     []byte
+	Opcode  byte
+	Payload []byte
+	Err     error // nil when the frame is accepted; compared with errors.Is
+}
+
+// fuzzMask is the masking key of the conformance cases' masked frames.
+var fuzzMask = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+// encodeFrame returns a final frame carrying payload, masked with
+// fuzzMask when masked is set.
+func encodeFrame(opcode byte, payload []byte, masked bool) []byte {
+	raw := appendHeader(nil, opcode, len(payload), masked)
+	if !masked {
+		return append(raw, payload...)
+	}
+	raw = append(raw, fuzzMask[:]...)
+	for i, c := range payload {
+		raw = append(raw, c^fuzzMask[i&3])
+	}
+	return raw
+}
+
+// accepted returns the unmasked and masked cases of a valid frame.
+func accepted(name string, opcode byte, payload []byte) []FrameCase {
+	return []FrameCase{
+		{Name: name, Raw: encodeFrame(opcode, payload, false), Opcode: opcode, Payload: payload},
+		{Name: name + " (masked)", Raw: encodeFrame(opcode, payload, true), Opcode: opcode, Payload: payload},
+	}
+}
+
+// FrameCases are the frames a reader must accept or refuse.
+var FrameCases = func() []FrameCase {
+	var cases []FrameCase
+	cases = append(cases, accepted("text", OpText, []byte(`{"type":"heartbeat"}`))...)
+	cases = append(cases, accepted("empty text", OpText, []byte{})...)
+	cases = append(cases, accepted("binary with 16-bit length", OpBinary, bytes.Repeat([]byte{0xff}, 200))...)
+	cases = append(cases, accepted("binary with 64-bit length", OpBinary, bytes.Repeat([]byte{0xa5}, 65536))...)
+	cases = append(cases, accepted("ping", OpPing, []byte("12345678"))...)
+	cases = append(cases, accepted("pong at the control limit", OpPong, bytes.Repeat([]byte{1}, maxControlPayload))...)
+	cases = append(cases, accepted("close with status", OpClose, []byte{0x03, 0xe8})...)
+	cases = append(cases, accepted("multibyte text", OpText, []byte("héllo, 世界"))...)
+
+	return append(cases,
+		FrameCase{Name: "empty input", Raw: nil, Err: io.EOF},
+		FrameCase{Name: "truncated header", Raw: []byte{0x81}, Err: io.EOF},
+		FrameCase{Name: "truncated 16-bit length", Raw: []byte{0x82, 126, 0x01}, Err: io.EOF},
+		FrameCase{Name: "truncated mask", Raw: []byte{0x81, 0x82, 0x01, 0x02}, Err: io.EOF},
+		FrameCase{Name: "truncated payload", Raw: []byte{0x82, 0x05, 'a', 'b'}, Err: io.ErrUnexpectedEOF},
+		FrameCase{Name: "reserved bit 1", Raw: []byte{0xc1, 0x00}, Err: ErrBadFrame},
+		FrameCase{Name: "reserved bit 3", Raw: []byte{0x92, 0x00}, Err: ErrBadFrame},
+		FrameCase{Name: "reserved data opcode", Raw: []byte{0x83, 0x00}, Err: ErrBadFrame},
+		FrameCase{Name: "reserved control opcode", Raw: []byte{0x8b, 0x00}, Err: ErrBadFrame},
+		FrameCase{Name: "first fragment", Raw: []byte{0x01, 0x01, 'a'}, Err: ErrFragmented},
+		FrameCase{Name: "continuation", Raw: []byte{0x80, 0x01, 'a'}, Err: ErrFragmented},
+		FrameCase{Name: "fragmented ping", Raw: []byte{0x09, 0x00}, Err: ErrBadFrame},
+		FrameCase{Name: "oversized ping", Raw: append([]byte{0x89, 126, 0x00, 126}, make([]byte, 126)...), Err: ErrBadFrame},
+		FrameCase{Name: "16-bit length under 126", Raw: []byte{0x82, 126, 0x00, 0x05, 1, 2, 3, 4, 5}, Err: ErrBadFrame},
+		FrameCase{Name: "64-bit length under 65536", Raw: []byte{0x82, 127, 0, 0, 0, 0, 0, 0, 0x01, 0x00}, Err: ErrBadFrame},
+		FrameCase{Name: "length over MaxFrameSize", Raw: []byte{0x82, 127, 0, 0, 0, 0x01, 0, 0, 0, 0}, Err: ErrFrameTooLarge},
+		FrameCase{Name: "64-bit length with top bit set", Raw: []byte{0x82, 127, 0x80, 0, 0, 0, 0, 0, 0, 0}, Err: ErrFrameTooLarge},
+		FrameCase{Name: "invalid UTF-8", Raw: encodeFrame(OpText, []byte{'a', 0xff, 'b'}, false), Err: ErrInvalidUTF8},
+		FrameCase{Name: "invalid UTF-8 (masked)", Raw: encodeFrame(OpText, []byte{0xc3, 0x28}, true), Err: ErrInvalidUTF8},
+		FrameCase{Name: "truncated UTF-8 sequence", Raw: encodeFrame(OpText, []byte("\xe4\xb8"), false), Err: ErrInvalidUTF8},
+		FrameCase{Name: "surrogate half", Raw: encodeFrame(OpText, []byte("\xed\xa0\x80"), false), Err: ErrInvalidUTF8},
+		FrameCase{Name: "binary that is not UTF-8", Raw: encodeFrame(OpBinary, []byte{0xff, 0xfe}, false), Opcode: OpBinary, Payload: []byte{0xff, 0xfe}},
+	)
+}()
+
+// CheckFrames reads every FrameCase with read and describes each result
+// that differs from the expected one.
+func CheckFrames(read func(*bufio.Reader) (byte, []byte, error)) []string {
+	var failures []string
+	for _, c := range FrameCases {
+		op, payload, err := read(bufio.NewReader(bytes.NewReader(c.Raw)))
+		switch {
+		case c.Err != nil && !errors.Is(err, c.Err):
+			failures = append(failures, fmt.Sprintf("%s: got error %v, want %v", c.Name, err, c.Err))
+		case c.Err == nil && err != nil:
+			failures = append(failures, fmt.Sprintf("%s: unexpected error %v", c.Name, err))
+		case c.Err == nil && (op != c.Opcode || !bytes.Equal(payload, c.Payload)):
+			failures = append(failures, fmt.Sprintf("%s: got opcode %d with %d bytes, want opcode %d with %d bytes",
+				c.Name, op, len(payload), c.Opcode, len(c.Payload)))
+		}
+	}
+	return failures
+}
+
+// checkStream reads the frames in data with ReadFrame and with a
+// FrameReader, which must agree, and encodes each frame read again,
+// masked and unmasked, which must read back the same. It returns the
+// number of frames read, or an error describing the first disagreement.
+func checkStream(data []byte) (int, error) {
+	plain := bufio.NewReader(bytes.NewReader(data))
+	reused := NewFrameReader(bufio.NewReader(bytes.NewReader(data)))
+	frames := 0
+	for {
+		op, payload, err := ReadFrame(plain)
+		op2, payload2, err2 := reused.Next()
+		if (err == nil) != (err2 == nil) || op != op2 || !bytes.Equal(payload, payload2) {
+			return frames, fmt.Errorf("ReadFrame and FrameReader disagree: %v / %v", err, err2)
+		}
+		if err != nil {
+			return frames, nil
+		}
+		frames++
+		for _, masked := range []bool{false, true} {
+			op3, payload3, err := ReadFrame(bufio.NewReader(bytes.NewReader(encodeFrame(op, payload, masked))))
+			if err != nil || op3 != op || !bytes.Equal(payload3, payload) {
+				return frames, fmt.Errorf("frame does not survive re-encoding (masked=%t): %v", masked, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"bufio"
+	"net"
+	"time"
+)
+
+// Conn is an established WebSocket connection, read and written a frame
+// at a time. The server holds its agent, viewer and gateway connections
+// as Conns, so the hand-rolled framing in this package (NewConn) can be
+// swapped for another implementation.
+type Conn interface {
+	// ReadFrame returns the next frame, control frames included. The
+	// payload is valid until the next call; callers that keep it must
+	// copy it.
+	ReadFrame() (opcode byte, payload []byte, err error)
+	// WriteFrame sends a final frame. It is safe for concurrent use, and
+	// frames from concurrent writers never interleave.
+	WriteFrame(opcode byte, payload []byte) error
+	SetReadDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// frameConn is a Conn using ReadFrame, WriteServerFrame and
+// WriteClientFrame.
+type frameConn struct {
+	net.Conn
+	frames *FrameReader
+	server bool
+}
+
+// NewConn returns a Conn reading frames from r, which buffers conn, and
+// writing them to conn: unmasked for the server end of the connection,
+// masked for the client end.
+func NewConn(conn net.Conn, r *bufio.Reader, server bool) Conn {
+	return &frameConn{Conn: conn, frames: NewFrameReader(r), server: server}
+}
+
+func (c *frameConn) ReadFrame() (byte, []byte, error) {
+	return c.frames.Next()
+}
+
+func (c *frameConn) WriteFrame(opcode byte, payload []byte) error {
+	if c.server {
+		return WriteServerFrame(c.Conn, opcode, payload)
+	}
+	return WriteClientFrame(c.Conn, opcode, payload)
+}
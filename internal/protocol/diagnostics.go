@@ -0,0 +1,23 @@
+package protocol
+
+// MaxDiagnosticsSize caps the compressed size of a diagnostics archive.
+const MaxDiagnosticsSize = 64 << 20
+
+// DiagnosticsRequest ("collect_diagnostics") asks the agent to gather its
+// recent log, system information, recent OS event logs and network
+// configuration into a .tar.gz archive. The agent uploads the archive
+// over its file channel in the other direction: a "file_start" message
+// (FileStart with the request's ID and FilePurposeDiagnostics), BinFile
+// frames, and a "file_end" message, pacing the chunks against credit
+// when flow control is on. If it cannot, it answers with a
+// "diagnostics_result" message (DiagnosticsResult) instead.
+type DiagnosticsRequest struct {
+	ID string `json:"id"`
+}
+
+// DiagnosticsResult reports that the DiagnosticsRequest with the same ID
+// failed before its archive was uploaded.
+type DiagnosticsResult struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
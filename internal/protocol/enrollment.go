@@ -0,0 +1,32 @@
+package protocol
+
+import "crypto/sha256"
+
+// Signed enrollment. An agent enrolling over an unverified connection
+// (-insecure, before it has the CA certificate) cannot tell the server
+// from whoever sits in between, and pins whatever CA certificate and
+// platform fingerprint the reply carries. The server therefore signs
+// what the agent will keep with the platform key: the reply carries the
+// public key and an Ed25519 signature over EnrollmentDigest. The platform
+// fingerprint is shown next to the enrollment code and carried in the
+// enrollment URL (EnrollURLFingerprint), so an agent given it out of band
+// refuses a reply not signed by that platform.
+
+// EnrollURLFingerprint is the enrollment URL query parameter carrying
+// the platform fingerprint.
+const EnrollURLFingerprint = "fp"
+
+// EnrollmentDigest is the SHA-256 digest the platform key signs in an
+// enrollment reply. credentialHash and caCertHash are SHA-256 hex digests
+// of the issued credential and of the CA certificate PEM, the latter
+// empty when the reply has no CA certificate.
+func EnrollmentDigest(agentID, credentialHash, caCertHash string) []byte {
+	h := sha256.New()
+	h.Write([]byte("rmm-enroll-v1\x00"))
+	h.Write([]byte(agentID))
+	h.Write([]byte{0})
+	h.Write([]byte(credentialHash))
+	h.Write([]byte{0})
+	h.Write([]byte(caCertHash))
+	return h.Sum(nil)
+}
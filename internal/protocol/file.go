@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+)
+
+// MaxFileSize is the default cap on the uncompressed size of a single
+// upload to an agent. The server's transfer policy may change it.
+const MaxFileSize = 64 << 20
+
+// Upload purposes: what the agent does with a received file, or, for
+// uploads from the agent, what the server does with it.
+const (
+	FilePurposePrint       = "print"       // print on the default printer
+	FilePurposeDropbox     = "dropbox"     // save to the user's downloads
+	FilePurposePackage     = "package"     // stage an installer for a SoftwareRequest
+	FilePurposeDiagnostics = "diagnostics" // agent to server: a diagnostics archive (see DiagnosticsRequest)
+)
+
+// CompressionDeflate marks an upload whose chunks, concatenated, form a
+// raw DEFLATE stream (RFC 1951), as produced by the browser's
+// CompressionStream("deflate-raw").
+const CompressionDeflate = "deflate"
+
+// FileStart opens an upload to the agent, from a viewer or from the
+// server's drop-box. The content follows as BinFile frames (see
+// FileChunk) and is closed by a "file_end" message carrying the same ID.
+// One upload is in flight per agent. Size is the uncompressed size.
+type FileStart struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	Purpose     string `json:"purpose"`
+	Compression string `json:"compression,omitempty"`
+}
+
+// FileEnd closes the upload opened by the FileStart with the same ID.
+// SHA256 is the hex digest of the uncompressed content. It is required:
+// the server refuses a FileEnd without one, and the agent rejects the
+// file if it is missing or does not match.
+type FileEnd struct {
+	ID     string `json:"id"`
+	SHA256 string `json:"sha256"`
+}
+
+// ValidSHA256 reports whether s is a hex SHA-256 digest.
+func ValidSHA256(s string) bool {
+	sum, err := hex.DecodeString(s)
+	return err == nil && len(sum) == sha256.Size
+}
+
+// FileProgress reports how much of an upload the agent has received,
+// counted in uncompressed bytes. The final message has Done set, with
+// the agent's SHA-256 of the content, or carries Error. Path is where a
+// saved file (FilePurposeDropbox) ended up.
+type FileProgress struct {
+	ID       string `json:"id"`
+	Received int64  `json:"received"`
+	Size     int64  `json:"size"`
+	Done     bool   `json:"done,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// FileChunkOverhead is the size of the BinFile prefix and CRC that
+// precede every chunk's data.
+const FileChunkOverhead = 5
+
+// ErrChunkChecksum is returned by ParseFileChunk for corrupt chunks.
+var ErrChunkChecksum = errors.New("file chunk checksum mismatch")
+
+// FileChunk frames data as a BinFile message:
+// [BinFile][CRC-32 (IEEE) of data, big-endian][data].
+func FileChunk(data []byte) []byte {
+	frame := make([]byte, FileChunkOverhead, FileChunkOverhead+len(data))
+	frame[0] = BinFile
+	binary.BigEndian.PutUint32(frame[1:], crc32.ChecksumIEEE(data))
+	return append(frame, data...)
+}
+
+// ParseFileChunk verifies a BinFile frame and returns its data.
+func ParseFileChunk(frame []byte) ([]byte, error) {
+	if len(frame) < FileChunkOverhead || frame[0] != BinFile {
+		return nil, errors.New("malformed file chunk")
+	}
+	data := frame[FileChunkOverhead:]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(frame[1:]) {
+		return nil, ErrChunkChecksum
+	}
+	return data, nil
+}
+
+// MaxWireSize bounds the chunk data accepted for an upload of size bytes.
+// Deflate can slightly expand incompressible input, so compressed uploads
+// get a small allowance over the uncompressed size.
+func MaxWireSize(size int64, compression string) int64 {
+	if compression == CompressionDeflate {
+		return size + size/64 + 1024
+	}
+	return size
+}
+
+// Print job states reported in PrintStatus.
+const (
+	PrintSubmitted = "submitted" // accepted by the local spooler
+	PrintCompleted = "completed" // left the spooler queue
+	PrintFailed    = "failed"
+)
+
+// PrintStatus reports the progress of a print job to the viewer.
+type PrintStatus struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Job    string `json:"job,omitempty"` // spooler job ID, when known
+	Error  string `json:"error,omitempty"`
+}
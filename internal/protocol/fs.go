@@ -0,0 +1,45 @@
+package protocol
+
+import "time"
+
+// File system commands sent by the server as message types. Each carries
+// an FSRequest and is answered by an "fs_result" message with an FSResult.
+const (
+	FSList   = "fs_list"
+	FSStat   = "fs_stat"
+	FSMkdir  = "fs_mkdir"
+	FSDelete = "fs_delete"
+	FSRename = "fs_rename"
+)
+
+// FSRequest names the target of a file system command. Root is the
+// policy directory the server matched Path against; the agent resolves
+// symlinks and refuses to act on anything that escapes it.
+type FSRequest struct {
+	ID        string `json:"id"`
+	Path      string `json:"path"`
+	NewPath   string `json:"new_path,omitempty"` // fs_rename destination
+	NewRoot   string `json:"new_root,omitempty"` // policy directory for NewPath
+	Root      string `json:"root"`
+	Recursive bool   `json:"recursive,omitempty"` // fs_delete of a non-empty directory
+}
+
+// FSEntry describes one file or directory.
+type FSEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+	Symlink bool      `json:"symlink,omitempty"`
+}
+
+// FSResult answers the FSRequest with the same ID. fs_list fills Entries,
+// fs_stat, fs_mkdir and fs_rename fill Entry.
+type FSResult struct {
+	ID      string    `json:"id"`
+	Entry   *FSEntry  `json:"entry,omitempty"`
+	Entries []FSEntry `json:"entries,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
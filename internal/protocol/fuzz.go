@@ -0,0 +1,40 @@
+//go:build gofuzz
+
+package protocol
+
+// go-fuzz entry point for the frame reader. It is built only with the
+// gofuzz tag, which go-fuzz-build sets:
+//
+//	go-fuzz-build -o protocol-fuzz.zip ./internal/protocol
+//	go-fuzz -bin protocol-fuzz.zip -workdir /tmp/protocol-fuzz
+//
+// FuzzReadFrame in websocket_test.go runs the same checks under
+// "go test -fuzz".
+
+// Fuzz is the go-fuzz entry point; see checkStream. It panics on a
+// disagreement, which go-fuzz reports as a crasher, and on the first run
+// checks FrameCases.
+func Fuzz(data []byte) int {
+	checkOnce()
+	frames, err := checkStream(data)
+	if err != nil {
+		panic(err.Error())
+	}
+	if frames > 0 {
+		return 1
+	}
+	return 0
+}
+
+var checked bool
+
+// checkOnce panics if ReadFrame fails FrameCases.
+func checkOnce() {
+	if checked {
+		return
+	}
+	checked = true
+	if failures := CheckFrames(ReadFrame); len(failures) > 0 {
+		panic("frame conformance: " + failures[0])
+	}
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Gateway streams. An agent can relay a TCP connection to a host on its
+// network, typically a VNC or RDP server on a machine without an agent
+// of its own. The server opens a stream with GatewayOpen; once the agent
+// has connected it answers with GatewayResult, and the bytes flow in both
+// directions as BinGateway frames: [BinGateway][stream, big-endian
+// uint32][data]. Either side ends the stream with "gateway_close"
+// (GatewayClose).
+//
+// The relay is byte for byte: the remote desktop protocol's own handshake
+// and authentication run between the target and the client at the far
+// end of the server, and neither the agent nor the server sees them.
+//
+// Each direction of a stream is flow-controlled with its own Credit; the
+// receiver grants it back with GatewayCreditGrant once the data has been
+// written on.
+
+// GatewayChunkSize is the most data carried by one BinGateway frame.
+const GatewayChunkSize = 32 << 10
+
+// GatewayFrameOverhead is the length of a BinGateway frame's header.
+const GatewayFrameOverhead = 5
+
+// GatewayOpen asks the agent to connect to Host:Port and relay the
+// connection as Stream.
+type GatewayOpen struct {
+	ID       string `json:"id"`
+	Stream   uint32 `json:"stream"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Operator string `json:"operator,omitempty"` // API key that opened the stream
+}
+
+// GatewayResult reports whether the agent connected a GatewayOpen.
+type GatewayResult struct {
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// GatewayClose ends a stream, with the reason when it failed.
+type GatewayClose struct {
+	Stream uint32 `json:"stream"`
+	Error  string `json:"error,omitempty"`
+}
+
+// GatewayFrame frames data for stream.
+func GatewayFrame(stream uint32, data []byte) []byte {
+	frame := make([]byte, GatewayFrameOverhead, GatewayFrameOverhead+len(data))
+	frame[0] = BinGateway
+	binary.BigEndian.PutUint32(frame[1:], stream)
+	return append(frame, data...)
+}
+
+// ParseGatewayFrame splits a BinGateway frame into its stream and data.
+func ParseGatewayFrame(frame []byte) (stream uint32, data []byte, err error) {
+	if len(frame) < GatewayFrameOverhead || frame[0] != BinGateway {
+		return 0, nil, errors.New("malformed gateway frame")
+	}
+	return binary.BigEndian.Uint32(frame[1:]), frame[GatewayFrameOverhead:], nil
+}
+
+// gatewayGrantSize is the length of a GatewayCreditGrant frame.
+const gatewayGrantSize = 10
+
+// GatewayCreditGrant frames a grant of n bytes of credit on a gateway
+// stream: [BinControl][BinGateway][n, big-endian uint32][stream,
+// big-endian uint32]. Its length tells it apart from a CreditGrant.
+func GatewayCreditGrant(stream uint32, n int) []byte {
+	frame := make([]byte, gatewayGrantSize)
+	frame[0] = BinControl
+	frame[1] = BinGateway
+	binary.BigEndian.PutUint32(frame[2:], uint32(n))
+	binary.BigEndian.PutUint32(frame[6:], stream)
+	return frame
+}
+
+// ParseGatewayCreditGrant decodes a GatewayCreditGrant frame.
+func ParseGatewayCreditGrant(frame []byte) (stream uint32, n int, err error) {
+	if len(frame) != gatewayGrantSize || frame[0] != BinControl || frame[1] != BinGateway {
+		return 0, 0, errors.New("malformed gateway credit grant")
+	}
+	return binary.BigEndian.Uint32(frame[6:]), int(binary.BigEndian.Uint32(frame[2:])), nil
+}
@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Host configuration: the hosts file and the system-wide environment
+// variables, which often explain name resolution, proxy and path
+// problems.
+
+// Targets of a HostConfigRequest.
+const (
+	HostConfigHosts       = "hosts"       // the hosts file
+	HostConfigEnvironment = "environment" // system-wide environment variables
+)
+
+// Operations carried in HostConfigRequest.
+const (
+	HostConfigRead  = "read"
+	HostConfigWrite = "write"
+)
+
+// MaxHostsFileSize caps the hosts file content the agent reads or writes.
+const MaxHostsFileSize = 1 << 20
+
+// HostConfigRequest asks the agent to read a target, or to change it:
+//
+//   - hosts: replace the file with Hosts. If Digest is set the write
+//     fails unless it matches the current content's digest, so a change
+//     based on a stale read does not overwrite a newer one.
+//   - environment: set each variable in Environment, removing those
+//     whose value is null. Variables not named are left alone.
+//
+// Environment variables are stored in the registry (HKLM Session
+// Manager\Environment) on Windows and /etc/environment on Linux; macOS
+// has no system-wide equivalent, so reads return the agent's own
+// environment and writes are refused.
+type HostConfigRequest struct {
+	ID          string             `json:"id"`
+	Op          string             `json:"op"`
+	Target      string             `json:"target"`
+	Hosts       string             `json:"hosts,omitempty"`
+	Digest      string             `json:"digest,omitempty"`
+	Environment map[string]*string `json:"environment,omitempty"`
+}
+
+// HostConfigResult answers the HostConfigRequest with the same ID with
+// the target as it stands after the operation. Values of likely secrets
+// (see SecretEnvName) are redacted.
+type HostConfigResult struct {
+	ID          string            `json:"id"`
+	Path        string            `json:"path,omitempty"` // where the target is stored
+	Hosts       string            `json:"hosts,omitempty"`
+	Digest      string            `json:"digest,omitempty"` // of Hosts, see HostsDigest
+	Environment map[string]string `json:"environment,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// HostsDigest is the hex SHA-256 of hosts file content.
+func HostsDigest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// secretEnvMarkers flag environment variables whose values are withheld.
+var secretEnvMarkers = []string{"KEY", "SECRET", "TOKEN", "PASSWORD", "PASSWD", "CREDENTIAL", "AUTH", "COOKIE"}
+
+// SecretEnvName reports whether an environment variable's name suggests
+// its value is a secret, which agents report as "[redacted]".
+func SecretEnvName(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, marker := range secretEnvMarkers {
+		if strings.Contains(upper, marker) {
+			return true
+		}
+	}
+	return false
+}
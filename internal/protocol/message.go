@@ -14,13 +14,20 @@ const (
 	OpPong     = 10
 )
 
-// Binary message type prefixes.
-// The first byte of every binary WebSocket frame identifies the payload kind,
-// allowing multiplexed channels over a single connection.
+// Binary channel IDs.
+// The first byte of every binary WebSocket frame names the logical channel
+// it belongs to, multiplexing several streams over a single connection.
+// Text frames (Message) belong to the control channel. Bulky channels are
+// flow-controlled so they cannot starve it; see Credit.
 const (
-	BinScreen byte = 0x01 // JPEG screen-capture frame
-	BinFile   byte = 0x02 // File-transfer chunk (reserved)
-	BinAudio  byte = 0x03 // Audio stream chunk (reserved)
+	BinControl  byte = 0x00 // Flow-control grants (see CreditGrant)
+	BinScreen   byte = 0x01 // JPEG screen-capture frame
+	BinFile     byte = 0x02 // File-transfer chunk (see FileStart)
+	BinAudio    byte = 0x03 // Audio stream chunk (reserved)
+	BinTerminal byte = 0x04 // Terminal session data (reserved)
+	BinDisplay  byte = 0x05 // JPEG frame of one display: [BinDisplay][display][JPEG] (see ViewSeparate)
+	BinGateway  byte = 0x06 // Relayed TCP stream data (see GatewayOpen)
+	BinTiles    byte = 0x07 // Changed regions of the last BinScreen frame (see TilesHeader)
 )
 
 // Message is the envelope for all WebSocket messages exchanged
@@ -28,6 +35,57 @@ const (
 type Message struct {
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// Signed authorizes a high-impact command from the server; see
+	// RequiresSignature.
+	Signed *CommandSignature `json:"signed,omitempty"`
+}
+
+// Registered is the server's reply to a Registration.
+type Registered struct {
+	ID string `json:"id"`
+	// FlowControl confirms the server grants and honours channel credit;
+	// servers that predate it leave it unset.
+	FlowControl bool `json:"flow_control,omitempty"`
+	// PlatformKey is the platform's Ed25519 public key (base64), which
+	// signs high-impact commands. Agents check it against the fingerprint
+	// pinned at enrollment before trusting it.
+	PlatformKey string `json:"platform_key,omitempty"`
+	// DisabledCapabilities are capability classes the server's policy
+	// locks off. Agents add them to the classes their local config
+	// disables and keep them disabled from then on.
+	DisabledCapabilities []string `json:"disabled_capabilities,omitempty"`
+	// Branding is the agent's organization's branding, if any; later
+	// changes arrive as "branding" messages.
+	Branding *Branding `json:"branding,omitempty"`
+	// Servers are the URLs (https://…) the deployment can be reached at,
+	// in order of preference; agents keep them for failover. Empty when
+	// the server has no list.
+	Servers []string `json:"servers,omitempty"`
+}
+
+// RegistrationRefused is the server's reply to a Registration it turns
+// away for a reason that will pass, such as a connection quota. The agent
+// tries again after RetryAfterMS.
+type RegistrationRefused struct {
+	Error        string `json:"error"`
+	RetryAfterMS int64  `json:"retry_after_ms"`
+}
+
+// ServerClosing is the payload of "server_closing", which the server sends
+// each agent as it shuts down, just before closing the connection. The
+// agent reconnects after ReconnectAfterMS instead of its usual delay; the
+// server spreads its agents over a window sized to the fleet, so a
+// restarted server is not met by all of them at once.
+type ServerClosing struct {
+	ReconnectAfterMS int64 `json:"reconnect_after_ms"`
+}
+
+// Branding is the part of an organization's white-labeling agents use:
+// the product name shown in their dialogs and tray. An empty name
+// restores the default look.
+type Branding struct {
+	ProductName string `json:"product_name,omitempty"`
 }
 
 // DisplayInfo describes a single connected display.
@@ -38,9 +96,132 @@ type DisplayInfo struct {
 	Height int `json:"height"`
 }
 
+// DisplaysChanged is sent by the agent when displays are connected or
+// disconnected after registration. It replaces the registered list.
+type DisplaysChanged struct {
+	Displays     []DisplayInfo `json:"displays"`
+	DisplayCount int           `json:"display_count"`
+}
+
+// View modes for "set_view". ViewSingle, the default, streams the display
+// chosen with "switch_display" as BinScreen frames. The other two show
+// every display at once, at reduced size, quality and frame rate:
+// ViewStitched as one BinScreen image with the displays side by side,
+// ViewSeparate as one BinDisplay frame per display, tagged with its
+// 1-based index. Input is only injected in ViewSingle, where viewer
+// coordinates map onto a single display.
+const (
+	ViewSingle   = "single"
+	ViewStitched = "stitched"
+	ViewSeparate = "separate"
+)
+
+// SetView is the payload of "set_view" (viewer to agent) and of the
+// agent's "view_changed" reply, which adds the display count.
+type SetView struct {
+	Mode         string `json:"mode"`
+	DisplayCount int    `json:"display_count,omitempty"`
+}
+
+// SetResolution is the payload of "set_resolution" (viewer to agent):
+// Full asks for frames at the display's own resolution instead of scaled
+// down to the agent's maximum size, for the rest of the session. The
+// agent's "resolution_changed" reply adds that size; zero means the agent
+// does not scale.
+type SetResolution struct {
+	Full    bool `json:"full"`
+	MaxSize int  `json:"max_size,omitempty"`
+}
+
+// SessionSetup is the payload of "session_setup", which a viewer sends
+// when its session opens: its keyboard (see the agent's keyboard modes)
+// and the frames it can draw. Tiles asks for BinTiles frames; viewers
+// that predate them leave it unset and get whole frames only.
+type SessionSetup struct {
+	Locale string `json:"locale"`
+	Layout string `json:"layout"`
+	Tiles  bool   `json:"tiles,omitempty"`
+}
+
+// CaptureStart is the payload of "start_capture". Operator names who is
+// viewing, for the agent's session indicator; servers that predate it
+// send no payload. Permissions is the session's viewer permission mask
+// (see PermView); servers that predate it leave it empty, allowing all.
+// Recording is set when the server records the session, so the agent can
+// tell the local user. Watermark asks the agent to draw the operator and
+// the time onto every frame it sends.
+type CaptureStart struct {
+	Operator    string   `json:"operator,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	Recording   bool     `json:"recording,omitempty"`
+	Watermark   bool     `json:"watermark,omitempty"`
+}
+
+// CaptureStats is the agent's reply to "stop_capture": how many screen
+// frames the capture run sent, and how many it dropped because the
+// connection could not keep up. ID echoes the stop request's.
+type CaptureStats struct {
+	ID            string `json:"id,omitempty"`
+	FramesSent    int64  `json:"frames_sent"`
+	FramesDropped int64  `json:"frames_dropped"`
+}
+
+// FrameStamp is the payload of "frame_stamp", which the agent sends just
+// before each screen frame (BinScreen or BinTiles): Seq numbers the frame
+// within the session, CapturedAt is when capture began on the agent's
+// clock (Unix milliseconds) and AgeMS how long before sending that was.
+// The server relays it to the viewer and measures latency from AgeMS
+// alone, since the agent's clock need not match its own.
+type FrameStamp struct {
+	Seq        uint32  `json:"seq"`
+	CapturedAt int64   `json:"captured_at"`
+	AgeMS      float64 `json:"age_ms"`
+}
+
+// FrameDisplayed is the payload of "frame_displayed", which the viewer
+// sends once it has drawn the frame a FrameStamp announced. DrawMS is the
+// time from the frame's arrival to its drawing, on the viewer.
+type FrameDisplayed struct {
+	Seq    uint32  `json:"seq"`
+	DrawMS float64 `json:"draw_ms,omitempty"`
+}
+
+// SessionDiagnosticsRequest asks the agent how its capture run is doing
+// ("session_diagnostics_request").
+type SessionDiagnosticsRequest struct {
+	ID string `json:"id"`
+}
+
+// SessionDiagnostics is the agent's answer ("session_diagnostics_result").
+// Times are moving averages over recent frames, in milliseconds; agents
+// that encode in the screenshot tool itself report an EncodeMS of zero.
+// Active is false, and the rest empty, outside a capture run.
+type SessionDiagnostics struct {
+	ID     string `json:"id"`
+	Active bool   `json:"active"`
+
+	IntervalMS int     `json:"interval_ms"` // the target time between captures
+	CaptureMS  float64 `json:"capture_ms"`  // grabbing the screen
+	EncodeMS   float64 `json:"encode_ms"`   // compressing the image
+	SendMS     float64 `json:"send_ms"`     // writing a frame to the connection
+	FrameBytes int     `json:"frame_bytes"`
+	FPS        float64 `json:"fps"` // frames sent per second
+
+	// Pending is how many captures wait for the sender (at most one);
+	// CreditBytes the screen credit left, or -1 without flow control.
+	Pending     int `json:"pending"`
+	CreditBytes int `json:"credit_bytes"`
+
+	FramesSent      int64 `json:"frames_sent"`
+	FramesDropped   int64 `json:"frames_dropped"`
+	DroppedNoCredit int64 `json:"dropped_no_credit"` // of FramesDropped, for want of credit
+}
+
 // Registration is the wire format sent by the agent during registration.
 // Shared between agent (serialisation) and server (deserialisation) to
 // keep the two sides in sync.
+// Agents also send it, without the credential, as "inventory" to
+// refresh what the server shows when asked through their local API.
 type Registration struct {
 	Credential    string        `json:"credential,omitempty"`
 	Name          string        `json:"name"`
@@ -59,4 +240,17 @@ type Registration struct {
 	Username      string        `json:"username"`
 	UptimeSeconds int64         `json:"uptime_seconds"`
 	AgentVersion  string        `json:"agent_version"`
+
+	// FlowControl is set by agents that grant and honour channel credit.
+	FlowControl bool `json:"flow_control,omitempty"`
+
+	// Inventory collected at registration; see StartupItem.
+	StartupItems []StartupItem     `json:"startup_items,omitempty"`
+	Environment  map[string]string `json:"environment,omitempty"`
+
+	// Permissions is reported by macOS agents; see Permissions.
+	Permissions *Permissions `json:"permissions,omitempty"`
+
+	// DisabledCapabilities are the capability classes the agent refuses.
+	DisabledCapabilities []string `json:"disabled_capabilities,omitempty"`
 }
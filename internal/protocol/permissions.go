@@ -0,0 +1,38 @@
+package protocol
+
+// Permission states. macOS gates screen capture and input injection
+// behind Screen Recording and Accessibility permissions; without them
+// capture returns only the desktop background and input is ignored.
+const (
+	PermissionGranted = "granted"
+	PermissionDenied  = "denied"
+	PermissionUnknown = "unknown" // the check itself failed
+)
+
+// Permissions is the state of the OS permissions remote control needs.
+// Only macOS agents report it.
+type Permissions struct {
+	ScreenRecording string `json:"screen_recording"`
+	Accessibility   string `json:"accessibility"`
+}
+
+// Missing reports whether any permission is not granted.
+func (p *Permissions) Missing() bool {
+	return p != nil && (p.ScreenRecording != PermissionGranted || p.Accessibility != PermissionGranted)
+}
+
+// PermissionsRequest asks the agent for its current permissions. With
+// Prompt set it first asks the local user for the missing ones: the OS
+// prompts appear and System Settings opens on the matching pane.
+type PermissionsRequest struct {
+	ID     string `json:"id"`
+	Prompt bool   `json:"prompt,omitempty"`
+}
+
+// PermissionsResult answers a PermissionsRequest. Permissions is nil on
+// platforms without such permissions.
+type PermissionsResult struct {
+	ID          string       `json:"id"`
+	Permissions *Permissions `json:"permissions,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
@@ -0,0 +1,93 @@
+package protocol
+
+// Plugin statuses, reported in PluginOutput.Status, worst last.
+const (
+	PluginOK       = "ok"
+	PluginWarning  = "warning"
+	PluginCritical = "critical"
+)
+
+// Why a plugin ran, reported in PluginInput.Trigger.
+const (
+	PluginScheduled = "schedule" // the agent's own schedule
+	PluginCommanded = "command"  // a PluginRequest from the server
+)
+
+// MaxPluginInterval bounds the Interval a plugin may ask for, in seconds.
+const MaxPluginInterval = 24 * 60 * 60
+
+// PluginInput is what the agent writes to a plugin's standard input
+// before closing it. Args come from the PluginRequest that ran it, if
+// any.
+type PluginInput struct {
+	Plugin  string            `json:"plugin"`
+	Trigger string            `json:"trigger"`
+	AgentID string            `json:"agent_id,omitempty"`
+	OS      string            `json:"os"`
+	Arch    string            `json:"arch"`
+	Args    map[string]string `json:"args,omitempty"`
+}
+
+// PluginOutput is what a plugin writes to its standard output: one JSON
+// object, every field optional. Status is one of the Plugin* statuses,
+// PluginOK when empty. Metrics are readings exported with the server's
+// metrics and Inventory facts kept with the agent's inventory. Interval,
+// in seconds, is when the plugin wants to run next on schedule, the
+// agent's default when zero.
+type PluginOutput struct {
+	Status    string             `json:"status,omitempty"`
+	Message   string             `json:"message,omitempty"`
+	Metrics   map[string]float64 `json:"metrics,omitempty"`
+	Inventory map[string]string  `json:"inventory,omitempty"`
+	Interval  int                `json:"interval,omitempty"`
+}
+
+// PluginResult is one run of a plugin, named after its executable
+// without the extension. Error is set when the plugin could not be run,
+// exited with an error or wrote no valid output; Status is then
+// PluginCritical. Time is when the run finished, in Unix milliseconds.
+type PluginResult struct {
+	Plugin  string `json:"plugin"`
+	Trigger string `json:"trigger"`
+	PluginOutput
+	Error      string `json:"error,omitempty"`
+	Time       int64  `json:"time"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// PluginResults is sent by the agent ("plugin_results") after scheduled
+// runs, and once per connection with the latest result of every plugin,
+// so the server's view survives a reconnect.
+type PluginResults struct {
+	Results []PluginResult `json:"results"`
+}
+
+// PluginRequest asks the agent to run a plugin now ("plugin_request");
+// the agent answers with a PluginReply with the same ID.
+type PluginRequest struct {
+	ID     string            `json:"id"`
+	Plugin string            `json:"plugin"`
+	Args   map[string]string `json:"args,omitempty"`
+}
+
+// PluginReply answers a PluginRequest ("plugin_result"). Error is set,
+// and Result empty, when the plugin does not exist.
+type PluginReply struct {
+	ID     string        `json:"id"`
+	Result *PluginResult `json:"result,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// ValidPluginName reports whether name is usable as a plugin name:
+// letters, digits, '-', '_' and '.', not starting with '.'.
+func ValidPluginName(name string) bool {
+	if name == "" || len(name) > 64 || name[0] == '.' {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
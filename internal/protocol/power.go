@@ -0,0 +1,42 @@
+package protocol
+
+// Power actions accepted in a PowerRequest.
+const (
+	PowerReboot   = "reboot"
+	PowerShutdown = "shutdown"
+)
+
+// PowerRequest asks the agent to reboot or shut down its machine. The
+// agent answers with a PowerResult once the operating system has accepted
+// the request, before the machine goes down.
+type PowerRequest struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+}
+
+// PowerResult reports whether a PowerRequest was accepted.
+type PowerResult struct {
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// RebootNotice asks the agent to warn the logged-in user that the machine
+// will reboot after Countdown seconds, then reboot. While DeferralsLeft
+// is positive the user may instead postpone it by DeferMinutes, and the
+// server sends a new notice when that time is up. Message, if set, is
+// shown with the warning.
+type RebootNotice struct {
+	ID            string `json:"id"`
+	Countdown     int    `json:"countdown"` // seconds
+	DeferralsLeft int    `json:"deferrals_left"`
+	DeferMinutes  int    `json:"defer_minutes"`
+	Message       string `json:"message,omitempty"`
+}
+
+// RebootNoticeResult answers a RebootNotice once the user has postponed
+// the reboot (Deferred) or the operating system has accepted it.
+type RebootNoticeResult struct {
+	ID       string `json:"id"`
+	Deferred bool   `json:"deferred,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
@@ -0,0 +1,60 @@
+package protocol
+
+// TopProcessCount is how many processes each heartbeat list holds.
+const TopProcessCount = 5
+
+// Heartbeat is the payload of the agent's periodic "heartbeat" message.
+// TopCPU and TopMemory are the busiest processes since the previous
+// heartbeat, so the dashboard can show what is slowing a machine down
+// without a session; agents started with -top-processes=false omit them.
+// RebootRequired reports a pending reboot (Windows servicing or update
+// flags, /var/run/reboot-required, restart-requiring macOS updates), with
+// what asked for it in RebootReasons. Health is absent from agents that
+// predate it. Time is the agent's clock when it sent the heartbeat, in
+// Unix milliseconds, from which the server measures the clock's drift;
+// TimeSync is the state of the OS time service. Both are absent from
+// agents that predate them.
+type Heartbeat struct {
+	UptimeSeconds  int64         `json:"uptime_seconds,omitempty"`
+	RebootRequired bool          `json:"reboot_required,omitempty"`
+	RebootReasons  []string      `json:"reboot_reasons,omitempty"`
+	TopCPU         []ProcessInfo `json:"top_cpu,omitempty"`
+	TopMemory      []ProcessInfo `json:"top_memory,omitempty"`
+	Health         *Health       `json:"health,omitempty"`
+	Time           int64         `json:"time,omitempty"`
+	TimeSync       *TimeSync     `json:"time_sync,omitempty"`
+}
+
+// TimeSync is the state of a machine's time synchronization as its OS
+// reports it: the service keeping time (w32time, chrony,
+// systemd-timesyncd, ntpd or sntp), whether it is enabled and currently
+// synchronized, the time source, and the offset from that source the
+// service last measured, in milliseconds (positive when the local clock
+// is ahead). Offset is zero when the service does not report one.
+type TimeSync struct {
+	Service      string  `json:"service,omitempty"`
+	Enabled      bool    `json:"enabled"`
+	Synchronized bool    `json:"synchronized"`
+	Source       string  `json:"source,omitempty"`
+	OffsetMS     float64 `json:"offset_ms,omitempty"`
+}
+
+// Health is a machine's load and free resources at a heartbeat. CPU is
+// the share of all cores used since the previous heartbeat (0–100);
+// MemoryFree is available memory and DiskFree the free space on the
+// system volume, both in bytes.
+type Health struct {
+	CPU        float64 `json:"cpu_percent"`
+	MemoryFree uint64  `json:"memory_free"`
+	DiskFree   uint64  `json:"disk_free"`
+}
+
+// ProcessInfo summarises one process. CPU is the share of one core used
+// since the previous heartbeat, so it can exceed 100 on multi-core hosts;
+// Memory is the resident set (working set on Windows) in bytes.
+type ProcessInfo struct {
+	PID    int     `json:"pid"`
+	Name   string  `json:"name"`
+	CPU    float64 `json:"cpu_percent"`
+	Memory uint64  `json:"memory"`
+}
@@ -0,0 +1,42 @@
+package protocol
+
+import "time"
+
+// Provisioning: a pre-seeded agent configuration baked into a golden
+// image or delivered by an MDM profile. The agent enrolls itself with it
+// on first boot, and again when it finds itself on a clone of the machine
+// it enrolled on.
+
+// ProvisioningFile is the file name the agent looks for next to its
+// configuration.
+const ProvisioningFile = "provision.json"
+
+// Provisioning is the pre-seeded configuration. Code is a multi-use
+// provisioning token; Fingerprint pins the server's platform identity and
+// CACert, when the server uses its own CA, the certificate it presents.
+type Provisioning struct {
+	ServerURL   string    `json:"server_url"`
+	Code        string    `json:"code"`
+	Fingerprint string    `json:"platform_fingerprint"`
+	CACert      string    `json:"ca_certificate,omitempty"`
+	TokenID     string    `json:"token_id"`
+	Image       string    `json:"image,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Reasons an agent enrolls itself from its provisioning file.
+const (
+	ProvisionFirstBoot = "first_boot" // no configuration yet
+	ProvisionCloned    = "cloned"     // configuration enrolled on another machine
+)
+
+// Provenance is what an agent enrolling from its provisioning file
+// reports about where it came from. Image may carry more than the token's
+// own label, since image builds may stamp the file with their build.
+type Provenance struct {
+	TokenID    string    `json:"token_id"`
+	Image      string    `json:"image,omitempty"`
+	Reason     string    `json:"reason"`
+	ClonedFrom string    `json:"cloned_from,omitempty"` // agent ID the image carried
+	CreatedAt  time.Time `json:"created_at"`            // when the provisioning file was generated
+}
@@ -0,0 +1,35 @@
+package protocol
+
+// Registry operations carried in RegistryRequest.
+const (
+	RegistryRead  = "read"
+	RegistryWrite = "write"
+)
+
+// RegistryRequest asks the agent to read or write one OS-level setting.
+// Path and Name are interpreted per platform:
+//
+//   - Windows: registry key (e.g. HKLM\SOFTWARE\Vendor) and value name
+//   - macOS:   defaults domain (e.g. com.apple.screensaver) and key
+//   - Linux:   gsettings schema (e.g. org.gnome.desktop.interface) and key
+//
+// Type selects the value type for writes: string, expand_string, dword or
+// qword on Windows; string, int, float or bool on macOS. Linux takes the
+// value as a GVariant literal and ignores Type.
+type RegistryRequest struct {
+	ID    string `json:"id"`
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+	Type  string `json:"type,omitempty"`
+}
+
+// RegistryResult answers the RegistryRequest with the same ID. For reads
+// Value holds the current value as text.
+type RegistryResult struct {
+	ID    string `json:"id"`
+	Value string `json:"value,omitempty"`
+	Type  string `json:"type,omitempty"`
+	Error string `json:"error,omitempty"`
+}
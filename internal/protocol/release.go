@@ -0,0 +1,22 @@
+package protocol
+
+import "crypto/sha256"
+
+// Signed releases. A deployment signs its agent builds with the platform
+// key ("rmmctl sign"), leaving a detached signature beside each binary:
+// the base64 Ed25519 signature over ReleaseDigest, in a file named
+// ReleaseSignatureSuffix after the binary. An agent built with the
+// platform's public key embedded checks its own binary against it before
+// it starts, and refuses to run if the binary was altered after signing.
+
+// ReleaseSignatureSuffix names a binary's detached signature file.
+const ReleaseSignatureSuffix = ".sig"
+
+// ReleaseDigest is the SHA-256 digest the platform key signs for an agent
+// binary whose SHA-256 is binarySum.
+func ReleaseDigest(binarySum []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("rmm-release-v1\x00"))
+	h.Write(binarySum)
+	return h.Sum(nil)
+}
@@ -0,0 +1,19 @@
+package protocol
+
+// ScreenshotRequest asks the agent for a single JPEG capture of a
+// display, outside any viewer session. Display 0 means the primary
+// display.
+type ScreenshotRequest struct {
+	ID      string `json:"id"`
+	Display int    `json:"display,omitempty"`
+}
+
+// ScreenshotResult answers the ScreenshotRequest with the same ID. Image
+// holds the JPEG (base64 in JSON). A failed capture sets Error rather
+// than substituting a placeholder image.
+type ScreenshotResult struct {
+	ID      string `json:"id"`
+	Display int    `json:"display"`
+	Image   []byte `json:"image,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
@@ -0,0 +1,103 @@
+package protocol
+
+import "strings"
+
+// Software deployment: the server asks an agent to install or remove a
+// package with the platform's package manager, and the agent answers
+// once the manager has finished.
+
+// Package managers a SoftwareRequest can name.
+const (
+	ManagerApt   = "apt"   // Debian and Ubuntu (apt-get)
+	ManagerBrew  = "brew"  // macOS (Homebrew)
+	ManagerChoco = "choco" // Windows (Chocolatey)
+)
+
+// Installer formats served from the server's package repository. A
+// SoftwareRequest naming one installs the file staged by its Artifact
+// upload instead of a package from the manager's repositories.
+const (
+	ManagerDeb = "deb" // Debian package, installed with apt-get (or dpkg)
+	ManagerPkg = "pkg" // macOS installer package
+	ManagerMSI = "msi" // Windows Installer package
+)
+
+// Actions carried in SoftwareRequest.
+const (
+	SoftwareInstall   = "install"
+	SoftwareUninstall = "uninstall"
+)
+
+// ManagerOS is the operating system (runtime.GOOS) each package manager
+// is deployed to.
+var ManagerOS = map[string]string{
+	ManagerApt:   "linux",
+	ManagerBrew:  "darwin",
+	ManagerChoco: "windows",
+	ManagerDeb:   "linux",
+	ManagerPkg:   "darwin",
+	ManagerMSI:   "windows",
+}
+
+// InstallerManager reports whether manager installs a file from the
+// server's package repository rather than a named package.
+func InstallerManager(manager string) bool {
+	return manager == ManagerDeb || manager == ManagerPkg || manager == ManagerMSI
+}
+
+const (
+	// DefaultSoftwareTimeout and MaxSoftwareTimeout bound how long the
+	// package manager may run, in seconds.
+	DefaultSoftwareTimeout = 30 * 60
+	MaxSoftwareTimeout     = 4 * 60 * 60
+
+	// MaxSoftwareOutput caps the log returned in a SoftwareResult; the
+	// agent keeps the end, where failures are reported.
+	MaxSoftwareOutput = 64 << 10
+)
+
+// SoftwareRequest asks the agent to install or uninstall Package with
+// Manager, pinned to Version if set. The agent gives up after Timeout
+// seconds.
+//
+// For an installer format (see InstallerManager) the action is always an
+// install, Package is the installer's file name, and Artifact is the ID
+// of the FilePurposePackage upload that staged it. The agent refuses to
+// run the file unless its digest matches SHA256, which, unlike the
+// upload, is covered by the command signature.
+type SoftwareRequest struct {
+	ID       string `json:"id"`
+	Manager  string `json:"manager"`
+	Action   string `json:"action"`
+	Package  string `json:"package"`
+	Version  string `json:"version,omitempty"`
+	Artifact string `json:"artifact,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Timeout  int    `json:"timeout"`
+}
+
+// SoftwareResult answers the SoftwareRequest with the same ID with the
+// manager's exit code and the tail of its output. Error is set if it
+// could not run or did not succeed.
+type SoftwareResult struct {
+	ID       string `json:"id"`
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ValidPackageName reports whether name can be passed to a package
+// manager as a package name: letters, digits and ._+@/- (Homebrew taps
+// contain slashes), not starting with "-" so it is never read as an
+// option.
+func ValidPackageName(name string) bool {
+	return name != "" && len(name) <= 200 && !strings.HasPrefix(name, "-") &&
+		strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._+@/-") == ""
+}
+
+// ValidPackageVersion reports whether version is a plausible version
+// string for any of the managers (apt's include epochs and tildes).
+func ValidPackageVersion(version string) bool {
+	return version != "" && len(version) <= 100 && !strings.HasPrefix(version, "-") &&
+		strings.Trim(version, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.+~:_-") == ""
+}
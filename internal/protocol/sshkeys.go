@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// SSH key operations carried in SSHKeysRequest.
+const (
+	SSHKeysList  = "list"
+	SSHKeysApply = "apply"
+)
+
+// SSHKeysBegin and SSHKeysEnd delimit the block of a user's
+// authorized_keys file the agent manages. Lines outside it are left
+// alone.
+const (
+	SSHKeysBegin = "# BEGIN rmm managed keys"
+	SSHKeysEnd   = "# END rmm managed keys"
+)
+
+// SSHKeysRequest asks a Linux or macOS agent to list User's authorized
+// SSH keys, or to replace its managed block with Keys (authorized_keys
+// lines; none removes the block).
+type SSHKeysRequest struct {
+	ID   string   `json:"id"`
+	Op   string   `json:"op"`
+	User string   `json:"user"`
+	Keys []string `json:"keys,omitempty"`
+}
+
+// SSHKeysResult answers the SSHKeysRequest with the same ID, giving the
+// keys in the managed block and those added outside it, after any
+// change.
+type SSHKeysResult struct {
+	ID        string   `json:"id"`
+	Managed   []string `json:"managed"`
+	Unmanaged []string `json:"unmanaged,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// sshKeyTypes are the public key algorithms accepted in authorized_keys
+// lines.
+var sshKeyTypes = map[string]bool{
+	"ssh-ed25519":                        true,
+	"ssh-rsa":                            true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"sk-ssh-ed25519@openssh.com":         true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+// ParseSSHKey parses a public key in authorized_keys form without
+// options ("<type> <base64> [comment]"), checking that the encoded key
+// names the same type. It returns the type and base64 fields, which
+// identify the key, and its SHA256 fingerprint as ssh-keygen prints it.
+func ParseSSHKey(line string) (typ, data, fingerprint string, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", "", "", errors.New("expected \"<type> <base64> [comment]\"")
+	}
+	typ, data = fields[0], fields[1]
+	if !sshKeyTypes[typ] {
+		return "", "", "", errors.New("unsupported key type " + typ)
+	}
+	blob, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", "", "", errors.New("malformed key data")
+	}
+	if len(blob) < 4 {
+		return "", "", "", errors.New("truncated key data")
+	}
+	n := binary.BigEndian.Uint32(blob)
+	if uint64(n) > uint64(len(blob)-4) || string(blob[4:4+n]) != typ {
+		return "", "", "", errors.New("key data does not match type " + typ)
+	}
+	sum := sha256.Sum256(blob)
+	return typ, data, "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,48 @@
+package protocol
+
+// Startup item kinds reported in StartupItem.Kind.
+const (
+	StartupRunKey       = "run_key"        // Windows Run / RunOnce registry value
+	StartupFolder       = "startup_folder" // Windows Startup folder entry
+	StartupLaunchAgent  = "launch_agent"   // macOS LaunchAgents plist
+	StartupLaunchDaemon = "launch_daemon"  // macOS LaunchDaemons plist
+	StartupSystemd      = "systemd"        // enabled systemd system unit
+	StartupSystemdUser  = "systemd_user"   // enabled systemd user unit
+	StartupXDG          = "xdg_autostart"  // XDG autostart .desktop file
+	StartupCron         = "cron"           // @reboot or scheduled crontab line
+)
+
+// StartupItem is one entry that runs automatically at boot, login or on a
+// schedule. ID is derived from the entry itself, so it stays stable across
+// inventories and identifies the entry in disable requests.
+type StartupItem struct {
+	ID       string `json:"id"`
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Command  string `json:"command,omitempty"`
+	Location string `json:"location"` // registry key, file path or crontab
+	Enabled  bool   `json:"enabled"`
+}
+
+// Startup operations carried in StartupRequest.
+const (
+	StartupList    = "list"
+	StartupDisable = "disable"
+)
+
+// StartupRequest asks the agent for a fresh startup inventory or to
+// disable the item with ID Item.
+type StartupRequest struct {
+	ID   string `json:"id"`
+	Op   string `json:"op"`
+	Item string `json:"item,omitempty"`
+}
+
+// StartupResult answers the StartupRequest with the same ID with the
+// inventory as it stands after the operation.
+type StartupResult struct {
+	ID          string            `json:"id"`
+	Items       []StartupItem     `json:"items"`
+	Environment map[string]string `json:"environment,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
@@ -0,0 +1,15 @@
+package protocol
+
+// MaxSupportMessage bounds the message in a SupportRequest, in bytes.
+const MaxSupportMessage = 1000
+
+// SupportRequest is sent by an agent ("support_request") when its local
+// user asks for help from the tray indicator or the command line. The
+// server raises an alert for it and lets the next technician start an
+// attended session without a consent prompt. Time is set on requests
+// replayed from a Backlog: when the user asked, in Unix milliseconds.
+type SupportRequest struct {
+	Message string `json:"message,omitempty"`
+	User    string `json:"user,omitempty"` // local account that asked
+	Time    int64  `json:"time,omitempty"`
+}
@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+)
+
+// TelemetryReport is what a telemetry-only agent, a device too small to
+// run the agent, publishes to the server's MQTT or NATS broker under a
+// topic naming it. Its first report, sent as is, carries Enroll, an
+// enrollment code, and Secret, chosen by the device and at least 16
+// characters. Later reports go in a TelemetryEnvelope, authenticated with
+// a key derived from the secret, and carry neither. The rest is optional:
+// Health is kept with other agents' health history, Inventory holds
+// further facts (a model, a firmware version) and Metrics readings of the
+// device's own, e.g. a temperature.
+type TelemetryReport struct {
+	Secret string `json:"secret,omitempty"`
+	Enroll string `json:"enroll,omitempty"`
+
+	Name          string             `json:"name,omitempty"`
+	Hostname      string             `json:"hostname,omitempty"`
+	OS            string             `json:"os,omitempty"`
+	OSVersion     string             `json:"os_version,omitempty"`
+	Arch          string             `json:"arch,omitempty"`
+	UptimeSeconds int64              `json:"uptime_seconds,omitempty"`
+	Health        *Health            `json:"health,omitempty"`
+	Inventory     map[string]string  `json:"inventory,omitempty"`
+	Metrics       map[string]float64 `json:"metrics,omitempty"`
+}
+
+// TelemetryEnvelope carries a report from an enrolled device. MAC is the
+// hex HMAC-SHA-256, under TelemetryKey, of the decimal Time, a '.' and
+// Report exactly as sent, so anyone subscribed to the topic can read
+// reports but not forge or replay them.
+type TelemetryEnvelope struct {
+	Report json.RawMessage `json:"report"`
+	Time   int64           `json:"ts"` // Unix seconds
+	MAC    string          `json:"mac"`
+}
+
+// TelemetryKey derives the key a device authenticates its reports with
+// from the secret it enrolled with and its device name.
+func TelemetryKey(secret, device string) []byte {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte("rmm-telemetry-v1\x00"))
+	m.Write([]byte(device))
+	return m.Sum(nil)
+}
+
+// TelemetryMAC returns the MAC of a TelemetryEnvelope sent at ts.
+func TelemetryMAC(key []byte, ts int64, report []byte) string {
+	m := hmac.New(sha256.New, key)
+	m.Write(strconv.AppendInt(nil, ts, 10))
+	m.Write([]byte{'.'})
+	m.Write(report)
+	return hex.EncodeToString(m.Sum(nil))
+}
@@ -0,0 +1,22 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// TestTelemetryMAC pins the report authentication devices implement,
+// against values computed with Python's hmac module.
+func TestTelemetryMAC(t *testing.T) {
+	key := TelemetryKey("a-random-string-of-16-or-more", "cold-room-2")
+	if got, want := hex.EncodeToString(key), "a77550f39875ca9729acdbd69867a3bf1d370cecd079af4e45d349686507b06d"; got != want {
+		t.Fatalf("key = %s, want %s", got, want)
+	}
+	report := []byte(`{"metrics":{"temperature_c":3.9}}`)
+	if got, want := TelemetryMAC(key, 1760000000, report), "bfe8143d09fa078826cf4db2e5a50668d2d2b5fbcdceceb02aed049a61e2778f"; got != want {
+		t.Fatalf("MAC = %s, want %s", got, want)
+	}
+	if TelemetryMAC(key, 1760000001, report) == TelemetryMAC(key, 1760000000, report) {
+		t.Fatal("MAC does not cover the time")
+	}
+}
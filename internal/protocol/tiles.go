@@ -0,0 +1,43 @@
+package protocol
+
+import "encoding/binary"
+
+// Tile frames (BinTiles) update regions of the screen the viewer already
+// has, so an agent can send what changed instead of a whole frame, and
+// send each region in the format that suits it: text-heavy tiles
+// losslessly, photos and video as JPEG. A frame is
+//
+//	[BinTiles][width uint16][height uint16] then, per tile,
+//	[x uint16][y uint16][format uint8][length uint32][image]
+//
+// all big endian. Width and height are those of the frame the tiles
+// belong to; x and y place each tile's top-left corner on it. Viewers ask
+// for tile frames in "session_setup" (see SessionSetup); a BinScreen
+// frame always replaces the whole screen.
+const (
+	TileJPEG byte = 0
+	TilePNG  byte = 1
+
+	tilesHeaderSize = 5
+	tileHeaderSize  = 9
+)
+
+// TilesHeader starts a BinTiles frame for a width × height screen.
+func TilesHeader(width, height int) []byte {
+	frame := make([]byte, tilesHeaderSize, 64<<10)
+	frame[0] = BinTiles
+	binary.BigEndian.PutUint16(frame[1:], uint16(width))
+	binary.BigEndian.PutUint16(frame[3:], uint16(height))
+	return frame
+}
+
+// AppendTile appends a tile at x, y, encoded as format, to a BinTiles
+// frame.
+func AppendTile(frame []byte, x, y int, format byte, img []byte) []byte {
+	var hdr [tileHeaderSize]byte
+	binary.BigEndian.PutUint16(hdr[0:], uint16(x))
+	binary.BigEndian.PutUint16(hdr[2:], uint16(y))
+	hdr[4] = format
+	binary.BigEndian.PutUint32(hdr[5:], uint32(len(img)))
+	return append(append(frame, hdr[:]...), img...)
+}
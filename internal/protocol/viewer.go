@@ -0,0 +1,62 @@
+package protocol
+
+// Viewer permissions. Each viewer session has a mask of them, derived by
+// the server from the API key's role and the agent's policy; the server
+// relays only the messages the mask allows, and tells the viewer and the
+// agent what it is.
+const (
+	PermView     = "view"     // watch the screen and switch displays
+	PermInput    = "input"    // inject keyboard and mouse input
+	PermFiles    = "files"    // upload files and print
+	PermTerminal = "terminal" // terminal sessions (reserved; see BinTerminal)
+)
+
+// AllPermissions lists every viewer permission.
+var AllPermissions = []string{PermView, PermInput, PermFiles, PermTerminal}
+
+// ValidPermission reports whether p names a viewer permission.
+func ValidPermission(p string) bool {
+	switch p {
+	case PermView, PermInput, PermFiles, PermTerminal:
+		return true
+	}
+	return false
+}
+
+// viewerMessages maps each message a viewer may send to the permission
+// it needs.
+var viewerMessages = map[string]string{
+	"switch_display":  PermView,
+	"set_view":        PermView,
+	"set_resolution":  PermView,
+	"session_setup":   PermView,
+	"frame_displayed": PermView,
+	"input":           PermInput,
+	"file_start":      PermFiles,
+	"file_end":        PermFiles,
+}
+
+// ViewerMessagePermission reports the permission a viewer needs to send
+// msgType, and false for messages viewers never send.
+func ViewerMessagePermission(msgType string) (string, bool) {
+	p, ok := viewerMessages[msgType]
+	return p, ok
+}
+
+// ViewerChannelPermission reports the permission a viewer needs to send
+// on binary channel ch, and false for channels viewers never send on.
+func ViewerChannelPermission(ch byte) (string, bool) {
+	switch ch {
+	case BinFile:
+		return PermFiles, true
+	case BinTerminal:
+		return PermTerminal, true
+	}
+	return "", false
+}
+
+// SessionPermissions is the payload of "session_permissions", sent to the
+// viewer when it connects: what the session may do.
+type SessionPermissions struct {
+	Permissions []string `json:"permissions"`
+}
@@ -5,9 +5,12 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
-	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"unicode/utf8"
 )
 
 // WebSocket GUID per RFC 6455 section 4.2.2.
@@ -20,101 +23,216 @@ func AcceptKey(key string) string {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
+// MaxFrameSize is the largest frame payload ReadFrame accepts. The
+// biggest frames on the wire are full screen images, well under it.
+const MaxFrameSize = 64 << 20
+
+// maxControlPayload is the largest payload of a control frame (close,
+// ping, pong), RFC 6455 section 5.5.
+const maxControlPayload = 125
+
+// Errors returned by ReadFrame for frames it refuses. Peers on either end
+// are this repository's agent, server and viewers, none of which set
+// extension bits or fragment messages, so a frame that does is treated as
+// hostile rather than supported.
+var (
+	ErrFrameTooLarge = errors.New("websocket: frame larger than MaxFrameSize")
+	ErrFragmented    = errors.New("websocket: fragmented messages are not supported")
+	ErrInvalidUTF8   = errors.New("websocket: text frame is not valid UTF-8")
+	ErrBadFrame      = errors.New("websocket: malformed frame")
+)
+
+// maxPooledFrame is the largest buffer kept for reuse; bigger frames get
+// one-off allocations so a rare large frame does not pin its memory.
+const maxPooledFrame = 4 << 20
+
+// framePool recycles the buffers outgoing frames are assembled in.
+var framePool = sync.Pool{New: func() any { return new([]byte) }}
+
 // ReadFrame reads a single WebSocket frame from r.
-// It handles extended payload lengths and optional masking.
+// It handles extended payload lengths and optional masking, and refuses
+// frames with reserved bits or opcodes, fragments, oversized payloads
+// and text that is not UTF-8, before reading their payload where it can.
 func ReadFrame(r *bufio.Reader) (opcode byte, payload []byte, err error) {
-	header := make([]byte, 2)
-	if _, err = io.ReadFull(r, header); err != nil {
+	return readFrame(r, nil)
+}
+
+// FrameReader reads frames into a buffer it reuses, so a relay loop
+// allocates only when a frame outgrows every earlier one. Each payload is
+// valid until the next call to Next; callers that keep one must copy it.
+type FrameReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+// NewFrameReader returns a FrameReader reading from r.
+func NewFrameReader(r *bufio.Reader) *FrameReader {
+	return &FrameReader{r: r}
+}
+
+// Next reads the next frame, as ReadFrame does.
+func (fr *FrameReader) Next() (opcode byte, payload []byte, err error) {
+	opcode, payload, err = readFrame(fr.r, fr.buf)
+	if cap(payload) > cap(fr.buf) && cap(payload) <= maxPooledFrame {
+		fr.buf = payload[:0]
+	}
+	return opcode, payload, err
+}
+
+// readFrame reads a frame, placing the payload in buf when it fits.
+// The header is read byte by byte so that it needs no allocation.
+func readFrame(r *bufio.Reader, buf []byte) (opcode byte, payload []byte, err error) {
+	b0, err := r.ReadByte()
+	if err != nil {
 		return 0, nil, err
 	}
+	b1, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	opcode = b0 & 0x0F
+	masked := (b1 & 0x80) != 0
+	length := uint64(b1 & 0x7F)
+	control := opcode >= OpClose
 
-	opcode = header[0] & 0x0F
-	masked := (header[1] & 0x80) != 0
-	length := uint64(header[1] & 0x7F)
+	switch {
+	case b0&0x70 != 0:
+		return 0, nil, fmt.Errorf("%w: reserved bits set", ErrBadFrame)
+	case opcode > OpBinary && opcode < OpClose, opcode > OpPong:
+		return 0, nil, fmt.Errorf("%w: reserved opcode %#x", ErrBadFrame, opcode)
+	case b0&0x80 == 0, opcode == OpContinue:
+		if control {
+			return 0, nil, fmt.Errorf("%w: fragmented control frame", ErrBadFrame)
+		}
+		return 0, nil, ErrFragmented
+	case control && length > maxControlPayload:
+		return 0, nil, fmt.Errorf("%w: control frame payload over %d bytes", ErrBadFrame, maxControlPayload)
+	}
 
+	var extLen int
 	switch length {
 	case 126:
-		ext := make([]byte, 2)
-		if _, err = io.ReadFull(r, ext); err != nil {
-			return 0, nil, err
-		}
-		length = uint64(binary.BigEndian.Uint16(ext))
+		extLen = 2
 	case 127:
-		ext := make([]byte, 8)
-		if _, err = io.ReadFull(r, ext); err != nil {
-			return 0, nil, err
+		extLen = 8
+	}
+	if extLen > 0 {
+		length = 0
+		for i := 0; i < extLen; i++ {
+			c, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			length = length<<8 | uint64(c)
+		}
+		// Lengths must use the shortest form.
+		if (extLen == 2 && length < 126) || (extLen == 8 && length < 65536) {
+			return 0, nil, fmt.Errorf("%w: length not minimally encoded", ErrBadFrame)
 		}
-		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > MaxFrameSize {
+		return 0, nil, ErrFrameTooLarge
 	}
 
-	var maskKey []byte
+	var maskKey [4]byte
 	if masked {
-		maskKey = make([]byte, 4)
-		if _, err = io.ReadFull(r, maskKey); err != nil {
-			return 0, nil, err
+		for i := range maskKey {
+			if maskKey[i], err = r.ReadByte(); err != nil {
+				return 0, nil, err
+			}
 		}
 	}
 
-	payload = make([]byte, length)
+	if uint64(cap(buf)) >= length {
+		payload = buf[:length]
+	} else {
+		payload = make([]byte, length)
+	}
 	if _, err = io.ReadFull(r, payload); err != nil {
 		return 0, nil, err
 	}
 
 	if masked {
 		for i := range payload {
-			payload[i] ^= maskKey[i%4]
+			payload[i] ^= maskKey[i&3]
 		}
 	}
+	if opcode == OpText && !utf8.Valid(payload) {
+		return 0, nil, ErrInvalidUTF8
+	}
 
 	return opcode, payload, nil
 }
 
-// WriteServerFrame writes an unmasked WebSocket frame (server → client).
-func WriteServerFrame(conn net.Conn, opcode byte, payload []byte) error {
-	length := len(payload)
-
-	// Pre-allocate: 2-byte header + up to 8 extended length bytes + payload
-	frame := make([]byte, 0, 2+8+length)
-	frame = append(frame, 0x80|opcode)
-
+// appendHeader appends a frame header for a payload of length bytes,
+// with the mask bit set when masked.
+func appendHeader(dst []byte, opcode byte, length int, masked bool) []byte {
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	dst = append(dst, 0x80|opcode)
 	switch {
 	case length < 126:
-		frame = append(frame, byte(length))
+		dst = append(dst, byte(length)|maskBit)
 	case length < 65536:
-		frame = append(frame, 126, byte(length>>8), byte(length))
+		dst = append(dst, 126|maskBit, byte(length>>8), byte(length))
 	default:
-		frame = append(frame, 127)
+		dst = append(dst, 127|maskBit)
 		for i := 7; i >= 0; i-- {
-			frame = append(frame, byte(length>>(i*8)))
+			dst = append(dst, byte(length>>(i*8)))
 		}
 	}
+	return dst
+}
+
+// getFrameBuf returns an empty pooled buffer with room for n bytes.
+func getFrameBuf(n int) *[]byte {
+	bp := framePool.Get().(*[]byte)
+	if cap(*bp) < n {
+		*bp = make([]byte, 0, n)
+	}
+	*bp = (*bp)[:0]
+	return bp
+}
+
+func putFrameBuf(bp *[]byte) {
+	if cap(*bp) <= maxPooledFrame {
+		framePool.Put(bp)
+	}
+}
 
+// WriteServerFrame writes an unmasked WebSocket frame (server → client).
+// Larger payloads on plain TCP connections go out with their header in
+// one writev, without copying; otherwise the frame is assembled in a
+// pooled buffer. Either way the frame is a single write, so frames from
+// concurrent writers never interleave.
+func WriteServerFrame(conn io.Writer, opcode byte, payload []byte) error {
+	if tcp, ok := conn.(*net.TCPConn); ok && len(payload) >= 1024 {
+		bufs := net.Buffers{appendHeader(make([]byte, 0, 10), opcode, len(payload), false), payload}
+		_, err := bufs.WriteTo(tcp)
+		return err
+	}
+
+	bp := getFrameBuf(10 + len(payload))
+	defer putFrameBuf(bp)
+	frame := appendHeader(*bp, opcode, len(payload), false)
 	frame = append(frame, payload...)
 	_, err := conn.Write(frame)
+	*bp = frame
 	return err
 }
 
-// WriteClientFrame writes a masked WebSocket frame (client → server).
+// WriteClientFrame writes a masked WebSocket frame (client → server),
+// masking the payload into a pooled buffer.
 func WriteClientFrame(conn net.Conn, opcode byte, payload []byte) error {
 	length := len(payload)
+	bp := getFrameBuf(14 + length)
+	defer putFrameBuf(bp)
 
-	// Pre-allocate: 2-byte header + up to 8 extended + 4 mask + payload
-	frame := make([]byte, 0, 2+8+4+length)
-	frame = append(frame, 0x80|opcode)
-
-	switch {
-	case length < 126:
-		frame = append(frame, byte(length)|0x80)
-	case length < 65536:
-		frame = append(frame, 126|0x80, byte(length>>8), byte(length))
-	default:
-		frame = append(frame, 127|0x80)
-		for i := 7; i >= 0; i-- {
-			frame = append(frame, byte(length>>(i*8)))
-		}
-	}
-
-	maskKey := [4]byte{}
+	frame := appendHeader(*bp, opcode, length, true)
+	var maskKey [4]byte
 	rand.Read(maskKey[:]) //nolint:errcheck
 	frame = append(frame, maskKey[:]...)
 
@@ -126,5 +244,6 @@ func WriteClientFrame(conn net.Conn, opcode byte, payload []byte) error {
 	}
 
 	_, err := conn.Write(frame)
+	*bp = frame
 	return err
 }
@@ -0,0 +1,27 @@
+package protocol
+
+import (
+	"bufio"
+	"testing"
+)
+
+func TestFrameCases(t *testing.T) {
+	for _, failure := range CheckFrames(ReadFrame) {
+		t.Error(failure)
+	}
+	reader := func(r *bufio.Reader) (byte, []byte, error) { return NewFrameReader(r).Next() }
+	for _, failure := range CheckFrames(reader) {
+		t.Error("FrameReader: " + failure)
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	for _, c := range FrameCases {
+		f.Add(c.Raw)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if _, err := checkStream(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,492 @@
+// Package qr renders short strings as QR codes (ISO/IEC 18004) without
+// third-party dependencies. It supports byte-mode encoding at error
+// correction level M for versions 1–10 (up to 213 bytes), which comfortably
+// fits a server URL plus an enrollment code.
+package qr
+
+import (
+	"errors"
+)
+
+// maxVersion is the largest QR version this encoder produces.
+const maxVersion = 10
+
+// Level M error-correction parameters, indexed by version (index 0 unused).
+var (
+	eccPerBlock = [maxVersion + 1]int{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26}
+	numBlocks   = [maxVersion + 1]int{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5}
+)
+
+// alignmentPositions lists alignment-pattern centre coordinates per version.
+var alignmentPositions = [maxVersion + 1][]int{
+	nil, nil,
+	{6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// ErrTooLong is returned when the input does not fit in a version-10 symbol.
+var ErrTooLong = errors.New("qr: data too long")
+
+// Code is an encoded QR symbol.
+type Code struct {
+	Size     int // modules per side, excluding the quiet zone
+	modules  [][]bool
+	function [][]bool
+}
+
+// Dark reports whether the module at column x, row y is dark.
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// Encode encodes text in byte mode, choosing the smallest version that fits
+// and the mask with the lowest penalty score.
+func Encode(text string) (*Code, error) {
+	data := []byte(text)
+
+	version := 0
+	for v := 1; v <= maxVersion; v++ {
+		if len(data) <= dataCapacity(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+
+	codewords := addECCAndInterleave(encodeData(data, version), version)
+
+	size := version*4 + 17
+	c := &Code{Size: size, modules: newGrid(size), function: newGrid(size)}
+	c.drawFunctionPatterns(version)
+	c.drawCodewords(codewords)
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormatBits(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // XOR again to undo
+	}
+	c.applyMask(best)
+	c.drawFormatBits(best)
+
+	return c, nil
+}
+
+// dataCapacity returns the number of payload bytes a version holds in
+// byte mode at level M.
+func dataCapacity(version int) int {
+	bits := dataCodewords(version) * 8
+	bits -= 4 + charCountBits(version)
+	return bits / 8
+}
+
+func charCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// rawCodewords returns the number of codewords (data + ECC) in a symbol.
+func rawCodewords(version int) int {
+	bits := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		bits -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			bits -= 36
+		}
+	}
+	return bits / 8
+}
+
+func dataCodewords(version int) int {
+	return rawCodewords(version) - eccPerBlock[version]*numBlocks[version]
+}
+
+// encodeData builds the padded data codeword sequence in byte mode.
+func encodeData(data []byte, version int) []byte {
+	var bb bitBuffer
+	bb.append(0x4, 4) // byte mode
+	bb.append(uint32(len(data)), charCountBits(version))
+	for _, b := range data {
+		bb.append(uint32(b), 8)
+	}
+
+	capacity := dataCodewords(version) * 8
+	term := capacity - len(bb)
+	if term > 4 {
+		term = 4
+	}
+	bb.append(0, term)
+	bb.append(0, (8-len(bb)%8)%8)
+	for pad := uint32(0xEC); len(bb) < capacity; pad ^= 0xEC ^ 0x11 {
+		bb.append(pad, 8)
+	}
+
+	out := make([]byte, len(bb)/8)
+	for i, bit := range bb {
+		if bit {
+			out[i>>3] |= 1 << (7 - uint(i&7))
+		}
+	}
+	return out
+}
+
+// addECCAndInterleave splits data into blocks, appends Reed-Solomon ECC to
+// each, and interleaves the result as the symbol requires.
+func addECCAndInterleave(data []byte, version int) []byte {
+	blocks := numBlocks[version]
+	eccLen := eccPerBlock[version]
+	raw := rawCodewords(version)
+	numShort := blocks - raw%blocks
+	shortLen := raw / blocks
+
+	divisor := rsDivisor(eccLen)
+	all := make([][]byte, 0, blocks)
+	k := 0
+	for i := 0; i < blocks; i++ {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		dat := append([]byte(nil), data[k:k+n]...)
+		k += n
+		ecc := rsRemainder(dat, divisor)
+		if i < numShort {
+			dat = append(dat, 0) // placeholder so all blocks align
+		}
+		all = append(all, append(dat, ecc...))
+	}
+
+	result := make([]byte, 0, raw)
+	for i := range all[0] {
+		for j, blk := range all {
+			if i != shortLen-eccLen || j >= numShort {
+				result = append(result, blk[i])
+			}
+		}
+	}
+	return result
+}
+
+// --- Function patterns ---
+
+func (c *Code) drawFunctionPatterns(version int) {
+	for i := 0; i < c.Size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+
+	c.drawFinder(3, 3)
+	c.drawFinder(c.Size-4, 3)
+	c.drawFinder(3, c.Size-4)
+
+	pos := alignmentPositions[version]
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue // overlaps a finder pattern
+			}
+			c.drawAlignment(pos[i], pos[j])
+		}
+	}
+
+	c.drawFormatBits(0) // reserve; overwritten once the mask is chosen
+	c.drawVersion(version)
+}
+
+func (c *Code) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || x >= c.Size || y < 0 || y >= c.Size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			c.setFunction(x, y, d != 2 && d != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignment(cx, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormatBits writes both copies of the 15-bit format information
+// (level M, given mask) plus the always-dark module.
+func (c *Code) drawFormatBits(mask int) {
+	const levelM = 0
+	data := levelM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(bits, i))
+	}
+	c.setFunction(8, 7, bit(bits, 6))
+	c.setFunction(8, 8, bit(bits, 7))
+	c.setFunction(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(bits, i))
+	}
+
+	for i := 0; i < 8; i++ {
+		c.setFunction(c.Size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.Size-15+i, bit(bits, i))
+	}
+	c.setFunction(8, c.Size-8, true)
+}
+
+// drawVersion writes the 18-bit version information blocks (version ≥ 7).
+func (c *Code) drawVersion(version int) {
+	if version < 7 {
+		return
+	}
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		b := bit(bits, i)
+		a, z := c.Size-11+i%3, i/3
+		c.setFunction(a, z, b)
+		c.setFunction(z, a, b)
+	}
+}
+
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+// --- Data placement and masking ---
+
+// drawCodewords places the codeword bits in the zigzag order, skipping
+// function modules. Leftover remainder modules stay light.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert // upward column pair
+				}
+				if !c.function[y][x] && i < len(data)*8 {
+					c.modules[y][x] = data[i>>3]>>(7-uint(i&7))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask XORs the data modules with the given mask pattern.
+// Applying the same mask twice restores the original.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.function[y][x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol per the four ISO/IEC 18004 mask-evaluation
+// rules; lower is better.
+func (c *Code) penalty() int {
+	n := c.Size
+	score := 0
+
+	// Rule 1: runs of five or more same-coloured modules.
+	for y := 0; y < n; y++ {
+		score += runPenalty(func(i int) bool { return c.modules[y][i] }, n)
+	}
+	for x := 0; x < n; x++ {
+		score += runPenalty(func(i int) bool { return c.modules[i][x] }, n)
+	}
+
+	// Rule 2: 2×2 blocks of one colour.
+	for y := 0; y < n-1; y++ {
+		for x := 0; x < n-1; x++ {
+			v := c.modules[y][x]
+			if v == c.modules[y][x+1] && v == c.modules[y+1][x] && v == c.modules[y+1][x+1] {
+				score += 3
+			}
+		}
+	}
+
+	// Rule 3: finder-like 1:1:3:1:1 patterns with four light modules on a side.
+	patterns := [2][11]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+	for y := 0; y < n; y++ {
+		for x := 0; x+11 <= n; x++ {
+			for _, p := range patterns {
+				rowMatch, colMatch := true, true
+				for k := 0; k < 11; k++ {
+					if c.modules[y][x+k] != p[k] {
+						rowMatch = false
+					}
+					if c.modules[x+k][y] != p[k] {
+						colMatch = false
+					}
+				}
+				if rowMatch {
+					score += 40
+				}
+				if colMatch {
+					score += 40
+				}
+			}
+		}
+	}
+
+	// Rule 4: deviation of the dark-module ratio from 50%.
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+		}
+	}
+	total := n * n
+	score += abs(dark*20-total*10) / total * 10
+
+	return score
+}
+
+func runPenalty(at func(int) bool, n int) int {
+	score := 0
+	run := 1
+	for i := 1; i < n; i++ {
+		if at(i) == at(i-1) {
+			run++
+			continue
+		}
+		if run >= 5 {
+			score += run - 2
+		}
+		run = 1
+	}
+	if run >= 5 {
+		score += run - 2
+	}
+	return score
+}
+
+// --- Reed-Solomon over GF(2^8) with polynomial 0x11D ---
+
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := 0; j < degree; j++ {
+			result[j] = gfMul(result[j], root)
+			if j+1 < degree {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+	return result
+}
+
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// --- Helpers ---
+
+type bitBuffer []bool
+
+func (b *bitBuffer) append(val uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (val>>uint(i))&1 == 1)
+	}
+}
+
+func newGrid(size int) [][]bool {
+	g := make([][]bool, size)
+	for i := range g {
+		g[i] = make([]bool, size)
+	}
+	return g
+}
+
+func bit(x, i int) bool {
+	return (x>>uint(i))&1 != 0
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
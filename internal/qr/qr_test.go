@@ -0,0 +1,120 @@
+package qr
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestRSRemainder checks the error-correction codewords of the
+// "HELLO WORLD" 1-M symbol from ISO/IEC 18004 (and the thonky.com
+// tutorial): 16 data codewords, 10 ECC codewords.
+func TestRSRemainder(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	if got := rsRemainder(data, rsDivisor(eccPerBlock[1])); !bytes.Equal(got, want) {
+		t.Fatalf("ECC = %v, want %v", got, want)
+	}
+	// A single block is not interleaved, so the symbol carries the data
+	// followed by the ECC.
+	if got := addECCAndInterleave(data, 1); !bytes.Equal(got, append(data, want...)) {
+		t.Fatalf("codewords = %v, want %v", got, append(data, want...))
+	}
+}
+
+// TestFormatBits checks both copies of the format information for level M
+// and each mask, most significant bit first.
+func TestFormatBits(t *testing.T) {
+	want := [8]string{
+		"101010000010010",
+		"101000100100101",
+		"101111001111100",
+		"101101101001011",
+		"100010111111001",
+		"100000011001110",
+		"100111110010111",
+		"100101010100000",
+	}
+
+	const size = 21
+	for mask, w := range want {
+		c := &Code{Size: size, modules: newGrid(size), function: newGrid(size)}
+		c.drawFormatBits(mask)
+
+		// Around the top-left finder: row 8 left to right, then column 8
+		// upwards, skipping the timing pattern.
+		var first strings.Builder
+		for x := 0; x <= 8; x++ {
+			if x != 6 {
+				first.WriteString(module(c, x, 8))
+			}
+		}
+		for y := 7; y >= 0; y-- {
+			if y != 6 {
+				first.WriteString(module(c, 8, y))
+			}
+		}
+		// Split between the other two finders: column 8 upwards from the
+		// bottom, then row 8 to the right edge.
+		var second strings.Builder
+		for y := size - 1; y >= size-7; y-- {
+			second.WriteString(module(c, 8, y))
+		}
+		for x := size - 8; x < size; x++ {
+			second.WriteString(module(c, x, 8))
+		}
+
+		if first.String() != w {
+			t.Errorf("mask %d: first copy = %s, want %s", mask, first.String(), w)
+		}
+		if second.String() != w {
+			t.Errorf("mask %d: second copy = %s, want %s", mask, second.String(), w)
+		}
+		if !c.Dark(8, size-8) {
+			t.Errorf("mask %d: dark module is light", mask)
+		}
+	}
+}
+
+// TestVersion7 checks the size and version information of the first
+// version that carries it.
+func TestVersion7(t *testing.T) {
+	c, err := Encode(strings.Repeat("a", dataCapacity(6)+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Size != 45 {
+		t.Fatalf("size = %d, want 45 (version 7)", c.Size)
+	}
+
+	const want = "000111110010010100" // 0x07C94, most significant bit first
+	var topRight, bottomLeft strings.Builder
+	for i := 17; i >= 0; i-- {
+		a, z := c.Size-11+i%3, i/3
+		topRight.WriteString(module(c, a, z))
+		bottomLeft.WriteString(module(c, z, a))
+	}
+	if topRight.String() != want {
+		t.Errorf("top-right version info = %s, want %s", topRight.String(), want)
+	}
+	if bottomLeft.String() != want {
+		t.Errorf("bottom-left version info = %s, want %s", bottomLeft.String(), want)
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	if _, err := Encode(strings.Repeat("a", dataCapacity(maxVersion))); err != nil {
+		t.Fatalf("Encode at capacity: %v", err)
+	}
+	if _, err := Encode(strings.Repeat("a", dataCapacity(maxVersion)+1)); err != ErrTooLong {
+		t.Fatalf("Encode over capacity: err = %v, want ErrTooLong", err)
+	}
+}
+
+func module(c *Code, x, y int) string {
+	if c.Dark(x, y) {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,63 @@
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// quietZone is the mandatory light border, in modules.
+const quietZone = 4
+
+// PNG renders the symbol as a black-on-white PNG with scale pixels per
+// module, including the quiet zone.
+func (c *Code) PNG(scale int) ([]byte, error) {
+	if scale < 1 {
+		scale = 1
+	}
+	dim := (c.Size + 2*quietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, dim, dim), color.Palette{color.White, color.Black})
+
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.modules[y][x] {
+				continue
+			}
+			px, py := (x+quietZone)*scale, (y+quietZone)*scale
+			for dy := 0; dy < scale; dy++ {
+				row := img.Pix[(py+dy)*img.Stride:]
+				for dx := 0; dx < scale; dx++ {
+					row[px+dx] = 1
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG renders the symbol as a scalable SVG document. Each dark module is a
+// unit square in a single path, so the output scales cleanly to any size.
+func (c *Code) SVG() string {
+	dim := c.Size + 2*quietZone
+
+	var path strings.Builder
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+quietZone, y+quietZone)
+			}
+		}
+	}
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		dim, dim, path.String())
+}
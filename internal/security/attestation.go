@@ -0,0 +1,46 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// ErrAttestationFailed is returned when an attestation signature does not
+// verify against the agent's registered key.
+var ErrAttestationFailed = errors.New("attestation signature invalid")
+
+// ParseAttestationKey decodes a base64 PKIX public key. Only ECDSA P-256,
+// which every TPM 2.0 supports, is accepted.
+func ParseAttestationKey(b64 string) (*ecdsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("attestation key: %w", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("attestation key: %w", err)
+	}
+	ec, ok := pub.(*ecdsa.PublicKey)
+	if !ok || ec.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("attestation key: must be ECDSA P-256")
+	}
+	return ec, nil
+}
+
+// VerifyAttestation checks a base64 ASN.1 ECDSA signature over digest
+// with the base64 PKIX key.
+func VerifyAttestation(keyB64 string, digest []byte, sigB64 string) error {
+	pub, err := ParseAttestationKey(keyB64)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(sigB64)
+	if err != nil || !ecdsa.VerifyASN1(pub, digest, sig) {
+		return ErrAttestationFailed
+	}
+	return nil
+}
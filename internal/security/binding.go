@@ -0,0 +1,62 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+// ErrBindingMismatch is returned when an enrolling machine does not match
+// the identity an enrollment token is bound to.
+var ErrBindingMismatch = errors.New("enrollment token is bound to a different machine")
+
+// MachineIdentity is what an enrolling agent reports about itself.
+type MachineIdentity struct {
+	Hostname  string
+	MACs      []string
+	MachineID string
+}
+
+// NormalizeMAC parses a MAC address in any common notation and returns it
+// in lower-case colon form.
+func NormalizeMAC(s string) (string, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(s))
+	if err != nil {
+		return "", fmt.Errorf("invalid MAC address: %s", s)
+	}
+	return hw.String(), nil
+}
+
+// NormalizeMachineID lower-cases a machine UUID and strips braces, so
+// SMBIOS, Windows, and macOS renderings of the same ID compare equal.
+func NormalizeMachineID(s string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(s), "{}"))
+}
+
+// CheckBinding verifies id against every binding set on t. A token with no
+// bindings accepts any machine. The returned error wraps ErrBindingMismatch
+// and names the first binding that failed.
+func CheckBinding(t *store.EnrollmentToken, id MachineIdentity) error {
+	if t.BindHostname != "" && !store.HostnameMatches(t.BindHostname, id.Hostname) {
+		return fmt.Errorf("%w: hostname", ErrBindingMismatch)
+	}
+	if t.BindMAC != "" {
+		found := false
+		for _, m := range id.MACs {
+			if n, err := NormalizeMAC(m); err == nil && n == t.BindMAC {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: mac", ErrBindingMismatch)
+		}
+	}
+	if t.BindMachineID != "" && NormalizeMachineID(id.MachineID) != t.BindMachineID {
+		return fmt.Errorf("%w: machine_id", ErrBindingMismatch)
+	}
+	return nil
+}
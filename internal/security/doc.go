@@ -5,6 +5,9 @@
 //   - Platform identity keypair (Ed25519)
 //   - Agent credential signing and verification (HMAC-SHA-512)
 //   - Enrollment token and API key generation
+//   - Enrollment token binding to a machine identity
+//   - TPM key binding signature verification
+//   - Dashboard sessions, CSRF tokens, and viewer tickets
 //   - HTTP authentication middleware
 //
 // # File layout
@@ -13,8 +16,12 @@
 //   - tls_selfsigned.go  Self-signed CA + server certificate generation
 //   - tls_acme.go        Let's Encrypt automatic certificate management
 //   - platform.go        Ed25519 identity, credential signing
-//   - hmac.go            HMAC-SHA-512 implementation, constant-time compare
+//   - hmac.go            HMAC-SHA-512 (crypto/hmac), constant-time compare
+//   - fips.go            FIPS 140-3 mode checks and TLS restrictions
 //   - token.go           Enrollment tokens, API keys
+//   - binding.go         Token binding to hostname, MAC, machine UUID
+//   - attestation.go     Attestation key parsing, signature verification
+//   - session.go         Dashboard session cookies, CSRF, viewer tickets
 //   - middleware.go      HTTP authentication middleware
 //
 // # Quantum-readiness
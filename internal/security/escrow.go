@@ -0,0 +1,132 @@
+package security
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Key escrow: the platform seed, encrypted under a recovery passphrase,
+// as a code short enough to print on paper or in a QR code. The layout
+// before encoding is
+//
+//	version (1) | salt (16) | nonce (12) | AES-256-GCM(seed) (48) | checksum (2)
+//
+// The key is PBKDF2-HMAC-SHA-256 of the passphrase and salt, so the code
+// uses only FIPS-approved primitives. The checksum, the first two bytes of
+// SHA-256 over the rest, tells a mistyped code from a wrong passphrase.
+// The code is unpadded base32 in dash-separated groups of four.
+
+const (
+	escrowVersion    = 1
+	escrowSaltSize   = 16
+	escrowIterations = 600000
+	escrowGroup      = 4
+)
+
+// MinEscrowPassphrase is the shortest recovery passphrase accepted.
+const MinEscrowPassphrase = 12
+
+var escrowEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Errors returned by RecoverPlatform.
+var (
+	ErrEscrowCode       = errors.New("recovery code is mistyped or incomplete")
+	ErrEscrowPassphrase = errors.New("wrong recovery passphrase")
+)
+
+// Escrow returns the platform seed encrypted under passphrase, as a
+// recovery code for RecoverPlatform.
+func (p *Platform) Escrow(passphrase string) (string, error) {
+	if len(passphrase) < MinEscrowPassphrase {
+		return "", fmt.Errorf("recovery passphrase must be at least %d characters", MinEscrowPassphrase)
+	}
+	salt := make([]byte, escrowSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	aead, err := escrowAEAD(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	buf := append([]byte{escrowVersion}, salt...)
+	buf = append(buf, nonce...)
+	buf = aead.Seal(buf, nonce, p.privateKey.Seed(), buf[:1])
+	sum := sha256.Sum256(buf)
+	buf = append(buf, sum[:2]...)
+
+	enc := escrowEncoding.EncodeToString(buf)
+	var groups []string
+	for len(enc) > escrowGroup {
+		groups = append(groups, enc[:escrowGroup])
+		enc = enc[escrowGroup:]
+	}
+	return strings.Join(append(groups, enc), "-"), nil
+}
+
+// RecoverPlatform decrypts a recovery code from Escrow. Case, dashes and
+// spaces in the code do not matter.
+func RecoverPlatform(code, passphrase string) (*Platform, error) {
+	code = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+	buf, err := escrowEncoding.DecodeString(code)
+	if err != nil || len(buf) < 1+escrowSaltSize+2 {
+		return nil, ErrEscrowCode
+	}
+	body, check := buf[:len(buf)-2], buf[len(buf)-2:]
+	if sum := sha256.Sum256(body); !bytes.Equal(sum[:2], check) {
+		return nil, ErrEscrowCode
+	}
+	if body[0] != escrowVersion {
+		return nil, fmt.Errorf("unsupported recovery code version %d", body[0])
+	}
+
+	salt := body[1 : 1+escrowSaltSize]
+	aead, err := escrowAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	rest := body[1+escrowSaltSize:]
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrEscrowCode
+	}
+	nonce, sealed := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	seed, err := aead.Open(nil, nonce, sealed, body[:1])
+	if err != nil {
+		return nil, ErrEscrowPassphrase
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid platform key size")
+	}
+	return newPlatform(ed25519.NewKeyFromSeed(seed)), nil
+}
+
+// escrowAEAD returns AES-256-GCM keyed from passphrase and salt.
+func escrowAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, escrowIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
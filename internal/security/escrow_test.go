@@ -0,0 +1,52 @@
+package security
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEscrow(t *testing.T) {
+	p := testPlatform(t)
+	const passphrase = "correct horse battery"
+
+	code, err := p.Escrow(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Escrow("too short"); err == nil {
+		t.Fatal("Escrow accepted a short passphrase")
+	}
+
+	// Mistype a character that falls wholly in the checksum, so the
+	// mismatch does not depend on the random salt and nonce.
+	typo := []byte(strings.ReplaceAll(code, "-", ""))
+	if i := len(typo) - 2; typo[i] == 'A' {
+		typo[i] = 'B'
+	} else {
+		typo[i] = 'A'
+	}
+
+	tests := []struct {
+		name, code, passphrase string
+		err                    error
+	}{
+		{"round trip", code, passphrase, nil},
+		{"lower case, spaces", strings.ToLower(strings.ReplaceAll(code, "-", " ")), passphrase, nil},
+		{"wrong passphrase", code, passphrase + "!", ErrEscrowPassphrase},
+		{"mistyped code", string(typo), passphrase, ErrEscrowCode},
+		{"truncated code", code[:len(code)-5], passphrase, ErrEscrowCode},
+		{"not base32", code[:len(code)-1] + "1", passphrase, ErrEscrowCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RecoverPlatform(tt.code, tt.passphrase)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && got.Fingerprint() != p.Fingerprint() {
+				t.Fatalf("recovered %s, want %s", got.Fingerprint(), p.Fingerprint())
+			}
+		})
+	}
+}
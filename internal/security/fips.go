@@ -0,0 +1,73 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/fips140"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// FIPS mode. Every primitive the platform uses comes from Go's FIPS 140-3
+// module: Ed25519 (platform identity), HMAC-SHA-512 with a 512-bit
+// HKDF-SHA-512 derived key (agent credentials), SHA-256 (token, key and
+// credential hashes), ECDSA P-384 (self-signed TLS), ECDSA P-256
+// (TPM attestation) and PBKDF2-HMAC-SHA-256 with AES-256-GCM (platform
+// key escrow). FIPS mode additionally requires that module to be
+// active, so the primitives run their self-tests and refuse unapproved
+// parameters, and restricts TLS to approved key exchanges and
+// certificate keys.
+
+// FIPSEnabled reports whether Go's FIPS 140-3 module is active: the binary
+// was built with GOFIPS140 set, or runs with GODEBUG=fips140=on.
+func FIPSEnabled() bool {
+	return fips140.Enabled()
+}
+
+// CheckFIPS returns an error unless FIPS mode can be enforced.
+func CheckFIPS() error {
+	if !FIPSEnabled() {
+		return errors.New("the Go FIPS 140-3 module is not active (build with GOFIPS140=v1.0.0 or run with GODEBUG=fips140=on)")
+	}
+	return nil
+}
+
+// RestrictTLS limits cfg to TLS 1.3 with the NIST curves for key exchange.
+// TLS 1.3 cipher suites are not configurable; with the FIPS module active
+// Go offers only the AES-GCM ones.
+func RestrictTLS(cfg *tls.Config) {
+	cfg.MinVersion = tls.VersionTLS13
+	cfg.CurvePreferences = []tls.CurveID{tls.CurveP384, tls.CurveP256}
+}
+
+// CheckFIPSCertificate returns an error unless cert's key is an ECDSA key
+// on P-256, P-384 or P-521, or an RSA key of at least 2048 bits.
+func CheckFIPSCertificate(cert *tls.Certificate) error {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return errors.New("no certificate")
+		}
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	switch pub := leaf.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+			return nil
+		}
+		return fmt.Errorf("certificate key uses unapproved curve %s", pub.Curve.Params().Name)
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return fmt.Errorf("certificate RSA key is %d bits; at least 2048 required", pub.N.BitLen())
+		}
+		return nil
+	}
+	return fmt.Errorf("certificate key type %T is not allowed in FIPS mode", leaf.PublicKey)
+}
@@ -8,7 +8,10 @@ import (
 	"github.com/avaropoint/rmm/internal/store"
 )
 
-// AuthMiddleware validates API key authentication on HTTP requests.
+// principalKey is the context key for the authenticated API key.
+type principalKey struct{}
+
+// AuthMiddleware validates API key or session authentication on HTTP requests.
 type AuthMiddleware struct {
 	store store.Store
 }
@@ -18,34 +21,83 @@ func NewAuthMiddleware(s store.Store) *AuthMiddleware {
 	return &AuthMiddleware{store: s}
 }
 
-// Wrap returns an http.HandlerFunc that requires valid API key authentication.
-// The key can be provided via Authorization header or "token" query parameter.
+// Wrap returns an http.HandlerFunc that requires authentication.
+//
+// Scripts authenticate with an Authorization: Bearer <key> header. The
+// dashboard authenticates with the session cookie issued at login; because
+// browsers attach cookies automatically, mutating requests made that way
+// must also echo the session's CSRF token in the X-CSRF-Token header.
+//
+// The authenticated API key is available to handlers via APIKeyFromContext.
 func (a *AuthMiddleware) Wrap(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		key := extractKey(r)
-		if key == "" {
-			http.Error(w, `{"error":"authentication required"}`, http.StatusUnauthorized)
+		apiKey, status, msg := a.authenticate(r)
+		if apiKey == nil {
+			http.Error(w, msg, status)
 			return
 		}
 
-		keyHash := HashAPIKey(key)
-		apiKey, err := a.store.VerifyAPIKey(context.Background(), keyHash)
+		ctx := context.WithValue(r.Context(), principalKey{}, apiKey)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// Session returns the dashboard session attached to the request cookie,
+// or nil if there is none or it has expired.
+func (a *AuthMiddleware) Session(r *http.Request) *store.Session {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	sess, err := a.store.GetSession(r.Context(), HashSessionToken(cookie.Value))
+	if err != nil {
+		return nil
+	}
+	return sess
+}
+
+// authenticate resolves the request's credentials to an API key. On failure
+// it returns nil along with the HTTP status and JSON error body to send.
+func (a *AuthMiddleware) authenticate(r *http.Request) (*store.APIKey, int, string) {
+	if key := extractKey(r); key != "" {
+		apiKey, err := a.store.VerifyAPIKey(r.Context(), HashAPIKey(key))
 		if err != nil || apiKey == nil {
-			http.Error(w, `{"error":"invalid API key"}`, http.StatusUnauthorized)
-			return
+			return nil, http.StatusUnauthorized, `{"error":"invalid API key"}`
 		}
+		return apiKey, 0, ""
+	}
+
+	sess := a.Session(r)
+	if sess == nil {
+		return nil, http.StatusUnauthorized, `{"error":"authentication required"}`
+	}
 
-		next(w, r)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if !TokensEqual(r.Header.Get(CSRFHeader), sess.CSRFToken) {
+			return nil, http.StatusForbidden, `{"error":"invalid CSRF token"}`
+		}
 	}
+
+	return &store.APIKey{ID: sess.APIKeyID, Name: sess.APIKeyName, Role: sess.APIKeyRole}, 0, ""
+}
+
+// APIKeyFromContext returns the API key that authenticated the request,
+// or nil outside an AuthMiddleware-wrapped handler.
+func APIKeyFromContext(ctx context.Context) *store.APIKey {
+	k, _ := ctx.Value(principalKey{}).(*store.APIKey)
+	return k
 }
 
-// extractKey gets the API key from the request.
-// Checks Authorization: Bearer <key> header first, then "token" query param.
+// extractKey gets the API key from the Authorization: Bearer <key> header.
+// Query-string keys are not accepted: they leak into access logs and
+// browser history.
 func extractKey(r *http.Request) string {
 	if auth := r.Header.Get("Authorization"); auth != "" {
 		if strings.HasPrefix(auth, "Bearer ") {
 			return strings.TrimPrefix(auth, "Bearer ")
 		}
 	}
-	return r.URL.Query().Get("token")
+	return ""
 }
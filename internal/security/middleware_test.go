@@ -0,0 +1,96 @@
+package security
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	s, err := store.NewSQLiteStore(filepath.Join(t.TempDir(), "platform.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close() //nolint:errcheck
+	ctx := context.Background()
+
+	const rawKey = "rmm_testkey"
+	key := &store.APIKey{
+		ID: "k1", Name: "tech", KeyHash: HashAPIKey(rawKey), Prefix: "rmm_test",
+		Role: store.RoleTechnician, CreatedAt: time.Now(),
+	}
+	if err := s.CreateAPIKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	sess, token, err := GenerateSession(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateSession(ctx, sess); err != nil {
+		t.Fatal(err)
+	}
+	expired, expiredToken, err := GenerateSession(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := s.CreateSession(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	var got *store.APIKey
+	handler := NewAuthMiddleware(s).Wrap(func(w http.ResponseWriter, r *http.Request) {
+		got = APIKeyFromContext(r.Context())
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		bearer string
+		cookie string
+		csrf   string
+		status int
+	}{
+		{"no credentials", http.MethodGet, "", "", "", http.StatusUnauthorized},
+		{"API key", http.MethodPost, rawKey, "", "", http.StatusOK},
+		{"unknown API key", http.MethodGet, "rmm_other", "", "", http.StatusUnauthorized},
+		{"session read", http.MethodGet, "", token, "", http.StatusOK},
+		{"session write with CSRF token", http.MethodPost, "", token, sess.CSRFToken, http.StatusOK},
+		{"session write without CSRF token", http.MethodPost, "", token, "", http.StatusForbidden},
+		{"session write with wrong CSRF token", http.MethodDelete, "", token, expired.CSRFToken, http.StatusForbidden},
+		{"expired session", http.MethodGet, "", expiredToken, "", http.StatusUnauthorized},
+		{"unknown session", http.MethodGet, "", "0123", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			r := httptest.NewRequest(tt.method, "/api/agents", nil)
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: SessionCookie, Value: tt.cookie})
+			}
+			if tt.csrf != "" {
+				r.Header.Set(CSRFHeader, tt.csrf)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.status, w.Body.String())
+			}
+			if tt.status == http.StatusOK && (got == nil || got.ID != key.ID || got.Role != key.Role) {
+				t.Fatalf("handler saw key %+v, want %s (%s)", got, key.ID, key.Role)
+			}
+			if tt.status != http.StatusOK && got != nil {
+				t.Fatal("handler ran for a rejected request")
+			}
+		})
+	}
+}
@@ -2,17 +2,15 @@ package security
 
 import (
 	"crypto/ed25519"
+	"crypto/hkdf"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/hex"
 	"encoding/pem"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
-
-	"golang.org/x/crypto/hkdf"
 )
 
 // Platform holds the server's Ed25519 identity keypair and a derived
@@ -30,6 +28,11 @@ func (p *Platform) Fingerprint() string {
 	return hex.EncodeToString(h[:])
 }
 
+// Sign signs data with the platform's Ed25519 private key.
+func (p *Platform) Sign(data []byte) []byte {
+	return ed25519.Sign(p.privateKey, data)
+}
+
 // SignCredential produces a versioned agent credential:
 //
 //	v1.<agentID>.<hmac_sha512_hex>
@@ -119,29 +122,34 @@ func generatePlatformKey(path string) (*Platform, error) {
 		return nil, err
 	}
 
-	seed := priv.Seed()
-	block := &pem.Block{Type: "PRIVATE KEY", Bytes: seed}
+	p := newPlatform(priv)
+	if err := p.WriteKey(path); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// WriteKey writes the platform seed to path in the form
+// LoadOrCreatePlatform reads, replacing any file there.
+func (p *Platform) WriteKey(path string) error {
+	block := &pem.Block{Type: "PRIVATE KEY", Bytes: p.privateKey.Seed()}
 
 	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if err := pem.Encode(f, block); err != nil {
 		f.Close() //nolint:errcheck
-		return nil, err
+		return err
 	}
-	_ = f.Close()
-
-	return newPlatform(priv), nil
+	return f.Close()
 }
 
 func newPlatform(priv ed25519.PrivateKey) *Platform {
 	// Derive a separate symmetric key for HMAC credential signing.
 	// HKDF-SHA-512: deterministic, one-way, quantum-safe key derivation.
-	credKey := make([]byte, 64)
-	r := hkdf.New(sha512.New, priv.Seed(), []byte("rmm-credential-v1"), []byte("agent-authentication"))
-	io.ReadFull(r, credKey) //nolint:errcheck
+	credKey, _ := hkdf.Key(sha512.New, priv.Seed(), []byte("rmm-credential-v1"), "agent-authentication", 64)
 
 	return &Platform{
 		PublicKey:  priv.Public().(ed25519.PublicKey),
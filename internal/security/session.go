@@ -0,0 +1,95 @@
+package security
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/avaropoint/rmm/internal/store"
+)
+
+const (
+	// SessionCookie is the name of the dashboard session cookie.
+	SessionCookie = "rmm_session"
+
+	// CSRFHeader carries the per-session CSRF token on mutating requests
+	// authenticated by the session cookie.
+	CSRFHeader = "X-CSRF-Token"
+
+	// SessionLifetime bounds how long a dashboard login stays valid.
+	SessionLifetime = 12 * time.Hour
+)
+
+// GenerateSession creates a dashboard session for an authenticated API key.
+// Returns the record to persist and the raw token for the cookie.
+func GenerateSession(apiKey *store.APIKey) (*store.Session, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	csrf := make([]byte, 32)
+	if _, err := rand.Read(csrf); err != nil {
+		return nil, "", err
+	}
+
+	token := hex.EncodeToString(raw)
+	now := time.Now()
+	sess := &store.Session{
+		ID:         randomHex(8),
+		TokenHash:  hashCode(token),
+		APIKeyID:   apiKey.ID,
+		APIKeyName: apiKey.Name,
+		CSRFToken:  hex.EncodeToString(csrf),
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(SessionLifetime),
+	}
+	return sess, token, nil
+}
+
+// HashSessionToken returns the SHA-256 hash of a session token for DB lookup.
+func HashSessionToken(token string) string {
+	return hashCode(token)
+}
+
+// SessionCookieFor builds the HttpOnly, SameSite=Strict cookie carrying a
+// session token. Secure is set whenever the request arrived over TLS.
+func SessionCookieFor(r *http.Request, token string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// ClearSessionCookie builds a cookie that removes the session from the browser.
+func ClearSessionCookie(r *http.Request) *http.Cookie {
+	return &http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// GenerateTicket returns a random single-use ticket for authenticating a
+// WebSocket upgrade, where custom headers cannot be sent.
+func GenerateTicket() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// TokensEqual compares two secret strings in constant time.
+func TokensEqual(a, b string) bool {
+	return hmacEqual([]byte(a), []byte(b))
+}
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	"golang.org/x/crypto/acme/autocert"
 )
@@ -96,6 +97,43 @@ func LoadCustomTLS(certFile, keyFile string) (*tls.Config, error) {
 	}, nil
 }
 
+// CertReloader serves a certificate whose files can be replaced on disk,
+// loading them again on Reload. Connections in progress keep the
+// certificate they started with.
+type CertReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// NewCertReloader returns a reloader for certFile and keyFile serving
+// cert, already loaded from them, until the first Reload.
+func NewCertReloader(certFile, keyFile string, cert tls.Certificate) *CertReloader {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	c.cert.Store(&cert)
+	return c
+}
+
+// Reload loads the files again. If they do not load, or check (when
+// non-nil) rejects the certificate, the current one stays in use.
+func (c *CertReloader) Reload(check func(*tls.Certificate) error) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS keypair: %w", err)
+	}
+	if check != nil {
+		if err := check(&cert); err != nil {
+			return err
+		}
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate serves the current certificate (tls.Config.GetCertificate).
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
 // ReadCACert returns the PEM-encoded CA certificate.
 func ReadCACert(paths *TLSConfig) ([]byte, error) {
 	return os.ReadFile(paths.CACertPath)
@@ -1,29 +1,32 @@
 package security
 
 import (
+	"context"
 	"crypto/tls"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	"golang.org/x/crypto/acme/autocert"
 )
 
-// NewACMEManager creates a Let's Encrypt autocert manager for the given domains.
-// Certificates are automatically obtained and renewed. Cached in certsDir/acme/.
+// NewACMEManager creates a Let's Encrypt autocert manager for the domains
+// hosts allows. Certificates are automatically obtained and renewed.
+// Cached in certsDir/acme/.
 //
 // Usage:
 //
-//	manager, tlsCfg := security.NewACMEManager(certsDir, "rmm.example.com")
+//	manager, tlsCfg := security.NewACMEManager(certsDir, security.NewACMEHosts("rmm.example.com"))
 //	go http.ListenAndServe(":80", manager.HTTPHandler(nil))  // HTTP-01 challenges
 //	server := &http.Server{Addr: ":443", TLSConfig: tlsCfg}
 //	server.ListenAndServeTLS("", "")
-func NewACMEManager(certsDir string, domains ...string) (*autocert.Manager, *tls.Config) {
+func NewACMEManager(certsDir string, hosts *ACMEHosts) (*autocert.Manager, *tls.Config) {
 	cacheDir := filepath.Join(certsDir, "acme")
 	_ = os.MkdirAll(cacheDir, 0700)
 
 	manager := &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(domains...),
+		HostPolicy: hosts.allow,
 		Cache:      autocert.DirCache(cacheDir),
 	}
 
@@ -32,3 +35,27 @@ func NewACMEManager(certsDir string, domains ...string) (*autocert.Manager, *tls
 
 	return manager, tlsCfg
 }
+
+// ACMEHosts is the list of domains an ACME manager obtains certificates
+// for. It can be replaced while the manager runs.
+type ACMEHosts struct {
+	policy atomic.Pointer[autocert.HostPolicy]
+}
+
+// NewACMEHosts returns a host list allowing domains.
+func NewACMEHosts(domains ...string) *ACMEHosts {
+	h := &ACMEHosts{}
+	h.Set(domains...)
+	return h
+}
+
+// Set replaces the allowed domains. A removed domain gets no new
+// certificates, though one already cached is served until it expires.
+func (h *ACMEHosts) Set(domains ...string) {
+	policy := autocert.HostWhitelist(domains...)
+	h.policy.Store(&policy)
+}
+
+func (h *ACMEHosts) allow(ctx context.Context, host string) error {
+	return (*h.policy.Load())(ctx, host)
+}
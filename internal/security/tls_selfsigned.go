@@ -10,6 +10,7 @@ import (
 	"math/big"
 	"net"
 	"os"
+	"slices"
 	"time"
 )
 
@@ -87,11 +88,15 @@ func generateCerts(paths *TLSConfig) error {
 }
 
 // collectSANs gathers DNS names and IP addresses for the server certificate.
+// Both address families are included, so agents on IPv6-only networks can
+// use the server's IPv6 literal ("wss://[2001:db8::10]:8443"). Link-local
+// addresses are left out: they are only reachable with a zone, which an IP
+// SAN cannot carry, and mean nothing off the link.
 func collectSANs() ([]string, []net.IP) {
 	dnsNames := []string{"localhost"}
 	var ipAddrs []net.IP
 
-	if hostname, err := os.Hostname(); err == nil {
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
 		dnsNames = append(dnsNames, hostname)
 	}
 
@@ -102,21 +107,8 @@ func collectSANs() ([]string, []net.IP) {
 			if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
 				continue
 			}
-			addrs, err := iface.Addrs()
-			if err != nil {
-				continue
-			}
-			for _, addr := range addrs {
-				var ip net.IP
-				switch v := addr.(type) {
-				case *net.IPNet:
-					ip = v.IP
-				case *net.IPAddr:
-					ip = v.IP
-				}
-				if ip != nil && !ip.IsLoopback() {
-					ipAddrs = append(ipAddrs, ip)
-				}
+			if addrs, err := iface.Addrs(); err == nil {
+				ipAddrs = appendSANIPs(ipAddrs, addrs)
 			}
 		}
 	}
@@ -124,6 +116,27 @@ func collectSANs() ([]string, []net.IP) {
 	return dnsNames, ipAddrs
 }
 
+// appendSANIPs appends the IPs of addrs to ips, skipping loopback and
+// link-local addresses and any already present.
+func appendSANIPs(ips []net.IP, addrs []net.Addr) []net.IP {
+	for _, addr := range addrs {
+		var ip net.IP
+		switch v := addr.(type) {
+		case *net.IPNet:
+			ip = v.IP
+		case *net.IPAddr:
+			ip = v.IP
+		}
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		if !slices.ContainsFunc(ips, ip.Equal) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
 func writePEM(path, blockType string, data []byte) error {
 	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
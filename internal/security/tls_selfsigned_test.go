@@ -0,0 +1,46 @@
+package security
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAppendSANIPs(t *testing.T) {
+	ipNet := func(s string) net.Addr { return &net.IPNet{IP: net.ParseIP(s), Mask: net.CIDRMask(64, 128)} }
+	addrs := []net.Addr{
+		ipNet("192.0.2.10"),
+		ipNet("2001:db8::10"),
+		ipNet("fe80::1"),                           // IPv6 link-local
+		ipNet("169.254.10.1"),                      // IPv4 link-local
+		ipNet("127.0.0.1"),                         // loopback, already present
+		ipNet("::1"),                               // loopback, already present
+		&net.IPAddr{IP: net.ParseIP("192.0.2.10")}, // duplicate
+		ipNet("2001:db8:0:0::10"),                  // duplicate, another spelling
+		&net.IPAddr{IP: net.ParseIP("198.51.100.7")},
+	}
+
+	got := appendSANIPs([]net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, addrs)
+	want := []string{"127.0.0.1", "::1", "192.0.2.10", "2001:db8::10", "198.51.100.7"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i, ip := range got {
+		if !ip.Equal(net.ParseIP(want[i])) {
+			t.Errorf("SAN %d = %v, want %s", i, ip, want[i])
+		}
+	}
+}
+
+func TestCollectSANsSkipsLinkLocal(t *testing.T) {
+	_, ips := collectSANs()
+	seen := map[string]bool{}
+	for _, ip := range ips {
+		if ip.IsLinkLocalUnicast() {
+			t.Errorf("link-local SAN %v", ip)
+		}
+		if seen[ip.String()] {
+			t.Errorf("duplicate SAN %v", ip)
+		}
+		seen[ip.String()] = true
+	}
+}
@@ -16,7 +16,9 @@ const tokenAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
 
 // GenerateEnrollmentToken creates an enrollment token with a human-readable code.
 // Attended tokens use a short code (XXXX-XXXX) and expire in 15 minutes.
-// Unattended tokens use a longer code and expire in 7 days.
+// Unattended tokens use a longer code and expire in 7 days. Provisioning
+// tokens, baked into golden images, use a longer code still and expire in
+// a year.
 func GenerateEnrollmentToken(tokenType, label string) (*store.EnrollmentToken, string, error) {
 	var codeLen int
 	var expiry time.Duration
@@ -28,6 +30,9 @@ func GenerateEnrollmentToken(tokenType, label string) (*store.EnrollmentToken, s
 	case "unattended":
 		codeLen = 24
 		expiry = 7 * 24 * time.Hour
+	case store.TokenProvisioning:
+		codeLen = 32
+		expiry = 365 * 24 * time.Hour
 	default:
 		return nil, "", fmt.Errorf("invalid token type: %s", tokenType)
 	}
@@ -75,6 +80,7 @@ func GenerateAPIKey(name string) (*store.APIKey, string, error) {
 		Name:      name,
 		KeyHash:   keyHash,
 		Prefix:    key[:12],
+		Role:      store.RoleAdmin,
 		CreatedAt: time.Now(),
 	}
 
@@ -86,6 +92,18 @@ func HashAPIKey(key string) string {
 	return hashCode(key)
 }
 
+// GenerateShareToken creates a random token for read-only links such as
+// an organization's status page, and returns it with its hash.
+func GenerateShareToken() (token, hash string) {
+	token = randomHex(24)
+	return token, hashCode(token)
+}
+
+// HashShareToken returns the SHA-256 hash of a share token for comparison.
+func HashShareToken(token string) string {
+	return hashCode(token)
+}
+
 func randomCode(length int) (string, error) {
 	b := make([]byte, length)
 	if _, err := rand.Read(b); err != nil {
@@ -121,3 +139,8 @@ func randomHex(n int) string {
 	rand.Read(b) //nolint:errcheck
 	return hex.EncodeToString(b)
 }
+
+// NewID returns a random 16-character hex identifier for database records.
+func NewID() string {
+	return randomHex(8)
+}
@@ -0,0 +1,131 @@
+package security
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Viewer tokens are the tickets that admit a browser to /ws/viewer and
+// /ws/gateway: JWTs (RFC 7519) signed with the platform's Ed25519 key
+// (alg EdDSA, RFC 8037). Anything holding the platform public key, such
+// as a relay node, verifies them without the database or the issuing
+// server; the server publishes the key as a JWK set.
+
+// ViewerAudience is the aud claim of viewer tokens.
+const ViewerAudience = "viewer"
+
+// viewerTokenSkew is how far a verifier's clock may be behind the
+// issuer's before a fresh token looks issued in the future.
+const viewerTokenSkew = 5 * time.Second
+
+var jwtEncoding = base64.RawURLEncoding
+
+// ViewerClaims are the claims of a viewer token.
+type ViewerClaims struct {
+	Issuer    string `json:"iss"` // platform fingerprint
+	Audience  string `json:"aud"`
+	Subject   string `json:"sub"` // agent ID
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+
+	KeyID       string   `json:"key_id"`   // API key the token was issued to
+	KeyName     string   `json:"key_name"` // shown to the agent's user
+	Permissions []string `json:"perms"`
+
+	// ViewerOnly tokens, for external portals, open /ws/viewer only and,
+	// with Origin set, only from that origin.
+	ViewerOnly bool   `json:"viewer_only,omitempty"`
+	Origin     string `json:"origin,omitempty"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// KeyID identifies the platform key in token headers and the JWK set:
+// the first 16 hex digits of its fingerprint.
+func (p *Platform) KeyID() string {
+	return p.Fingerprint()[:16]
+}
+
+// SignViewerToken fills in c's issuer, audience, ID and issue time and
+// returns it as a signed token valid for ttl.
+func (p *Platform) SignViewerToken(c *ViewerClaims, ttl time.Duration) (string, error) {
+	id, err := GenerateTicket()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	c.Issuer, c.Audience, c.ID = p.Fingerprint(), ViewerAudience, id
+	c.IssuedAt, c.ExpiresAt = now.Unix(), now.Add(ttl).Unix()
+
+	header, _ := json.Marshal(jwtHeader{Alg: "EdDSA", Typ: "JWT", Kid: p.KeyID()})
+	claims, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	signed := jwtEncoding.EncodeToString(header) + "." + jwtEncoding.EncodeToString(claims)
+	return signed + "." + jwtEncoding.EncodeToString(p.Sign([]byte(signed))), nil
+}
+
+// VerifyViewerToken checks a viewer token's signature against the
+// platform public key and its audience, issuer and lifetime at now.
+func VerifyViewerToken(pub ed25519.PublicKey, token string, now time.Time) (*ViewerClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if raw, err := jwtEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if header.Alg != "EdDSA" {
+		return nil, errors.New("unsupported token algorithm")
+	}
+	sig, err := jwtEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var c ViewerClaims
+	if raw, err := jwtEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(raw, &c) != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	sum := sha256.Sum256(pub)
+	switch {
+	case c.Audience != ViewerAudience:
+		return nil, errors.New("token is not for viewers")
+	case c.Issuer != hex.EncodeToString(sum[:]):
+		return nil, errors.New("token issued by another platform")
+	case now.Unix() >= c.ExpiresAt:
+		return nil, errors.New("token expired")
+	case time.Unix(c.IssuedAt, 0).After(now.Add(viewerTokenSkew)):
+		return nil, errors.New("token issued in the future")
+	}
+	return &c, nil
+}
+
+// JWKS returns the platform public key as a JWK set (RFC 7517, OKP keys
+// per RFC 8037) for relays that verify viewer tokens.
+func (p *Platform) JWKS() map[string]any {
+	return map[string]any{
+		"keys": []map[string]string{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   jwtEncoding.EncodeToString(p.PublicKey),
+			"kid": p.KeyID(),
+			"alg": "EdDSA",
+			"use": "sig",
+		}},
+	}
+}
@@ -0,0 +1,95 @@
+package security
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPlatform(tb testing.TB) *Platform {
+	tb.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return newPlatform(priv)
+}
+
+// signJWT signs arbitrary header and claims with the platform key, for
+// tokens SignViewerToken would never issue.
+func signJWT(p *Platform, header jwtHeader, claims ViewerClaims) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := jwtEncoding.EncodeToString(h) + "." + jwtEncoding.EncodeToString(c)
+	return signed + "." + jwtEncoding.EncodeToString(p.Sign([]byte(signed)))
+}
+
+func TestVerifyViewerToken(t *testing.T) {
+	p := testPlatform(t)
+	other := testPlatform(t)
+	now := time.Now()
+
+	valid, err := p.SignViewerToken(&ViewerClaims{Subject: "agent-1", KeyID: "k1"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, ".")
+
+	claims := func(edit func(*ViewerClaims)) ViewerClaims {
+		c := ViewerClaims{
+			Issuer: p.Fingerprint(), Audience: ViewerAudience, Subject: "agent-1", ID: "t1",
+			IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix(),
+		}
+		edit(&c)
+		return c
+	}
+	header := jwtHeader{Alg: "EdDSA", Typ: "JWT", Kid: p.KeyID()}
+
+	// Flip a bit of the signature, keeping it valid base64url.
+	sig, _ := jwtEncoding.DecodeString(parts[2])
+	sig[0] ^= 1
+	tamperedSig := parts[0] + "." + parts[1] + "." + jwtEncoding.EncodeToString(sig)
+
+	// Swap in claims for another agent under the original signature.
+	forged, _ := json.Marshal(claims(func(c *ViewerClaims) { c.Subject = "agent-2" }))
+	tamperedClaims := parts[0] + "." + jwtEncoding.EncodeToString(forged) + "." + parts[2]
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"valid", valid, ""},
+		{"tampered signature", tamperedSig, "invalid token signature"},
+		{"tampered claims", tamperedClaims, "invalid token signature"},
+		{"signed by another platform", signJWT(other, header, claims(func(*ViewerClaims) {})), "invalid token signature"},
+		{"wrong audience", signJWT(p, header, claims(func(c *ViewerClaims) { c.Audience = "api" })), "token is not for viewers"},
+		{"wrong issuer", signJWT(p, header, claims(func(c *ViewerClaims) { c.Issuer = other.Fingerprint() })), "token issued by another platform"},
+		{"expired", signJWT(p, header, claims(func(c *ViewerClaims) { c.ExpiresAt = now.Unix() })), "token expired"},
+		{"issued in the future", signJWT(p, header, claims(func(c *ViewerClaims) { c.IssuedAt = now.Add(time.Minute).Unix() })), "token issued in the future"},
+		{"alg none", signJWT(p, jwtHeader{Alg: "none", Typ: "JWT"}, claims(func(*ViewerClaims) {})), "unsupported token algorithm"},
+		{"alg HS256", signJWT(p, jwtHeader{Alg: "HS256", Typ: "JWT"}, claims(func(*ViewerClaims) {})), "unsupported token algorithm"},
+		{"unsigned", parts[0] + "." + parts[1] + ".", "invalid token signature"},
+		{"two parts", parts[0] + "." + parts[1], "malformed token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := VerifyViewerToken(p.PublicKey, tt.token, now)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("err = %v", err)
+				}
+				if c.Subject != "agent-1" || c.KeyID != "k1" {
+					t.Fatalf("claims = %+v", c)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
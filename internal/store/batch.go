@@ -0,0 +1,245 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// Query helpers for SQLiteStore: a prepared statement cache, per-query
+// timeouts, retries when the database is locked, and batching of the
+// timestamps that would otherwise cost a write per request.
+
+// queryTimeout bounds every statement on top of the caller's context, so
+// one slow query cannot hold the store's single connection indefinitely.
+const queryTimeout = 10 * time.Second
+
+// touchInterval is how often batched last_used and last_seen timestamps
+// are written. Reads through the store see pending values immediately;
+// only a crash loses them.
+const touchInterval = 5 * time.Second
+
+// busyRetries bounds how often a write is retried after SQLITE_BUSY or
+// SQLITE_LOCKED. SQLite returns those without waiting out busy_timeout
+// when waiting could deadlock, e.g. a WAL snapshot that went stale.
+const busyRetries = 5
+
+// stmt returns a prepared statement for query, preparing it on first use.
+// Queries must be constant strings so the cache stays bounded.
+func (s *SQLiteStore) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	s.stmtMu.Lock()
+	st, ok := s.stmts[query]
+	s.stmtMu.Unlock()
+	if ok {
+		return st, nil
+	}
+	// Prepare without the lock: with one connection, preparing waits for
+	// any transaction in progress.
+	st, err := s.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	s.stmtMu.Lock()
+	defer s.stmtMu.Unlock()
+	if cached, ok := s.stmts[query]; ok {
+		st.Close() //nolint:errcheck
+		return cached, nil
+	}
+	s.stmts[query] = st
+	return st, nil
+}
+
+// exec runs a write through the statement cache, retrying while the
+// database is busy.
+func (s *SQLiteStore) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	st, err := s.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		res, err := st.ExecContext(ctx, args...)
+		if err == nil || !isBusy(err) || attempt == busyRetries {
+			return res, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(10<<attempt) * time.Millisecond):
+		}
+	}
+}
+
+// queryRow runs a single-row query through the statement cache. Its
+// timeout ends with Scan.
+func (s *SQLiteStore) queryRow(ctx context.Context, query string, args ...any) timedRow {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	st, err := s.stmt(ctx, query)
+	if err != nil {
+		return timedRow{s.db.QueryRowContext(ctx, query, args...), cancel} // reports the error on Scan
+	}
+	return timedRow{st.QueryRowContext(ctx, args...), cancel}
+}
+
+// query runs a multi-row query. Filtered queries are built at run time,
+// so it bypasses the statement cache. Its timeout ends with Close.
+func (s *SQLiteStore) query(ctx context.Context, query string, args ...any) (*timedRows, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &timedRows{rows, cancel}, nil
+}
+
+// timedRow is a *sql.Row that releases its query's timeout on Scan.
+type timedRow struct {
+	row    *sql.Row
+	cancel context.CancelFunc
+}
+
+func (r timedRow) Scan(dest ...any) error {
+	defer r.cancel()
+	return r.row.Scan(dest...)
+}
+
+// timedRows is a *sql.Rows that releases its query's timeout on Close.
+type timedRows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+func (r *timedRows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
+
+// isBusy reports whether err is SQLITE_BUSY or SQLITE_LOCKED, including
+// their extended codes.
+func isBusy(err error) bool {
+	var coded interface{ Code() int }
+	if !errors.As(err, &coded) {
+		return false
+	}
+	switch coded.Code() & 0xff {
+	case 5, 6: // SQLITE_BUSY, SQLITE_LOCKED
+		return true
+	}
+	return false
+}
+
+// touchKey records that an API key was used at t.
+func (s *SQLiteStore) touchKey(id string, t time.Time) {
+	s.touchMu.Lock()
+	s.keysUsed[id] = t
+	s.touchMu.Unlock()
+}
+
+// pendingUse returns an API key's unwritten last_used time, if any.
+func (s *SQLiteStore) pendingUse(id string) (time.Time, bool) {
+	s.touchMu.Lock()
+	defer s.touchMu.Unlock()
+	t, ok := s.keysUsed[id]
+	return t, ok
+}
+
+// pendingSeen returns an agent's unwritten last_seen time, if any.
+func (s *SQLiteStore) pendingSeen(id string) (time.Time, bool) {
+	s.touchMu.Lock()
+	defer s.touchMu.Unlock()
+	t, ok := s.agentsSeen[id]
+	return t, ok
+}
+
+// runTouches flushes batched timestamps every touchInterval until Close.
+func (s *SQLiteStore) runTouches() {
+	defer close(s.touchesDone)
+	ticker := time.NewTicker(touchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopTouches:
+			return
+		case <-ticker.C:
+			if err := s.flushTouches(); err != nil {
+				log.Printf("Store: flush timestamps: %v", err)
+			}
+		}
+	}
+}
+
+// flushTouches writes the pending timestamps in one transaction. On
+// failure they stay pending for the next flush, unless newer ones have
+// replaced them meanwhile.
+func (s *SQLiteStore) flushTouches() error {
+	s.touchMu.Lock()
+	keys, agents := s.keysUsed, s.agentsSeen
+	if len(keys) == 0 && len(agents) == 0 {
+		s.touchMu.Unlock()
+		return nil
+	}
+	s.keysUsed, s.agentsSeen = make(map[string]time.Time), make(map[string]time.Time)
+	s.touchMu.Unlock()
+
+	err := s.writeTouches(keys, agents)
+	if err != nil {
+		s.touchMu.Lock()
+		for id, t := range keys {
+			if _, newer := s.keysUsed[id]; !newer {
+				s.keysUsed[id] = t
+			}
+		}
+		for id, t := range agents {
+			if _, newer := s.agentsSeen[id]; !newer {
+				s.agentsSeen[id] = t
+			}
+		}
+		s.touchMu.Unlock()
+	}
+	return err
+}
+
+func (s *SQLiteStore) writeTouches(keys, agents map[string]time.Time) error {
+	ctx := context.Background()
+	keyStmt, err := s.stmt(ctx, `UPDATE api_keys SET last_used = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	agentStmt, err := s.stmt(ctx, `UPDATE agents SET last_seen = ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	write := func() error {
+		ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+		defer cancel()
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck
+		ks, as := tx.StmtContext(ctx, keyStmt), tx.StmtContext(ctx, agentStmt)
+		for id, t := range keys {
+			if _, err := ks.ExecContext(ctx, t.UTC().Format(time.RFC3339), id); err != nil {
+				return err
+			}
+		}
+		for id, t := range agents {
+			if _, err := as.ExecContext(ctx, t.UTC().Format(time.RFC3339), id); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if err == nil || !isBusy(err) || attempt == busyRetries {
+			return err
+		}
+		time.Sleep(time.Duration(10<<attempt) * time.Millisecond)
+	}
+}
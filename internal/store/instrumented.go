@@ -0,0 +1,764 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the store latency
+// histogram buckets.
+var latencyBuckets = [...]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// methodStats accumulates the calls to one Store method.
+type methodStats struct {
+	buckets [len(latencyBuckets)]atomic.Uint64 // per bucket, not cumulative; see latencyBuckets
+	count   atomic.Uint64
+	errors  atomic.Uint64
+	nanos   atomic.Int64
+}
+
+// Instrumented decorates a Store, recording a latency histogram and an
+// error count per method and logging calls slower than a threshold. It
+// is safe for concurrent use when the wrapped Store is.
+type Instrumented struct {
+	store Store
+	slow  time.Duration
+	stats map[string]*methodStats // one per Store method, fixed at construction
+}
+
+// NewInstrumented wraps st. Calls taking slow or longer are logged; a
+// non-positive slow disables the log.
+func NewInstrumented(st Store, slow time.Duration) *Instrumented {
+	s := &Instrumented{store: st, slow: slow, stats: make(map[string]*methodStats)}
+	t := reflect.TypeFor[Store]()
+	for i := range t.NumMethod() {
+		s.stats[t.Method(i).Name] = &methodStats{}
+	}
+	return s
+}
+
+// observe records a call to method that started at start and failed with
+// *err, if non-nil.
+func (s *Instrumented) observe(method string, start time.Time, err *error) {
+	d := time.Since(start)
+	st := s.stats[method]
+	st.count.Add(1)
+	st.nanos.Add(int64(d))
+	if *err != nil {
+		st.errors.Add(1)
+	}
+	for i, le := range latencyBuckets {
+		if d.Seconds() <= le {
+			st.buckets[i].Add(1)
+			break
+		}
+	}
+	if s.slow > 0 && d >= s.slow {
+		if *err != nil {
+			log.Printf("Store: slow %s took %s: %v", method, d.Round(time.Millisecond), *err)
+		} else {
+			log.Printf("Store: slow %s took %s", method, d.Round(time.Millisecond))
+		}
+	}
+}
+
+// WriteMetrics writes the recorded latencies and errors in the Prometheus
+// text exposition format. Methods that were never called are omitted.
+func (s *Instrumented) WriteMetrics(w io.Writer) error {
+	methods := make([]string, 0, len(s.stats))
+	for m, st := range s.stats {
+		if st.count.Load() > 0 {
+			methods = append(methods, m)
+		}
+	}
+	sort.Strings(methods)
+
+	b := &metricsBuf{w: w}
+	b.printf("# HELP rmm_store_call_duration_seconds Latency of store calls by method.\n")
+	b.printf("# TYPE rmm_store_call_duration_seconds histogram\n")
+	for _, m := range methods {
+		st := s.stats[m]
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += st.buckets[i].Load()
+			b.printf("rmm_store_call_duration_seconds_bucket{method=%q,le=\"%g\"} %d\n", m, le, cum)
+		}
+		count := st.count.Load()
+		b.printf("rmm_store_call_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", m, count)
+		b.printf("rmm_store_call_duration_seconds_sum{method=%q} %g\n", m, time.Duration(st.nanos.Load()).Seconds())
+		b.printf("rmm_store_call_duration_seconds_count{method=%q} %d\n", m, count)
+	}
+	b.printf("# HELP rmm_store_call_errors_total Store calls that returned an error, by method.\n")
+	b.printf("# TYPE rmm_store_call_errors_total counter\n")
+	for _, m := range methods {
+		b.printf("rmm_store_call_errors_total{method=%q} %d\n", m, s.stats[m].errors.Load())
+	}
+	return b.err
+}
+
+// metricsBuf keeps the first write error, so WriteMetrics can write
+// without checking each line.
+type metricsBuf struct {
+	w   io.Writer
+	err error
+}
+
+func (b *metricsBuf) printf(format string, args ...any) {
+	if b.err == nil {
+		_, b.err = fmt.Fprintf(b.w, format, args...)
+	}
+}
+
+// --- Store methods ---
+
+func (s *Instrumented) CreateAgent(ctx context.Context, agent *AgentRecord) (err error) {
+	defer s.observe("CreateAgent", time.Now(), &err)
+	return s.store.CreateAgent(ctx, agent)
+}
+
+func (s *Instrumented) GetAgent(ctx context.Context, id string) (_ *AgentRecord, err error) {
+	defer s.observe("GetAgent", time.Now(), &err)
+	return s.store.GetAgent(ctx, id)
+}
+
+func (s *Instrumented) GetAgentByCredential(ctx context.Context, credentialHash string) (_ *AgentRecord, err error) {
+	defer s.observe("GetAgentByCredential", time.Now(), &err)
+	return s.store.GetAgentByCredential(ctx, credentialHash)
+}
+
+func (s *Instrumented) UpdateAgentSeen(ctx context.Context, id string, t time.Time) (err error) {
+	defer s.observe("UpdateAgentSeen", time.Now(), &err)
+	return s.store.UpdateAgentSeen(ctx, id, t)
+}
+
+func (s *Instrumented) SetAgentUnattended(ctx context.Context, id string, allowed bool) (err error) {
+	defer s.observe("SetAgentUnattended", time.Now(), &err)
+	return s.store.SetAgentUnattended(ctx, id, allowed)
+}
+
+func (s *Instrumented) ListAgents(ctx context.Context) (_ []*AgentRecord, err error) {
+	defer s.observe("ListAgents", time.Now(), &err)
+	return s.store.ListAgents(ctx)
+}
+
+func (s *Instrumented) DeleteAgent(ctx context.Context, id string) (_ map[string]int64, err error) {
+	defer s.observe("DeleteAgent", time.Now(), &err)
+	return s.store.DeleteAgent(ctx, id)
+}
+
+func (s *Instrumented) PurgeAgent(ctx context.Context, id string) (_ map[string]int64, err error) {
+	defer s.observe("PurgeAgent", time.Now(), &err)
+	return s.store.PurgeAgent(ctx, id)
+}
+
+func (s *Instrumented) SetAgentOrg(ctx context.Context, id, orgID string) (err error) {
+	defer s.observe("SetAgentOrg", time.Now(), &err)
+	return s.store.SetAgentOrg(ctx, id, orgID)
+}
+
+func (s *Instrumented) SetAgentSite(ctx context.Context, id, site string) (err error) {
+	defer s.observe("SetAgentSite", time.Now(), &err)
+	return s.store.SetAgentSite(ctx, id, site)
+}
+
+func (s *Instrumented) SetAgentViewerPermissions(ctx context.Context, id string, perms []string) (err error) {
+	defer s.observe("SetAgentViewerPermissions", time.Now(), &err)
+	return s.store.SetAgentViewerPermissions(ctx, id, perms)
+}
+
+func (s *Instrumented) SetAgentSensitive(ctx context.Context, id string, sensitive bool) (err error) {
+	defer s.observe("SetAgentSensitive", time.Now(), &err)
+	return s.store.SetAgentSensitive(ctx, id, sensitive)
+}
+
+func (s *Instrumented) CreateEnrollmentToken(ctx context.Context, token *EnrollmentToken) (err error) {
+	defer s.observe("CreateEnrollmentToken", time.Now(), &err)
+	return s.store.CreateEnrollmentToken(ctx, token)
+}
+
+func (s *Instrumented) CreateEnrollmentTokens(ctx context.Context, tokens []*EnrollmentToken) (err error) {
+	defer s.observe("CreateEnrollmentTokens", time.Now(), &err)
+	return s.store.CreateEnrollmentTokens(ctx, tokens)
+}
+
+func (s *Instrumented) GetEnrollmentToken(ctx context.Context, codeHash string) (_ *EnrollmentToken, err error) {
+	defer s.observe("GetEnrollmentToken", time.Now(), &err)
+	return s.store.GetEnrollmentToken(ctx, codeHash)
+}
+
+func (s *Instrumented) ConsumeEnrollmentToken(ctx context.Context, codeHash, agentID, hostname string) (_ *EnrollmentToken, err error) {
+	defer s.observe("ConsumeEnrollmentToken", time.Now(), &err)
+	return s.store.ConsumeEnrollmentToken(ctx, codeHash, agentID, hostname)
+}
+
+func (s *Instrumented) ListEnrollmentTokens(ctx context.Context) (_ []*EnrollmentToken, err error) {
+	defer s.observe("ListEnrollmentTokens", time.Now(), &err)
+	return s.store.ListEnrollmentTokens(ctx)
+}
+
+func (s *Instrumented) DeleteEnrollmentToken(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteEnrollmentToken", time.Now(), &err)
+	return s.store.DeleteEnrollmentToken(ctx, id)
+}
+
+func (s *Instrumented) CreateAPIKey(ctx context.Context, key *APIKey) (err error) {
+	defer s.observe("CreateAPIKey", time.Now(), &err)
+	return s.store.CreateAPIKey(ctx, key)
+}
+
+func (s *Instrumented) VerifyAPIKey(ctx context.Context, keyHash string) (_ *APIKey, err error) {
+	defer s.observe("VerifyAPIKey", time.Now(), &err)
+	return s.store.VerifyAPIKey(ctx, keyHash)
+}
+
+func (s *Instrumented) ListAPIKeys(ctx context.Context) (_ []*APIKey, err error) {
+	defer s.observe("ListAPIKeys", time.Now(), &err)
+	return s.store.ListAPIKeys(ctx)
+}
+
+func (s *Instrumented) DeleteAPIKey(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteAPIKey", time.Now(), &err)
+	return s.store.DeleteAPIKey(ctx, id)
+}
+
+func (s *Instrumented) CreateSession(ctx context.Context, session *Session) (err error) {
+	defer s.observe("CreateSession", time.Now(), &err)
+	return s.store.CreateSession(ctx, session)
+}
+
+func (s *Instrumented) GetSession(ctx context.Context, tokenHash string) (_ *Session, err error) {
+	defer s.observe("GetSession", time.Now(), &err)
+	return s.store.GetSession(ctx, tokenHash)
+}
+
+func (s *Instrumented) DeleteSession(ctx context.Context, tokenHash string) (err error) {
+	defer s.observe("DeleteSession", time.Now(), &err)
+	return s.store.DeleteSession(ctx, tokenHash)
+}
+
+func (s *Instrumented) DeleteExpiredSessions(ctx context.Context) (err error) {
+	defer s.observe("DeleteExpiredSessions", time.Now(), &err)
+	return s.store.DeleteExpiredSessions(ctx)
+}
+
+func (s *Instrumented) CreateViewerSession(ctx context.Context, vs *ViewerSession) (err error) {
+	defer s.observe("CreateViewerSession", time.Now(), &err)
+	return s.store.CreateViewerSession(ctx, vs)
+}
+
+func (s *Instrumented) EndViewerSession(ctx context.Context, vs *ViewerSession) (err error) {
+	defer s.observe("EndViewerSession", time.Now(), &err)
+	return s.store.EndViewerSession(ctx, vs)
+}
+
+func (s *Instrumented) ListViewerSessions(ctx context.Context, agentID string, limit int) (_ []*ViewerSession, err error) {
+	defer s.observe("ListViewerSessions", time.Now(), &err)
+	return s.store.ListViewerSessions(ctx, agentID, limit)
+}
+
+func (s *Instrumented) CreateAuditEvent(ctx context.Context, ev *AuditEvent) (err error) {
+	defer s.observe("CreateAuditEvent", time.Now(), &err)
+	return s.store.CreateAuditEvent(ctx, ev)
+}
+
+func (s *Instrumented) ListAuditEvents(ctx context.Context, filter AuditFilter) (_ []*AuditEvent, err error) {
+	defer s.observe("ListAuditEvents", time.Now(), &err)
+	return s.store.ListAuditEvents(ctx, filter)
+}
+
+func (s *Instrumented) CreateDropboxFile(ctx context.Context, f *DropboxFile) (err error) {
+	defer s.observe("CreateDropboxFile", time.Now(), &err)
+	return s.store.CreateDropboxFile(ctx, f)
+}
+
+func (s *Instrumented) GetDropboxFile(ctx context.Context, id string) (_ *DropboxFile, err error) {
+	defer s.observe("GetDropboxFile", time.Now(), &err)
+	return s.store.GetDropboxFile(ctx, id)
+}
+
+func (s *Instrumented) ListDropboxFiles(ctx context.Context, agentID string) (_ []*DropboxFile, err error) {
+	defer s.observe("ListDropboxFiles", time.Now(), &err)
+	return s.store.ListDropboxFiles(ctx, agentID)
+}
+
+func (s *Instrumented) UpdateDropboxFile(ctx context.Context, f *DropboxFile) (err error) {
+	defer s.observe("UpdateDropboxFile", time.Now(), &err)
+	return s.store.UpdateDropboxFile(ctx, f)
+}
+
+func (s *Instrumented) SetScreenshotSchedule(ctx context.Context, sched *ScreenshotSchedule) (err error) {
+	defer s.observe("SetScreenshotSchedule", time.Now(), &err)
+	return s.store.SetScreenshotSchedule(ctx, sched)
+}
+
+func (s *Instrumented) GetScreenshotSchedule(ctx context.Context, agentID string) (_ *ScreenshotSchedule, err error) {
+	defer s.observe("GetScreenshotSchedule", time.Now(), &err)
+	return s.store.GetScreenshotSchedule(ctx, agentID)
+}
+
+func (s *Instrumented) ListScreenshotSchedules(ctx context.Context) (_ []*ScreenshotSchedule, err error) {
+	defer s.observe("ListScreenshotSchedules", time.Now(), &err)
+	return s.store.ListScreenshotSchedules(ctx)
+}
+
+func (s *Instrumented) DeleteScreenshotSchedule(ctx context.Context, agentID string) (err error) {
+	defer s.observe("DeleteScreenshotSchedule", time.Now(), &err)
+	return s.store.DeleteScreenshotSchedule(ctx, agentID)
+}
+
+func (s *Instrumented) CreateScreenshot(ctx context.Context, shot *Screenshot) (err error) {
+	defer s.observe("CreateScreenshot", time.Now(), &err)
+	return s.store.CreateScreenshot(ctx, shot)
+}
+
+func (s *Instrumented) GetScreenshot(ctx context.Context, id string) (_ *Screenshot, err error) {
+	defer s.observe("GetScreenshot", time.Now(), &err)
+	return s.store.GetScreenshot(ctx, id)
+}
+
+func (s *Instrumented) ListScreenshots(ctx context.Context, filter ScreenshotFilter) (_ []*Screenshot, err error) {
+	defer s.observe("ListScreenshots", time.Now(), &err)
+	return s.store.ListScreenshots(ctx, filter)
+}
+
+func (s *Instrumented) PruneScreenshots(ctx context.Context, agentID string, keep int, before time.Time) (_ []string, err error) {
+	defer s.observe("PruneScreenshots", time.Now(), &err)
+	return s.store.PruneScreenshots(ctx, agentID, keep, before)
+}
+
+func (s *Instrumented) CreateDiagnosticsArchive(ctx context.Context, a *DiagnosticsArchive) (err error) {
+	defer s.observe("CreateDiagnosticsArchive", time.Now(), &err)
+	return s.store.CreateDiagnosticsArchive(ctx, a)
+}
+
+func (s *Instrumented) GetDiagnosticsArchive(ctx context.Context, id string) (_ *DiagnosticsArchive, err error) {
+	defer s.observe("GetDiagnosticsArchive", time.Now(), &err)
+	return s.store.GetDiagnosticsArchive(ctx, id)
+}
+
+func (s *Instrumented) ListDiagnosticsArchives(ctx context.Context, agentID string) (_ []*DiagnosticsArchive, err error) {
+	defer s.observe("ListDiagnosticsArchives", time.Now(), &err)
+	return s.store.ListDiagnosticsArchives(ctx, agentID)
+}
+
+func (s *Instrumented) DeleteDiagnosticsArchive(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteDiagnosticsArchive", time.Now(), &err)
+	return s.store.DeleteDiagnosticsArchive(ctx, id)
+}
+
+func (s *Instrumented) PruneDiagnosticsArchives(ctx context.Context, agentID string, keep int) (_ []string, err error) {
+	defer s.observe("PruneDiagnosticsArchives", time.Now(), &err)
+	return s.store.PruneDiagnosticsArchives(ctx, agentID, keep)
+}
+
+func (s *Instrumented) CreateRebootSchedule(ctx context.Context, sched *RebootSchedule) (err error) {
+	defer s.observe("CreateRebootSchedule", time.Now(), &err)
+	return s.store.CreateRebootSchedule(ctx, sched)
+}
+
+func (s *Instrumented) GetRebootSchedule(ctx context.Context, id string) (_ *RebootSchedule, err error) {
+	defer s.observe("GetRebootSchedule", time.Now(), &err)
+	return s.store.GetRebootSchedule(ctx, id)
+}
+
+func (s *Instrumented) ListRebootSchedules(ctx context.Context) (_ []*RebootSchedule, err error) {
+	defer s.observe("ListRebootSchedules", time.Now(), &err)
+	return s.store.ListRebootSchedules(ctx)
+}
+
+func (s *Instrumented) DeleteRebootSchedule(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteRebootSchedule", time.Now(), &err)
+	return s.store.DeleteRebootSchedule(ctx, id)
+}
+
+func (s *Instrumented) CreateAccessSchedule(ctx context.Context, sched *AccessSchedule) (err error) {
+	defer s.observe("CreateAccessSchedule", time.Now(), &err)
+	return s.store.CreateAccessSchedule(ctx, sched)
+}
+
+func (s *Instrumented) GetAccessSchedule(ctx context.Context, id string) (_ *AccessSchedule, err error) {
+	defer s.observe("GetAccessSchedule", time.Now(), &err)
+	return s.store.GetAccessSchedule(ctx, id)
+}
+
+func (s *Instrumented) ListAccessSchedules(ctx context.Context) (_ []*AccessSchedule, err error) {
+	defer s.observe("ListAccessSchedules", time.Now(), &err)
+	return s.store.ListAccessSchedules(ctx)
+}
+
+func (s *Instrumented) DeleteAccessSchedule(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteAccessSchedule", time.Now(), &err)
+	return s.store.DeleteAccessSchedule(ctx, id)
+}
+
+func (s *Instrumented) SetRebootRun(ctx context.Context, run *RebootRun) (err error) {
+	defer s.observe("SetRebootRun", time.Now(), &err)
+	return s.store.SetRebootRun(ctx, run)
+}
+
+func (s *Instrumented) ListRebootRuns(ctx context.Context, filter RebootRunFilter) (_ []*RebootRun, err error) {
+	defer s.observe("ListRebootRuns", time.Now(), &err)
+	return s.store.ListRebootRuns(ctx, filter)
+}
+
+func (s *Instrumented) CreateArtifact(ctx context.Context, a *Artifact) (err error) {
+	defer s.observe("CreateArtifact", time.Now(), &err)
+	return s.store.CreateArtifact(ctx, a)
+}
+
+func (s *Instrumented) GetArtifact(ctx context.Context, id string) (_ *Artifact, err error) {
+	defer s.observe("GetArtifact", time.Now(), &err)
+	return s.store.GetArtifact(ctx, id)
+}
+
+func (s *Instrumented) ListArtifacts(ctx context.Context) (_ []*Artifact, err error) {
+	defer s.observe("ListArtifacts", time.Now(), &err)
+	return s.store.ListArtifacts(ctx)
+}
+
+func (s *Instrumented) DeleteArtifact(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteArtifact", time.Now(), &err)
+	return s.store.DeleteArtifact(ctx, id)
+}
+
+func (s *Instrumented) CreateRecording(ctx context.Context, rec *Recording) (err error) {
+	defer s.observe("CreateRecording", time.Now(), &err)
+	return s.store.CreateRecording(ctx, rec)
+}
+
+func (s *Instrumented) FinishRecording(ctx context.Context, rec *Recording) (err error) {
+	defer s.observe("FinishRecording", time.Now(), &err)
+	return s.store.FinishRecording(ctx, rec)
+}
+
+func (s *Instrumented) GetRecording(ctx context.Context, id string) (_ *Recording, err error) {
+	defer s.observe("GetRecording", time.Now(), &err)
+	return s.store.GetRecording(ctx, id)
+}
+
+func (s *Instrumented) ListRecordings(ctx context.Context, filter RecordingFilter) (_ []*Recording, err error) {
+	defer s.observe("ListRecordings", time.Now(), &err)
+	return s.store.ListRecordings(ctx, filter)
+}
+
+func (s *Instrumented) SetRecordingHold(ctx context.Context, rec *Recording) (err error) {
+	defer s.observe("SetRecordingHold", time.Now(), &err)
+	return s.store.SetRecordingHold(ctx, rec)
+}
+
+func (s *Instrumented) DeleteRecording(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteRecording", time.Now(), &err)
+	return s.store.DeleteRecording(ctx, id)
+}
+
+func (s *Instrumented) PruneRecordings(ctx context.Context, before time.Time) (_ []*Recording, err error) {
+	defer s.observe("PruneRecordings", time.Now(), &err)
+	return s.store.PruneRecordings(ctx, before)
+}
+
+func (s *Instrumented) CreateDeployment(ctx context.Context, d *Deployment, agentIDs []string) (err error) {
+	defer s.observe("CreateDeployment", time.Now(), &err)
+	return s.store.CreateDeployment(ctx, d, agentIDs)
+}
+
+func (s *Instrumented) GetDeployment(ctx context.Context, id string) (_ *Deployment, err error) {
+	defer s.observe("GetDeployment", time.Now(), &err)
+	return s.store.GetDeployment(ctx, id)
+}
+
+func (s *Instrumented) ListDeployments(ctx context.Context, limit int) (_ []*Deployment, err error) {
+	defer s.observe("ListDeployments", time.Now(), &err)
+	return s.store.ListDeployments(ctx, limit)
+}
+
+func (s *Instrumented) ListDeploymentResults(ctx context.Context, filter DeploymentResultFilter) (_ []*DeploymentResult, err error) {
+	defer s.observe("ListDeploymentResults", time.Now(), &err)
+	return s.store.ListDeploymentResults(ctx, filter)
+}
+
+func (s *Instrumented) UpdateDeploymentResult(ctx context.Context, r *DeploymentResult) (err error) {
+	defer s.observe("UpdateDeploymentResult", time.Now(), &err)
+	return s.store.UpdateDeploymentResult(ctx, r)
+}
+
+func (s *Instrumented) CreateAlertRule(ctx context.Context, rule *AlertRule) (err error) {
+	defer s.observe("CreateAlertRule", time.Now(), &err)
+	return s.store.CreateAlertRule(ctx, rule)
+}
+
+func (s *Instrumented) GetAlertRule(ctx context.Context, id string) (_ *AlertRule, err error) {
+	defer s.observe("GetAlertRule", time.Now(), &err)
+	return s.store.GetAlertRule(ctx, id)
+}
+
+func (s *Instrumented) ListAlertRules(ctx context.Context) (_ []*AlertRule, err error) {
+	defer s.observe("ListAlertRules", time.Now(), &err)
+	return s.store.ListAlertRules(ctx)
+}
+
+func (s *Instrumented) DeleteAlertRule(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteAlertRule", time.Now(), &err)
+	return s.store.DeleteAlertRule(ctx, id)
+}
+
+func (s *Instrumented) CreateAlert(ctx context.Context, alert *Alert) (err error) {
+	defer s.observe("CreateAlert", time.Now(), &err)
+	return s.store.CreateAlert(ctx, alert)
+}
+
+func (s *Instrumented) ResolveAlert(ctx context.Context, id string, at time.Time) (err error) {
+	defer s.observe("ResolveAlert", time.Now(), &err)
+	return s.store.ResolveAlert(ctx, id, at)
+}
+
+func (s *Instrumented) ListAlerts(ctx context.Context, filter AlertFilter) (_ []*Alert, err error) {
+	defer s.observe("ListAlerts", time.Now(), &err)
+	return s.store.ListAlerts(ctx, filter)
+}
+
+func (s *Instrumented) RecordHealthSamples(ctx context.Context, samples []*HealthSample) (err error) {
+	defer s.observe("RecordHealthSamples", time.Now(), &err)
+	return s.store.RecordHealthSamples(ctx, samples)
+}
+
+func (s *Instrumented) ListHealthSamples(ctx context.Context, agentID string, since, until time.Time) (_ []*HealthSample, err error) {
+	defer s.observe("ListHealthSamples", time.Now(), &err)
+	return s.store.ListHealthSamples(ctx, agentID, since, until)
+}
+
+func (s *Instrumented) DeleteHealthSamplesBefore(ctx context.Context, before time.Time) (_ int64, err error) {
+	defer s.observe("DeleteHealthSamplesBefore", time.Now(), &err)
+	return s.store.DeleteHealthSamplesBefore(ctx, before)
+}
+
+func (s *Instrumented) CreateReportSchedule(ctx context.Context, sched *ReportSchedule) (err error) {
+	defer s.observe("CreateReportSchedule", time.Now(), &err)
+	return s.store.CreateReportSchedule(ctx, sched)
+}
+
+func (s *Instrumented) GetReportSchedule(ctx context.Context, id string) (_ *ReportSchedule, err error) {
+	defer s.observe("GetReportSchedule", time.Now(), &err)
+	return s.store.GetReportSchedule(ctx, id)
+}
+
+func (s *Instrumented) ListReportSchedules(ctx context.Context) (_ []*ReportSchedule, err error) {
+	defer s.observe("ListReportSchedules", time.Now(), &err)
+	return s.store.ListReportSchedules(ctx)
+}
+
+func (s *Instrumented) DeleteReportSchedule(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteReportSchedule", time.Now(), &err)
+	return s.store.DeleteReportSchedule(ctx, id)
+}
+
+func (s *Instrumented) SetReportScheduleRun(ctx context.Context, id string, at time.Time) (err error) {
+	defer s.observe("SetReportScheduleRun", time.Now(), &err)
+	return s.store.SetReportScheduleRun(ctx, id, at)
+}
+
+func (s *Instrumented) CreateReport(ctx context.Context, report *Report) (err error) {
+	defer s.observe("CreateReport", time.Now(), &err)
+	return s.store.CreateReport(ctx, report)
+}
+
+func (s *Instrumented) GetReport(ctx context.Context, id string) (_ *Report, err error) {
+	defer s.observe("GetReport", time.Now(), &err)
+	return s.store.GetReport(ctx, id)
+}
+
+func (s *Instrumented) ListReports(ctx context.Context, limit int) (_ []*Report, err error) {
+	defer s.observe("ListReports", time.Now(), &err)
+	return s.store.ListReports(ctx, limit)
+}
+
+func (s *Instrumented) DeleteReportsBefore(ctx context.Context, before time.Time) (_ []string, err error) {
+	defer s.observe("DeleteReportsBefore", time.Now(), &err)
+	return s.store.DeleteReportsBefore(ctx, before)
+}
+
+func (s *Instrumented) CreateOrg(ctx context.Context, org *Organization) (err error) {
+	defer s.observe("CreateOrg", time.Now(), &err)
+	return s.store.CreateOrg(ctx, org)
+}
+
+func (s *Instrumented) GetOrg(ctx context.Context, id string) (_ *Organization, err error) {
+	defer s.observe("GetOrg", time.Now(), &err)
+	return s.store.GetOrg(ctx, id)
+}
+
+func (s *Instrumented) ListOrgs(ctx context.Context) (_ []*Organization, err error) {
+	defer s.observe("ListOrgs", time.Now(), &err)
+	return s.store.ListOrgs(ctx)
+}
+
+func (s *Instrumented) DeleteOrg(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteOrg", time.Now(), &err)
+	return s.store.DeleteOrg(ctx, id)
+}
+
+func (s *Instrumented) SetOrgStatus(ctx context.Context, id, mode, tokenHash string) (err error) {
+	defer s.observe("SetOrgStatus", time.Now(), &err)
+	return s.store.SetOrgStatus(ctx, id, mode, tokenHash)
+}
+
+func (s *Instrumented) SetBranding(ctx context.Context, b *Branding) (err error) {
+	defer s.observe("SetBranding", time.Now(), &err)
+	return s.store.SetBranding(ctx, b)
+}
+
+func (s *Instrumented) GetBranding(ctx context.Context, orgID string) (_ *Branding, err error) {
+	defer s.observe("GetBranding", time.Now(), &err)
+	return s.store.GetBranding(ctx, orgID)
+}
+
+func (s *Instrumented) ListBrandings(ctx context.Context) (_ []*Branding, err error) {
+	defer s.observe("ListBrandings", time.Now(), &err)
+	return s.store.ListBrandings(ctx)
+}
+
+func (s *Instrumented) DeleteBranding(ctx context.Context, orgID string) (err error) {
+	defer s.observe("DeleteBranding", time.Now(), &err)
+	return s.store.DeleteBranding(ctx, orgID)
+}
+
+func (s *Instrumented) RecordUsageSample(ctx context.Context, sample *UsageSample) (err error) {
+	defer s.observe("RecordUsageSample", time.Now(), &err)
+	return s.store.RecordUsageSample(ctx, sample)
+}
+
+func (s *Instrumented) AddSessionUsage(ctx context.Context, orgID string, at time.Time, seconds, bytes int64) (err error) {
+	defer s.observe("AddSessionUsage", time.Now(), &err)
+	return s.store.AddSessionUsage(ctx, orgID, at, seconds, bytes)
+}
+
+func (s *Instrumented) ListUsageMonths(ctx context.Context, orgID, from, to string) (_ []*UsageMonth, err error) {
+	defer s.observe("ListUsageMonths", time.Now(), &err)
+	return s.store.ListUsageMonths(ctx, orgID, from, to)
+}
+
+func (s *Instrumented) ListUsageSamples(ctx context.Context, orgID string, since, until time.Time) (_ []*UsageSample, err error) {
+	defer s.observe("ListUsageSamples", time.Now(), &err)
+	return s.store.ListUsageSamples(ctx, orgID, since, until)
+}
+
+func (s *Instrumented) CreateIntegration(ctx context.Context, in *Integration) (err error) {
+	defer s.observe("CreateIntegration", time.Now(), &err)
+	return s.store.CreateIntegration(ctx, in)
+}
+
+func (s *Instrumented) GetIntegration(ctx context.Context, id string) (_ *Integration, err error) {
+	defer s.observe("GetIntegration", time.Now(), &err)
+	return s.store.GetIntegration(ctx, id)
+}
+
+func (s *Instrumented) ListIntegrations(ctx context.Context) (_ []*Integration, err error) {
+	defer s.observe("ListIntegrations", time.Now(), &err)
+	return s.store.ListIntegrations(ctx)
+}
+
+func (s *Instrumented) UpdateIntegration(ctx context.Context, in *Integration) (err error) {
+	defer s.observe("UpdateIntegration", time.Now(), &err)
+	return s.store.UpdateIntegration(ctx, in)
+}
+
+func (s *Instrumented) DeleteIntegration(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteIntegration", time.Now(), &err)
+	return s.store.DeleteIntegration(ctx, id)
+}
+
+func (s *Instrumented) CreateTicket(ctx context.Context, t *Ticket) (err error) {
+	defer s.observe("CreateTicket", time.Now(), &err)
+	return s.store.CreateTicket(ctx, t)
+}
+
+func (s *Instrumented) ListTickets(ctx context.Context, filter TicketFilter) (_ []*Ticket, err error) {
+	defer s.observe("ListTickets", time.Now(), &err)
+	return s.store.ListTickets(ctx, filter)
+}
+
+func (s *Instrumented) CreateSSHKey(ctx context.Context, key *SSHKey) (err error) {
+	defer s.observe("CreateSSHKey", time.Now(), &err)
+	return s.store.CreateSSHKey(ctx, key)
+}
+
+func (s *Instrumented) GetSSHKey(ctx context.Context, id string) (_ *SSHKey, err error) {
+	defer s.observe("GetSSHKey", time.Now(), &err)
+	return s.store.GetSSHKey(ctx, id)
+}
+
+func (s *Instrumented) ListSSHKeys(ctx context.Context) (_ []*SSHKey, err error) {
+	defer s.observe("ListSSHKeys", time.Now(), &err)
+	return s.store.ListSSHKeys(ctx)
+}
+
+func (s *Instrumented) DeleteSSHKey(ctx context.Context, id string) (err error) {
+	defer s.observe("DeleteSSHKey", time.Now(), &err)
+	return s.store.DeleteSSHKey(ctx, id)
+}
+
+func (s *Instrumented) SetSSHKeyAssignments(ctx context.Context, agentID, username string, keyIDs []string, by string) (err error) {
+	defer s.observe("SetSSHKeyAssignments", time.Now(), &err)
+	return s.store.SetSSHKeyAssignments(ctx, agentID, username, keyIDs, by)
+}
+
+func (s *Instrumented) ListSSHKeyAssignments(ctx context.Context, agentID string) (_ []*SSHKeyAssignment, err error) {
+	defer s.observe("ListSSHKeyAssignments", time.Now(), &err)
+	return s.store.ListSSHKeyAssignments(ctx, agentID)
+}
+
+func (s *Instrumented) CreateOperation(ctx context.Context, op *Operation) (err error) {
+	defer s.observe("CreateOperation", time.Now(), &err)
+	return s.store.CreateOperation(ctx, op)
+}
+
+func (s *Instrumented) UpdateOperation(ctx context.Context, op *Operation) (err error) {
+	defer s.observe("UpdateOperation", time.Now(), &err)
+	return s.store.UpdateOperation(ctx, op)
+}
+
+func (s *Instrumented) GetOperation(ctx context.Context, id string) (_ *Operation, err error) {
+	defer s.observe("GetOperation", time.Now(), &err)
+	return s.store.GetOperation(ctx, id)
+}
+
+func (s *Instrumented) ListOperations(ctx context.Context, filter OperationFilter) (_ []*Operation, err error) {
+	defer s.observe("ListOperations", time.Now(), &err)
+	return s.store.ListOperations(ctx, filter)
+}
+
+func (s *Instrumented) InterruptOperations(ctx context.Context, before time.Time) (_ int64, err error) {
+	defer s.observe("InterruptOperations", time.Now(), &err)
+	return s.store.InterruptOperations(ctx, before)
+}
+
+func (s *Instrumented) DeleteOperationsBefore(ctx context.Context, before time.Time) (_ int64, err error) {
+	defer s.observe("DeleteOperationsBefore", time.Now(), &err)
+	return s.store.DeleteOperationsBefore(ctx, before)
+}
+
+func (s *Instrumented) MigrateExtension(ctx context.Context, name string, migrations []string) (err error) {
+	defer s.observe("MigrateExtension", time.Now(), &err)
+	return s.store.MigrateExtension(ctx, name, migrations)
+}
+
+// DB is not instrumented: extensions query it directly.
+func (s *Instrumented) DB() *sql.DB {
+	return s.store.DB()
+}
+
+func (s *Instrumented) Backup(ctx context.Context, path string) (err error) {
+	defer s.observe("Backup", time.Now(), &err)
+	return s.store.Backup(ctx, path)
+}
+
+func (s *Instrumented) Close() (err error) {
+	defer s.observe("Close", time.Now(), &err)
+	return s.store.Close()
+}
@@ -3,7 +3,12 @@ package store
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
 	"time"
 
 	_ "modernc.org/sqlite" // Pure-Go SQLite driver.
@@ -40,27 +45,398 @@ var migrations = []string{
 		created_at TEXT NOT NULL,
 		last_used  TEXT
 	)`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id         TEXT PRIMARY KEY,
+		token_hash TEXT UNIQUE NOT NULL,
+		api_key_id TEXT NOT NULL,
+		csrf_token TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS viewer_sessions (
+		id           TEXT PRIMARY KEY,
+		agent_id     TEXT NOT NULL,
+		api_key_id   TEXT NOT NULL,
+		api_key_name TEXT NOT NULL DEFAULT '',
+		remote_addr  TEXT NOT NULL DEFAULT '',
+		started_at   TEXT NOT NULL,
+		ended_at     TEXT,
+		key_events   INTEGER NOT NULL DEFAULT 0,
+		mouse_events INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_viewer_sessions_agent ON viewer_sessions (agent_id, started_at)`,
+	`CREATE TABLE IF NOT EXISTS audit_events (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		time       TEXT NOT NULL,
+		action     TEXT NOT NULL,
+		actor_id   TEXT NOT NULL DEFAULT '',
+		actor_name TEXT NOT NULL DEFAULT '',
+		agent_id   TEXT NOT NULL DEFAULT '',
+		session_id TEXT NOT NULL DEFAULT '',
+		detail     TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_audit_events_agent ON audit_events (agent_id, time)`,
+	`CREATE TABLE IF NOT EXISTS dropbox_files (
+		id           TEXT PRIMARY KEY,
+		agent_id     TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		size         INTEGER NOT NULL,
+		sha256       TEXT NOT NULL,
+		created_by   TEXT NOT NULL DEFAULT '',
+		created_at   TEXT NOT NULL,
+		expires_at   TEXT NOT NULL,
+		status       TEXT NOT NULL,
+		delivered_at TEXT,
+		path         TEXT NOT NULL DEFAULT '',
+		error        TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_dropbox_files_agent ON dropbox_files (agent_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS screenshot_schedules (
+		agent_id       TEXT PRIMARY KEY,
+		interval_min   INTEGER NOT NULL,
+		display        INTEGER NOT NULL DEFAULT 0,
+		keep           INTEGER NOT NULL,
+		retention_days INTEGER NOT NULL,
+		enabled        INTEGER NOT NULL DEFAULT 1,
+		updated_by     TEXT NOT NULL DEFAULT '',
+		updated_at     TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS screenshots (
+		id       TEXT PRIMARY KEY,
+		agent_id TEXT NOT NULL,
+		taken_at TEXT NOT NULL,
+		display  INTEGER NOT NULL,
+		size     INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_screenshots_agent ON screenshots (agent_id, taken_at)`,
+	`CREATE TABLE IF NOT EXISTS alert_rules (
+		id          TEXT PRIMARY KEY,
+		name        TEXT NOT NULL,
+		type        TEXT NOT NULL,
+		agent_id    TEXT NOT NULL DEFAULT '',
+		for_minutes INTEGER NOT NULL DEFAULT 0,
+		created_by  TEXT NOT NULL DEFAULT '',
+		created_at  TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS alerts (
+		id          TEXT PRIMARY KEY,
+		rule_id     TEXT NOT NULL,
+		type        TEXT NOT NULL,
+		agent_id    TEXT NOT NULL,
+		message     TEXT NOT NULL DEFAULT '',
+		raised_at   TEXT NOT NULL,
+		resolved_at TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_alerts_agent ON alerts (agent_id, raised_at)`,
+	`CREATE TABLE IF NOT EXISTS health_samples (
+		agent_id    TEXT NOT NULL,
+		at          TEXT NOT NULL,
+		cpu_percent REAL NOT NULL,
+		memory_free INTEGER NOT NULL,
+		disk_free   INTEGER NOT NULL,
+		replayed    INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (agent_id, at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS report_schedules (
+		id          TEXT PRIMARY KEY,
+		name        TEXT NOT NULL,
+		format      TEXT NOT NULL,
+		frequency   TEXT NOT NULL,
+		channels    TEXT NOT NULL DEFAULT '[]',
+		created_by  TEXT NOT NULL DEFAULT '',
+		created_at  TEXT NOT NULL,
+		last_run_at TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS reports (
+		id           TEXT PRIMARY KEY,
+		schedule_id  TEXT NOT NULL DEFAULT '',
+		name         TEXT NOT NULL,
+		format       TEXT NOT NULL,
+		period_start TEXT NOT NULL,
+		period_end   TEXT NOT NULL,
+		created_at   TEXT NOT NULL,
+		size         INTEGER NOT NULL,
+		delivered    TEXT NOT NULL DEFAULT '[]',
+		error        TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS organizations (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS org_branding (
+		org_id        TEXT PRIMARY KEY,
+		product_name  TEXT NOT NULL DEFAULT '',
+		primary_color TEXT NOT NULL DEFAULT '',
+		accent_color  TEXT NOT NULL DEFAULT '',
+		domains       TEXT NOT NULL DEFAULT '[]',
+		logo_type     TEXT NOT NULL DEFAULT '',
+		updated_by    TEXT NOT NULL DEFAULT '',
+		updated_at    TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS usage_samples (
+		org_id TEXT NOT NULL,
+		at     TEXT NOT NULL,
+		agents INTEGER NOT NULL,
+		online INTEGER NOT NULL,
+		PRIMARY KEY (org_id, at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS usage_months (
+		org_id          TEXT NOT NULL,
+		month           TEXT NOT NULL,
+		agent_peak      INTEGER NOT NULL DEFAULT 0,
+		online_peak     INTEGER NOT NULL DEFAULT 0,
+		agent_hours     INTEGER NOT NULL DEFAULT 0,
+		samples         INTEGER NOT NULL DEFAULT 0,
+		sessions        INTEGER NOT NULL DEFAULT 0,
+		session_seconds INTEGER NOT NULL DEFAULT 0,
+		bytes_relayed   INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (org_id, month)
+	)`,
+	`CREATE TABLE IF NOT EXISTS integrations (
+		id          TEXT PRIMARY KEY,
+		name        TEXT NOT NULL,
+		provider    TEXT NOT NULL,
+		config      TEXT NOT NULL DEFAULT '{}',
+		alert_types TEXT NOT NULL DEFAULT '[]',
+		enabled     INTEGER NOT NULL DEFAULT 1,
+		created_by  TEXT NOT NULL DEFAULT '',
+		created_at  TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS tickets (
+		id             TEXT PRIMARY KEY,
+		integration_id TEXT NOT NULL,
+		alert_id       TEXT NOT NULL,
+		agent_id       TEXT NOT NULL,
+		external_id    TEXT NOT NULL DEFAULT '',
+		created_at     TEXT NOT NULL,
+		error          TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_tickets_alert ON tickets (alert_id)`,
+	`CREATE TABLE IF NOT EXISTS ssh_keys (
+		id          TEXT PRIMARY KEY,
+		name        TEXT NOT NULL,
+		public_key  TEXT NOT NULL,
+		fingerprint TEXT UNIQUE NOT NULL,
+		created_by  TEXT NOT NULL DEFAULT '',
+		created_at  TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS ssh_key_assignments (
+		key_id      TEXT NOT NULL,
+		agent_id    TEXT NOT NULL,
+		username    TEXT NOT NULL,
+		assigned_by TEXT NOT NULL DEFAULT '',
+		assigned_at TEXT NOT NULL,
+		PRIMARY KEY (agent_id, username, key_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS diagnostics_archives (
+		id           TEXT PRIMARY KEY,
+		agent_id     TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		size         INTEGER NOT NULL,
+		sha256       TEXT NOT NULL,
+		requested_by TEXT NOT NULL DEFAULT '',
+		collected_at TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_diagnostics_archives_agent ON diagnostics_archives (agent_id, collected_at)`,
+	`CREATE TABLE IF NOT EXISTS reboot_schedules (
+		id           TEXT PRIMARY KEY,
+		name         TEXT NOT NULL,
+		agent_id     TEXT NOT NULL DEFAULT '',
+		org_id       TEXT NOT NULL DEFAULT '',
+		site         TEXT NOT NULL DEFAULT '',
+		days         TEXT NOT NULL DEFAULT '[]',
+		start        TEXT NOT NULL,
+		timezone     TEXT NOT NULL,
+		window_min   INTEGER NOT NULL,
+		countdown    INTEGER NOT NULL,
+		deferrals    INTEGER NOT NULL,
+		defer_min    INTEGER NOT NULL,
+		pending_only INTEGER NOT NULL DEFAULT 0,
+		message      TEXT NOT NULL DEFAULT '',
+		created_by   TEXT NOT NULL DEFAULT '',
+		created_at   TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS access_schedules (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		org_id     TEXT NOT NULL DEFAULT '',
+		site       TEXT NOT NULL DEFAULT '',
+		days       TEXT NOT NULL DEFAULT '[]',
+		start      TEXT NOT NULL,
+		end_time   TEXT NOT NULL,
+		timezone   TEXT NOT NULL,
+		mode       TEXT NOT NULL,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS reboot_runs (
+		schedule_id  TEXT NOT NULL,
+		agent_id     TEXT NOT NULL,
+		window_start TEXT NOT NULL,
+		status       TEXT NOT NULL,
+		deferrals    INTEGER NOT NULL DEFAULT 0,
+		next_at      TEXT NOT NULL,
+		notice_id    TEXT NOT NULL DEFAULT '',
+		error        TEXT NOT NULL DEFAULT '',
+		updated_at   TEXT NOT NULL,
+		PRIMARY KEY (schedule_id, agent_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS deployments (
+		id             TEXT PRIMARY KEY,
+		manager        TEXT NOT NULL,
+		action         TEXT NOT NULL,
+		package        TEXT NOT NULL,
+		version        TEXT NOT NULL DEFAULT '',
+		agent_ids      TEXT NOT NULL DEFAULT '[]',
+		org_id         TEXT NOT NULL DEFAULT '',
+		site           TEXT NOT NULL DEFAULT '',
+		timeout_min    INTEGER NOT NULL,
+		max_concurrent INTEGER NOT NULL DEFAULT 0,
+		created_by     TEXT NOT NULL DEFAULT '',
+		created_at     TEXT NOT NULL,
+		expires_at     TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS deployment_results (
+		deployment_id TEXT NOT NULL,
+		agent_id      TEXT NOT NULL,
+		status        TEXT NOT NULL,
+		exit_code     INTEGER NOT NULL DEFAULT 0,
+		output        TEXT NOT NULL DEFAULT '',
+		error         TEXT NOT NULL DEFAULT '',
+		started_at    TEXT,
+		finished_at   TEXT,
+		PRIMARY KEY (deployment_id, agent_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_deployment_results_status ON deployment_results (status)`,
+	`CREATE TABLE IF NOT EXISTS artifacts (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		kind       TEXT NOT NULL,
+		size       INTEGER NOT NULL,
+		sha256     TEXT NOT NULL,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS recordings (
+		id          TEXT PRIMARY KEY,
+		agent_id    TEXT NOT NULL,
+		api_key_id  TEXT NOT NULL DEFAULT '',
+		operator    TEXT NOT NULL DEFAULT '',
+		started_at  TEXT NOT NULL,
+		ended_at    TEXT,
+		frames      INTEGER NOT NULL DEFAULT 0,
+		size        INTEGER NOT NULL DEFAULT 0,
+		legal_hold  INTEGER NOT NULL DEFAULT 0,
+		hold_reason TEXT NOT NULL DEFAULT '',
+		hold_by     TEXT NOT NULL DEFAULT '',
+		hold_at     TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_recordings_agent ON recordings (agent_id, started_at)`,
+	`CREATE TABLE IF NOT EXISTS operations (
+		id            TEXT PRIMARY KEY,
+		kind          TEXT NOT NULL,
+		status        TEXT NOT NULL,
+		progress      INTEGER NOT NULL DEFAULT 0,
+		message       TEXT NOT NULL DEFAULT '',
+		result        TEXT NOT NULL DEFAULT '',
+		error         TEXT NOT NULL DEFAULT '',
+		created_by_id TEXT NOT NULL DEFAULT '',
+		created_by    TEXT NOT NULL DEFAULT '',
+		created_at    TEXT NOT NULL,
+		started_at    TEXT,
+		finished_at   TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_operations_created ON operations (created_at)`,
+	`CREATE TABLE IF NOT EXISTS extension_migrations (
+		extension  TEXT NOT NULL,
+		version    INTEGER NOT NULL,
+		applied_at TEXT NOT NULL,
+		PRIMARY KEY (extension, version)
+	)`,
+}
+
+// columnMigrations adds columns to tables created by earlier releases.
+// SQLite has no ADD COLUMN IF NOT EXISTS, so each is applied only when
+// the column is missing.
+var columnMigrations = []struct {
+	table, column, def string
+}{
+	{"enrollment_tokens", "expected_hostname", "TEXT NOT NULL DEFAULT ''"},
+	{"enrollment_tokens", "used_hostname", "TEXT NOT NULL DEFAULT ''"},
+	{"enrollment_tokens", "bind_hostname", "TEXT NOT NULL DEFAULT ''"},
+	{"enrollment_tokens", "bind_mac", "TEXT NOT NULL DEFAULT ''"},
+	{"enrollment_tokens", "bind_machine_id", "TEXT NOT NULL DEFAULT ''"},
+	{"agents", "attestation_type", "TEXT NOT NULL DEFAULT ''"},
+	{"agents", "attestation_key", "TEXT NOT NULL DEFAULT ''"},
+	// Agents enrolled before per-agent settings keep unattended access.
+	{"agents", "unattended", "INTEGER NOT NULL DEFAULT 1"},
+	{"agents", "org_id", "TEXT NOT NULL DEFAULT ''"},
+	{"enrollment_tokens", "org_id", "TEXT NOT NULL DEFAULT ''"},
+	{"agents", "site", "TEXT NOT NULL DEFAULT ''"},
+	{"enrollment_tokens", "site", "TEXT NOT NULL DEFAULT ''"},
+	{"organizations", "status_mode", "TEXT NOT NULL DEFAULT ''"},
+	{"organizations", "status_token_hash", "TEXT NOT NULL DEFAULT ''"},
+	{"viewer_sessions", "frames_sent", "INTEGER NOT NULL DEFAULT 0"},
+	{"viewer_sessions", "frames_dropped", "INTEGER NOT NULL DEFAULT 0"},
+	{"alert_rules", "threshold", "REAL NOT NULL DEFAULT 0"},
+	{"deployments", "artifact_id", "TEXT NOT NULL DEFAULT ''"},
+	{"enrollment_tokens", "max_uses", "INTEGER NOT NULL DEFAULT 0"},
+	{"enrollment_tokens", "uses", "INTEGER NOT NULL DEFAULT 0"},
+	{"enrollment_tokens", "image", "TEXT NOT NULL DEFAULT ''"},
+	{"agents", "image", "TEXT NOT NULL DEFAULT ''"},
+	// Keys created before roles keep full access.
+	{"api_keys", "role", "TEXT NOT NULL DEFAULT 'admin'"},
+	{"agents", "viewer_permissions", "TEXT NOT NULL DEFAULT ''"},
+	{"viewer_sessions", "latency_ms", "REAL NOT NULL DEFAULT 0"},
+	{"viewer_sessions", "max_latency_ms", "REAL NOT NULL DEFAULT 0"},
+	{"agents", "telemetry_only", "INTEGER NOT NULL DEFAULT 0"},
+	{"agents", "sensitive", "INTEGER NOT NULL DEFAULT 0"},
 }
 
+// tsLayout is a fixed-width UTC timestamp with nanoseconds, used where
+// sub-second ordering matters. Unlike RFC3339Nano it never trims trailing
+// zeros, so TEXT columns sort chronologically.
+const tsLayout = "2006-01-02T15:04:05.000000000Z"
+
 // SQLiteStore implements Store using a SQLite database.
 type SQLiteStore struct {
 	db *sql.DB
+
+	stmtMu sync.Mutex
+	stmts  map[string]*sql.Stmt // prepared on first use; see stmt
+
+	// Timestamps written in batches; see runTouches.
+	touchMu     sync.Mutex
+	keysUsed    map[string]time.Time // api_keys.last_used by key ID
+	agentsSeen  map[string]time.Time // agents.last_seen by agent ID
+	stopTouches chan struct{}
+	touchesDone chan struct{}
 }
 
 // NewSQLiteStore opens (or creates) a SQLite database at path and runs migrations.
 func NewSQLiteStore(path string) (*SQLiteStore, error) {
-	dsn := fmt.Sprintf("%s?_journal=WAL&_busy_timeout=5000", path)
+	dsn := fmt.Sprintf("%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)", path)
 	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
 	db.SetMaxOpenConns(1) // SQLite handles one writer at a time.
 
-	s := &SQLiteStore{db: db}
+	s := &SQLiteStore{
+		db:          db,
+		stmts:       make(map[string]*sql.Stmt),
+		keysUsed:    make(map[string]time.Time),
+		agentsSeen:  make(map[string]time.Time),
+		stopTouches: make(chan struct{}),
+		touchesDone: make(chan struct{}),
+	}
 	if err := s.migrate(); err != nil {
 		db.Close() //nolint:errcheck
 		return nil, err
 	}
+	go s.runTouches()
 	return s, nil
 }
 
@@ -70,41 +446,201 @@ func (s *SQLiteStore) migrate() error {
 			return fmt.Errorf("migration: %w", err)
 		}
 	}
+	for _, c := range columnMigrations {
+		if err := s.ensureColumn(c.table, c.column, c.def); err != nil {
+			return fmt.Errorf("migration: %w", err)
+		}
+	}
+	return nil
+}
+
+// ensureColumn adds column to table unless it already exists.
+func (s *SQLiteStore) ensureColumn(table, column, def string) error {
+	rows, err := s.db.Query(fmt.Sprintf(`SELECT name FROM pragma_table_info('%s')`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, def))
+	return err
+}
+
+// Close writes pending timestamps and closes the database.
+func (s *SQLiteStore) Close() error {
+	close(s.stopTouches)
+	<-s.touchesDone
+	if err := s.flushTouches(); err != nil {
+		log.Printf("Store: flush timestamps: %v", err)
+	}
+	s.stmtMu.Lock()
+	for _, st := range s.stmts {
+		st.Close() //nolint:errcheck
+	}
+	s.stmtMu.Unlock()
+	return s.db.Close()
+}
+
+// MigrateExtension applies the extension's migrations it has not applied
+// yet, each in a transaction with the record that it was. Migration n is
+// recorded as version n, from 1.
+func (s *SQLiteStore) MigrateExtension(ctx context.Context, name string, migrations []string) error {
+	var applied int
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT COALESCE(MAX(version), 0) FROM extension_migrations WHERE extension = ?`, name).Scan(&applied); err != nil {
+		return err
+	}
+	for v := applied + 1; v <= len(migrations); v++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, migrations[v-1]); err != nil {
+			tx.Rollback() //nolint:errcheck
+			return fmt.Errorf("migration %d: %w", v, err)
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO extension_migrations (extension, version, applied_at) VALUES (?, ?, ?)`,
+			name, v, time.Now().UTC().Format(tsLayout)); err != nil {
+			tx.Rollback() //nolint:errcheck
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (s *SQLiteStore) Close() error { return s.db.Close() }
+// DB returns the database, for extensions' own tables. Its single
+// connection is shared with the store.
+func (s *SQLiteStore) DB() *sql.DB {
+	return s.db
+}
+
+// Backup uses VACUUM INTO to write a compacted, transactionally
+// consistent copy of the database without blocking readers. Only ctx
+// bounds it: copying a large database can outlast queryTimeout.
+func (s *SQLiteStore) Backup(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("backup target %s already exists", path)
+	}
+	_, err := s.db.ExecContext(ctx, `VACUUM INTO ?`, path)
+	return err
+}
 
 // --- Agents ---
 
 func (s *SQLiteStore) CreateAgent(ctx context.Context, a *AgentRecord) error {
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO agents (id, name, hostname, os, arch, credential_hash, enrolled_at, last_seen)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+	_, err := s.exec(ctx,
+		`INSERT INTO agents (id, name, hostname, os, arch, credential_hash, enrolled_at, last_seen,
+		 attestation_type, attestation_key, unattended, org_id, site, image, viewer_permissions, telemetry_only, sensitive)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		a.ID, a.Name, a.Hostname, a.OS, a.Arch,
-		a.CredentialHash, a.EnrolledAt.UTC().Format(time.RFC3339), a.LastSeen.UTC().Format(time.RFC3339))
+		a.CredentialHash, a.EnrolledAt.UTC().Format(time.RFC3339), a.LastSeen.UTC().Format(time.RFC3339),
+		a.AttestationType, a.AttestationKey, a.Unattended, a.OrgID, a.Site, a.Image, permissionsColumn(a.ViewerPermissions), a.TelemetryOnly, a.Sensitive)
 	return err
 }
 
 func (s *SQLiteStore) GetAgent(ctx context.Context, id string) (*AgentRecord, error) {
-	return s.scanAgent(s.db.QueryRowContext(ctx,
-		`SELECT id, name, hostname, os, arch, credential_hash, enrolled_at, last_seen FROM agents WHERE id = ?`, id))
+	return s.scanAgent(s.queryRow(ctx,
+		`SELECT id, name, hostname, os, arch, credential_hash, enrolled_at, last_seen, attestation_type, attestation_key, unattended, org_id, site, image, viewer_permissions, telemetry_only, sensitive FROM agents WHERE id = ?`, id))
 }
 
 func (s *SQLiteStore) GetAgentByCredential(ctx context.Context, credentialHash string) (*AgentRecord, error) {
-	return s.scanAgent(s.db.QueryRowContext(ctx,
-		`SELECT id, name, hostname, os, arch, credential_hash, enrolled_at, last_seen FROM agents WHERE credential_hash = ?`, credentialHash))
+	return s.scanAgent(s.queryRow(ctx,
+		`SELECT id, name, hostname, os, arch, credential_hash, enrolled_at, last_seen, attestation_type, attestation_key, unattended, org_id, site, image, viewer_permissions, telemetry_only, sensitive FROM agents WHERE credential_hash = ?`, credentialHash))
 }
 
+// UpdateAgentSeen records t as the agent's last_seen time. The write is
+// batched (see runTouches); reads through the store see it at once.
 func (s *SQLiteStore) UpdateAgentSeen(ctx context.Context, id string, t time.Time) error {
-	_, err := s.db.ExecContext(ctx,
-		`UPDATE agents SET last_seen = ? WHERE id = ?`, t.UTC().Format(time.RFC3339), id)
-	return err
+	s.touchMu.Lock()
+	s.agentsSeen[id] = t
+	s.touchMu.Unlock()
+	return nil
+}
+
+func (s *SQLiteStore) SetAgentUnattended(ctx context.Context, id string, allowed bool) error {
+	res, err := s.exec(ctx, `UPDATE agents SET unattended = ? WHERE id = ?`, allowed, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("agent %s not found", id)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SetAgentOrg(ctx context.Context, id, orgID string) error {
+	res, err := s.exec(ctx, `UPDATE agents SET org_id = ? WHERE id = ?`, orgID, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("agent %s not found", id)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SetAgentSite(ctx context.Context, id, site string) error {
+	res, err := s.exec(ctx, `UPDATE agents SET site = ? WHERE id = ?`, site, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("agent %s not found", id)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SetAgentViewerPermissions(ctx context.Context, id string, perms []string) error {
+	res, err := s.exec(ctx, `UPDATE agents SET viewer_permissions = ? WHERE id = ?`, permissionsColumn(perms), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("agent %s not found", id)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SetAgentSensitive(ctx context.Context, id string, sensitive bool) error {
+	res, err := s.exec(ctx, `UPDATE agents SET sensitive = ? WHERE id = ?`, sensitive, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("agent %s not found", id)
+	}
+	return nil
+}
+
+// permissionsColumn encodes an agent's viewer permissions as JSON,
+// storing a nil list (no restriction) as the empty string.
+func permissionsColumn(perms []string) string {
+	if perms == nil {
+		return ""
+	}
+	data, _ := json.Marshal(perms)
+	return string(data)
 }
 
 func (s *SQLiteStore) ListAgents(ctx context.Context) ([]*AgentRecord, error) {
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, name, hostname, os, arch, credential_hash, enrolled_at, last_seen FROM agents ORDER BY enrolled_at DESC`)
+	rows, err := s.query(ctx,
+		`SELECT id, name, hostname, os, arch, credential_hash, enrolled_at, last_seen, attestation_type, attestation_key, unattended, org_id, site, image, viewer_permissions, telemetry_only, sensitive FROM agents ORDER BY enrolled_at DESC`)
 	if err != nil {
 		return nil, err
 	}
@@ -121,15 +657,122 @@ func (s *SQLiteStore) ListAgents(ctx context.Context) ([]*AgentRecord, error) {
 	return agents, rows.Err()
 }
 
-func (s *SQLiteStore) DeleteAgent(ctx context.Context, id string) error {
-	_, err := s.db.ExecContext(ctx, `DELETE FROM agents WHERE id = ?`, id)
-	return err
+// deleteStatements remove an agent and the work still queued for it,
+// keyed by the table they touch. Its history (sessions, recordings,
+// screenshots, audit events, alerts and tickets) is kept; open alerts are
+// resolved and queued drop-box files and deployments canceled.
+var deleteStatements = []struct{ table, query string }{
+	{"dropbox_files", `UPDATE dropbox_files SET status = 'canceled' WHERE agent_id = ? AND status = 'pending'`},
+	{"screenshot_schedules", `DELETE FROM screenshot_schedules WHERE agent_id = ?`},
+	{"alert_rules", `DELETE FROM alert_rules WHERE agent_id = ?`},
+	{"alerts", `UPDATE alerts SET resolved_at = strftime('%Y-%m-%dT%H:%M:%SZ', 'now') WHERE agent_id = ? AND resolved_at IS NULL`},
+	{"ssh_key_assignments", `DELETE FROM ssh_key_assignments WHERE agent_id = ?`},
+	{"reboot_schedules", `DELETE FROM reboot_schedules WHERE agent_id = ?`},
+	{"reboot_runs", `DELETE FROM reboot_runs WHERE agent_id = ?`},
+	{"deployment_results", `UPDATE deployment_results SET status = 'canceled' WHERE agent_id = ? AND status = 'pending'`},
+	{"agents", `DELETE FROM agents WHERE id = ?`},
+}
+
+// DeleteAgent removes an agent, which revokes its credential, and the
+// work queued for it in one transaction (see deleteStatements), also
+// removing it from deployment target lists. It returns the number of rows
+// changed per table.
+func (s *SQLiteStore) DeleteAgent(ctx context.Context, id string) (map[string]int64, error) {
+	return s.runAgentStatements(ctx, id, deleteStatements)
+}
+
+// purgeStatements erase an agent's data, keyed by the table they touch.
+// Audit events are kept but anonymized: the agent ID and the detail,
+// which may name the host or its users, are cleared. Recordings on legal
+// hold are kept.
+var purgeStatements = []struct{ table, query string }{
+	{"viewer_sessions", `DELETE FROM viewer_sessions WHERE agent_id = ?`},
+	{"audit_events", `UPDATE audit_events SET agent_id = '', detail = '' WHERE agent_id = ?`},
+	{"dropbox_files", `DELETE FROM dropbox_files WHERE agent_id = ?`},
+	{"screenshot_schedules", `DELETE FROM screenshot_schedules WHERE agent_id = ?`},
+	{"screenshots", `DELETE FROM screenshots WHERE agent_id = ?`},
+	{"recordings", `DELETE FROM recordings WHERE agent_id = ? AND legal_hold = 0`},
+	{"diagnostics_archives", `DELETE FROM diagnostics_archives WHERE agent_id = ?`},
+	{"alert_rules", `DELETE FROM alert_rules WHERE agent_id = ?`},
+	{"alerts", `DELETE FROM alerts WHERE agent_id = ?`},
+	{"health_samples", `DELETE FROM health_samples WHERE agent_id = ?`},
+	{"tickets", `DELETE FROM tickets WHERE agent_id = ?`},
+	{"ssh_key_assignments", `DELETE FROM ssh_key_assignments WHERE agent_id = ?`},
+	{"reboot_schedules", `DELETE FROM reboot_schedules WHERE agent_id = ?`},
+	{"reboot_runs", `DELETE FROM reboot_runs WHERE agent_id = ?`},
+	{"deployment_results", `DELETE FROM deployment_results WHERE agent_id = ?`},
+	{"enrollment_tokens", `UPDATE enrollment_tokens SET used_by = '', used_hostname = '' WHERE used_by = ?`},
+	{"agents", `DELETE FROM agents WHERE id = ?`},
+}
+
+// PurgeAgent erases everything stored about an agent in one transaction
+// (see purgeStatements), also removing it from deployment target lists.
+// It returns the number of rows deleted or anonymized per table; files
+// kept outside the database are the caller's to remove.
+func (s *SQLiteStore) PurgeAgent(ctx context.Context, id string) (map[string]int64, error) {
+	return s.runAgentStatements(ctx, id, purgeStatements)
+}
+
+// runAgentStatements runs statements for agent id and removes it from
+// deployment target lists in one transaction, returning the rows changed
+// per table.
+func (s *SQLiteStore) runAgentStatements(ctx context.Context, id string, statements []struct{ table, query string }) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	counts := make(map[string]int64)
+	for _, st := range statements {
+		res, err := tx.ExecContext(ctx, st.query, id)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", st.table, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			counts[st.table] = n
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, agent_ids FROM deployments WHERE agent_ids LIKE ?`, `%"`+id+`"%`)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string][]string)
+	for rows.Next() {
+		var depID, ids string
+		if err := rows.Scan(&depID, &ids); err != nil {
+			rows.Close() //nolint:errcheck
+			return nil, err
+		}
+		var agentIDs []string
+		_ = json.Unmarshal([]byte(ids), &agentIDs)
+		targets[depID] = slices.DeleteFunc(agentIDs, func(a string) bool { return a == id })
+	}
+	rows.Close() //nolint:errcheck
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for depID, agentIDs := range targets {
+		ids, _ := json.Marshal(agentIDs)
+		if _, err := tx.ExecContext(ctx, `UPDATE deployments SET agent_ids = ? WHERE id = ?`, string(ids), depID); err != nil {
+			return nil, fmt.Errorf("deployments: %w", err)
+		}
+	}
+	if len(targets) > 0 {
+		counts["deployments"] = int64(len(targets))
+	}
+	return counts, tx.Commit()
 }
 
-func (s *SQLiteStore) scanAgent(row *sql.Row) (*AgentRecord, error) {
+func (s *SQLiteStore) scanAgent(row interface{ Scan(...any) error }) (*AgentRecord, error) {
 	var a AgentRecord
-	var enrolled, seen string
-	if err := row.Scan(&a.ID, &a.Name, &a.Hostname, &a.OS, &a.Arch, &a.CredentialHash, &enrolled, &seen); err != nil {
+	var enrolled, seen, perms string
+	if err := row.Scan(&a.ID, &a.Name, &a.Hostname, &a.OS, &a.Arch, &a.CredentialHash, &enrolled, &seen,
+		&a.AttestationType, &a.AttestationKey, &a.Unattended, &a.OrgID, &a.Site, &a.Image, &perms, &a.TelemetryOnly, &a.Sensitive); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
@@ -137,48 +780,123 @@ func (s *SQLiteStore) scanAgent(row *sql.Row) (*AgentRecord, error) {
 	}
 	a.EnrolledAt, _ = time.Parse(time.RFC3339, enrolled)
 	a.LastSeen, _ = time.Parse(time.RFC3339, seen)
+	if perms != "" {
+		_ = json.Unmarshal([]byte(perms), &a.ViewerPermissions)
+	}
+	if t, ok := s.pendingSeen(a.ID); ok {
+		a.LastSeen = t
+	}
 	return &a, nil
 }
 
-func (s *SQLiteStore) scanAgentRows(rows *sql.Rows) (*AgentRecord, error) {
+func (s *SQLiteStore) scanAgentRows(rows interface{ Scan(...any) error }) (*AgentRecord, error) {
 	var a AgentRecord
-	var enrolled, seen string
-	if err := rows.Scan(&a.ID, &a.Name, &a.Hostname, &a.OS, &a.Arch, &a.CredentialHash, &enrolled, &seen); err != nil {
+	var enrolled, seen, perms string
+	if err := rows.Scan(&a.ID, &a.Name, &a.Hostname, &a.OS, &a.Arch, &a.CredentialHash, &enrolled, &seen,
+		&a.AttestationType, &a.AttestationKey, &a.Unattended, &a.OrgID, &a.Site, &a.Image, &perms, &a.TelemetryOnly, &a.Sensitive); err != nil {
 		return nil, err
 	}
 	a.EnrolledAt, _ = time.Parse(time.RFC3339, enrolled)
 	a.LastSeen, _ = time.Parse(time.RFC3339, seen)
+	if perms != "" {
+		_ = json.Unmarshal([]byte(perms), &a.ViewerPermissions)
+	}
+	if t, ok := s.pendingSeen(a.ID); ok {
+		a.LastSeen = t
+	}
 	return &a, nil
 }
 
 // --- Enrollment Tokens ---
 
+const enrollmentTokenColumns = `id, code_hash, type, label, expected_hostname,
+	bind_hostname, bind_mac, bind_machine_id, org_id, site,
+	created_at, expires_at, used_at, used_by, used_hostname,
+	max_uses, uses, image`
+
+// scanEnrollmentToken reads one row selected with enrollmentTokenColumns.
+func scanEnrollmentToken(row interface{ Scan(...any) error }) (*EnrollmentToken, error) {
+	var t EnrollmentToken
+	var created, expires string
+	var usedAt, usedBy sql.NullString
+	if err := row.Scan(&t.ID, &t.CodeHash, &t.Type, &t.Label, &t.ExpectedHostname,
+		&t.BindHostname, &t.BindMAC, &t.BindMachineID, &t.OrgID, &t.Site,
+		&created, &expires, &usedAt, &usedBy, &t.UsedHostname,
+		&t.MaxUses, &t.Uses, &t.Image); err != nil {
+		return nil, err
+	}
+	t.CreatedAt, _ = time.Parse(time.RFC3339, created)
+	t.ExpiresAt, _ = time.Parse(time.RFC3339, expires)
+	if usedAt.Valid {
+		parsed, _ := time.Parse(time.RFC3339, usedAt.String)
+		t.UsedAt = &parsed
+	}
+	t.UsedBy = usedBy.String
+	t.HostnameMismatch = usedAt.Valid && t.ExpectedHostname != "" &&
+		!HostnameMatches(t.ExpectedHostname, t.UsedHostname)
+	return &t, nil
+}
+
+const insertEnrollmentToken = `INSERT INTO enrollment_tokens (id, code_hash, type, label, expected_hostname,
+	 bind_hostname, bind_mac, bind_machine_id, org_id, site, created_at, expires_at,
+	 max_uses, image)
+	 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+func enrollmentTokenArgs(t *EnrollmentToken) []any {
+	return []any{
+		t.ID, t.CodeHash, t.Type, t.Label, t.ExpectedHostname,
+		t.BindHostname, t.BindMAC, t.BindMachineID, t.OrgID, t.Site,
+		t.CreatedAt.UTC().Format(time.RFC3339), t.ExpiresAt.UTC().Format(time.RFC3339),
+		t.MaxUses, t.Image,
+	}
+}
+
 func (s *SQLiteStore) CreateEnrollmentToken(ctx context.Context, t *EnrollmentToken) error {
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO enrollment_tokens (id, code_hash, type, label, created_at, expires_at)
-		 VALUES (?, ?, ?, ?, ?, ?)`,
-		t.ID, t.CodeHash, t.Type, t.Label,
-		t.CreatedAt.UTC().Format(time.RFC3339), t.ExpiresAt.UTC().Format(time.RFC3339))
+	_, err := s.exec(ctx, insertEnrollmentToken, enrollmentTokenArgs(t)...)
 	return err
 }
 
-func (s *SQLiteStore) ConsumeEnrollmentToken(ctx context.Context, codeHash string, agentID string) (*EnrollmentToken, error) {
+// CreateEnrollmentTokens stores tokens in one transaction: if one fails,
+// none is stored.
+func (s *SQLiteStore) CreateEnrollmentTokens(ctx context.Context, tokens []*EnrollmentToken) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, t := range tokens {
+		if _, err := tx.ExecContext(ctx, insertEnrollmentToken, enrollmentTokenArgs(t)...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetEnrollmentToken(ctx context.Context, codeHash string) (*EnrollmentToken, error) {
+	t, err := scanEnrollmentToken(s.queryRow(ctx,
+		`SELECT `+enrollmentTokenColumns+` FROM enrollment_tokens WHERE code_hash = ?`, codeHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+func (s *SQLiteStore) ConsumeEnrollmentToken(ctx context.Context, codeHash, agentID, hostname string) (*EnrollmentToken, error) {
 	now := time.Now().UTC().Format(time.RFC3339)
 
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback() //nolint:errcheck
 
-	var t EnrollmentToken
-	var created, expires string
-	var usedAt, usedBy sql.NullString
-
-	err = tx.QueryRowContext(ctx,
-		`SELECT id, code_hash, type, label, created_at, expires_at, used_at, used_by
-		 FROM enrollment_tokens WHERE code_hash = ?`, codeHash).
-		Scan(&t.ID, &t.CodeHash, &t.Type, &t.Label, &created, &expires, &usedAt, &usedBy)
+	t, err := scanEnrollmentToken(tx.QueryRowContext(ctx,
+		`SELECT `+enrollmentTokenColumns+` FROM enrollment_tokens WHERE code_hash = ?`, codeHash))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -186,11 +904,14 @@ func (s *SQLiteStore) ConsumeEnrollmentToken(ctx context.Context, codeHash strin
 		return nil, err
 	}
 
-	t.CreatedAt, _ = time.Parse(time.RFC3339, created)
-	t.ExpiresAt, _ = time.Parse(time.RFC3339, expires)
-
-	// Check if already used.
-	if usedAt.Valid {
+	// Check if already used. Provisioning tokens enroll many agents, up
+	// to their limit.
+	switch {
+	case t.Type == TokenProvisioning:
+		if t.MaxUses > 0 && t.Uses >= t.MaxUses {
+			return nil, fmt.Errorf("provisioning token has no uses left")
+		}
+	case t.UsedAt != nil:
 		return nil, fmt.Errorf("enrollment token already used")
 	}
 
@@ -201,8 +922,8 @@ func (s *SQLiteStore) ConsumeEnrollmentToken(ctx context.Context, codeHash strin
 
 	// Mark as consumed.
 	if _, err := tx.ExecContext(ctx,
-		`UPDATE enrollment_tokens SET used_at = ?, used_by = ? WHERE id = ?`,
-		now, agentID, t.ID); err != nil {
+		`UPDATE enrollment_tokens SET used_at = ?, used_by = ?, used_hostname = ?, uses = uses + 1 WHERE id = ?`,
+		now, agentID, hostname, t.ID); err != nil {
 		return nil, err
 	}
 
@@ -210,13 +931,16 @@ func (s *SQLiteStore) ConsumeEnrollmentToken(ctx context.Context, codeHash strin
 		return nil, err
 	}
 
-	return &t, nil
+	t.UsedBy = agentID
+	t.UsedHostname = hostname
+	t.Uses++
+	t.HostnameMismatch = t.ExpectedHostname != "" && !HostnameMatches(t.ExpectedHostname, hostname)
+	return t, nil
 }
 
 func (s *SQLiteStore) ListEnrollmentTokens(ctx context.Context) ([]*EnrollmentToken, error) {
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, code_hash, type, label, created_at, expires_at, used_at, used_by
-		 FROM enrollment_tokens ORDER BY created_at DESC`)
+	rows, err := s.query(ctx,
+		`SELECT `+enrollmentTokenColumns+` FROM enrollment_tokens ORDER BY created_at DESC`)
 	if err != nil {
 		return nil, err
 	}
@@ -224,35 +948,26 @@ func (s *SQLiteStore) ListEnrollmentTokens(ctx context.Context) ([]*EnrollmentTo
 
 	var tokens []*EnrollmentToken
 	for rows.Next() {
-		var t EnrollmentToken
-		var created, expires string
-		var usedAt, usedBy sql.NullString
-		if err := rows.Scan(&t.ID, &t.CodeHash, &t.Type, &t.Label, &created, &expires, &usedAt, &usedBy); err != nil {
+		t, err := scanEnrollmentToken(rows)
+		if err != nil {
 			return nil, err
 		}
-		t.CreatedAt, _ = time.Parse(time.RFC3339, created)
-		t.ExpiresAt, _ = time.Parse(time.RFC3339, expires)
-		if usedAt.Valid {
-			parsed, _ := time.Parse(time.RFC3339, usedAt.String)
-			t.UsedAt = &parsed
-		}
-		t.UsedBy = usedBy.String
-		tokens = append(tokens, &t)
+		tokens = append(tokens, t)
 	}
 	return tokens, rows.Err()
 }
 
 func (s *SQLiteStore) DeleteEnrollmentToken(ctx context.Context, id string) error {
-	_, err := s.db.ExecContext(ctx, `DELETE FROM enrollment_tokens WHERE id = ?`, id)
+	_, err := s.exec(ctx, `DELETE FROM enrollment_tokens WHERE id = ?`, id)
 	return err
 }
 
 // --- API Keys ---
 
 func (s *SQLiteStore) CreateAPIKey(ctx context.Context, k *APIKey) error {
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO api_keys (id, name, key_hash, prefix, created_at) VALUES (?, ?, ?, ?, ?)`,
-		k.ID, k.Name, k.KeyHash, k.Prefix, k.CreatedAt.UTC().Format(time.RFC3339))
+	_, err := s.exec(ctx,
+		`INSERT INTO api_keys (id, name, key_hash, prefix, created_at, role) VALUES (?, ?, ?, ?, ?, ?)`,
+		k.ID, k.Name, k.KeyHash, k.Prefix, k.CreatedAt.UTC().Format(time.RFC3339), k.Role)
 	return err
 }
 
@@ -261,9 +976,9 @@ func (s *SQLiteStore) VerifyAPIKey(ctx context.Context, keyHash string) (*APIKey
 	var created string
 	var lastUsed sql.NullString
 
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, name, key_hash, prefix, created_at, last_used FROM api_keys WHERE key_hash = ?`, keyHash).
-		Scan(&k.ID, &k.Name, &k.KeyHash, &k.Prefix, &created, &lastUsed)
+	err := s.queryRow(ctx,
+		`SELECT id, name, key_hash, prefix, created_at, last_used, role FROM api_keys WHERE key_hash = ?`, keyHash).
+		Scan(&k.ID, &k.Name, &k.KeyHash, &k.Prefix, &created, &lastUsed, &k.Role)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -272,19 +987,17 @@ func (s *SQLiteStore) VerifyAPIKey(ctx context.Context, keyHash string) (*APIKey
 	}
 	k.CreatedAt, _ = time.Parse(time.RFC3339, created)
 
-	// Update last_used timestamp.
+	// Update last_used timestamp (batched; see runTouches).
 	now := time.Now()
 	k.LastUsed = &now
-	_, _ = s.db.ExecContext(ctx,
-		`UPDATE api_keys SET last_used = ? WHERE id = ?`,
-		now.UTC().Format(time.RFC3339), k.ID)
+	s.touchKey(k.ID, now)
 
 	return &k, nil
 }
 
 func (s *SQLiteStore) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, name, key_hash, prefix, created_at, last_used FROM api_keys ORDER BY created_at DESC`)
+	rows, err := s.query(ctx,
+		`SELECT id, name, key_hash, prefix, created_at, last_used, role FROM api_keys ORDER BY created_at DESC`)
 	if err != nil {
 		return nil, err
 	}
@@ -295,11 +1008,13 @@ func (s *SQLiteStore) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
 		var k APIKey
 		var created string
 		var lastUsed sql.NullString
-		if err := rows.Scan(&k.ID, &k.Name, &k.KeyHash, &k.Prefix, &created, &lastUsed); err != nil {
+		if err := rows.Scan(&k.ID, &k.Name, &k.KeyHash, &k.Prefix, &created, &lastUsed, &k.Role); err != nil {
 			return nil, err
 		}
 		k.CreatedAt, _ = time.Parse(time.RFC3339, created)
-		if lastUsed.Valid {
+		if t, ok := s.pendingUse(k.ID); ok {
+			k.LastUsed = &t
+		} else if lastUsed.Valid {
 			parsed, _ := time.Parse(time.RFC3339, lastUsed.String)
 			k.LastUsed = &parsed
 		}
@@ -309,6 +1024,1923 @@ func (s *SQLiteStore) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
 }
 
 func (s *SQLiteStore) DeleteAPIKey(ctx context.Context, id string) error {
-	_, err := s.db.ExecContext(ctx, `DELETE FROM api_keys WHERE id = ?`, id)
+	_, err := s.exec(ctx, `DELETE FROM api_keys WHERE id = ?`, id)
+	return err
+}
+
+// --- Sessions ---
+
+func (s *SQLiteStore) CreateSession(ctx context.Context, sess *Session) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO sessions (id, token_hash, api_key_id, csrf_token, created_at, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		sess.ID, sess.TokenHash, sess.APIKeyID, sess.CSRFToken,
+		sess.CreatedAt.UTC().Format(time.RFC3339), sess.ExpiresAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetSession returns the unexpired session for tokenHash, or nil if there is
+// none or its API key has since been deleted.
+func (s *SQLiteStore) GetSession(ctx context.Context, tokenHash string) (*Session, error) {
+	var sess Session
+	var created, expires string
+
+	err := s.queryRow(ctx,
+		`SELECT s.id, s.token_hash, s.api_key_id, k.name, k.role, s.csrf_token, s.created_at, s.expires_at
+		 FROM sessions s JOIN api_keys k ON k.id = s.api_key_id
+		 WHERE s.token_hash = ? AND s.expires_at > ?`,
+		tokenHash, time.Now().UTC().Format(time.RFC3339)).
+		Scan(&sess.ID, &sess.TokenHash, &sess.APIKeyID, &sess.APIKeyName, &sess.APIKeyRole, &sess.CSRFToken, &created, &expires)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sess.CreatedAt, _ = time.Parse(time.RFC3339, created)
+	sess.ExpiresAt, _ = time.Parse(time.RFC3339, expires)
+	return &sess, nil
+}
+
+func (s *SQLiteStore) DeleteSession(ctx context.Context, tokenHash string) error {
+	_, err := s.exec(ctx, `DELETE FROM sessions WHERE token_hash = ?`, tokenHash)
+	return err
+}
+
+func (s *SQLiteStore) DeleteExpiredSessions(ctx context.Context) error {
+	_, err := s.exec(ctx,
+		`DELETE FROM sessions WHERE expires_at <= ?`, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// --- Viewer Sessions ---
+
+func (s *SQLiteStore) CreateViewerSession(ctx context.Context, vs *ViewerSession) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO viewer_sessions (id, agent_id, api_key_id, api_key_name, remote_addr, started_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		vs.ID, vs.AgentID, vs.APIKeyID, vs.APIKeyName, vs.RemoteAddr,
+		vs.StartedAt.UTC().Format(tsLayout))
+	return err
+}
+
+// EndViewerSession stores the end time, the final input and frame
+// counters and the frame latency.
+func (s *SQLiteStore) EndViewerSession(ctx context.Context, vs *ViewerSession) error {
+	var ended interface{}
+	if vs.EndedAt != nil {
+		ended = vs.EndedAt.UTC().Format(tsLayout)
+	}
+	_, err := s.exec(ctx,
+		`UPDATE viewer_sessions SET ended_at = ?, key_events = ?, mouse_events = ?, frames_sent = ?, frames_dropped = ?,
+		        latency_ms = ?, max_latency_ms = ?
+		 WHERE id = ?`,
+		ended, vs.KeyEvents, vs.MouseEvents, vs.FramesSent, vs.FramesDropped, vs.LatencyMS, vs.MaxLatencyMS, vs.ID)
 	return err
 }
+
+// ListViewerSessions returns the most recent sessions, newest first.
+// An empty agentID lists sessions for all agents.
+func (s *SQLiteStore) ListViewerSessions(ctx context.Context, agentID string, limit int) ([]*ViewerSession, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.query(ctx,
+		`SELECT id, agent_id, api_key_id, api_key_name, remote_addr, started_at, ended_at, key_events, mouse_events,
+		        frames_sent, frames_dropped, latency_ms, max_latency_ms
+		 FROM viewer_sessions WHERE (? = '' OR agent_id = ?) ORDER BY started_at DESC LIMIT ?`,
+		agentID, agentID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var sessions []*ViewerSession
+	for rows.Next() {
+		var vs ViewerSession
+		var started string
+		var ended sql.NullString
+		if err := rows.Scan(&vs.ID, &vs.AgentID, &vs.APIKeyID, &vs.APIKeyName, &vs.RemoteAddr,
+			&started, &ended, &vs.KeyEvents, &vs.MouseEvents, &vs.FramesSent, &vs.FramesDropped,
+			&vs.LatencyMS, &vs.MaxLatencyMS); err != nil {
+			return nil, err
+		}
+		vs.StartedAt, _ = time.Parse(tsLayout, started)
+		if ended.Valid {
+			parsed, _ := time.Parse(tsLayout, ended.String)
+			vs.EndedAt = &parsed
+		}
+		sessions = append(sessions, &vs)
+	}
+	return sessions, rows.Err()
+}
+
+// --- Audit Events ---
+
+func (s *SQLiteStore) CreateAuditEvent(ctx context.Context, ev *AuditEvent) error {
+	res, err := s.exec(ctx,
+		`INSERT INTO audit_events (time, action, actor_id, actor_name, agent_id, session_id, detail)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		ev.Time.UTC().Format(tsLayout), ev.Action, ev.ActorID, ev.ActorName,
+		ev.AgentID, ev.SessionID, ev.Detail)
+	if err != nil {
+		return err
+	}
+	ev.ID, _ = res.LastInsertId()
+	return nil
+}
+
+// ListAuditEvents returns matching events, newest first.
+func (s *SQLiteStore) ListAuditEvents(ctx context.Context, f AuditFilter) ([]*AuditEvent, error) {
+	if f.Limit <= 0 {
+		f.Limit = 500
+	}
+	since := ""
+	if !f.Since.IsZero() {
+		since = f.Since.UTC().Format(tsLayout)
+	}
+	rows, err := s.query(ctx,
+		`SELECT id, time, action, actor_id, actor_name, agent_id, session_id, detail
+		 FROM audit_events
+		 WHERE (? = '' OR agent_id = ?) AND (? = '' OR session_id = ?) AND time >= ?
+		 ORDER BY id DESC LIMIT ?`,
+		f.AgentID, f.AgentID, f.SessionID, f.SessionID, since, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var events []*AuditEvent
+	for rows.Next() {
+		var ev AuditEvent
+		var t string
+		if err := rows.Scan(&ev.ID, &t, &ev.Action, &ev.ActorID, &ev.ActorName,
+			&ev.AgentID, &ev.SessionID, &ev.Detail); err != nil {
+			return nil, err
+		}
+		ev.Time, _ = time.Parse(tsLayout, t)
+		events = append(events, &ev)
+	}
+	return events, rows.Err()
+}
+
+// --- Drop-box Files ---
+
+const dropboxColumns = `id, agent_id, name, size, sha256, created_by, created_at, expires_at,
+	status, delivered_at, path, error`
+
+func (s *SQLiteStore) CreateDropboxFile(ctx context.Context, f *DropboxFile) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO dropbox_files (id, agent_id, name, size, sha256, created_by, created_at, expires_at, status)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		f.ID, f.AgentID, f.Name, f.Size, f.SHA256, f.CreatedBy,
+		f.CreatedAt.UTC().Format(tsLayout), f.ExpiresAt.UTC().Format(tsLayout), f.Status)
+	return err
+}
+
+// GetDropboxFile returns nil, nil when no file has the ID.
+func (s *SQLiteStore) GetDropboxFile(ctx context.Context, id string) (*DropboxFile, error) {
+	f, err := scanDropboxFile(s.queryRow(ctx,
+		`SELECT `+dropboxColumns+` FROM dropbox_files WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return f, err
+}
+
+// ListDropboxFiles returns files oldest first, which is also delivery
+// order. An empty agentID lists files for all agents.
+func (s *SQLiteStore) ListDropboxFiles(ctx context.Context, agentID string) ([]*DropboxFile, error) {
+	rows, err := s.query(ctx,
+		`SELECT `+dropboxColumns+` FROM dropbox_files
+		 WHERE (? = '' OR agent_id = ?) ORDER BY created_at`, agentID, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var files []*DropboxFile
+	for rows.Next() {
+		f, err := scanDropboxFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// UpdateDropboxFile stores the delivery outcome fields.
+func (s *SQLiteStore) UpdateDropboxFile(ctx context.Context, f *DropboxFile) error {
+	var delivered interface{}
+	if f.DeliveredAt != nil {
+		delivered = f.DeliveredAt.UTC().Format(tsLayout)
+	}
+	_, err := s.exec(ctx,
+		`UPDATE dropbox_files SET status = ?, delivered_at = ?, path = ?, error = ? WHERE id = ?`,
+		f.Status, delivered, f.Path, f.Error, f.ID)
+	return err
+}
+
+// scanDropboxFile reads one row selected with dropboxColumns.
+func scanDropboxFile(row interface{ Scan(...any) error }) (*DropboxFile, error) {
+	var f DropboxFile
+	var created, expires string
+	var delivered sql.NullString
+	if err := row.Scan(&f.ID, &f.AgentID, &f.Name, &f.Size, &f.SHA256, &f.CreatedBy,
+		&created, &expires, &f.Status, &delivered, &f.Path, &f.Error); err != nil {
+		return nil, err
+	}
+	f.CreatedAt, _ = time.Parse(tsLayout, created)
+	f.ExpiresAt, _ = time.Parse(tsLayout, expires)
+	if delivered.Valid {
+		t, _ := time.Parse(tsLayout, delivered.String)
+		f.DeliveredAt = &t
+	}
+	return &f, nil
+}
+
+// --- Screenshots ---
+
+// SetScreenshotSchedule creates or replaces the agent's schedule.
+func (s *SQLiteStore) SetScreenshotSchedule(ctx context.Context, sc *ScreenshotSchedule) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO screenshot_schedules (agent_id, interval_min, display, keep, retention_days, enabled, updated_by, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT (agent_id) DO UPDATE SET interval_min = excluded.interval_min, display = excluded.display,
+		   keep = excluded.keep, retention_days = excluded.retention_days, enabled = excluded.enabled,
+		   updated_by = excluded.updated_by, updated_at = excluded.updated_at`,
+		sc.AgentID, sc.Interval, sc.Display, sc.Keep, sc.RetentionDays, sc.Enabled,
+		sc.UpdatedBy, sc.UpdatedAt.UTC().Format(tsLayout))
+	return err
+}
+
+const screenshotScheduleColumns = `agent_id, interval_min, display, keep, retention_days, enabled, updated_by, updated_at`
+
+// GetScreenshotSchedule returns nil, nil when the agent has no schedule.
+func (s *SQLiteStore) GetScreenshotSchedule(ctx context.Context, agentID string) (*ScreenshotSchedule, error) {
+	sc, err := scanScreenshotSchedule(s.queryRow(ctx,
+		`SELECT `+screenshotScheduleColumns+` FROM screenshot_schedules WHERE agent_id = ?`, agentID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sc, err
+}
+
+func (s *SQLiteStore) ListScreenshotSchedules(ctx context.Context) ([]*ScreenshotSchedule, error) {
+	rows, err := s.query(ctx,
+		`SELECT `+screenshotScheduleColumns+` FROM screenshot_schedules ORDER BY agent_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var scheds []*ScreenshotSchedule
+	for rows.Next() {
+		sc, err := scanScreenshotSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		scheds = append(scheds, sc)
+	}
+	return scheds, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteScreenshotSchedule(ctx context.Context, agentID string) error {
+	_, err := s.exec(ctx, `DELETE FROM screenshot_schedules WHERE agent_id = ?`, agentID)
+	return err
+}
+
+// scanScreenshotSchedule reads one row selected with screenshotScheduleColumns.
+func scanScreenshotSchedule(row interface{ Scan(...any) error }) (*ScreenshotSchedule, error) {
+	var sc ScreenshotSchedule
+	var updated string
+	if err := row.Scan(&sc.AgentID, &sc.Interval, &sc.Display, &sc.Keep, &sc.RetentionDays,
+		&sc.Enabled, &sc.UpdatedBy, &updated); err != nil {
+		return nil, err
+	}
+	sc.UpdatedAt, _ = time.Parse(tsLayout, updated)
+	return &sc, nil
+}
+
+func (s *SQLiteStore) CreateScreenshot(ctx context.Context, shot *Screenshot) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO screenshots (id, agent_id, taken_at, display, size) VALUES (?, ?, ?, ?, ?)`,
+		shot.ID, shot.AgentID, shot.TakenAt.UTC().Format(tsLayout), shot.Display, shot.Size)
+	return err
+}
+
+// GetScreenshot returns nil, nil when no screenshot has the ID.
+func (s *SQLiteStore) GetScreenshot(ctx context.Context, id string) (*Screenshot, error) {
+	shot, err := scanScreenshot(s.queryRow(ctx,
+		`SELECT id, agent_id, taken_at, display, size FROM screenshots WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return shot, err
+}
+
+// ListScreenshots returns matching screenshots, newest first.
+func (s *SQLiteStore) ListScreenshots(ctx context.Context, f ScreenshotFilter) ([]*Screenshot, error) {
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+	since, until := "", ""
+	if !f.Since.IsZero() {
+		since = f.Since.UTC().Format(tsLayout)
+	}
+	if !f.Until.IsZero() {
+		until = f.Until.UTC().Format(tsLayout)
+	}
+	rows, err := s.query(ctx,
+		`SELECT id, agent_id, taken_at, display, size FROM screenshots
+		 WHERE (? = '' OR agent_id = ?) AND taken_at >= ? AND (? = '' OR taken_at < ?)
+		 ORDER BY taken_at DESC LIMIT ?`,
+		f.AgentID, f.AgentID, since, until, until, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var shots []*Screenshot
+	for rows.Next() {
+		shot, err := scanScreenshot(rows)
+		if err != nil {
+			return nil, err
+		}
+		shots = append(shots, shot)
+	}
+	return shots, rows.Err()
+}
+
+// PruneScreenshots deletes the agent's screenshots beyond the newest keep
+// and any taken before before, returning the deleted IDs (even on error)
+// so the caller can remove the images.
+func (s *SQLiteStore) PruneScreenshots(ctx context.Context, agentID string, keep int, before time.Time) ([]string, error) {
+	rows, err := s.query(ctx,
+		`SELECT id FROM screenshots WHERE agent_id = ? AND (taken_at < ? OR id NOT IN (
+		   SELECT id FROM screenshots WHERE agent_id = ? ORDER BY taken_at DESC LIMIT ?))`,
+		agentID, before.UTC().Format(tsLayout), agentID, keep)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close() //nolint:errcheck
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close() //nolint:errcheck
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, id := range ids {
+		if _, err := s.exec(ctx, `DELETE FROM screenshots WHERE id = ?`, id); err != nil {
+			return ids[:i], err
+		}
+	}
+	return ids, nil
+}
+
+// scanScreenshot reads one id, agent_id, taken_at, display, size row.
+func scanScreenshot(row interface{ Scan(...any) error }) (*Screenshot, error) {
+	var shot Screenshot
+	var taken string
+	if err := row.Scan(&shot.ID, &shot.AgentID, &taken, &shot.Display, &shot.Size); err != nil {
+		return nil, err
+	}
+	shot.TakenAt, _ = time.Parse(tsLayout, taken)
+	return &shot, nil
+}
+
+// --- Diagnostics archives ---
+
+func (s *SQLiteStore) CreateDiagnosticsArchive(ctx context.Context, a *DiagnosticsArchive) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO diagnostics_archives (id, agent_id, name, size, sha256, requested_by, collected_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, a.AgentID, a.Name, a.Size, a.SHA256, a.RequestedBy, a.CollectedAt.UTC().Format(tsLayout))
+	return err
+}
+
+const diagnosticsArchiveColumns = `id, agent_id, name, size, sha256, requested_by, collected_at`
+
+// GetDiagnosticsArchive returns nil, nil when no archive has the ID.
+func (s *SQLiteStore) GetDiagnosticsArchive(ctx context.Context, id string) (*DiagnosticsArchive, error) {
+	a, err := scanDiagnosticsArchive(s.queryRow(ctx,
+		`SELECT `+diagnosticsArchiveColumns+` FROM diagnostics_archives WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return a, err
+}
+
+// ListDiagnosticsArchives returns the agent's archives, newest first.
+func (s *SQLiteStore) ListDiagnosticsArchives(ctx context.Context, agentID string) ([]*DiagnosticsArchive, error) {
+	rows, err := s.query(ctx,
+		`SELECT `+diagnosticsArchiveColumns+` FROM diagnostics_archives
+		 WHERE agent_id = ? ORDER BY collected_at DESC`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var archives []*DiagnosticsArchive
+	for rows.Next() {
+		a, err := scanDiagnosticsArchive(rows)
+		if err != nil {
+			return nil, err
+		}
+		archives = append(archives, a)
+	}
+	return archives, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteDiagnosticsArchive(ctx context.Context, id string) error {
+	_, err := s.exec(ctx, `DELETE FROM diagnostics_archives WHERE id = ?`, id)
+	return err
+}
+
+// PruneDiagnosticsArchives deletes the agent's archives beyond the newest
+// keep, returning the deleted IDs (even on error) so the caller can
+// remove the files.
+func (s *SQLiteStore) PruneDiagnosticsArchives(ctx context.Context, agentID string, keep int) ([]string, error) {
+	rows, err := s.query(ctx,
+		`SELECT id FROM diagnostics_archives WHERE agent_id = ? AND id NOT IN (
+		   SELECT id FROM diagnostics_archives WHERE agent_id = ? ORDER BY collected_at DESC LIMIT ?)`,
+		agentID, agentID, keep)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close() //nolint:errcheck
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close() //nolint:errcheck
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, id := range ids {
+		if err := s.DeleteDiagnosticsArchive(ctx, id); err != nil {
+			return ids[:i], err
+		}
+	}
+	return ids, nil
+}
+
+// scanDiagnosticsArchive reads one row selected with
+// diagnosticsArchiveColumns.
+func scanDiagnosticsArchive(row interface{ Scan(...any) error }) (*DiagnosticsArchive, error) {
+	var a DiagnosticsArchive
+	var collected string
+	if err := row.Scan(&a.ID, &a.AgentID, &a.Name, &a.Size, &a.SHA256, &a.RequestedBy, &collected); err != nil {
+		return nil, err
+	}
+	a.CollectedAt, _ = time.Parse(tsLayout, collected)
+	return &a, nil
+}
+
+// --- Reboot schedules ---
+
+func (s *SQLiteStore) CreateRebootSchedule(ctx context.Context, r *RebootSchedule) error {
+	days, _ := json.Marshal(r.Days)
+	_, err := s.exec(ctx,
+		`INSERT INTO reboot_schedules (id, name, agent_id, org_id, site, days, start, timezone, window_min,
+		   countdown, deferrals, defer_min, pending_only, message, created_by, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.ID, r.Name, r.AgentID, r.OrgID, r.Site, string(days), r.Start, r.TimeZone, r.Window,
+		r.Countdown, r.Deferrals, r.DeferFor, r.PendingOnly, r.Message, r.CreatedBy, r.CreatedAt.UTC().Format(tsLayout))
+	return err
+}
+
+const rebootScheduleColumns = `id, name, agent_id, org_id, site, days, start, timezone, window_min,
+	countdown, deferrals, defer_min, pending_only, message, created_by, created_at`
+
+// GetRebootSchedule returns nil, nil when no schedule has the ID.
+func (s *SQLiteStore) GetRebootSchedule(ctx context.Context, id string) (*RebootSchedule, error) {
+	r, err := scanRebootSchedule(s.queryRow(ctx,
+		`SELECT `+rebootScheduleColumns+` FROM reboot_schedules WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+func (s *SQLiteStore) ListRebootSchedules(ctx context.Context) ([]*RebootSchedule, error) {
+	rows, err := s.query(ctx,
+		`SELECT `+rebootScheduleColumns+` FROM reboot_schedules ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var scheds []*RebootSchedule
+	for rows.Next() {
+		r, err := scanRebootSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		scheds = append(scheds, r)
+	}
+	return scheds, rows.Err()
+}
+
+// DeleteRebootSchedule deletes the schedule and its runs.
+func (s *SQLiteStore) DeleteRebootSchedule(ctx context.Context, id string) error {
+	if _, err := s.exec(ctx, `DELETE FROM reboot_runs WHERE schedule_id = ?`, id); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, `DELETE FROM reboot_schedules WHERE id = ?`, id)
+	return err
+}
+
+// scanRebootSchedule reads one row selected with rebootScheduleColumns.
+func scanRebootSchedule(row interface{ Scan(...any) error }) (*RebootSchedule, error) {
+	var r RebootSchedule
+	var days, created string
+	if err := row.Scan(&r.ID, &r.Name, &r.AgentID, &r.OrgID, &r.Site, &days, &r.Start, &r.TimeZone,
+		&r.Window, &r.Countdown, &r.Deferrals, &r.DeferFor, &r.PendingOnly, &r.Message,
+		&r.CreatedBy, &created); err != nil {
+		return nil, err
+	}
+	_ = json.Unmarshal([]byte(days), &r.Days)
+	r.CreatedAt, _ = time.Parse(tsLayout, created)
+	return &r, nil
+}
+
+// --- Access schedules ---
+
+func (s *SQLiteStore) CreateAccessSchedule(ctx context.Context, a *AccessSchedule) error {
+	days, _ := json.Marshal(a.Days)
+	_, err := s.exec(ctx,
+		`INSERT INTO access_schedules (id, name, org_id, site, days, start, end_time, timezone, mode, created_by, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, a.Name, a.OrgID, a.Site, string(days), a.Start, a.End, a.TimeZone, a.Mode,
+		a.CreatedBy, a.CreatedAt.UTC().Format(tsLayout))
+	return err
+}
+
+const accessScheduleColumns = `id, name, org_id, site, days, start, end_time, timezone, mode, created_by, created_at`
+
+// GetAccessSchedule returns nil, nil when no schedule has the ID.
+func (s *SQLiteStore) GetAccessSchedule(ctx context.Context, id string) (*AccessSchedule, error) {
+	a, err := scanAccessSchedule(s.queryRow(ctx,
+		`SELECT `+accessScheduleColumns+` FROM access_schedules WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return a, err
+}
+
+func (s *SQLiteStore) ListAccessSchedules(ctx context.Context) ([]*AccessSchedule, error) {
+	rows, err := s.query(ctx,
+		`SELECT `+accessScheduleColumns+` FROM access_schedules ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var scheds []*AccessSchedule
+	for rows.Next() {
+		a, err := scanAccessSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		scheds = append(scheds, a)
+	}
+	return scheds, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteAccessSchedule(ctx context.Context, id string) error {
+	_, err := s.exec(ctx, `DELETE FROM access_schedules WHERE id = ?`, id)
+	return err
+}
+
+// scanAccessSchedule reads one row selected with accessScheduleColumns.
+func scanAccessSchedule(row interface{ Scan(...any) error }) (*AccessSchedule, error) {
+	var a AccessSchedule
+	var days, created string
+	if err := row.Scan(&a.ID, &a.Name, &a.OrgID, &a.Site, &days, &a.Start, &a.End, &a.TimeZone,
+		&a.Mode, &a.CreatedBy, &created); err != nil {
+		return nil, err
+	}
+	_ = json.Unmarshal([]byte(days), &a.Days)
+	a.CreatedAt, _ = time.Parse(tsLayout, created)
+	return &a, nil
+}
+
+// SetRebootRun creates or replaces the schedule's run on the agent.
+func (s *SQLiteStore) SetRebootRun(ctx context.Context, run *RebootRun) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO reboot_runs (schedule_id, agent_id, window_start, status, deferrals, next_at, notice_id, error, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT (schedule_id, agent_id) DO UPDATE SET window_start = excluded.window_start,
+		   status = excluded.status, deferrals = excluded.deferrals, next_at = excluded.next_at,
+		   notice_id = excluded.notice_id, error = excluded.error, updated_at = excluded.updated_at`,
+		run.ScheduleID, run.AgentID, run.WindowStart.UTC().Format(tsLayout), run.Status, run.Deferrals,
+		run.NextAt.UTC().Format(tsLayout), run.NoticeID, run.Error, run.UpdatedAt.UTC().Format(tsLayout))
+	return err
+}
+
+// ListRebootRuns returns matching runs, most recently updated first.
+func (s *SQLiteStore) ListRebootRuns(ctx context.Context, f RebootRunFilter) ([]*RebootRun, error) {
+	rows, err := s.query(ctx,
+		`SELECT schedule_id, agent_id, window_start, status, deferrals, next_at, notice_id, error, updated_at
+		 FROM reboot_runs WHERE (? = '' OR schedule_id = ?) AND (? = '' OR agent_id = ?)
+		 ORDER BY updated_at DESC`,
+		f.ScheduleID, f.ScheduleID, f.AgentID, f.AgentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var runs []*RebootRun
+	for rows.Next() {
+		var run RebootRun
+		var window, next, updated string
+		if err := rows.Scan(&run.ScheduleID, &run.AgentID, &window, &run.Status, &run.Deferrals,
+			&next, &run.NoticeID, &run.Error, &updated); err != nil {
+			return nil, err
+		}
+		run.WindowStart, _ = time.Parse(tsLayout, window)
+		run.NextAt, _ = time.Parse(tsLayout, next)
+		run.UpdatedAt, _ = time.Parse(tsLayout, updated)
+		runs = append(runs, &run)
+	}
+	return runs, rows.Err()
+}
+
+// --- Artifacts ---
+
+func (s *SQLiteStore) CreateArtifact(ctx context.Context, a *Artifact) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO artifacts (id, name, kind, size, sha256, created_by, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, a.Name, a.Kind, a.Size, a.SHA256, a.CreatedBy, a.CreatedAt.UTC().Format(tsLayout))
+	return err
+}
+
+const artifactColumns = `id, name, kind, size, sha256, created_by, created_at`
+
+// GetArtifact returns nil, nil when no artifact has the ID.
+func (s *SQLiteStore) GetArtifact(ctx context.Context, id string) (*Artifact, error) {
+	a, err := scanArtifact(s.queryRow(ctx,
+		`SELECT `+artifactColumns+` FROM artifacts WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return a, err
+}
+
+// ListArtifacts returns every artifact, newest first.
+func (s *SQLiteStore) ListArtifacts(ctx context.Context) ([]*Artifact, error) {
+	rows, err := s.query(ctx,
+		`SELECT `+artifactColumns+` FROM artifacts ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var artifacts []*Artifact
+	for rows.Next() {
+		a, err := scanArtifact(rows)
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, a)
+	}
+	return artifacts, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteArtifact(ctx context.Context, id string) error {
+	_, err := s.exec(ctx, `DELETE FROM artifacts WHERE id = ?`, id)
+	return err
+}
+
+// scanArtifact reads one row selected with artifactColumns.
+func scanArtifact(row interface{ Scan(...any) error }) (*Artifact, error) {
+	var a Artifact
+	var created string
+	if err := row.Scan(&a.ID, &a.Name, &a.Kind, &a.Size, &a.SHA256, &a.CreatedBy, &created); err != nil {
+		return nil, err
+	}
+	a.CreatedAt, _ = time.Parse(tsLayout, created)
+	return &a, nil
+}
+
+// --- Recordings ---
+
+const recordingColumns = `id, agent_id, api_key_id, operator, started_at, ended_at,
+	frames, size, legal_hold, hold_reason, hold_by, hold_at`
+
+func (s *SQLiteStore) CreateRecording(ctx context.Context, rec *Recording) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO recordings (id, agent_id, api_key_id, operator, started_at) VALUES (?, ?, ?, ?, ?)`,
+		rec.ID, rec.AgentID, rec.APIKeyID, rec.Operator, rec.StartedAt.UTC().Format(tsLayout))
+	return err
+}
+
+// FinishRecording stores the end time, frame count and size.
+func (s *SQLiteStore) FinishRecording(ctx context.Context, rec *Recording) error {
+	var ended any
+	if rec.EndedAt != nil {
+		ended = rec.EndedAt.UTC().Format(tsLayout)
+	}
+	_, err := s.exec(ctx,
+		`UPDATE recordings SET ended_at = ?, frames = ?, size = ? WHERE id = ?`,
+		ended, rec.Frames, rec.Size, rec.ID)
+	return err
+}
+
+// GetRecording returns nil, nil when no recording has the ID.
+func (s *SQLiteStore) GetRecording(ctx context.Context, id string) (*Recording, error) {
+	rec, err := scanRecording(s.queryRow(ctx,
+		`SELECT `+recordingColumns+` FROM recordings WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return rec, err
+}
+
+// ListRecordings returns matching recordings, newest first.
+func (s *SQLiteStore) ListRecordings(ctx context.Context, f RecordingFilter) ([]*Recording, error) {
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+	rows, err := s.query(ctx,
+		`SELECT `+recordingColumns+` FROM recordings
+		 WHERE (? = '' OR agent_id = ?) AND (? = 0 OR legal_hold = 1)
+		 ORDER BY started_at DESC LIMIT ?`,
+		f.AgentID, f.AgentID, f.Held, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var recs []*Recording
+	for rows.Next() {
+		rec, err := scanRecording(rows)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+// SetRecordingHold stores the recording's legal hold fields.
+func (s *SQLiteStore) SetRecordingHold(ctx context.Context, rec *Recording) error {
+	var at any
+	if rec.HoldAt != nil {
+		at = rec.HoldAt.UTC().Format(tsLayout)
+	}
+	res, err := s.exec(ctx,
+		`UPDATE recordings SET legal_hold = ?, hold_reason = ?, hold_by = ?, hold_at = ? WHERE id = ?`,
+		rec.LegalHold, rec.HoldReason, rec.HoldBy, at, rec.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("recording %s not found", rec.ID)
+	}
+	return nil
+}
+
+// DeleteRecording deletes a recording unless it is on legal hold.
+func (s *SQLiteStore) DeleteRecording(ctx context.Context, id string) error {
+	res, err := s.exec(ctx, `DELETE FROM recordings WHERE id = ? AND legal_hold = 0`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("recording %s not found or on legal hold", id)
+	}
+	return nil
+}
+
+// PruneRecordings deletes finished recordings that ended before before
+// and are not on legal hold, returning them (even on error) so the caller
+// can remove their files.
+func (s *SQLiteStore) PruneRecordings(ctx context.Context, before time.Time) ([]*Recording, error) {
+	rows, err := s.query(ctx,
+		`SELECT `+recordingColumns+` FROM recordings
+		 WHERE legal_hold = 0 AND ended_at IS NOT NULL AND ended_at < ?`,
+		before.UTC().Format(tsLayout))
+	if err != nil {
+		return nil, err
+	}
+	var recs []*Recording
+	for rows.Next() {
+		rec, err := scanRecording(rows)
+		if err != nil {
+			rows.Close() //nolint:errcheck
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	rows.Close() //nolint:errcheck
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, rec := range recs {
+		// A hold placed since the SELECT still wins.
+		if _, err := s.exec(ctx, `DELETE FROM recordings WHERE id = ? AND legal_hold = 0`, rec.ID); err != nil {
+			return recs[:i], err
+		}
+	}
+	return recs, nil
+}
+
+// scanRecording reads one row selected with recordingColumns.
+func scanRecording(row interface{ Scan(...any) error }) (*Recording, error) {
+	var rec Recording
+	var started string
+	var ended, holdAt sql.NullString
+	if err := row.Scan(&rec.ID, &rec.AgentID, &rec.APIKeyID, &rec.Operator, &started, &ended,
+		&rec.Frames, &rec.Size, &rec.LegalHold, &rec.HoldReason, &rec.HoldBy, &holdAt); err != nil {
+		return nil, err
+	}
+	rec.StartedAt, _ = time.Parse(tsLayout, started)
+	if ended.Valid {
+		t, _ := time.Parse(tsLayout, ended.String)
+		rec.EndedAt = &t
+	}
+	if holdAt.Valid {
+		t, _ := time.Parse(tsLayout, holdAt.String)
+		rec.HoldAt = &t
+	}
+	return &rec, nil
+}
+
+// --- Software deployments ---
+
+// CreateDeployment stores the deployment with a pending result for each
+// target agent.
+func (s *SQLiteStore) CreateDeployment(ctx context.Context, d *Deployment, agentIDs []string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	ids, _ := json.Marshal(d.AgentIDs)
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO deployments (id, manager, action, package, version, artifact_id, agent_ids, org_id, site,
+		   timeout_min, max_concurrent, created_by, created_at, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.ID, d.Manager, d.Action, d.Package, d.Version, d.ArtifactID, string(ids), d.OrgID, d.Site,
+		d.Timeout, d.MaxConcurrent, d.CreatedBy, d.CreatedAt.UTC().Format(tsLayout),
+		d.ExpiresAt.UTC().Format(tsLayout)); err != nil {
+		return err
+	}
+	for _, agentID := range agentIDs {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO deployment_results (deployment_id, agent_id, status) VALUES (?, ?, ?)`,
+			d.ID, agentID, DeploymentPending); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const deploymentColumns = `id, manager, action, package, version, artifact_id, agent_ids, org_id, site,
+	timeout_min, max_concurrent, created_by, created_at, expires_at`
+
+// GetDeployment returns nil, nil when no deployment has the ID.
+func (s *SQLiteStore) GetDeployment(ctx context.Context, id string) (*Deployment, error) {
+	d, err := scanDeployment(s.queryRow(ctx,
+		`SELECT `+deploymentColumns+` FROM deployments WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return d, err
+}
+
+// ListDeployments returns up to limit deployments, newest first.
+func (s *SQLiteStore) ListDeployments(ctx context.Context, limit int) ([]*Deployment, error) {
+	rows, err := s.query(ctx,
+		`SELECT `+deploymentColumns+` FROM deployments ORDER BY created_at DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var deployments []*Deployment
+	for rows.Next() {
+		d, err := scanDeployment(rows)
+		if err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, d)
+	}
+	return deployments, rows.Err()
+}
+
+// scanDeployment reads one row selected with deploymentColumns.
+func scanDeployment(row interface{ Scan(...any) error }) (*Deployment, error) {
+	var d Deployment
+	var ids, created, expires string
+	if err := row.Scan(&d.ID, &d.Manager, &d.Action, &d.Package, &d.Version, &d.ArtifactID, &ids, &d.OrgID, &d.Site,
+		&d.Timeout, &d.MaxConcurrent, &d.CreatedBy, &created, &expires); err != nil {
+		return nil, err
+	}
+	_ = json.Unmarshal([]byte(ids), &d.AgentIDs)
+	d.CreatedAt, _ = time.Parse(tsLayout, created)
+	d.ExpiresAt, _ = time.Parse(tsLayout, expires)
+	return &d, nil
+}
+
+// ListDeploymentResults returns matching results, ordered by deployment
+// and agent.
+func (s *SQLiteStore) ListDeploymentResults(ctx context.Context, f DeploymentResultFilter) ([]*DeploymentResult, error) {
+	rows, err := s.query(ctx,
+		`SELECT deployment_id, agent_id, status, exit_code, output, error, started_at, finished_at
+		 FROM deployment_results
+		 WHERE (? = '' OR deployment_id = ?) AND (? = '' OR agent_id = ?) AND (? = '' OR status = ?)
+		 ORDER BY deployment_id, agent_id`,
+		f.DeploymentID, f.DeploymentID, f.AgentID, f.AgentID, f.Status, f.Status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var results []*DeploymentResult
+	for rows.Next() {
+		var r DeploymentResult
+		var started, finished sql.NullString
+		if err := rows.Scan(&r.DeploymentID, &r.AgentID, &r.Status, &r.ExitCode, &r.Output, &r.Error,
+			&started, &finished); err != nil {
+			return nil, err
+		}
+		if started.Valid {
+			t, _ := time.Parse(tsLayout, started.String)
+			r.StartedAt = &t
+		}
+		if finished.Valid {
+			t, _ := time.Parse(tsLayout, finished.String)
+			r.FinishedAt = &t
+		}
+		results = append(results, &r)
+	}
+	return results, rows.Err()
+}
+
+// UpdateDeploymentResult replaces the state of the deployment's result
+// on the agent.
+func (s *SQLiteStore) UpdateDeploymentResult(ctx context.Context, r *DeploymentResult) error {
+	var started, finished any
+	if r.StartedAt != nil {
+		started = r.StartedAt.UTC().Format(tsLayout)
+	}
+	if r.FinishedAt != nil {
+		finished = r.FinishedAt.UTC().Format(tsLayout)
+	}
+	_, err := s.exec(ctx,
+		`UPDATE deployment_results SET status = ?, exit_code = ?, output = ?, error = ?, started_at = ?, finished_at = ?
+		 WHERE deployment_id = ? AND agent_id = ?`,
+		r.Status, r.ExitCode, r.Output, r.Error, started, finished, r.DeploymentID, r.AgentID)
+	return err
+}
+
+// --- Alerts ---
+
+func (s *SQLiteStore) CreateAlertRule(ctx context.Context, r *AlertRule) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO alert_rules (id, name, type, agent_id, for_minutes, threshold, created_by, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.ID, r.Name, r.Type, r.AgentID, r.ForMinutes, r.Threshold, r.CreatedBy, r.CreatedAt.UTC().Format(tsLayout))
+	return err
+}
+
+const alertRuleColumns = `id, name, type, agent_id, for_minutes, threshold, created_by, created_at`
+
+// GetAlertRule returns nil, nil when no rule has the ID.
+func (s *SQLiteStore) GetAlertRule(ctx context.Context, id string) (*AlertRule, error) {
+	r, err := scanAlertRule(s.queryRow(ctx,
+		`SELECT `+alertRuleColumns+` FROM alert_rules WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+func (s *SQLiteStore) ListAlertRules(ctx context.Context) ([]*AlertRule, error) {
+	rows, err := s.query(ctx,
+		`SELECT `+alertRuleColumns+` FROM alert_rules ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var rules []*AlertRule
+	for rows.Next() {
+		r, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteAlertRule(ctx context.Context, id string) error {
+	_, err := s.exec(ctx, `DELETE FROM alert_rules WHERE id = ?`, id)
+	return err
+}
+
+// scanAlertRule reads one row selected with alertRuleColumns.
+func scanAlertRule(row interface{ Scan(...any) error }) (*AlertRule, error) {
+	var r AlertRule
+	var created string
+	if err := row.Scan(&r.ID, &r.Name, &r.Type, &r.AgentID, &r.ForMinutes, &r.Threshold, &r.CreatedBy, &created); err != nil {
+		return nil, err
+	}
+	r.CreatedAt, _ = time.Parse(tsLayout, created)
+	return &r, nil
+}
+
+func (s *SQLiteStore) CreateAlert(ctx context.Context, a *Alert) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO alerts (id, rule_id, type, agent_id, message, raised_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		a.ID, a.RuleID, a.Type, a.AgentID, a.Message, a.RaisedAt.UTC().Format(tsLayout))
+	return err
+}
+
+// ResolveAlert closes an open alert; resolving a closed one is a no-op.
+func (s *SQLiteStore) ResolveAlert(ctx context.Context, id string, at time.Time) error {
+	_, err := s.exec(ctx,
+		`UPDATE alerts SET resolved_at = ? WHERE id = ? AND resolved_at IS NULL`,
+		at.UTC().Format(tsLayout), id)
+	return err
+}
+
+// ListAlerts returns matching alerts, newest first.
+func (s *SQLiteStore) ListAlerts(ctx context.Context, f AlertFilter) ([]*Alert, error) {
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+	since := ""
+	if !f.Since.IsZero() {
+		since = f.Since.UTC().Format(tsLayout)
+	}
+	rows, err := s.query(ctx,
+		`SELECT id, rule_id, type, agent_id, message, raised_at, resolved_at FROM alerts
+		 WHERE (? = '' OR agent_id = ?) AND (? = '' OR rule_id = ?) AND (? = 0 OR resolved_at IS NULL)
+		   AND raised_at >= ?
+		 ORDER BY raised_at DESC LIMIT ?`,
+		f.AgentID, f.AgentID, f.RuleID, f.RuleID, f.Open, since, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var alerts []*Alert
+	for rows.Next() {
+		var a Alert
+		var raised string
+		var resolved sql.NullString
+		if err := rows.Scan(&a.ID, &a.RuleID, &a.Type, &a.AgentID, &a.Message, &raised, &resolved); err != nil {
+			return nil, err
+		}
+		a.RaisedAt, _ = time.Parse(tsLayout, raised)
+		if resolved.Valid {
+			t, _ := time.Parse(tsLayout, resolved.String)
+			a.ResolvedAt = &t
+		}
+		alerts = append(alerts, &a)
+	}
+	return alerts, rows.Err()
+}
+
+// --- Health history ---
+
+// RecordHealthSamples stores samples in one transaction. A second sample
+// for the same agent and time is ignored, so a backlog replayed twice is
+// stored once.
+func (s *SQLiteStore) RecordHealthSamples(ctx context.Context, samples []*HealthSample) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, h := range samples {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT OR IGNORE INTO health_samples (agent_id, at, cpu_percent, memory_free, disk_free, replayed)
+			 VALUES (?, ?, ?, ?, ?, ?)`,
+			h.AgentID, h.At.UTC().Format(tsLayout), h.CPU, h.MemoryFree, h.DiskFree, h.Replayed); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListHealthSamples returns an agent's samples taken in [since, until),
+// oldest first.
+func (s *SQLiteStore) ListHealthSamples(ctx context.Context, agentID string, since, until time.Time) ([]*HealthSample, error) {
+	rows, err := s.query(ctx,
+		`SELECT agent_id, at, cpu_percent, memory_free, disk_free, replayed FROM health_samples
+		 WHERE agent_id = ? AND at >= ? AND at < ? ORDER BY at`,
+		agentID, since.UTC().Format(tsLayout), until.UTC().Format(tsLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var samples []*HealthSample
+	for rows.Next() {
+		var h HealthSample
+		var at string
+		if err := rows.Scan(&h.AgentID, &at, &h.CPU, &h.MemoryFree, &h.DiskFree, &h.Replayed); err != nil {
+			return nil, err
+		}
+		h.At, _ = time.Parse(tsLayout, at)
+		samples = append(samples, &h)
+	}
+	return samples, rows.Err()
+}
+
+// DeleteHealthSamplesBefore deletes samples taken before before and
+// returns how many there were.
+func (s *SQLiteStore) DeleteHealthSamplesBefore(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.exec(ctx, `DELETE FROM health_samples WHERE at < ?`, before.UTC().Format(tsLayout))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// --- Reports ---
+
+func (s *SQLiteStore) CreateReportSchedule(ctx context.Context, r *ReportSchedule) error {
+	channels, _ := json.Marshal(r.Channels)
+	_, err := s.exec(ctx,
+		`INSERT INTO report_schedules (id, name, format, frequency, channels, created_by, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		r.ID, r.Name, r.Format, r.Frequency, string(channels), r.CreatedBy, r.CreatedAt.UTC().Format(tsLayout))
+	return err
+}
+
+const reportScheduleColumns = `id, name, format, frequency, channels, created_by, created_at, last_run_at`
+
+// GetReportSchedule returns nil, nil when no schedule has the ID.
+func (s *SQLiteStore) GetReportSchedule(ctx context.Context, id string) (*ReportSchedule, error) {
+	r, err := scanReportSchedule(s.queryRow(ctx,
+		`SELECT `+reportScheduleColumns+` FROM report_schedules WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+func (s *SQLiteStore) ListReportSchedules(ctx context.Context) ([]*ReportSchedule, error) {
+	rows, err := s.query(ctx,
+		`SELECT `+reportScheduleColumns+` FROM report_schedules ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var scheds []*ReportSchedule
+	for rows.Next() {
+		r, err := scanReportSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		scheds = append(scheds, r)
+	}
+	return scheds, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteReportSchedule(ctx context.Context, id string) error {
+	_, err := s.exec(ctx, `DELETE FROM report_schedules WHERE id = ?`, id)
+	return err
+}
+
+func (s *SQLiteStore) SetReportScheduleRun(ctx context.Context, id string, at time.Time) error {
+	_, err := s.exec(ctx,
+		`UPDATE report_schedules SET last_run_at = ? WHERE id = ?`, at.UTC().Format(tsLayout), id)
+	return err
+}
+
+// scanReportSchedule reads one row selected with reportScheduleColumns.
+func scanReportSchedule(row interface{ Scan(...any) error }) (*ReportSchedule, error) {
+	var r ReportSchedule
+	var channels, created string
+	var lastRun sql.NullString
+	if err := row.Scan(&r.ID, &r.Name, &r.Format, &r.Frequency, &channels, &r.CreatedBy,
+		&created, &lastRun); err != nil {
+		return nil, err
+	}
+	_ = json.Unmarshal([]byte(channels), &r.Channels)
+	r.CreatedAt, _ = time.Parse(tsLayout, created)
+	if lastRun.Valid {
+		t, _ := time.Parse(tsLayout, lastRun.String)
+		r.LastRunAt = &t
+	}
+	return &r, nil
+}
+
+func (s *SQLiteStore) CreateReport(ctx context.Context, r *Report) error {
+	delivered, _ := json.Marshal(r.Delivered)
+	_, err := s.exec(ctx,
+		`INSERT INTO reports (id, schedule_id, name, format, period_start, period_end, created_at, size, delivered, error)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.ID, r.ScheduleID, r.Name, r.Format, r.PeriodStart.UTC().Format(tsLayout),
+		r.PeriodEnd.UTC().Format(tsLayout), r.CreatedAt.UTC().Format(tsLayout), r.Size,
+		string(delivered), r.Error)
+	return err
+}
+
+const reportColumns = `id, schedule_id, name, format, period_start, period_end, created_at, size, delivered, error`
+
+// GetReport returns nil, nil when no report has the ID.
+func (s *SQLiteStore) GetReport(ctx context.Context, id string) (*Report, error) {
+	r, err := scanReport(s.queryRow(ctx,
+		`SELECT `+reportColumns+` FROM reports WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+// ListReports returns the newest reports first.
+func (s *SQLiteStore) ListReports(ctx context.Context, limit int) ([]*Report, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.query(ctx,
+		`SELECT `+reportColumns+` FROM reports ORDER BY created_at DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var reports []*Report
+	for rows.Next() {
+		r, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
+
+// DeleteReportsBefore deletes reports generated before before and returns
+// their IDs so the caller can remove the files.
+func (s *SQLiteStore) DeleteReportsBefore(ctx context.Context, before time.Time) ([]string, error) {
+	cutoff := before.UTC().Format(tsLayout)
+	rows, err := s.query(ctx, `SELECT id FROM reports WHERE created_at < ?`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close() //nolint:errcheck
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close() //nolint:errcheck
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := s.exec(ctx, `DELETE FROM reports WHERE created_at < ?`, cutoff); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// scanReport reads one row selected with reportColumns.
+func scanReport(row interface{ Scan(...any) error }) (*Report, error) {
+	var r Report
+	var start, end, created, delivered string
+	if err := row.Scan(&r.ID, &r.ScheduleID, &r.Name, &r.Format, &start, &end, &created,
+		&r.Size, &delivered, &r.Error); err != nil {
+		return nil, err
+	}
+	r.PeriodStart, _ = time.Parse(tsLayout, start)
+	r.PeriodEnd, _ = time.Parse(tsLayout, end)
+	r.CreatedAt, _ = time.Parse(tsLayout, created)
+	_ = json.Unmarshal([]byte(delivered), &r.Delivered)
+	return &r, nil
+}
+
+// --- Operations ---
+
+func (s *SQLiteStore) CreateOperation(ctx context.Context, op *Operation) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO operations (id, kind, status, progress, message, result, error, created_by_id, created_by, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		op.ID, op.Kind, op.Status, op.Progress, op.Message, string(op.Result), op.Error,
+		op.CreatedByID, op.CreatedBy, op.CreatedAt.UTC().Format(tsLayout))
+	return err
+}
+
+// UpdateOperation stores the operation's state, progress and outcome.
+func (s *SQLiteStore) UpdateOperation(ctx context.Context, op *Operation) error {
+	var started, finished any
+	if op.StartedAt != nil {
+		started = op.StartedAt.UTC().Format(tsLayout)
+	}
+	if op.FinishedAt != nil {
+		finished = op.FinishedAt.UTC().Format(tsLayout)
+	}
+	_, err := s.exec(ctx,
+		`UPDATE operations SET status = ?, progress = ?, message = ?, result = ?, error = ?, started_at = ?, finished_at = ?
+		 WHERE id = ?`,
+		op.Status, op.Progress, op.Message, string(op.Result), op.Error, started, finished, op.ID)
+	return err
+}
+
+const operationColumns = `id, kind, status, progress, message, result, error, created_by_id, created_by, created_at, started_at, finished_at`
+
+// GetOperation returns nil, nil when no operation has the ID.
+func (s *SQLiteStore) GetOperation(ctx context.Context, id string) (*Operation, error) {
+	op, err := scanOperation(s.queryRow(ctx,
+		`SELECT `+operationColumns+` FROM operations WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return op, err
+}
+
+// ListOperations returns the newest operations first.
+func (s *SQLiteStore) ListOperations(ctx context.Context, f OperationFilter) ([]*Operation, error) {
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+	rows, err := s.query(ctx,
+		`SELECT `+operationColumns+` FROM operations
+		 WHERE (? = '' OR kind = ?) AND (? = '' OR status = ?) AND (? = '' OR created_by_id = ?)
+		 ORDER BY created_at DESC LIMIT ?`,
+		f.Kind, f.Kind, f.Status, f.Status, f.CreatedByID, f.CreatedByID, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var ops []*Operation
+	for rows.Next() {
+		op, err := scanOperation(rows)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
+
+// InterruptOperations fails the operations created before before that
+// are still queued or running, which a server that stopped left
+// unfinished, and returns how many there were.
+func (s *SQLiteStore) InterruptOperations(ctx context.Context, before time.Time) (int64, error) {
+	cutoff := before.UTC().Format(tsLayout)
+	res, err := s.exec(ctx,
+		`UPDATE operations SET status = ?, error = 'interrupted by a server restart', finished_at = ?
+		 WHERE created_at < ? AND status IN (?, ?)`,
+		OperationFailed, cutoff, cutoff, OperationQueued, OperationRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteOperationsBefore deletes finished operations created before
+// before.
+func (s *SQLiteStore) DeleteOperationsBefore(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.exec(ctx,
+		`DELETE FROM operations WHERE created_at < ? AND status NOT IN (?, ?)`,
+		before.UTC().Format(tsLayout), OperationQueued, OperationRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// scanOperation reads one row selected with operationColumns.
+func scanOperation(row interface{ Scan(...any) error }) (*Operation, error) {
+	var op Operation
+	var result, created string
+	var started, finished sql.NullString
+	if err := row.Scan(&op.ID, &op.Kind, &op.Status, &op.Progress, &op.Message, &result, &op.Error,
+		&op.CreatedByID, &op.CreatedBy, &created, &started, &finished); err != nil {
+		return nil, err
+	}
+	if result != "" {
+		op.Result = json.RawMessage(result)
+	}
+	op.CreatedAt, _ = time.Parse(tsLayout, created)
+	if started.Valid {
+		t, _ := time.Parse(tsLayout, started.String)
+		op.StartedAt = &t
+	}
+	if finished.Valid {
+		t, _ := time.Parse(tsLayout, finished.String)
+		op.FinishedAt = &t
+	}
+	return &op, nil
+}
+
+// --- Organizations and usage ---
+
+// usageMonthLayout formats the calendar month (UTC) usage rolls up into.
+const usageMonthLayout = "2006-01"
+
+func (s *SQLiteStore) CreateOrg(ctx context.Context, o *Organization) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO organizations (id, name, created_by, created_at) VALUES (?, ?, ?, ?)`,
+		o.ID, o.Name, o.CreatedBy, o.CreatedAt.UTC().Format(tsLayout))
+	return err
+}
+
+const orgColumns = `id, name, created_by, created_at, status_mode, status_token_hash`
+
+// GetOrg returns nil, nil when no organization has the ID.
+func (s *SQLiteStore) GetOrg(ctx context.Context, id string) (*Organization, error) {
+	o, err := scanOrg(s.queryRow(ctx,
+		`SELECT `+orgColumns+` FROM organizations WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return o, err
+}
+
+func (s *SQLiteStore) ListOrgs(ctx context.Context) ([]*Organization, error) {
+	rows, err := s.query(ctx, `SELECT `+orgColumns+` FROM organizations ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var orgs []*Organization
+	for rows.Next() {
+		o, err := scanOrg(rows)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+// DeleteOrg removes an organization together with its branding and usage
+// history.
+func (s *SQLiteStore) DeleteOrg(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, stmt := range []string{
+		`DELETE FROM organizations WHERE id = ?`,
+		`DELETE FROM org_branding WHERE org_id = ?`,
+		`DELETE FROM usage_samples WHERE org_id = ?`,
+		`DELETE FROM usage_months WHERE org_id = ?`,
+		`DELETE FROM access_schedules WHERE org_id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetOrgStatus sets the status page mode and share token hash.
+func (s *SQLiteStore) SetOrgStatus(ctx context.Context, id, mode, tokenHash string) error {
+	_, err := s.exec(ctx,
+		`UPDATE organizations SET status_mode = ?, status_token_hash = ? WHERE id = ?`, mode, tokenHash, id)
+	return err
+}
+
+// SetBranding creates or replaces an organization's branding.
+func (s *SQLiteStore) SetBranding(ctx context.Context, b *Branding) error {
+	domains, err := json.Marshal(b.Domains)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(ctx,
+		`INSERT INTO org_branding (org_id, product_name, primary_color, accent_color, domains, logo_type, updated_by, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT (org_id) DO UPDATE SET product_name = excluded.product_name,
+		   primary_color = excluded.primary_color, accent_color = excluded.accent_color,
+		   domains = excluded.domains, logo_type = excluded.logo_type,
+		   updated_by = excluded.updated_by, updated_at = excluded.updated_at`,
+		b.OrgID, b.ProductName, b.PrimaryColor, b.AccentColor, string(domains), b.LogoType,
+		b.UpdatedBy, b.UpdatedAt.UTC().Format(tsLayout))
+	return err
+}
+
+const brandingColumns = `org_id, product_name, primary_color, accent_color, domains, logo_type, updated_by, updated_at`
+
+// GetBranding returns nil, nil when the organization has no branding.
+func (s *SQLiteStore) GetBranding(ctx context.Context, orgID string) (*Branding, error) {
+	b, err := scanBranding(s.queryRow(ctx,
+		`SELECT `+brandingColumns+` FROM org_branding WHERE org_id = ?`, orgID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (s *SQLiteStore) ListBrandings(ctx context.Context) ([]*Branding, error) {
+	rows, err := s.query(ctx, `SELECT `+brandingColumns+` FROM org_branding ORDER BY org_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var brandings []*Branding
+	for rows.Next() {
+		b, err := scanBranding(rows)
+		if err != nil {
+			return nil, err
+		}
+		brandings = append(brandings, b)
+	}
+	return brandings, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteBranding(ctx context.Context, orgID string) error {
+	_, err := s.exec(ctx, `DELETE FROM org_branding WHERE org_id = ?`, orgID)
+	return err
+}
+
+// scanBranding reads one row selected with brandingColumns.
+func scanBranding(row interface{ Scan(...any) error }) (*Branding, error) {
+	var b Branding
+	var domains, updated string
+	if err := row.Scan(&b.OrgID, &b.ProductName, &b.PrimaryColor, &b.AccentColor, &domains,
+		&b.LogoType, &b.UpdatedBy, &updated); err != nil {
+		return nil, err
+	}
+	_ = json.Unmarshal([]byte(domains), &b.Domains)
+	b.UpdatedAt, _ = time.Parse(tsLayout, updated)
+	return &b, nil
+}
+
+// scanOrg reads one row selected with orgColumns.
+func scanOrg(row interface{ Scan(...any) error }) (*Organization, error) {
+	var o Organization
+	var created string
+	if err := row.Scan(&o.ID, &o.Name, &o.CreatedBy, &created, &o.StatusMode, &o.StatusTokenHash); err != nil {
+		return nil, err
+	}
+	o.CreatedAt, _ = time.Parse(tsLayout, created)
+	return &o, nil
+}
+
+// RecordUsageSample stores a sample and folds it into its month's
+// rollup. A second sample for the same organization and time is ignored,
+// so samplers may retry without counting an hour twice.
+func (s *SQLiteStore) RecordUsageSample(ctx context.Context, u *UsageSample) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	res, err := tx.ExecContext(ctx,
+		`INSERT OR IGNORE INTO usage_samples (org_id, at, agents, online) VALUES (?, ?, ?, ?)`,
+		u.OrgID, u.At.UTC().Format(tsLayout), u.Agents, u.Online)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO usage_months (org_id, month, agent_peak, online_peak, agent_hours, samples)
+		 VALUES (?, ?, ?, ?, ?, 1)
+		 ON CONFLICT (org_id, month) DO UPDATE SET
+		   agent_peak = max(agent_peak, excluded.agent_peak),
+		   online_peak = max(online_peak, excluded.online_peak),
+		   agent_hours = agent_hours + excluded.agent_hours,
+		   samples = samples + 1`,
+		u.OrgID, u.At.UTC().Format(usageMonthLayout), u.Agents, u.Online, u.Agents); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddSessionUsage adds one finished remote-control session to the
+// rollup for the month containing at.
+func (s *SQLiteStore) AddSessionUsage(ctx context.Context, orgID string, at time.Time, seconds, bytes int64) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO usage_months (org_id, month, sessions, session_seconds, bytes_relayed)
+		 VALUES (?, ?, 1, ?, ?)
+		 ON CONFLICT (org_id, month) DO UPDATE SET
+		   sessions = sessions + 1,
+		   session_seconds = session_seconds + excluded.session_seconds,
+		   bytes_relayed = bytes_relayed + excluded.bytes_relayed`,
+		orgID, at.UTC().Format(usageMonthLayout), seconds, bytes)
+	return err
+}
+
+// ListUsageMonths returns an organization's rollups for the months from
+// through to (YYYY-MM, inclusive), oldest first. Months without usage are
+// absent.
+func (s *SQLiteStore) ListUsageMonths(ctx context.Context, orgID, from, to string) ([]*UsageMonth, error) {
+	rows, err := s.query(ctx,
+		`SELECT org_id, month, agent_peak, online_peak, agent_hours, samples, sessions, session_seconds, bytes_relayed
+		 FROM usage_months WHERE org_id = ? AND month >= ? AND month <= ? ORDER BY month`,
+		orgID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var months []*UsageMonth
+	for rows.Next() {
+		var m UsageMonth
+		if err := rows.Scan(&m.OrgID, &m.Month, &m.AgentPeak, &m.OnlinePeak, &m.AgentHours, &m.Samples,
+			&m.Sessions, &m.SessionSeconds, &m.BytesRelayed); err != nil {
+			return nil, err
+		}
+		months = append(months, &m)
+	}
+	return months, rows.Err()
+}
+
+// ListUsageSamples returns an organization's samples taken in
+// [since, until), oldest first.
+func (s *SQLiteStore) ListUsageSamples(ctx context.Context, orgID string, since, until time.Time) ([]*UsageSample, error) {
+	rows, err := s.query(ctx,
+		`SELECT org_id, at, agents, online FROM usage_samples
+		 WHERE org_id = ? AND at >= ? AND at < ? ORDER BY at`,
+		orgID, since.UTC().Format(tsLayout), until.UTC().Format(tsLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var samples []*UsageSample
+	for rows.Next() {
+		var u UsageSample
+		var at string
+		if err := rows.Scan(&u.OrgID, &at, &u.Agents, &u.Online); err != nil {
+			return nil, err
+		}
+		u.At, _ = time.Parse(tsLayout, at)
+		samples = append(samples, &u)
+	}
+	return samples, rows.Err()
+}
+
+// --- Integrations ---
+
+func (s *SQLiteStore) CreateIntegration(ctx context.Context, in *Integration) error {
+	types, _ := json.Marshal(in.AlertTypes)
+	_, err := s.exec(ctx,
+		`INSERT INTO integrations (id, name, provider, config, alert_types, enabled, created_by, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		in.ID, in.Name, in.Provider, string(in.Config), string(types), in.Enabled, in.CreatedBy,
+		in.CreatedAt.UTC().Format(tsLayout))
+	return err
+}
+
+const integrationColumns = `id, name, provider, config, alert_types, enabled, created_by, created_at`
+
+// GetIntegration returns nil, nil when no integration has the ID.
+func (s *SQLiteStore) GetIntegration(ctx context.Context, id string) (*Integration, error) {
+	in, err := scanIntegration(s.queryRow(ctx,
+		`SELECT `+integrationColumns+` FROM integrations WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return in, err
+}
+
+func (s *SQLiteStore) ListIntegrations(ctx context.Context) ([]*Integration, error) {
+	rows, err := s.query(ctx,
+		`SELECT `+integrationColumns+` FROM integrations ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var ins []*Integration
+	for rows.Next() {
+		in, err := scanIntegration(rows)
+		if err != nil {
+			return nil, err
+		}
+		ins = append(ins, in)
+	}
+	return ins, rows.Err()
+}
+
+// UpdateIntegration replaces everything but the ID and creation details.
+func (s *SQLiteStore) UpdateIntegration(ctx context.Context, in *Integration) error {
+	types, _ := json.Marshal(in.AlertTypes)
+	_, err := s.exec(ctx,
+		`UPDATE integrations SET name = ?, provider = ?, config = ?, alert_types = ?, enabled = ? WHERE id = ?`,
+		in.Name, in.Provider, string(in.Config), string(types), in.Enabled, in.ID)
+	return err
+}
+
+func (s *SQLiteStore) DeleteIntegration(ctx context.Context, id string) error {
+	_, err := s.exec(ctx, `DELETE FROM integrations WHERE id = ?`, id)
+	return err
+}
+
+// scanIntegration reads one row selected with integrationColumns.
+func scanIntegration(row interface{ Scan(...any) error }) (*Integration, error) {
+	var in Integration
+	var config, types, created string
+	if err := row.Scan(&in.ID, &in.Name, &in.Provider, &config, &types, &in.Enabled,
+		&in.CreatedBy, &created); err != nil {
+		return nil, err
+	}
+	in.Config = json.RawMessage(config)
+	_ = json.Unmarshal([]byte(types), &in.AlertTypes)
+	in.CreatedAt, _ = time.Parse(tsLayout, created)
+	return &in, nil
+}
+
+func (s *SQLiteStore) CreateTicket(ctx context.Context, t *Ticket) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO tickets (id, integration_id, alert_id, agent_id, external_id, created_at, error)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		t.ID, t.IntegrationID, t.AlertID, t.AgentID, t.ExternalID, t.CreatedAt.UTC().Format(tsLayout), t.Error)
+	return err
+}
+
+// ListTickets returns tickets, newest first.
+func (s *SQLiteStore) ListTickets(ctx context.Context, f TicketFilter) ([]*Ticket, error) {
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+	rows, err := s.query(ctx,
+		`SELECT id, integration_id, alert_id, agent_id, external_id, created_at, error FROM tickets
+		 WHERE (? = '' OR integration_id = ?) AND (? = '' OR alert_id = ?) AND (? = '' OR agent_id = ?)
+		 ORDER BY created_at DESC LIMIT ?`,
+		f.IntegrationID, f.IntegrationID, f.AlertID, f.AlertID, f.AgentID, f.AgentID, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var tickets []*Ticket
+	for rows.Next() {
+		var t Ticket
+		var created string
+		if err := rows.Scan(&t.ID, &t.IntegrationID, &t.AlertID, &t.AgentID, &t.ExternalID,
+			&created, &t.Error); err != nil {
+			return nil, err
+		}
+		t.CreatedAt, _ = time.Parse(tsLayout, created)
+		tickets = append(tickets, &t)
+	}
+	return tickets, rows.Err()
+}
+
+// --- SSH keys ---
+
+func (s *SQLiteStore) CreateSSHKey(ctx context.Context, k *SSHKey) error {
+	_, err := s.exec(ctx,
+		`INSERT INTO ssh_keys (id, name, public_key, fingerprint, created_by, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		k.ID, k.Name, k.PublicKey, k.Fingerprint, k.CreatedBy, k.CreatedAt.UTC().Format(tsLayout))
+	return err
+}
+
+const sshKeyColumns = `id, name, public_key, fingerprint, created_by, created_at`
+
+// GetSSHKey returns nil, nil when no key has the ID.
+func (s *SQLiteStore) GetSSHKey(ctx context.Context, id string) (*SSHKey, error) {
+	k, err := scanSSHKey(s.queryRow(ctx,
+		`SELECT `+sshKeyColumns+` FROM ssh_keys WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return k, err
+}
+
+func (s *SQLiteStore) ListSSHKeys(ctx context.Context) ([]*SSHKey, error) {
+	rows, err := s.query(ctx, `SELECT `+sshKeyColumns+` FROM ssh_keys ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var keys []*SSHKey
+	for rows.Next() {
+		k, err := scanSSHKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// DeleteSSHKey removes the key and its assignments.
+func (s *SQLiteStore) DeleteSSHKey(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, stmt := range []string{
+		`DELETE FROM ssh_key_assignments WHERE key_id = ?`,
+		`DELETE FROM ssh_keys WHERE id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// scanSSHKey reads one row selected with sshKeyColumns.
+func scanSSHKey(row interface{ Scan(...any) error }) (*SSHKey, error) {
+	var k SSHKey
+	var created string
+	if err := row.Scan(&k.ID, &k.Name, &k.PublicKey, &k.Fingerprint, &k.CreatedBy, &created); err != nil {
+		return nil, err
+	}
+	k.CreatedAt, _ = time.Parse(tsLayout, created)
+	return &k, nil
+}
+
+// SetSSHKeyAssignments replaces the keys assigned to username on the
+// agent. Assignments that are kept keep their original details.
+func (s *SQLiteStore) SetSSHKeyAssignments(ctx context.Context, agentID, username string, keyIDs []string, by string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	keep, _ := json.Marshal(keyIDs)
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM ssh_key_assignments WHERE agent_id = ? AND username = ?
+		 AND key_id NOT IN (SELECT value FROM json_each(?))`,
+		agentID, username, string(keep)); err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(tsLayout)
+	for _, id := range keyIDs {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT OR IGNORE INTO ssh_key_assignments (key_id, agent_id, username, assigned_by, assigned_at)
+			 VALUES (?, ?, ?, ?, ?)`,
+			id, agentID, username, by, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListSSHKeyAssignments returns the agent's assignments, or every
+// assignment when agentID is empty, by agent and username.
+func (s *SQLiteStore) ListSSHKeyAssignments(ctx context.Context, agentID string) ([]*SSHKeyAssignment, error) {
+	rows, err := s.query(ctx,
+		`SELECT key_id, agent_id, username, assigned_by, assigned_at FROM ssh_key_assignments
+		 WHERE (? = '' OR agent_id = ?) ORDER BY agent_id, username, assigned_at`,
+		agentID, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var assignments []*SSHKeyAssignment
+	for rows.Next() {
+		var a SSHKeyAssignment
+		var at string
+		if err := rows.Scan(&a.KeyID, &a.AgentID, &a.Username, &a.AssignedBy, &at); err != nil {
+			return nil, err
+		}
+		a.AssignedAt, _ = time.Parse(tsLayout, at)
+		assignments = append(assignments, &a)
+	}
+	return assignments, rows.Err()
+}
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestStore opens a store in a temporary directory, closed when the
+// test ends.
+func openTestStore(tb testing.TB) *SQLiteStore {
+	tb.Helper()
+	s, err := NewSQLiteStore(filepath.Join(tb.TempDir(), "platform.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { s.Close() }) //nolint:errcheck
+	return s
+}
+
+func createTestAgent(tb testing.TB, s *SQLiteStore, id string) {
+	tb.Helper()
+	err := s.CreateAgent(context.Background(), &AgentRecord{
+		ID: id, Name: id, Hostname: id, OS: "linux", Arch: "amd64",
+		CredentialHash: "cred-" + id, EnrolledAt: time.Now(),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// storedSeen reads an agent's last_seen as written to the database,
+// bypassing the pending timestamps.
+func storedSeen(tb testing.TB, s *SQLiteStore, id string) string {
+	tb.Helper()
+	var seen string
+	if err := s.db.QueryRow(`SELECT COALESCE(last_seen, '') FROM agents WHERE id = ?`, id).Scan(&seen); err != nil {
+		tb.Fatal(err)
+	}
+	return seen
+}
+
+func TestFlushTouchesRequeuesOnFailure(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	createTestAgent(t, s, "a1")
+
+	seen := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := s.UpdateAgentSeen(ctx, "a1", seen); err != nil {
+		t.Fatal(err)
+	}
+
+	// Take the table away so the write fails.
+	if _, err := s.db.Exec(`ALTER TABLE agents RENAME TO agents_moved`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.flushTouches(); err == nil {
+		t.Fatal("flushTouches succeeded without the agents table")
+	}
+	if got, ok := s.pendingSeen("a1"); !ok || !got.Equal(seen) {
+		t.Fatalf("pending last_seen after a failed flush = %v, %t; want %v", got, ok, seen)
+	}
+
+	if _, err := s.db.Exec(`ALTER TABLE agents_moved RENAME TO agents`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.flushTouches(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.pendingSeen("a1"); ok {
+		t.Fatal("last_seen still pending after a successful flush")
+	}
+	if got, want := storedSeen(t, s, "a1"), seen.Format(time.RFC3339); got != want {
+		t.Fatalf("stored last_seen = %q, want %q", got, want)
+	}
+}
+
+func BenchmarkVerifyAPIKey(b *testing.B) {
+	ctx := context.Background()
+	setup := func(b *testing.B) *SQLiteStore {
+		s := openTestStore(b)
+		err := s.CreateAPIKey(ctx, &APIKey{
+			ID: "k1", Name: "bench", KeyHash: "hash", Prefix: "rmm_bench", Role: RoleAdmin, CreatedAt: time.Now(),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		return s
+	}
+
+	b.Run("batched", func(b *testing.B) {
+		s := setup(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if k, err := s.VerifyAPIKey(ctx, "hash"); err != nil || k == nil {
+				b.Fatal(k, err)
+			}
+		}
+	})
+	// Unbatched: what every request cost when last_used was written
+	// with each verification.
+	b.Run("unbatched", func(b *testing.B) {
+		s := setup(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			k, err := s.VerifyAPIKey(ctx, "hash")
+			if err != nil || k == nil {
+				b.Fatal(k, err)
+			}
+			if _, err := s.exec(ctx, `UPDATE api_keys SET last_used = ? WHERE id = ?`,
+				k.LastUsed.UTC().Format(time.RFC3339), k.ID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkUpdateAgentSeen(b *testing.B) {
+	ctx := context.Background()
+	const agents = 100
+	setup := func(b *testing.B) *SQLiteStore {
+		s := openTestStore(b)
+		for i := 0; i < agents; i++ {
+			createTestAgent(b, s, fmt.Sprintf("a%d", i))
+		}
+		return s
+	}
+
+	// Batched, including the flushes a ticker would make in the meantime.
+	b.Run("batched", func(b *testing.B) {
+		s := setup(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := s.UpdateAgentSeen(ctx, fmt.Sprintf("a%d", i%agents), time.Now()); err != nil {
+				b.Fatal(err)
+			}
+			if i%agents == agents-1 {
+				if err := s.flushTouches(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		if err := s.flushTouches(); err != nil {
+			b.Fatal(err)
+		}
+	})
+	b.Run("unbatched", func(b *testing.B) {
+		s := setup(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := s.exec(ctx, `UPDATE agents SET last_seen = ? WHERE id = ?`,
+				time.Now().UTC().Format(time.RFC3339), fmt.Sprintf("a%d", i%agents)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestCreateEnrollmentTokensIsAtomic(t *testing.T) {
+	s := openTestStore(t)
+	ctx := context.Background()
+	token := func(id string) *EnrollmentToken {
+		return &EnrollmentToken{
+			ID: id, CodeHash: "hash-" + id, Type: "unattended", Label: id,
+			CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour), MaxUses: 1,
+		}
+	}
+
+	// The third token reuses the first one's ID, so its insert fails.
+	if err := s.CreateEnrollmentTokens(ctx, []*EnrollmentToken{token("t1"), token("t2"), token("t1")}); err == nil {
+		t.Fatal("CreateEnrollmentTokens stored a duplicate token")
+	}
+	if got, err := s.ListEnrollmentTokens(ctx); err != nil || len(got) != 0 {
+		t.Fatalf("tokens after a failed batch = %d, %v; want none", len(got), err)
+	}
+
+	if err := s.CreateEnrollmentTokens(ctx, []*EnrollmentToken{token("t1"), token("t2")}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.ListEnrollmentTokens(ctx); err != nil || len(got) != 2 {
+		t.Fatalf("tokens = %d, %v; want 2", len(got), err)
+	}
+}
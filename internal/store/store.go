@@ -5,6 +5,9 @@ package store
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
 	"time"
 )
 
@@ -16,12 +19,20 @@ type Store interface {
 	GetAgent(ctx context.Context, id string) (*AgentRecord, error)
 	GetAgentByCredential(ctx context.Context, credentialHash string) (*AgentRecord, error)
 	UpdateAgentSeen(ctx context.Context, id string, t time.Time) error
+	SetAgentUnattended(ctx context.Context, id string, allowed bool) error
 	ListAgents(ctx context.Context) ([]*AgentRecord, error)
-	DeleteAgent(ctx context.Context, id string) error
+	DeleteAgent(ctx context.Context, id string) (map[string]int64, error)
+	PurgeAgent(ctx context.Context, id string) (map[string]int64, error)
+	SetAgentOrg(ctx context.Context, id, orgID string) error
+	SetAgentSite(ctx context.Context, id, site string) error
+	SetAgentViewerPermissions(ctx context.Context, id string, perms []string) error
+	SetAgentSensitive(ctx context.Context, id string, sensitive bool) error
 
 	// Enrollment tokens.
 	CreateEnrollmentToken(ctx context.Context, token *EnrollmentToken) error
-	ConsumeEnrollmentToken(ctx context.Context, codeHash string, agentID string) (*EnrollmentToken, error)
+	CreateEnrollmentTokens(ctx context.Context, tokens []*EnrollmentToken) error
+	GetEnrollmentToken(ctx context.Context, codeHash string) (*EnrollmentToken, error)
+	ConsumeEnrollmentToken(ctx context.Context, codeHash, agentID, hostname string) (*EnrollmentToken, error)
 	ListEnrollmentTokens(ctx context.Context) ([]*EnrollmentToken, error)
 	DeleteEnrollmentToken(ctx context.Context, id string) error
 
@@ -31,6 +42,150 @@ type Store interface {
 	ListAPIKeys(ctx context.Context) ([]*APIKey, error)
 	DeleteAPIKey(ctx context.Context, id string) error
 
+	// Dashboard sessions.
+	CreateSession(ctx context.Context, session *Session) error
+	GetSession(ctx context.Context, tokenHash string) (*Session, error)
+	DeleteSession(ctx context.Context, tokenHash string) error
+	DeleteExpiredSessions(ctx context.Context) error
+
+	// Remote-control sessions and the audit trail.
+	CreateViewerSession(ctx context.Context, vs *ViewerSession) error
+	EndViewerSession(ctx context.Context, vs *ViewerSession) error
+	ListViewerSessions(ctx context.Context, agentID string, limit int) ([]*ViewerSession, error)
+	CreateAuditEvent(ctx context.Context, ev *AuditEvent) error
+	ListAuditEvents(ctx context.Context, filter AuditFilter) ([]*AuditEvent, error)
+
+	// Drop-box files queued for delivery to agents.
+	CreateDropboxFile(ctx context.Context, f *DropboxFile) error
+	GetDropboxFile(ctx context.Context, id string) (*DropboxFile, error)
+	ListDropboxFiles(ctx context.Context, agentID string) ([]*DropboxFile, error)
+	UpdateDropboxFile(ctx context.Context, f *DropboxFile) error
+
+	// Scheduled screenshot archiving.
+	SetScreenshotSchedule(ctx context.Context, sched *ScreenshotSchedule) error
+	GetScreenshotSchedule(ctx context.Context, agentID string) (*ScreenshotSchedule, error)
+	ListScreenshotSchedules(ctx context.Context) ([]*ScreenshotSchedule, error)
+	DeleteScreenshotSchedule(ctx context.Context, agentID string) error
+	CreateScreenshot(ctx context.Context, shot *Screenshot) error
+	GetScreenshot(ctx context.Context, id string) (*Screenshot, error)
+	ListScreenshots(ctx context.Context, filter ScreenshotFilter) ([]*Screenshot, error)
+	PruneScreenshots(ctx context.Context, agentID string, keep int, before time.Time) ([]string, error)
+
+	// Session recordings.
+	CreateRecording(ctx context.Context, rec *Recording) error
+	FinishRecording(ctx context.Context, rec *Recording) error
+	GetRecording(ctx context.Context, id string) (*Recording, error)
+	ListRecordings(ctx context.Context, filter RecordingFilter) ([]*Recording, error)
+	SetRecordingHold(ctx context.Context, rec *Recording) error
+	DeleteRecording(ctx context.Context, id string) error
+	PruneRecordings(ctx context.Context, before time.Time) ([]*Recording, error)
+
+	// Diagnostics archives collected from agents.
+	CreateDiagnosticsArchive(ctx context.Context, a *DiagnosticsArchive) error
+	GetDiagnosticsArchive(ctx context.Context, id string) (*DiagnosticsArchive, error)
+	ListDiagnosticsArchives(ctx context.Context, agentID string) ([]*DiagnosticsArchive, error)
+	DeleteDiagnosticsArchive(ctx context.Context, id string) error
+	PruneDiagnosticsArchives(ctx context.Context, agentID string, keep int) ([]string, error)
+
+	// Scheduled reboots and their progress on each agent.
+	CreateRebootSchedule(ctx context.Context, sched *RebootSchedule) error
+	GetRebootSchedule(ctx context.Context, id string) (*RebootSchedule, error)
+	ListRebootSchedules(ctx context.Context) ([]*RebootSchedule, error)
+	DeleteRebootSchedule(ctx context.Context, id string) error
+	SetRebootRun(ctx context.Context, run *RebootRun) error
+	ListRebootRuns(ctx context.Context, filter RebootRunFilter) ([]*RebootRun, error)
+
+	// Business hours outside which remote control is restricted.
+	CreateAccessSchedule(ctx context.Context, sched *AccessSchedule) error
+	GetAccessSchedule(ctx context.Context, id string) (*AccessSchedule, error)
+	ListAccessSchedules(ctx context.Context) ([]*AccessSchedule, error)
+	DeleteAccessSchedule(ctx context.Context, id string) error
+
+	// Installer artifacts hosted for deployments.
+	CreateArtifact(ctx context.Context, a *Artifact) error
+	GetArtifact(ctx context.Context, id string) (*Artifact, error)
+	ListArtifacts(ctx context.Context) ([]*Artifact, error)
+	DeleteArtifact(ctx context.Context, id string) error
+
+	// Software deployments and their result on each target agent.
+	CreateDeployment(ctx context.Context, d *Deployment, agentIDs []string) error
+	GetDeployment(ctx context.Context, id string) (*Deployment, error)
+	ListDeployments(ctx context.Context, limit int) ([]*Deployment, error)
+	ListDeploymentResults(ctx context.Context, filter DeploymentResultFilter) ([]*DeploymentResult, error)
+	UpdateDeploymentResult(ctx context.Context, r *DeploymentResult) error
+
+	// Alert rules and the alerts they raise.
+	CreateAlertRule(ctx context.Context, rule *AlertRule) error
+	GetAlertRule(ctx context.Context, id string) (*AlertRule, error)
+	ListAlertRules(ctx context.Context) ([]*AlertRule, error)
+	DeleteAlertRule(ctx context.Context, id string) error
+	CreateAlert(ctx context.Context, alert *Alert) error
+	ResolveAlert(ctx context.Context, id string, at time.Time) error
+	ListAlerts(ctx context.Context, filter AlertFilter) ([]*Alert, error)
+
+	// Health history from heartbeats, live and replayed.
+	RecordHealthSamples(ctx context.Context, samples []*HealthSample) error
+	ListHealthSamples(ctx context.Context, agentID string, since, until time.Time) ([]*HealthSample, error)
+	DeleteHealthSamplesBefore(ctx context.Context, before time.Time) (int64, error)
+
+	// Report schedules and the reports generated from them.
+	CreateReportSchedule(ctx context.Context, sched *ReportSchedule) error
+	GetReportSchedule(ctx context.Context, id string) (*ReportSchedule, error)
+	ListReportSchedules(ctx context.Context) ([]*ReportSchedule, error)
+	DeleteReportSchedule(ctx context.Context, id string) error
+	SetReportScheduleRun(ctx context.Context, id string, at time.Time) error
+	CreateReport(ctx context.Context, report *Report) error
+	GetReport(ctx context.Context, id string) (*Report, error)
+	ListReports(ctx context.Context, limit int) ([]*Report, error)
+	DeleteReportsBefore(ctx context.Context, before time.Time) ([]string, error)
+
+	// Organizations and their usage metering.
+	CreateOrg(ctx context.Context, org *Organization) error
+	GetOrg(ctx context.Context, id string) (*Organization, error)
+	ListOrgs(ctx context.Context) ([]*Organization, error)
+	DeleteOrg(ctx context.Context, id string) error
+	SetOrgStatus(ctx context.Context, id, mode, tokenHash string) error
+	SetBranding(ctx context.Context, b *Branding) error
+	GetBranding(ctx context.Context, orgID string) (*Branding, error)
+	ListBrandings(ctx context.Context) ([]*Branding, error)
+	DeleteBranding(ctx context.Context, orgID string) error
+	RecordUsageSample(ctx context.Context, sample *UsageSample) error
+	AddSessionUsage(ctx context.Context, orgID string, at time.Time, seconds, bytes int64) error
+	ListUsageMonths(ctx context.Context, orgID, from, to string) ([]*UsageMonth, error)
+	ListUsageSamples(ctx context.Context, orgID string, since, until time.Time) ([]*UsageSample, error)
+
+	// PSA/ticketing integrations and the tickets they opened.
+	CreateIntegration(ctx context.Context, in *Integration) error
+	GetIntegration(ctx context.Context, id string) (*Integration, error)
+	ListIntegrations(ctx context.Context) ([]*Integration, error)
+	UpdateIntegration(ctx context.Context, in *Integration) error
+	DeleteIntegration(ctx context.Context, id string) error
+	CreateTicket(ctx context.Context, t *Ticket) error
+	ListTickets(ctx context.Context, filter TicketFilter) ([]*Ticket, error)
+
+	// SSH public keys and their assignment to local users on agents.
+	CreateSSHKey(ctx context.Context, key *SSHKey) error
+	GetSSHKey(ctx context.Context, id string) (*SSHKey, error)
+	ListSSHKeys(ctx context.Context) ([]*SSHKey, error)
+	DeleteSSHKey(ctx context.Context, id string) error
+	SetSSHKeyAssignments(ctx context.Context, agentID, username string, keyIDs []string, by string) error
+	ListSSHKeyAssignments(ctx context.Context, agentID string) ([]*SSHKeyAssignment, error)
+
+	// Long-running server actions and their progress.
+	CreateOperation(ctx context.Context, op *Operation) error
+	UpdateOperation(ctx context.Context, op *Operation) error
+	GetOperation(ctx context.Context, id string) (*Operation, error)
+	ListOperations(ctx context.Context, filter OperationFilter) ([]*Operation, error)
+	InterruptOperations(ctx context.Context, before time.Time) (int64, error)
+	DeleteOperationsBefore(ctx context.Context, before time.Time) (int64, error)
+
+	// Server extensions' own tables (see internal/extension).
+	MigrateExtension(ctx context.Context, name string, migrations []string) error
+	DB() *sql.DB
+
+	// Backup writes a consistent snapshot of the database to path.
+	Backup(ctx context.Context, path string) error
+
 	// Close releases database resources.
 	Close() error
 }
@@ -45,18 +200,107 @@ type AgentRecord struct {
 	CredentialHash string    `json:"-"`
 	EnrolledAt     time.Time `json:"enrolled_at"`
 	LastSeen       time.Time `json:"last_seen"`
+
+	// AttestationKey is the public half of the agent's TPM key (base64
+	// PKIX), set when the agent bound one at enrollment. Registration then
+	// requires a signature from it, so the credential alone is not enough.
+	AttestationType string `json:"attestation_type,omitempty"`
+	AttestationKey  string `json:"-"`
+
+	// Unattended allows viewers to start capture without the local user's
+	// consent. It defaults from the type of token the agent enrolled with.
+	Unattended bool `json:"unattended"`
+
+	// OrgID is the organization the agent is billed to, inherited from
+	// its enrollment token. Empty for unassigned agents.
+	OrgID string `json:"org_id,omitempty"`
+	// Site is a free-form location label, e.g. "HQ" or "Warehouse",
+	// used to group agents on status pages.
+	Site string `json:"site,omitempty"`
+
+	// Image is the golden image or MDM profile the agent was provisioned
+	// from, as reported at its first boot. Empty for agents enrolled by
+	// hand.
+	Image string `json:"image,omitempty"`
+
+	// ViewerPermissions, when set, caps what viewer sessions on this agent
+	// may do, whatever the API key's role allows (see protocol.PermView).
+	ViewerPermissions []string `json:"viewer_permissions,omitempty"`
+
+	// TelemetryOnly marks an agent that publishes reports through the
+	// telemetry broker and never connects: it cannot be controlled.
+	TelemetryOnly bool `json:"telemetry_only,omitempty"`
+
+	// Sensitive agents need a second admin to approve each unattended
+	// session before capture starts.
+	Sensitive bool `json:"sensitive,omitempty"`
 }
 
 // EnrollmentToken authorises a single agent enrollment.
 type EnrollmentToken struct {
 	ID        string     `json:"id"`
 	CodeHash  string     `json:"-"`
-	Type      string     `json:"type"`  // "attended" or "unattended"
+	Type      string     `json:"type"`  // "attended", "unattended" or "provisioning"
 	Label     string     `json:"label"` // human-readable description
 	CreatedAt time.Time  `json:"created_at"`
 	ExpiresAt time.Time  `json:"expires_at"`
 	UsedAt    *time.Time `json:"used_at,omitempty"`
 	UsedBy    string     `json:"used_by,omitempty"`
+
+	// ExpectedHostname, when set, is the machine this token was issued
+	// for. Enrollment from any other host still succeeds but is flagged.
+	ExpectedHostname string `json:"expected_hostname,omitempty"`
+	UsedHostname     string `json:"used_hostname,omitempty"`
+	HostnameMismatch bool   `json:"hostname_mismatch,omitempty"`
+
+	// Bind* restrict the token to one machine. Unlike ExpectedHostname,
+	// a mismatch on any non-empty binding rejects the enrollment.
+	BindHostname  string `json:"bind_hostname,omitempty"`
+	BindMAC       string `json:"bind_mac,omitempty"`
+	BindMachineID string `json:"bind_machine_id,omitempty"`
+
+	// OrgID and Site assign the enrolled agent to an organization and
+	// a site.
+	OrgID string `json:"org_id,omitempty"`
+	Site  string `json:"site,omitempty"`
+
+	// MaxUses limits how many agents a provisioning token may enroll (0
+	// for no limit); Uses counts enrollments with any token. Image names
+	// the golden image or MDM profile a provisioning token was made for.
+	MaxUses int    `json:"max_uses,omitempty"`
+	Uses    int    `json:"uses"`
+	Image   string `json:"image,omitempty"`
+}
+
+// TokenProvisioning is the type of multi-use tokens baked into golden
+// images and MDM profiles. Unlike attended and unattended tokens they are
+// not used up by an enrollment.
+const TokenProvisioning = "provisioning"
+
+// Bound reports whether the token is restricted to a specific machine.
+func (t *EnrollmentToken) Bound() bool {
+	return t.BindHostname != "" || t.BindMAC != "" || t.BindMachineID != ""
+}
+
+// HostnameMatches reports whether actual is the machine named by expected.
+// Comparison is case-insensitive, and a bare name matches any FQDN with
+// that first label (and vice versa).
+func HostnameMatches(expected, actual string) bool {
+	expected = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(expected), "."))
+	actual = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(actual), "."))
+	if expected == actual {
+		return true
+	}
+	if strings.Contains(expected, ".") && strings.Contains(actual, ".") {
+		return false
+	}
+	short := func(h string) string {
+		if i := strings.IndexByte(h, '.'); i >= 0 {
+			return h[:i]
+		}
+		return h
+	}
+	return short(expected) == short(actual)
 }
 
 // APIKey grants access to the management dashboard and APIs.
@@ -65,6 +309,576 @@ type APIKey struct {
 	Name      string     `json:"name"`
 	KeyHash   string     `json:"-"`
 	Prefix    string     `json:"prefix"` // first 12 chars for identification
+	Role      string     `json:"role"`   // RoleAdmin, RoleTechnician or RoleAuditor
 	CreatedAt time.Time  `json:"created_at"`
 	LastUsed  *time.Time `json:"last_used,omitempty"`
 }
+
+// API key roles, which set what the key's viewer sessions may do.
+const (
+	RoleAdmin      = "admin"      // everything
+	RoleTechnician = "technician" // view, input and files
+	RoleAuditor    = "auditor"    // view only
+)
+
+// Session is a browser login backed by an API key. The raw session token
+// lives only in the client's HttpOnly cookie; the store keeps its hash.
+// Deleting the API key invalidates every session created from it.
+type Session struct {
+	ID         string    `json:"id"`
+	TokenHash  string    `json:"-"`
+	APIKeyID   string    `json:"api_key_id"`
+	APIKeyName string    `json:"api_key_name"` // populated on read
+	APIKeyRole string    `json:"api_key_role"` // populated on read
+	CSRFToken  string    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// ViewerSession records one remote-control connection from a viewer to an
+// agent, including a summary of the input it injected and the screen
+// frames streamed.
+type ViewerSession struct {
+	ID          string     `json:"id"`
+	AgentID     string     `json:"agent_id"`
+	APIKeyID    string     `json:"api_key_id"`
+	APIKeyName  string     `json:"api_key_name"`
+	RemoteAddr  string     `json:"remote_addr"`
+	StartedAt   time.Time  `json:"started_at"`
+	EndedAt     *time.Time `json:"ended_at,omitempty"`
+	KeyEvents   int64      `json:"key_events"`
+	MouseEvents int64      `json:"mouse_events"`
+	// Screen frames the agent streamed, and dropped because the
+	// connection could not keep up, as reported when capture stopped.
+	FramesSent    int64 `json:"frames_sent"`
+	FramesDropped int64 `json:"frames_dropped"`
+	// Glass-to-glass latency of the screen frames, capture to display, in
+	// milliseconds: the session's moving average at its end, and the
+	// worst frame. Zero when it was not measured.
+	LatencyMS    float64 `json:"latency_ms"`
+	MaxLatencyMS float64 `json:"max_latency_ms"`
+}
+
+// AuditEvent is a single entry in the security audit trail.
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"` // e.g. "control_taken", "control_released"
+	ActorID   string    `json:"actor_id"`
+	ActorName string    `json:"actor_name"`
+	AgentID   string    `json:"agent_id,omitempty"`
+	SessionID string    `json:"session_id,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// Drop-box file states.
+const (
+	DropboxPending   = "pending"   // waiting for the agent to connect
+	DropboxDelivered = "delivered" // saved by the agent
+	DropboxFailed    = "failed"    // rejected by the agent
+	DropboxExpired   = "expired"   // not delivered before ExpiresAt
+	DropboxCanceled  = "canceled"  // withdrawn before delivery
+)
+
+// DropboxFile is a file held by the server until its agent next connects.
+// The content lives outside the database and is removed once the file
+// leaves the pending state.
+type DropboxFile struct {
+	ID          string     `json:"id"`
+	AgentID     string     `json:"agent_id"`
+	Name        string     `json:"name"`
+	Size        int64      `json:"size"`
+	SHA256      string     `json:"sha256"`
+	CreatedBy   string     `json:"created_by"` // API key name
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	Status      string     `json:"status"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	Path        string     `json:"path,omitempty"` // where the agent saved it
+	Error       string     `json:"error,omitempty"`
+}
+
+// ScreenshotSchedule captures an agent's screen every Interval minutes
+// while it is online, keeping at most Keep screenshots and none older
+// than RetentionDays.
+type ScreenshotSchedule struct {
+	AgentID       string    `json:"agent_id"`
+	Interval      int       `json:"interval_minutes"`
+	Display       int       `json:"display"` // 0 = primary
+	Keep          int       `json:"keep"`
+	RetentionDays int       `json:"retention_days"`
+	Enabled       bool      `json:"enabled"`
+	UpdatedBy     string    `json:"updated_by"` // API key name
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Screenshot is one archived capture. The JPEG lives outside the
+// database.
+type Screenshot struct {
+	ID      string    `json:"id"`
+	AgentID string    `json:"agent_id"`
+	TakenAt time.Time `json:"taken_at"`
+	Display int       `json:"display"`
+	Size    int64     `json:"size"`
+}
+
+// Recording is a recorded viewer session, sharing the session's ID. The
+// frames live outside the database. A recording on legal hold is kept
+// past the retention period and cannot be deleted until the hold is
+// released.
+type Recording struct {
+	ID         string     `json:"id"`
+	AgentID    string     `json:"agent_id"`
+	APIKeyID   string     `json:"api_key_id"`
+	Operator   string     `json:"operator"`
+	StartedAt  time.Time  `json:"started_at"`
+	EndedAt    *time.Time `json:"ended_at,omitempty"` // nil while recording
+	Frames     int64      `json:"frames"`
+	Size       int64      `json:"size"`
+	LegalHold  bool       `json:"legal_hold"`
+	HoldReason string     `json:"hold_reason,omitempty"`
+	HoldBy     string     `json:"hold_by,omitempty"` // API key name
+	HoldAt     *time.Time `json:"hold_at,omitempty"`
+}
+
+// RecordingFilter narrows ListRecordings. Zero-value fields match
+// everything.
+type RecordingFilter struct {
+	AgentID string
+	Held    bool // only recordings on legal hold
+	Limit   int
+}
+
+// DiagnosticsArchive is a diagnostics archive (.tar.gz) uploaded by an
+// agent. The archive lives outside the database.
+type DiagnosticsArchive struct {
+	ID          string    `json:"id"`
+	AgentID     string    `json:"agent_id"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	RequestedBy string    `json:"requested_by"` // API key name
+	CollectedAt time.Time `json:"collected_at"`
+}
+
+// ScreenshotFilter narrows ListScreenshots. Zero-value fields match
+// everything.
+type ScreenshotFilter struct {
+	AgentID string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// RebootSchedule reboots its agents in a recurring maintenance window,
+// after warning the logged-in user with a countdown they may postpone a
+// limited number of times. It targets one agent (AgentID) or a group:
+// every agent in OrgID and/or at Site.
+type RebootSchedule struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	AgentID   string   `json:"agent_id,omitempty"`
+	OrgID     string   `json:"org_id,omitempty"`
+	Site      string   `json:"site,omitempty"`
+	Days      []string `json:"days"`     // "mon" … "sun"; empty for every day
+	Start     string   `json:"start"`    // "15:04" in TimeZone
+	TimeZone  string   `json:"timezone"` // IANA name, e.g. "Europe/London"
+	Window    int      `json:"window_minutes"`
+	Countdown int      `json:"countdown_minutes"`
+	Deferrals int      `json:"max_deferrals"`
+	DeferFor  int      `json:"defer_minutes"`
+	// PendingOnly limits the schedule to agents reporting a pending
+	// reboot when the window opens.
+	PendingOnly bool      `json:"pending_only"`
+	Message     string    `json:"message,omitempty"` // shown to the user with the countdown
+	CreatedBy   string    `json:"created_by"`        // API key name
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// AccessSchedule sets the business hours of a group of agents, every
+// agent in OrgID and/or at Site: on Days, from Start to End in TimeZone
+// (past midnight when End is not after Start). Outside them, remote
+// control of the group is restricted as Mode says.
+type AccessSchedule struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	OrgID     string    `json:"org_id,omitempty"`
+	Site      string    `json:"site,omitempty"`
+	Days      []string  `json:"days"`     // "mon" … "sun"; empty for every day
+	Start     string    `json:"start"`    // "15:04" in TimeZone
+	End       string    `json:"end"`      // "15:04" in TimeZone
+	TimeZone  string    `json:"timezone"` // IANA name, e.g. "Europe/London"
+	Mode      string    `json:"mode"`     // AccessBlock or AccessApproval
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Access schedule modes: what happens to remote control after hours.
+const (
+	AccessBlock    = "block"    // refused
+	AccessApproval = "approval" // allowed with an approved override
+)
+
+// Reboot run states.
+const (
+	RebootCountdown = "countdown" // the user has been warned
+	RebootDeferred  = "deferred"  // postponed by the user until NextAt
+	RebootRebooted  = "rebooted"  // the agent's OS accepted the reboot
+	RebootFailed    = "failed"    // the agent could not reboot
+)
+
+// RebootRun is a reboot schedule's progress on one agent in one window.
+// A run that is counting down or deferred carries on past the end of its
+// window until the agent reboots.
+type RebootRun struct {
+	ScheduleID  string    `json:"schedule_id"`
+	AgentID     string    `json:"agent_id"`
+	WindowStart time.Time `json:"window_start"`
+	Status      string    `json:"status"`
+	Deferrals   int       `json:"deferrals"` // used so far
+	NextAt      time.Time `json:"next_at"`   // when the user is warned again
+	NoticeID    string    `json:"-"`         // of the countdown the agent is showing
+	Error       string    `json:"error,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// RebootRunFilter narrows ListRebootRuns. Zero-value fields match
+// everything.
+type RebootRunFilter struct {
+	ScheduleID string
+	AgentID    string
+}
+
+// Artifact is an installer (MSI, PKG or DEB) uploaded to the server's
+// package repository. Kind is its format, from the file extension.
+type Artifact struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"` // "msi", "pkg" or "deb"
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	CreatedBy string    `json:"created_by"` // API key name
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Deployment installs or removes a package with a package manager
+// ("apt", "brew" or "choco"), or installs an Artifact (Manager is then
+// its Kind and Package its name), on the agents it targets: those listed in
+// AgentIDs, or a group, every agent in OrgID and/or at Site, running the
+// manager's OS when the deployment was created. It rolls out to at most
+// MaxConcurrent agents at a time, as they come online.
+type Deployment struct {
+	ID            string    `json:"id"`
+	Manager       string    `json:"manager"`
+	Action        string    `json:"action"` // "install" or "uninstall"
+	Package       string    `json:"package"`
+	Version       string    `json:"version,omitempty"`
+	ArtifactID    string    `json:"artifact_id,omitempty"`
+	AgentIDs      []string  `json:"agent_ids,omitempty"`
+	OrgID         string    `json:"org_id,omitempty"`
+	Site          string    `json:"site,omitempty"`
+	Timeout       int       `json:"timeout_minutes"` // per agent
+	MaxConcurrent int       `json:"max_concurrent"`  // 0 for no limit
+	CreatedBy     string    `json:"created_by"`      // API key name
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"` // agents not started by then are skipped
+}
+
+// Deployment result states.
+const (
+	DeploymentPending   = "pending"   // waiting for the agent to come online
+	DeploymentRunning   = "running"   // sent to the agent
+	DeploymentSucceeded = "succeeded" // the package manager succeeded
+	DeploymentFailed    = "failed"    // it failed, timed out or the agent refused
+	DeploymentCanceled  = "canceled"  // canceled before it started
+	DeploymentExpired   = "expired"   // the agent stayed offline until ExpiresAt
+)
+
+// DeploymentResult is a deployment's progress on one agent, with the
+// package manager's exit code and output once it has finished.
+type DeploymentResult struct {
+	DeploymentID string     `json:"deployment_id"`
+	AgentID      string     `json:"agent_id"`
+	Status       string     `json:"status"`
+	ExitCode     int        `json:"exit_code"`
+	Output       string     `json:"output,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+// DeploymentResultFilter narrows ListDeploymentResults. Zero-value
+// fields match everything.
+type DeploymentResultFilter struct {
+	DeploymentID string
+	AgentID      string
+	Status       string
+}
+
+// Alert rule types.
+const (
+	AlertRebootRequired = "reboot_required" // the agent reports a pending reboot
+	AlertCPUHigh        = "cpu_high"        // CPU use at or above Threshold percent
+	AlertMemoryLow      = "memory_low"      // free memory at or below Threshold percent
+	AlertDiskLow        = "disk_low"        // free disk at or below Threshold percent
+	AlertTimeDrift      = "time_drift"      // clock off by at least Threshold seconds
+	AlertPluginCritical = "plugin_critical" // an agent plugin reports critical or fails to run
+
+	// AlertSupportRequest is raised by an agent's local user asking for
+	// help rather than by a rule; its RuleID is empty.
+	AlertSupportRequest = "support_request"
+
+	// AlertEnrollmentAnomaly is raised by the server when an enrollment
+	// token is tried from more client addresses than expected. AgentID is
+	// the agent the token enrolled, if any.
+	AlertEnrollmentAnomaly = "enrollment_anomaly"
+)
+
+// AlertRule raises an alert for an agent, or for every agent when AgentID
+// is empty, once the rule's condition has held for ForMinutes.
+type AlertRule struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	AgentID    string    `json:"agent_id,omitempty"`
+	ForMinutes int       `json:"for_minutes"`
+	Threshold  float64   `json:"threshold,omitempty"` // percent (seconds for time_drift), for threshold rule types
+	CreatedBy  string    `json:"created_by"`          // API key name
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Alert is one firing of a rule for an agent. It stays open until its
+// condition clears or the rule is deleted.
+type Alert struct {
+	ID         string     `json:"id"`
+	RuleID     string     `json:"rule_id"`
+	Type       string     `json:"type"`
+	AgentID    string     `json:"agent_id"`
+	Message    string     `json:"message"`
+	RaisedAt   time.Time  `json:"raised_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// AlertFilter narrows ListAlerts. Zero-value fields match everything.
+type AlertFilter struct {
+	AgentID string
+	RuleID  string
+	Open    bool      // only alerts that are not resolved
+	Since   time.Time // raised at or after
+	Limit   int
+}
+
+// HealthSample is an agent's load and free resources at one heartbeat.
+// Replayed samples were buffered by the agent while it could not reach
+// the server; their time is the agent's clock when it took them.
+type HealthSample struct {
+	AgentID    string    `json:"-"`
+	At         time.Time `json:"at"`
+	CPU        float64   `json:"cpu_percent"`
+	MemoryFree uint64    `json:"memory_free"`
+	DiskFree   uint64    `json:"disk_free"`
+	Replayed   bool      `json:"replayed,omitempty"`
+}
+
+// Report formats.
+const (
+	ReportCSV  = "csv"
+	ReportHTML = "html"
+)
+
+// Report schedule frequencies; each report covers the period since the
+// previous one.
+const (
+	ReportDaily   = "daily"
+	ReportWeekly  = "weekly"
+	ReportMonthly = "monthly"
+)
+
+// ReportSchedule generates a fleet report every Frequency and delivers it
+// to the named notification channels.
+type ReportSchedule struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Format    string     `json:"format"`
+	Frequency string     `json:"frequency"`
+	Channels  []string   `json:"channels"`
+	CreatedBy string     `json:"created_by"` // API key name
+	CreatedAt time.Time  `json:"created_at"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+}
+
+// Report is one generated fleet report. The rendered file lives outside
+// the database.
+type Report struct {
+	ID          string    `json:"id"`
+	ScheduleID  string    `json:"schedule_id,omitempty"` // empty when generated on demand
+	Name        string    `json:"name"`
+	Format      string    `json:"format"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	CreatedAt   time.Time `json:"created_at"`
+	Size        int64     `json:"size"`
+	Delivered   []string  `json:"delivered,omitempty"` // channels that accepted it
+	Error       string    `json:"error,omitempty"`     // delivery failures
+}
+
+// Operation states. Queued and running operations are active; the
+// others are final.
+const (
+	OperationQueued    = "queued"
+	OperationRunning   = "running"
+	OperationSucceeded = "succeeded"
+	OperationFailed    = "failed"
+	OperationCanceled  = "canceled"
+)
+
+// Operation is a long-running server action (a report, a backup, a
+// quick action on many agents) run in the background. Progress is a
+// percentage and Message what it is doing; Result is the action's own
+// JSON once it has succeeded.
+type Operation struct {
+	ID          string          `json:"id"`
+	Kind        string          `json:"kind"`
+	Status      string          `json:"status"`
+	Progress    int             `json:"progress"`
+	Message     string          `json:"message,omitempty"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	CreatedByID string          `json:"-"`          // API key ID
+	CreatedBy   string          `json:"created_by"` // API key name
+	CreatedAt   time.Time       `json:"created_at"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+}
+
+// Active reports whether the operation has yet to finish.
+func (op *Operation) Active() bool {
+	return op.Status == OperationQueued || op.Status == OperationRunning
+}
+
+// OperationFilter narrows ListOperations; empty fields match everything.
+type OperationFilter struct {
+	Kind        string
+	Status      string
+	CreatedByID string
+	Limit       int
+}
+
+// Organization is a tenant that agents are assigned to for usage metering.
+type Organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"created_by"` // API key name
+	CreatedAt time.Time `json:"created_at"`
+
+	// StatusMode controls the organization's read-only status page: off
+	// (empty), StatusPublic, or StatusToken to require the share token
+	// whose hash is StatusTokenHash.
+	StatusMode      string `json:"status_mode,omitempty"`
+	StatusTokenHash string `json:"-"`
+}
+
+// Status page modes.
+const (
+	StatusPublic = "public"
+	StatusToken  = "token"
+)
+
+// Branding white-labels the dashboard and the agents of an organization.
+// The dashboard picks it by the host name it is served under (Domains);
+// agents by their organization.
+type Branding struct {
+	OrgID        string    `json:"org_id"`
+	ProductName  string    `json:"product_name,omitempty"`
+	PrimaryColor string    `json:"primary_color,omitempty"` // #rrggbb
+	AccentColor  string    `json:"accent_color,omitempty"`  // #rrggbb
+	Domains      []string  `json:"domains,omitempty"`
+	LogoType     string    `json:"logo_type,omitempty"` // media type, empty without a logo
+	UpdatedBy    string    `json:"updated_by"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// UsageSample is an organization's agent count at the start of one hour.
+type UsageSample struct {
+	OrgID  string    `json:"-"`
+	At     time.Time `json:"at"`
+	Agents int       `json:"agents"` // enrolled
+	Online int       `json:"online"` // connected
+}
+
+// UsageMonth rolls up an organization's usage for one calendar month
+// (UTC). Sessions count towards the month they ended in.
+type UsageMonth struct {
+	OrgID          string `json:"-"`
+	Month          string `json:"month"` // YYYY-MM
+	AgentPeak      int    `json:"agents_peak"`
+	OnlinePeak     int    `json:"online_peak"`
+	AgentHours     int64  `json:"agent_hours"` // sum of hourly enrolled counts
+	Samples        int    `json:"samples"`
+	Sessions       int    `json:"sessions"`
+	SessionSeconds int64  `json:"session_seconds"`
+	BytesRelayed   int64  `json:"bytes_relayed"`
+}
+
+// Integration connects the platform to a PSA or ticketing system. Config
+// is the provider's JSON configuration, which holds credentials and is
+// never served back by the API.
+type Integration struct {
+	ID         string          `json:"id"`
+	Name       string          `json:"name"`
+	Provider   string          `json:"provider"`
+	Config     json.RawMessage `json:"-"`
+	AlertTypes []string        `json:"alert_types"` // empty for every type
+	Enabled    bool            `json:"enabled"`
+	CreatedBy  string          `json:"created_by"` // API key name
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// Ticket links an alert to the ticket an integration opened for it.
+// ExternalID is empty and Error set when the ticket could not be opened.
+type Ticket struct {
+	ID            string    `json:"id"`
+	IntegrationID string    `json:"integration_id"`
+	AlertID       string    `json:"alert_id"`
+	AgentID       string    `json:"agent_id"`
+	ExternalID    string    `json:"external_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// TicketFilter narrows ListTickets. Zero-value fields match everything.
+type TicketFilter struct {
+	IntegrationID string
+	AlertID       string
+	AgentID       string
+	Limit         int
+}
+
+// SSHKey is an SSH public key in the central inventory. PublicKey is the
+// key in authorized_keys form: "<type> <base64> [comment]".
+type SSHKey struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	PublicKey   string    `json:"public_key"`
+	Fingerprint string    `json:"fingerprint"` // SHA256:<base64>, as ssh-keygen -l prints it
+	CreatedBy   string    `json:"created_by"`  // API key name
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// SSHKeyAssignment authorizes an inventory key for one local user on one
+// agent.
+type SSHKeyAssignment struct {
+	KeyID      string    `json:"key_id"`
+	AgentID    string    `json:"agent_id"`
+	Username   string    `json:"username"`
+	AssignedBy string    `json:"assigned_by"` // API key name
+	AssignedAt time.Time `json:"assigned_at"`
+}
+
+// AuditFilter narrows ListAuditEvents. Zero-value fields match everything.
+type AuditFilter struct {
+	AgentID   string
+	SessionID string
+	Since     time.Time
+	Limit     int
+}
@@ -0,0 +1,102 @@
+// Package watermark draws a caption, such as the operator's name and the
+// time, onto screen frames, so a recording or a screenshot of a session
+// shows who was connected and when. The caption sits in a bottom corner
+// on a translucent band, scaled with the frame's width: the right for
+// recordings, the left for live frames, so both can be read on a
+// recorded frame the agent watermarked.
+package watermark
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+)
+
+// Caption colours: white text on half-transparent black.
+var (
+	textColor = color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}
+	bandColor = color.RGBA{0, 0, 0, 0x80}
+)
+
+// scale picks the size of a font pixel for an image width bounds.Dx(),
+// about 1 per 640 pixels.
+func scale(bounds image.Rectangle) int {
+	if s := bounds.Dx() / 640; s > 1 {
+		return s
+	}
+	return 1
+}
+
+// Draw writes lines onto img, one per row, in its bottom right corner.
+// Characters outside printable ASCII are drawn as '?'.
+func Draw(img draw.Image, lines ...string) {
+	drawCaption(img, false, lines)
+}
+
+// DrawLeft is Draw in the bottom left corner.
+func DrawLeft(img draw.Image, lines ...string) {
+	drawCaption(img, true, lines)
+}
+
+// drawCaption draws lines in the bottom left or right corner of img.
+func drawCaption(img draw.Image, left bool, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	b := img.Bounds()
+	px := scale(b)
+	cols := 0
+	for _, l := range lines {
+		cols = max(cols, len([]rune(l)))
+	}
+	pad := 2 * px
+	w := cols*cellWidth*px + 2*pad
+	h := len(lines)*cellHeight*px + 2*pad
+	band := image.Rect(b.Max.X-w, b.Max.Y-h, b.Max.X, b.Max.Y).Intersect(b)
+	if left {
+		band = image.Rect(b.Min.X, b.Max.Y-h, b.Min.X+w, b.Max.Y).Intersect(b)
+	}
+	draw.Draw(img, band, image.NewUniform(bandColor), image.Point{}, draw.Over)
+
+	for row, l := range lines {
+		y := band.Min.Y + pad + row*cellHeight*px
+		for col, r := range []rune(l) {
+			x := band.Min.X + pad + col*cellWidth*px
+			drawGlyph(img, glyph(r), x, y, px)
+		}
+	}
+}
+
+// drawGlyph draws one glyph with its top left corner at (x, y), each font
+// pixel px image pixels square.
+func drawGlyph(img draw.Image, g [5]byte, x, y, px int) {
+	for c, bits := range g {
+		for r := 0; r < glyphHeight; r++ {
+			if bits&(1<<r) == 0 {
+				continue
+			}
+			dot := image.Rect(x+c*px, y+r*px, x+(c+1)*px, y+(r+1)*px)
+			draw.Draw(img, dot, image.NewUniform(textColor), image.Point{}, draw.Src)
+		}
+	}
+}
+
+// StampJPEG decodes a JPEG, draws lines on it and encodes it again at
+// quality.
+func StampJPEG(data []byte, quality int, lines ...string) ([]byte, error) {
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+	Draw(img, lines...)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
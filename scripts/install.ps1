@@ -85,6 +85,13 @@ function Install-Binary {
         } catch {
             Write-Error "Download failed: $_"
         }
+
+        # Release signature, checked by signed builds at startup
+        try {
+            Invoke-WebRequest -Uri "$downloadUrl.sig" -OutFile "$tempPath.sig" -UseBasicParsing
+        } catch {
+            Remove-Item "$tempPath.sig" -Force -ErrorAction SilentlyContinue
+        }
         
         $sourcePath = $tempPath
     }
@@ -97,10 +104,14 @@ function Install-Binary {
     # Copy binary
     $destPath = Join-Path $InstallDir "agent.exe"
     Copy-Item -Path $sourcePath -Destination $destPath -Force
+    if (Test-Path "$sourcePath.sig") {
+        Copy-Item -Path "$sourcePath.sig" -Destination "$destPath.sig" -Force
+    }
     
     # Cleanup temp file
     if ($sourcePath -eq "$env:TEMP\agent.exe" -and (Test-Path $sourcePath)) {
         Remove-Item $sourcePath -Force
+        Remove-Item "$sourcePath.sig" -Force -ErrorAction SilentlyContinue
     }
     
     Write-Success "Installed to $destPath"
@@ -170,6 +170,15 @@ download_binary() {
         fi
     fi
     
+    # Release signature, checked by signed builds at startup
+    if [ -z "$LOCAL_BIN" ]; then
+        if command -v curl &> /dev/null; then
+            curl -fsSL "${DOWNLOAD_URL}.sig" -o "${TEMP_BIN}.sig" 2>/dev/null || rm -f "${TEMP_BIN}.sig"
+        else
+            wget -q "${DOWNLOAD_URL}.sig" -O "${TEMP_BIN}.sig" 2>/dev/null || rm -f "${TEMP_BIN}.sig"
+        fi
+    fi
+    
     chmod +x "$TEMP_BIN"
     success "Downloaded successfully"
 }
@@ -185,11 +194,14 @@ install_binary() {
     # Copy binary
     sudo cp "$TEMP_BIN" "${INSTALL_DIR}/agent"
     sudo chmod +x "${INSTALL_DIR}/agent"
+    if [ -f "${TEMP_BIN}.sig" ]; then
+        sudo cp "${TEMP_BIN}.sig" "${INSTALL_DIR}/agent.sig"
+    fi
 
     
     # Cleanup temp file
     if [ "$TEMP_BIN" != "$LOCAL_BIN" ] && [ -f "$TEMP_BIN" ]; then
-        rm -f "$TEMP_BIN"
+        rm -f "$TEMP_BIN" "${TEMP_BIN}.sig"
     fi
     
     success "Installed to ${INSTALL_DIR}/agent"
@@ -0,0 +1,12 @@
+// Package web embeds the browser dashboard so the server binary can
+// serve it without any files on disk, and the desktop viewer its viewer
+// page.
+package web
+
+import "embed"
+
+// Assets holds index.html, status.html, embed.html and the css/ and js/
+// trees.
+//
+//go:embed index.html status.html embed.html css js
+var Assets embed.FS
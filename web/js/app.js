@@ -14,8 +14,9 @@ import { toast }                       from './components/toast.js';
 import { Icons }                       from './components/icons.js';
 import { escapeHtml, formatOS, formatIP,
          formatRelativeTime, formatBytes,
-         formatUptime, formatDisplays }  from './core/utils.js';
-import { get, post, del, setAuthToken, getAuthToken } from './core/http.js';
+         formatUptime, formatDisplays,
+         formatProcesses, formatClock }  from './core/utils.js';
+import { get, post, put, del, setCsrfToken, getCsrfToken } from './core/http.js';
 
 /* Selectors */
 
@@ -27,6 +28,12 @@ const SEL = Object.freeze({
     canvas:           '#screen',
     displayWrap:      '#display-selector',
     displaySelect:    '#display-select',
+    resolutionSelect: '#resolution-select',
+    inputModeWrap:    '#input-mode-selector',
+    inputModeSelect:  '#input-mode-select',
+    printFile:        '#print-file',
+    printButton:      '[data-action="print"]',
+    transferStatus:   '#transfer-status',
     loginOverlay:     '#login-overlay',
     loginForm:        '#login-form',
     loginError:       '#login-error',
@@ -35,6 +42,10 @@ const SEL = Object.freeze({
     enrollmentTokens: '#enrollment-tokens',
     enrollCodeDisplay:'#enrollment-code-display',
     enrollCodeValue:  '#enrollment-code-value',
+    enrollCodeQR:     '#enrollment-code-qr',
+    enrollCodeFP:     '#enrollment-code-fingerprint',
+    brandTitles:      '.login-title, .header-title',
+    brandLogos:       '.login-logo, .header-logo',
 });
 
 /* State */
@@ -44,10 +55,8 @@ let   viewer = null;
 
 /* ─── Authentication ─── */
 
-const AUTH_KEY = 'rmm_api_key';
-
 function isAuthenticated() {
-    return !!getAuthToken();
+    return !!getCsrfToken();
 }
 
 function showLogin() {
@@ -69,16 +78,10 @@ async function handleLogin(event) {
     if (!key) return;
 
     try {
-        // Verify key with server (unauthenticated endpoint).
-        const resp = await fetch('/api/auth/verify', {
-            method: 'POST',
-            headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify({ key }),
-        });
-        if (!resp.ok) throw new Error('Invalid API key');
-
-        setAuthToken(key);
-        sessionStorage.setItem(AUTH_KEY, key);
+        // Exchange the key for a session cookie; the key itself is not kept.
+        const session = await post('/api/auth/login', { key });
+        setCsrfToken(session.csrf_token);
+        input.value = '';
         hideLogin();
         if (error) error.hidden = true;
         agents.startPolling();
@@ -91,13 +94,31 @@ async function handleLogin(event) {
     }
 }
 
-function handleLogout() {
-    setAuthToken(null);
-    sessionStorage.removeItem(AUTH_KEY);
+async function handleLogout() {
+    try {
+        await post('/api/auth/logout');
+    } catch {
+        // Session may already be gone — sign out locally regardless.
+    }
+    setCsrfToken(null);
     agents.stopPolling();
     showLogin();
 }
 
+/**
+ * Resume an existing cookie session (e.g. after a page reload).
+ * @returns {Promise<boolean>}
+ */
+async function restoreSession() {
+    try {
+        const session = await get('/api/auth/session');
+        setCsrfToken(session.csrf_token);
+        return true;
+    } catch {
+        return false;
+    }
+}
+
 /* ─── Enrollment Management ─── */
 
 function toggleEnrollment() {
@@ -129,7 +150,11 @@ function renderTokens(tokens) {
         <tr>
             <td><code>${escapeHtml(t.id)}</code></td>
             <td>${escapeHtml(t.type)}</td>
-            <td>${escapeHtml(t.label || '—')}</td>
+            <td>${escapeHtml(t.label || '—')}${t.bind_hostname || t.bind_mac || t.bind_machine_id
+                ? ` <span class="token-bound" title="Bound to ${escapeHtml([t.bind_hostname, t.bind_mac, t.bind_machine_id].filter(Boolean).join(', '))}">🔒</span>`
+                : ''}${t.hostname_mismatch
+                ? ` <span class="token-flag" title="Expected ${escapeHtml(t.expected_hostname)}">⚠ used by ${escapeHtml(t.used_hostname || 'unknown host')}</span>`
+                : ''}</td>
             <td>${formatRelativeTime(new Date(t.created_at))}</td>
             <td>${t.expires_at ? formatRelativeTime(new Date(t.expires_at)) : '—'}</td>
             <td><button class="btn btn-sm" data-action="delete-token" data-token-id="${t.id}">Delete</button></td>
@@ -149,6 +174,15 @@ async function createToken(type) {
             value.textContent = result.code;
             display.hidden = false;
         }
+        const fp = document.querySelector(SEL.enrollCodeFP);
+        if (fp) fp.textContent = result.platform_fingerprint || '';
+
+        // Scannable QR of the enrollment URL (server keeps the code in memory).
+        const qr = document.querySelector(SEL.enrollCodeQR);
+        if (qr) {
+            qr.src = `/api/enrollment/${encodeURIComponent(result.id)}/qr?format=svg`;
+            qr.hidden = false;
+        }
 
         toast(`${type} token created`, 'success');
         refreshTokens();
@@ -167,6 +201,36 @@ async function deleteToken(id) {
     }
 }
 
+async function rebootAgent(agentId, name) {
+    if (!confirm(`Reboot ${name} now? Unsaved work on the machine will be lost.`)) return;
+    try {
+        await post(`/api/agents/${encodeURIComponent(agentId)}/power`, { action: 'reboot' });
+        toast(`Reboot requested for ${name}`, 'success');
+    } catch (err) {
+        toast('Failed to reboot agent: ' + err.message, 'error');
+    }
+}
+
+async function requestPermissions(agentId, name) {
+    try {
+        await post(`/api/agents/${encodeURIComponent(agentId)}/permissions`, {});
+        toast(`Asked the user on ${name} to grant permissions`, 'success');
+        agents.fetchAgents();
+    } catch (err) {
+        toast('Failed to request permissions: ' + err.message, 'error');
+    }
+}
+
+async function setUnattended(agentId, allowed) {
+    try {
+        await put(`/api/agents/${encodeURIComponent(agentId)}/settings`, { unattended: allowed });
+        toast(allowed ? 'Unattended access allowed' : 'Consent now required', 'success');
+        agents.fetchAgents();
+    } catch (err) {
+        toast('Failed to update agent: ' + err.message, 'error');
+    }
+}
+
 /* Agent card rendering */
 
 function renderAgents(list) {
@@ -195,6 +259,11 @@ function renderAgents(list) {
     }
 }
 
+/** Whether a macOS agent lacks a permission remote control needs. */
+function missingPermissions(perms) {
+    return !!perms && (perms.screen_recording !== 'granted' || perms.accessibility !== 'granted');
+}
+
 function buildAgentCard(agent) {
     const card = document.createElement('div');
     card.className = 'card';
@@ -230,12 +299,20 @@ function buildAgentCard(agent) {
             </div>
             <div class="agent-detail">
                 <span class="agent-detail-label">CPU</span>
-                <span class="agent-detail-value">${agent.cpu_count ?? 0} cores</span>
+                <span class="agent-detail-value">${agent.cpu_count ?? 0} cores, ${agent.cpu_percent ?? 0}% used</span>
             </div>
             <div class="agent-detail">
                 <span class="agent-detail-label">Memory</span>
                 <span class="agent-detail-value">${formatBytes(agent.memory_free)} / ${formatBytes(agent.memory_total)}</span>
             </div>
+            <div class="agent-detail">
+                <span class="agent-detail-label">Top CPU</span>
+                <span class="agent-detail-value">${escapeHtml(formatProcesses(agent.top_cpu, p => `${p.cpu_percent}%`))}</span>
+            </div>
+            <div class="agent-detail">
+                <span class="agent-detail-label">Top memory</span>
+                <span class="agent-detail-value">${escapeHtml(formatProcesses(agent.top_memory, p => formatBytes(p.memory)))}</span>
+            </div>
             <div class="agent-detail">
                 <span class="agent-detail-label">Disk</span>
                 <span class="agent-detail-value">${formatBytes(agent.disk_free)} / ${formatBytes(agent.disk_total)}</span>
@@ -248,10 +325,52 @@ function buildAgentCard(agent) {
                 <span class="agent-detail-label">Uptime</span>
                 <span class="agent-detail-value">${formatUptime(agent.uptime_seconds)}</span>
             </div>
+            <div class="agent-detail">
+                <span class="agent-detail-label">Clock</span>
+                <span class="agent-detail-value">${escapeHtml(formatClock(agent.clock_drift_ms, agent.time_sync))}</span>
+            </div>
+            ${agent.reboot_required ? `
+            <div class="agent-detail">
+                <span class="agent-detail-label">Reboot</span>
+                <span class="agent-detail-value">
+                    <span title="${escapeHtml((agent.reboot_reasons ?? []).join(', '))}">Pending</span>
+                    <button class="btn btn-sm"
+                            data-action="reboot"
+                            data-agent-id="${agent.id}"
+                            data-agent-name="${escapeHtml(agent.name ?? agent.hostname)}">
+                        Reboot now
+                    </button>
+                </span>
+            </div>` : ''}
+            ${missingPermissions(agent.permissions) ? `
+            <div class="agent-detail">
+                <span class="agent-detail-label">Permissions</span>
+                <span class="agent-detail-value">
+                    <span title="Screen Recording: ${escapeHtml(agent.permissions.screen_recording)}, Accessibility: ${escapeHtml(agent.permissions.accessibility)}">Missing</span>
+                    <button class="btn btn-sm"
+                            data-action="request-permissions"
+                            data-agent-id="${agent.id}"
+                            data-agent-name="${escapeHtml(agent.name ?? agent.hostname)}">
+                        Request
+                    </button>
+                </span>
+            </div>` : ''}
             <div class="agent-detail">
                 <span class="agent-detail-label">Seen</span>
                 <span class="agent-detail-value">${lastSeen}</span>
             </div>
+            <div class="agent-detail">
+                <span class="agent-detail-label">Access</span>
+                <span class="agent-detail-value">
+                    ${agent.unattended ? 'Unattended' : 'Requires consent'}
+                    <button class="btn btn-sm"
+                            data-action="toggle-unattended"
+                            data-agent-id="${agent.id}"
+                            data-unattended="${agent.unattended ? 'true' : 'false'}">
+                        ${agent.unattended ? 'Require consent' : 'Allow unattended'}
+                    </button>
+                </span>
+            </div>
         </div>
         <div class="card-footer">
             <button class="btn btn-primary btn-block"
@@ -286,13 +405,42 @@ function setupDisplaySelector(agent) {
         opt.textContent = `Display ${i}`;
         select.appendChild(opt);
     }
+    for (const [mode, label] of [['stitched', 'All (side by side)'], ['separate', 'All (grid)']]) {
+        const opt = document.createElement('option');
+        opt.value = mode;
+        opt.textContent = label;
+        select.appendChild(opt);
+    }
 
     wrap.style.display = 'flex';
     select.onchange = () => {
-        viewer?.switchDisplay(parseInt(select.value, 10));
+        const display = parseInt(select.value, 10);
+        if (Number.isNaN(display)) viewer?.setView(select.value);
+        else viewer?.switchDisplay(display);
     };
 }
 
+/* Resolution */
+
+/** Start each session on scaled frames; the menu asks for full size. */
+function setupResolution() {
+    const select = document.querySelector(SEL.resolutionSelect);
+    if (!select) return;
+    select.value = 'scaled';
+    select.onchange = () => viewer?.setFullResolution(select.value === 'full');
+}
+
+/* Input mode */
+
+/** Start each session typing raw keys; the menu switches to text. */
+function setupInputMode() {
+    const select = document.querySelector(SEL.inputModeSelect);
+    if (!select) return;
+    select.value = 'raw';
+    viewer?.setInputMode('raw');
+    select.onchange = () => viewer?.setInputMode(select.value);
+}
+
 /* Connection lifecycle */
 
 function connectToAgent(agentId) {
@@ -300,6 +448,8 @@ function connectToAgent(agentId) {
 
     const agent = agents.get(agentId);
     if (agent) setupDisplaySelector(agent);
+    setupResolution();
+    setupInputMode();
 
     viewer.connect(agentId).catch(() => {
         toast('Failed to connect to agent', 'error');
@@ -310,6 +460,64 @@ function disconnectViewer() {
     viewer?.disconnect();
 }
 
+/* Session permissions */
+
+/** Hide controls the session's permissions do not allow. */
+function showSessionPermissions(permissions) {
+    const print = document.querySelector(SEL.printButton);
+    if (print) print.hidden = !permissions.includes('files');
+    const inputMode = document.querySelector(SEL.inputModeWrap);
+    if (inputMode) inputMode.hidden = !permissions.includes('input');
+    if (!permissions.includes('input')) toast('View only: this session cannot control the computer', 'info');
+}
+
+/* Remote printing */
+
+function choosePrintFile() {
+    const input = document.querySelector(SEL.printFile);
+    if (!input || !viewer?.connected) return;
+    input.value = '';
+    input.onchange = () => {
+        const file = input.files[0];
+        if (!file) return;
+        viewer.print(file)
+            .then((id) => { if (id) toast(`Sending ${file.name} to the printer…`, 'info'); })
+            .catch((err) => toast('Print failed: ' + err.message, 'error'));
+    };
+    input.click();
+}
+
+function showTransferProgress(progress) {
+    const el = document.querySelector(SEL.transferStatus);
+    if (!el || !progress) return;
+    if (progress.error) {
+        el.hidden = true;
+        toast('Upload failed: ' + progress.error, 'error');
+        return;
+    }
+    if (progress.done) {
+        el.hidden = true;
+        return;
+    }
+    const pct = progress.size > 0 ? Math.floor(100 * progress.received / progress.size) : 0;
+    el.textContent = `Uploading ${pct}% (${formatBytes(progress.received)} of ${formatBytes(progress.size)})`;
+    el.hidden = false;
+}
+
+function showPrintStatus(status) {
+    switch (status?.status) {
+        case 'submitted':
+            toast('Print job submitted' + (status.job ? ` (${status.job})` : ''), 'success');
+            break;
+        case 'completed':
+            toast('Print job completed', 'success');
+            break;
+        case 'failed':
+            toast('Print failed: ' + (status.error ?? 'unknown error'), 'error');
+            break;
+    }
+}
+
 /* Event delegation */
 
 function handleGlobalClick(event) {
@@ -323,6 +531,9 @@ function handleGlobalClick(event) {
         case 'disconnect':
             disconnectViewer();
             break;
+        case 'print':
+            choosePrintFile();
+            break;
         case 'toggle-enrollment':
             toggleEnrollment();
             break;
@@ -332,19 +543,65 @@ function handleGlobalClick(event) {
         case 'delete-token':
             deleteToken(btn.dataset.tokenId);
             break;
+        case 'toggle-unattended':
+            setUnattended(btn.dataset.agentId, btn.dataset.unattended !== 'true');
+            break;
+        case 'reboot':
+            rebootAgent(btn.dataset.agentId, btn.dataset.agentName);
+            break;
+        case 'request-permissions':
+            requestPermissions(btn.dataset.agentId, btn.dataset.agentName);
+            break;
         case 'logout':
             handleLogout();
             break;
     }
 }
 
+/* Branding */
+
+/**
+ * Apply the white-label branding the server has for this host name, if
+ * any: product name, logo and colours. Failures keep the default look.
+ */
+async function applyBranding() {
+    let brand;
+    try {
+        brand = await get('/api/branding');
+    } catch {
+        return;
+    }
+    if (brand?.product_name) {
+        document.title = brand.product_name;
+        document.querySelectorAll(SEL.brandTitles).forEach((el) => { el.textContent = brand.product_name; });
+    }
+    const root = document.documentElement.style;
+    if (brand?.primary_color) root.setProperty('--brand-dark', brand.primary_color);
+    if (brand?.accent_color) {
+        const [r, g, b] = [1, 3, 5].map((i) => parseInt(brand.accent_color.slice(i, i + 2), 16));
+        root.setProperty('--brand-accent', brand.accent_color);
+        root.setProperty('--brand-accent-dark', brand.accent_color);
+        root.setProperty('--accent-hover', brand.accent_color);
+        root.setProperty('--accent-bg', `rgba(${r}, ${g}, ${b}, 0.15)`);
+    }
+    if (brand?.logo) {
+        document.querySelectorAll(SEL.brandLogos).forEach((el) => {
+            const img = document.createElement('img');
+            img.src = brand.logo;
+            img.alt = brand.product_name ?? '';
+            el.replaceChildren(img);
+            el.classList.add('branded');
+        });
+    }
+}
+
 /* Bootstrap */
 
-function init() {
-    // Check for stored session.
-    const savedKey = sessionStorage.getItem(AUTH_KEY);
-    if (savedKey) {
-        setAuthToken(savedKey);
+async function init() {
+    applyBranding();
+
+    // Check for an existing session cookie.
+    if (await restoreSession()) {
         hideLogin();
     } else {
         showLogin();
@@ -359,11 +616,41 @@ function init() {
     if (canvas) {
         viewer = new ScreenViewer(canvas);
         viewer.on('connected',    () => showModal(SEL.viewerModal));
-        viewer.on('disconnected', () => hideModal(SEL.viewerModal));
+        viewer.on('disconnected', () => {
+            hideModal(SEL.viewerModal);
+            const status = document.querySelector(SEL.transferStatus);
+            if (status) status.hidden = true;
+        });
         viewer.on('display_switched', (payload) => {
             const select = document.querySelector(SEL.displaySelect);
             if (select && payload?.display) select.value = payload.display;
         });
+        viewer.on('displays_changed', (payload) => {
+            // Rebuild the menu for the new displays, keeping the current
+            // choice if it still exists (the agent falls back to display 1).
+            const select = document.querySelector(SEL.displaySelect);
+            const current = select?.value;
+            setupDisplaySelector(payload ?? {});
+            if (select && [...select.options].some((o) => o.value === current)) select.value = current;
+            toast(`Displays changed: ${payload?.display_count ?? 1} connected`, 'info');
+        });
+        viewer.on('view_changed', (payload) => {
+            const select = document.querySelector(SEL.displaySelect);
+            if (select && payload?.mode && payload.mode !== 'single') select.value = payload.mode;
+        });
+        viewer.on('resolution_changed', (payload) => {
+            const select = document.querySelector(SEL.resolutionSelect);
+            if (select) select.value = payload?.full ? 'full' : 'scaled';
+            if (!payload?.max_size) toast('This agent sends full-resolution frames already', 'info');
+        });
+        viewer.on('consent_pending', () => toast('Waiting for the user to approve access…', 'info'));
+        viewer.on('consent_denied',  (payload) => toast('Access denied: ' + (payload?.reason ?? 'declined'), 'warning'));
+        viewer.on('approval_pending', () => toast('Waiting for a second admin to approve the session…', 'info'));
+        viewer.on('approval_denied',  (payload) => toast('Session not approved: ' + (payload?.reason ?? 'denied'), 'warning'));
+        viewer.on('session_ended',   (payload) => toast('Session ' + (payload?.reason ?? 'ended'), 'warning'));
+        viewer.on('file_progress',   showTransferProgress);
+        viewer.on('print_status',    showPrintStatus);
+        viewer.on('permissions',     showSessionPermissions);
     }
 
     // Agent polling (only when authenticated).
@@ -1,20 +1,21 @@
 /**
- * HTTP client — Thin fetch wrapper with JSON handling and auth.
+ * HTTP client — Thin fetch wrapper with JSON handling and CSRF protection.
+ * Authentication rides on the HttpOnly session cookie set at login.
  * @module core/http
  */
 
 /** @type {string|null} */
-let _authToken = null;
+let _csrfToken = null;
 
-/** Set the API key for all subsequent requests. */
-export function setAuthToken(token) { _authToken = token; }
+/** Set the session CSRF token sent with every mutating request. */
+export function setCsrfToken(token) { _csrfToken = token; }
 
-/** Get the current auth token. */
-export function getAuthToken() { return _authToken; }
+/** Get the current CSRF token (null when signed out). */
+export function getCsrfToken() { return _csrfToken; }
 
 /**
  * Perform an HTTP request with automatic JSON serialisation/parsing.
- * Injects Authorization header when an auth token is set.
+ * Injects the X-CSRF-Token header on non-GET requests when signed in.
  * @param {string} url
  * @param {RequestInit} [options]
  * @returns {Promise<*>}
@@ -26,9 +27,9 @@ export async function request(url, options = {}) {
         headers: { ...options.headers },
     };
 
-    // Inject auth header.
-    if (_authToken) {
-        config.headers['Authorization'] = `Bearer ${_authToken}`;
+    // Inject CSRF header (session cookie is sent by the browser).
+    if (_csrfToken && config.method !== 'GET' && config.method !== 'HEAD') {
+        config.headers['X-CSRF-Token'] = _csrfToken;
     }
 
     // Only set Content-Type for methods with a body (avoids unnecessary CORS preflight)
@@ -79,6 +79,24 @@ export function formatBytes(bytes) {
     return `${(bytes / Math.pow(1024, i)).toFixed(1)} ${units[i]}`;
 }
 
+/**
+ * Format an agent's clock drift and time service state.
+ * @param {number|undefined} driftMs - agent clock minus server clock
+ * @param {Object|undefined} timeSync - {service, enabled, synchronized, source}
+ * @returns {string}
+ */
+export function formatClock(driftMs, timeSync) {
+    if (driftMs === undefined || driftMs === null) return 'Unknown';
+    const secs = Math.abs(driftMs) / 1000;
+    let text = secs < 1 ? 'Within 1 s' : `${secs.toFixed(0)} s ${driftMs > 0 ? 'ahead' : 'behind'}`;
+    if (timeSync) {
+        const state = !timeSync.enabled ? 'disabled'
+            : timeSync.synchronized ? 'synchronized' : 'not synchronized';
+        text += ` (${timeSync.service || 'time sync'} ${state}${timeSync.source ? `, ${timeSync.source}` : ''})`;
+    }
+    return text;
+}
+
 /**
  * Format seconds to a human-readable uptime string.
  * @param {number} seconds
@@ -104,6 +122,18 @@ export function formatDisplays(displays) {
     return displays.map(d => `${d.width}×${d.height}`).join(', ');
 }
 
+/**
+ * Format a heartbeat process list (top_cpu / top_memory) as
+ * "name value, …", using the given formatter for each value.
+ * @param {Array} procs
+ * @param {function(object): string} value
+ * @returns {string}
+ */
+export function formatProcesses(procs, value) {
+    if (!procs?.length) return '—';
+    return procs.map(p => `${p.name} ${value(p)}`).join(', ');
+}
+
 /**
  * Generate a short unique identifier.
  * @returns {string}
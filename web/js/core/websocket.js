@@ -85,13 +85,15 @@ export class WebSocketClient extends EventEmitter {
     }
 
     /**
-     * Send data over the socket. Objects are JSON-serialised automatically.
-     * @param {string|Object} data
+     * Send data over the socket. Strings and binary data are sent as-is;
+     * other objects are JSON-serialised automatically.
+     * @param {string|ArrayBuffer|ArrayBufferView|Object} data
      * @returns {boolean} — true if sent, false if not connected.
      */
     send(data) {
         if (!this.connected) return false;
-        this.#ws.send(typeof data === 'string' ? data : JSON.stringify(data));
+        const raw = typeof data === 'string' || data instanceof ArrayBuffer || ArrayBuffer.isView(data);
+        this.#ws.send(raw ? data : JSON.stringify(data));
         return true;
     }
 
@@ -0,0 +1,40 @@
+/**
+ * Embedded viewer — the remote viewer on its own page, for external
+ * portals that frame /embed?agent=…&ticket=… with a session ticket from
+ * POST /api/sessions/ticket. The ticket is single use: it is taken off the
+ * address bar before connecting, and a reload needs a new one.
+ * @module embed
+ */
+
+import { ScreenViewer } from './modules/viewer.js';
+
+const params = new URLSearchParams(location.search);
+const agentId = params.get('agent') || '';
+const ticket = params.get('ticket') || '';
+const desktop = params.has('desktop');
+history.replaceState(null, '', location.pathname);
+
+const status = document.getElementById('embed-status');
+const setStatus = (text) => { status.textContent = text; };
+
+const viewer = new ScreenViewer('#embed-canvas');
+let ended = false;
+
+viewer.on('connected',       () => setStatus(''));
+viewer.on('consent_pending', () => setStatus('Waiting for the user to approve access…'));
+viewer.on('consent_denied',  (payload) => { ended = true; setStatus('Access denied: ' + (payload?.reason ?? 'declined')); });
+viewer.on('approval_pending', () => setStatus('Waiting for a second admin to approve the session…'));
+viewer.on('approval_denied',  (payload) => { ended = true; setStatus('Session not approved: ' + (payload?.reason ?? 'denied')); });
+viewer.on('session_ended',   (payload) => { ended = true; setStatus('Session ' + (payload?.reason ?? 'ended')); });
+viewer.on('disconnected',    () => { if (!ended) setStatus('Disconnected'); });
+
+// In the desktop client's window, hold the keyboard so system shortcuts
+// (Alt+Tab, the Windows key, Escape) go to the remote computer. Browsers
+// honour the lock only while the window is fullscreen.
+if (desktop) navigator.keyboard?.lock?.().catch(() => {});
+
+if (!agentId || !ticket) {
+    setStatus('Missing session ticket');
+} else {
+    viewer.connect(agentId, ticket).catch(() => setStatus('Could not connect'));
+}
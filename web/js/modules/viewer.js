@@ -5,6 +5,7 @@
 
 import { EventEmitter }    from '../core/events.js';
 import { WebSocketClient } from '../core/websocket.js';
+import { post }            from '../core/http.js';
 
 export class ScreenViewer extends EventEmitter {
     #canvas;
@@ -14,8 +15,14 @@ export class ScreenViewer extends EventEmitter {
     #active       = false;
     #handlers     = {};
     #options;
-    #pendingFrame = null;
+    #frameQueue   = [];
+    #stamp        = null;
     #rendering    = false;
+    #view         = 'single';
+    #tiles        = new Map();
+    #permissions  = null;
+    #inputMode    = 'raw';
+    #textInput    = null;
 
     /**
      * @param {string|HTMLCanvasElement} canvas — Selector or element.
@@ -35,37 +42,62 @@ export class ScreenViewer extends EventEmitter {
     /** The ID of the currently connected agent (or null). */
     get agentId() { return this.#agentId; }
 
+    /**
+     * Whether the session may do something: 'view', 'input', 'files' or
+     * 'terminal'. Everything is allowed until the server says otherwise.
+     * @param {string} permission
+     */
+    can(permission) { return this.#permissions?.includes(permission) ?? true; }
+
     /**
      * Open a viewer session to the given agent.
+     * A single-use ticket is fetched first so no credential appears in the URL,
+     * unless one was issued already (the embedded viewer's session ticket).
      * @param {string} agentId
+     * @param {string} [ticket] — Pre-issued single-use ticket.
      * @returns {Promise<WebSocketClient>}
      */
-    connect(agentId) {
+    async connect(agentId, ticket) {
         if (this.#active) this.disconnect();
 
         this.#agentId = agentId;
+        this.#permissions = null;
+        ticket ??= (await post('/api/viewer/ticket', { agent: agentId })).ticket;
         const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
-        const token = sessionStorage.getItem('rmm_api_key') || '';
-        const url = `${protocol}//${location.host}/ws/viewer?agent=${agentId}&token=${encodeURIComponent(token)}`;
+        const url = `${protocol}//${location.host}/ws/viewer?agent=${encodeURIComponent(agentId)}&ticket=${encodeURIComponent(ticket)}`;
 
         this.#ws = new WebSocketClient(url, { reconnect: false });
 
         this.#ws.on('open', () => {
             this.#active = true;
             this.#attachInput();
+            this.#sendSessionSetup();
             this.emit('connected', agentId);
         });
 
         this.#ws.on('close', () => {
             this.#active = false;
-            this.#pendingFrame = null;
+            this.#frameQueue = [];
             this.#rendering = false;
+            this.#resetView();
             this.#detachInput();
             this.emit('disconnected', agentId);
         });
 
+        this.#ws.on('session_permissions', (msg) => this.#setPermissions(msg.payload?.permissions ?? []));
         this.#ws.on('binary',            (buf) => this.#handleBinary(buf));
+        this.#ws.on('frame_stamp',        (msg) => { this.#stamp = msg.payload?.seq ?? null; });
         this.#ws.on('display_switched',   (msg) => this.emit('display_switched', msg.payload));
+        this.#ws.on('view_changed',       (msg) => this.emit('view_changed', msg.payload));
+        this.#ws.on('resolution_changed', (msg) => this.emit('resolution_changed', msg.payload));
+        this.#ws.on('displays_changed',   (msg) => this.emit('displays_changed', msg.payload));
+        this.#ws.on('consent_pending',    ()    => this.emit('consent_pending', agentId));
+        this.#ws.on('consent_denied',     (msg) => this.emit('consent_denied', msg.payload));
+        this.#ws.on('approval_pending',   ()    => this.emit('approval_pending', agentId));
+        this.#ws.on('approval_denied',    (msg) => this.emit('approval_denied', msg.payload));
+        this.#ws.on('session_ended',      (msg) => this.emit('session_ended', msg.payload));
+        this.#ws.on('print_status',       (msg) => this.emit('print_status', msg.payload));
+        this.#ws.on('file_progress',      (msg) => this.emit('file_progress', msg.payload));
         this.#ws.on('error',              (err) => this.emit('error', err));
 
         return this.#ws.connect();
@@ -81,22 +113,279 @@ export class ScreenViewer extends EventEmitter {
     }
 
     /**
-     * Request the agent switch to a different display.
+     * Choose how typing reaches the agent, for this session: 'raw' sends
+     * every key press as a key, as the viewer's keyboard produced it;
+     * 'text' sends what the viewer's keyboard composes — dead keys, IME
+     * input for Chinese, Japanese or Korean — as committed text, typed on
+     * the agent whatever its layout. Shortcuts and named keys (Enter, the
+     * arrows, F-keys…) are sent as keys in both.
+     * @param {'raw'|'text'} mode
+     */
+    setInputMode(mode) {
+        this.#inputMode = mode === 'text' ? 'text' : 'raw';
+        if (this.#handlers.mousemove) {
+            this.#detachInput();
+            this.#attachInput();
+        }
+    }
+
+    /**
+     * Request the agent switch to a different display, leaving any
+     * all-displays view (see setView).
      * @param {number} displayNumber — 1-based display index.
      * @returns {boolean}
      */
     switchDisplay(displayNumber) {
         if (!this.#active) return false;
+        this.#resetView();
         return this.#ws.send({
             type: 'switch_display',
             payload: { display: displayNumber },
         });
     }
 
+    /**
+     * Choose how displays are shown: 'single' streams the display chosen
+     * with switchDisplay(); 'stitched' shows all displays side by side in
+     * one image, and 'separate' as a grid of per-display frames, both at
+     * reduced quality and frame rate. Mouse input is only sent in 'single'
+     * mode, where the canvas maps onto one display.
+     * @param {'single'|'stitched'|'separate'} mode
+     * @returns {boolean}
+     */
+    setView(mode) {
+        if (!this.#active) return false;
+        this.#resetView();
+        this.#view = mode;
+        return this.#ws.send({ type: 'set_view', payload: { mode } });
+    }
+
+    /**
+     * Choose between frames scaled down to the agent's maximum size (the
+     * default, much lighter for high-DPI displays) and the display's full
+     * resolution, for reading fine print. Applies to the single-display
+     * view for the rest of the session; the agent confirms with a
+     * 'resolution_changed' event.
+     * @param {boolean} full
+     * @returns {boolean}
+     */
+    setFullResolution(full) {
+        if (!this.#active) return false;
+        return this.#ws.send({ type: 'set_resolution', payload: { full: !!full } });
+    }
+
+    /** Return to the single-display view, dropping any per-display tiles. */
+    #resetView() {
+        this.#view = 'single';
+        for (const bitmap of this.#tiles.values()) bitmap.close();
+        this.#tiles.clear();
+    }
+
+    /**
+     * Upload a PDF and print it on the agent's default printer. Transfer
+     * progress is reported through 'file_progress' events and the job
+     * through 'print_status' events, both carrying the returned ID.
+     * @param {File|Blob} file
+     * @returns {Promise<string|null>} — upload ID, or null if not connected.
+     */
+    async print(file) {
+        return this.#upload(file, 'print');
+    }
+
+    /**
+     * Send a file over the session's file channel. The content is deflated
+     * when that makes it smaller, each chunk carries a CRC-32 and the end
+     * message the SHA-256 of the original, so the agent can reject a
+     * corrupted upload. The server refuses files over its transfer policy
+     * with a 'file_progress' error.
+     * @param {File|Blob} file
+     * @param {string} purpose
+     * @returns {Promise<string|null>}
+     */
+    async #upload(file, purpose) {
+        if (!this.#active) return null;
+
+        const id   = crypto.randomUUID();
+        const data = new Uint8Array(await file.arrayBuffer());
+        const [packed, sha256] = await Promise.all([
+            ScreenViewer.#deflate(data),
+            ScreenViewer.#sha256(data),
+        ]);
+        const compressed = packed !== null && packed.length < data.length;
+        const body = compressed ? packed : data;
+
+        this.#ws.send({
+            type: 'file_start',
+            payload: {
+                id, purpose,
+                name: file.name ?? 'upload',
+                size: data.length,
+                compression: compressed ? 'deflate' : undefined,
+            },
+        });
+        for (let off = 0; off < body.length; off += ScreenViewer.#CHUNK_SIZE) {
+            const chunk = body.subarray(off, off + ScreenViewer.#CHUNK_SIZE);
+            const frame = new Uint8Array(chunk.length + 5);
+            frame[0] = ScreenViewer.#BIN_FILE;
+            new DataView(frame.buffer).setUint32(1, ScreenViewer.#crc32(chunk));
+            frame.set(chunk, 5);
+            if (!this.#ws.send(frame)) return null;
+        }
+        this.#ws.send({ type: 'file_end', payload: { id, sha256 } });
+        return id;
+    }
+
+    /**
+     * Raw-deflate data with CompressionStream, or null where unsupported.
+     * @param {Uint8Array} data
+     * @returns {Promise<Uint8Array|null>}
+     */
+    static async #deflate(data) {
+        if (typeof CompressionStream === 'undefined') return null;
+        try {
+            const stream = new Blob([data]).stream().pipeThrough(new CompressionStream('deflate-raw'));
+            return new Uint8Array(await new Response(stream).arrayBuffer());
+        } catch {
+            return null;
+        }
+    }
+
+    /**
+     * Hex SHA-256 of data. Outside a secure context, where crypto.subtle
+     * is unavailable, it is computed in script.
+     * @param {Uint8Array} data
+     * @returns {Promise<string>}
+     */
+    static async #sha256(data) {
+        const digest = crypto.subtle
+            ? new Uint8Array(await crypto.subtle.digest('SHA-256', data))
+            : ScreenViewer.#sha256Script(data);
+        return Array.from(digest, (b) => b.toString(16).padStart(2, '0')).join('');
+    }
+
+    /** SHA-256 round constants, built on first use. */
+    static #sha256K = null;
+
+    /**
+     * SHA-256 (FIPS 180-4) of data in script.
+     * @param {Uint8Array} data
+     * @returns {Uint8Array}
+     */
+    static #sha256Script(data) {
+        if (!ScreenViewer.#sha256K) {
+            // First 32 bits of the fractional parts of the cube roots of
+            // the first 64 primes.
+            const k = [];
+            for (let n = 2; k.length < 64; n++) {
+                let prime = true;
+                for (let d = 2; d * d <= n; d++) if (n % d === 0) { prime = false; break; }
+                if (prime) k.push((Math.cbrt(n) % 1) * 0x100000000 >>> 0);
+            }
+            ScreenViewer.#sha256K = Uint32Array.from(k);
+        }
+        const K = ScreenViewer.#sha256K;
+
+        // Pad: 0x80, zeros, then the bit length as a 64-bit big-endian.
+        const padded = new Uint8Array(((data.length + 9 + 63) >> 6) << 6);
+        padded.set(data);
+        padded[data.length] = 0x80;
+        const view = new DataView(padded.buffer);
+        view.setUint32(padded.length - 8, Math.floor(data.length / 0x20000000));
+        view.setUint32(padded.length - 4, (data.length << 3) >>> 0);
+
+        const H = Uint32Array.of(0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+                                 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19);
+        const W = new Uint32Array(64);
+        const rotr = (x, n) => (x >>> n) | (x << (32 - n));
+        for (let off = 0; off < padded.length; off += 64) {
+            for (let i = 0; i < 16; i++) W[i] = view.getUint32(off + i * 4);
+            for (let i = 16; i < 64; i++) {
+                const s0 = rotr(W[i - 15], 7) ^ rotr(W[i - 15], 18) ^ (W[i - 15] >>> 3);
+                const s1 = rotr(W[i - 2], 17) ^ rotr(W[i - 2], 19) ^ (W[i - 2] >>> 10);
+                W[i] = W[i - 16] + s0 + W[i - 7] + s1;
+            }
+            let [a, b, c, d, e, f, g, h] = H;
+            for (let i = 0; i < 64; i++) {
+                const t1 = h + (rotr(e, 6) ^ rotr(e, 11) ^ rotr(e, 25)) + ((e & f) ^ (~e & g)) + K[i] + W[i];
+                const t2 = (rotr(a, 2) ^ rotr(a, 13) ^ rotr(a, 22)) + ((a & b) ^ (a & c) ^ (b & c));
+                h = g; g = f; f = e; e = (d + t1) >>> 0;
+                d = c; c = b; b = a; a = (t1 + t2) >>> 0;
+            }
+            H[0] += a; H[1] += b; H[2] += c; H[3] += d;
+            H[4] += e; H[5] += f; H[6] += g; H[7] += h;
+        }
+        const out = new Uint8Array(32);
+        const outView = new DataView(out.buffer);
+        H.forEach((word, i) => outView.setUint32(i * 4, word));
+        return out;
+    }
+
+    /** CRC-32 (IEEE) lookup table, built on first use. */
+    static #crcTable = null;
+
+    /**
+     * CRC-32 (IEEE) of data, matching Go's crc32.ChecksumIEEE.
+     * @param {Uint8Array} data
+     * @returns {number}
+     */
+    static #crc32(data) {
+        if (!ScreenViewer.#crcTable) {
+            ScreenViewer.#crcTable = new Uint32Array(256);
+            for (let n = 0; n < 256; n++) {
+                let c = n;
+                for (let k = 0; k < 8; k++) c = c & 1 ? 0xEDB88320 ^ (c >>> 1) : c >>> 1;
+                ScreenViewer.#crcTable[n] = c >>> 0;
+            }
+        }
+        let crc = 0xFFFFFFFF;
+        for (let i = 0; i < data.length; i++) {
+            crc = ScreenViewer.#crcTable[(crc ^ data[i]) & 0xFF] ^ (crc >>> 8);
+        }
+        return (crc ^ 0xFFFFFFFF) >>> 0;
+    }
+
+    /* Session setup */
+
+    /**
+     * Tell the agent which keyboard layout and locale the viewer uses so it
+     * can choose between injecting physical keys and characters.
+     */
+    async #sendSessionSetup() {
+        const layout = await ScreenViewer.#detectLayout();
+        this.#ws?.send({
+            type: 'session_setup',
+            payload: { locale: navigator.language, layout, tiles: true },
+        });
+    }
+
+    /**
+     * Guess the keyboard layout from the Keyboard Map API where supported
+     * (Chromium). Returns '' when the layout cannot be determined.
+     * @returns {Promise<string>}
+     */
+    static async #detectLayout() {
+        if (!navigator.keyboard?.getLayoutMap) return '';
+        try {
+            const map = await navigator.keyboard.getLayoutMap();
+            if (map.get('KeyQ') === 'a') return 'fr';
+            if (map.get('KeyY') === 'z') return 'de';
+            if (map.get('Semicolon') === 'ñ') return 'es';
+            if (map.get('Backslash') === '#') return 'gb';
+            if (map.get('KeyQ') === 'q' && map.get('KeyY') === 'y') return 'us';
+        } catch { /* permission denied or not focused */ }
+        return '';
+    }
+
     /* Binary frame handling */
 
     /** Binary message type prefixes (must match protocol.Bin* constants). */
-    static #BIN_SCREEN = 0x01;
+    static #BIN_SCREEN  = 0x01;
+    static #BIN_FILE    = 0x02;
+    static #BIN_DISPLAY = 0x05;
+    static #BIN_TILES   = 0x07;
+
+    /** Compressed bytes per BinFile chunk, before the 5-byte header. */
+    static #CHUNK_SIZE = 64 * 1024;
 
     /**
      * Route an incoming binary WebSocket frame by its type prefix.
@@ -105,22 +394,82 @@ export class ScreenViewer extends EventEmitter {
     #handleBinary(buffer) {
         const view = new Uint8Array(buffer);
         if (view[0] === ScreenViewer.#BIN_SCREEN) {
-            // Skip the 1-byte type prefix; queue the raw JPEG for rendering
-            this.#pendingFrame = buffer.slice(1);
+            // Skip the 1-byte type prefix. A whole frame replaces anything
+            // still waiting to be drawn.
+            this.#frameQueue = [{ jpeg: buffer.slice(1), ...this.#takeStamp() }];
+            if (!this.#rendering) this.#drainFrameQueue();
+        } else if (view[0] === ScreenViewer.#BIN_TILES) {
+            // Tiles update the frame drawn before them, so none is skipped.
+            this.#frameQueue.push({ tiles: buffer, ...this.#takeStamp() });
             if (!this.#rendering) this.#drainFrameQueue();
+        } else if (view[0] === ScreenViewer.#BIN_DISPLAY && this.#view === 'separate') {
+            // [type][1-based display index][JPEG]
+            this.#drawTile(view[1], buffer.slice(2));
         }
     }
 
     /**
-     * Render the most recent frame, skipping any that arrived while decoding.
+     * Decode one display's frame and redraw the grid of displays: as many
+     * columns as needed for a square-ish grid, each cell the size of the
+     * largest display, labelled with its number.
+     * @param {number} display
+     * @param {ArrayBuffer} jpeg
+     */
+    async #drawTile(display, jpeg) {
+        const bitmap = await createImageBitmap(new Blob([jpeg], { type: 'image/jpeg' }));
+        if (this.#view !== 'separate') {
+            bitmap.close();
+            return;
+        }
+        this.#tiles.get(display)?.close();
+        this.#tiles.set(display, bitmap);
+
+        const order = [...this.#tiles.keys()].sort((a, b) => a - b);
+        const cols  = Math.ceil(Math.sqrt(order.length));
+        const rows  = Math.ceil(order.length / cols);
+        let cellW = 0, cellH = 0;
+        for (const tile of this.#tiles.values()) {
+            cellW = Math.max(cellW, tile.width);
+            cellH = Math.max(cellH, tile.height);
+        }
+
+        const w = cols * cellW;
+        const h = rows * cellH;
+        if (this.#canvas.width !== w || this.#canvas.height !== h) {
+            this.#canvas.width  = w;
+            this.#canvas.height = h;
+        }
+        this.#ctx.fillStyle = '#000';
+        this.#ctx.fillRect(0, 0, w, h);
+        this.#ctx.font = '24px sans-serif';
+        order.forEach((n, i) => {
+            const x = (i % cols) * cellW;
+            const y = Math.floor(i / cols) * cellH;
+            this.#ctx.drawImage(this.#tiles.get(n), x, y);
+            this.#ctx.fillStyle = 'rgba(0, 0, 0, 0.6)';
+            this.#ctx.fillRect(x, y, 48, 36);
+            this.#ctx.fillStyle = '#fff';
+            this.#ctx.fillText(String(n), x + 16, y + 26);
+        });
+
+        this.emit('frame', { width: w, height: h });
+    }
+
+    /**
+     * Render queued frames in order: the most recent whole frame, skipping
+     * any that arrived while decoding, and the tile updates after it.
      * Uses createImageBitmap for off-main-thread JPEG decode.
      */
     async #drainFrameQueue() {
         this.#rendering = true;
 
-        while (this.#pendingFrame) {
-            const jpeg = this.#pendingFrame;
-            this.#pendingFrame = null;
+        while (this.#frameQueue.length) {
+            const { jpeg, tiles, seq, arrived } = this.#frameQueue.shift();
+            if (tiles) {
+                await this.#drawTiles(tiles);
+                this.#frameDisplayed(seq, arrived);
+                continue;
+            }
 
             const blob   = new Blob([jpeg], { type: 'image/jpeg' });
             const bitmap = await createImageBitmap(blob);
@@ -134,6 +483,7 @@ export class ScreenViewer extends EventEmitter {
 
             this.#ctx.drawImage(bitmap, 0, 0);
             bitmap.close();
+            this.#frameDisplayed(seq, arrived);
 
             this.emit('frame', { width: w, height: h });
         }
@@ -141,10 +491,70 @@ export class ScreenViewer extends EventEmitter {
         this.#rendering = false;
     }
 
+    /**
+     * Claim the stamp the agent sent ahead of the frame just received.
+     * @returns {{seq?: number, arrived?: number}}
+     */
+    #takeStamp() {
+        const seq = this.#stamp;
+        this.#stamp = null;
+        return seq === null ? {} : { seq, arrived: performance.now() };
+    }
+
+    /**
+     * Tell the server a stamped frame is on screen, for its glass-to-glass
+     * latency measurement.
+     * @param {number|undefined} seq
+     * @param {number|undefined} arrived
+     */
+    #frameDisplayed(seq, arrived) {
+        if (seq === undefined || !this.#active) return;
+        const draw_ms = Math.round((performance.now() - arrived) * 10) / 10;
+        this.#ws.send({ type: 'frame_displayed', payload: { seq, draw_ms } });
+    }
+
+    /**
+     * Draw a tile frame: [type][width u16][height u16] then, per tile,
+     * [x u16][y u16][format u8][length u32][image], big endian; format 0
+     * is JPEG and 1 PNG (lossless, for text). The tiles update the whole
+     * frame drawn before them, so they are dropped if the canvas no longer
+     * has its size.
+     * @param {ArrayBuffer} buffer
+     */
+    async #drawTiles(buffer) {
+        const data = new DataView(buffer);
+        const w = data.getUint16(1);
+        const h = data.getUint16(3);
+        const parts = [];
+        for (let off = 5; off + 9 <= buffer.byteLength;) {
+            const x = data.getUint16(off);
+            const y = data.getUint16(off + 2);
+            const type = data.getUint8(off + 4) === 1 ? 'image/png' : 'image/jpeg';
+            const len = data.getUint32(off + 5);
+            off += 9;
+            parts.push({ x, y, blob: new Blob([buffer.slice(off, off + len)], { type }) });
+            off += len;
+        }
+        const bitmaps = await Promise.all(parts.map((p) => createImageBitmap(p.blob)));
+        const fits = this.#canvas.width === w && this.#canvas.height === h;
+        parts.forEach((p, i) => {
+            if (fits) this.#ctx.drawImage(bitmaps[i], p.x, p.y);
+            bitmaps[i].close();
+        });
+        if (fits) this.emit('frame', { width: w, height: h });
+    }
+
+    /** Apply the session's permission mask, dropping input if it excludes it. */
+    #setPermissions(permissions) {
+        this.#permissions = permissions;
+        if (!this.can('input')) this.#detachInput();
+        this.emit('permissions', permissions);
+    }
+
     /* Input handling */
 
     #attachInput() {
-        if (!this.#options.enableInput) return;
+        if (!this.#options.enableInput || !this.can('input')) return;
 
         // Throttle mousemove to ≤60fps to avoid flooding the WebSocket
         let moveQueued = false;
@@ -159,11 +569,13 @@ export class ScreenViewer extends EventEmitter {
 
         this.#handlers = {
             mousemove: throttledMove,
-            mousedown: (e) => this.#sendMouse('down', e),
+            mousedown: (e) => { this.#sendMouse('down', e); this.#textInput?.focus(); },
             mouseup:   (e) => this.#sendMouse('up', e),
-            keydown:   (e) => { e.preventDefault(); this.#sendKey('down', e); },
-            keyup:     (e) => { e.preventDefault(); this.#sendKey('up', e); },
+            keydown:   (e) => { if (this.#composes(e)) return; e.preventDefault(); this.#sendKey('down', e); },
+            keyup:     (e) => { if (this.#composes(e)) return; e.preventDefault(); this.#sendKey('up', e); },
         };
+        if (this.#inputMode === 'text') this.#attachTextInput();
+        this.#attachTouch();
 
         this.#canvas.addEventListener('mousemove', this.#handlers.mousemove);
         this.#canvas.addEventListener('mousedown', this.#handlers.mousedown);
@@ -179,37 +591,204 @@ export class ScreenViewer extends EventEmitter {
         this.#canvas.removeEventListener('mouseup',   this.#handlers.mouseup);
         document.removeEventListener('keydown',       this.#handlers.keydown);
         document.removeEventListener('keyup',         this.#handlers.keyup);
+        for (const type of ['touchstart', 'touchmove', 'touchend', 'touchcancel']) {
+            this.#canvas.removeEventListener(type, this.#handlers.touch);
+        }
         this.#handlers = {};
+        this.#textInput?.remove();
+        this.#textInput = null;
     }
 
-    #sendMouse(action, event) {
-        if (!this.#active) return;
+    /**
+     * In text mode, keys that produce text go to a hidden text box instead,
+     * where the browser composes them; what it commits is sent as text.
+     */
+    #attachTextInput() {
+        const box = document.createElement('textarea');
+        box.className = 'viewer-text-input';
+        box.setAttribute('aria-label', 'Remote text input');
+        box.autocomplete = 'off';
+        box.spellcheck = false;
+        box.setAttribute('autocapitalize', 'off');
+
+        box.addEventListener('compositionend', (e) => {
+            this.#sendText(e.data);
+            box.value = '';
+        });
+        box.addEventListener('input', (e) => {
+            if (e.isComposing) return;
+            if (e.inputType === 'insertText') this.#sendText(e.data);
+            box.value = '';
+        });
+
+        this.#canvas.parentElement.appendChild(box);
+        this.#textInput = box;
+        box.focus();
+    }
+
+    /**
+     * Whether a key event is left to the text box: in text mode, keys that
+     * type a character, dead keys and keys an IME is composing with. Keys
+     * with Ctrl, Alt or Meta are shortcuts, except AltGr's characters.
+     */
+    #composes(event) {
+        if (this.#inputMode !== 'text') return false;
+        if (event.isComposing || event.keyCode === 229) return true;
+        if (event.key === 'Dead' || event.key === 'Process') return true;
+        if ([...event.key].length !== 1) return false;
+        const altGraph = event.getModifierState?.('AltGraph');
+        return altGraph || !(event.ctrlKey || event.altKey || event.metaKey);
+    }
+
+    /**
+     * Touch gestures for tablets: a tap clicks, a long press right-clicks,
+     * a one-finger drag drags the mouse, two fingers scroll, and a pinch
+     * zooms (Ctrl+wheel on the agent). Scrolling and pinching are sent in
+     * whole wheel notches as they add up.
+     */
+    #attachTouch() {
+        const LONG_PRESS_MS = 500;
+        const DRAG_SLOP     = 10;    // CSS pixels a finger may wander and still tap
+        const SCROLL_NOTCH  = 40;    // CSS pixels of two-finger travel per notch
+        const ZOOM_STEP     = 1.25;  // pinch ratio per zoom notch
+
+        let one = null;   // { x, y, timer, dragging, pressed }
+        let two = null;   // { x, y, distance }
+
+        const point = (t) => ({ clientX: t.clientX, clientY: t.clientY, button: 0 });
+        const pair = (touches) => {
+            const [a, b] = touches;
+            return {
+                x: (a.clientX + b.clientX) / 2,
+                y: (a.clientY + b.clientY) / 2,
+                distance: Math.hypot(a.clientX - b.clientX, a.clientY - b.clientY),
+            };
+        };
+        const cancelOne = () => {
+            if (one?.timer) clearTimeout(one.timer);
+            one = null;
+        };
+
+        this.#handlers.touch = (e) => {
+            e.preventDefault();
+            const touches = e.touches;
+
+            if (e.type === 'touchstart') {
+                cancelOne();
+                if (touches.length === 1) {
+                    const t = touches[0];
+                    one = { x: t.clientX, y: t.clientY, dragging: false, pressed: false };
+                    one.timer = setTimeout(() => {
+                        one.pressed = true;
+                        one.timer = null;
+                        this.#sendTouch('long_press', point(t));
+                    }, LONG_PRESS_MS);
+                } else if (touches.length === 2) {
+                    two = pair(touches);
+                }
+                return;
+            }
+
+            if (e.type === 'touchmove') {
+                if (one && touches.length === 1) {
+                    const t = touches[0];
+                    if (!one.dragging && !one.pressed &&
+                        Math.hypot(t.clientX - one.x, t.clientY - one.y) > DRAG_SLOP) {
+                        clearTimeout(one.timer);
+                        one.timer = null;
+                        one.dragging = true;
+                        this.#sendMouse('down', { clientX: one.x, clientY: one.y, button: 0 });
+                    }
+                    if (one.dragging) this.#sendMouse('move', point(t));
+                } else if (two && touches.length === 2) {
+                    const now = pair(touches);
+                    const dx = Math.trunc((two.x - now.x) / SCROLL_NOTCH);
+                    const dy = Math.trunc((two.y - now.y) / SCROLL_NOTCH);
+                    if (dx || dy) {
+                        this.#sendTouch('scroll', { clientX: now.x, clientY: now.y }, { dx, dy });
+                        two.x -= dx * SCROLL_NOTCH;
+                        two.y -= dy * SCROLL_NOTCH;
+                    }
+                    const scale = now.distance / two.distance;
+                    if (scale >= ZOOM_STEP || scale <= 1 / ZOOM_STEP) {
+                        this.#sendTouch('pinch', { clientX: now.x, clientY: now.y }, { scale });
+                        two.distance = now.distance;
+                    }
+                }
+                return;
+            }
+
+            // touchend, touchcancel
+            if (one && touches.length === 0) {
+                const t = e.changedTouches[0];
+                if (one.dragging) this.#sendMouse('up', point(t));
+                else if (!one.pressed && e.type === 'touchend') this.#sendTouch('tap', point(t));
+                this.#textInput?.focus();
+            }
+            cancelOne();
+            if (touches.length < 2) two = null;
+        };
+
+        for (const type of ['touchstart', 'touchmove', 'touchend', 'touchcancel']) {
+            this.#canvas.addEventListener(type, this.#handlers.touch, { passive: false });
+        }
+    }
+
+    /** Map a client position onto the remote display. */
+    #remotePoint(event) {
         const rect   = this.#canvas.getBoundingClientRect();
         const scaleX = this.#canvas.width  / rect.width;
         const scaleY = this.#canvas.height / rect.height;
+        return {
+            x: Math.round((event.clientX - rect.left) * scaleX),
+            y: Math.round((event.clientY - rect.top)  * scaleY),
+        };
+    }
 
+    #sendMouse(action, event) {
+        if (!this.#active || this.#view !== 'single') return;
         this.#ws.send({
             type: 'input',
             payload: {
                 kind:   'mouse',
                 action,
                 button: event.button,
-                x: Math.round((event.clientX - rect.left) * scaleX),
-                y: Math.round((event.clientY - rect.top)  * scaleY),
+                ...this.#remotePoint(event),
             },
         });
     }
 
+    #sendTouch(gesture, event, extra = {}) {
+        if (!this.#active || this.#view !== 'single') return;
+        this.#ws.send({
+            type: 'input',
+            payload: { kind: 'touch', gesture, ...this.#remotePoint(event), ...extra },
+        });
+    }
+
     #sendKey(action, event) {
         if (!this.#active) return;
         this.#ws.send({
             type: 'input',
             payload: {
-                kind:   'key',
+                kind:     'key',
                 action,
-                key:    event.key,
-                code:   event.keyCode,
+                key:      event.key,
+                code:     event.keyCode,
+                physical: event.code,
+                ctrl:     event.ctrlKey,
+                alt:      event.altKey,
+                shift:    event.shiftKey,
+                meta:     event.metaKey,
             },
         });
     }
+
+    #sendText(text) {
+        if (!this.#active || !text) return;
+        this.#ws.send({
+            type: 'input',
+            payload: { kind: 'text', text },
+        });
+    }
 }
@@ -0,0 +1,69 @@
+/**
+ * Status page — renders an organization's agent availability per site
+ * from /api/status/{org}. The share token, when required, is read from
+ * the URL fragment (#token=…) so it never reaches server logs as a path.
+ * @module status
+ */
+
+const REFRESH_MS = 60_000;
+
+const orgId = location.pathname.split('/').filter(Boolean).pop() || '';
+const token = new URLSearchParams(location.hash.slice(1)).get('token') || '';
+
+const $ = (id) => document.getElementById(id);
+
+/** CSS modifier for an availability percentage. */
+function availabilityClass(pct, total) {
+    if (total === 0 || pct >= 99.95) return 'is-good';
+    return pct > 0 ? 'is-partial' : 'is-down';
+}
+
+/** Build one site row. */
+function siteCard(site) {
+    const card = document.createElement('article');
+    card.className = 'site-card';
+
+    const info = document.createElement('div');
+    const name = document.createElement('div');
+    name.className = 'site-name';
+    name.textContent = site.site || 'Other machines';
+    const detail = document.createElement('div');
+    detail.className = 'site-detail';
+    detail.textContent = `${site.online} of ${site.agents} online`;
+    info.append(name, detail);
+
+    const pct = document.createElement('div');
+    pct.className = `site-availability ${availabilityClass(site.availability, site.agents)}`;
+    pct.textContent = `${site.availability}%`;
+
+    card.append(info, pct);
+    return card;
+}
+
+async function refresh() {
+    const url = `/api/status/${encodeURIComponent(orgId)}` +
+        (token ? `?token=${encodeURIComponent(token)}` : '');
+    try {
+        const res = await fetch(url, { cache: 'no-store' });
+        if (!res.ok) {
+            $('status-summary').textContent = 'This status page is not available.';
+            $('status-sites').replaceChildren();
+            return;
+        }
+        const st = await res.json();
+        document.title = `${st.org} — Status`;
+        $('status-org').textContent = st.org;
+        $('status-summary').textContent = st.agents === 0
+            ? 'No machines are being monitored.'
+            : `${st.online} of ${st.agents} machines online (${st.availability}%)`;
+        $('status-sites').replaceChildren(...st.sites.map(siteCard));
+        const updated = new Date(st.updated_at);
+        $('status-updated').dateTime = st.updated_at;
+        $('status-updated').textContent = updated.toLocaleString();
+    } catch {
+        $('status-summary').textContent = 'Unable to reach the server; retrying.';
+    }
+}
+
+refresh();
+setInterval(refresh, REFRESH_MS);